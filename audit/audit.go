@@ -0,0 +1,271 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EventAuthentication   = "authentication"
+	EventAccessDenied     = "access_denied"
+	EventChannelRequest   = "channel_request"
+	EventExec             = "exec"
+	EventSubsystem        = "subsystem"
+	EventChannelPlugin    = "channel_plugin"
+	EventForward          = "forward"
+	EventFileTransfer     = "file_transfer"
+	EventMalformedMessage = "malformed_message"
+	EventPanic            = "panic"
+	EventBreakGlass       = "break_glass"
+	EventPreauth          = "preauth"
+	EventLiveTail         = "live_tail"
+	EventAdmin            = "admin"
+)
+
+type Event struct {
+	Type           string            `json:"type"`
+	Username       string            `json:"username,omitempty"`
+	ConversationID string            `json:"conversation_id,omitempty"`
+	ChannelID      uint64            `json:"channel_id,omitempty"`
+	RemoteAddr     string            `json:"remote_addr,omitempty"`
+	Details        map[string]string `json:"details,omitempty"`
+}
+
+// the maximum length of the details recorded, e.g. the commands of the users that can be as
+// long as the channel requests
+const MaxDetailLength = 4096
+
+// Truncated returns the event with its details truncated to MaxDetailLength, the length and
+// the SHA-256 of the truncated ones being recorded along, e.g. command_length and command_sha256
+func (e Event) Truncated() Event {
+	var details map[string]string
+	for key, value := range e.Details {
+		if len(value) <= MaxDetailLength {
+			continue
+		}
+		if details == nil {
+			details = make(map[string]string, len(e.Details)+2)
+			for key, value := range e.Details {
+				details[key] = value
+			}
+		}
+		// the value is not cut in the middle of a character
+		cut := MaxDetailLength
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut -= 1
+		}
+		hash := sha256.Sum256([]byte(value))
+		details[key] = value[:cut]
+		details[key+"_length"] = strconv.Itoa(len(value))
+		details[key+"_sha256"] = hex.EncodeToString(hash[:])
+	}
+	if details != nil {
+		e.Details = details
+	}
+	return e
+}
+
+// Record is written as a single JSON line. Hash is the hex-encoded SHA-256 of the
+// record encoded without its hash, and PrevHash is the hash of the previous record:
+// modifying, removing or reordering records breaks the chain.
+type Record struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Event
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+type CorruptedLog struct {
+	Line   uint64
+	Reason string
+}
+
+func (e CorruptedLog) Error() string {
+	return fmt.Sprintf("corrupted audit log at line %d: %s", e.Line, e.Reason)
+}
+
+// Logger appends hash-chained records to an append-only writer
+type Logger struct {
+	lock     sync.Mutex
+	w        io.Writer
+	nextSeq  uint64
+	lastHash string
+}
+
+// NewLogger starts a new chain of records on w. Each record is written using a single
+// call to w.Write.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// OpenFile appends records to the specified file, continuing the chain of the
+// records it already contains. It fails if the existing records do not verify, the last line
+// torn by a crash while it was written being removed.
+func OpenFile(filename string) (*Logger, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := verify(file)
+	if err == nil && verified.torn {
+		log.Warn().Msgf("removing the last line of the audit log %s, torn by a crash while it was written", filename)
+		err = file.Truncate(verified.length)
+	} else if err == nil && verified.unterminated {
+		// the record was written but not its newline
+		_, err = file.Write([]byte("\n"))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	logger := NewLogger(file)
+	if verified.last != nil {
+		logger.nextSeq = verified.last.Seq + 1
+		logger.lastHash = verified.last.Hash
+	}
+	return logger, nil
+}
+
+func (l *Logger) Log(event Event) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	record := Record{
+		Seq:      l.nextSeq,
+		Time:     time.Now().UTC(),
+		Event:    event.Truncated(),
+		PrevHash: l.lastHash,
+	}
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = l.w.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	l.nextSeq += 1
+	l.lastHash = hash
+	return nil
+}
+
+// the records of a log that verify
+type verifiedLog struct {
+	// nil if there is no record
+	last *Record
+	// the length of the lines of the records
+	length int64
+	// set if the log ends with a line without newline that is not a record, torn by a crash
+	// while it was written
+	torn bool
+	// set if the last record lacks its newline
+	unterminated bool
+}
+
+func verify(r io.Reader) (verifiedLog, error) {
+	var verified verifiedLog
+	// the records written before their details were truncated can be arbitrarily long
+	reader := bufio.NewReader(r)
+	line := uint64(0)
+	for {
+		content, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF && len(content) == 0 {
+			break
+		} else if readErr != nil && readErr != io.EOF {
+			return verifiedLog{}, readErr
+		}
+		line += 1
+		record := &Record{}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(record); err != nil {
+			if readErr == io.EOF {
+				verified.torn = true
+				return verified, nil
+			}
+			return verifiedLog{}, CorruptedLog{Line: line, Reason: err.Error()}
+		}
+		expectedSeq, expectedPrevHash := uint64(0), ""
+		if verified.last != nil {
+			expectedSeq, expectedPrevHash = verified.last.Seq+1, verified.last.Hash
+		}
+		if record.Seq != expectedSeq {
+			return verifiedLog{}, CorruptedLog{Line: line, Reason: fmt.Sprintf("expected sequence number %d, got %d", expectedSeq, record.Seq)}
+		}
+		if record.PrevHash != expectedPrevHash {
+			return verifiedLog{}, CorruptedLog{Line: line, Reason: "the previous hash does not match the previous record"}
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return verifiedLog{}, CorruptedLog{Line: line, Reason: err.Error()}
+		}
+		if record.Hash != hash {
+			return verifiedLog{}, CorruptedLog{Line: line, Reason: "the record does not match its hash"}
+		}
+		verified.last = record
+		verified.length += int64(len(content))
+		if readErr == io.EOF {
+			verified.unterminated = true
+			break
+		}
+	}
+	return verified, nil
+}
+
+// Verify checks the chain of records read from r and returns the number of records. A last
+// line torn by a crash while it was written is ignored, as OpenFile removes it.
+func Verify(r io.Reader) (uint64, error) {
+	verified, err := verify(r)
+	if err != nil || verified.last == nil {
+		return 0, err
+	}
+	return verified.last.Seq + 1, nil
+}
+
+// EventLogger records events, e.g. a Logger or a logger forwarding them to another process
+type EventLogger interface {
+	Log(event Event) error
+}
+
+var defaultLogger EventLogger
+
+// SetDefaultLogger sets the logger used by Log. It must be called before logging any event.
+func SetDefaultLogger(logger EventLogger) {
+	defaultLogger = logger
+}
+
+// Log records event using the default logger, if any
+func Log(event Event) {
+	if defaultLogger == nil {
+		return
+	}
+	if err := defaultLogger.Log(event); err != nil {
+		log.Error().Msgf("could not write %s audit record: %s", event.Type, err)
+	}
+}
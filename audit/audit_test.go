@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit log", func() {
+	var buf *bytes.Buffer
+	var logger *Logger
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		logger = NewLogger(buf)
+		Expect(logger.Log(Event{Type: EventAuthentication, Username: "alice", Details: map[string]string{"result": "success"}})).To(Succeed())
+		Expect(logger.Log(Event{Type: EventExec, Username: "alice", ChannelID: 4, Details: map[string]string{"command": "ls -la"}})).To(Succeed())
+		Expect(logger.Log(Event{Type: EventForward, Username: "alice", Details: map[string]string{"target": "192.0.2.1:22"}})).To(Succeed())
+	})
+
+	lines := func() []string {
+		return strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	It("Verifies an untouched log", func() {
+		n, err := Verify(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(3))
+	})
+
+	It("Detects modified records", func() {
+		tampered := strings.Replace(buf.String(), "ls -la", "ls -lh", 1)
+		_, err := Verify(strings.NewReader(tampered))
+		Expect(err).To(Equal(CorruptedLog{Line: 2, Reason: "the record does not match its hash"}))
+	})
+
+	It("Detects removed records", func() {
+		l := lines()
+		_, err := Verify(strings.NewReader(l[0] + l[2]))
+		Expect(err).To(BeAssignableToTypeOf(CorruptedLog{}))
+		Expect(err.(CorruptedLog).Line).To(BeEquivalentTo(2))
+	})
+
+	It("Detects reordered records", func() {
+		l := lines()
+		_, err := Verify(strings.NewReader(l[0] + l[2] + "\n" + l[1]))
+		Expect(err).To(BeAssignableToTypeOf(CorruptedLog{}))
+	})
+
+	It("Continues the chain of an existing file", func() {
+		filename := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		Expect(os.WriteFile(filename, buf.Bytes(), 0600)).To(Succeed())
+		fileLogger, err := OpenFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileLogger.Log(Event{Type: EventSubsystem, Username: "alice", Details: map[string]string{"subsystem": "sftp"}})).To(Succeed())
+
+		file, err := os.Open(filename)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		n, err := Verify(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(4))
+	})
+
+	It("Truncates the long details", func() {
+		argv := strings.Repeat("é", 4096)
+		Expect(logger.Log(Event{Type: EventExec, Username: "alice", Details: map[string]string{"command": argv, "argv": "true"}})).To(Succeed())
+		n, err := Verify(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(4))
+		l := lines()
+		Expect(len(l[3])).To(BeNumerically("<", 2*MaxDetailLength))
+		Expect(l[3]).To(ContainSubstring(`"command_length":"8192"`))
+		Expect(l[3]).To(ContainSubstring(`"command_sha256":"`))
+		Expect(l[3]).To(ContainSubstring(`"argv":"true"`))
+		Expect(l[3]).ToNot(ContainSubstring(`\ufffd`))
+	})
+
+	It("Verifies the records longer than the previous line limit", func() {
+		// written before the details were truncated
+		record := Record{Event: Event{Type: EventExec, Details: map[string]string{"command": strings.Repeat("a", 2<<20)}}}
+		var err error
+		record.Hash, err = record.computeHash()
+		Expect(err).ToNot(HaveOccurred())
+		encoded, err := json.Marshal(record)
+		Expect(err).ToNot(HaveOccurred())
+		n, err := Verify(bytes.NewReader(append(encoded, '\n')))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(1))
+	})
+
+	It("Removes the record torn by a crash", func() {
+		filename := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		torn := buf.Bytes()[:buf.Len()-20]
+		Expect(os.WriteFile(filename, torn, 0600)).To(Succeed())
+		n, err := Verify(bytes.NewReader(torn))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(2))
+
+		fileLogger, err := OpenFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileLogger.Log(Event{Type: EventSubsystem, Username: "alice", Details: map[string]string{"subsystem": "sftp"}})).To(Succeed())
+		content, err := os.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		n, err = Verify(bytes.NewReader(content))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(3))
+		Expect(string(content)).To(HavePrefix(lines()[0] + lines()[1]))
+	})
+
+	It("Terminates the last record written without its newline", func() {
+		filename := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		Expect(os.WriteFile(filename, bytes.TrimSuffix(buf.Bytes(), []byte("\n")), 0600)).To(Succeed())
+		fileLogger, err := OpenFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileLogger.Log(Event{Type: EventSubsystem, Username: "alice", Details: map[string]string{"subsystem": "sftp"}})).To(Succeed())
+		file, err := os.Open(filename)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		n, err := Verify(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(4))
+	})
+
+	It("Refuses to append to a corrupted file", func() {
+		filename := filepath.Join(GinkgoT().TempDir(), "audit.log")
+		l := lines()
+		Expect(os.WriteFile(filename, []byte(l[1]), 0600)).To(Succeed())
+		_, err := OpenFile(filename)
+		Expect(err).To(BeAssignableToTypeOf(CorruptedLog{}))
+	})
+})
@@ -0,0 +1,198 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"path"
+	"strings"
+)
+
+// The redactions of the fields of the events
+const (
+	// replaces the field by the hex-encoded HMAC-SHA256 of its value, so that the records of a
+	// same user can still be correlated without revealing who the user is
+	RedactHash = "hash"
+	// removes the field
+	RedactDrop = "drop"
+	// only keeps the first word of the field, e.g. the executable of a command line
+	RedactDropArguments = "drop_arguments"
+)
+
+// the prefix of the hashed fields, telling them apart from the values that were not redacted
+const hashedFieldPrefix = "hmac-sha256:"
+
+// The fields of the events that are not details
+const (
+	FieldUsername   = "username"
+	FieldRemoteAddr = "remote_addr"
+)
+
+// Policy limits what is recorded in the audit log, e.g. to meet privacy requirements without
+// disabling auditing entirely. The first rule matching an event applies, the events not
+// matching any rule are recorded untouched.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+	// the file containing the key of the HMAC hashing the redacted fields. If unset, a random key
+	// is generated when the server starts and the hashes of a same value differ across restarts.
+	HashKeyFile string `json:"hash_key_file,omitempty"`
+}
+
+type PolicyRule struct {
+	// username patterns that may contain the '*' and '?' wildcards, the rule matches all the
+	// users if empty
+	Users []string `json:"users,omitempty"`
+	// the event types matched by the rule (e.g. "exec"), all of them if empty
+	Events []string `json:"events,omitempty"`
+	// the fraction of the matching events that are recorded, between 0 and 1. All of them are
+	// recorded if unset.
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+	// maps the redacted fields onto their redaction ("hash", "drop" or "drop_arguments"). The fields
+	// are "username", "remote_addr" or the keys of the details of the events (e.g. "command").
+	Redact map[string]string `json:"redact,omitempty"`
+}
+
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		for _, pattern := range rule.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid username pattern %q in audit policy rule %d: %w", pattern, i, err)
+			}
+		}
+		if rule.SampleRate != nil && (*rule.SampleRate < 0 || *rule.SampleRate > 1) {
+			return fmt.Errorf("the sample rate of audit policy rule %d is not between 0 and 1: %v", i, *rule.SampleRate)
+		}
+		for field, redaction := range rule.Redact {
+			switch redaction {
+			case RedactHash, RedactDrop, RedactDropArguments:
+			default:
+				return fmt.Errorf("unknown redaction %q of field %q in audit policy rule %d", redaction, field, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) matches(event *Event) bool {
+	if len(r.Events) > 0 && !contains(r.Events, event.Type) {
+		return false
+	}
+	if len(r.Users) == 0 {
+		return true
+	}
+	for _, pattern := range r.Users {
+		if matched, _ := path.Match(pattern, event.Username); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyLogger applies a policy to the events before recording them using another logger
+type PolicyLogger struct {
+	logger  EventLogger
+	policy  *Policy
+	hashKey []byte
+	// returns a number in [0, 1), replaced in the tests
+	random func() float64
+}
+
+// NewPolicyLogger records the events using logger once policy has been applied to them
+func NewPolicyLogger(logger EventLogger, policy *Policy) (*PolicyLogger, error) {
+	var hashKey []byte
+	if policy.HashKeyFile != "" {
+		content, err := os.ReadFile(policy.HashKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		hashKey = []byte(strings.TrimSpace(string(content)))
+		if len(hashKey) == 0 {
+			return nil, fmt.Errorf("the audit hash key file %s is empty", policy.HashKeyFile)
+		}
+	} else {
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			return nil, err
+		}
+	}
+	return &PolicyLogger{logger: logger, policy: policy, hashKey: hashKey, random: mathrand.Float64}, nil
+}
+
+func (l *PolicyLogger) Log(event Event) error {
+	var rule *PolicyRule
+	for i := range l.policy.Rules {
+		if l.policy.Rules[i].matches(&event) {
+			rule = &l.policy.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return l.logger.Log(event)
+	}
+	if rule.SampleRate != nil && l.random() >= *rule.SampleRate {
+		return nil
+	}
+	if len(rule.Redact) > 0 {
+		// the details may be shared with the caller
+		details := make(map[string]string, len(event.Details))
+		for key, value := range event.Details {
+			details[key] = value
+		}
+		for field, redaction := range rule.Redact {
+			switch field {
+			case FieldUsername:
+				event.Username = l.redact(event.Username, redaction)
+			case FieldRemoteAddr:
+				event.RemoteAddr = l.redact(event.RemoteAddr, redaction)
+			default:
+				// the hash of a truncated detail would reveal it
+				delete(details, field+"_sha256")
+				if value, ok := details[field]; ok {
+					if redacted := l.redact(value, redaction); redacted != "" {
+						details[field] = redacted
+					} else {
+						delete(details, field)
+					}
+				}
+			}
+		}
+		event.Details = details
+		if len(details) == 0 {
+			event.Details = nil
+		}
+	}
+	return l.logger.Log(event)
+}
+
+// returns the redacted value, an empty string if it is dropped
+func (l *PolicyLogger) redact(value string, redaction string) string {
+	if value == "" {
+		return ""
+	}
+	switch redaction {
+	case RedactHash:
+		mac := hmac.New(sha256.New, l.hashKey)
+		mac.Write([]byte(value))
+		return hashedFieldPrefix + hex.EncodeToString(mac.Sum(nil))
+	case RedactDropArguments:
+		if fields := strings.Fields(value); len(fields) > 0 {
+			return fields[0]
+		}
+		return ""
+	default:
+		return ""
+	}
+}
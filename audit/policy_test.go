@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) Log(event Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+var _ = Describe("Audit policy", func() {
+	var recorder *eventRecorder
+
+	BeforeEach(func() {
+		recorder = &eventRecorder{}
+	})
+
+	rate := func(rate float64) *float64 {
+		return &rate
+	}
+
+	newPolicyLogger := func(policy *Policy) *PolicyLogger {
+		Expect(policy.Validate()).To(Succeed())
+		logger, err := NewPolicyLogger(recorder, policy)
+		Expect(err).ToNot(HaveOccurred())
+		return logger
+	}
+
+	It("Records the events not matching any rule untouched", func() {
+		logger := newPolicyLogger(&Policy{Rules: []PolicyRule{{Users: []string{"bob"}, Redact: map[string]string{"username": "drop"}}}})
+		event := Event{Type: EventExec, Username: "alice", RemoteAddr: "192.0.2.1:4242", Details: map[string]string{"command": "ls -la"}}
+		Expect(logger.Log(event)).To(Succeed())
+		Expect(recorder.events).To(Equal([]Event{event}))
+	})
+
+	It("Redacts the fields of the matching events", func() {
+		logger := newPolicyLogger(&Policy{Rules: []PolicyRule{{
+			Users:  []string{"a*"},
+			Events: []string{EventExec},
+			Redact: map[string]string{"username": "hash", "remote_addr": "drop", "command": "drop_arguments", "directory": "drop"},
+		}}})
+		details := map[string]string{"command": "mysql -psecret db", "directory": "/home/alice/private"}
+		Expect(logger.Log(Event{Type: EventExec, Username: "alice", RemoteAddr: "192.0.2.1:4242", Details: details})).To(Succeed())
+		Expect(logger.Log(Event{Type: EventExec, Username: "alice", Details: map[string]string{"command": "id"}})).To(Succeed())
+		Expect(logger.Log(Event{Type: EventSubsystem, Username: "alice", Details: map[string]string{"subsystem": "sftp"}})).To(Succeed())
+
+		Expect(recorder.events).To(HaveLen(3))
+		redacted := recorder.events[0]
+		Expect(redacted.Username).To(HavePrefix(hashedFieldPrefix))
+		Expect(redacted.Username).ToNot(ContainSubstring("alice"))
+		Expect(redacted.RemoteAddr).To(BeEmpty())
+		Expect(redacted.Details).To(Equal(map[string]string{"command": "mysql"}))
+		// the records of a same user can still be correlated
+		Expect(recorder.events[1].Username).To(Equal(redacted.Username))
+		// the caller's details are untouched
+		Expect(details["command"]).To(Equal("mysql -psecret db"))
+		// only the exec events match the rule
+		Expect(recorder.events[2].Username).To(Equal("alice"))
+	})
+
+	It("Redacts the hash of the truncated details", func() {
+		logger := newPolicyLogger(&Policy{Rules: []PolicyRule{{Redact: map[string]string{"command": "drop_arguments"}}}})
+		event := Event{Type: EventExec, Username: "alice", Details: map[string]string{"command": "mysql -p" + strings.Repeat("s", MaxDetailLength)}}
+		Expect(logger.Log(event.Truncated())).To(Succeed())
+		Expect(recorder.events[0].Details).To(Equal(map[string]string{"command": "mysql", "command_length": fmt.Sprint(MaxDetailLength + 8)}))
+	})
+
+	It("Applies the first matching rule", func() {
+		logger := newPolicyLogger(&Policy{Rules: []PolicyRule{
+			{Users: []string{"root"}},
+			{Redact: map[string]string{"username": "hash"}},
+		}})
+		Expect(logger.Log(Event{Type: EventAuthentication, Username: "root"})).To(Succeed())
+		Expect(logger.Log(Event{Type: EventAuthentication, Username: "alice"})).To(Succeed())
+		Expect(recorder.events[0].Username).To(Equal("root"))
+		Expect(recorder.events[1].Username).To(HavePrefix(hashedFieldPrefix))
+	})
+
+	It("Samples the matching events", func() {
+		logger := newPolicyLogger(&Policy{Rules: []PolicyRule{{Events: []string{EventForward}, SampleRate: rate(0.25)}}})
+		draws := []float64{0.1, 0.5, 0.9, 0.2}
+		logger.random = func() float64 {
+			draw := draws[0]
+			draws = draws[1:]
+			return draw
+		}
+		for i := 0; i < 4; i++ {
+			Expect(logger.Log(Event{Type: EventForward, Username: "alice", ChannelID: uint64(i)})).To(Succeed())
+		}
+		Expect(recorder.events).To(HaveLen(2))
+		Expect(recorder.events[0].ChannelID).To(BeEquivalentTo(0))
+		Expect(recorder.events[1].ChannelID).To(BeEquivalentTo(3))
+	})
+
+	It("Hashes using the configured key", func() {
+		keyFile := filepath.Join(GinkgoT().TempDir(), "audit_hash_key")
+		Expect(os.WriteFile(keyFile, []byte("a secret key\n"), 0600)).To(Succeed())
+		policy := &Policy{Rules: []PolicyRule{{Redact: map[string]string{"username": "hash"}}}, HashKeyFile: keyFile}
+		Expect(newPolicyLogger(policy).Log(Event{Type: EventAuthentication, Username: "alice"})).To(Succeed())
+		Expect(newPolicyLogger(policy).Log(Event{Type: EventAuthentication, Username: "alice"})).To(Succeed())
+		Expect(recorder.events[0].Username).To(Equal(recorder.events[1].Username))
+
+		policy.HashKeyFile = ""
+		Expect(newPolicyLogger(policy).Log(Event{Type: EventAuthentication, Username: "alice"})).To(Succeed())
+		Expect(recorder.events[2].Username).ToNot(Equal(recorder.events[0].Username))
+	})
+
+	It("Refuses invalid policies", func() {
+		Expect((&Policy{Rules: []PolicyRule{{SampleRate: rate(1.5)}}}).Validate()).ToNot(Succeed())
+		Expect((&Policy{Rules: []PolicyRule{{Users: []string{"["}}}}).Validate()).ToNot(Succeed())
+		Expect((&Policy{Rules: []PolicyRule{{Redact: map[string]string{"command": "encrypt"}}}}).Validate()).To(MatchError(ContainSubstring("encrypt")))
+	})
+})
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package audit
+
+import "log/syslog"
+
+// NewSyslogLogger sends the records to the local syslog daemon with the AUTHPRIV facility.
+// As previous records cannot be read back, a new chain starts every time it is called.
+func NewSyslogLogger(tag string) (*Logger, error) {
+	writer, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogger(writer), nil
+}
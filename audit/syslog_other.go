@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func NewSyslogLogger(tag string) (*Logger, error) {
+	return nil, fmt.Errorf("syslog is not available on %s", runtime.GOOS)
+}
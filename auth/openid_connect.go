@@ -28,8 +28,10 @@ type OIDCConfig struct {
  *  opens a browser window towards the authorization endpoint. A local webserver is temporarily
  *  started at a random port to retrieve the issued authorization token.
  *	This token is then returned as an http url-encoded string.
+ *  If nonce is not empty, the issued token must carry it (e.g. the conversation ID, so that the
+ *  server can check that the token was issued for this conversation).
  */
-func Connect(ctx context.Context, oidcConfig *OIDCConfig, issuerURL string, doPKCE bool) (rawIDTokey string, err error) {
+func Connect(ctx context.Context, oidcConfig *OIDCConfig, issuerURL string, doPKCE bool, nonce string) (rawIDTokey string, err error) {
 	provider, err := oidc.NewProvider(ctx, issuerURL)
 	if err != nil {
 		return "", err
@@ -78,7 +80,7 @@ func Connect(ctx context.Context, oidcConfig *OIDCConfig, issuerURL string, doPK
 
 	tokenChannel := make(chan string)
 	mux := http.NewServeMux()
-	mux.Handle(path, getOAuth2Callback(ctx, provider, oidcConfig.ClientID, &oauthConfig, tokenChannel, verifier, doPKCE))
+	mux.Handle(path, getOAuth2Callback(ctx, provider, oidcConfig.ClientID, &oauthConfig, tokenChannel, verifier, doPKCE, nonce))
 	server := http.Server{Handler: mux}
 	go server.Serve(listener)
 	var cmd string
@@ -97,6 +99,9 @@ func Connect(ctx context.Context, oidcConfig *OIDCConfig, issuerURL string, doPK
 	if doPKCE {
 		options = append(options, oauth2.S256ChallengeOption(verifier))
 	}
+	if nonce != "" {
+		options = append(options, oidc.Nonce(nonce))
+	}
 
 	authCodeURL := oauthConfig.AuthCodeURL("state", options...)
 
@@ -116,7 +121,7 @@ func Connect(ctx context.Context, oidcConfig *OIDCConfig, issuerURL string, doPK
 }
 
 func getOAuth2Callback(ctx context.Context, provider *oidc.Provider, clientID string, oauth2Config *oauth2.Config,
-	tokenChannel chan string, challengeVerifier string, doPKCE bool) http.HandlerFunc {
+	tokenChannel chan string, challengeVerifier string, doPKCE bool, nonce string) http.HandlerFunc {
 
 	verifier := provider.Verifier(&oidc.Config{ClientID: clientID})
 
@@ -147,6 +152,10 @@ func getOAuth2Callback(ctx context.Context, provider *oidc.Provider, clientID st
 			log.Error().Msgf("error when verifying oauth token: %s", err.Error())
 			return
 		}
+		if nonce != "" && idToken.Nonce != nonce {
+			log.Error().Msgf("unexpected oauth token nonce %q", idToken.Nonce)
+			return
+		}
 
 		// Extract custom claims
 		var claims struct {
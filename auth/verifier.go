@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/rs/zerolog/log"
+)
+
+// the duration during which the discovery document and keys of an issuer are used
+// before being fetched again, if not configured
+const DefaultProviderCacheDuration = time.Hour
+
+// TokenVerifier verifies the ID tokens issued by OpenID Connect providers. It caches the
+// discovery document and the keys of the issuers rather than fetching them for every token,
+// and verifies the tokens of the issuers whose keys were provisioned without contacting them.
+type TokenVerifier struct {
+	cacheDuration time.Duration
+
+	mutex     sync.Mutex
+	providers map[string]*cachedProvider
+	// the key sets of the issuers that are never contacted, e.g. on air-gapped servers
+	staticKeys map[string]*oidc.StaticKeySet
+}
+
+type cachedProvider struct {
+	provider  *oidc.Provider
+	fetchedAt time.Time
+}
+
+// NewTokenVerifier returns a verifier fetching the discovery document and keys of the issuers
+// again after cacheDuration, DefaultProviderCacheDuration if it is not positive
+func NewTokenVerifier(cacheDuration time.Duration) *TokenVerifier {
+	if cacheDuration <= 0 {
+		cacheDuration = DefaultProviderCacheDuration
+	}
+	return &TokenVerifier{
+		cacheDuration: cacheDuration,
+		providers:     make(map[string]*cachedProvider),
+		staticKeys:    make(map[string]*oidc.StaticKeySet),
+	}
+}
+
+// SetStaticKeys makes the verifier check the signature of the tokens of the issuer using these
+// keys, without ever fetching its discovery document or keys
+func (v *TokenVerifier) SetStaticKeys(issuerURL string, keys []crypto.PublicKey) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.staticKeys[issuerURL] = &oidc.StaticKeySet{PublicKeys: keys}
+}
+
+// Verify checks the signature, issuer, audience and expiry of the token. If nonce is not
+// empty, the token must carry it.
+func (v *TokenVerifier) Verify(ctx context.Context, clientID string, issuerURL string, rawIDToken string, nonce string) (*oidc.IDToken, error) {
+	config := &oidc.Config{ClientID: clientID}
+	var verifier *oidc.IDTokenVerifier
+	v.mutex.Lock()
+	staticKeys, ok := v.staticKeys[issuerURL]
+	v.mutex.Unlock()
+	if ok {
+		verifier = oidc.NewVerifier(issuerURL, staticKeys, config)
+	} else {
+		provider, err := v.provider(ctx, issuerURL)
+		if err != nil {
+			return nil, err
+		}
+		verifier = provider.Verifier(config)
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, fmt.Errorf("unexpected token nonce %q", idToken.Nonce)
+	}
+	return idToken, nil
+}
+
+// returns the provider of the issuer, discovering it if it is not cached. The last discovered
+// provider is used when it cannot be discovered again, e.g. when the issuer is briefly unreachable.
+func (v *TokenVerifier) provider(ctx context.Context, issuerURL string) (*oidc.Provider, error) {
+	v.mutex.Lock()
+	cached, ok := v.providers[issuerURL]
+	v.mutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < v.cacheDuration {
+		return cached.provider, nil
+	}
+	// the keys of the provider are cached along with it and fetched again when a token is
+	// signed using an unknown key, e.g. after a key rotation
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		if ok {
+			log.Warn().Msgf("cannot refresh the discovery document of %s, using the one fetched at %s: %s", issuerURL, cached.fetchedAt, err)
+			return cached.provider, nil
+		}
+		return nil, err
+	}
+	v.mutex.Lock()
+	v.providers[issuerURL] = &cachedProvider{provider: provider, fetchedAt: time.Now()}
+	v.mutex.Unlock()
+	return provider, nil
+}
@@ -0,0 +1,75 @@
+package ssh3
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter throttles the data of the channels of the conversations it is set on (see
+// Conversation.SetBandwidthLimiter), using a token bucket per direction. The conversations sharing
+// a limiter share its rates, e.g. all the conversations of a user. The datagrams are not throttled.
+type BandwidthLimiter struct {
+	send    *tokenBucket
+	receive *tokenBucket
+}
+
+// NewBandwidthLimiter limits the data sent and the data received to the specified rates in bytes
+// per second, 0 leaving a direction unlimited. A second of data can be sent at once after an idle
+// period, so that the short transfers are not slowed down.
+func NewBandwidthLimiter(sendRate uint64, receiveRate uint64) *BandwidthLimiter {
+	return &BandwidthLimiter{send: newTokenBucket(sendRate), receive: newTokenBucket(receiveRate)}
+}
+
+// ParseBandwidthRate parses a rate in bytes per second such as "10MiB", "512KB/s" or "65536"
+func ParseBandwidthRate(value string) (uint64, error) {
+	return parseByteSize(strings.TrimSuffix(value, "/s"))
+}
+
+// waits until n bytes of data may be sent
+func (l *BandwidthLimiter) waitSend(n int) {
+	time.Sleep(l.send.reserve(n, time.Now()))
+}
+
+// waits until n more bytes of data may be received
+func (l *BandwidthLimiter) waitReceive(n int) {
+	time.Sleep(l.receive.reserve(n, time.Now()))
+}
+
+// a token bucket of one token per byte, nil if the rate is not limited
+type tokenBucket struct {
+	lock sync.Mutex
+	// in bytes per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate)}
+}
+
+// takes n tokens at now and returns how long to wait before using them. The bucket goes into debt
+// rather than refusing the messages larger than its burst, the next reservations waiting longer.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,58 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bandwidth limits", func() {
+	It("Parses the rates", func() {
+		for value, rate := range map[string]uint64{"65536": 65536, "10MiB": 10 << 20, "512KB/s": 512000} {
+			parsed, err := ssh3.ParseBandwidthRate(value)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed).To(Equal(rate), value)
+		}
+		for _, invalid := range []string{"", "0", "-1MiB", "fast", "10Mbit"} {
+			_, err := ssh3.ParseBandwidthRate(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("Lets a second of data through at once and then spreads the data over time", func() {
+		limiter := ssh3.NewBandwidthLimiter(1000, 0)
+		now := time.Now()
+		Expect(ssh3.ReserveSendBandwidth(limiter, 1000, now)).To(BeZero())
+		Expect(ssh3.ReserveSendBandwidth(limiter, 500, now)).To(Equal(500 * time.Millisecond))
+		// the debt is paid back before the bucket fills again
+		Expect(ssh3.ReserveSendBandwidth(limiter, 500, now.Add(time.Second))).To(BeZero())
+		Expect(ssh3.ReserveSendBandwidth(limiter, 2000, now.Add(time.Second))).To(Equal(2 * time.Second))
+		// the bucket does not hold more than a second of data after an idle period
+		later := now.Add(time.Hour)
+		Expect(ssh3.ReserveSendBandwidth(limiter, 1000, later)).To(BeZero())
+		Expect(ssh3.ReserveSendBandwidth(limiter, 100, later)).To(Equal(100 * time.Millisecond))
+	})
+
+	It("Does not limit the directions without a rate", func() {
+		limiter := ssh3.NewBandwidthLimiter(0, 1000)
+		Expect(ssh3.ReserveSendBandwidth(limiter, 1<<30, time.Now())).To(BeZero())
+	})
+
+	It("Throttles the data written on the channels", func() {
+		stream := &bytes.Buffer{}
+		sender := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, nil, nopCloser{stream}, nil, nil, false, true, true, 0, nil)
+		ssh3.SetBandwidthLimiter(sender, ssh3.NewBandwidthLimiter(100000, 0))
+
+		start := time.Now()
+		_, err := sender.WriteData(make([]byte, 200000), ssh3Messages.SSH_EXTENDED_DATA_NONE)
+		Expect(err).ToNot(HaveOccurred())
+		// the first second of data goes through at once
+		Expect(time.Since(start)).To(BeNumerically("~", time.Second, 300*time.Millisecond))
+		Expect(stream.Len()).To(BeNumerically(">", 200000))
+	})
+})
@@ -0,0 +1,56 @@
+package ssh3
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// the content type of the responses whose body carries conversation-level messages, e.g. the
+// banner of the server or the disconnect message ending the conversation
+const ConversationMessagesContentType = "application/ssh3-messages"
+
+// BannerHandler is called with the banners sent by the server, before the authentication or
+// along with its refusal
+type BannerHandler func(banner string)
+
+// SetBannerHandler sets the handler of the banners sent by the server, it must be set before
+// establishing the conversation
+func (c *Conversation) SetBannerHandler(handler BannerHandler) {
+	c.bannerHandler = handler
+}
+
+// handles the conversation-level messages of the body of rsp until its end, or until
+// maxMessages messages if positive, as the body of the refusals may not be terminated
+func (c *Conversation) handleConversationMessages(rsp *http.Response, maxMessages int) {
+	if rsp.Header.Get("Content-Type") != ConversationMessagesContentType {
+		return
+	}
+	reader := bufio.NewReader(rsp.Body)
+	for i := 0; maxMessages <= 0 || i < maxMessages; i++ {
+		message, err := ssh3Messages.ParseMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debug().Msgf("stopped reading the conversation messages of the server: %s", err)
+			}
+			return
+		}
+		switch m := message.(type) {
+		case *ssh3Messages.BannerMessage:
+			if c.bannerHandler != nil {
+				c.bannerHandler(m.MessageUTF8)
+			}
+		case *ssh3Messages.DisconnectMessage:
+			// the last message, the conversation ends with it
+			c.cancelContext(Disconnect{ReasonCode: m.ReasonCode, Description: m.DescriptionUTF8, LanguageTag: m.LanguageTag})
+			return
+		default:
+			log.Warn().Msgf("unexpected %T conversation message from the server", message)
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package ssh3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// the release of the binaries, set by the Makefile using
+// -ldflags "-X github.com/francoismichel/ssh3.releaseVersion=..."
+var releaseVersion string
+
+// FeatureReport describes a binary for the fleet inventory tools, as printed by -V --features
+type FeatureReport struct {
+	Program string `json:"program"`
+	// the version string exchanged with the peers
+	Version  string          `json:"version"`
+	Protocol ProtocolReport  `json:"protocol"`
+	Features map[string]bool `json:"features"`
+	Build    BuildProvenance `json:"build"`
+}
+
+type ProtocolReport struct {
+	SSH string `json:"ssh"`
+	// the versions of the peers predating the version negotiation accepted, the patch version
+	// being ignored
+	Compatible []string `json:"compatible"`
+	// the range of wire format versions negotiated with the other peers, e.g. "1-2"
+	WireVersions string   `json:"wire_versions"`
+	ALPN         []string `json:"alpn"`
+	QUICVersions []string `json:"quic_versions"`
+}
+
+// BuildProvenance is read from the build information embedded by the Go toolchain
+type BuildProvenance struct {
+	Release       string `json:"release,omitempty"`
+	GoVersion     string `json:"go_version"`
+	Module        string `json:"module,omitempty"`
+	ModuleVersion string `json:"module_version,omitempty"`
+	VCSRevision   string `json:"vcs_revision,omitempty"`
+	VCSTime       string `json:"vcs_time,omitempty"`
+	VCSModified   bool   `json:"vcs_modified,omitempty"`
+	// the settings of the build, e.g. CGO_ENABLED, GOOS, GOARCH, -tags and -trimpath
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// NewFeatureReport reports the features of the protocol implemented by this package along with
+// the ones of the program
+func NewFeatureReport(program string, programFeatures map[string]bool) *FeatureReport {
+	features := map[string]bool{
+		"datagrams":      true,
+		"udp_forwarding": true,
+		"tcp_forwarding": true,
+		"openid_connect": true,
+	}
+	for name, enabled := range programFeatures {
+		features[name] = enabled
+	}
+	return &FeatureReport{
+		Program: program,
+		Version: GetCurrentVersion(),
+		Protocol: ProtocolReport{
+			SSH:          "3.0",
+			Compatible:   []string{fmt.Sprintf("%d.%d.x", MAJOR, MINOR)},
+			WireVersions: formatProtocolVersions(ssh3Messages.MinProtocolVersion, ssh3Messages.MaxProtocolVersion),
+			ALPN:         []string{http3.NextProtoH3},
+			QUICVersions: []string{quic.Version1.String(), quic.Version2.String()},
+		},
+		Features: features,
+		Build:    readBuildProvenance(),
+	}
+}
+
+func readBuildProvenance() BuildProvenance {
+	provenance := BuildProvenance{Release: releaseVersion}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return provenance
+	}
+	provenance.GoVersion = info.GoVersion
+	provenance.Module = info.Main.Path
+	if info.Main.Version != "(devel)" {
+		provenance.ModuleVersion = info.Main.Version
+	}
+	provenance.Settings = make(map[string]string)
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			provenance.VCSRevision = setting.Value
+		case "vcs.time":
+			provenance.VCSTime = setting.Value
+		case "vcs.modified":
+			provenance.VCSModified = setting.Value == "true"
+		case "CGO_ENABLED", "GOOS", "GOARCH", "-tags", "-trimpath", "-buildmode", "-compiler":
+			provenance.Settings[setting.Key] = setting.Value
+		}
+	}
+	return provenance
+}
+
+// ReleaseVersion returns the release of the binary if the Makefile set it, the version of the
+// protocol implementation otherwise
+func ReleaseVersion() string {
+	if releaseVersion != "" {
+		return releaseVersion
+	}
+	return fmt.Sprintf("%d.%d.%d", MAJOR, MINOR, PATCH)
+}
+
+// Write writes the report as indented JSON
+func (r *FeatureReport) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
@@ -0,0 +1,33 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Feature report", func() {
+	It("Merges the features of the program with the ones of the protocol", func() {
+		report := ssh3.NewFeatureReport("test", map[string]bool{"pam": false, "datagrams": false})
+		Expect(report.Program).To(Equal("test"))
+		Expect(report.Version).To(Equal(ssh3.GetCurrentVersion()))
+		Expect(report.Features).To(HaveKeyWithValue("pam", false))
+		Expect(report.Features).To(HaveKeyWithValue("datagrams", false))
+		Expect(report.Features).To(HaveKeyWithValue("tcp_forwarding", true))
+		Expect(report.Protocol.Compatible).To(ConsistOf("0.1.x"))
+	})
+
+	It("Is written as JSON", func() {
+		var buf bytes.Buffer
+		Expect(ssh3.NewFeatureReport("test", nil).Write(&buf)).To(Succeed())
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal(buf.Bytes(), &decoded)).To(Succeed())
+		Expect(decoded).To(HaveKey("protocol"))
+		Expect(decoded).To(HaveKey("build"))
+		Expect(decoded["features"]).To(HaveKeyWithValue("udp_forwarding", true))
+	})
+})
@@ -0,0 +1,147 @@
+package ssh3_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/quic-go/quic-go"
+)
+
+// the size of the data transferred at each iteration of the bulk transfer benchmarks
+const bulkTransferSize = 16 << 20
+
+// the default max packet size of the server
+const benchmarkMaxPacketSize = 30000
+
+// returns both ends of a QUIC stream on the loopback interface
+func loopbackStreams(b *testing.B) (send quic.Stream, recv quic.Stream) {
+	pub, priv, err := util.GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	template, err := util.GenerateCert(priv)
+	if err != nil {
+		b.Fatal(err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: priv}}, NextProtos: []string{"ssh3-benchmark"}}
+	clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"ssh3-benchmark"}}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { listener.Close() })
+	ctx := context.Background()
+	clientConn, err := quic.DialAddr(ctx, listener.Addr().(*net.UDPAddr).String(), clientTLS, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { clientConn.CloseWithError(0, "") })
+	send, err = clientConn.OpenStreamSync(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// the stream is only announced to the peer with its first bytes
+	if _, err := send.Write([]byte{0}); err != nil {
+		b.Fatal(err)
+	}
+	serverConn, err := listener.Accept(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	recv, err = serverConn.AcceptStream(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := recv.Read(make([]byte, 1)); err != nil {
+		b.Fatal(err)
+	}
+	return send, recv
+}
+
+// benchmarks the transfer of bulkTransferSize bytes written by chunks of writeSize bytes, e.g. a
+// `cat bigfile`, with write on the sending side and read on the receiving one
+func benchmarkBulkTransfer(b *testing.B, writeSize int, write func(data []byte) error, read func() (int, error)) {
+	data := make([]byte, writeSize)
+	b.SetBytes(bulkTransferSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		errs := make(chan error, 1)
+		go func() {
+			for sent := 0; sent < bulkTransferSize; sent += writeSize {
+				if err := write(data); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+		for received := 0; received < bulkTransferSize; {
+			n, err := read()
+			if err != nil {
+				b.Fatal(err)
+			}
+			received += n
+		}
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBulkTransfer(b *testing.B) {
+	for _, writeSize := range []int{16 << 10, 256 << 10} {
+		b.Run("quic/"+byteSize(writeSize), func(b *testing.B) {
+			send, recv := loopbackStreams(b)
+			buf := make([]byte, 64<<10)
+			benchmarkBulkTransfer(b, writeSize, func(data []byte) error {
+				_, err := send.Write(data)
+				return err
+			}, func() (int, error) {
+				return recv.Read(buf)
+			})
+		})
+
+		b.Run("channel/"+byteSize(writeSize), func(b *testing.B) {
+			send, recv := loopbackStreams(b)
+			sender := ssh3.NewChannel(0, ssh3.ConversationID{}, uint64(send.StreamID()), "session", benchmarkMaxPacketSize, &ssh3.StreamByteReader{Stream: send}, send, nil, nil, false, true, true, 10, nil)
+			receiver := ssh3.NewChannel(0, ssh3.ConversationID{}, uint64(recv.StreamID()), "session", benchmarkMaxPacketSize, &ssh3.StreamByteReader{Stream: recv}, recv, nil, nil, false, true, true, 10, nil)
+			benchmarkBulkTransfer(b, writeSize, func(data []byte) error {
+				_, err := sender.WriteData(data, ssh3Messages.SSH_EXTENDED_DATA_NONE)
+				return err
+			}, func() (int, error) {
+				message, err := receiver.NextMessage()
+				if err != nil {
+					return 0, err
+				}
+				data, ok := message.(*ssh3Messages.DataOrExtendedDataMessage)
+				if !ok {
+					b.Fatalf("unexpected message %T", message)
+				}
+				// what the client does with the output of a command
+				n, err := io.WriteString(io.Discard, data.Data)
+				return n, err
+			})
+		})
+	}
+}
+
+func byteSize(size int) string {
+	if size >= 1<<20 {
+		return fmt.Sprintf("%dMiB", size>>20)
+	}
+	return fmt.Sprintf("%dKiB", size>>10)
+}
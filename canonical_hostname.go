@@ -0,0 +1,181 @@
+package ssh3
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// the values of CanonicalizeHostname
+const (
+	CanonicalizeNo     = "no"
+	CanonicalizeYes    = "yes"
+	CanonicalizeAlways = "always"
+)
+
+// HostnameCanonicalization holds the Canonicalize* and CanonicalDomains options of
+// ~/.ssh/config, with the semantics of OpenSSH: a short name is expanded with the first of the
+// canonical domains under which it resolves, and the configuration is then matched again using the
+// canonical name, which is also the name looked up in the known hosts.
+type HostnameCanonicalization struct {
+	// CanonicalizeNo, CanonicalizeYes or CanonicalizeAlways. The client does not use proxies, so
+	// that CanonicalizeYes and CanonicalizeAlways are equivalent.
+	Mode string
+	// the domains appended to the short names, in order
+	Domains []string
+	// the names with more dots are considered fully qualified and are not canonicalized
+	MaxDots int
+	// if false, the names that do not resolve in any canonical domain are refused instead of
+	// being resolved as is
+	FallbackLocal bool
+	// the CNAMEs that can replace the canonical names
+	PermittedCNAMEs []CNAMERule
+}
+
+// CNAMERule lets a canonical name matching one of the source patterns be replaced by the target of
+// its CNAME record if it matches one of the target patterns, as the CanonicalizePermittedCNAMEs
+// rules of OpenSSH, e.g. "*.a.example.com:*.b.example.com,*.c.example.com"
+type CNAMERule struct {
+	Sources *ssh_config.Host
+	Targets *ssh_config.Host
+}
+
+// HostResolver resolves the names during the canonicalization, e.g. a *net.Resolver
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// GetCanonicalizationForHost returns the canonicalization options of host, OpenSSH defaults if
+// config is nil
+func GetCanonicalizationForHost(host string, config *ssh_config.Config) (HostnameCanonicalization, error) {
+	canonicalization := HostnameCanonicalization{Mode: CanonicalizeNo, MaxDots: 1, FallbackLocal: true}
+	if config == nil {
+		return canonicalization, nil
+	}
+	get := func(key string) string {
+		value, err := config.Get(host, key)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(value)
+	}
+	switch mode := strings.ToLower(get("CanonicalizeHostname")); mode {
+	case "":
+	case CanonicalizeNo, CanonicalizeYes, CanonicalizeAlways:
+		canonicalization.Mode = mode
+	default:
+		return canonicalization, fmt.Errorf("invalid CanonicalizeHostname %q", mode)
+	}
+	if domains := strings.Fields(get("CanonicalDomains")); len(domains) > 0 {
+		canonicalization.Domains = domains
+	}
+	if maxDots := get("CanonicalizeMaxDots"); maxDots != "" {
+		n, err := strconv.Atoi(maxDots)
+		if err != nil || n < 0 {
+			return canonicalization, fmt.Errorf("invalid CanonicalizeMaxDots %q", maxDots)
+		}
+		canonicalization.MaxDots = n
+	}
+	switch fallback := strings.ToLower(get("CanonicalizeFallbackLocal")); fallback {
+	case "", "yes":
+	case "no":
+		canonicalization.FallbackLocal = false
+	default:
+		return canonicalization, fmt.Errorf("invalid CanonicalizeFallbackLocal %q", fallback)
+	}
+	for _, rule := range strings.Fields(get("CanonicalizePermittedCNAMEs")) {
+		parsed, err := ParseCNAMERule(rule)
+		if err != nil {
+			return canonicalization, err
+		}
+		canonicalization.PermittedCNAMEs = append(canonicalization.PermittedCNAMEs, parsed)
+	}
+	return canonicalization, nil
+}
+
+// ParseCNAMERule parses a "source_patterns:target_patterns" rule, each list being
+// comma-separated
+func ParseCNAMERule(rule string) (CNAMERule, error) {
+	sources, targets, ok := strings.Cut(rule, ":")
+	if !ok {
+		return CNAMERule{}, fmt.Errorf("invalid CanonicalizePermittedCNAMEs rule %q, expected source_domains:target_domains", rule)
+	}
+	var parsed CNAMERule
+	var err error
+	if parsed.Sources, err = parseHostPatterns(sources); err != nil {
+		return CNAMERule{}, fmt.Errorf("invalid CanonicalizePermittedCNAMEs rule %q: %w", rule, err)
+	}
+	if parsed.Targets, err = parseHostPatterns(targets); err != nil {
+		return CNAMERule{}, fmt.Errorf("invalid CanonicalizePermittedCNAMEs rule %q: %w", rule, err)
+	}
+	return parsed, nil
+}
+
+// parses comma-separated patterns, matched as the patterns of the Host blocks
+func parseHostPatterns(list string) (*ssh_config.Host, error) {
+	host := &ssh_config.Host{}
+	for _, pattern := range strings.Split(list, ",") {
+		parsed, err := ssh_config.NewPattern(strings.ToLower(pattern))
+		if err != nil {
+			return nil, err
+		}
+		host.Patterns = append(host.Patterns, parsed)
+	}
+	return host, nil
+}
+
+// Canonicalize returns the canonical name of hostname, or hostname itself if it is not
+// canonicalized, e.g. if it is an IP address or has more than MaxDots dots. A trailing dot marks
+// a fully qualified name, which is only checked against the permitted CNAMEs.
+func (c HostnameCanonicalization) Canonicalize(ctx context.Context, resolver HostResolver, hostname string) (string, error) {
+	if c.Mode == CanonicalizeNo || c.Mode == "" || net.ParseIP(hostname) != nil {
+		return hostname, nil
+	}
+	name := strings.ToLower(hostname)
+	if fqdn, ok := strings.CutSuffix(name, "."); ok {
+		if _, err := resolver.LookupHost(ctx, fqdn); err != nil {
+			return "", fmt.Errorf("could not resolve %s: %w", fqdn, err)
+		}
+		return c.followCNAME(ctx, resolver, fqdn), nil
+	}
+	if strings.Count(name, ".") > c.MaxDots {
+		return hostname, nil
+	}
+	for _, domain := range c.Domains {
+		candidate := name + "." + strings.Trim(strings.ToLower(domain), ".")
+		if _, err := resolver.LookupHost(ctx, candidate); err != nil {
+			continue
+		}
+		return c.followCNAME(ctx, resolver, candidate), nil
+	}
+	if !c.FallbackLocal {
+		return "", fmt.Errorf("could not resolve %s in the canonical domains %s", hostname, strings.Join(c.Domains, ", "))
+	}
+	return hostname, nil
+}
+
+// returns the target of the CNAME of name if a rule permits it, name otherwise
+func (c HostnameCanonicalization) followCNAME(ctx context.Context, resolver HostResolver, name string) string {
+	if len(c.PermittedCNAMEs) == 0 {
+		return name
+	}
+	cname, err := resolver.LookupCNAME(ctx, name)
+	if err != nil {
+		return name
+	}
+	cname = strings.TrimSuffix(strings.ToLower(cname), ".")
+	if cname == name {
+		return name
+	}
+	for _, rule := range c.PermittedCNAMEs {
+		if rule.Sources.Matches(name) && rule.Targets.Matches(cname) {
+			return cname
+		}
+	}
+	return name
+}
@@ -0,0 +1,91 @@
+package ssh3_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/kevinburke/ssh_config"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// resolves the names of the map, mapped to their CNAME or to themselves
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if _, ok := r[host]; !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+func (r fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, ok := r[host]
+	if !ok {
+		return "", fmt.Errorf("no such host %s", host)
+	}
+	return cname + ".", nil
+}
+
+var _ = Describe("Hostname canonicalization", func() {
+	resolver := fakeResolver{
+		"web1.corp.example.com": "web1.corp.example.com",
+		"db.example.com":        "db.example.com",
+		"git.example.com":       "git.cdn.example.net",
+		"www.example.com":       "www.tracker.example.org",
+	}
+
+	canonicalizationFor := func(host string, config string) ssh3.HostnameCanonicalization {
+		decoded, err := ssh_config.Decode(strings.NewReader(config))
+		Expect(err).ToNot(HaveOccurred())
+		canonicalization, err := ssh3.GetCanonicalizationForHost(host, decoded)
+		Expect(err).ToNot(HaveOccurred())
+		return canonicalization
+	}
+
+	It("Uses the defaults of OpenSSH", func() {
+		canonicalization := canonicalizationFor("web1", "Host other\n  CanonicalizeHostname yes\n")
+		Expect(canonicalization).To(Equal(ssh3.HostnameCanonicalization{Mode: ssh3.CanonicalizeNo, MaxDots: 1, FallbackLocal: true}))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "web1")).To(Equal("web1"))
+	})
+
+	It("Expands the short names with the first domain under which they resolve", func() {
+		canonicalization := canonicalizationFor("web1", "Host *\n  CanonicalizeHostname yes\n  CanonicalDomains example.com corp.example.com\n")
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "web1")).To(Equal("web1.corp.example.com"))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "DB")).To(Equal("db.example.com"))
+		// not found, resolved as is
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "laptop")).To(Equal("laptop"))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "web1.corp")).To(Equal("web1.corp.example.com"))
+		// more dots than CanonicalizeMaxDots
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "web1.corp.example")).To(Equal("web1.corp.example"))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "192.0.2.1")).To(Equal("192.0.2.1"))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "db.example.com.")).To(Equal("db.example.com"))
+	})
+
+	It("Refuses the names that do not resolve without CanonicalizeFallbackLocal", func() {
+		canonicalization := canonicalizationFor("laptop", "CanonicalizeHostname always\nCanonicalDomains example.com\nCanonicalizeFallbackLocal no\nCanonicalizeMaxDots 0\n")
+		Expect(canonicalization.MaxDots).To(Equal(0))
+		_, err := canonicalization.Canonicalize(context.Background(), resolver, "laptop")
+		Expect(err).To(HaveOccurred())
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "web1.corp")).To(Equal("web1.corp"))
+	})
+
+	It("Only follows the permitted CNAMEs", func() {
+		canonicalization := canonicalizationFor("git", "CanonicalizeHostname yes\nCanonicalDomains example.com\nCanonicalizePermittedCNAMEs *.example.com:*.cdn.example.net,!*.example.org\n")
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "git")).To(Equal("git.cdn.example.net"))
+		Expect(canonicalization.Canonicalize(context.Background(), resolver, "www")).To(Equal("www.example.com"))
+	})
+
+	It("Rejects the invalid options", func() {
+		for _, config := range []string{"CanonicalizeHostname maybe\n", "CanonicalizeMaxDots -1\n", "CanonicalizeFallbackLocal perhaps\n",
+			"CanonicalizePermittedCNAMEs *.example.com\n"} {
+			decoded, err := ssh_config.Decode(strings.NewReader(config))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = ssh3.GetCanonicalizationForHost("host", decoded)
+			Expect(err).To(HaveOccurred(), config)
+		}
+	})
+})
@@ -1,11 +1,15 @@
 package ssh3
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	ssh3 "github.com/francoismichel/ssh3/message"
 	"github.com/francoismichel/ssh3/util"
@@ -13,13 +17,44 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+// ChannelOpenFailure is the refusal of a channel by the peer, e.g. SSH_OPEN_ADMINISTRATIVELY_PROHIBITED
+// for a forwarding denied by its policy or SSH_OPEN_CONNECT_FAILED when it could not reach the
+// destination of the forwarding
 type ChannelOpenFailure struct {
 	ReasonCode uint64
 	ErrorMsg   string
 }
 
 func (e ChannelOpenFailure) Error() string {
-	return fmt.Sprintf("Channel open failure: reason: %d: %s", e.ReasonCode, e.ErrorMsg)
+	return fmt.Sprintf("Channel open failure: reason: %d (%s): %s", e.ReasonCode, e.Reason(), e.ErrorMsg)
+}
+
+// Reason returns the name of the reason code
+func (e ChannelOpenFailure) Reason() string {
+	switch e.ReasonCode {
+	case ssh3.SSH_OPEN_ADMINISTRATIVELY_PROHIBITED:
+		return "administratively prohibited"
+	case ssh3.SSH_OPEN_CONNECT_FAILED:
+		return "connect failed"
+	case ssh3.SSH_OPEN_UNKNOWN_CHANNEL_TYPE:
+		return "unknown channel type"
+	case ssh3.SSH_OPEN_RESOURCE_SHORTAGE:
+		return "resource shortage"
+	case ssh3.SSH3_OPEN_UNSUPPORTED_FEATURE:
+		return "unsupported feature"
+	default:
+		return "unknown reason"
+	}
+}
+
+// AsChannelOpenFailure returns the refusal of the channel if err is a ChannelOpenFailure, e.g.
+// to tell a forwarding denied by the server from a destination it could not reach
+func AsChannelOpenFailure(err error) (ChannelOpenFailure, bool) {
+	var failure ChannelOpenFailure
+	if errors.As(err, &failure) {
+		return failure, true
+	}
+	return ChannelOpenFailure{}, false
 }
 
 type MessageOnNonConfirmedChannel struct {
@@ -62,6 +97,61 @@ type channelCloseListener interface {
 	onChannelClose(channel Channel)
 }
 
+// ChannelStats contains the application-level counters of a channel.
+// Transport-level events such as QUIC retransmissions are not attributable
+// to a single channel and are therefore not part of these counters.
+type ChannelStats struct {
+	BytesSent         uint64 `json:"bytes_sent"`
+	BytesReceived     uint64 `json:"bytes_received"`
+	MessagesSent      uint64 `json:"messages_sent"`
+	MessagesReceived  uint64 `json:"messages_received"`
+	DatagramsSent     uint64 `json:"datagrams_sent"`
+	DatagramsReceived uint64 `json:"datagrams_received"`
+	// the data messages sent compressed, with the size of their data before and after the
+	// compression and the time spent compressing, including the data that did not compress
+	CompressedMessagesSent uint64 `json:"compressed_messages_sent"`
+	CompressionInputBytes  uint64 `json:"compression_input_bytes"`
+	CompressionOutputBytes uint64 `json:"compression_output_bytes"`
+	CompressionTimeNs      uint64 `json:"compression_time_ns"`
+	// the compressed data messages received and the time spent decompressing them
+	CompressedMessagesReceived uint64 `json:"compressed_messages_received"`
+	DecompressionTimeNs        uint64 `json:"decompression_time_ns"`
+}
+
+type channelCounters struct {
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+	messagesSent      atomic.Uint64
+	messagesReceived  atomic.Uint64
+	datagramsSent     atomic.Uint64
+	datagramsReceived atomic.Uint64
+
+	compressedMessagesSent     atomic.Uint64
+	compressionInputBytes      atomic.Uint64
+	compressionOutputBytes     atomic.Uint64
+	compressionTimeNs          atomic.Uint64
+	compressedMessagesReceived atomic.Uint64
+	decompressionTimeNs        atomic.Uint64
+}
+
+func (c *channelCounters) snapshot() ChannelStats {
+	return ChannelStats{
+		BytesSent:         c.bytesSent.Load(),
+		BytesReceived:     c.bytesReceived.Load(),
+		MessagesSent:      c.messagesSent.Load(),
+		MessagesReceived:  c.messagesReceived.Load(),
+		DatagramsSent:     c.datagramsSent.Load(),
+		DatagramsReceived: c.datagramsReceived.Load(),
+
+		CompressedMessagesSent:     c.compressedMessagesSent.Load(),
+		CompressionInputBytes:      c.compressionInputBytes.Load(),
+		CompressionOutputBytes:     c.compressionOutputBytes.Load(),
+		CompressionTimeNs:          c.compressionTimeNs.Load(),
+		CompressedMessagesReceived: c.compressedMessagesReceived.Load(),
+		DecompressionTimeNs:        c.decompressionTimeNs.Load(),
+	}
+}
+
 type ChannelInfo struct {
 	MaxPacketSize        uint64
 	ConversationStreamID uint64
@@ -75,33 +165,60 @@ type Channel interface {
 	ConversationID() ConversationID
 	ConversationStreamID() uint64
 	NextMessage() (ssh3.Message, error)
+	WaitConfirmation(ctx context.Context) error
 	ReceiveDatagram(ctx context.Context) ([]byte, error)
 	SendDatagram(datagram []byte) error
 	SendRequest(r *ssh3.ChannelRequestMessage) error
+	SendRequestContext(ctx context.Context, r *ssh3.ChannelRequestMessage) error
+	SendRequestWaitReply(ctx context.Context, r *ssh3.ChannelRequestMessage) error
 	CancelRead()
 	Close()
 	MaxPacketSize() uint64
 	WriteData(dataBuf []byte, dataType ssh3.SSHDataType) (int, error)
+	SetWriteDeadline(t time.Time) error
 	ChannelType() string
+	Stats() ChannelStats
+	// MessageWriter returns the writer of the messages of the channel, safe for concurrent use
+	MessageWriter() *MessageWriter
 	confirmChannel(maxPacketSize uint64) error
+	rejectChannel(reasonCode uint64, errorMessage string) error
 	setDatagramSender(func(datagram []byte) error)
+	setProtocolVersion(ssh3.ProtocolVersion)
 	waitAddDatagram(ctx context.Context, datagram []byte) error
 	addDatagram(datagram []byte) bool
 	maybeSendHeader() error
 	setDgramQueue(*util.DatagramsQueue)
+	setMessageTracer(MessageTracer)
+	setCompressor(*channelCompressor)
+	setBandwidthLimiter(func() *BandwidthLimiter)
 }
 
 type channelImpl struct {
 	ChannelInfo
 	confirmSent     bool
 	confirmReceived bool
-	header          []byte
+	writer          *MessageWriter
+	// the wire format of the messages received, negotiated by the conversation
+	protocolVersion ssh3.ProtocolVersion
 
 	datagramSender util.SSH3DatagramSenderFunc
 
 	channelCloseListener
 
-	recv           quic.ReceiveStream
+	counters      channelCounters
+	messageTracer MessageTracer
+	// compresses the data sent, nil if the conversation did not negotiate compression
+	compressor   *channelCompressor
+	decompressor channelDecompressor
+	// returns the current bandwidth limiter of the conversation, nil if it is not limited
+	bandwidthLimiter func() *BandwidthLimiter
+
+	recv quic.ReceiveStream
+	// buffers recv, so that the messages are not parsed from the stream a few bytes at a time
+	reader *bufio.Reader
+	// held by the reader of the messages, NextMessage or a request waiting for its reply
+	readToken      chan struct{}
+	replies        requestReplies
 	send           io.WriteCloser
 	datagramsQueue *util.DatagramsQueue
 	PtyReqHandler
@@ -191,13 +308,13 @@ func parseForwardingHeader(channelID uint64, buf util.Reader) (net.IP, uint16, e
 		return nil, 0, fmt.Errorf("invalid address family: %d", addressFamily)
 	}
 
-	_, err = buf.Read(address)
+	_, err = io.ReadFull(buf, address)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	var portBuf [2]byte
-	_, err = buf.Read(portBuf[:])
+	_, err = io.ReadFull(buf, portBuf[:])
 	if err != nil {
 		return nil, 0, err
 	}
@@ -228,14 +345,18 @@ func parseTCPForwardingHeader(channelID uint64, buf util.Reader) (*net.TCPAddr,
 	}, nil
 }
 
+// the size of the buffer of the messages received, large enough to read several data messages
+// of the default max packet size at once
+const channelReadBufferSize = 128 << 10
+
 func NewChannel(conversationStreamID uint64, conversationID ConversationID, channelID uint64, channelType string, maxPacketSize uint64, recv quic.ReceiveStream,
 	send io.WriteCloser, datagramSender util.SSH3DatagramSenderFunc, channelCloseListener channelCloseListener, sendHeader bool, confirmSent bool,
 	confirmReceived bool, datagramsQueueSize uint64, additonalHeaderBytes []byte) Channel {
-	var header []byte = nil
+	writer := NewMessageWriter(send)
 	if sendHeader {
-		header = buildHeader(conversationStreamID, channelType, maxPacketSize, additonalHeaderBytes)
+		writer.header = buildHeader(conversationStreamID, channelType, maxPacketSize, additonalHeaderBytes)
 	}
-	return &channelImpl{
+	channel := &channelImpl{
 		ChannelInfo: ChannelInfo{
 			MaxPacketSize:        maxPacketSize,
 			ConversationStreamID: conversationStreamID,
@@ -244,14 +365,36 @@ func NewChannel(conversationStreamID uint64, conversationID ConversationID, chan
 			ChannelType:          channelType,
 		},
 		recv:                 recv,
+		reader:               bufio.NewReaderSize(recv, channelReadBufferSize),
+		readToken:            make(chan struct{}, 1),
 		send:                 send,
 		datagramsQueue:       util.NewDatagramsQueue(datagramsQueueSize),
 		datagramSender:       datagramSender,
 		channelCloseListener: channelCloseListener,
-		header:               header,
+		writer:               writer,
+		protocolVersion:      ssh3.MaxProtocolVersion,
 		confirmSent:          confirmSent,
 		confirmReceived:      confirmReceived,
 	}
+	writer.onSent = channel.messageSent
+	return channel
+}
+
+func (c *channelImpl) messageSent(m ssh3.Message, n int, complete bool) {
+	c.counters.bytesSent.Add(uint64(n))
+	if !complete {
+		return
+	}
+	c.counters.messagesSent.Add(1)
+	if c.messageTracer != nil {
+		c.messageTracer.MessageSent(c, m)
+	}
+}
+
+// MessageWriter returns the writer of the messages of the channel, e.g. to write several
+// messages at once
+func (c *channelImpl) MessageWriter() *MessageWriter {
+	return c.writer
 }
 
 func (c *channelImpl) ChannelID() util.ChannelID {
@@ -270,13 +413,80 @@ func (c *channelImpl) ConversationID() ConversationID {
 // / after reading some but not all the bytes, nextMessage returns
 // / ErrUnexpectedEOF.
 func (c *channelImpl) nextMessage() (ssh3.Message, error) {
-	return ssh3.ParseMessage(util.NewReader(c.recv))
+	return ssh3.ParseMessageVersion(c.reader, c.protocolVersion)
+}
+
+// reads the next message, counting and tracing it
+func (c *channelImpl) receiveMessage() (ssh3.Message, error) {
+	genericMessage, err := c.nextMessage()
+	if err != nil {
+		return nil, err
+	}
+	c.counters.messagesReceived.Add(1)
+	c.counters.bytesReceived.Add(uint64(genericMessage.Length()))
+	if c.messageTracer != nil {
+		c.messageTracer.MessageReceived(c, genericMessage)
+	}
+	return genericMessage, nil
+}
+
+// WaitConfirmation waits until the peer confirms the channel that was opened locally, returning
+// the ChannelOpenFailure if it refuses it. The read is canceled if ctx is done first. The peer
+// confirms the channel before sending any message on it.
+func (c *channelImpl) WaitConfirmation(ctx context.Context) error {
+	if c.confirmReceived {
+		return nil
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.CancelRead()
+		case <-done:
+		}
+	}()
+	genericMessage, err := c.receiveMessage()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	switch message := genericMessage.(type) {
+	case *ssh3.ChannelOpenConfirmationMessage:
+		c.confirmReceived = true
+		return nil
+	case *ssh3.ChannelOpenFailureMessage:
+		return ChannelOpenFailure{ReasonCode: message.ReasonCode, ErrorMsg: message.ErrorMessageUTF8}
+	default:
+		return MessageOnNonConfirmedChannel{message: genericMessage}
+	}
 }
 
 // The returned  message will neither be ChannelOpenConfirmationMessage nor ChannelOpenFailureMessage
 // as this function handles it internally
 func (c *channelImpl) NextMessage() (ssh3.Message, error) {
-	genericMessage, err := c.nextMessage()
+	// the messages read while waiting for a reply come first
+	if received, ok := c.replies.popPending(); ok {
+		return received.message, received.err
+	}
+	c.readToken <- struct{}{}
+	defer func() { <-c.readToken }()
+	if received, ok := c.replies.popPending(); ok {
+		return received.message, received.err
+	}
+	for {
+		message, err := c.readMessage()
+		if err != nil || !c.receiveReply(message) {
+			return message, err
+		}
+	}
+}
+
+// reads the next message, the replies included
+func (c *channelImpl) readMessage() (ssh3.Message, error) {
+	genericMessage, err := c.receiveMessage()
 	if err != nil {
 		return nil, err
 	}
@@ -285,29 +495,40 @@ func (c *channelImpl) NextMessage() (ssh3.Message, error) {
 	case *ssh3.ChannelOpenConfirmationMessage:
 		c.confirmReceived = true
 		// let's read the next message
-		return c.NextMessage()
+		return c.readMessage()
+	case *ssh3.ChannelSuccessMessage, *ssh3.ChannelFailureMessage:
+		return genericMessage, nil
 	case *ssh3.ChannelOpenFailureMessage:
 		return nil, ChannelOpenFailure{ReasonCode: message.ReasonCode, ErrorMsg: message.ErrorMessageUTF8}
+	case *ssh3.CompressedDataMessage:
+		start := time.Now()
+		genericMessage, err = c.decompressor.decompress(message)
+		if err != nil {
+			return nil, err
+		}
+		c.counters.compressedMessagesReceived.Add(1)
+		c.counters.decompressionTimeNs.Add(uint64(time.Since(start)))
 	}
 
 	// TODO: might be problematic if a peer already sends data along the channel opening
 	if !c.confirmSent {
 		return nil, MessageOnNonConfirmedChannel{message: genericMessage}
 	}
+	if message, ok := genericMessage.(*ssh3.DataOrExtendedDataMessage); ok {
+		// the data is handed over once the limit allows it, the flow control then slowing the peer down
+		if limiter := c.currentBandwidthLimiter(); limiter != nil {
+			limiter.waitReceive(len(message.Data))
+		}
+	}
 	return genericMessage, nil
 }
 
 func (c *channelImpl) maybeSendHeader() error {
-	if len(c.header) > 0 {
-		written, err := c.send.Write(c.header)
-		if err != nil {
-			return err
-		}
-		c.header = c.header[written:]
-	}
-	return nil
+	return c.writer.WriteHeader()
 }
 
+// WriteData splits dataBuf in messages of at most MaxPacketSize bytes, each written at once. The
+// messages of concurrent writers may be written between them.
 func (c *channelImpl) WriteData(dataBuf []byte, dataType ssh3.SSHDataType) (int, error) {
 	err := c.maybeSendHeader()
 	if err != nil {
@@ -315,22 +536,14 @@ func (c *channelImpl) WriteData(dataBuf []byte, dataType ssh3.SSHDataType) (int,
 	}
 	written := 0
 	for len(dataBuf) > 0 {
-		dataMsg := &ssh3.DataOrExtendedDataMessage{
-			DataType: dataType,
-			Data:     "",
-		}
-		emptyMsgLen := dataMsg.Length()
+		emptyMsgLen := ssh3.DataHeaderLength(dataType, 0)
 		msgLen := util.MinUint64(c.ChannelInfo.MaxPacketSize-uint64(emptyMsgLen), uint64(len(dataBuf)))
 
-		dataMsg.Data = string(dataBuf[:msgLen])
-		dataBuf = dataBuf[msgLen:]
-		// TODO: avoid unnecessary copies and buffer creations
-		msgBuf := make([]byte, dataMsg.Length())
-		_, err := dataMsg.Write(msgBuf)
-		if err != nil {
-			return written, err
+		if limiter := c.currentBandwidthLimiter(); limiter != nil {
+			limiter.waitSend(int(msgLen))
 		}
-		n, err := c.send.Write(msgBuf)
+		n, err := c.writeData(dataType, dataBuf[:msgLen])
+		dataBuf = dataBuf[msgLen:]
 		written += n
 		if err != nil {
 			return written, err
@@ -339,6 +552,42 @@ func (c *channelImpl) WriteData(dataBuf []byte, dataType ssh3.SSHDataType) (int,
 	return written, nil
 }
 
+// writes data in a single message, compressed if it is worth it. It returns the number of bytes
+// of data written.
+func (c *channelImpl) writeData(dataType ssh3.SSHDataType, data []byte) (int, error) {
+	if c.compressor == nil {
+		return c.writer.WriteData(dataType, data)
+	}
+	start := time.Now()
+	compressed, err := c.compressor.compress(dataType, data)
+	c.counters.compressionTimeNs.Add(uint64(time.Since(start)))
+	if err != nil {
+		return 0, err
+	}
+	if compressed == nil {
+		return c.writer.WriteData(dataType, data)
+	}
+	if _, err := c.writer.WriteMessage(compressed); err != nil {
+		// the message is written at once, the peer does not decompress a part of it
+		return 0, err
+	}
+	c.counters.compressedMessagesSent.Add(1)
+	c.counters.compressionInputBytes.Add(uint64(len(data)))
+	c.counters.compressionOutputBytes.Add(uint64(len(compressed.CompressedData)))
+	return len(data), nil
+}
+
+// SetWriteDeadline makes the writes on the channel fail with os.ErrDeadlineExceeded once t is
+// reached, e.g. when they are blocked by the flow control of a peer that stopped reading the
+// channel. A zero t disables the deadline.
+func (c *channelImpl) SetWriteDeadline(t time.Time) error {
+	stream, ok := c.send.(interface{ SetWriteDeadline(t time.Time) error })
+	if !ok {
+		return fmt.Errorf("channel %d does not support write deadlines", c.ChannelID())
+	}
+	return stream.SetWriteDeadline(t)
+}
+
 func (c *channelImpl) confirmChannel(maxPacketSize uint64) error {
 	err := c.sendMessage(&ssh3.ChannelOpenConfirmationMessage{MaxPacketSize: maxPacketSize})
 	if err == nil {
@@ -347,18 +596,17 @@ func (c *channelImpl) confirmChannel(maxPacketSize uint64) error {
 	return err
 }
 
+// sends a channel open failure instead of confirming the channel, then closes it
+func (c *channelImpl) rejectChannel(reasonCode uint64, errorMessage string) error {
+	err := c.sendMessage(&ssh3.ChannelOpenFailureMessage{ReasonCode: reasonCode, ErrorMessageUTF8: errorMessage})
+	c.recv.CancelRead(42)
+	c.send.Close()
+	return err
+}
+
 func (c *channelImpl) sendMessage(m ssh3.Message) error {
-	err := c.maybeSendHeader()
-	if err != nil {
-		return err
-	}
-	buf := make([]byte, m.Length())
-	_, err = m.Write(buf)
-	if err != nil {
-		return err
-	}
-	c.send.Write(buf)
-	return nil
+	_, err := c.writer.WriteMessage(m)
+	return err
 }
 
 // blocks until the datagram is added
@@ -372,7 +620,12 @@ func (c *channelImpl) addDatagram(datagram []byte) bool {
 }
 
 func (c *channelImpl) ReceiveDatagram(ctx context.Context) ([]byte, error) {
-	return c.datagramsQueue.WaitNext(ctx)
+	datagram, err := c.datagramsQueue.WaitNext(ctx)
+	if err == nil {
+		c.counters.datagramsReceived.Add(1)
+		c.counters.bytesReceived.Add(uint64(len(datagram)))
+	}
+	return datagram, err
 }
 
 func (c *channelImpl) SendDatagram(datagram []byte) error {
@@ -380,7 +633,12 @@ func (c *channelImpl) SendDatagram(datagram []byte) error {
 	if c.datagramSender == nil {
 		return SentDatagramOnNonDatagramChannel{c.ChannelID()}
 	}
-	return c.datagramSender(datagram)
+	err := c.datagramSender(datagram)
+	if err == nil {
+		c.counters.datagramsSent.Add(1)
+		c.counters.bytesSent.Add(uint64(len(datagram)))
+	}
+	return err
 }
 
 func (c *channelImpl) SendRequest(r *ssh3.ChannelRequestMessage) error {
@@ -388,12 +646,39 @@ func (c *channelImpl) SendRequest(r *ssh3.ChannelRequestMessage) error {
 	return c.sendMessage(r)
 }
 
+// SendRequestContext sends r as SendRequest does, but gives up when ctx is done, e.g. when the
+// write is blocked by the flow control of the peer. It resets the write deadline of the channel.
+func (c *channelImpl) SendRequestContext(ctx context.Context, r *ssh3.ChannelRequestMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadlineSet := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		// unblocks the pending write
+		c.SetWriteDeadline(time.Now())
+		close(deadlineSet)
+	})
+	err := c.sendMessage(r)
+	if !stop() {
+		<-deadlineSet
+		c.SetWriteDeadline(time.Time{})
+		if err != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
 func (c *channelImpl) CancelRead() {
 	c.recv.CancelRead(42)
 }
 
 func (c *channelImpl) Close() {
 	c.send.Close()
+	// the conversation forgets the channel, e.g. in its statistics, as it may last much longer
+	if c.channelCloseListener != nil {
+		c.channelCloseListener.onChannelClose(c)
+	}
 }
 
 func (c *channelImpl) MaxPacketSize() uint64 {
@@ -404,10 +689,41 @@ func (c *channelImpl) ChannelType() string {
 	return c.ChannelInfo.ChannelType
 }
 
+func (c *channelImpl) Stats() ChannelStats {
+	return c.counters.snapshot()
+}
+
 func (c *channelImpl) setDatagramSender(datagramSender func(datagram []byte) error) {
 	c.datagramSender = datagramSender
 }
 
+// must be called before using the channel
+func (c *channelImpl) setProtocolVersion(version ssh3.ProtocolVersion) {
+	c.protocolVersion = version
+	c.writer.setProtocolVersion(version)
+}
+
 func (c *channelImpl) setDgramQueue(q *util.DatagramsQueue) {
 	c.datagramsQueue = q
 }
+
+// must be called before using the channel
+func (c *channelImpl) setCompressor(compressor *channelCompressor) {
+	c.compressor = compressor
+}
+
+func (c *channelImpl) setBandwidthLimiter(limiter func() *BandwidthLimiter) {
+	c.bandwidthLimiter = limiter
+}
+
+func (c *channelImpl) currentBandwidthLimiter() *BandwidthLimiter {
+	if c.bandwidthLimiter == nil {
+		return nil
+	}
+	return c.bandwidthLimiter()
+}
+
+func (c *channelImpl) setMessageTracer(tracer MessageTracer) {
+	c.messageTracer = tracer
+	c.writer.setTraceData(tracer != nil)
+}
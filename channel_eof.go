@@ -0,0 +1,22 @@
+package ssh3
+
+import (
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// FeatureChannelEOF is the ExtInfo feature of the servers accepting the ChannelEOFMessage on the
+// session channels, see SendEOF
+const FeatureChannelEOF = "channel-eof"
+
+// SendEOF sends the end of the data of the channel, e.g. of the standard input of a remote
+// command, the peer still sending its output and both peers their requests. It returns an
+// UnsupportedFeature if the peer did not advertise FeatureChannelEOF: the older servers end the
+// session when the channel is closed in this direction, which is then the only way of ending
+// the data.
+func SendEOF(channel Channel, peer *ExtInfo) error {
+	if !peer.HasFeature(FeatureChannelEOF) {
+		return UnsupportedFeature{Feature: "channel_eof"}
+	}
+	_, err := channel.MessageWriter().WriteMessage(&ssh3Messages.ChannelEOFMessage{})
+	return err
+}
@@ -0,0 +1,64 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Channel opening", func() {
+	// returns a channel opened locally, receiving the messages sent by the peer
+	openedChannel := func(messages ...ssh3Messages.Message) ssh3.Channel {
+		stream := &bytes.Buffer{}
+		_, err := ssh3.NewMessageWriter(stream).WriteMessages(messages...)
+		Expect(err).ToNot(HaveOccurred())
+		return ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "direct-tcp", 30000, bufferReceiveStream{Buffer: stream}, nopCloser{&bytes.Buffer{}}, nil, nil, false, true, false, 0, nil)
+	}
+
+	It("Names the reason codes of the failures", func() {
+		failure := ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_ADMINISTRATIVELY_PROHIBITED, ErrorMsg: "forwarding to 10.0.0.1:22 is not permitted"}
+		Expect(failure.Reason()).To(Equal("administratively prohibited"))
+		Expect(failure.Error()).To(ContainSubstring("administratively prohibited"))
+		Expect(ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_CONNECT_FAILED}.Reason()).To(Equal("connect failed"))
+		Expect(ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE}.Reason()).To(Equal("resource shortage"))
+
+		found, ok := ssh3.AsChannelOpenFailure(fmt.Errorf("could not dial: %w", failure))
+		Expect(ok).To(BeTrue())
+		Expect(found).To(Equal(failure))
+		_, ok = ssh3.AsChannelOpenFailure(context.DeadlineExceeded)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Waits for the confirmation before reading the messages", func() {
+		channel := openedChannel(
+			&ssh3Messages.ChannelOpenConfirmationMessage{MaxPacketSize: 30000},
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello"},
+		)
+		Expect(channel.WaitConfirmation(context.Background())).To(Succeed())
+		// already confirmed
+		Expect(channel.WaitConfirmation(context.Background())).To(Succeed())
+		message, err := channel.NextMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.(*ssh3Messages.DataOrExtendedDataMessage).Data).To(Equal("hello"))
+	})
+
+	It("Returns the failure of the channels refused by the peer", func() {
+		channel := openedChannel(&ssh3Messages.ChannelOpenFailureMessage{ReasonCode: ssh3Messages.SSH_OPEN_CONNECT_FAILED, ErrorMessageUTF8: "could not connect to 127.0.0.1:1: connection refused"})
+		err := channel.WaitConfirmation(context.Background())
+		failure, ok := ssh3.AsChannelOpenFailure(err)
+		Expect(ok).To(BeTrue())
+		Expect(failure.ReasonCode).To(BeEquivalentTo(ssh3Messages.SSH_OPEN_CONNECT_FAILED))
+		Expect(failure.ErrorMsg).To(ContainSubstring("connection refused"))
+
+		_, err = openedChannel(&ssh3Messages.ChannelOpenFailureMessage{ReasonCode: ssh3Messages.SSH_OPEN_ADMINISTRATIVELY_PROHIBITED}).NextMessage()
+		failure, ok = ssh3.AsChannelOpenFailure(err)
+		Expect(ok).To(BeTrue())
+		Expect(failure.Reason()).To(Equal("administratively prohibited"))
+	})
+})
@@ -0,0 +1,85 @@
+package ssh3
+
+import (
+	"errors"
+	"io"
+
+	ssh3 "github.com/francoismichel/ssh3/message"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ChannelOutput demultiplexes the data messages received on a session channel into the standard
+// output and the standard error of the remote command. The server sends the standard error as
+// SSH_EXTENDED_DATA_STDERR extended data, so both streams keep the order in which the command
+// wrote them, but the order between the two streams is not preserved.
+// The commands running in a pty only have a standard output, their errors being written in it.
+type ChannelOutput struct {
+	Stdout io.Reader
+	Stderr io.Reader
+
+	stdoutR *io.PipeReader
+	stderrR *io.PipeReader
+	stdout  *io.PipeWriter
+	stderr  *io.PipeWriter
+}
+
+// ReadChannelOutput reads the messages of the channel in background until its end, passing the
+// other messages than data (e.g. the exit status request) to handleMessage. As with the pipes of
+// os/exec, Stdout and Stderr must be read concurrently: a reader that is not consumed blocks the
+// other one, and in turn the writes of the peer through the flow control of the channel.
+// Both readers return io.EOF once the channel is closed by the peer, or the error that ended it.
+func ReadChannelOutput(channel Channel, handleMessage func(message ssh3.Message)) *ChannelOutput {
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	output := &ChannelOutput{
+		Stdout:  stdoutR,
+		Stderr:  stderrR,
+		stdoutR: stdoutR,
+		stderrR: stderrR,
+		stdout:  stdoutW,
+		stderr:  stderrW,
+	}
+	go output.readMessages(channel, handleMessage)
+	return output
+}
+
+func (o *ChannelOutput) readMessages(channel Channel, handleMessage func(message ssh3.Message)) {
+	for {
+		genericMessage, err := channel.NextMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			// a nil error makes the readers return io.EOF
+			o.stdout.CloseWithError(err)
+			o.stderr.CloseWithError(err)
+			return
+		}
+		message, ok := genericMessage.(*ssh3.DataOrExtendedDataMessage)
+		if !ok {
+			handleMessage(genericMessage)
+			continue
+		}
+		var stream *io.PipeWriter
+		switch message.DataType {
+		case ssh3.SSH_EXTENDED_DATA_NONE:
+			stream = o.stdout
+		case ssh3.SSH_EXTENDED_DATA_STDERR:
+			stream = o.stderr
+		default:
+			log.Warn().Msgf("ignoring message data of unexpected type %d on channel %d", message.DataType, channel.ChannelID())
+			continue
+		}
+		// the write fails if the reader has been closed, the data of that stream is then discarded
+		stream.Write([]byte(message.Data))
+	}
+}
+
+// Close makes the following reads of Stdout and Stderr fail with io.ErrClosedPipe and discards the
+// remaining output of the channel
+func (o *ChannelOutput) Close() error {
+	o.stdoutR.Close()
+	o.stderrR.Close()
+	return nil
+}
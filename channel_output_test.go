@@ -0,0 +1,101 @@
+package ssh3_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// replays a fixed sequence of messages, then the end of the channel
+type messagesChannel struct {
+	ssh3.Channel
+	messages []ssh3Messages.Message
+	end      error
+}
+
+func (c *messagesChannel) NextMessage() (ssh3Messages.Message, error) {
+	if len(c.messages) == 0 {
+		return nil, c.end
+	}
+	message := c.messages[0]
+	c.messages = c.messages[1:]
+	return message, nil
+}
+
+func (c *messagesChannel) ChannelID() uint64 {
+	return 2
+}
+
+func data(dataType ssh3Messages.SSHDataType, content string) *ssh3Messages.DataOrExtendedDataMessage {
+	return &ssh3Messages.DataOrExtendedDataMessage{DataType: dataType, Data: content}
+}
+
+var _ = Describe("Channel output", func() {
+	readBoth := func(output *ssh3.ChannelOutput) (stdout string, stderr string, stdoutErr error, stderrErr error) {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			buf, err := io.ReadAll(output.Stdout)
+			stdout, stdoutErr = string(buf), err
+		}()
+		go func() {
+			defer wg.Done()
+			buf, err := io.ReadAll(output.Stderr)
+			stderr, stderrErr = string(buf), err
+		}()
+		wg.Wait()
+		return
+	}
+
+	It("Separates the standard output and error in order", func() {
+		channel := &messagesChannel{end: io.EOF, messages: []ssh3Messages.Message{
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "out 1\n"),
+			data(ssh3Messages.SSH_EXTENDED_DATA_STDERR, "err 1\n"),
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "out 2\n"),
+			&ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: 3}},
+			data(ssh3Messages.SSH_EXTENDED_DATA_STDERR, "err 2\n"),
+			data(42, "unknown"),
+		}}
+		var handled []ssh3Messages.Message
+		output := ssh3.ReadChannelOutput(channel, func(message ssh3Messages.Message) {
+			handled = append(handled, message)
+		})
+		stdout, stderr, stdoutErr, stderrErr := readBoth(output)
+		Expect(stdoutErr).ToNot(HaveOccurred())
+		Expect(stderrErr).ToNot(HaveOccurred())
+		Expect(stdout).To(Equal("out 1\nout 2\n"))
+		Expect(stderr).To(Equal("err 1\nerr 2\n"))
+		Expect(handled).To(HaveLen(1))
+		Expect(handled[0].(*ssh3Messages.ChannelRequestMessage).ChannelRequest).To(Equal(&ssh3Messages.ExitStatusRequest{ExitStatus: 3}))
+	})
+
+	It("Returns the error that ended the channel", func() {
+		reset := errors.New("stream reset")
+		channel := &messagesChannel{end: reset, messages: []ssh3Messages.Message{
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "partial"),
+		}}
+		stdout, _, stdoutErr, stderrErr := readBoth(ssh3.ReadChannelOutput(channel, func(ssh3Messages.Message) {}))
+		Expect(stdout).To(Equal("partial"))
+		Expect(stdoutErr).To(Equal(reset))
+		Expect(stderrErr).To(Equal(reset))
+	})
+
+	It("Discards the output of a closed stream", func() {
+		channel := &messagesChannel{end: io.EOF, messages: []ssh3Messages.Message{
+			data(ssh3Messages.SSH_EXTENDED_DATA_STDERR, "discarded"),
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "kept"),
+		}}
+		output := ssh3.ReadChannelOutput(channel, func(ssh3Messages.Message) {})
+		output.Stderr.(io.Closer).Close()
+		stdout, err := io.ReadAll(output.Stdout)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(stdout)).To(Equal("kept"))
+	})
+})
@@ -0,0 +1,81 @@
+package ssh3
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// ChannelHeaderParser parses the header bytes that a channel type adds after the common channel
+// header and returns the channel to accept, e.g. channel wrapped in a type exposing the parsed
+// fields. A nil parser accepts the channels of the type as is.
+type ChannelHeaderParser func(conv *Conversation, channel Channel, header util.Reader) (Channel, error)
+
+var (
+	channelTypesLock sync.RWMutex
+	channelTypes     = map[string]ChannelHeaderParser{
+		"session": nil,
+		// opened by the servers to forward the requests to the agent of the client
+		"agent-connection": nil,
+		"direct-udp": func(conv *Conversation, channel Channel, header util.Reader) (Channel, error) {
+			udpAddr, err := parseUDPForwardingHeader(channel.ChannelID(), header)
+			if err != nil {
+				return nil, err
+			}
+			channel.setDatagramSender(conv.getDatagramSenderForChannel(channel.ChannelID()))
+			return &UDPForwardingChannelImpl{Channel: channel, RemoteAddr: udpAddr}, nil
+		},
+		"direct-tcp": func(conv *Conversation, channel Channel, header util.Reader) (Channel, error) {
+			tcpAddr, err := parseTCPForwardingHeader(channel.ChannelID(), header)
+			if err != nil {
+				return nil, err
+			}
+			return &TCPForwardingChannelImpl{Channel: channel, RemoteAddr: tcpAddr}, nil
+		},
+	}
+)
+
+// the SSH extension names, e.g. "tunnel@example.com"
+var channelTypeRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]*$`)
+
+// RegisterChannelType registers an extension channel type, whose header is parsed by parse. The
+// channels of types that are not registered are accepted without parsing their header, and
+// refused by the servers. It fails if the type is already registered.
+func RegisterChannelType(channelType string, parse ChannelHeaderParser) error {
+	if len(channelType) > 64 || !channelTypeRegexp.MatchString(channelType) {
+		return fmt.Errorf("invalid channel type %q", channelType)
+	}
+	channelTypesLock.Lock()
+	defer channelTypesLock.Unlock()
+	if _, ok := channelTypes[channelType]; ok {
+		return fmt.Errorf("channel type %s already registered", channelType)
+	}
+	channelTypes[channelType] = parse
+	return nil
+}
+
+// RegisteredChannelTypes returns the sorted channel types registered, built-in ones included
+func RegisteredChannelTypes() []string {
+	channelTypesLock.RLock()
+	defer channelTypesLock.RUnlock()
+	types := make([]string, 0, len(channelTypes))
+	for channelType := range channelTypes {
+		types = append(types, channelType)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// parses the type-specific header of a new channel opened by the peer
+func parseChannelTypeHeader(conv *Conversation, channel Channel, header util.Reader) (Channel, error) {
+	channelTypesLock.RLock()
+	parse := channelTypes[channel.ChannelType()]
+	channelTypesLock.RUnlock()
+	if parse == nil {
+		return channel, nil
+	}
+	return parse(conv, channel, header)
+}
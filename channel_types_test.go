@@ -0,0 +1,24 @@
+package ssh3_test
+
+import (
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Channel types", func() {
+	It("Registers the extension types once", func() {
+		Expect(ssh3.RegisteredChannelTypes()).To(ContainElements("session", "direct-udp", "direct-tcp"))
+		Expect(ssh3.RegisterChannelType("test-tunnel@example.com", nil)).To(Succeed())
+		Expect(ssh3.RegisteredChannelTypes()).To(ContainElement("test-tunnel@example.com"))
+		Expect(ssh3.RegisterChannelType("test-tunnel@example.com", nil)).ToNot(Succeed())
+		Expect(ssh3.RegisterChannelType("session", nil)).ToNot(Succeed())
+	})
+
+	It("Refuses the invalid type names", func() {
+		Expect(ssh3.RegisterChannelType("", nil)).ToNot(Succeed())
+		Expect(ssh3.RegisterChannelType("Tunnel", nil)).ToNot(Succeed())
+		Expect(ssh3.RegisterChannelType("a, b", nil)).ToNot(Succeed())
+	})
+})
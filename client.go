@@ -22,6 +22,25 @@ import (
 )
 
 type PasswordAuthMethod struct{}
+
+// authenticates using a one-time token issued on the break-glass socket of the server
+type BreakGlassAuthMethod struct{}
+
+// authenticates using a pre-authorization token stored in a file, see NewPreauthToken
+type PreauthAuthMethod struct {
+	filename string
+}
+
+// authenticates using a bearer token stored in a file, e.g. an OAuth2 access token or a base64-encoded
+// SAML assertion, validated by a token validator of the server
+type BearerTokenAuthMethod struct {
+	filename string
+}
+
+// authenticates using the certificate presented during the TLS handshake, which must be set in the
+// Certificates of the TLS config of the client
+type ClientCertificateAuthMethod struct{}
+
 type OidcAuthMethod struct {
 	doPKCE bool
 	config *auth.OIDCConfig
@@ -46,6 +65,64 @@ func (m *PasswordAuthMethod) IntoIdentity(password string) Identity {
 	return passwordIdentity(password)
 }
 
+func NewBreakGlassAuthMethod() *BreakGlassAuthMethod {
+	return &BreakGlassAuthMethod{}
+}
+
+func (m *BreakGlassAuthMethod) IntoIdentity(token string) Identity {
+	return rawBearerTokenIdentity(token)
+}
+
+func NewPreauthAuthMethod(filename string) *PreauthAuthMethod {
+	return &PreauthAuthMethod{filename: filename}
+}
+
+func (m *PreauthAuthMethod) Filename() string {
+	return m.filename
+}
+
+// IntoIdentity reads the token from the file
+func (m *PreauthAuthMethod) IntoIdentity() (Identity, error) {
+	content, err := os.ReadFile(m.filename)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(token, PreauthTokenPrefix) {
+		return nil, InvalidPreauthToken{Reason: fmt.Sprintf("%s does not contain a pre-authorization token", m.filename)}
+	}
+	return rawBearerTokenIdentity(token), nil
+}
+
+func NewBearerTokenAuthMethod(filename string) *BearerTokenAuthMethod {
+	return &BearerTokenAuthMethod{filename: filename}
+}
+
+func (m *BearerTokenAuthMethod) Filename() string {
+	return m.filename
+}
+
+// IntoIdentity reads the token from the file
+func (m *BearerTokenAuthMethod) IntoIdentity() (Identity, error) {
+	content, err := os.ReadFile(m.filename)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return nil, fmt.Errorf("%s does not contain a bearer token", m.filename)
+	}
+	return rawBearerTokenIdentity(token), nil
+}
+
+func NewClientCertificateAuthMethod() *ClientCertificateAuthMethod {
+	return &ClientCertificateAuthMethod{}
+}
+
+func (m *ClientCertificateAuthMethod) IntoIdentity() Identity {
+	return clientCertificateIdentity{}
+}
+
 func NewOidcAuthMethod(doPKCE bool, config *auth.OIDCConfig) *OidcAuthMethod {
 	return &OidcAuthMethod{
 		doPKCE: doPKCE,
@@ -68,14 +145,14 @@ func (m *PrivkeyFileAuthMethod) Filename() string {
 }
 
 // IntoIdentityWithoutPassphrase returns an SSH3 identity stored on the provided path.
-// It supports the same keys as ssh.ParsePrivateKey
+// It supports the same keys as ParseRawPrivateKey
 // If the private key is encrypted, it returns an ssh.PassphraseMissingError.
 func (m *PrivkeyFileAuthMethod) IntoIdentityWithoutPassphrase() (Identity, error) {
 	return m.intoIdentity(nil)
 }
 
 // IntoIdentityPassphrase returns a passphrase-protected private key stored on the provided path.
-// It supports the same keys as ssh.ParsePrivateKey
+// It supports the same keys as ParseRawPrivateKeyWithPassphrase
 // If the passphrase is wrong, it returns an x509.IncorrectPasswordError.
 func (m *PrivkeyFileAuthMethod) IntoIdentityPassphrase(passphrase string) (Identity, error) {
 	return m.intoIdentity(&passphrase)
@@ -96,9 +173,9 @@ func (m *PrivkeyFileAuthMethod) intoIdentity(passphrase *string) (Identity, erro
 	var signer interface{}
 	var ok bool
 	if passphrase == nil {
-		signer, err = ssh.ParseRawPrivateKey(pemBytes)
+		signer, err = ParseRawPrivateKey(pemBytes)
 	} else {
-		signer, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(*passphrase))
+		signer, err = ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(*passphrase))
 	}
 	if err != nil {
 		return nil, err
@@ -169,7 +246,7 @@ type agentSigningMethod struct {
 }
 
 func (m *agentSigningMethod) Verify(signingString string, sig []byte, key interface{}) error {
-	panic("not implemented")
+	return fmt.Errorf("verifying signatures using an agent is not implemented")
 }
 
 func (m *agentSigningMethod) Sign(signingString string, key interface{}) ([]byte, error) {
@@ -241,6 +318,22 @@ func (i passwordIdentity) String() string {
 	return "password-identity"
 }
 
+// the server authenticates the certificate presented during the TLS handshake, so that the
+// request carries no Authorization header
+type clientCertificateIdentity struct{}
+
+func (i clientCertificateIdentity) SetAuthorizationHeader(req *http.Request, username string, conversation *Conversation) error {
+	return nil
+}
+
+func (i clientCertificateIdentity) AuthHint() string {
+	return "client-certificate"
+}
+
+func (i clientCertificateIdentity) String() string {
+	return "client-certificate-identity"
+}
+
 type rawBearerTokenIdentity string
 
 func (i rawBearerTokenIdentity) SetAuthorizationHeader(req *http.Request, username string, conversation *Conversation) error {
@@ -311,3 +404,33 @@ func buildJWTBearerToken(signingMethod jwt.SigningMethod, key interface{}, usern
 	}
 	return signedString, nil
 }
+
+// VerifyJWTBearerToken checks that token has been built by an identity of username holding the
+// private key of pubkey, for the conversation identified by base64ConversationID
+func VerifyJWTBearerToken(token string, pubkey crypto.PublicKey, username string, base64ConversationID string) error {
+	parsedToken, err := jwt.Parse(token, func(unvalidatedToken *jwt.Token) (interface{}, error) {
+		return pubkey, nil
+	},
+		jwt.WithIssuer(username),
+		jwt.WithSubject("ssh3"),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience("unused"),
+		jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
+	if err != nil {
+		return err
+	}
+	claims, ok := parsedToken.Claims.(jwt.MapClaims)
+	if !parsedToken.Valid || !ok {
+		return fmt.Errorf("invalid token")
+	}
+	if _, ok = claims["exp"]; !ok {
+		return fmt.Errorf("the token does not expire")
+	}
+	if clientId, ok := claims["client_id"]; !ok || clientId != fmt.Sprintf("ssh3-%s", username) {
+		return fmt.Errorf("the client_id claim does not match the user")
+	}
+	if jti, ok := claims["jti"]; !ok || jti != base64ConversationID {
+		return fmt.Errorf("the jti claim does not contain the base64-encoded conversation ID")
+	}
+	return nil
+}
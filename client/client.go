@@ -0,0 +1,271 @@
+// Package client lets Go programs connect to SSH3 servers, with an API close to the one of
+// golang.org/x/crypto/ssh: Dial a server, then run commands in sessions or open TCP connections
+// from the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxPacketSize      = 30000
+	datagramsQueueSize = 10
+	// the time given to the disconnect message of the server to arrive once a session ended
+	disconnectMessageDelay = 200 * time.Millisecond
+	// the time given to the server to reply to the requests of the sessions
+	requestReplyTimeout = 30 * time.Second
+)
+
+type Config struct {
+	// the user to log in as, if the URL does not specify one (user@host or ?user=)
+	User string
+	// the identities tried in turn until the server accepts one, e.g. the ones returned by
+	// ssh3.NewPrivkeyFileAuthMethod(path).IntoIdentityWithoutPassphrase()
+	Identities []ssh3.Identity
+	// if nil, the certificate of the server is verified using the roots of the system
+	TLSConfig *tls.Config
+	// if set, the keys pinned for the host in this file (e.g. ~/.ssh3/known_hosts) are trusted as
+	// well and the keys it revokes are refused, as the ssh3 command does
+	KnownHostsPath string
+	// if nil, the settings of the ssh3 command are used
+	QUICConfig *quic.Config
+	// the knock secret of a hidden server, see ssh3.LoadKnockSecret. Without it, the hidden
+	// servers answer 404 to the requests, including the ones whose identity they refuse.
+	KnockSecret []byte
+}
+
+// Client is an authenticated conversation with an SSH3 server
+type Client struct {
+	conv         *ssh3.Conversation
+	qconn        quic.EarlyConnection
+	roundTripper *http3.RoundTripper
+}
+
+// splits the URL of the server (https:// can be omitted, the port defaults to 443) into the
+// address to dial and the URL of the CONNECT request, identifying the user
+func parseServerURL(rawURL string, defaultUser string) (address string, requestURL string, username string, err error) {
+	if !strings.HasPrefix(rawURL, "https://") {
+		rawURL = "https://" + rawURL
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	username = parsedURL.User.Username()
+	if username == "" {
+		username = parsedURL.Query().Get("user")
+	}
+	if username == "" {
+		username = defaultUser
+	}
+	if username == "" {
+		return "", "", "", fmt.Errorf("no username in %s nor in the config", rawURL)
+	}
+	port := parsedURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	address = net.JoinHostPort(parsedURL.Hostname(), port)
+	parsedURL.User = nil
+	query := parsedURL.Query()
+	query.Set("user", username)
+	parsedURL.RawQuery = query.Encode()
+	return address, parsedURL.String(), username, nil
+}
+
+func (config *Config) tlsConfig(hostname string) (*tls.Config, error) {
+	tlsConf := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConf = config.TLSConfig.Clone()
+	}
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	if config.KnownHostsPath == "" {
+		return tlsConf, nil
+	}
+	knownHosts, _, err := ssh3.LoadKnownHosts(config.KnownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse known hosts: %w", err)
+	}
+	if tlsConf.RootCAs == nil {
+		tlsConf.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, err
+		}
+	}
+	knownHosts.ConfigureTLS(hostname, tlsConf)
+	return tlsConf, nil
+}
+
+// Dial connects to the SSH3 server at rawURL (e.g. https://user@host:443/ssh3-term) and
+// authenticates using the identities of the config
+func Dial(ctx context.Context, rawURL string, config *Config) (*Client, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if len(config.Identities) == 0 {
+		return nil, fmt.Errorf("no identity to authenticate with")
+	}
+	address, requestURL, username, err := parseServerURL(rawURL, config.User)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _, _ := net.SplitHostPort(address)
+	tlsConf, err := config.tlsConfig(hostname)
+	if err != nil {
+		return nil, err
+	}
+	qconf := &quic.Config{
+		MaxIncomingStreams: 10,
+		Allow0RTT:          true,
+		EnableDatagrams:    true,
+		KeepAlivePeriod:    1 * time.Second,
+	}
+	if config.QUICConfig != nil {
+		qconf = config.QUICConfig.Clone()
+		qconf.EnableDatagrams = true
+	}
+
+	qconn, err := quic.DialAddrEarly(ctx, address, tlsConf, qconf)
+	if err != nil {
+		return nil, fmt.Errorf("could not establish the QUIC connection with %s: %w", address, err)
+	}
+	roundTripper := &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig:      qconf,
+		EnableDatagrams: true,
+		// use the connection established above for all the requests
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return qconn, nil
+		},
+	}
+	client := &Client{qconn: qconn, roundTripper: roundTripper}
+	if err := client.establishConversation(ctx, requestURL, username, config.Identities, config.KnockSecret); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *Client) establishConversation(ctx context.Context, requestURL string, username string, identities []ssh3.Identity, knockSecret []byte) error {
+	select {
+	case <-c.qconn.HandshakeComplete():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// the conversation ID is derived from the TLS exporter, available once 1-RTT
+	tlsState := c.qconn.ConnectionState().TLS
+	conv, err := ssh3.NewClientConversation(maxPacketSize, datagramsQueueSize, &tlsState)
+	if err != nil {
+		return fmt.Errorf("could not create new client conversation: %w", err)
+	}
+	var refusal error = util.Unauthorized{}
+	for _, identity := range identities {
+		req, err := http.NewRequestWithContext(ctx, "CONNECT", requestURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Proto = "ssh3"
+		req.Header.Set("User-Agent", ssh3.GetCurrentVersion())
+		// the client accepts no channel from the server
+		ssh3.NewExtInfo(nil, "datagrams", ssh3.FeatureRequestReplies).SetHeader(req.Header)
+		if knockSecret != nil {
+			ssh3.SetKnockHeader(req, knockSecret)
+		}
+		if err := identity.SetAuthorizationHeader(req, username, conv); err != nil {
+			return fmt.Errorf("could not set authorization header for %s: %w", identity, err)
+		}
+		err = conv.EstablishClientConversation(req, c.roundTripper)
+		if errors.Is(err, util.Unauthorized{}) || errors.Is(err, util.NotFound{}) {
+			// a hidden server answers 404 to the refused identities when no knock secret is set
+			log.Debug().Msgf("the server refused identity %s: %s", identity, err)
+			refusal = err
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not establish the conversation: %w", err)
+		}
+		c.conv = conv
+		return nil
+	}
+	return fmt.Errorf("no identity accepted by the server: %w", refusal)
+}
+
+// Conversation returns the underlying conversation, e.g. to open channels of other types
+func (c *Client) Conversation() *ssh3.Conversation {
+	return c.conv
+}
+
+// Close ends the conversation and the QUIC connection
+func (c *Client) Close() error {
+	if c.conv != nil {
+		c.conv.Close()
+	}
+	err := c.roundTripper.Close()
+	c.qconn.CloseWithError(0, "")
+	return err
+}
+
+// NewSession opens a session channel. The server currently ends the conversation along with
+// its first session, a new client must be dialed for each session.
+func (c *Client) NewSession() (*Session, error) {
+	channel, err := c.conv.OpenChannel("session", maxPacketSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	session := newSession(channel)
+	session.peer = c.conv.PeerExtInfo()
+	session.conv = c.conv
+	return session, nil
+}
+
+// NewSessionContext opens a session channel, waiting until ctx is done if the server does not
+// allow more channels yet
+func (c *Client) NewSessionContext(ctx context.Context) (*Session, error) {
+	channel, err := c.conv.OpenChannelContext(ctx, "session", maxPacketSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	session := newSession(channel)
+	session.peer = c.conv.PeerExtInfo()
+	session.conv = c.conv
+	return session, nil
+}
+
+// Run runs cmd in a new session and returns its standard output, see Session.Output
+func (c *Client) Run(cmd string) ([]byte, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(cmd)
+}
+
+// RunContext runs cmd as Run does, the command being killed if ctx is done before it completes
+func (c *Client) RunContext(ctx context.Context, cmd string) ([]byte, error) {
+	session, err := c.NewSessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	err = session.RunContext(ctx, cmd)
+	return stdout.Bytes(), err
+}
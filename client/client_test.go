@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// replays a fixed sequence of messages then, as the server after the exit status, keeps the
+// channel open until it is closed locally
+type fakeChannel struct {
+	ssh3.Channel
+	messages []ssh3Messages.Message
+	// if set, the channel ends with this error once the messages are replayed
+	end error
+
+	lock     sync.Mutex
+	requests []ssh3Messages.ChannelRequest
+	written  []byte
+	// the messages written using the MessageWriter, e.g. the channel EOF
+	messagesWritten bytes.Buffer
+	closed          chan struct{}
+	once            sync.Once
+}
+
+func newFakeChannel(end error, messages ...ssh3Messages.Message) *fakeChannel {
+	return &fakeChannel{messages: messages, end: end, closed: make(chan struct{})}
+}
+
+func (c *fakeChannel) NextMessage() (ssh3Messages.Message, error) {
+	if len(c.messages) > 0 {
+		message := c.messages[0]
+		c.messages = c.messages[1:]
+		return message, nil
+	}
+	if c.end != nil {
+		return nil, c.end
+	}
+	<-c.closed
+	return nil, io.EOF
+}
+
+func (c *fakeChannel) SendRequest(r *ssh3Messages.ChannelRequestMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, r.ChannelRequest)
+	return nil
+}
+
+func (c *fakeChannel) SendRequestContext(ctx context.Context, r *ssh3Messages.ChannelRequestMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.SendRequest(r)
+}
+
+func (c *fakeChannel) WriteData(dataBuf []byte, dataType ssh3Messages.SSHDataType) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.written = append(c.written, dataBuf...)
+	return len(dataBuf) + 8, nil
+}
+
+func (c *fakeChannel) MessageWriter() *ssh3.MessageWriter {
+	return ssh3.NewMessageWriter(&c.messagesWritten)
+}
+
+func (c *fakeChannel) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *fakeChannel) CancelRead() {}
+
+func (c *fakeChannel) ChannelID() uint64 {
+	return 2
+}
+
+func data(dataType ssh3Messages.SSHDataType, content string) *ssh3Messages.DataOrExtendedDataMessage {
+	return &ssh3Messages.DataOrExtendedDataMessage{DataType: dataType, Data: content}
+}
+
+func exitStatus(status uint64) *ssh3Messages.ChannelRequestMessage {
+	return &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: status}}
+}
+
+var _ = Describe("Server URL", func() {
+	It("Adds the user to the CONNECT request", func() {
+		address, requestURL, username, err := parseServerURL("alice@example.org:4443/ssh3-term", "bob")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(address).To(Equal("example.org:4443"))
+		Expect(requestURL).To(Equal("https://example.org:4443/ssh3-term?user=alice"))
+		Expect(username).To(Equal("alice"))
+	})
+
+	It("Uses the default user and port", func() {
+		address, requestURL, username, err := parseServerURL("https://[::1]/ssh3", "bob")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(address).To(Equal("[::1]:443"))
+		Expect(requestURL).To(Equal("https://[::1]/ssh3?user=bob"))
+		Expect(username).To(Equal("bob"))
+	})
+
+	It("Requires a user", func() {
+		_, _, _, err := parseServerURL("example.org/ssh3", "")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Session", func() {
+	It("Returns the standard output of a successful command", func() {
+		channel := newFakeChannel(nil,
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "hello "),
+			data(ssh3Messages.SSH_EXTENDED_DATA_STDERR, "warning\n"),
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "world\n"),
+			exitStatus(0),
+		)
+		session := newSession(channel)
+		output, err := session.Output("echo hello world")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(output)).To(Equal("hello world\n"))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExecRequest{Command: "echo hello world"}}))
+		Expect(session.Close()).To(Succeed())
+	})
+
+	It("Runs the argument vectors without a shell if the server supports it", func() {
+		channel := newFakeChannel(nil, exitStatus(0))
+		session := newSession(channel)
+		Expect(session.RunArgv("touch", "a file")).To(Succeed())
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExecArgvRequest{Argv: []string{"touch", "a file"}}}))
+		session.Close()
+
+		session = newSession(newFakeChannel(nil))
+		session.peer = &ssh3.ExtInfo{RequestTypes: []string{"exec", "shell"}}
+		err := session.RunArgv("true")
+		Expect(errors.As(err, &ssh3.UnsupportedFeature{})).To(BeTrue())
+	})
+
+	It("Sends the end of the input if the server supports it", func() {
+		channel := newFakeChannel(nil)
+		session := newSession(channel)
+		session.peer = &ssh3.ExtInfo{Features: []string{ssh3.FeatureChannelEOF}}
+		stdin, err := session.StdinPipe()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Start("cat")).To(Succeed())
+		stdin.Write([]byte("hello"))
+		Expect(stdin.Close()).To(Succeed())
+		Expect(string(channel.written)).To(Equal("hello"))
+		message, err := ssh3Messages.ParseMessage(bytes.NewReader(channel.messagesWritten.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message).To(Equal(&ssh3Messages.ChannelEOFMessage{}))
+		session.Close()
+
+		// the older servers would end the session
+		channel = newFakeChannel(nil)
+		session = newSession(channel)
+		session.peer = &ssh3.ExtInfo{}
+		stdin, _ = session.StdinPipe()
+		Expect(stdin.Close()).To(Succeed())
+		Expect(channel.messagesWritten.Len()).To(BeZero())
+	})
+
+	It("Reports the exit status and signal of the command", func() {
+		session := newSession(newFakeChannel(nil, exitStatus(3)))
+		err := session.Run("false")
+		var exitError *ExitError
+		Expect(errors.As(err, &exitError)).To(BeTrue())
+		Expect(exitError.Status).To(Equal(3))
+		session.Close()
+
+		session = newSession(newFakeChannel(nil, &ssh3Messages.ChannelRequestMessage{
+			ChannelRequest: &ssh3Messages.ExitSignalRequest{SignalNameWithoutSig: "KILL"},
+		}))
+		err = session.Run("sleep 100")
+		Expect(errors.As(err, &exitError)).To(BeTrue())
+		Expect(exitError.Signal).To(Equal("KILL"))
+		session.Close()
+	})
+
+	It("Reports a session ended without exit status", func() {
+		session := newSession(newFakeChannel(io.EOF, data(ssh3Messages.SSH_EXTENDED_DATA_STDERR, "error\n")))
+		output, err := session.CombinedOutput("true")
+		Expect(err).To(Equal(ExitMissingError{}))
+		Expect(string(output)).To(Equal("error\n"))
+	})
+
+	It("Kills the command when the context is done", func() {
+		channel := newFakeChannel(nil, data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "started\n"))
+		session := newSession(channel)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := session.RunContext(ctx, "sleep 100")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Eventually(func() []ssh3Messages.ChannelRequest {
+			channel.lock.Lock()
+			defer channel.lock.Unlock()
+			return channel.requests
+		}).Should(Equal([]ssh3Messages.ChannelRequest{
+			&ssh3Messages.ExecRequest{Command: "sleep 100"},
+			&ssh3Messages.SignalRequest{SignalNameWithoutSig: "KILL"},
+		}))
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(newSession(newFakeChannel(nil)).RunContext(canceled, "true")).To(Equal(context.Canceled))
+	})
+
+	It("Streams the output through pipes and sends the input", func() {
+		channel := newFakeChannel(nil, data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "output"), exitStatus(0))
+		session := newSession(channel)
+		stdin, err := session.StdinPipe()
+		Expect(err).ToNot(HaveOccurred())
+		stdout, err := session.StdoutPipe()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(session.Shell()).To(Succeed())
+		Expect(session.Shell()).ToNot(Succeed())
+		_, err = stdin.Write([]byte("input"))
+		Expect(err).ToNot(HaveOccurred())
+		output, err := io.ReadAll(stdout)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(output)).To(Equal("output"))
+		Expect(session.Wait()).To(Succeed())
+		Expect(string(channel.written)).To(Equal("input"))
+		session.Close()
+	})
+})
+
+var _ = Describe("Forwarded connection", func() {
+	It("Reads the data messages in buffers of any size", func() {
+		conn := &channelConn{channel: newFakeChannel(io.EOF,
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "abc"),
+			data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "de"),
+		)}
+		buf := make([]byte, 2)
+		var read []string
+		for {
+			n, err := conn.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			Expect(err).ToNot(HaveOccurred())
+			read = append(read, string(buf[:n]))
+		}
+		Expect(read).To(Equal([]string{"ab", "c", "de"}))
+	})
+})
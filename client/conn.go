@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	"github.com/rs/zerolog/log"
+)
+
+// a TCP connection established by the server on a forwarding channel
+type channelConn struct {
+	channel    ssh3.Channel
+	localAddr  *net.TCPAddr
+	remoteAddr *net.TCPAddr
+
+	readLock sync.Mutex
+	// the data of the last message that did not fit in the buffer of Read
+	pending []byte
+}
+
+func (c *channelConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for len(c.pending) == 0 {
+		genericMessage, err := c.channel.NextMessage()
+		if err != nil {
+			return 0, err
+		} else if genericMessage == nil {
+			return 0, io.EOF
+		}
+		message, ok := genericMessage.(*ssh3Messages.DataOrExtendedDataMessage)
+		if !ok || message.DataType != ssh3Messages.SSH_EXTENDED_DATA_NONE {
+			log.Warn().Msgf("ignoring message of type %T on TCP forwarding channel %d", genericMessage, c.channel.ChannelID())
+			continue
+		}
+		c.pending = []byte(message.Data)
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *channelConn) Write(b []byte) (int, error) {
+	return (&channelWriter{c.channel}).Write(b)
+}
+
+// CloseWrite sends the end of the data to the server, which half-closes the TCP connection
+func (c *channelConn) CloseWrite() error {
+	c.channel.Close()
+	return nil
+}
+
+func (c *channelConn) Close() error {
+	c.channel.CancelRead()
+	c.channel.Close()
+	return nil
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return errors.New("read deadlines are not supported on forwarding channels")
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	return errors.New("read deadlines are not supported on forwarding channels")
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return c.channel.SetWriteDeadline(t)
+}
+
+// Dial connects to addr from the server. Only TCP is supported, and addr must be an IP address
+// and a port as the host names are resolved by the client.
+func (c *Client) Dial(network string, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr as Dial does, waiting until ctx is done if the server does not
+// allow more channels yet. It can be used as the DialContext of an http.Transport.
+func (c *Client) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	remoteAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.dialTCP(ctx, &net.TCPAddr{}, remoteAddr)
+}
+
+func (c *Client) dialTCP(ctx context.Context, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (*channelConn, error) {
+	// fail early rather than opening a channel that the server refuses
+	if err := c.conv.CheckPeerChannelType("direct-tcp"); err != nil {
+		return nil, err
+	}
+	channel, err := c.conv.OpenTCPForwardingChannelContext(ctx, maxPacketSize, datagramsQueueSize, localAddr, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	// the server confirms the channel once connected, ssh3.AsChannelOpenFailure then telling a
+	// forwarding denied by its policy from a destination it could not reach
+	if err := channel.WaitConfirmation(ctx); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	return &channelConn{channel: channel, localAddr: localAddr, remoteAddr: remoteAddr}, nil
+}
+
+// TCPForwarding forwards the connections accepted on a local address to a remote one
+type TCPForwarding struct {
+	listener *net.TCPListener
+}
+
+// Addr returns the local address, e.g. to get the port chosen by the system
+func (f *TCPForwarding) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Close stops listening, the connections already forwarded are kept
+func (f *TCPForwarding) Close() error {
+	return f.listener.Close()
+}
+
+// ListenTCP forwards the connections accepted on the local laddr to raddr through the server,
+// as the -forward-tcp option of the ssh3 command. Unlike ListenTCP of golang.org/x/crypto/ssh,
+// SSH3 servers do not listen on behalf of the clients.
+func (c *Client) ListenTCP(laddr *net.TCPAddr, raddr *net.TCPAddr) (*TCPForwarding, error) {
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Error().Msgf("could accept on TCP socket: %s", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// the server confirms the channel once connected to raddr
+				channelConn, err := c.dialTCP(context.Background(), listener.Addr().(*net.TCPAddr), raddr)
+				if err != nil {
+					log.Error().Msgf("could open new TCP forwarding channel: %s", err)
+					return
+				}
+				sent := make(chan struct{})
+				go func() {
+					defer close(sent)
+					io.Copy(channelConn, conn)
+					channelConn.CloseWrite()
+				}()
+				io.Copy(conn, channelConn)
+				conn.CloseWrite()
+				<-sent
+			}()
+		}
+	}()
+	return &TCPForwarding{listener: listener}, nil
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An OutputFilter wraps the writer of the output of a session, e.g. to timestamp its lines
+// before they are displayed. The filters keep their state across writes (e.g. whether a line
+// is being written), so each stream needs its own instances.
+type OutputFilter func(w io.Writer) io.Writer
+
+// FilterOutput returns a writer passing the output through the filters, in order, before
+// writing it to w
+func FilterOutput(w io.Writer, filters ...OutputFilter) io.Writer {
+	for i := len(filters) - 1; i >= 0; i-- {
+		w = filters[i](w)
+	}
+	return w
+}
+
+// the default layout of the timestamps of TimestampLines
+const DefaultTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// TimestampLines prefixes each line with the time at which its first byte was received,
+// formatted using layout (see time.Layout)
+func TimestampLines(layout string) OutputFilter {
+	return func(w io.Writer) io.Writer {
+		return &timestampWriter{w: w, layout: layout, now: time.Now, atLineStart: true}
+	}
+}
+
+type timestampWriter struct {
+	w           io.Writer
+	layout      string
+	now         func() time.Time
+	atLineStart bool
+	buf         []byte
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	out := w.buf[:0]
+	for rest := p; len(rest) > 0; {
+		if w.atLineStart {
+			out = append(w.now().AppendFormat(out, w.layout), ' ')
+			w.atLineStart = false
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			out = append(out, rest...)
+			break
+		}
+		out = append(out, rest[:i+1]...)
+		rest = rest[i+1:]
+		w.atLineStart = true
+	}
+	w.buf = out
+	if _, err := w.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// StripANSI removes the ANSI escape sequences (e.g. colors and cursor movements) from the
+// output, e.g. before it is written in a log file. The sequences split across writes are
+// removed as well.
+func StripANSI() OutputFilter {
+	return func(w io.Writer) io.Writer {
+		return &ansiStripper{w: w}
+	}
+}
+
+type ansiState int
+
+const (
+	ansiText ansiState = iota
+	// after ESC
+	ansiEscape
+	// in an escape sequence with intermediate bytes, e.g. ESC ( B
+	ansiIntermediate
+	// in a control sequence, e.g. ESC [ 1 ; 3 1 m
+	ansiCSI
+	// in a control string ended by ST (ESC \) or BEL, e.g. an OSC setting the window title
+	ansiString
+	// after ESC in a control string
+	ansiStringEscape
+)
+
+type ansiStripper struct {
+	w     io.Writer
+	state ansiState
+	buf   []byte
+}
+
+func (s *ansiStripper) Write(p []byte) (int, error) {
+	out := s.buf[:0]
+	for _, b := range p {
+		switch s.state {
+		case ansiText:
+			if b == 0x1b {
+				s.state = ansiEscape
+			} else {
+				out = append(out, b)
+			}
+		case ansiEscape:
+			switch {
+			case b == '[':
+				s.state = ansiCSI
+			case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+				s.state = ansiString
+			case b >= 0x20 && b <= 0x2f:
+				s.state = ansiIntermediate
+			default:
+				s.state = ansiText
+			}
+		case ansiIntermediate:
+			if b < 0x20 || b > 0x2f {
+				s.state = ansiText
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = ansiText
+			}
+		case ansiString:
+			if b == 0x07 {
+				s.state = ansiText
+			} else if b == 0x1b {
+				s.state = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if b == '\\' {
+				s.state = ansiText
+			} else if b != 0x1b {
+				s.state = ansiString
+			}
+		}
+	}
+	s.buf = out
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+const (
+	highlightStart = "\x1b[1;31m"
+	highlightEnd   = "\x1b[0m"
+)
+
+// Highlight displays the matches of pattern in bold red. The output is not buffered, so that
+// e.g. a prompt is displayed right away: a match split across two writes of the server is not
+// highlighted.
+func Highlight(pattern *regexp.Regexp) OutputFilter {
+	return func(w io.Writer) io.Writer {
+		return writerFunc(func(p []byte) (int, error) {
+			highlighted := pattern.ReplaceAllFunc(p, func(match []byte) []byte {
+				return []byte(highlightStart + string(match) + highlightEnd)
+			})
+			if _, err := w.Write(highlighted); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		})
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// ParseOutputFilter parses a filter specified as "timestamp", "timestamp=<Go time layout>",
+// "strip-ansi" or "highlight=<regexp>"
+func ParseOutputFilter(spec string) (OutputFilter, error) {
+	name, arg, hasArg := strings.Cut(spec, "=")
+	switch name {
+	case "timestamp":
+		if !hasArg {
+			arg = DefaultTimestampLayout
+		}
+		return TimestampLines(arg), nil
+	case "strip-ansi":
+		if hasArg {
+			return nil, fmt.Errorf("the strip-ansi output filter takes no argument")
+		}
+		return StripANSI(), nil
+	case "highlight":
+		if arg == "" {
+			return nil, fmt.Errorf("the highlight output filter expects a regexp, e.g. highlight=(?i)error")
+		}
+		pattern, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid highlight regexp: %w", err)
+		}
+		return Highlight(pattern), nil
+	default:
+		return nil, fmt.Errorf("unknown output filter %q (expected timestamp, strip-ansi or highlight)", name)
+	}
+}
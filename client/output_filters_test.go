@@ -0,0 +1,71 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output filters", func() {
+	writeAll := func(w io.Writer, chunks ...string) {
+		for _, chunk := range chunks {
+			n, err := w.Write([]byte(chunk))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(chunk)))
+		}
+	}
+
+	It("Timestamps the lines when they start", func() {
+		var out bytes.Buffer
+		w := TimestampLines("15:04:05")(&out).(*timestampWriter)
+		now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+		w.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		writeAll(w, "first ", "line\nsecond line\r\n", "", "third")
+		Expect(out.String()).To(Equal("10:00:01 first line\n10:00:02 second line\r\n10:00:03 third"))
+	})
+
+	It("Strips the ANSI escape sequences, even split across writes", func() {
+		var out bytes.Buffer
+		w := StripANSI()(&out)
+		writeAll(w, "\x1b[1;31mred\x1b[", "0m plain \x1b]0;window title\x07", "\x1b(Bcharset \x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b", "\\ end\r\n")
+		Expect(out.String()).To(Equal("red plain charset link end\r\n"))
+	})
+
+	It("Highlights the matches", func() {
+		var out bytes.Buffer
+		w := Highlight(regexp.MustCompile(`(?i)error`))(&out)
+		writeAll(w, "an Error and an error\n")
+		Expect(out.String()).To(Equal("an \x1b[1;31mError\x1b[0m and an \x1b[1;31merror\x1b[0m\n"))
+	})
+
+	It("Composes the filters in order", func() {
+		var out bytes.Buffer
+		highlight, err := ParseOutputFilter("highlight=fail")
+		Expect(err).ToNot(HaveOccurred())
+		strip, err := ParseOutputFilter("strip-ansi")
+		Expect(err).ToNot(HaveOccurred())
+		// the highlighting is stripped
+		writeAll(FilterOutput(&out, highlight, strip), "\x1b[32mtests fail\x1b[0m\n")
+		Expect(out.String()).To(Equal("tests fail\n"))
+
+		out.Reset()
+		writeAll(FilterOutput(&out, strip, highlight), "\x1b[32mtests fail\x1b[0m\n")
+		Expect(out.String()).To(Equal("tests \x1b[1;31mfail\x1b[0m\n"))
+	})
+
+	It("Rejects the invalid filters", func() {
+		for _, invalid := range []string{"", "timestamps", "strip-ansi=all", "highlight", "highlight=(", "highlight="} {
+			_, err := ParseOutputFilter(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+		_, err := ParseOutputFilter("timestamp=2006-01-02")
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// ExitError reports a remote command that did not exit successfully
+type ExitError struct {
+	Status int
+	// the name of the signal that killed the command, without the SIG prefix
+	Signal string
+	Msg    string
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		if e.Msg != "" {
+			return fmt.Sprintf("process killed by signal %s: %s", e.Signal, e.Msg)
+		}
+		return fmt.Sprintf("process killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("process exited with status %d", e.Status)
+}
+
+// ExitMissingError reports a session that ended without the exit status of its command
+type ExitMissingError struct{}
+
+func (e ExitMissingError) Error() string {
+	return "the session ended without exit status"
+}
+
+// Session runs a remote command or shell. As with os/exec, the standard streams must be set
+// before starting it: a nil Stdin sends no input and a nil Stdout or Stderr discards the output.
+type Session struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	channel ssh3.Channel
+	// tells why the server ended the conversation, nil in the tests
+	conv *ssh3.Conversation
+	// what the server supports, nil if it predates the ExtInfo
+	peer    *ssh3.ExtInfo
+	started bool
+	output  *ssh3.ChannelOutput
+	// the pipes returned to the user, closed at the end of the output
+	closeAfterOutput []io.Closer
+	outputCopies     sync.WaitGroup
+	outputDone       chan struct{}
+
+	lock      sync.Mutex
+	exitError error
+	copyError error
+	exited    bool
+}
+
+func newSession(channel ssh3.Channel) *Session {
+	return &Session{channel: channel, outputDone: make(chan struct{})}
+}
+
+func (s *Session) sendRequest(ctx context.Context, request ssh3Messages.ChannelRequest) error {
+	// the server would end the channel on a request type it cannot parse
+	if err := s.peer.CheckRequestType(request.RequestTypeStr()); err != nil {
+		return err
+	}
+	message := &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: request}
+	if !s.peer.HasFeature(ssh3.FeatureRequestReplies) {
+		return s.channel.SendRequestContext(ctx, message)
+	}
+	// the request fails if the server refused it, e.g. a pty request
+	ctx, cancel := context.WithTimeout(ctx, requestReplyTimeout)
+	defer cancel()
+	return s.channel.SendRequestWaitReply(ctx, message)
+}
+
+// RequestPty requests a pty of the given size, the remote command then reads its input from it
+// and writes both its output and errors in it
+func (s *Session) RequestPty(term string, height int, width int, modes ssh3Messages.TerminalModes) error {
+	return s.sendRequest(context.Background(), &ssh3Messages.PtyRequest{
+		Term:          term,
+		CharWidth:     uint64(width),
+		CharHeight:    uint64(height),
+		TerminalModes: modes,
+	})
+}
+
+// WindowChange informs the remote pty of the new size of the local terminal
+func (s *Session) WindowChange(height int, width int) error {
+	return s.channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+		WantReply: false,
+		ChannelRequest: &ssh3Messages.WindowChangeRequest{
+			CharWidth:  uint64(width),
+			CharHeight: uint64(height),
+		},
+	})
+}
+
+// Signal sends the signal (e.g. "INT", without the SIG prefix) to the remote command
+func (s *Session) Signal(signalNameWithoutSig string) error {
+	return s.sendRequest(context.Background(), &ssh3Messages.SignalRequest{SignalNameWithoutSig: signalNameWithoutSig})
+}
+
+// StdinPipe returns a writer sending its data to the standard input of the remote command.
+// Closing it sends the end of the input, unless the server predates ssh3.FeatureChannelEOF.
+func (s *Session) StdinPipe() (io.WriteCloser, error) {
+	if s.Stdin != nil {
+		return nil, errors.New("Stdin already set")
+	}
+	if s.started {
+		return nil, errors.New("StdinPipe after session started")
+	}
+	return &stdinWriter{channelWriter{s.channel}, s}, nil
+}
+
+// StdoutPipe returns a reader of the standard output of the remote command. It must be read
+// concurrently with StderrPipe, if used, as the channel carries both streams.
+func (s *Session) StdoutPipe() (io.Reader, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if s.started {
+		return nil, errors.New("StdoutPipe after session started")
+	}
+	reader, writer := io.Pipe()
+	s.Stdout = writer
+	s.closeAfterOutput = append(s.closeAfterOutput, writer)
+	return reader, nil
+}
+
+// StderrPipe returns a reader of the standard error of the remote command, see StdoutPipe
+func (s *Session) StderrPipe() (io.Reader, error) {
+	if s.Stderr != nil {
+		return nil, errors.New("Stderr already set")
+	}
+	if s.started {
+		return nil, errors.New("StderrPipe after session started")
+	}
+	reader, writer := io.Pipe()
+	s.Stderr = writer
+	s.closeAfterOutput = append(s.closeAfterOutput, writer)
+	return reader, nil
+}
+
+// Start runs cmd using the shell of the user on the server, without waiting for it to complete
+func (s *Session) Start(cmd string) error {
+	return s.start(context.Background(), &ssh3Messages.ExecRequest{Command: cmd})
+}
+
+// StartArgv runs argv[0] with the arguments as is, without the shell of the user, so that they
+// need no quoting. It returns an ssh3.UnsupportedFeature if the server does not support it.
+func (s *Session) StartArgv(argv ...string) error {
+	if len(argv) == 0 {
+		return errors.New("empty argument vector")
+	}
+	return s.start(context.Background(), &ssh3Messages.ExecArgvRequest{Argv: argv})
+}
+
+// Shell starts the login shell of the user, usually after RequestPty
+func (s *Session) Shell() error {
+	return s.start(context.Background(), &ssh3Messages.ShellRequest{})
+}
+
+// RequestSubsystem starts the subsystem (e.g. "sftp") configured on the server
+func (s *Session) RequestSubsystem(subsystem string) error {
+	return s.start(context.Background(), &ssh3Messages.SubsystemRequest{SubsystemName: subsystem})
+}
+
+func (s *Session) start(ctx context.Context, request ssh3Messages.ChannelRequest) error {
+	if s.started {
+		return errors.New("session already started")
+	}
+	s.started = true
+	if err := s.sendRequest(ctx, request); err != nil {
+		return err
+	}
+	// handleMessage may be called before ReadChannelOutput returns
+	s.lock.Lock()
+	s.output = ssh3.ReadChannelOutput(s.channel, s.handleMessage)
+	s.lock.Unlock()
+	s.outputCopies.Add(2)
+	go s.copyOutput(s.Stdout, s.output.Stdout)
+	go s.copyOutput(s.Stderr, s.output.Stderr)
+	go func() {
+		s.outputCopies.Wait()
+		for _, closer := range s.closeAfterOutput {
+			closer.Close()
+		}
+		close(s.outputDone)
+	}()
+	if s.Stdin != nil {
+		go func() {
+			if _, err := io.Copy(&channelWriter{s.channel}, s.Stdin); err == nil {
+				s.sendEOF()
+			}
+		}()
+	}
+	return nil
+}
+
+func (s *Session) copyOutput(dst io.Writer, src io.Reader) {
+	defer s.outputCopies.Done()
+	if dst == nil {
+		dst = io.Discard
+	}
+	_, err := io.Copy(dst, src)
+	// the readers are closed once the command exited
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		s.lock.Lock()
+		if s.copyError == nil {
+			s.copyError = err
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *Session) handleMessage(message ssh3Messages.Message) {
+	request, ok := message.(*ssh3Messages.ChannelRequestMessage)
+	if !ok {
+		return
+	}
+	var exitError error
+	switch exit := request.ChannelRequest.(type) {
+	case *ssh3Messages.ExitStatusRequest:
+		if exit.ExitStatus != 0 {
+			exitError = &ExitError{Status: int(exit.ExitStatus)}
+		}
+	case *ssh3Messages.ExitSignalRequest:
+		exitError = &ExitError{Signal: exit.SignalNameWithoutSig, Msg: exit.ErrorMessageUTF8}
+	default:
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.exited {
+		s.exitError = exitError
+		s.exited = true
+		// the server sends the exit status after all the output, which has then been consumed
+		// by the copies as the pipes are unbuffered, but it keeps the channel open
+		s.output.Close()
+	}
+}
+
+// Wait waits for the remote command to exit and its output to be copied. The error is an
+// *ExitError if the command did not exit successfully, or an ssh3.Disconnect if the server
+// ended the conversation before it exited.
+func (s *Session) Wait() error {
+	if !s.started {
+		return errors.New("session not started")
+	}
+	<-s.outputDone
+	s.lock.Lock()
+	exited := s.exited
+	s.lock.Unlock()
+	if !exited && s.conv != nil {
+		if disconnect, ok := s.conv.PeerDisconnect(disconnectMessageDelay); ok {
+			return disconnect
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.copyError != nil {
+		return s.copyError
+	}
+	if !s.exited {
+		return ExitMissingError{}
+	}
+	return s.exitError
+}
+
+// Run runs cmd and waits for it to complete, see Start and Wait
+func (s *Session) Run(cmd string) error {
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// RunArgv runs argv without a shell and waits for it to complete, see StartArgv and Wait
+func (s *Session) RunArgv(argv ...string) error {
+	if err := s.StartArgv(argv...); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// RunContext runs cmd as Run does, but kills the command and closes the session if ctx is done
+// before the command completes, returning the error of ctx
+func (s *Session) RunContext(ctx context.Context, cmd string) error {
+	if err := s.start(ctx, &ssh3Messages.ExecRequest{Command: cmd}); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		// stop waiting for the output first, sending the signal may block
+		s.lock.Lock()
+		s.output.Close()
+		s.lock.Unlock()
+		s.Signal("KILL")
+		s.Close()
+	})
+	err := s.Wait()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Output runs cmd and returns its standard output
+func (s *Session) Output(cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	var stdout bytes.Buffer
+	s.Stdout = &stdout
+	err := s.Run(cmd)
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs cmd and returns its standard output and error, interleaved
+func (s *Session) CombinedOutput(cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if s.Stderr != nil {
+		return nil, errors.New("Stderr already set")
+	}
+	output := &lockedBuffer{}
+	s.Stdout = output
+	s.Stderr = output
+	err := s.Run(cmd)
+	return output.buffer.Bytes(), err
+}
+
+// Close closes the session channel, which ends the conversation on the server
+func (s *Session) Close() error {
+	if s.output != nil {
+		s.output.Close()
+	}
+	s.channel.CancelRead()
+	s.channel.Close()
+	return nil
+}
+
+// the writes of the standard output and error copies are concurrent
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+// WriteData splits the data in messages that fit in the packets of the channel
+type channelWriter struct {
+	channel ssh3.Channel
+}
+
+func (w *channelWriter) Write(p []byte) (int, error) {
+	// WriteData counts the bytes of the messages, headers included
+	if _, err := w.channel.WriteData(p, ssh3Messages.SSH_EXTENDED_DATA_NONE); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sends the end of the input to the remote command, if the server supports it
+func (s *Session) sendEOF() error {
+	err := ssh3.SendEOF(s.channel, s.peer)
+	if errors.As(err, &ssh3.UnsupportedFeature{}) {
+		// the older servers end the session when the channel is closed, the command keeps
+		// waiting for its input instead
+		return nil
+	}
+	return err
+}
+
+// the writer returned by StdinPipe, sending the end of the input when closed
+type stdinWriter struct {
+	channelWriter
+	session *Session
+}
+
+func (w *stdinWriter) Close() error {
+	return w.session.sendEOF()
+}
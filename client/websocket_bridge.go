@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// the delay given to the browser to send its auth message after opening the WebSocket
+	webSocketAuthTimeout = 30 * time.Second
+	// the largest message accepted from the browser, the input being typed or pasted
+	webSocketMaxMessageSize = 1 << 20
+	defaultWebSocketTerm    = "xterm-256color"
+)
+
+// WebSocketBridge is an http.Handler bridging the WebSocket connections of browser terminals
+// (e.g. xterm.js) to shell sessions on an SSH3 server, the browsers not being able to open the
+// Extended CONNECT requests of SSH3 themselves. Each WebSocket connection dials a conversation of
+// its own, the server authenticating the user as for the other clients.
+//
+// The browser sends JSON text messages, starting with the auth message:
+//
+//	{"type": "auth", "user": "alice", "password": "...", "cols": 80, "rows": 24}
+//	{"type": "input", "data": "ls\r"}
+//	{"type": "resize", "cols": 120, "rows": 40}
+//
+// "token" replaces "password" to authenticate using a bearer token (e.g. an OAuth2 access token),
+// and both are omitted when Authenticate is set. The output of the terminal is sent in binary
+// messages, along with the JSON text messages {"type": "ready"} once the shell started,
+// {"type": "exit", "status": 0} (or "signal": "KILL") once it exited and
+// {"type": "error", "message": "..."} before closing the WebSocket on failure.
+type WebSocketBridge struct {
+	// the URL of the SSH3 server, without user, e.g. "my-server.example.org:443/ssh3-term"
+	ServerURL string
+	// the settings of the conversations, whose User and Identities are the ones of each browser
+	Config Config
+	// the origins (e.g. "https://console.example.org") whose pages may open the WebSocket
+	// connections. If empty, only the pages served by the host of the bridge may.
+	AllowedOrigins []string
+	// if set, authenticates the WebSocket request of the browser (e.g. using the session cookie
+	// of the web console) and returns the user to log in as and the identities to use, the auth
+	// message then carrying no credentials. An error refuses the request with 401.
+	Authenticate func(r *http.Request) (user string, identities []ssh3.Identity, err error)
+	// the TERM of the pty, "xterm-256color" if empty
+	Term string
+
+	// opens the session of the user on the server, replaced in the tests
+	openSession func(ctx context.Context, user string, identities []ssh3.Identity) (*Session, io.Closer, error)
+}
+
+type webSocketMessage struct {
+	Type     string `json:"type"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Cols     int    `json:"cols,omitempty"`
+	Rows     int    `json:"rows,omitempty"`
+	Status   *int   `json:"status,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+func (b *WebSocketBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var user string
+	var identities []ssh3.Identity
+	if b.Authenticate != nil {
+		var err error
+		if user, identities, err = b.Authenticate(r); err != nil {
+			log.Info().Msgf("refusing the WebSocket of %s: %s", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	server := websocket.Server{
+		Handshake: b.checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			b.serveTerminal(ws, user, identities)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// refuses the WebSockets opened by the pages of other sites, which the browsers allow
+func (b *WebSocketBridge) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		return fmt.Errorf("missing origin")
+	}
+	if len(b.AllowedOrigins) == 0 {
+		if origin.Host != r.Host {
+			return fmt.Errorf("origin %s not allowed", origin)
+		}
+		return nil
+	}
+	for _, allowed := range b.AllowedOrigins {
+		if allowedURL, err := url.Parse(allowed); err == nil && allowedURL.Scheme == origin.Scheme && allowedURL.Host == origin.Host {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func (b *WebSocketBridge) dialSession(ctx context.Context, user string, identities []ssh3.Identity) (*Session, io.Closer, error) {
+	config := b.Config
+	config.User = user
+	config.Identities = identities
+	client, err := Dial(ctx, b.ServerURL, &config)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := client.NewSessionContext(ctx)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return session, client, nil
+}
+
+// the output of the terminal, in binary messages
+type webSocketOutput struct {
+	ws *websocket.Conn
+}
+
+func (o webSocketOutput) Write(p []byte) (int, error) {
+	return o.ws.Write(p)
+}
+
+func sendWebSocketError(ws *websocket.Conn, format string, args ...any) {
+	websocket.JSON.Send(ws, webSocketMessage{Type: "error", Message: fmt.Sprintf(format, args...)})
+}
+
+// runs a shell in a pty for the browser until it exits or the browser leaves
+func (b *WebSocketBridge) serveTerminal(ws *websocket.Conn, user string, identities []ssh3.Identity) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = webSocketMaxMessageSize
+	ws.PayloadType = websocket.BinaryFrame
+	remoteAddr := ws.Request().RemoteAddr
+
+	var auth webSocketMessage
+	ws.SetReadDeadline(time.Now().Add(webSocketAuthTimeout))
+	if err := websocket.JSON.Receive(ws, &auth); err != nil || auth.Type != "auth" {
+		sendWebSocketError(ws, "expected the auth message")
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+	if b.Authenticate == nil {
+		user = auth.User
+		switch {
+		case auth.Password != "":
+			identities = []ssh3.Identity{ssh3.NewPasswordAuthMethod().IntoIdentity(auth.Password)}
+		case auth.Token != "":
+			identities = []ssh3.Identity{ssh3.NewOidcAuthMethod(false, nil).IntoIdentity(auth.Token)}
+		default:
+			sendWebSocketError(ws, "the auth message carries no password nor token")
+			return
+		}
+	}
+	if user == "" {
+		sendWebSocketError(ws, "no user to log in as")
+		return
+	}
+
+	openSession := b.openSession
+	if openSession == nil {
+		openSession = b.dialSession
+	}
+	ctx, cancel := context.WithTimeout(ws.Request().Context(), 30*time.Second)
+	session, conversation, err := openSession(ctx, user, identities)
+	cancel()
+	if err != nil {
+		log.Info().Msgf("could not open the session of %s for the WebSocket of %s: %s", user, remoteAddr, err)
+		sendWebSocketError(ws, "could not log in: %s", err)
+		return
+	}
+	defer conversation.Close()
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		sendWebSocketError(ws, "%s", err)
+		return
+	}
+	output := webSocketOutput{ws}
+	session.Stdout = output
+	session.Stderr = output
+	term := b.Term
+	if term == "" {
+		term = defaultWebSocketTerm
+	}
+	if auth.Cols <= 0 || auth.Rows <= 0 {
+		auth.Cols, auth.Rows = 80, 24
+	}
+	if err := session.RequestPty(term, auth.Rows, auth.Cols, nil); err != nil {
+		sendWebSocketError(ws, "could not allocate a pty: %s", err)
+		return
+	}
+	if err := session.Shell(); err != nil {
+		sendWebSocketError(ws, "could not start the shell: %s", err)
+		return
+	}
+	log.Info().Msgf("bridging the WebSocket of %s to a shell of %s", remoteAddr, user)
+	if err := websocket.JSON.Send(ws, webSocketMessage{Type: "ready"}); err != nil {
+		return
+	}
+
+	go func() {
+		// the shell is hung up when the browser leaves
+		defer session.Close()
+		for {
+			var message webSocketMessage
+			if err := websocket.JSON.Receive(ws, &message); err != nil {
+				return
+			}
+			switch message.Type {
+			case "input":
+				if _, err := stdin.Write([]byte(message.Data)); err != nil {
+					return
+				}
+			case "resize":
+				if message.Cols > 0 && message.Rows > 0 {
+					session.WindowChange(message.Rows, message.Cols)
+				}
+			}
+		}
+	}()
+
+	err = session.Wait()
+	var exitError *ExitError
+	status := 0
+	switch {
+	case err == nil:
+		websocket.JSON.Send(ws, webSocketMessage{Type: "exit", Status: &status})
+	case errors.As(err, &exitError) && exitError.Signal != "":
+		websocket.JSON.Send(ws, webSocketMessage{Type: "exit", Signal: exitError.Signal})
+	case errors.As(err, &exitError):
+		websocket.JSON.Send(ws, webSocketMessage{Type: "exit", Status: &exitError.Status})
+	default:
+		sendWebSocketError(ws, "the session ended: %s", err)
+	}
+}
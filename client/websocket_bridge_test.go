@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"golang.org/x/net/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocket bridge", func() {
+	var channel *fakeChannel
+	var user string
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		user = ""
+	})
+
+	startBridge := func(bridge *WebSocketBridge) {
+		bridge.openSession = func(ctx context.Context, u string, identities []ssh3.Identity) (*Session, io.Closer, error) {
+			user = u
+			return newSession(channel), io.NopCloser(nil), nil
+		}
+		server = httptest.NewServer(bridge)
+		DeferCleanup(server.Close)
+	}
+
+	dial := func(origin string) (*websocket.Conn, error) {
+		return websocket.Dial(strings.Replace(server.URL, "http", "ws", 1), "", origin)
+	}
+
+	receiveJSON := func(ws *websocket.Conn) webSocketMessage {
+		var message webSocketMessage
+		Expect(websocket.JSON.Receive(ws, &message)).To(Succeed())
+		return message
+	}
+
+	It("Runs a shell in a pty and forwards its output and exit status", func() {
+		channel = newFakeChannel(nil, data(ssh3Messages.SSH_EXTENDED_DATA_NONE, "output"), exitStatus(3))
+		startBridge(&WebSocketBridge{})
+		ws, err := dial(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		defer ws.Close()
+		Expect(websocket.JSON.Send(ws, webSocketMessage{Type: "auth", User: "alice", Password: "secret", Cols: 120, Rows: 40})).To(Succeed())
+
+		Expect(receiveJSON(ws).Type).To(Equal("ready"))
+		var output []byte
+		Expect(websocket.Message.Receive(ws, &output)).To(Succeed())
+		Expect(string(output)).To(Equal("output"))
+		exit := receiveJSON(ws)
+		Expect(exit.Type).To(Equal("exit"))
+		Expect(*exit.Status).To(Equal(3))
+		Expect(user).To(Equal("alice"))
+		Expect(channel.requests[0]).To(BeAssignableToTypeOf(&ssh3Messages.PtyRequest{}))
+		pty := channel.requests[0].(*ssh3Messages.PtyRequest)
+		Expect(pty.Term).To(Equal("xterm-256color"))
+		Expect(pty.CharWidth).To(Equal(uint64(120)))
+		Expect(pty.CharHeight).To(Equal(uint64(40)))
+	})
+
+	It("Sends the input and window changes and hangs up when the browser leaves", func() {
+		channel = newFakeChannel(nil)
+		startBridge(&WebSocketBridge{})
+		ws, err := dial(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(websocket.JSON.Send(ws, webSocketMessage{Type: "auth", User: "alice", Token: "token"})).To(Succeed())
+		Expect(receiveJSON(ws).Type).To(Equal("ready"))
+
+		Expect(websocket.JSON.Send(ws, webSocketMessage{Type: "input", Data: "ls\r"})).To(Succeed())
+		Expect(websocket.JSON.Send(ws, webSocketMessage{Type: "resize", Cols: 100, Rows: 30})).To(Succeed())
+		Eventually(func() string {
+			channel.lock.Lock()
+			defer channel.lock.Unlock()
+			return string(channel.written)
+		}).Should(Equal("ls\r"))
+		Eventually(func() []ssh3Messages.ChannelRequest {
+			channel.lock.Lock()
+			defer channel.lock.Unlock()
+			return channel.requests
+		}).Should(ContainElement(&ssh3Messages.WindowChangeRequest{CharWidth: 100, CharHeight: 30}))
+
+		ws.Close()
+		Eventually(channel.closed).Should(BeClosed())
+	})
+
+	It("Refuses the pages of other origins", func() {
+		channel = newFakeChannel(nil)
+		startBridge(&WebSocketBridge{AllowedOrigins: []string{"https://console.example.org"}})
+		_, err := dial("https://evil.example.org")
+		Expect(err).To(HaveOccurred())
+		ws, err := dial("https://console.example.org")
+		Expect(err).ToNot(HaveOccurred())
+		ws.Close()
+	})
+
+	It("Requires credentials in the auth message", func() {
+		channel = newFakeChannel(nil)
+		startBridge(&WebSocketBridge{})
+		ws, err := dial(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		defer ws.Close()
+		Expect(websocket.JSON.Send(ws, webSocketMessage{Type: "auth", User: "alice"})).To(Succeed())
+		Expect(receiveJSON(ws).Type).To(Equal("error"))
+		Expect(user).To(BeEmpty())
+	})
+})
@@ -0,0 +1,146 @@
+package main
+
+// git-remote-ssh3 is the git remote helper of the ssh3:// URLs, e.g.
+//
+//	git clone ssh3://user@my-server.example.org:443/ssh3:/srv/git/project.git
+//
+// git runs it when it meets such a URL, the helper then running git-upload-pack or
+// git-receive-pack on the server with the ssh3 client, and connecting git to it as over SSH.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const urlScheme = "ssh3://"
+
+// the environment variable overriding the ssh3 command run by the helper, with its options
+const commandEnv = "GIT_SSH3_COMMAND"
+
+const usage = `usage: git-remote-ssh3 <remote> [<url>]
+
+git-remote-ssh3 is run by git for the ssh3://[user@]host[:port]/url-path:/path/to/repo URLs,
+the repository path being absolute or relative to the remote home if it starts with ~/.
+The ssh3 command run to reach the server (ssh3 by default) can be set with its options in
+GIT_SSH3_COMMAND, e.g. GIT_SSH3_COMMAND="ssh3 -privkey ~/.ssh/id_git".
+`
+
+// the git services that the helper connects to
+var services = map[string]bool{
+	"git-upload-pack":    true,
+	"git-receive-pack":   true,
+	"git-upload-archive": true,
+}
+
+// splits the URL into the destination of the ssh3 client and the path of the repository on the
+// server, following the colon ending the URL path as in the destinations of the ssh3 client
+func splitURL(url string) (string, string, error) {
+	address := strings.TrimPrefix(url, urlScheme)
+	// the colon before a port is followed by a digit and the colons of IPv6 addresses are in brackets
+	index := strings.Index(address, ":/")
+	if homeIndex := strings.Index(address, ":~"); homeIndex >= 0 && (index < 0 || homeIndex < index) {
+		index = homeIndex
+	}
+	if index <= 0 || index == len(address)-1 {
+		return "", "", fmt.Errorf("no repository path in %s, expected %s[user@]host[:port]/url-path:/path/to/repo", url, urlScheme)
+	}
+	return address[:index], address[index+1:], nil
+}
+
+// quotes the argument for the shell of the server, as git does over SSH
+func shellQuote(argument string) string {
+	return "'" + strings.ReplaceAll(argument, "'", `'\''`) + "'"
+}
+
+// reads a line of a command sent by git, one byte at a time so that the data following the
+// connect command is left on stdin for the ssh3 client
+func readLine(reader io.Reader) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := reader.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, buf[0])
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return string(line), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// runs the service on the server, the ssh3 client inheriting the stdin and stdout connected to git
+func connect(destination string, repoPath string, service string) int {
+	command := strings.Fields(os.Getenv(commandEnv))
+	if len(command) == 0 {
+		command = []string{"ssh3"}
+	}
+	// the git protocol is binary, so no pty is requested, and the progress of the connection
+	// would mix with the output of git
+	args := append(command[1:], "-T", "-quiet", destination, service+" "+shellQuote(repoPath))
+	cmd := exec.Command(command[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "git-remote-ssh3: could not run %s: %s\n", command[0], err)
+		return 128
+	}
+	return 0
+}
+
+func mainWithStatusCode() int {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		fmt.Fprint(os.Stderr, usage)
+		return 128
+	}
+	// git passes the URL as second argument, or only the URL if it was given on the command line
+	url := os.Args[len(os.Args)-1]
+	destination, repoPath, err := splitURL(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "git-remote-ssh3: %s\n", err)
+		return 128
+	}
+	for {
+		line, err := readLine(os.Stdin)
+		if errors.Is(err, io.EOF) {
+			return 0
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "git-remote-ssh3: could not read the commands of git: %s\n", err)
+			return 128
+		}
+		switch command, argument, _ := strings.Cut(line, " "); command {
+		case "":
+			return 0
+		case "capabilities":
+			fmt.Fprint(os.Stdout, "connect\n\n")
+		case "connect":
+			if !services[argument] {
+				fmt.Fprintf(os.Stderr, "git-remote-ssh3: unsupported service %q\n", argument)
+				return 128
+			}
+			// the empty line tells git that the connection is established
+			fmt.Fprint(os.Stdout, "\n")
+			return connect(destination, repoPath, argument)
+		default:
+			fmt.Fprintf(os.Stderr, "git-remote-ssh3: unsupported command %q\n", line)
+			return 128
+		}
+	}
+}
+
+func main() {
+	os.Exit(mainWithStatusCode())
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// returns a random serial number of 128 bits, as recommended by the CA/Browser forum
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// the subject key identifier of a public key, as computed by x509.CreateCertificate for the CAs
+func subjectKeyID(public crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	id := sha1.Sum(der)
+	return id[:], nil
+}
+
+func writeCertificate(filename string, der []byte) error {
+	return writeNewFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// ssh3-keygen ca creates the self-signed certificate of a certificate authority, signing the
+// host certificates trusted by the clients or the user certificates of client_certificates
+func runCA(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen ca", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "the private key of the certificate authority, e.g. generated with ssh3-keygen generate -t ecdsa")
+	passphrase := flags.String("P", "", "the passphrase of the private key (prompted if needed and not set)")
+	name := flags.String("name", "", "the common name of the certificate authority")
+	validity := flags.Duration("validity", 10*365*24*time.Hour, "the validity of the certificate")
+	output := flags.String("o", "", "the file of the certificate")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *keyFile == "" || *name == "" || *output == "" {
+		fmt.Fprintf(os.Stderr, "ssh3-keygen ca requires -key, -name and -o\n")
+		flags.Usage()
+		return -1
+	}
+	if *validity <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid certificate validity %s\n", *validity)
+		return -1
+	}
+	key, err := loadKey(*keyFile, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %s\n", *keyFile, err)
+		return -1
+	}
+	if key.private == nil {
+		fmt.Fprintf(os.Stderr, "%s does not contain a private key\n", *keyFile)
+		return -1
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate the serial number: %s\n", err)
+		return -1
+	}
+	keyID, err := subjectKeyID(key.public)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unsupported key in %s: %s\n", *keyFile, err)
+		return -1
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: *name},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(*validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          keyID,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.public, key.private)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the certificate: %s\n", err)
+		return -1
+	}
+	if err := writeCertificate(*output, der); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write %s: %s\n", *output, err)
+		return -1
+	}
+	fmt.Printf("Created certificate authority %q in %s, valid until %s\n", *name, *output, template.NotAfter.Format(time.RFC3339))
+	return 0
+}
+
+// returns the default file of the certificate of the public key stored in keyFile, e.g.
+// id_ed25519-cert.pem for id_ed25519.pub
+func defaultCertificateFile(keyFile string) string {
+	return strings.TrimSuffix(keyFile, filepath.Ext(keyFile)) + "-cert.pem"
+}
+
+// ssh3-keygen sign issues a certificate for a public key, signed by a certificate authority: a
+// host certificate for ssh3-server or a user certificate for ssh3 -client-cert
+func runSign(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen sign", flag.ContinueOnError)
+	caKeyFile := flags.String("ca-key", "", "the private key of the certificate authority")
+	caCertFile := flags.String("ca-cert", "", "the certificate of the certificate authority, e.g. created with ssh3-keygen ca")
+	passphrase := flags.String("P", "", "the passphrase of the private key of the certificate authority (prompted if needed and not set)")
+	keyFile := flags.String("f", "", "the key to certify, whose public key is read in any format")
+	certType := flags.String("type", "user", "the type of certificate: host or user")
+	names := flags.String("names", "", "the comma-separated names: the DNS names and IP addresses of a host, or the common name of a user followed by its email addresses and URIs")
+	validity := flags.Duration("validity", 365*24*time.Hour, "the validity of the certificate")
+	output := flags.String("o", "", "the file of the certificate (<key file without extension>-cert.pem by default)")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	nameList := splitList(*names)
+	if *caKeyFile == "" || *caCertFile == "" || *keyFile == "" || len(nameList) == 0 {
+		fmt.Fprintf(os.Stderr, "ssh3-keygen sign requires -ca-key, -ca-cert, -f and -names\n")
+		flags.Usage()
+		return -1
+	}
+	if *certType != "host" && *certType != "user" {
+		fmt.Fprintf(os.Stderr, "unknown certificate type %q, use host or user\n", *certType)
+		return -1
+	}
+	if *validity <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid certificate validity %s\n", *validity)
+		return -1
+	}
+	if *output == "" {
+		*output = defaultCertificateFile(*keyFile)
+	}
+
+	ca, err := loadKey(*caCertFile, nil)
+	if err != nil || ca.certificate == nil {
+		fmt.Fprintf(os.Stderr, "could not load the certificate authority %s: %v\n", *caCertFile, err)
+		return -1
+	}
+	caKey, err := loadKey(*caKeyFile, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %s\n", *caKeyFile, err)
+		return -1
+	}
+	if caKey.private == nil {
+		fmt.Fprintf(os.Stderr, "%s does not contain a private key\n", *caKeyFile)
+		return -1
+	}
+	if public, ok := caKey.public.(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(ca.certificate.PublicKey) {
+		fmt.Fprintf(os.Stderr, "the private key %s does not match the certificate authority %s\n", *caKeyFile, *caCertFile)
+		return -1
+	}
+	key, err := loadKey(*keyFile, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %s\n", *keyFile, err)
+		return -1
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate the serial number: %s\n", err)
+		return -1
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: nameList[0]},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(*validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if _, ok := key.public.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if *certType == "host" {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, name := range nameList {
+			if ip := net.ParseIP(name); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, name)
+			}
+		}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		for _, name := range nameList[1:] {
+			if strings.Contains(name, "://") {
+				uri, err := url.Parse(name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "invalid URI %q: %s\n", name, err)
+					return -1
+				}
+				template.URIs = append(template.URIs, uri)
+			} else if strings.Contains(name, "@") {
+				template.EmailAddresses = append(template.EmailAddresses, name)
+			} else {
+				fmt.Fprintf(os.Stderr, "invalid name %q: the user certificates hold a common name followed by email addresses and URIs\n", name)
+				return -1
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, key.public, caKey.private)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the certificate: %s\n", err)
+		return -1
+	}
+	if err := writeCertificate(*output, der); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write %s: %s\n", *output, err)
+		return -1
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not parse the created certificate: %s\n", err)
+		return -1
+	}
+	fmt.Printf("Signed %s certificate %s: serial %x, subject %q, valid until %s\n", *certType, *output, cert.SerialNumber, cert.Subject.String(), cert.NotAfter.Format(time.RFC3339))
+	if *certType == "user" {
+		fmt.Printf("Map it onto local users with the mapping file line:\nsubject:%s <users>\n", cert.Subject.String())
+	}
+	return 0
+}
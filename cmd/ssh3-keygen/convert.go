@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/francoismichel/ssh3"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// returns the authorized_keys line of key, with its comment
+func authorizedKeyLine(key ssh.PublicKey, comment string) []byte {
+	line := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(key), []byte("\n"))
+	if comment != "" {
+		line = append(line, ' ')
+		line = append(line, comment...)
+	}
+	return append(line, '\n')
+}
+
+// encodes a private key in the OpenSSH or PKCS#8 PEM format, encrypted if passphrase is set
+func marshalPrivateKey(key crypto.Signer, format string, passphrase string, comment string) ([]byte, error) {
+	var block *pem.Block
+	var err error
+	switch format {
+	case "openssh":
+		if passphrase != "" {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(key, comment, []byte(passphrase))
+		} else {
+			block, err = ssh.MarshalPrivateKey(key, comment)
+		}
+	case "pkcs8":
+		if passphrase != "" {
+			block, err = ssh3.MarshalEncryptedPKCS8PrivateKey(key, []byte(passphrase))
+		} else {
+			var der []byte
+			der, err = x509.MarshalPKCS8PrivateKey(key)
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		}
+	default:
+		return nil, fmt.Errorf("unknown private key format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// encodes a public key in the OpenSSH (authorized_keys), PKCS#8 (PKIX) or JWK format
+func marshalPublicKey(public crypto.PublicKey, format string, comment string) ([]byte, error) {
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "openssh":
+		return authorizedKeyLine(sshPublic, comment), nil
+	case "pkcs8":
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	case "jwk":
+		return marshalJWK(public, sshPublic)
+	default:
+		return nil, fmt.Errorf("unknown public key format %q", format)
+	}
+}
+
+// encodes a public or private key as a JWK, identified by the SHA256 fingerprint of its public key
+func marshalJWK(key interface{}, sshPublic ssh.PublicKey) ([]byte, error) {
+	jwk, err := ssh3.NewJWK(key)
+	if err != nil {
+		return nil, err
+	}
+	jwk.Kid = ssh.FingerprintSHA256(sshPublic)
+	jwk.Use = "sig"
+	out, err := json.MarshalIndent(jwk, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// ssh3-keygen convert writes a key in another format: the private key if the input holds one and
+// -public is not set, the public key otherwise
+func runConvert(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen convert", flag.ContinueOnError)
+	filename := flags.String("f", "", "the key to convert: a private key, a public key or a JWK")
+	format := flags.String("format", "openssh", "the output format: openssh, pkcs8 or jwk")
+	public := flags.Bool("public", false, "only write the public key")
+	output := flags.String("o", "", "the output file (the standard output by default)")
+	passphrase := flags.String("P", "", "the passphrase of the input private key (prompted if needed and not set)")
+	newPassphrase := flags.String("N", "", "the passphrase encrypting the output private key, in the openssh and pkcs8 formats (empty for no passphrase)")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *filename == "" {
+		fmt.Fprintf(os.Stderr, "ssh3-keygen convert requires -f\n")
+		flags.Usage()
+		return -1
+	}
+	if *format != "openssh" && *format != "pkcs8" && *format != "jwk" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use openssh, pkcs8 or jwk\n", *format)
+		return -1
+	}
+	key, err := loadKey(*filename, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %s\n", *filename, err)
+		return -1
+	}
+
+	var out []byte
+	if key.private == nil || *public {
+		out, err = marshalPublicKey(key.public, *format, key.comment)
+	} else if *format == "jwk" {
+		if *newPassphrase != "" {
+			fmt.Fprintf(os.Stderr, "the JWK format cannot be encrypted, -N is not supported\n")
+			return -1
+		}
+		var sshPublic ssh.PublicKey
+		if sshPublic, err = ssh.NewPublicKey(key.public); err == nil {
+			out, err = marshalJWK(key.private, sshPublic)
+		}
+	} else {
+		out, err = marshalPrivateKey(key.private, *format, *newPassphrase, key.comment)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not convert %s: %s\n", *filename, err)
+		return -1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(out)
+		return 0
+	}
+	perm := os.FileMode(0644)
+	if key.private != nil && !*public {
+		perm = 0600
+	}
+	if err := writeNewFile(*output, out, perm); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write %s: %s\n", *output, err)
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/francoismichel/ssh3/util"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func keyBits(public crypto.PublicKey) int {
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		return 256
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	}
+	return 0
+}
+
+// ssh3-keygen fingerprint prints the fingerprint of a key as ssh-keygen -l does, e.g.
+// "256 SHA256:... alice@laptop (ED25519)"
+func runFingerprint(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen fingerprint", flag.ContinueOnError)
+	filename := flags.String("f", "", "the key or certificate: a private key, a public key, a JWK or a PEM certificate")
+	hash := flags.String("E", "sha256", "the hash of the fingerprint: sha256 or md5")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *filename == "" {
+		fmt.Fprintf(os.Stderr, "ssh3-keygen fingerprint requires -f\n")
+		flags.Usage()
+		return -1
+	}
+	if *hash != "sha256" && *hash != "md5" {
+		fmt.Fprintf(os.Stderr, "unknown fingerprint hash %q, use sha256 or md5\n", *hash)
+		return -1
+	}
+	// the fingerprint only needs the public key, read it next to the private key to avoid
+	// prompting for the passphrase
+	key, err := loadKey(*filename+".pub", nil)
+	if err != nil {
+		key, err = loadKey(*filename, nil)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load %s: %s\n", *filename, err)
+		return -1
+	}
+	sshPublic, err := ssh.NewPublicKey(key.public)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unsupported key in %s: %s\n", *filename, err)
+		return -1
+	}
+	fingerprint := ssh.FingerprintSHA256(sshPublic)
+	if *hash == "md5" {
+		fingerprint = "MD5:" + ssh.FingerprintLegacyMD5(sshPublic)
+	}
+	comment := key.comment
+	if comment == "" {
+		comment = "no comment"
+	}
+	fmt.Printf("%d %s %s (%s)\n", keyBits(key.public), fingerprint, comment, keyTypeName(key.public))
+	if key.certificate != nil {
+		// as displayed by the client when it does not trust the certificate of a server
+		fmt.Printf("certificate public key: SHA256 %s\n", util.Sha256Fingerprint(key.certificate.RawSubjectPublicKeyInfo))
+	}
+	return 0
+}
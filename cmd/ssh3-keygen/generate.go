@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// generates a private key of the given type and size, as ssh-keygen -t and -b
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		curves := map[int]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		if bits == 0 {
+			bits = 256
+		}
+		curve, ok := curves[bits]
+		if !ok {
+			return nil, fmt.Errorf("invalid ECDSA key size %d, use 256, 384 or 521", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("invalid RSA key size %d, use at least 2048 bits", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	default:
+		return nil, fmt.Errorf("unknown key type %q, use ed25519, ecdsa or rsa", keyType)
+	}
+}
+
+// the comment of the generated keys, user@host as ssh-keygen
+func defaultComment() string {
+	username := "unknown"
+	if u, err := osuser.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return username + "@" + hostname
+}
+
+// reads the passphrase of a new key twice on the terminal
+func readNewPassphrase() (string, error) {
+	passphrase, err := readSecret("Enter passphrase (empty for no passphrase): ")
+	if err != nil {
+		return "", err
+	}
+	confirmation, err := readSecret("Enter same passphrase again: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirmation {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// ssh3-keygen generate writes a new key pair: the private key in filename and the public key in
+// filename.pub, as an authorized_keys line
+func runGenerate(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen generate", flag.ContinueOnError)
+	keyType := flags.String("t", "ed25519", "the type of the key: ed25519, ecdsa or rsa")
+	bits := flags.Int("b", 0, "the size of the key: 256, 384 or 521 for ecdsa (256 by default), at least 2048 for rsa (3072 by default)")
+	filename := flags.String("f", "", "the file of the private key (~/.ssh/id_<type> by default), the public key is written in the same file with .pub appended")
+	passphrase := flags.String("N", "", "the passphrase encrypting the private key (prompted on the terminal if not set, empty for no passphrase)")
+	noPassphrase := flags.Bool("no-passphrase", false, "do not prompt for a passphrase, leaving the private key unencrypted unless -N is set")
+	comment := flags.String("C", defaultComment(), "the comment of the public key")
+	format := flags.String("format", "openssh", "the format of the private key: openssh or pkcs8")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *keyType == "ed25519" && *bits != 0 && *bits != 256 {
+		fmt.Fprintf(os.Stderr, "ed25519 keys have a fixed size of 256 bits\n")
+		return -1
+	}
+	if *format != "openssh" && *format != "pkcs8" {
+		fmt.Fprintf(os.Stderr, "unknown private key format %q, use openssh or pkcs8\n", *format)
+		return -1
+	}
+	if *filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not get the home directory, set -f: %s\n", err)
+			return -1
+		}
+		*filename = filepath.Join(home, ".ssh", "id_"+*keyType)
+	}
+	for _, f := range []string{*filename, *filename + ".pub"} {
+		if _, err := os.Stat(f); err == nil {
+			fmt.Fprintf(os.Stderr, "%s already exists, remove it or choose another file with -f\n", f)
+			return -1
+		}
+	}
+
+	fmt.Printf("Generating public/private %s key pair.\n", *keyType)
+	key, err := generateKey(*keyType, *bits)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate the key: %s\n", err)
+		return -1
+	}
+	passphraseSet := false
+	flags.Visit(func(f *flag.Flag) {
+		passphraseSet = passphraseSet || f.Name == "N"
+	})
+	if !passphraseSet && !*noPassphrase {
+		if *passphrase, err = readNewPassphrase(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not read the passphrase: %s\n", err)
+			return -1
+		}
+	}
+	privateBytes, err := marshalPrivateKey(key, *format, *passphrase, *comment)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not encode the private key: %s\n", err)
+		return -1
+	}
+	sshPublic, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not encode the public key: %s\n", err)
+		return -1
+	}
+	if err := os.MkdirAll(filepath.Dir(*filename), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the directory of %s: %s\n", *filename, err)
+		return -1
+	}
+	if err := writeNewFile(*filename, privateBytes, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the private key: %s\n", err)
+		return -1
+	}
+	fmt.Printf("Your identification has been saved in %s\n", *filename)
+	if err := writeNewFile(*filename+".pub", authorizedKeyLine(sshPublic, *comment), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the public key: %s\n", err)
+		return -1
+	}
+	fmt.Printf("Your public key has been saved in %s.pub\n", *filename)
+	fmt.Printf("The key fingerprint is:\n%s %s\n", ssh.FingerprintSHA256(sshPublic), *comment)
+	return 0
+}
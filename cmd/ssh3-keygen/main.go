@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const usage = `usage: ssh3-keygen <command> [options]
+
+commands:
+  generate     generates an ed25519, ECDSA or RSA key pair
+  fingerprint  prints the fingerprint of a key or certificate
+  convert      converts a key between the OpenSSH, PKCS#8 and JWK formats
+  ca           creates a self-signed certificate authority
+  sign         issues a host or user certificate signed by a certificate authority
+  totp         generates the one-time password secret of the second authentication factor
+  version      prints the version
+
+Run ssh3-keygen <command> -h for the options of a command.
+`
+
+func mainWithStatusCode() int {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return -1
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "generate":
+		return runGenerate(args)
+	case "fingerprint":
+		return runFingerprint(args)
+	case "convert":
+		return runConvert(args)
+	case "ca":
+		return runCA(args)
+	case "sign":
+		return runSign(args)
+	case "totp":
+		return runTOTP(args)
+	case "version", "-V", "--version":
+		fmt.Printf("ssh3-keygen %s (%s)\n", ssh3.ReleaseVersion(), ssh3.GetCurrentVersion())
+		return 0
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		fmt.Fprint(os.Stderr, usage)
+		return -1
+	}
+}
+
+// reads a secret on the terminal without echoing it
+func readSecret(prompt string) (string, error) {
+	in, out := os.Stdin, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	} else if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("cannot prompt %q without a terminal", prompt)
+	}
+	fmt.Fprint(out, prompt)
+	secret, err := term.ReadPassword(int(in.Fd()))
+	fmt.Fprintln(out)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// a key read by loadKey: the private key is nil if the file only holds a public key
+type loadedKey struct {
+	public  crypto.PublicKey
+	private crypto.Signer
+	comment string
+	// the certificate, if the file is a PEM certificate
+	certificate *x509.Certificate
+}
+
+// loads the private or public key stored in filename, in any format produced by ssh3-keygen:
+// an OpenSSH or PKCS#8 private key, prompting for its passphrase if none is given, an
+// authorized_keys line, a PKIX public key, a PEM certificate or a JWK. With a nil passphrase,
+// only the public key of the encrypted OpenSSH private keys is loaded.
+func loadKey(filename string, passphrase *string) (*loadedKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		jwk, err := ssh3.ParseJWK(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		public, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		key := &loadedKey{public: public, comment: jwk.Kid}
+		if jwk.IsPrivate() {
+			if key.private, err = jwk.PrivateKey(); err != nil {
+				return nil, err
+			}
+		}
+		return key, nil
+	}
+	if block, _ := pem.Decode(trimmed); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			public, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return &loadedKey{public: public}, nil
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return &loadedKey{public: cert.PublicKey, certificate: cert, comment: cert.Subject.CommonName}, nil
+		}
+		return loadPrivateKey(filename, data, passphrase)
+	}
+	sshPublic, comment, _, _, err := ssh.ParseAuthorizedKey(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("unknown key format")
+	}
+	cryptoPublic, ok := sshPublic.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %s", sshPublic.Type())
+	}
+	return &loadedKey{public: cryptoPublic.CryptoPublicKey(), comment: comment}, nil
+}
+
+func loadPrivateKey(filename string, pemBytes []byte, passphrase *string) (*loadedKey, error) {
+	key, err := ssh3.ParseRawPrivateKey(pemBytes)
+	if missing, ok := err.(*ssh.PassphraseMissingError); ok {
+		if cryptoPublic, ok := missing.PublicKey.(ssh.CryptoPublicKey); passphrase == nil && ok {
+			return withComment(filename, &loadedKey{public: cryptoPublic.CryptoPublicKey()}), nil
+		}
+		if passphrase == nil || *passphrase == "" {
+			p, err := readSecret(fmt.Sprintf("Enter passphrase for %s: ", filename))
+			if err != nil {
+				return nil, err
+			}
+			passphrase = &p
+		}
+		key, err = ssh3.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(*passphrase))
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return withComment(filename, &loadedKey{public: signer.Public(), private: signer}), nil
+}
+
+// sets the comment of the private key stored in filename, which is kept in the public key next
+// to it
+func withComment(filename string, key *loadedKey) *loadedKey {
+	if pubBytes, err := os.ReadFile(filename + ".pub"); err == nil {
+		if _, comment, _, _, err := ssh.ParseAuthorizedKey(pubBytes); err == nil {
+			key.comment = comment
+		}
+	}
+	return key
+}
+
+// returns the name of the type of the key, as printed by ssh-keygen
+func keyTypeName(public crypto.PublicKey) string {
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "UNKNOWN"
+	}
+	switch sshPublic.Type() {
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	default:
+		return "ECDSA"
+	}
+}
+
+// the string of a list flag, e.g. -names host.example.org,192.0.2.1
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// writes content to filename, refusing to overwrite an existing file
+func writeNewFile(filename string, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func main() {
+	os.Exit(mainWithStatusCode())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// ssh3-keygen totp generates the TOTP secret of the second authentication factor of the user,
+// written in ~/.ssh3/totp_secret by default, and prints the URI to enroll it in an authenticator app
+func runTOTP(args []string) int {
+	flags := flag.NewFlagSet("ssh3-keygen totp", flag.ContinueOnError)
+	filename := flags.String("f", "", "the file of the secret, ~/.ssh3/totp_secret by default")
+	issuer := flags.String("issuer", "ssh3", "the issuer displayed by the authenticator app, e.g. the name of the server")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	user, err := osuser.Current()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not get the current user: %s\n", err)
+		return -1
+	}
+	if *filename == "" {
+		*filename = filepath.Join(user.HomeDir, ".ssh3", "totp_secret")
+		if err := os.MkdirAll(filepath.Dir(*filename), 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "could not create %s: %s\n", filepath.Dir(*filename), err)
+			return -1
+		}
+	}
+	secret, err := ssh3.GenerateTOTPSecret()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not generate the secret: %s\n", err)
+		return -1
+	}
+	// the server refuses the secrets accessible by other users
+	if err := writeNewFile(*filename, []byte(secret+"\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the secret: %s\n", err)
+		return -1
+	}
+	fmt.Printf("Your TOTP secret has been saved in %s\n", *filename)
+	fmt.Printf("Enroll it in your authenticator app using the secret %s or the URI:\n", secret)
+	fmt.Println(ssh3.TOTPKeyURI(secret, user.Username, *issuer))
+	return 0
+}
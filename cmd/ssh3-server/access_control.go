@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// answers the conversation request with statusCode and message, then closes the conversation
+func refuseConversation(conv *ssh3.Conversation, w http.ResponseWriter, statusCode int, message string) {
+	w.WriteHeader(statusCode)
+	w.Write([]byte(message))
+	// the request stream was hijacked when creating the conversation, so it must be closed
+	// explicitly for the client to receive the end of the message
+	w.(http.Flusher).Flush()
+	conv.Close()
+}
+
+// answers the conversation request with statusCode and a disconnect message telling the client
+// why, then closes the conversation
+func disconnectConversation(conv *ssh3.Conversation, w http.ResponseWriter, statusCode int, disconnect ssh3.Disconnect) {
+	ssh3.WriteDisconnectResponse(w, statusCode, disconnect)
+	w.(http.Flusher).Flush()
+	conv.Close()
+}
+
+// refuses the conversations of the users not allowed by the access control config
+func accessControlHandler(handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.AuthenticatedHandlerFunc {
+	return func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+		if !settings().accessControl.AllowsUser(authenticatedUsername) {
+			log.Info().Msgf("refusing conversation of user %s: not allowed by the access control config", authenticatedUsername)
+			audit.Log(audit.Event{
+				Type:           audit.EventAccessDenied,
+				Username:       authenticatedUsername,
+				ConversationID: newConv.ConversationID().String(),
+				RemoteAddr:     r.RemoteAddr,
+				Details:        map[string]string{"reason": "access_control"},
+			})
+			disconnectConversation(newConv, w, http.StatusForbidden, ssh3.Disconnect{
+				ReasonCode:  ssh3Messages.SSH_DISCONNECT_BY_APPLICATION,
+				Description: fmt.Sprintf("user %s is not allowed to connect to this server", authenticatedUsername),
+				LanguageTag: "en",
+			})
+			return
+		}
+		handlerFunc(authenticatedUsername, newConv, w, r)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/francoismichel/ssh3/unix_server"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the maximum duration of the first issuance of the certificate, the server does not start before
+const acmeObtainTimeout = 5 * time.Minute
+
+// obtains the certificate of the server using ACME, unless a valid one is cached, and renews it in
+// the background. The HTTP-01 challenges are answered on a companion HTTP listener.
+func startACME(config *unix_server.ACMEConfig) (*unix_server.ACMEManager, error) {
+	manager, err := unix_server.NewACMEManager(config, egressHTTPClient())
+	if err != nil {
+		return nil, err
+	}
+	if config.Challenge != unix_server.ACMEChallengeDNS01 {
+		listener, err := net.Listen("tcp", config.ChallengeHTTPAddr())
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			err := http.Serve(listener, manager.HTTPHandler())
+			log.Error().Msgf("the listener of the ACME HTTP-01 challenges stopped: %s", err)
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeObtainTimeout)
+	defer cancel()
+	if err := manager.LoadOrObtain(ctx); err != nil {
+		return nil, err
+	}
+	go manager.RenewPeriodically(context.Background())
+	return manager, nil
+}
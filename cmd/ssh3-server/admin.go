@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog/log"
+)
+
+type activeConversation struct {
+	username     string
+	conversation *ssh3.Conversation
+	remoteAddr   string
+	startTime    time.Time
+}
+
+// keeps track of the authenticated conversations currently handled by the server
+type conversationsRegistry struct {
+	conversations map[ssh3.ConversationID]*activeConversation
+	lock          sync.Mutex
+}
+
+func newConversationsRegistry() *conversationsRegistry {
+	return &conversationsRegistry{conversations: make(map[ssh3.ConversationID]*activeConversation)}
+}
+
+func (r *conversationsRegistry) add(username string, conv *ssh3.Conversation, remoteAddr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.conversations[conv.ConversationID()] = &activeConversation{
+		username:     username,
+		conversation: conv,
+		remoteAddr:   remoteAddr,
+		startTime:    time.Now(),
+	}
+}
+
+func (r *conversationsRegistry) remove(conv *ssh3.Conversation) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.conversations, conv.ConversationID())
+}
+
+// returns nil if there is no such conversation
+func (r *conversationsRegistry) get(conversationID ssh3.ConversationID) *activeConversation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.conversations[conversationID]
+}
+
+func (r *conversationsRegistry) list() []*activeConversation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	conversations := make([]*activeConversation, 0, len(r.conversations))
+	for _, conv := range r.conversations {
+		conversations = append(conversations, conv)
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].startTime.Before(conversations[j].startTime)
+	})
+	return conversations
+}
+
+var activeConversations = newConversationsRegistry()
+
+type conversationStatsReport struct {
+	ConversationID string                    `json:"conversation_id"`
+	Username       string                    `json:"username"`
+	StartTime      time.Time                 `json:"start_time"`
+	Channels       []ssh3.ChannelStatsReport `json:"channels"`
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	var reports []conversationStatsReport
+	for _, conv := range activeConversations.list() {
+		reports = append(reports, conversationStatsReport{
+			ConversationID: conv.conversation.ConversationID().String(),
+			Username:       conv.username,
+			StartTime:      conv.startTime,
+			Channels:       conv.conversation.ChannelsStats(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reports); err != nil {
+		log.Error().Msgf("could not write stats on admin socket: %s", err)
+	}
+}
+
+type conversationReport struct {
+	ConversationID string    `json:"conversation_id"`
+	Username       string    `json:"username"`
+	RemoteAddr     string    `json:"remote_addr"`
+	StartTime      time.Time `json:"start_time"`
+	// the open channels and their traffic
+	Channels      int    `json:"channels"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+// lists the conversations along with the address of their client, without their channels
+func handleAdminConversations(w http.ResponseWriter, r *http.Request) {
+	reports := []conversationReport{}
+	for _, conv := range activeConversations.list() {
+		report := conversationReport{
+			ConversationID: conv.conversation.ConversationID().String(),
+			Username:       conv.username,
+			RemoteAddr:     conv.remoteAddr,
+			StartTime:      conv.startTime,
+		}
+		for _, channel := range conv.conversation.ChannelsStats() {
+			report.Channels++
+			report.BytesSent += channel.BytesSent
+			report.BytesReceived += channel.BytesReceived
+		}
+		reports = append(reports, report)
+	}
+	writeAdminResult(w, reports)
+}
+
+type forwardingReport struct {
+	Username string `json:"username"`
+	ssh3.ChannelStatsReport
+}
+
+// lists the TCP and UDP connections forwarded by the clients
+func handleAdminForwardings(w http.ResponseWriter, r *http.Request) {
+	reports := []forwardingReport{}
+	for _, conv := range activeConversations.list() {
+		for _, channel := range conv.conversation.ChannelsStats() {
+			// only the forwarding channels have a remote address
+			if channel.RemoteAddr != "" {
+				reports = append(reports, forwardingReport{Username: conv.username, ChannelStatsReport: channel})
+			}
+		}
+	}
+	writeAdminResult(w, reports)
+}
+
+type userReport struct {
+	Username      string `json:"username"`
+	Conversations int    `json:"conversations"`
+	Channels      int    `json:"channels"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+// sums the traffic of the open channels of the conversations of each user, sorted by username
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users := make(map[string]*userReport)
+	for _, conv := range activeConversations.list() {
+		report, ok := users[conv.username]
+		if !ok {
+			report = &userReport{Username: conv.username}
+			users[conv.username] = report
+		}
+		report.Conversations++
+		for _, channel := range conv.conversation.ChannelsStats() {
+			report.Channels++
+			report.BytesSent += channel.BytesSent
+			report.BytesReceived += channel.BytesReceived
+		}
+	}
+	reports := make([]userReport, 0, len(users))
+	for _, report := range users {
+		reports = append(reports, *report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Username < reports[j].Username
+	})
+	writeAdminResult(w, reports)
+}
+
+func writeAdminResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Error().Msgf("could not write result of %T on admin API: %s", result, err)
+	}
+}
+
+// listens on a UNIX socket only accessible by the user running the server
+func listenAdminSocket(socketPath string) (net.Listener, error) {
+	// remove a stale socket left by a previous run
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return util.ListenPrivateSocket(socketPath)
+}
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", handleAdminStats)
+	mux.HandleFunc("/conversations", handleAdminConversations)
+	mux.HandleFunc("/forwardings", handleAdminForwardings)
+	mux.HandleFunc("/users", handleAdminUsers)
+	mux.HandleFunc("/maintenance", handleAdminMaintenance)
+	mux.HandleFunc("/sessions/tail", handleAdminTail)
+	mux.HandleFunc("/broadcast", handleAdminBroadcast)
+	mux.HandleFunc("/conversations/terminate", handleAdminTerminate)
+	mux.HandleFunc("/config/reload", handleAdminReload)
+	return mux
+}
+
+// serves the admin API in background
+func serveAdmin(listener net.Listener) {
+	mux := newAdminMux()
+	go func() {
+		defer listener.Close()
+		if err := http.Serve(listener, mux); err != nil {
+			log.Error().Msgf("admin socket stopped serving: %s", err)
+		}
+	}()
+}
+
+// serves the admin API on a UNIX socket only accessible by the user running the server
+func serveAdminSocket(socketPath string) error {
+	listener, err := listenAdminSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	serveAdmin(listener)
+	return nil
+}
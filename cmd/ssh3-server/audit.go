@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+func auditChannelEvent(eventType string, username string, channel ssh3.Channel, details map[string]string) {
+	details["channel_type"] = channel.ChannelType()
+	audit.Log(audit.Event{
+		Type:           eventType,
+		Username:       username,
+		ConversationID: channel.ConversationID().String(),
+		ChannelID:      channel.ChannelID(),
+		Details:        details,
+	})
+}
+
+func auditResult(details map[string]string, err error) map[string]string {
+	if err != nil {
+		details["result"] = "failure"
+		details["error"] = err.Error()
+	} else {
+		details["result"] = "success"
+	}
+	return details
+}
+
+// returns the direction and paths of the file transfer performed by an scp command, if any
+func parseSCPCommand(command string) (direction string, paths []string, ok bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || path.Base(fields[0]) != "scp" {
+		return "", nil, false
+	}
+	for _, field := range fields[1:] {
+		switch {
+		case field == "-t":
+			direction = "upload"
+		case field == "-f":
+			direction = "download"
+		case field == "--":
+		case strings.HasPrefix(field, "-"):
+		default:
+			paths = append(paths, field)
+		}
+	}
+	return direction, paths, direction != ""
+}
+
+// records a channel request once it has been handled, err being the result of its handling
+func auditChannelRequest(username string, channel ssh3.Channel, request ssh3Messages.ChannelRequest, wantReply bool, err error) {
+	details := auditResult(map[string]string{
+		"request_type": request.RequestTypeStr(),
+		"want_reply":   strconv.FormatBool(wantReply),
+	}, err)
+	if session, ok := runningSessions.get(channel); ok && session.forcedCommand != "" {
+		switch request.(type) {
+		case *ssh3Messages.ShellRequest, *ssh3Messages.ExecRequest, *ssh3Messages.ExecArgvRequest, *ssh3Messages.SubsystemRequest:
+			details["forced_command"] = session.forcedCommand
+		}
+	}
+	switch r := request.(type) {
+	case *ssh3Messages.ExecRequest:
+		details["command"] = r.Command
+		auditChannelEvent(audit.EventExec, username, channel, details)
+		if direction, paths, ok := parseSCPCommand(r.Command); ok {
+			auditChannelEvent(audit.EventFileTransfer, username, channel, auditResult(map[string]string{
+				"protocol":  "scp",
+				"direction": direction,
+				"paths":     strings.Join(paths, " "),
+			}, err))
+		}
+	case *ssh3Messages.ExecArgvRequest:
+		details["command"] = r.Command()
+		details["argv"] = "true"
+		auditChannelEvent(audit.EventExec, username, channel, details)
+	case *ssh3Messages.SubsystemRequest:
+		details["subsystem"] = r.SubsystemName
+		auditChannelEvent(audit.EventSubsystem, username, channel, details)
+	case *ssh3Messages.PtyRequest:
+		details["term"] = r.Term
+		auditChannelEvent(audit.EventChannelRequest, username, channel, details)
+	case *ssh3Messages.SignalRequest:
+		details["signal"] = r.SignalNameWithoutSig
+		auditChannelEvent(audit.EventChannelRequest, username, channel, details)
+	case *ssh3Messages.WorkingDirectoryRequest:
+		details["directory"] = r.Directory
+		auditChannelEvent(audit.EventChannelRequest, username, channel, details)
+	case *ssh3Messages.ReattachRequest:
+		details["session_id"] = r.SessionID
+		auditChannelEvent(audit.EventChannelRequest, username, channel, details)
+	default:
+		auditChannelEvent(audit.EventChannelRequest, username, channel, details)
+	}
+}
+
+func auditForward(username string, channel ssh3.Channel, protocol string, target fmt.Stringer, err error) {
+	auditChannelEvent(audit.EventForward, username, channel, auditResult(map[string]string{
+		"protocol": protocol,
+		"target":   target.String(),
+	}, err))
+}
+
+func verifyAuditLog(filename string) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open audit log: %s\n", err)
+		return -1
+	}
+	defer file.Close()
+	records, err := audit.Verify(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return 1
+	}
+	fmt.Printf("%s: %d records verified\n", filename, records)
+	return 0
+}
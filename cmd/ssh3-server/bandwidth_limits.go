@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/rs/zerolog/log"
+)
+
+var bandwidthLimits []unix_server.BandwidthLimitConfig
+
+// the limiters of the users whose bandwidth is limited, shared by all their conversations
+var userBandwidthLimiters = struct {
+	lock     sync.Mutex
+	limiters map[string]*ssh3.BandwidthLimiter
+}{limiters: make(map[string]*ssh3.BandwidthLimiter)}
+
+// returns the bandwidth limiter of the user, nil if its bandwidth is not limited
+func userBandwidthLimiter(username string) *ssh3.BandwidthLimiter {
+	config, ok := unix_server.BandwidthLimits(bandwidthLimits, username)
+	if !ok {
+		return nil
+	}
+	// the rates have been checked when loading the config
+	download, upload, err := config.Rates()
+	if err != nil || download == 0 && upload == 0 {
+		return nil
+	}
+	userBandwidthLimiters.lock.Lock()
+	defer userBandwidthLimiters.lock.Unlock()
+	limiter, ok := userBandwidthLimiters.limiters[username]
+	if !ok {
+		log.Debug().Msgf("limiting the bandwidth of user %s to %d B/s down and %d B/s up", username, download, upload)
+		limiter = ssh3.NewBandwidthLimiter(download, upload)
+		userBandwidthLimiters.limiters[username] = limiter
+	}
+	return limiter
+}
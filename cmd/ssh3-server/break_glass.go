@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/store"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+var errBreakGlassRateLimited = errors.New("too many break-glass tokens issued in the last hour")
+
+type breakGlassToken struct {
+	Username string    `json:"username"`
+	Reason   string    `json:"reason"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+const (
+	// followed by the hex SHA-256 hash of the tokens
+	breakGlassTokensKeyPrefix = "break-glass/tokens/"
+	// one key per token issued in the last hour
+	breakGlassIssuesKeyPrefix = "break-glass/issues/"
+)
+
+// the one-time tokens issued on the break-glass socket, kept in the store
+type breakGlassTokens struct {
+	config *unix_server.BreakGlassConfig
+	store  store.Store
+	// serializes the rate limiting of the tokens issued by this server
+	lock sync.Mutex
+}
+
+func newBreakGlassTokens(config *unix_server.BreakGlassConfig, store store.Store) *breakGlassTokens {
+	return &breakGlassTokens{config: config, store: store}
+}
+
+func breakGlassTokenKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return breakGlassTokensKeyPrefix + hex.EncodeToString(hash[:])
+}
+
+// returns a new token authenticating the user once
+func (t *breakGlassTokens) issue(ctx context.Context, username string, reason string, now time.Time) (string, time.Time, error) {
+	if !t.config.AllowsUser(username) {
+		return "", time.Time{}, fmt.Errorf("break-glass tokens cannot be issued for user %s", username)
+	}
+	if _, err := unix_util.GetUser(username); err != nil {
+		return "", time.Time{}, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	recentIssues, err := t.store.Count(ctx, breakGlassIssuesKeyPrefix)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if recentIssues >= t.config.MaxTokens() {
+		return "", time.Time{}, errBreakGlassRateLimited
+	}
+	secret := make([]byte, 32)
+	issueID := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err := rand.Read(issueID); err != nil {
+		return "", time.Time{}, err
+	}
+	token := unix_server.BreakGlassTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	expiry := now.Add(t.config.TokenLifetime())
+	issued, err := json.Marshal(breakGlassToken{Username: username, Reason: reason, Expiry: expiry})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// the issue is counted even if the token cannot be stored
+	if err := t.store.Put(ctx, breakGlassIssuesKeyPrefix+hex.EncodeToString(issueID), nil, time.Hour); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := t.store.Put(ctx, breakGlassTokenKey(token), issued, t.config.TokenLifetime()); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiry, nil
+}
+
+// consumes the token, returns false if it is not valid for the user
+func (t *breakGlassTokens) redeem(ctx context.Context, username string, token string, now time.Time) (breakGlassToken, bool) {
+	// also burnt when presented for another user
+	stored, err := t.store.Take(ctx, breakGlassTokenKey(token))
+	if errors.Is(err, store.ErrNotFound) {
+		return breakGlassToken{}, false
+	} else if err != nil {
+		log.Error().Msgf("could not redeem break-glass token: %s", err)
+		return breakGlassToken{}, false
+	}
+	var issued breakGlassToken
+	if err := json.Unmarshal(stored, &issued); err != nil {
+		log.Error().Msgf("could not parse stored break-glass token: %s", err)
+		return breakGlassToken{}, false
+	}
+	return issued, issued.Username == username && now.Before(issued.Expiry)
+}
+
+// the identity verified by a break-glass token
+type breakGlassIdentity struct{}
+
+func (breakGlassIdentity) Verify(candidate interface{}, base64ConversationID string) bool {
+	// the token has already been redeemed
+	return false
+}
+
+// authenticates the break-glass tokens, the other credentials being handled by Authenticator
+type breakGlassAuthenticator struct {
+	unix_server.Authenticator
+	tokens *breakGlassTokens
+}
+
+func (a breakGlassAuthenticator) AuthenticateBearer(requestedUsername string, user *unix_util.User, bearer string, base64ConversationID string) (unix_server.Identity, error) {
+	if !unix_server.IsBreakGlassToken(bearer) {
+		return a.Authenticator.AuthenticateBearer(requestedUsername, user, bearer, base64ConversationID)
+	}
+	token, ok := a.tokens.redeem(context.Background(), user.Username, bearer, time.Now())
+	if !ok {
+		log.Warn().Msgf("refused an invalid break-glass token for user %s", user.Username)
+		return nil, nil
+	}
+	log.Warn().Msgf("user %s authenticated using a break-glass token: %s", user.Username, token.Reason)
+	audit.Log(audit.Event{
+		Type:           audit.EventBreakGlass,
+		Username:       user.Username,
+		ConversationID: base64ConversationID,
+		Details:        map[string]string{"action": "redeem", "reason": token.Reason},
+	})
+	return breakGlassIdentity{}, nil
+}
+
+type breakGlassTokenRequest struct {
+	Username string `json:"username"`
+	// the justification of the emergency access, recorded in the audit log
+	Reason string `json:"reason"`
+}
+
+type breakGlassTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type peerCredentialsKey struct{}
+
+// the process connected to the break-glass socket
+type peerCredentials struct {
+	uid int
+	pid int
+}
+
+// POST {"username": "...", "reason": "..."} issues a token for the user
+func (t *breakGlassTokens) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	peer, _ := r.Context().Value(peerCredentialsKey{}).(peerCredentials)
+	var request breakGlassTokenRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Username == "" || request.Reason == "" {
+		http.Error(w, "the username and the reason are required", http.StatusBadRequest)
+		return
+	}
+	details := map[string]string{
+		"action":   "issue",
+		"reason":   request.Reason,
+		"peer_uid": strconv.Itoa(peer.uid),
+		"peer_pid": strconv.Itoa(peer.pid),
+	}
+	token, expiry, err := t.issue(r.Context(), request.Username, request.Reason, time.Now())
+	if err != nil {
+		details["result"] = "failure"
+		details["error"] = err.Error()
+	} else {
+		details["result"] = "success"
+		details["expires_at"] = expiry.UTC().Format(time.RFC3339)
+	}
+	audit.Log(audit.Event{Type: audit.EventBreakGlass, Username: request.Username, Details: details})
+	if errors.Is(err, errBreakGlassRateLimited) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Warn().Msgf("issued a break-glass token for user %s to pid %d: %s", request.Username, peer.pid, request.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(breakGlassTokenResponse{Token: token, ExpiresAt: expiry}); err != nil {
+		log.Error().Msgf("could not write the break-glass token: %s", err)
+	}
+}
+
+// only accepts the connections of root
+type rootOnlyListener struct {
+	net.Listener
+}
+
+type peerConn struct {
+	net.Conn
+	peer peerCredentials
+}
+
+func (l rootOnlyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		peer, err := getPeerCredentials(conn.(*net.UnixConn))
+		if err != nil {
+			log.Error().Msgf("could not get the credentials of the break-glass socket peer: %s", err)
+			conn.Close()
+			continue
+		}
+		if peer.uid != 0 {
+			log.Warn().Msgf("refused a break-glass socket connection from uid %d (pid %d)", peer.uid, peer.pid)
+			audit.Log(audit.Event{Type: audit.EventBreakGlass, Details: map[string]string{
+				"action":   "connect",
+				"result":   "failure",
+				"peer_uid": strconv.Itoa(peer.uid),
+				"peer_pid": strconv.Itoa(peer.pid),
+			}})
+			conn.Close()
+			continue
+		}
+		return peerConn{Conn: conn, peer: peer}, nil
+	}
+}
+
+// serves the break-glass socket in background, returns the tokens it issues in store
+func serveBreakGlassSocket(config *unix_server.BreakGlassConfig, store store.Store) (*breakGlassTokens, error) {
+	if err := checkPeerCredentialsSupport(); err != nil {
+		return nil, err
+	}
+	listener, err := listenAdminSocket(config.Socket)
+	if err != nil {
+		return nil, err
+	}
+	tokens := newBreakGlassTokens(config, store)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokens", tokens.handleTokens)
+	server := &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, peerCredentialsKey{}, conn.(peerConn).peer)
+		},
+	}
+	go func() {
+		defer listener.Close()
+		if err := server.Serve(rootOnlyListener{Listener: listener}); err != nil {
+			log.Error().Msgf("break-glass socket stopped serving: %s", err)
+		}
+	}()
+	return tokens, nil
+}
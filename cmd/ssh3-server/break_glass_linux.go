@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func checkPeerCredentialsSupport() error {
+	return nil
+}
+
+func getPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	var ucred *unix.Ucred
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockoptErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	if sockoptErr != nil {
+		return peerCredentials{}, sockoptErr
+	}
+	return peerCredentials{uid: int(ucred.Uid), pid: int(ucred.Pid)}, nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// the peers of the break-glass socket must be identified to only accept root
+func checkPeerCredentialsSupport() error {
+	return fmt.Errorf("the break-glass socket is not supported on %s", runtime.GOOS)
+}
+
+func getPeerCredentials(conn *net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, checkPeerCredentialsSupport()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// the time given to a terminal to accept a message before it is skipped
+const terminalWriteTimeout = time.Second
+
+// the time given to the output of the terminals to carry the reason of a termination to the clients
+const terminationNoticeDelay = 500 * time.Millisecond
+
+// the pty of a running command, and the conversation it is attached to
+type terminal struct {
+	conversationID ssh3.ConversationID
+	username       string
+}
+
+// keeps track of the ptys of the running commands, so that the admin can write on them
+type terminalsRegistry struct {
+	lock      sync.Mutex
+	terminals map[*openPty]terminal
+}
+
+var terminals = &terminalsRegistry{terminals: make(map[*openPty]terminal)}
+
+func (r *terminalsRegistry) add(p *openPty, conversationID ssh3.ConversationID, username string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.terminals[p] = terminal{conversationID: conversationID, username: username}
+}
+
+func (r *terminalsRegistry) remove(p *openPty) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.terminals, p)
+}
+
+// moves the pty to the conversation of the channel it was reattached to
+func (r *terminalsRegistry) move(p *openPty, conversationID ssh3.ConversationID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if t, ok := r.terminals[p]; ok {
+		t.conversationID = conversationID
+		r.terminals[p] = t
+	}
+}
+
+// writes the message on the terminals of the conversation, or on every terminal if conversationID
+// is nil, and returns the number of terminals written
+func (r *terminalsRegistry) write(conversationID *ssh3.ConversationID, message string) int {
+	r.lock.Lock()
+	var ptys []*openPty
+	for p, t := range r.terminals {
+		if conversationID == nil || t.conversationID == *conversationID {
+			ptys = append(ptys, p)
+		}
+	}
+	r.lock.Unlock()
+	written := 0
+	for _, p := range ptys {
+		if err := p.writeTerminal(message); err != nil {
+			log.Warn().Msgf("could not write on a terminal: %s", err)
+			continue
+		}
+		written++
+	}
+	return written
+}
+
+// formats the message as wall does, the pty turning the line feeds into line breaks
+func wallMessage(message string) string {
+	message = strings.TrimRight(message, "\n")
+	return fmt.Sprintf("\nBroadcast message from ssh3-server (%s):\n\n%s\n\n", time.Now().Format(time.ANSIC), message)
+}
+
+type broadcastRequest struct {
+	Message string `json:"message"`
+}
+
+type broadcastResult struct {
+	Terminals int `json:"terminals"`
+}
+
+// POST {"message": "..."} writes the message on the terminal of every session with a pty, e.g.
+// before a maintenance window
+func handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request broadcastRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Message == "" {
+		http.Error(w, "empty message", http.StatusBadRequest)
+		return
+	}
+	written := terminals.write(nil, wallMessage(request.Message))
+	log.Info().Msgf("broadcast a message on %d terminals using the admin socket", written)
+	audit.Log(audit.Event{
+		Type:    audit.EventAdmin,
+		Details: map[string]string{"action": "broadcast", "message": request.Message, "terminals": fmt.Sprint(written)},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(broadcastResult{Terminals: written}); err != nil {
+		log.Error().Msgf("could not write broadcast result on admin socket: %s", err)
+	}
+}
+
+type terminateRequest struct {
+	// either the conversation to end or the user whose conversations all end
+	ConversationID string `json:"conversation_id"`
+	Username       string `json:"username"`
+	// if set, written on the terminals of the conversations before they end
+	Reason string `json:"reason"`
+}
+
+// POST {"conversation_id": "...", "reason": "..."} ends the conversation listed on /stats along
+// with all its channels, and POST {"username": "...", "reason": "..."} all those of the user
+func handleAdminTerminate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request terminateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var conversations []*activeConversation
+	switch {
+	case request.ConversationID != "" && request.Username != "":
+		http.Error(w, "both a conversation and a user to terminate", http.StatusBadRequest)
+		return
+	case request.Username != "":
+		for _, conv := range activeConversations.list() {
+			if conv.username == request.Username {
+				conversations = append(conversations, conv)
+			}
+		}
+		if len(conversations) == 0 {
+			http.Error(w, "no conversation of this user", http.StatusNotFound)
+			return
+		}
+	default:
+		conversationID, err := parseConversationID(request.ConversationID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conv := activeConversations.get(conversationID)
+		if conv == nil {
+			http.Error(w, "no such conversation", http.StatusNotFound)
+			return
+		}
+		conversations = append(conversations, conv)
+	}
+	if request.Reason != "" {
+		written := 0
+		for _, conv := range conversations {
+			conversationID := conv.conversation.ConversationID()
+			written += terminals.write(&conversationID, fmt.Sprintf("\nConnection terminated by the administrator: %s\n", request.Reason))
+		}
+		if written > 0 {
+			time.Sleep(terminationNoticeDelay)
+		}
+	}
+	for _, conv := range conversations {
+		terminateConversation(conv, request.Reason)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func terminateConversation(conv *activeConversation, reason string) {
+	conversationID := conv.conversation.ConversationID()
+	log.Info().Msgf("terminating conversation %s of %s using the admin API", conversationID, conv.username)
+	audit.Log(audit.Event{
+		Type:           audit.EventAdmin,
+		Username:       conv.username,
+		ConversationID: conversationID.String(),
+		Details:        map[string]string{"action": "terminate", "reason": reason},
+	})
+	description := "terminated by the administrator"
+	if reason != "" {
+		description += ": " + reason
+	}
+	channels := conv.conversation.Channels()
+	// the disconnect message is sent first, the clients only notice the end of the conversation
+	// once its channels end
+	if err := conv.conversation.Disconnect(ssh3.Disconnect{ReasonCode: ssh3Messages.SSH_DISCONNECT_BY_APPLICATION, Description: description, LanguageTag: "en"}); err != nil {
+		log.Debug().Msgf("could not send the disconnect message of conversation %s: %s", conversationID, err)
+	}
+	for _, channel := range channels {
+		channel.CancelRead()
+		channel.Close()
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// the executables serving the channels of extension types, by channel type
+var channelPlugins map[string]string
+
+// the channel types accepted by the server, advertised to the clients
+func acceptedChannelTypes() []string {
+	types := []string{"session", "direct-tcp"}
+	// the egress proxy only relays TCP connections
+	if egressDialer == nil {
+		types = append(types, "direct-udp")
+	}
+	for channelType := range channelPlugins {
+		types = append(types, channelType)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// refuses the channels of unknown types
+func channelTypeFilter(channel ssh3.Channel) *ssh3.ChannelOpenFailure {
+	// the UDP forwarding channels are refused by the forwarding filter when they are not
+	// accepted, e.g. for older clients ignoring the advertised channel types
+	if !slices.Contains(acceptedChannelTypes(), channel.ChannelType()) && channel.ChannelType() != "direct-udp" {
+		return ssh3.UnsupportedChannelType(channel.ChannelType())
+	}
+	return nil
+}
+
+// runs the plugin of the channel type as the user, unless a command is forced
+func newChannelPlugin(user *unix_util.User, channel ssh3.Channel) error {
+	plugin := channelPlugins[channel.ChannelType()]
+	forced, err := newForcedCommand(user, channel, "")
+	if !forced {
+		session, _ := runningSessions.get(channel)
+		session.env = append(session.env, "SSH3_CHANNEL_TYPE="+channel.ChannelType())
+		err = newCommand(user, channel, false, plugin)
+	}
+	auditChannelEvent(audit.EventChannelPlugin, user.Username, channel, auditResult(map[string]string{"plugin": plugin}, err))
+	return err
+}
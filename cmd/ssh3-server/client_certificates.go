@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the maximum duration of the revocation check of a client certificate
+const clientCertificateRevocationTimeout = 10 * time.Second
+
+// authenticates the client certificates using the mapping file once their revocation status has
+// been checked, the other credentials being handled by Authenticator
+type clientCertificateAuthenticator struct {
+	unix_server.Authenticator
+	config *unix_server.ClientCertificatesConfig
+}
+
+func (a clientCertificateAuthenticator) AuthenticateCertificate(username string, chain []*x509.Certificate) (bool, error) {
+	cert := chain[0]
+	mapping, err := unix_server.LoadCertificateMapping(a.config.MappingFile)
+	if err != nil {
+		return false, err
+	}
+	if !mapping.Allows(cert, username) {
+		log.Warn().Msgf("the client certificate %q is not mapped onto user %s", cert.Subject, username)
+		return false, nil
+	}
+	checker, err := a.config.RevocationChecker(egressHTTPClient())
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clientCertificateRevocationTimeout)
+	defer cancel()
+	if err := checker.Check(ctx, chain, nil); err != nil {
+		log.Warn().Msgf("refusing the client certificate of user %s: %s", username, err)
+		return false, nil
+	}
+	if _, err := unix_util.GetUser(username); err != nil {
+		return false, err
+	}
+	return true, nil
+}
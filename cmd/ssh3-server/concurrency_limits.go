@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/rs/zerolog/log"
+)
+
+var concurrencyLimits unix_server.ConcurrencyLimitsConfig
+
+// counts the conversations of each user, from their authentication to their end
+type userConversations struct {
+	counts map[string]int
+	lock   sync.Mutex
+}
+
+var conversationsPerUser = &userConversations{counts: make(map[string]int)}
+
+// reserves a conversation of the user, returns false if the user has too many of them
+func (u *userConversations) admit(username string, maxConversations int) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if maxConversations > 0 && u.counts[username] >= maxConversations {
+		return false
+	}
+	u.counts[username] += 1
+	return true
+}
+
+func (u *userConversations) release(username string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.counts[username] -= 1
+	if u.counts[username] <= 0 {
+		delete(u.counts, username)
+	}
+}
+
+// refuses the conversations of the users having too many of them
+func conversationLimitHandler(handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.AuthenticatedHandlerFunc {
+	return func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+		maxConversations := concurrencyLimits.MaxConversationsPerUser
+		if !conversationsPerUser.admit(authenticatedUsername, maxConversations) {
+			log.Info().Msgf("refusing conversation of user %s: too many conversations (maximum %d)", authenticatedUsername, maxConversations)
+			audit.Log(audit.Event{
+				Type:           audit.EventAccessDenied,
+				Username:       authenticatedUsername,
+				ConversationID: newConv.ConversationID().String(),
+				RemoteAddr:     r.RemoteAddr,
+				Details:        map[string]string{"reason": "max_conversations"},
+			})
+			refuseConversation(newConv, w, http.StatusServiceUnavailable,
+				fmt.Sprintf("Too many simultaneous connections for user %s (maximum %d), please close one of them first.", authenticatedUsername, maxConversations))
+			return
+		}
+		go func() {
+			// the conversation is closed when it ends, as when it is refused by the next handlers
+			<-newConv.Context().Done()
+			conversationsPerUser.release(authenticatedUsername)
+		}()
+		handlerFunc(authenticatedUsername, newConv, w, r)
+	}
+}
+
+// refuses the channels exceeding the maximum number of channels of the conversation
+func channelLimitFilter(conv interface{ Channels() []ssh3.Channel }) ssh3.ChannelOpenFilter {
+	return func(channel ssh3.Channel) *ssh3.ChannelOpenFailure {
+		// the channel being opened is already part of the channels of the conversation
+		maxChannels := concurrencyLimits.MaxChannelsPerConversation
+		if maxChannels > 0 && len(conv.Channels()) > maxChannels {
+			return &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE,
+				ErrorMsg: fmt.Sprintf("too many open channels (maximum %d)", maxChannels)}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// a conversation holding open channels
+type openChannels int
+
+func (c openChannels) Channels() []ssh3.Channel {
+	return make([]ssh3.Channel, c)
+}
+
+var _ = Describe("Concurrency limits", func() {
+	Context("Conversations per user", func() {
+		var conversations *userConversations
+
+		BeforeEach(func() {
+			conversations = &userConversations{counts: make(map[string]int)}
+		})
+
+		It("Admits the conversations of each user up to the maximum", func() {
+			Expect(conversations.admit("alice", 2)).To(BeTrue())
+			Expect(conversations.admit("alice", 2)).To(BeTrue())
+			Expect(conversations.admit("alice", 2)).To(BeFalse())
+			// the other users are counted apart
+			Expect(conversations.admit("bob", 2)).To(BeTrue())
+			Expect(conversations.counts).To(Equal(map[string]int{"alice": 2, "bob": 1}))
+		})
+
+		It("Admits a new conversation once another one is released", func() {
+			Expect(conversations.admit("alice", 1)).To(BeTrue())
+			Expect(conversations.admit("alice", 1)).To(BeFalse())
+			conversations.release("alice")
+			Expect(conversations.counts).To(BeEmpty())
+			Expect(conversations.admit("alice", 1)).To(BeTrue())
+		})
+
+		It("Counts the conversations without maximum", func() {
+			for i := 0; i < 5; i++ {
+				Expect(conversations.admit("alice", 0)).To(BeTrue())
+			}
+			Expect(conversations.counts["alice"]).To(Equal(5))
+			// a lower maximum set by a reload applies to the ongoing conversations
+			Expect(conversations.admit("alice", 3)).To(BeFalse())
+			for i := 0; i < 5; i++ {
+				conversations.release("alice")
+			}
+			Expect(conversations.counts).To(BeEmpty())
+		})
+
+		It("Never admits more conversations than the maximum concurrently", func() {
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			admitted := 0
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if conversations.admit("alice", 10) {
+						lock.Lock()
+						admitted += 1
+						lock.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(admitted).To(Equal(10))
+			Expect(conversations.counts["alice"]).To(Equal(10))
+		})
+	})
+
+	Context("Channels per conversation", func() {
+		BeforeEach(func() {
+			previousLimits := concurrencyLimits
+			DeferCleanup(func() { concurrencyLimits = previousLimits })
+		})
+
+		It("Counts the channel being opened along with the open ones", func() {
+			concurrencyLimits.MaxChannelsPerConversation = 2
+			Expect(channelLimitFilter(openChannels(2))(nil)).To(BeNil())
+			failure := channelLimitFilter(openChannels(3))(nil)
+			Expect(failure).ToNot(BeNil())
+			Expect(failure.ReasonCode).To(BeEquivalentTo(ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE))
+			Expect(failure.ErrorMsg).To(ContainSubstring("maximum 2"))
+		})
+
+		It("Does not limit the channels without maximum", func() {
+			concurrencyLimits.MaxChannelsPerConversation = 0
+			Expect(channelLimitFilter(openChannels(100))(nil)).To(BeNil())
+		})
+	})
+})
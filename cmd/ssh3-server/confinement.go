@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/francoismichel/ssh3/sandbox"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+var confinements []unix_server.ConfinementConfig
+
+// applies the confinement of the server config matching the user, if any, to cmd before it is started
+func confineCommand(user *unix_util.User, cmd *exec.Cmd) error {
+	confinement, ok := unix_server.Confinement(confinements, user.Username)
+	if !ok {
+		return nil
+	}
+	chrootDirectory := ""
+	if confinement.ChrootDirectory != "" {
+		var err error
+		chrootDirectory, err = unix_server.ExpandChrootDirectory(confinement.ChrootDirectory, user.Username, user.Dir)
+		if err != nil {
+			return err
+		}
+		if err := unix_server.CheckChrootDirectory(chrootDirectory); err != nil {
+			return fmt.Errorf("refusing to chroot user %s: %w", user.Username, err)
+		}
+	}
+	if confinement.Sandbox == nil {
+		log.Debug().Msgf("chrooting the session of user %s in %s", user.Username, chrootDirectory)
+		return user.Chroot(cmd, chrootDirectory)
+	}
+	if chrootDirectory != "" {
+		cmd.Dir = user.ChrootWorkingDir(chrootDirectory)
+	}
+	log.Debug().Msgf("sandboxing the session of user %s (chroot directory: %q)", user.Username, chrootDirectory)
+	return sandbox.Wrap(cmd, sandbox.Config{
+		ChrootDirectory: chrootDirectory,
+		AllowNetwork:    confinement.Sandbox.AllowNetwork,
+	})
+}
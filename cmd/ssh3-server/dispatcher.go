@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// returns the dispatcher of the channels of the conversation of the authenticated user, refusing
+// the channels that are not accepted and auditing the channel requests
+func newConversationDispatcher(conv *ssh3.Conversation, username string, user *unix_util.User, quota *forwardingQuota) *ssh3.ChannelDispatcher {
+	d := ssh3.NewChannelDispatcher()
+	d.ReplyToRequests(conv.PeerExtInfo())
+	d.AddChannelOpenFilter(channelLimitFilter(conv))
+	d.AddChannelOpenFilter(channelTypeFilter)
+	d.AddChannelOpenFilter(forwardingChannelFilter(conv.Context(), username, quota))
+
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.PtyRequest, wantReply bool) error {
+		return newPtyReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.X11Request, wantReply bool) error {
+		return newX11Req(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ShellRequest, wantReply bool) error {
+		return newShellReq(user, channel, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExecRequest, wantReply bool) error {
+		return newCommandInShellReq(user, channel, wantReply, request.Command)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExecArgvRequest, wantReply bool) error {
+		return newExecArgvReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.SubsystemRequest, wantReply bool) error {
+		return newSubsystemReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.WorkingDirectoryRequest, wantReply bool) error {
+		return newWorkingDirectoryReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.WindowChangeRequest, wantReply bool) error {
+		return newWindowChangeReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.BreakRequest, wantReply bool) error {
+		return newBreakReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.SignalRequest, wantReply bool) error {
+		return newSignalReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExitStatusRequest, wantReply bool) error {
+		return newExitStatusReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExitSignalRequest, wantReply bool) error {
+		return newExitSignalReq(user, channel, *request, wantReply)
+	})
+	ssh3.HandleChannelRequest(d, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ReattachRequest, wantReply bool) error {
+		return newReattachReq(user, channel, *request, wantReply)
+	})
+	d.AddPostRequestHook(func(ctx context.Context, channel ssh3.Channel, message *ssh3Messages.ChannelRequestMessage, err error) {
+		auditChannelRequest(username, channel, message.ChannelRequest, message.WantReply, err)
+	})
+
+	d.HandleEOF(ssh3.EOFHandlerFunc(func(ctx context.Context, channel ssh3.Channel) error {
+		return newEOFReq(user, channel)
+	}))
+	d.HandleData(ssh3.DataHandlerFunc(func(ctx context.Context, channel ssh3.Channel, message *ssh3Messages.DataOrExtendedDataMessage) error {
+		runningSession, ok := runningSessions.get(channel)
+		if !ok || runningSession.channelState != LARVAL {
+			return newDataReq(user, channel, *message)
+		}
+		if message.Data != "forward-agent" {
+			// invalid data on larval state
+			return fmt.Errorf("invalid data on ssh channel with LARVAL state")
+		}
+		var err error
+		runningSession.authAgentSocketPath, err = openAgentSocketAndForwardAgent(conv.Context(), conv, user)
+		return err
+	}))
+	return d
+}
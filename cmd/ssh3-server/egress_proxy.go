@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+// if set, all the forwarded TCP connections go through the egress proxy
+var egressDialer *unix_server.EgressDialer
+
+// returns the client of the outgoing HTTP requests of the server, e.g. to the ACME and OCSP
+// servers, going through the egress proxy if any, nil for http.DefaultClient
+func egressHTTPClient() *http.Client {
+	if egressDialer != nil {
+		return egressDialer.HTTPClient()
+	}
+	return nil
+}
+
+// the forwarded TCP connections are half-closed when either side stops writing
+type halfClosableConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+func dialForwardedTCP(ctx context.Context, address string) (halfClosableConn, error) {
+	var conn net.Conn
+	var err error
+	if egressDialer != nil {
+		conn, err = egressDialer.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	halfClosable, ok := conn.(halfClosableConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("the connection to %s cannot be half-closed (%T)", address, conn)
+	}
+	return halfClosable, nil
+}
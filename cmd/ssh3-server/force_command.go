@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+// the forced commands of the conversations, set when authenticating them
+// and taken by their handler
+type forcedCommandsRegistry struct {
+	commands map[ssh3.ConversationID]string
+	lock     sync.Mutex
+}
+
+var forcedCommands = &forcedCommandsRegistry{commands: make(map[ssh3.ConversationID]string)}
+
+func (r *forcedCommandsRegistry) set(conv *ssh3.Conversation, command string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.commands[conv.ConversationID()] = command
+}
+
+func (r *forcedCommandsRegistry) take(conv *ssh3.Conversation) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	command := r.commands[conv.ConversationID()]
+	delete(r.commands, conv.ConversationID())
+	return command
+}
+
+// resolves the command forced by the server config or the authenticating identity, if any
+func forceCommandHandler(handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.AuthenticatedHandlerFunc {
+	return func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+		identity, _ := unix_server.VerifiedIdentity(r.Context())
+		if command, ok := unix_server.ForcedCommand(settings().forceCommands, authenticatedUsername, identity); ok {
+			log.Debug().Msgf("conversation %s of user %s is restricted to the command %q", newConv.ConversationID(), authenticatedUsername, command)
+			forcedCommands.set(newConv, command)
+		}
+		handlerFunc(authenticatedUsername, newConv, w, r)
+	}
+}
+
+// runs the forced command of the session instead of the requested shell, command or subsystem.
+// Returns false if the session has no forced command.
+func newForcedCommand(user *unix_util.User, channel ssh3.Channel, originalCommand string) (bool, error) {
+	session, ok := runningSessions.get(channel)
+	if !ok || session.forcedCommand == "" {
+		return false, nil
+	}
+	log.Info().Msgf("running forced command %q instead of %q on channel %d (conv %s)", session.forcedCommand, originalCommand, channel.ChannelID(), channel.ConversationID())
+	if originalCommand != "" {
+		// SSH_ORIGINAL_COMMAND is also set for the scripts written for OpenSSH
+		session.env = append(session.env, "SSH3_ORIGINAL_COMMAND="+originalCommand, "SSH_ORIGINAL_COMMAND="+originalCommand)
+	}
+	return true, newCommand(user, channel, false, user.Shell, user.ShellCommandArgs(session.forcedCommand)...)
+}
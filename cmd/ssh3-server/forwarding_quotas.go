@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+// tracks the forwarded connections of a conversation
+type forwardingQuota struct {
+	config       unix_server.ForwardingQuotasConfig
+	connections  int
+	pendingDials int
+	// the times of the dials of the last minute
+	dialTimes []time.Time
+	lock      sync.Mutex
+}
+
+func newForwardingQuota(config unix_server.ForwardingQuotasConfig) *forwardingQuota {
+	return &forwardingQuota{config: config}
+}
+
+// reserves a connection and a pending dial, returns a failure if a quota is exceeded
+func (q *forwardingQuota) admit(now time.Time) *ssh3.ChannelOpenFailure {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.config.MaxConnections > 0 && q.connections >= q.config.MaxConnections {
+		return &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE,
+			ErrorMsg: fmt.Sprintf("too many forwarded connections (maximum %d)", q.config.MaxConnections)}
+	}
+	if q.config.MaxPendingDials > 0 && q.pendingDials >= q.config.MaxPendingDials {
+		return &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE,
+			ErrorMsg: fmt.Sprintf("too many connections being established (maximum %d)", q.config.MaxPendingDials)}
+	}
+	if q.config.MaxDialsPerMinute > 0 {
+		recentDials := q.dialTimes[:0]
+		for _, dialTime := range q.dialTimes {
+			if now.Sub(dialTime) < time.Minute {
+				recentDials = append(recentDials, dialTime)
+			}
+		}
+		q.dialTimes = recentDials
+		if len(q.dialTimes) >= q.config.MaxDialsPerMinute {
+			return &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_RESOURCE_SHORTAGE,
+				ErrorMsg: fmt.Sprintf("too many forwarded connections per minute (maximum %d)", q.config.MaxDialsPerMinute)}
+		}
+		q.dialTimes = append(q.dialTimes, now)
+	}
+	q.connections += 1
+	q.pendingDials += 1
+	return nil
+}
+
+func (q *forwardingQuota) dialDone() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pendingDials -= 1
+}
+
+func (q *forwardingQuota) connectionClosed() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.connections -= 1
+}
+
+// refuses the forwarding channels that are not permitted or exceed the quotas of the conversation
+func forwardingChannelFilter(ctx context.Context, username string, quota *forwardingQuota) ssh3.ChannelOpenFilter {
+	return func(channel ssh3.Channel) *ssh3.ChannelOpenFailure {
+		var protocol string
+		var target net.Addr
+		var ip net.IP
+		var port int
+		switch c := channel.(type) {
+		case *ssh3.UDPForwardingChannelImpl:
+			protocol, target, ip, port = "udp", c.RemoteAddr, c.RemoteAddr.IP, c.RemoteAddr.Port
+		case *ssh3.TCPForwardingChannelImpl:
+			protocol, target, ip, port = "tcp", c.RemoteAddr, c.RemoteAddr.IP, c.RemoteAddr.Port
+		default:
+			return nil
+		}
+		if protocol == "udp" && egressDialer != nil {
+			// the egress proxy only relays TCP connections
+			failure := ssh3.UnsupportedFeature{Feature: "udp_forwarding"}.ChannelOpenFailure()
+			auditForward(username, channel, protocol, target, failure)
+			return failure
+		}
+		failure := quota.admit(time.Now())
+		if failure == nil && !settings().accessControl.PermitsOpen(ctx, ip, port) {
+			quota.dialDone()
+			quota.connectionClosed()
+			failure = &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_ADMINISTRATIVELY_PROHIBITED,
+				ErrorMsg: fmt.Sprintf("forwarding to %s is not permitted", target)}
+		}
+		if failure != nil {
+			auditForward(username, channel, protocol, target, failure)
+		}
+		return failure
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util"
+)
+
+// ssh3-server import-sshd [-o server_config.json] /etc/ssh/sshd_config
+// prints the translated config and reports how every directive was handled,
+// returns 1 if some directives could not be translated
+func importSSHDConfig(args []string) int {
+	flags := flag.NewFlagSet("import-sshd", flag.ExitOnError)
+	outputPath := flags.String("o", "", "if set, write the translated config in the specified file instead of the standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s import-sshd: %s import-sshd [options] /etc/ssh/sshd_config\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return -1
+	}
+	sshdConfigPath := flags.Arg(0)
+
+	file, err := os.Open(sshdConfigPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open sshd config: %s\n", err)
+		return -1
+	}
+	defer file.Close()
+	config, reports, err := unix_server.ImportSSHDConfig(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", sshdConfigPath, err)
+		return -1
+	}
+
+	encoded, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not encode the translated config: %s\n", err)
+		return -1
+	}
+	encoded = append(encoded, '\n')
+	if *outputPath != "" {
+		// the config being replaced, if any, is kept with the .bak suffix
+		err = util.UpdateFile(*outputPath, 0644, func([]byte) ([]byte, error) { return encoded, nil })
+	} else {
+		_, err = os.Stdout.Write(encoded)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the translated config: %s\n", err)
+		return -1
+	}
+
+	unsupported := 0
+	for _, report := range reports {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s: %s: %s\n", sshdConfigPath, report.Line, report.Keyword, report.Status, report.Message)
+		if report.Status == unix_server.SSHDDirectiveUnsupported {
+			unsupported += 1
+		}
+	}
+	if unsupported > 0 {
+		fmt.Fprintf(os.Stderr, "%d directives could not be translated\n", unsupported)
+		return 1
+	}
+	return 0
+}
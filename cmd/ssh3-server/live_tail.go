@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/recording"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+// the number of outputs buffered for an auditor, the auditors that do not keep up are detached
+// instead of slowing down the session
+const liveTailBufferedOutputs = 256
+
+type liveTailer struct {
+	output chan []byte
+}
+
+// a session whose output can be tailed by the auditors
+type liveSession struct {
+	username      string
+	channel       ssh3.Channel
+	width, height uint64
+	title         string
+	withPty       bool
+	// written on the terminal when an auditor attaches, as configured when the session started
+	notice string
+	// the notices written on the terminal by the goroutine of the session, the only one
+	// writing on the channel
+	notices chan string
+
+	lock    sync.Mutex
+	tailers map[*liveTailer]struct{}
+	ended   bool
+}
+
+type liveSessionsRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*liveSession
+}
+
+var liveSessions = &liveSessionsRegistry{sessions: make(map[string]*liveSession)}
+
+func liveSessionKey(conversationID ssh3.ConversationID, channelID uint64) string {
+	return fmt.Sprintf("%s_%d", hex.EncodeToString(conversationID[:]), channelID)
+}
+
+// returns nil if the session cannot be tailed
+func startLiveSession(user *unix_util.User, channel ssh3.Channel, openPty *openPty, runningCommand *runningCommand) *liveSession {
+	liveTail := settings().liveTail
+	if liveTail == nil || !liveTail.AllowsUser(user.Username) {
+		return nil
+	}
+	session := &liveSession{
+		username: user.Username,
+		channel:  channel,
+		// the default size of a terminal for commands run without pty
+		width:   80,
+		height:  24,
+		title:   strings.Join(runningCommand.Args, " "),
+		withPty: openPty != nil,
+		notice:  liveTail.Notice,
+		notices: make(chan string, 1),
+		tailers: make(map[*liveTailer]struct{}),
+	}
+	if openPty != nil {
+		session.width, session.height = uint64(openPty.winSize.Cols), uint64(openPty.winSize.Rows)
+	}
+	liveSessions.lock.Lock()
+	defer liveSessions.lock.Unlock()
+	liveSessions.sessions[liveSessionKey(channel.ConversationID(), channel.ChannelID())] = session
+	return session
+}
+
+// returns nil if there is no such session
+func (r *liveSessionsRegistry) get(conversationID ssh3.ConversationID, channelID uint64) *liveSession {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sessions[liveSessionKey(conversationID, channelID)]
+}
+
+// sends the output of the session to the auditors
+func (s *liveSession) output(data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tailers) > 0 {
+		// the buffer of data is reused once written on the channel
+		data = bytes.Clone(data)
+	}
+	for tailer := range s.tailers {
+		select {
+		case tailer.output <- data:
+		default:
+			log.Warn().Msgf("detaching an auditor from channel %d (conv %s): it does not keep up with the session", s.channel.ChannelID(), s.channel.ConversationID())
+			delete(s.tailers, tailer)
+			close(tailer.output)
+		}
+	}
+}
+
+// detaches the auditors once the session ended
+func (s *liveSession) end() {
+	liveSessions.lock.Lock()
+	delete(liveSessions.sessions, liveSessionKey(s.channel.ConversationID(), s.channel.ChannelID()))
+	liveSessions.lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ended = true
+	for tailer := range s.tailers {
+		close(tailer.output)
+	}
+	s.tailers = nil
+}
+
+// returns nil if the session ended
+func (s *liveSession) attach() *liveTailer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended {
+		return nil
+	}
+	tailer := &liveTailer{output: make(chan []byte, liveTailBufferedOutputs)}
+	s.tailers[tailer] = struct{}{}
+	if s.notice != "" {
+		notice := s.notice + "\n"
+		if s.withPty {
+			notice = "\r\n" + s.notice + "\r\n"
+		}
+		select {
+		case s.notices <- notice:
+		default:
+			// another notice is already being written
+		}
+	}
+	return tailer
+}
+
+func (s *liveSession) detach(tailer *liveTailer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.tailers[tailer]; ok {
+		delete(s.tailers, tailer)
+		close(tailer.output)
+	}
+}
+
+// accepts the hex encoding of the recordings or the base64 encoding of the stats and audit log
+func parseConversationID(encoded string) (ssh3.ConversationID, error) {
+	var conversationID ssh3.ConversationID
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		decoded, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(decoded) != len(conversationID) {
+		return conversationID, fmt.Errorf("invalid conversation ID %q", encoded)
+	}
+	copy(conversationID[:], decoded)
+	return conversationID, nil
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (w flushWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.flusher.Flush()
+	return n, err
+}
+
+func (w flushWriter) Close() error {
+	return nil
+}
+
+// streams the live output of a session: GET /sessions/tail?conversation=<ID>&channel=<ID>&auditor=<name>,
+// in the asciicast v2 format if format=asciicast
+func handleAdminTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	auditor := query.Get("auditor")
+	if auditor == "" {
+		http.Error(w, "the auditor must be identified", http.StatusBadRequest)
+		return
+	}
+	conversationID, err := parseConversationID(query.Get("conversation"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	channelID, err := strconv.ParseUint(query.Get("channel"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid channel ID %q", query.Get("channel")), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format != "" && format != "raw" && format != "asciicast" {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	session := liveSessions.get(conversationID, channelID)
+	var tailer *liveTailer
+	if session != nil {
+		tailer = session.attach()
+	}
+	if tailer == nil {
+		http.Error(w, "no live session that can be tailed", http.StatusNotFound)
+		return
+	}
+	defer session.detach(tailer)
+
+	auditTail := func(result string) {
+		audit.Log(audit.Event{
+			Type:           audit.EventLiveTail,
+			Username:       session.username,
+			ConversationID: conversationID.String(),
+			ChannelID:      channelID,
+			Details:        map[string]string{"auditor": auditor, "result": result},
+		})
+	}
+	auditTail("attached")
+	defer auditTail("detached")
+	log.Info().Msgf("%s attached to channel %d (conv %s) of %s", auditor, channelID, conversationID, session.username)
+
+	out := flushWriter{w: w, flusher: flusher}
+	write := func(data []byte) error {
+		_, err := out.Write(data)
+		return err
+	}
+	if format == "asciicast" {
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		recorder, err := recording.NewAsciicastRecorder(out, session.width, session.height, session.title, nil)
+		if err != nil {
+			return
+		}
+		defer recorder.Close()
+		write = recorder.Output
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+	for {
+		select {
+		case data, ok := <-tailer.output:
+			if !ok {
+				return
+			}
+			if err := write(data); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
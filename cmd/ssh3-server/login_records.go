@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+const motdPath = "/etc/motd"
+
+// the previous login of a user, as recorded in lastlog
+type lastLogin struct {
+	time time.Time
+	line string
+	host string
+}
+
+// the addresses of the clients of the conversations, set when authenticating them and taken by
+// their handler to record the logins
+type remoteAddressesRegistry struct {
+	addresses map[ssh3.ConversationID]string
+	lock      sync.Mutex
+}
+
+var remoteAddresses = &remoteAddressesRegistry{addresses: make(map[ssh3.ConversationID]string)}
+
+func (r *remoteAddressesRegistry) set(conv *ssh3.Conversation, remoteAddr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addresses[conv.ConversationID()] = remoteAddr
+}
+
+func (r *remoteAddressesRegistry) take(conv *ssh3.Conversation) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	remoteAddr := r.addresses[conv.ConversationID()]
+	delete(r.addresses, conv.ConversationID())
+	return remoteAddr
+}
+
+// keeps the address of the client of the conversation for its login records
+func remoteAddressHandler(handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.AuthenticatedHandlerFunc {
+	return func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+		remoteAddresses.set(newConv, r.RemoteAddr)
+		handlerFunc(authenticatedUsername, newConv, w, r)
+	}
+}
+
+// the host recorded in the login records, without the port of the client
+func loginHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// sends the last login and the message of the day of the interactive login sessions, as sshd
+// does, unless the user has a ~/.hushlogin file
+func printLoginMessages(user *unix_util.User, channel ssh3.Channel) {
+	printMotd, printLastLog := settings().printMotd, settings().printLastLog
+	if !printMotd && !printLastLog {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(user.Dir, ".hushlogin")); err == nil {
+		return
+	}
+	var messages strings.Builder
+	if printLastLog {
+		last, err := readLastLogin(user)
+		if err != nil {
+			log.Debug().Msgf("could not read the last login of user %s: %s", user.Username, err)
+		} else if !last.time.IsZero() {
+			fmt.Fprintf(&messages, "Last login: %s", last.time.Format("Mon Jan _2 15:04:05 2006"))
+			if last.host != "" {
+				fmt.Fprintf(&messages, " from %s", last.host)
+			} else if last.line != "" {
+				fmt.Fprintf(&messages, " on %s", last.line)
+			}
+			messages.WriteString("\n")
+		}
+	}
+	if printMotd {
+		motd, err := os.ReadFile(motdPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Msgf("could not read the message of the day: %s", err)
+		}
+		messages.Write(motd)
+	}
+	if messages.Len() == 0 {
+		return
+	}
+	// the messages do not go through the pty translating the line feeds of the command
+	_, err := channel.WriteData([]byte(strings.ReplaceAll(messages.String(), "\n", "\r\n")), ssh3Messages.SSH_EXTENDED_DATA_NONE)
+	if err != nil {
+		log.Error().Msgf("could not send the login messages on channel %d: %s", channel.ChannelID(), err)
+	}
+}
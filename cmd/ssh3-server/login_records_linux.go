@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// the login records read by who, last and lastlog, in the formats of glibc
+const (
+	utmpPath    = "/var/run/utmp"
+	wtmpPath    = "/var/log/wtmp"
+	lastlogPath = "/var/log/lastlog"
+
+	// struct utmp, whose times are 32-bit for the compatibility with 32-bit programs
+	utmpRecordSize = 384
+	// struct lastlog: a 32-bit time, the line and the host
+	lastlogRecordSize = 292
+
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+// a record of utmp and wtmp
+type utmpRecord struct {
+	recordType int16
+	pid        int32
+	// the tty without /dev/, e.g. pts/3
+	line     string
+	id       string
+	username string
+	host     string
+	addr     net.IP
+	time     time.Time
+}
+
+func (r *utmpRecord) marshal() []byte {
+	b := make([]byte, utmpRecordSize)
+	binary.NativeEndian.PutUint16(b[0:], uint16(r.recordType))
+	binary.NativeEndian.PutUint32(b[4:], uint32(r.pid))
+	copy(b[8:40], r.line)
+	copy(b[40:44], r.id)
+	copy(b[44:76], r.username)
+	copy(b[76:332], r.host)
+	binary.NativeEndian.PutUint32(b[340:], uint32(r.time.Unix()))
+	binary.NativeEndian.PutUint32(b[344:], uint32(r.time.Nanosecond()/1000))
+	if ip4 := r.addr.To4(); ip4 != nil {
+		copy(b[348:352], ip4)
+	} else {
+		copy(b[348:364], r.addr.To16())
+	}
+	return b
+}
+
+// returns the C string of the fixed-size field b
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// opens a login records file and locks it, or returns nil if the system does not keep it
+func openLoginRecords(path string, flag int) (*os.File, error) {
+	file, err := os.OpenFile(path, flag, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// replaces the utmp record of the same id, or appends it, as pututline does
+func writeUtmp(record *utmpRecord) error {
+	file, err := openLoginRecords(utmpPath, os.O_RDWR)
+	if file == nil {
+		return err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	offset := int64(len(content) / utmpRecordSize * utmpRecordSize)
+	for i := 0; i+utmpRecordSize <= len(content); i += utmpRecordSize {
+		recordType := int16(binary.NativeEndian.Uint16(content[i:]))
+		if (recordType == utmpUserProcess || recordType == utmpDeadProcess) && cString(content[i+40:i+44]) == record.id {
+			offset = int64(i)
+			break
+		}
+	}
+	_, err = file.WriteAt(record.marshal(), offset)
+	return err
+}
+
+func appendWtmp(record *utmpRecord) error {
+	file, err := openLoginRecords(wtmpPath, os.O_WRONLY|os.O_APPEND)
+	if file == nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(record.marshal())
+	return err
+}
+
+func readLastLogin(user *unix_util.User) (lastLogin, error) {
+	file, err := os.Open(lastlogPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lastLogin{}, nil
+	} else if err != nil {
+		return lastLogin{}, err
+	}
+	defer file.Close()
+	b := make([]byte, lastlogRecordSize)
+	// the file is sparse, the users who never logged in have no record
+	_, err = file.ReadAt(b, int64(user.Uid)*lastlogRecordSize)
+	if errors.Is(err, io.EOF) {
+		return lastLogin{}, nil
+	} else if err != nil {
+		return lastLogin{}, err
+	}
+	seconds := int64(binary.NativeEndian.Uint32(b[0:]))
+	if seconds == 0 {
+		return lastLogin{}, nil
+	}
+	return lastLogin{time: time.Unix(seconds, 0), line: cString(b[4:36]), host: cString(b[36:292])}, nil
+}
+
+func writeLastLog(user *unix_util.User, record *utmpRecord) error {
+	file, err := openLoginRecords(lastlogPath, os.O_WRONLY)
+	if file == nil {
+		return err
+	}
+	defer file.Close()
+	b := make([]byte, lastlogRecordSize)
+	binary.NativeEndian.PutUint32(b[0:], uint32(record.time.Unix()))
+	copy(b[4:36], record.line)
+	copy(b[36:292], record.host)
+	_, err = file.WriteAt(b, int64(user.Uid)*lastlogRecordSize)
+	return err
+}
+
+// records the login of the user on the pty in utmp, wtmp and lastlog, so that it is listed by
+// who and last, and returns the function recording the logout once the command exits. Only the
+// server running as root can write these files, the monitor does not record the logins of the
+// worker when the privileges are separated.
+func recordLogin(user *unix_util.User, p *openPty, pid int, remoteAddr string) (logout func()) {
+	if os.Geteuid() != 0 {
+		return func() {}
+	}
+	line := strings.TrimPrefix(p.tty.Name(), "/dev/")
+	// the last 4 characters of the line, as sshd does
+	id := line
+	if len(id) > 4 {
+		id = id[len(id)-4:]
+	}
+	host := loginHost(remoteAddr)
+	record := &utmpRecord{
+		recordType: utmpUserProcess,
+		pid:        int32(pid),
+		line:       line,
+		id:         id,
+		username:   user.Username,
+		host:       host,
+		addr:       net.ParseIP(host),
+		time:       time.Now(),
+	}
+	write := func() {
+		if err := writeUtmp(record); err != nil {
+			log.Warn().Msgf("could not update %s: %s", utmpPath, err)
+		}
+		if err := appendWtmp(record); err != nil {
+			log.Warn().Msgf("could not update %s: %s", wtmpPath, err)
+		}
+	}
+	write()
+	if err := writeLastLog(user, record); err != nil {
+		log.Warn().Msgf("could not update %s: %s", lastlogPath, err)
+	}
+	return func() {
+		record.recordType = utmpDeadProcess
+		record.username, record.host, record.addr = "", "", nil
+		record.time = time.Now()
+		write()
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// the login records are only kept on Linux
+func readLastLogin(user *unix_util.User) (lastLogin, error) {
+	return lastLogin{}, nil
+}
+
+func recordLogin(user *unix_util.User, p *openPty, pid int, remoteAddr string) (logout func()) {
+	return func() {}
+}
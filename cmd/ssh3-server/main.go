@@ -4,6 +4,7 @@ import (
 	// "bufio"
 	// "context"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,10 +13,10 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"syscall"
-	"unsafe"
 
 	_ "net/http/pprof"
 
@@ -24,51 +25,23 @@ import (
 	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/limits"
 	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/privsep"
+	"github.com/francoismichel/ssh3/rpc"
+	"github.com/francoismichel/ssh3/sandbox"
 	"github.com/francoismichel/ssh3/unix_server"
 	util "github.com/francoismichel/ssh3/util"
 	"github.com/francoismichel/ssh3/util/unix_util"
 )
 
-var signals = map[string]os.Signal{
-	"SIGABRT":   syscall.Signal(0x6),
-	"SIGALRM":   syscall.Signal(0xe),
-	"SIGBUS":    syscall.Signal(0x7),
-	"SIGCHLD":   syscall.Signal(0x11),
-	"SIGCLD":    syscall.Signal(0x11),
-	"SIGCONT":   syscall.Signal(0x12),
-	"SIGFPE":    syscall.Signal(0x8),
-	"SIGHUP":    syscall.Signal(0x1),
-	"SIGILL":    syscall.Signal(0x4),
-	"SIGINT":    syscall.Signal(0x2),
-	"SIGIO":     syscall.Signal(0x1d),
-	"SIGIOT":    syscall.Signal(0x6),
-	"SIGKILL":   syscall.Signal(0x9),
-	"SIGPIPE":   syscall.Signal(0xd),
-	"SIGPOLL":   syscall.Signal(0x1d),
-	"SIGPROF":   syscall.Signal(0x1b),
-	"SIGPWR":    syscall.Signal(0x1e),
-	"SIGQUIT":   syscall.Signal(0x3),
-	"SIGSEGV":   syscall.Signal(0xb),
-	"SIGSTKFLT": syscall.Signal(0x10),
-	"SIGSTOP":   syscall.Signal(0x13),
-	"SIGSYS":    syscall.Signal(0x1f),
-	"SIGTERM":   syscall.Signal(0xf),
-	"SIGTRAP":   syscall.Signal(0x5),
-	"SIGTSTP":   syscall.Signal(0x14),
-	"SIGTTIN":   syscall.Signal(0x15),
-	"SIGTTOU":   syscall.Signal(0x16),
-	"SIGUNUSED": syscall.Signal(0x1f),
-	"SIGURG":    syscall.Signal(0x17),
-	"SIGUSR1":   syscall.Signal(0xa),
-	"SIGUSR2":   syscall.Signal(0xc),
-	"SIGVTALRM": syscall.Signal(0x1a),
-	"SIGWINCH":  syscall.Signal(0x1c),
-	"SIGXCPU":   syscall.Signal(0x18),
-	"SIGXFSZ":   syscall.Signal(0x19),
-}
+var tracer = otel.Tracer("github.com/francoismichel/ssh3/cmd/ssh3-server")
 
 type channelType uint64
 
@@ -77,9 +50,13 @@ const (
 	OPEN
 )
 
+// the size of the reads of the output of the commands, larger than the default max packet size
+// so that a bulk output is written on the channel with few reads. The output cannot be spliced
+// to the channel as QUIC runs in user space.
+const outputReadSize = 256 << 10
+
 type openPty struct {
-	pty     *os.File // pty used by the server/user to communicate with the running process
-	tty     *os.File // tty used by the running process to communicate with the server/user
+	pseudoTerminal
 	winSize *pty.Winsize
 	term    string
 }
@@ -89,6 +66,49 @@ type runningCommand struct {
 	stdoutR io.Reader
 	stderrR io.Reader
 	stdinW  io.Writer
+	// the pid of the command in the monitor, if the privileges are separated
+	monitoredPid int
+	// set if the command was not started by exec.Cmd, e.g. in a pseudo console on Windows
+	process *os.Process
+	// the session tmpdir of the command, removed once it exits
+	tmpDir string
+	// the address of the client, kept in the login records of the command run in a pty
+	remoteAddr string
+	// closed once the output and the exit status of the command have been sent
+	outputSent chan struct{}
+	// set if the pty session survives the end of its conversation
+	persistent *persistentSession
+}
+
+func (c *runningCommand) wait() error {
+	if c.process != nil {
+		state, err := c.process.Wait()
+		if err == nil && !state.Success() {
+			return &exec.ExitError{ProcessState: state}
+		}
+		return err
+	}
+	if c.monitoredPid == 0 {
+		return c.Wait()
+	}
+	var result privsep.WaitResult
+	if _, err := monitor.Call(privsep.OpWait, privsep.WaitParams{Pid: c.monitoredPid}, nil, &result); err != nil {
+		return err
+	}
+	if result.ExitCode != 0 || result.Signal != 0 {
+		return monitoredExitError{exitCode: result.ExitCode, signal: result.Signal, coreDumped: result.CoreDumped}
+	}
+	return nil
+}
+
+// delivers sig to the process group of the command, or to its foreground job in the pty p
+func (c *runningCommand) signal(p *openPty, sig os.Signal) error {
+	pgrp := c.processGroup(p)
+	if c.monitoredPid == 0 {
+		return signalProcessGroup(pgrp, sig)
+	}
+	_, err := monitor.Call(privsep.OpSignal, privsep.SignalParams{Pid: c.monitoredPid, Signal: int(sig.(syscall.Signal)), ProcessGroup: pgrp}, nil, nil)
+	return err
 }
 
 type runningSession struct {
@@ -96,13 +116,43 @@ type runningSession struct {
 	pty                 *openPty
 	runningCmd          *runningCommand
 	authAgentSocketPath string
+	// if set, run instead of the requested shell, command or subsystem
+	forcedCommand string
+	// added to the environment of the command
+	env []string
+	// if set, the directory in which the command starts instead of the home of the user
+	workingDirectory string
+	// carries the span of the session, propagated to the commands it runs
+	traceContext context.Context
+	// the address of the client of the conversation
+	remoteAddr string
+}
+
+// the sessions of the channels, accessed by the goroutines of all the conversations
+type runningSessionsRegistry struct {
+	lock     sync.Mutex
+	sessions map[ssh3.Channel]*runningSession
 }
 
-var runningSessions = make(map[ssh3.Channel]*runningSession)
+var runningSessions = &runningSessionsRegistry{sessions: make(map[ssh3.Channel]*runningSession)}
+
+func (r *runningSessionsRegistry) get(channel ssh3.Channel) (*runningSession, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	session, ok := r.sessions[channel]
+	return session, ok
+}
+
+func (r *runningSessionsRegistry) set(channel ssh3.Channel, session *runningSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[channel] = session
+}
 
-func setWinsize(f *os.File, charWidth, charHeight, pixWidth, pixHeight uint64) {
-	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
-		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(charHeight), uint16(charWidth), uint16(pixWidth), uint16(pixHeight)})))
+func (r *runningSessionsRegistry) remove(channel ssh3.Channel) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, channel)
 }
 
 // Size is needed by the /demo/upload handler to determine the size of the uploaded file
@@ -110,20 +160,27 @@ type Size interface {
 	Size() int64
 }
 
-func setupEnv(user *unix_util.User, runningCommand *runningCommand, authAgentSocketPath string) {
+func setupEnv(ctx context.Context, user *unix_util.User, runningCommand *runningCommand, authAgentSocketPath string) {
 	// TODO: set the environment like in do_setup_env of https://github.com/openssh/openssh-portable/blob/master/session.c
-	runningCommand.Cmd.Env = append(runningCommand.Cmd.Env,
-		fmt.Sprintf("HOME=%s", user.Dir),
-		fmt.Sprintf("USER=%s", user.Username),
-		fmt.Sprintf("PATH=%s", "/usr/bin:/bin:/usr/sbin:/sbin"),
-	)
+	runningCommand.Cmd.Env = append(runningCommand.Cmd.Env, userEnvironment(user)...)
 	if authAgentSocketPath != "" {
 		runningCommand.Cmd.Env = append(runningCommand.Cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", authAgentSocketPath))
 	}
+	// let the command continue the trace, see https://github.com/open-telemetry/opentelemetry-specification/issues/740
+	runningCommand.Cmd.Env = append(runningCommand.Cmd.Env, util.TraceContextEnv(ctx)...)
 }
 
-func forwardUDPInBackground(ctx context.Context, channel ssh3.Channel, conn *net.UDPConn) {
+// onClosed is called once the forwarding stopped in both directions
+func forwardUDPInBackground(ctx context.Context, user *unix_util.User, channel ssh3.Channel, conn *net.UDPConn, onClosed func()) {
+	var forwarding sync.WaitGroup
+	forwarding.Add(2)
 	go func() {
+		forwarding.Wait()
+		onClosed()
+	}()
+	go func() {
+		defer forwarding.Done()
+		defer recoverChannelPanic(user.Username, channel)
 		defer conn.Close()
 		for {
 			select {
@@ -145,6 +202,8 @@ func forwardUDPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 	}()
 
 	go func() {
+		defer forwarding.Done()
+		defer recoverChannelPanic(user.Username, channel)
 		defer channel.Close()
 		defer conn.Close()
 		buf := make([]byte, 1500)
@@ -168,8 +227,18 @@ func forwardUDPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 	}()
 }
 
-func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net.TCPConn) {
+// onClosed is called once the forwarding stopped in both directions
+func forwardTCPInBackground(ctx context.Context, user *unix_util.User, channel ssh3.Channel, conn halfClosableConn, onClosed func()) {
+	var forwarding sync.WaitGroup
+	forwarding.Add(2)
+	go func() {
+		forwarding.Wait()
+		conn.Close()
+		onClosed()
+	}()
 	go func() {
+		defer forwarding.Done()
+		defer recoverChannelPanic(user.Username, channel)
 		defer conn.CloseWrite()
 		for {
 			select {
@@ -180,6 +249,11 @@ func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 			genericMessage, err := channel.NextMessage()
 			if errors.Is(err, io.EOF) {
 				log.Info().Msgf("eof on tcp-forwarding channel %d", channel.ChannelID())
+			} else if isMalformedMessage(err) {
+				auditMalformedMessage(user.Username, channel, err)
+				channel.CancelRead()
+				channel.Close()
+				return
 			} else if err != nil {
 				log.Error().Msgf("could get message from tcp forwarding channel: %s", err)
 				return
@@ -210,6 +284,8 @@ func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 	}()
 
 	go func() {
+		defer forwarding.Done()
+		defer recoverChannelPanic(user.Username, channel)
 		defer channel.Close()
 		defer conn.CloseRead()
 		buf := make([]byte, channel.MaxPacketSize())
@@ -245,67 +321,119 @@ func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 	}()
 }
 
-func execCmdInBackground(channel ssh3.Channel, openPty *openPty, user *unix_util.User, runningCommand *runningCommand, authAgentSocketPath string) error {
-	setupEnv(user, runningCommand, authAgentSocketPath)
-	if openPty != nil {
-		err := unix_util.StartWithSizeAndPty(&runningCommand.Cmd, openPty.winSize, openPty.pty, openPty.tty)
+func execCmdInBackground(ctx context.Context, channel ssh3.Channel, openPty *openPty, user *unix_util.User, runningCommand *runningCommand, authAgentSocketPath string) error {
+	ctx, span := tracer.Start(ctx, "ssh3.exec", trace.WithAttributes(ssh3.ChannelAttributes(channel)...),
+		trace.WithAttributes(attribute.String("process.executable.path", runningCommand.Path)))
+	setupEnv(ctx, user, runningCommand, authAgentSocketPath)
+	logout := func() {}
+	if monitor != nil {
+		err := startMonitoredCommand(channel, user, runningCommand, openPty)
 		if err != nil {
+			util.SetSpanError(span, err)
+			span.End()
 			return err
 		}
+	} else if openPty != nil {
+		err := startWithPty(runningCommand, openPty)
+		if err != nil {
+			removeSessionTmpDir(runningCommand.tmpDir)
+			util.SetSpanError(span, err)
+			span.End()
+			return err
+		}
+		logout = recordLogin(user, openPty, runningCommand.Process.Pid, runningCommand.remoteAddr)
 	} else {
 		err := runningCommand.Start()
 		if err != nil {
+			removeSessionTmpDir(runningCommand.tmpDir)
+			util.SetSpanError(span, err)
+			span.End()
 			return err
 		}
 	}
 
+	recorder := startSessionRecording(user, channel, openPty, runningCommand)
+	live := startLiveSession(user, channel, openPty, runningCommand)
+	var output sessionOutput = channel
+	if persistent := runningCommand.persistent; persistent != nil {
+		persistentSessions.add(persistent)
+		output = persistent
+	}
+	if openPty != nil {
+		terminals.add(openPty, channel.ConversationID(), user.Username)
+	}
 	go func() {
+		defer recoverChannelPanic(user.Username, channel)
+		defer close(runningCommand.outputSent)
+		defer span.End()
+		if openPty != nil {
+			defer terminals.remove(openPty)
+		}
+		if runningCommand.persistent != nil {
+			defer runningCommand.persistent.end()
+		}
+		if recorder != nil {
+			defer recorder.Close()
+		}
+		var notices chan string
+		if live != nil {
+			notices = live.notices
+			defer live.end()
+		}
 
 		type readResult struct {
 			data []byte
 			err  error
+			// the buffer of data is given back to its reader once written on the channel
+			free chan<- []byte
 		}
 
 		stdoutChan := make(chan readResult, 1)
 		stderrChan := make(chan readResult, 1)
 		execResultChan := make(chan error, 1)
-		execExitStatus := uint64(0)
-
-		readStdout := func() {
-			defer close(stdoutChan)
-			if runningCommand.stdoutR != nil {
-				for {
-					buf := make([]byte, channel.MaxPacketSize())
-					n, err := runningCommand.stdoutR.Read(buf)
-					out := make([]byte, n)
-					copy(out, buf[:n])
-					stdoutChan <- readResult{data: out, err: err}
-					if err != nil {
-						return
-					}
-				}
+		var execErr error
+
+		// reads the output in large buffers so that a bulk output takes few reads, one buffer is
+		// read while the other one is written on the channel
+		readOutput := func(r io.Reader, results chan<- readResult) {
+			defer close(results)
+			if r == nil {
+				return
 			}
-		}
-		readStderr := func() {
-			defer close(stderrChan)
-			if runningCommand.stderrR != nil {
-				for {
-					buf := make([]byte, channel.MaxPacketSize())
-					n, err := runningCommand.stderrR.Read(buf)
-					out := make([]byte, n)
-					copy(out, buf[:n])
-					stderrChan <- readResult{data: out, err: err}
-					if err != nil {
-						return
-					}
+			free := make(chan []byte, 2)
+			for i := 0; i < cap(free); i++ {
+				free <- make([]byte, outputReadSize)
+			}
+			for {
+				buf := <-free
+				n, err := r.Read(buf)
+				results <- readResult{data: buf[:n], err: err, free: free}
+				if err != nil {
+					return
 				}
 			}
 		}
-
-		go readStdout()
-		go readStderr()
+		// Wait closes the output pipes, so it must only be called once everything has been read
+		var pipesRead sync.WaitGroup
+		pipesRead.Add(2)
+		go func() {
+			defer pipesRead.Done()
+			readOutput(runningCommand.stdoutR, stdoutChan)
+		}()
 		go func() {
-			execResultChan <- runningCommand.Wait()
+			defer pipesRead.Done()
+			readOutput(runningCommand.stderrR, stderrChan)
+		}()
+		go func() {
+			if openPty == nil {
+				pipesRead.Wait()
+			}
+			execResultChan <- runningCommand.wait()
+			logout()
+			removeSessionTmpDir(runningCommand.tmpDir)
+			if openPty != nil {
+				openPty.commandExited()
+			}
 			close(execResultChan)
 		}()
 
@@ -318,11 +446,14 @@ func execCmdInBackground(channel ssh3.Channel, openPty *openPty, user *unix_util
 				} else {
 					buf, err := stdoutResult.data, stdoutResult.err
 					// an error could be returned but still with relevant data, so first send the data
-					_, err2 := channel.WriteData(buf, ssh3Messages.SSH_EXTENDED_DATA_NONE)
+					recordOutput(recorder, channel, buf)
+					live.output(buf)
+					_, err2 := output.WriteData(buf, ssh3Messages.SSH_EXTENDED_DATA_NONE)
 					if err2 != nil {
 						log.Error().Msgf("could not write the pty's output in an SSH message: %+v\n", err)
 						return
 					}
+					stdoutResult.free <- buf[:cap(buf)]
 					if err != nil && !errors.Is(err, io.EOF) {
 						log.Info().Msgf("could not read the pty's output, it might have been closed by the running process: %s", err)
 					}
@@ -334,33 +465,54 @@ func execCmdInBackground(channel ssh3.Channel, openPty *openPty, user *unix_util
 					stderrChan = nil
 				} else {
 					buf, err := stderrResult.data, stderrResult.err
-					_, err2 := channel.WriteData(buf, ssh3Messages.SSH_EXTENDED_DATA_STDERR)
+					recordOutput(recorder, channel, buf)
+					live.output(buf)
+					_, err2 := output.WriteData(buf, ssh3Messages.SSH_EXTENDED_DATA_STDERR)
 					if err2 != nil {
 						log.Error().Msgf("could not write the pty's output in an SSH message: %+v\n", err)
 						return
 					}
+					stderrResult.free <- buf[:cap(buf)]
 					if err != nil && !errors.Is(err, io.EOF) {
 						log.Info().Msgf("could not read the pty's error output, it might have been closed by the running process: %s", err)
 					}
 				}
 
+			case notice := <-notices:
+				if _, err := output.WriteData([]byte(notice), ssh3Messages.SSH_EXTENDED_DATA_STDERR); err != nil {
+					log.Error().Msgf("could not write the live tail notice on channel %d: %s", channel.ChannelID(), err)
+				}
+
 			case err, ok := <-execResultChan:
 				if !ok {
 					// disable the channel: a select on a nil is always blocking
 					execResultChan = nil
 				} else {
-					execExitStatus = uint64(0)
-					if err != nil {
-						if exitError, ok := err.(*exec.ExitError); ok {
+					execErr = err
+				}
+			}
+			if stdoutChan == nil && stderrChan == nil && execResultChan == nil {
+				// the client exits with the status of the command, or 128 + the number of the
+				// signal that killed it
+				var exitRequest ssh3Messages.ChannelRequest
+				if exitSignal := exitSignalRequest(execErr); exitSignal != nil {
+					span.SetAttributes(attribute.String("ssh3.exit_signal", exitSignal.SignalNameWithoutSig))
+					exitRequest = exitSignal
+				} else {
+					execExitStatus := uint64(0)
+					if execErr != nil {
+						// the command could not be waited for or did not report any exit code
+						execExitStatus = 255
+						if exitError, ok := execErr.(interface{ ExitCode() int }); ok && exitError.ExitCode() >= 0 {
 							execExitStatus = uint64(exitError.ExitCode())
 						}
 					}
+					span.SetAttributes(attribute.Int64("ssh3.exit_status", int64(execExitStatus)))
+					exitRequest = &ssh3Messages.ExitStatusRequest{ExitStatus: execExitStatus}
 				}
-			}
-			if stdoutChan == nil && stderrChan == nil && execResultChan == nil {
-				err := channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+				err := output.SendRequest(&ssh3Messages.ChannelRequestMessage{
 					WantReply:      false,
-					ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: execExitStatus},
+					ChannelRequest: exitRequest,
 				})
 				if err != nil {
 					log.Error().Msgf("Could not send exit status message to the peer: %s", err)
@@ -375,7 +527,7 @@ func execCmdInBackground(channel ssh3.Channel, openPty *openPty, user *unix_util
 
 func newPtyReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.PtyRequest, wantReply bool) error {
 	var session *runningSession
-	session, ok := runningSessions[channel]
+	session, ok := runningSessions.get(channel)
 	if !ok {
 		return fmt.Errorf("internal error: cannot find session for current channel")
 	}
@@ -388,18 +540,21 @@ func newPtyReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.
 		return fmt.Errorf("cannot request new pty on a channel with an already existing pty")
 	}
 	winSize := &pty.Winsize{Rows: uint16(request.CharHeight), Cols: uint16(request.CharWidth), X: uint16(request.PixelWidth), Y: uint16(request.PixelHeight)}
-	pty, tty, err := pty.Open()
+	pseudoTerminal, err := openPseudoTerminal(winSize)
 	if err != nil {
 		return err
 	}
-
-	setWinsize(pty, request.CharWidth, request.CharHeight, request.PixelWidth, request.PixelHeight)
+	if len(request.TerminalModes) > 0 {
+		// the session can still be used with the default modes
+		if err := pseudoTerminal.setTerminalModes(request.TerminalModes); err != nil {
+			log.Warn().Msgf("could not set the terminal modes of the pty: %s", err)
+		}
+	}
 
 	session.pty = &openPty{
-		pty:     pty,
-		tty:     tty,
-		term:    request.Term,
-		winSize: winSize,
+		pseudoTerminal: pseudoTerminal,
+		term:           request.Term,
+		winSize:        winSize,
 	}
 
 	return nil
@@ -411,7 +566,7 @@ func newX11Req(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.
 
 func newCommand(user *unix_util.User, channel ssh3.Channel, loginShell bool, command string, args ...string) error {
 	var session *runningSession
-	session, ok := runningSessions[channel]
+	session, ok := runningSessions.get(channel)
 	if !ok {
 		return fmt.Errorf("internal error: cannot find session for current channel")
 	}
@@ -431,67 +586,149 @@ func newCommand(user *unix_util.User, channel ssh3.Channel, loginShell bool, com
 	var cmd *exec.Cmd
 
 	if session.pty != nil {
-		stdoutW = session.pty.tty
-		stderrW = session.pty.tty
-		stdinR = session.pty.tty
-
-		stdoutR = session.pty.pty
+		stdoutW, stderrW, stdinR, stdoutR, stdinW = session.pty.commandIO()
 		stderrR = nil
-		stdinW = session.pty.pty
+		// the keystrokes that the client sends in datagrams are written in order with its data
+		typing := ssh3.NewTypingReceiver(channel, stdinW)
+		go typing.Run(session.traceContext)
+		stdinW = typing
 		cmd, _, _, _, err = user.CreateCommand(env, stdoutW, stderrW, stdinR, loginShell, command, args...)
 	} else {
-		stdoutR, stdoutW, err = os.Pipe()
-		if err != nil {
+		// the standard error is sent as extended data, separately from the standard output
+		cmd, stdoutR, stderrR, stdinW, err = user.CreateCommandPipeOutput(env, loginShell, command, args...)
+		if err == nil {
+			ownProcessGroup(cmd)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cmd.Env = append(cmd.Env, session.env...)
+	if session.workingDirectory != "" {
+		cmd.Dir = session.workingDirectory
+	}
+	// the monitor applies the confinement when the privileges are separated
+	tmpDir := ""
+	if monitor == nil {
+		if err := confineCommand(user, cmd); err != nil {
 			return err
 		}
-		stderrR, stderrW, err = os.Pipe()
-		if err != nil {
+		if session.workingDirectory != "" {
+			// the confinement resets it, e.g. to the home of the user in the chroot
+			cmd.Dir = session.workingDirectory
+		}
+		if err := limitCommand(user, cmd); err != nil {
 			return err
 		}
-		stdinR, stdinW, err = os.Pipe()
+		var tmpDirEnv []string
+		tmpDir, tmpDirEnv, err = createSessionTmpDir(sessionTmpDir, user)
 		if err != nil {
 			return err
 		}
-		cmd, stdoutR, stderrR, stdinW, err = user.CreateCommandPipeOutput(env, loginShell, command, args...)
+		cmd.Env = append(cmd.Env, tmpDirEnv...)
 	}
 
+	runningCommand := &runningCommand{
+		Cmd:        *cmd,
+		stdoutR:    stdoutR,
+		stderrR:    stderrR,
+		stdinW:     stdinW,
+		tmpDir:     tmpDir,
+		remoteAddr: session.remoteAddr,
+		outputSent: make(chan struct{}),
+	}
+	runningCommand.persistent, err = newPersistentSession(user, channel, session, runningCommand)
 	if err != nil {
+		removeSessionTmpDir(tmpDir)
 		return err
 	}
 
-	runningCommand := &runningCommand{
-		Cmd:     *cmd,
-		stdoutR: stdoutR,
-		stderrR: stderrR,
-		stdinW:  stdinW,
-	}
-
 	session.runningCmd = runningCommand
 
 	session.channelState = OPEN
 
-	return execCmdInBackground(channel, session.pty, user, session.runningCmd, session.authAgentSocketPath)
+	if loginShell && session.pty != nil {
+		printLoginMessages(user, channel)
+	}
+	return execCmdInBackground(session.traceContext, channel, session.pty, user, session.runningCmd, session.authAgentSocketPath)
 }
 
 func newShellReq(user *unix_util.User, channel ssh3.Channel, wantReply bool) error {
+	if forced, err := newForcedCommand(user, channel, ""); forced {
+		return err
+	}
 	return newCommand(user, channel, true, user.Shell)
 }
 
 // similar behaviour to OpenSSH; exec requests are just pasted in the user's shell
 func newCommandInShellReq(user *unix_util.User, channel ssh3.Channel, wantReply bool, command string) error {
-	return newCommand(user, channel, false, user.Shell, "-c", command)
+	if forced, err := newForcedCommand(user, channel, command); forced {
+		return err
+	}
+	return newCommand(user, channel, false, user.Shell, user.ShellCommandArgs(command)...)
+}
+
+// runs the argument vector directly, without the shell of the user, so that its arguments are not
+// interpreted. The forced commands still run in the shell, with the quoted vector as original command.
+func newExecArgvReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.ExecArgvRequest, wantReply bool) error {
+	if len(request.Argv) == 0 {
+		return fmt.Errorf("empty argument vector")
+	}
+	if forced, err := newForcedCommand(user, channel, request.Command()); forced {
+		return err
+	}
+	return newCommand(user, channel, false, request.Argv[0], request.Argv[1:]...)
 }
 
 func newSubsystemReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.SubsystemRequest, wantReply bool) error {
-	return fmt.Errorf("%T not implemented", request)
+	if forced, err := newForcedCommand(user, channel, request.SubsystemName); forced {
+		return err
+	}
+	handler, ok := subsystemRegistry[request.SubsystemName]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %s", request.SubsystemName)
+	}
+	return handler(user, channel)
+}
+
+func newWorkingDirectoryReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.WorkingDirectoryRequest, wantReply bool) error {
+	session, ok := runningSessions.get(channel)
+	if !ok {
+		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	if session.channelState != LARVAL {
+		return fmt.Errorf("cannot change the working directory of an already established session")
+	}
+	if monitor != nil {
+		// the worker may not be able to access the directory, the monitor resolves it
+		session.workingDirectory = request.Directory
+		return nil
+	}
+	dir, err := resolveWorkingDirectory(user, request.Directory)
+	if err != nil {
+		return err
+	}
+	session.workingDirectory = dir
+	return nil
 }
 
 func newWindowChangeReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.WindowChangeRequest, wantReply bool) error {
-	return fmt.Errorf("%T not implemented", request)
+	session, ok := runningSessions.get(channel)
+	if !ok {
+		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	if session.pty == nil {
+		return fmt.Errorf("cannot change the window size of a session without pty (channel %d, conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	session.pty.winSize.Rows, session.pty.winSize.Cols = uint16(request.CharHeight), uint16(request.CharWidth)
+	session.pty.winSize.X, session.pty.winSize.Y = uint16(request.PixelWidth), uint16(request.PixelHeight)
+	return session.pty.resize()
 }
 
 func newSignalReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.SignalRequest, wantReply bool) error {
-	runningSession, ok := runningSessions[channel]
+	runningSession, ok := runningSessions.get(channel)
 	if !ok {
 		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
 	}
@@ -509,13 +746,31 @@ func newSignalReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messag
 		if !ok {
 			return fmt.Errorf("unhandled signal SIG%s", request.SignalNameWithoutSig)
 		}
-		runningSession.runningCmd.Process.Signal(signal)
+		// the command may have exited meanwhile, which does not end the session
+		if err := runningSession.runningCmd.signal(runningSession.pty, signal); err != nil {
+			log.Warn().Msgf("could not deliver SIG%s on channel %d (conv %d): %s", request.SignalNameWithoutSig, channel.ChannelID(), channel.ConversationID(), err)
+		}
 	default:
 		return fmt.Errorf("channel type %s not implemented", channel.ChannelType())
 	}
 	return nil
 }
 
+func newBreakReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.BreakRequest, wantReply bool) error {
+	runningSession, ok := runningSessions.get(channel)
+	if !ok {
+		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	if runningSession.pty == nil || runningSession.runningCmd == nil {
+		return fmt.Errorf("cannot send a break on a session without running pty (channel %d, conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	// the length of the break is meaningless for a pty
+	if err := runningSession.pty.sendBreak(runningSession.runningCmd); err != nil {
+		log.Warn().Msgf("could not send a break on channel %d (conv %d): %s", channel.ChannelID(), channel.ConversationID(), err)
+	}
+	return nil
+}
+
 func newExitStatusReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.ExitStatusRequest, wantReply bool) error {
 	return fmt.Errorf("%T not implemented", request)
 }
@@ -524,32 +779,78 @@ func newExitSignalReq(user *unix_util.User, channel ssh3.Channel, request ssh3Me
 	return fmt.Errorf("%T not implemented", request)
 }
 
-func handleUDPForwardingChannel(ctx context.Context, user *unix_util.User, conv *ssh3.Conversation, channel *ssh3.UDPForwardingChannelImpl) error {
-	// TODO: currently, the rights for socket creation are not checked. The socket is opened with the process's uid and gid
-	// Not sure how to handled that in go since we cannot temporarily change the uid/gid without potentially impacting every
-	// other goroutine
-	conn, err := net.DialUDP("udp", nil, channel.RemoteAddr)
-	if err != nil {
-		return err
-	}
-	forwardUDPInBackground(ctx, channel, conn)
-	return nil
+// the channel has been admitted by the quota of the conversation, the connection is
+// established in background so that slow dials do not block the conversation
+func handleUDPForwardingChannel(ctx context.Context, user *unix_util.User, conv *ssh3.Conversation, channel *ssh3.UDPForwardingChannelImpl, quota *forwardingQuota) {
+	go func() {
+		// TODO: currently, the rights for socket creation are not checked. The socket is opened with the process's uid and gid
+		// Not sure how to handled that in go since we cannot temporarily change the uid/gid without potentially impacting every
+		// other goroutine
+		conn, err := net.DialUDP("udp", nil, channel.RemoteAddr)
+		quota.dialDone()
+		auditForward(user.Username, channel, "udp", channel.RemoteAddr, err)
+		if err != nil {
+			log.Error().Msgf("could not forward UDP connection on channel %d: %s", channel.ChannelID(), err)
+			conv.RejectChannel(channel, &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_CONNECT_FAILED,
+				ErrorMsg: fmt.Sprintf("could not connect to %s: %s", channel.RemoteAddr, err)})
+			quota.connectionClosed()
+			return
+		}
+		if err := conv.ConfirmChannel(channel); err != nil {
+			log.Error().Msgf("could not confirm UDP forwarding channel %d: %s", channel.ChannelID(), err)
+			conn.Close()
+			channel.Close()
+			quota.connectionClosed()
+			return
+		}
+		forwardUDPInBackground(ctx, user, channel, conn, quota.connectionClosed)
+	}()
 }
 
-func handleTCPForwardingChannel(ctx context.Context, user *unix_util.User, conv *ssh3.Conversation, channel *ssh3.TCPForwardingChannelImpl) error {
-	// TODO: currently, the rights for socket creation are not checked. The socket is opened with the process's uid and gid
-	// Not sure how to handled that in go since we cannot temporarily change the uid/gid without potentially impacting every
-	// other goroutine
-	conn, err := net.DialTCP("tcp", nil, channel.RemoteAddr)
-	if err != nil {
-		return err
+func handleTCPForwardingChannel(ctx context.Context, user *unix_util.User, conv *ssh3.Conversation, channel *ssh3.TCPForwardingChannelImpl, quota *forwardingQuota) {
+	go func() {
+		// TODO: currently, the rights for socket creation are not checked. The socket is opened with the process's uid and gid
+		// Not sure how to handled that in go since we cannot temporarily change the uid/gid without potentially impacting every
+		// other goroutine
+		conn, err := dialForwardedTCP(ctx, channel.RemoteAddr.String())
+		quota.dialDone()
+		auditForward(user.Username, channel, "tcp", channel.RemoteAddr, err)
+		if err != nil {
+			log.Error().Msgf("could not forward TCP connection on channel %d: %s", channel.ChannelID(), err)
+			conv.RejectChannel(channel, &ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_CONNECT_FAILED,
+				ErrorMsg: fmt.Sprintf("could not connect to %s: %s", channel.RemoteAddr, err)})
+			quota.connectionClosed()
+			return
+		}
+		if err := conv.ConfirmChannel(channel); err != nil {
+			log.Error().Msgf("could not confirm TCP forwarding channel %d: %s", channel.ChannelID(), err)
+			conn.Close()
+			channel.Close()
+			quota.connectionClosed()
+			return
+		}
+		forwardTCPInBackground(ctx, user, channel, conn, quota.connectionClosed)
+	}()
+}
+
+// closes the standard input of the command once the client sent all its input. The commands run
+// in a pty keep it, as it also carries their output.
+func newEOFReq(user *unix_util.User, channel ssh3.Channel) error {
+	runningSession, ok := runningSessions.get(channel)
+	if !ok {
+		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
+	}
+	if runningSession.runningCmd == nil || runningSession.pty != nil {
+		return nil
+	}
+	if stdin, ok := runningSession.runningCmd.stdinW.(io.Closer); ok {
+		return stdin.Close()
 	}
-	forwardTCPInBackground(ctx, channel, conn)
 	return nil
 }
 
 func newDataReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.DataOrExtendedDataMessage) error {
-	runningSession, ok := runningSessions[channel]
+	runningSession, ok := runningSessions.get(channel)
 	if !ok {
 		return fmt.Errorf("could not find running session for channel %d (conv %d)", channel.ChannelID(), channel.ConversationID())
 	}
@@ -633,32 +934,54 @@ func listenAndAcceptAuthSockets(cancel context.CancelCauseFunc, conversation *ss
 	}
 }
 
-func openAgentSocketAndForwardAgent(parent context.Context, conv *ssh3.Conversation, user *unix_util.User) (string, error) {
-	ctx, cancel := context.WithCancelCause(parent)
+// returns the path and the listener of a new agent socket owned by the user
+func listenAgentSocket(ctx context.Context, user *unix_util.User) (string, net.Listener, error) {
 	sockPath, err := unix_util.NewUnixSocketPath()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	var listener net.ListenConfig
 	agentSock, err := listener.Listen(ctx, "unix", sockPath)
 	if err != nil {
 		log.Error().Msgf("could not listen on agent socket: %s", err.Error())
-		return "", err
+		return "", nil, err
 	}
 
-	sockDir := path.Dir(sockPath)
+	if runtime.GOOS == "windows" {
+		// the commands run as the account of the server
+		return sockPath, agentSock, nil
+	}
+	sockDir := filepath.Dir(sockPath)
 	err = os.Chown(sockDir, int(user.Uid), int(user.Gid))
 	if err != nil {
 		log.Error().Msgf("could chown the directory of the listening socket at %s: %s", sockPath, err.Error())
-		return "", err
+		agentSock.Close()
+		return "", nil, err
 	}
 	err = os.Chown(sockPath, int(user.Uid), int(user.Gid))
 	if err != nil {
 		log.Error().Msgf("could chown the listening socket at %s: %s", sockPath, err.Error())
-		return "", err
+		agentSock.Close()
+		return "", nil, err
 	}
+	return sockPath, agentSock, nil
+}
 
+func openAgentSocketAndForwardAgent(parent context.Context, conv *ssh3.Conversation, user *unix_util.User) (string, error) {
+	ctx, cancel := context.WithCancelCause(parent)
+	var sockPath string
+	var agentSock net.Listener
+	var err error
+	if monitor != nil {
+		sockPath, agentSock, err = monitorAgentSocket(conv, user)
+	} else {
+		sockPath, agentSock, err = listenAgentSocket(ctx, user)
+	}
+	if err != nil {
+		cancel(err)
+		return "", err
+	}
 	go listenAndAcceptAuthSockets(cancel, conv, agentSock, 30000)
 	return sockPath, nil
 }
@@ -669,6 +992,27 @@ func fileExists(path string) bool {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import-sshd" {
+		os.Exit(importSSHDConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayRecordings(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == sandbox.HelperSubcommand {
+		os.Exit(sandbox.RunHelper(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == rpc.HelperSubcommand {
+		os.Exit(rpc.RunHelper(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == limits.HelperSubcommand {
+		os.Exit(limits.RunHelper(os.Args[2:]))
+	}
+	// the worker parses the same args as the monitor
+	isPrivsepWorker := len(os.Args) > 1 && os.Args[1] == privsep.WorkerSubcommand
+	if isPrivsepWorker {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	bindAddr := flag.String("bind", "[::]:443", "the address:port pair to listen to, e.g. 0.0.0.0:443")
 	verbose := flag.Bool("v", false, "verbose mode, if set")
 	urlPath := flag.String("url-path", "/ssh3-term", "the secret URL path on which the ssh3 server listens")
@@ -676,20 +1020,70 @@ func main() {
 		"that will be stored at the paths indicated by the -cert and -key args (they must not already exist)")
 	certPath := flag.String("cert", "./cert.pem", "the filename of the server certificate (or fullchain)")
 	keyPath := flag.String("key", "./priv.key", "the filename of the certificate private key")
+	rotateCert := flag.Bool("rotate-selfsigned-cert", false, "if set, replace the certificate and key indicated by the -cert and -key args "+
+		"by a new self-signed certificate and key endorsed by the current key, so that the clients that pinned the current certificate "+
+		"trust the new one, then exit. The current files are kept with the "+previousIdentitySuffix+" suffix")
+	adminSocketPath := flag.String("admin-socket", "", "if set, serve the admin API (e.g. per-channel statistics on /stats) on a UNIX socket at the specified path")
+	qlogDir := flag.String("qlog-dir", "", "if set, write a qlog trace of each QUIC connection in the specified directory: only for debugging purpose")
+	qlogSSH3Messages := flag.Bool("qlog-ssh3-messages", false, "if set along with -qlog-dir, also trace the decrypted SSH3 messages of each conversation in the qlog directory")
+	auditLogPath := flag.String("audit-log", "", "if set, append tamper-evident audit records to the specified file, or send them to syslog if set to \"syslog\"")
+	verifyAuditLogPath := flag.String("verify-audit-log", "", "verify the chain of records of the specified audit log file and exit")
+	configPath := flag.String("config", "", "if set, the filename of a JSON server config (e.g. for username canonicalization)")
+	privsepUser := flag.String("privsep-user", "", "if set, parse the network traffic in a worker process running as this unprivileged user, "+
+		"the operations requiring privileges being performed by the main process")
 	enablePasswordLogin := false
 	if unix_util.PasswordAuthAvailable() {
 		flag.BoolVar(&enablePasswordLogin, "enable-password-login", false, "if set, enable password authentication (disabled by default)")
 	}
+	printVersionFlag := flag.Bool("V", false, "print the version and exit")
+	printFeatures := flag.Bool("features", false, "along with -V, print a JSON report of the compiled-in features, supported protocol versions and build provenance")
 	flag.Parse()
 
-	if !enablePasswordLogin {
+	if *printVersionFlag {
+		os.Exit(printVersion(*printFeatures))
+	}
+	if *verifyAuditLogPath != "" {
+		os.Exit(verifyAuditLog(*verifyAuditLogPath))
+	}
+	if *rotateCert {
+		if err := rotateSelfSignedCert(*certPath, *keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "could not rotate the certificate: %s\n", err)
+			os.Exit(-1)
+		}
+		fmt.Fprintf(os.Stderr, "rotated the certificate %s and key %s, restart the server to use them\n", *certPath, *keyPath)
+		os.Exit(0)
+	}
+
+	if !enablePasswordLogin && !isPrivsepWorker {
 		fmt.Fprintln(os.Stderr, "password login is disabled")
 	}
 
+	serverConfig := &unix_server.ServerConfig{}
+	if *configPath != "" && !isPrivsepWorker {
+		var err error
+		serverConfig, err = unix_server.LoadServerConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load server config: %s\n", err)
+			os.Exit(-1)
+		}
+		serverConfigPath = *configPath
+	}
+
 	certPathExists := fileExists(*certPath)
 	keyPathExists := fileExists(*keyPath)
 
-	if !*generateSelfSignedCert {
+	if isPrivsepWorker {
+		// the certificate is provided by the monitor
+	} else if serverConfig.ACME != nil {
+		if *generateSelfSignedCert {
+			fmt.Fprintln(os.Stderr, "cannot generate a self-signed certificate when the certificate is obtained using ACME")
+			os.Exit(-1)
+		}
+		if *privsepUser != "" {
+			fmt.Fprintln(os.Stderr, "the certificates obtained using ACME cannot be used along with -privsep-user yet")
+			os.Exit(-1)
+		}
+	} else if !*generateSelfSignedCert {
 		if !certPathExists {
 			fmt.Fprintf(os.Stderr, "the \"%s\" certificate file does not exist\n", *certPath)
 		}
@@ -731,9 +1125,14 @@ func main() {
 
 	}
 
+	// also the output of the worker if the privileges are separated
+	var logOutput io.Writer = os.Stderr
 	if *verbose {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		util.ConfigureLogger("debug")
+	} else if isPrivsepWorker {
+		// the stderr of the worker is the log file of the monitor
+		util.ConfigureLogger(os.Getenv("SSH3_LOG_LEVEL"))
 	} else {
 		util.ConfigureLogger(os.Getenv("SSH3_LOG_LEVEL"))
 
@@ -747,11 +1146,179 @@ func main() {
 			return
 		}
 		log.Logger = log.Output(logFile)
+		logOutput = logFile
+	}
+
+	var err error
+	var workerSetup *privsepWorkerSetup
+	if isPrivsepWorker {
+		workerSetup, err = setupPrivsepWorker()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set up the privilege separation worker: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	var auditLogger *audit.Logger
+	if isPrivsepWorker {
+		audit.SetDefaultLogger(monitorAuditLogger{})
+	} else if *auditLogPath != "" {
+		if *auditLogPath == "syslog" {
+			auditLogger, err = audit.NewSyslogLogger("ssh3-server")
+		} else {
+			auditLogger, err = audit.OpenFile(*auditLogPath)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open audit log %s: %s\n", *auditLogPath, err)
+			os.Exit(-1)
+		}
+		audit.SetDefaultLogger(auditLogger)
+	}
+
+	if isPrivsepWorker {
+		serverConfig = workerSetup.serverConfig
+	}
+	// in privilege separation mode, the policy is applied by the monitor writing the records
+	if auditLogger != nil && serverConfig.AuditPolicy != nil {
+		policyLogger, err := audit.NewPolicyLogger(auditLogger, serverConfig.AuditPolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set up the audit policy: %s\n", err)
+			os.Exit(-1)
+		}
+		audit.SetDefaultLogger(policyLogger)
+	}
+	maintenance.configure(serverConfig.Maintenance)
+	applyReloadableSettings(serverConfig)
+	sessionRecording = serverConfig.SessionRecording
+	concurrencyLimits = serverConfig.ConcurrencyLimits
+	confinements = serverConfig.Confinements
+	resourceLimits = serverConfig.ResourceLimits
+	bandwidthLimits = serverConfig.BandwidthLimits
+	cgroupDirectory = serverConfig.CgroupDirectory
+	virtualHosts = serverConfig.VirtualHosts
+	rpcSubsystem = serverConfig.RPCSubsystem
+	if err := registerSubsystems(serverConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "could not register the subsystems: %s\n", err)
+		os.Exit(-1)
+	}
+	if serverConfig.ChannelPlugins != nil {
+		channelPlugins, err = unix_server.LoadChannelPlugins(serverConfig.ChannelPlugins)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load the channel plugins: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+	sessionTmpDir = serverConfig.SessionTmpDir
+	if serverConfig.EgressProxy != nil {
+		egressDialer, err = unix_server.NewEgressDialer(serverConfig.EgressProxy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid egress proxy config: %s\n", err)
+			os.Exit(-1)
+		}
+		unix_server.UseEgressDialer(egressDialer)
+	}
+	if serverConfig.OpenIDConnect != nil {
+		if err := unix_server.ConfigureOpenIDConnect(serverConfig.OpenIDConnect); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid OpenID Connect config: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+	unix_server.RegisterTokenValidators(serverConfig.TokenValidators)
+	if serverConfig.WindowsShell != "" {
+		unix_util.WindowsShell = serverConfig.WindowsShell
+	}
+	var acmeManager *unix_server.ACMEManager
+	if serverConfig.ACME != nil && !isPrivsepWorker {
+		acmeManager, err = startACME(serverConfig.ACME)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not obtain the certificate using ACME: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+	if !isPrivsepWorker {
+		removeExpiredRecordingsInBackground(sessionRecording)
+	}
+	if *privsepUser != "" && !isPrivsepWorker {
+		if serverConfig.ManagementAPI != nil {
+			fmt.Fprintln(os.Stderr, "the management API cannot be served when the privileges are separated, use the admin socket")
+			os.Exit(-1)
+		}
+		if serverConfig.TCPFallback != nil {
+			fmt.Fprintln(os.Stderr, "the TCP fallback cannot be used along with -privsep-user yet")
+			os.Exit(-1)
+		}
+		if serverConfig.ClientCertificates != nil {
+			// the certificates are verified by the TLS stack of the worker, that the monitor cannot trust
+			fmt.Fprintln(os.Stderr, "the client certificates cannot be used along with -privsep-user yet")
+			os.Exit(-1)
+		}
+		os.Exit(runPrivsepMonitor(*privsepUser, *bindAddr, *certPath, *keyPath, *adminSocketPath, enablePasswordLogin, serverConfig, logOutput))
+	}
+
+	tracesFileName := os.Getenv("SSH3_TRACES_FILE")
+	shutdownTracing, err := util.ConfigureTracing(context.Background(), "ssh3-server", tracesFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not configure tracing: %s\n", err)
+		os.Exit(-1)
+	}
+	defer shutdownTracing(context.Background())
+
+	canonicalizeUsername, err := unix_server.NewUsernameCanonicalizer(serverConfig.UsernameCanonicalization)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid username canonicalization config: %s\n", err)
+		os.Exit(-1)
+	}
+
+	if isPrivsepWorker {
+		if workerSetup.adminListener != nil {
+			serveAdmin(workerSetup.adminListener)
+		}
+	} else if *adminSocketPath != "" {
+		if err := serveAdminSocket(*adminSocketPath); err != nil {
+			fmt.Fprintf(os.Stderr, "could not serve admin socket at %s: %s\n", *adminSocketPath, err)
+			os.Exit(-1)
+		}
+	}
+
+	if serverConfig.ManagementAPI != nil {
+		managementTLSConfig := &tls.Config{}
+		if acmeManager != nil {
+			managementTLSConfig.GetCertificate = acmeManager.GetCertificate
+		} else if certificate, err := tls.LoadX509KeyPair(*certPath, *keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "could not load the certificate of the management API: %s\n", err)
+			os.Exit(-1)
+		} else {
+			managementTLSConfig.Certificates = []tls.Certificate{certificate}
+		}
+		if err := serveManagementAPI(serverConfig.ManagementAPI, managementTLSConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "could not serve the management API: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	var issuedBreakGlassTokens *breakGlassTokens
+	if serverConfig.BreakGlass != nil && !isPrivsepWorker {
+		// the monitor serves it if the privileges are separated
+		serverStore, err := unix_server.OpenStore(context.Background(), serverConfig.Store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open the store: %s\n", err)
+			os.Exit(-1)
+		}
+		issuedBreakGlassTokens, err = serveBreakGlassSocket(serverConfig.BreakGlass, serverStore)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not serve break-glass socket at %s: %s\n", serverConfig.BreakGlass.Socket, err)
+			os.Exit(-1)
+		}
 	}
 
 	quicConf := &quic.Config{
 		Allow0RTT: true,
 	}
+	serverConfig.FlowControl.ApplyTo(quicConf)
+	serverConfig.Transport.ApplyTo(quicConf)
+	if *qlogDir != "" {
+		quicConf.Tracer = util.QlogTracer(*qlogDir)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -767,10 +1334,32 @@ func main() {
 
 		mux := http.NewServeMux()
 		ssh3Server := ssh3.NewServer(30000, 10, &server, func(authenticatedUsername string, conv *ssh3.Conversation) error {
+			if monitor != nil {
+				defer endMonitoredConversation(monitoredConversationID(conv.ConversationID()))
+			}
 			authenticatedUser, err := unix_util.GetUser(authenticatedUsername)
 			if err != nil {
 				return err
 			}
+			forcedCommand := forcedCommands.take(conv)
+			remoteAddr := remoteAddresses.take(conv)
+			activeConversations.add(authenticatedUsername, conv, remoteAddr)
+			conv.SetBandwidthLimiter(userBandwidthLimiter(authenticatedUsername))
+			quota := newForwardingQuota(settings().forwardingQuotas)
+			dispatcher := newConversationDispatcher(conv, authenticatedUsername, authenticatedUser, quota)
+			conv.SetChannelOpenFilter(dispatcher.ChannelOpenFilter())
+			// the forwarding channels are confirmed once their destination is reached
+			conv.DeferChannelConfirmation("direct-tcp", "direct-udp")
+			defer activeConversations.remove(conv)
+			if *qlogDir != "" && *qlogSSH3Messages {
+				messageTracer, err := ssh3.CreateQlogMessageTracer(*qlogDir, "server", conv.ConversationID())
+				if err != nil {
+					log.Error().Msgf("could not create SSH3 messages qlog for conversation %s: %s", conv.ConversationID(), err)
+				} else {
+					defer messageTracer.Close()
+					conv.SetMessageTracer(messageTracer)
+				}
+			}
 			for {
 				channel, err := conv.AcceptChannel(conv.Context())
 				if err != nil {
@@ -779,68 +1368,88 @@ func main() {
 
 				switch c := channel.(type) {
 				case *ssh3.UDPForwardingChannelImpl:
-					handleUDPForwardingChannel(conv.Context(), authenticatedUser, conv, c)
+					handleUDPForwardingChannel(conv.Context(), authenticatedUser, conv, c, quota)
 				case *ssh3.TCPForwardingChannelImpl:
-					handleTCPForwardingChannel(conv.Context(), authenticatedUser, conv, c)
+					handleTCPForwardingChannel(conv.Context(), authenticatedUser, conv, c, quota)
 				default:
-					runningSessions[channel] = &runningSession{
-						channelState: LARVAL,
-						pty:          nil,
-						runningCmd:   nil,
+					sessionCtx, sessionSpan := tracer.Start(conv.Context(), "ssh3.session", trace.WithAttributes(ssh3.ChannelAttributes(channel)...))
+					runningSessions.set(channel, &runningSession{
+						channelState:  LARVAL,
+						pty:           nil,
+						runningCmd:    nil,
+						forcedCommand: forcedCommand,
+						traceContext:  sessionCtx,
+						remoteAddr:    remoteAddr,
+					})
+					_, isPlugin := channelPlugins[channel.ChannelType()]
+					if isPlugin {
+						if err := newChannelPlugin(authenticatedUser, channel); err != nil {
+							log.Error().Msgf("could not run the plugin of %s channel %d: %s", channel.ChannelType(), channel.ChannelID(), err)
+							util.SetSpanError(sessionSpan, err)
+							sessionSpan.End()
+							channel.Close()
+							continue
+						}
 					}
 					go func() {
 						// handle the main sessionChannel, once it ends, the whole conversation ends
+						// unless the client runs several sessions in the conversation
+						defer sessionSpan.End()
 						defer channel.Close()
-						defer conv.Close()
+						defer runningSessions.remove(channel)
+						defer detachPersistentSession(channel)
+						endsConversation := !isPlugin && !conv.PeerExtInfo().HasFeature(ssh3.FeatureMultipleSessions)
+						// a malformed message only ends its channel, the client ending the conversation
+						// once it gets the exit status of the session
+						malformed := false
+						if endsConversation {
+							defer func() {
+								if !malformed {
+									conv.Close()
+								}
+							}()
+						}
+						defer recoverChannelPanic(authenticatedUsername, channel)
 						for {
 							genericMessage, err := channel.NextMessage()
 							if errors.Is(err, net.ErrClosed) {
 								log.Debug().Msgf("the connection was closed by the application: %s", err)
 								return
+							} else if isMalformedMessage(err) {
+								auditMalformedMessage(authenticatedUsername, channel, err)
+								util.SetSpanError(sessionSpan, err)
+								malformed = true
+								// the running commands send their own exit status
+								if session, ok := runningSessions.get(channel); !ok || session.runningCmd == nil {
+									if err := channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+										WantReply:      false,
+										ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: 255},
+									}); err != nil {
+										log.Debug().Msgf("could not send the exit status of channel %d: %s", channel.ChannelID(), err)
+									}
+								}
+								channel.CancelRead()
+								return
 							} else if err != nil && !errors.Is(err, io.EOF) {
 								log.Error().Msgf("error when getting message: %s", err)
 								return
 							}
 							if genericMessage == nil {
-								return
-							}
-							switch message := genericMessage.(type) {
-							case *ssh3Messages.ChannelRequestMessage:
-								switch requestMessage := message.ChannelRequest.(type) {
-								case *ssh3Messages.PtyRequest:
-									err = newPtyReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.X11Request:
-									err = newX11Req(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.ShellRequest:
-									err = newShellReq(authenticatedUser, channel, message.WantReply)
-								case *ssh3Messages.ExecRequest:
-									err = newCommandInShellReq(authenticatedUser, channel, message.WantReply, requestMessage.Command)
-								case *ssh3Messages.SubsystemRequest:
-									err = newSubsystemReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.WindowChangeRequest:
-									err = newWindowChangeReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.SignalRequest:
-									err = newSignalReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.ExitStatusRequest:
-									err = newExitStatusReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								case *ssh3Messages.ExitSignalRequest:
-									err = newExitSignalReq(authenticatedUser, channel, *requestMessage, message.WantReply)
-								}
-							case *ssh3Messages.DataOrExtendedDataMessage:
-								runningSession, ok := runningSessions[channel]
-								if ok && runningSession.channelState == LARVAL {
-									if message.Data == string("forward-agent") {
-										runningSession.authAgentSocketPath, err = openAgentSocketAndForwardAgent(conv.Context(), conv, authenticatedUser)
-									} else {
-										// invalid data on larval state
-										err = fmt.Errorf("invalid data on ssh channel with LARVAL state")
+								// the client closed its side of the channel after its input, the
+								// output of the command is still sent until it exits. The persistent
+								// sessions are detached instead.
+								if session, ok := runningSessions.get(channel); ok && session.runningCmd != nil && session.runningCmd.persistent == nil {
+									if err := newEOFReq(authenticatedUser, channel); err != nil {
+										log.Debug().Msgf("could not close the input of the command of channel %d: %s", channel.ChannelID(), err)
 									}
-								} else {
-									err = newDataReq(authenticatedUser, channel, *message)
+									<-session.runningCmd.outputSent
 								}
+								return
 							}
+							err = dispatcher.Dispatch(sessionCtx, channel, genericMessage)
 							if err != nil {
 								log.Error().Msgf("error while processing message: %+v: %+v\n", genericMessage, err)
+								util.SetSpanError(sessionSpan, err)
 								return
 							}
 						}
@@ -849,18 +1458,190 @@ func main() {
 
 			}
 		})
-		ssh3Handler := ssh3Server.GetHTTPHandlerFunc(context.Background())
-		handler, err := unix_server.HandleAuths(context.Background(), enablePasswordLogin, 30000, ssh3Handler)
+		ssh3Server.AdvertiseChannelTypes(acceptedChannelTypes(), ssh3.FeatureDatagramTyping, ssh3.FeatureChannelEOF, ssh3.FeatureMultipleSessions, ssh3.FeatureRequestReplies)
+		ssh3Server.SetCompression(serverConfig.Compression)
+		ssh3Handler := accessControlHandler(maintenanceHandler(conversationLimitHandler(forceCommandHandler(remoteAddressHandler(ssh3Server.GetHTTPHandlerFunc(context.Background()))))))
+		// already validated along with the server config
+		authenticationMethods, _ := unix_server.ParseAuthenticationMethods(serverConfig.AuthenticationMethods)
+		// the authenticator of the server, before the pre-authorization tokens that the virtual hosts can replace
+		var serverAuthenticator unix_server.Authenticator
+		if isPrivsepWorker {
+			serverAuthenticator = monitorAuthenticator{}
+		} else {
+			serverAuthenticator = unix_server.LocalAuthenticator{RevokedKeysFile: serverConfig.RevokedKeys}
+			if issuedBreakGlassTokens != nil {
+				serverAuthenticator = breakGlassAuthenticator{Authenticator: serverAuthenticator, tokens: issuedBreakGlassTokens}
+			}
+		}
+		// returns the authentication handler of the virtual host, or of the default host if nil
+		newAuthHandler := func(host *unix_server.VirtualHostConfig) (http.HandlerFunc, error) {
+			authenticator, passwordLogin, canonicalize := serverAuthenticator, enablePasswordLogin, canonicalizeUsername
+			if host != nil {
+				passwordLogin, canonicalize = host.PasswordLoginEnabled(enablePasswordLogin), host.UsernameCanonicalizer(canonicalizeUsername)
+			}
+			if isPrivsepWorker {
+				if host != nil {
+					authenticator = monitorAuthenticator{virtualHost: host.Name}
+				}
+			} else {
+				var err error
+				if authenticator, err = withPreauth(authenticator, serverConfig, host); err != nil {
+					return nil, fmt.Errorf("could not load the pre-authorization verification keys: %w", err)
+				}
+			}
+			if serverConfig.ClientCertificates != nil {
+				authenticator = clientCertificateAuthenticator{Authenticator: authenticator, config: serverConfig.ClientCertificates}
+			}
+			return unix_server.HandleAuths(context.Background(), passwordLogin, 30000, canonicalize, authenticator, authenticationMethods, ssh3Handler)
+		}
+		ssh3Path := *urlPath
+		routePath := func(urlPath string) string { return urlPath }
+		if serverConfig.ReverseProxy != nil {
+			routePath = serverConfig.ReverseProxy.Path
+			ssh3Path = routePath(*urlPath)
+		}
+		router := &unix_server.VirtualHostRouter{}
+		for i := range serverConfig.VirtualHosts {
+			host := &serverConfig.VirtualHosts[i]
+			hostHandler, err := newAuthHandler(host)
+			if err != nil {
+				log.Error().Msgf("Could not get authentication handlers of virtual host %s: %s", host.Name, err)
+				return
+			}
+			router.Handle(host, routePath(host.Path(*urlPath)), hostHandler)
+			log.Info().Msgf("serving virtual host %s on %s for the server names %v", host.Name, routePath(host.Path(*urlPath)), host.ServerNames)
+		}
+		defaultHandler, err := newAuthHandler(nil)
 		if err != nil {
 			log.Error().Msgf("Could not get authentication handlers: %s", err)
 			return
 		}
-		mux.HandleFunc(*urlPath, handler)
-		server.Handler = mux
-		outputMessage := fmt.Sprintf("Server started, listening on %s%s", *bindAddr, *urlPath)
+		router.Handle(nil, ssh3Path, defaultHandler)
+		handler := http.HandlerFunc(router.ServeHTTP)
+		if serverConfig.BannerFile != "" {
+			banner, err := os.ReadFile(serverConfig.BannerFile)
+			if err != nil {
+				log.Error().Msgf("could not read the banner file: %s", err)
+				return
+			}
+			handler = unix_server.BannerHandler(string(banner), handler)
+		}
+		if concurrencyLimits.MaxStartups != "" {
+			// validated with the config
+			maxStartups, _ := unix_server.ParseMaxStartups(concurrencyLimits.MaxStartups)
+			handler = unix_server.NewStartupLimiter(maxStartups).Handler(handler)
+		}
+		if serverConfig.AuthRateLimit != nil {
+			storeConfig := serverConfig.Store
+			if isPrivsepWorker && (storeConfig == nil || storeConfig.Type != "redis") {
+				// the worker cannot open the store files of the monitor, it counts its failures itself
+				storeConfig = nil
+			}
+			rateLimitStore, err := unix_server.OpenStore(context.Background(), storeConfig)
+			if err != nil {
+				log.Error().Msgf("could not open the store of the authentication rate limits: %s", err)
+				return
+			}
+			defer rateLimitStore.Close()
+			rateLimiter, err := unix_server.NewAuthRateLimiter(serverConfig.AuthRateLimit, rateLimitStore)
+			if err != nil {
+				log.Error().Msgf("%s", err)
+				return
+			}
+			handler = rateLimiter.Handler(handler)
+		}
+		var proxyConn *ssh3.ProxyProtocolConn
+		if reverseProxy := serverConfig.ReverseProxy; reverseProxy != nil {
+			if reverseProxy.ProxyProtocol {
+				var workerConn net.PacketConn
+				if isPrivsepWorker {
+					workerConn = workerSetup.packetConn
+				}
+				proxyConn, err = listenProxyProtocol(reverseProxy, serverConfig.Transport, *bindAddr, workerConn)
+				if err != nil {
+					log.Error().Msgf("could not listen for the PROXY protocol: %s", err)
+					return
+				}
+				defer proxyConn.Close()
+			}
+			handler, err = reverseProxy.ClientAddressHandler(proxyConn, handler)
+			if err != nil {
+				log.Error().Msgf("%s", err)
+				return
+			}
+			if reverseProxy.HealthCheckPath != "" {
+				mux.HandleFunc(reverseProxy.Path(reverseProxy.HealthCheckPath), handleHealthCheck)
+			}
+		}
+		if serverConfig.Stealth != nil {
+			handlers := make(map[string]http.HandlerFunc)
+			for _, path := range router.Paths() {
+				handlers[path] = handler
+			}
+			// the hidden endpoint replaces the mux, which would answer differently to some paths, e.g. by redirecting them
+			server.Handler, err = unix_server.NewStealthHandler(serverConfig.Stealth, handlers)
+			if err != nil {
+				log.Error().Msgf("could not hide the server: %s", err)
+				return
+			}
+		} else {
+			for _, path := range router.Paths() {
+				mux.HandleFunc(path, handler)
+			}
+			server.Handler = mux
+		}
+		outputMessage := fmt.Sprintf("Server started, listening on %s%s", *bindAddr, ssh3Path)
 		fmt.Fprintln(os.Stderr, outputMessage)
 		log.Info().Msg(outputMessage)
-		err = server.ListenAndServeTLS(*certPath, *keyPath)
+		if isPrivsepWorker {
+			server.TLSConfig = workerSetup.tlsConfig
+		} else if acmeManager != nil {
+			server.TLSConfig = &tls.Config{GetCertificate: acmeManager.GetCertificate}
+		} else {
+			certificate, err := tls.LoadX509KeyPair(*certPath, *keyPath)
+			if err != nil {
+				log.Error().Msgf("could not load the certificate: %s", err)
+				return
+			}
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+		var virtualHostCertificates map[string]tls.Certificate
+		if isPrivsepWorker {
+			virtualHostCertificates = workerSetup.virtualHostCertificates
+		} else if virtualHostCertificates, err = unix_server.LoadVirtualHostCertificates(serverConfig.VirtualHosts); err != nil {
+			log.Error().Msgf("%s", err)
+			return
+		}
+		unix_server.ApplyVirtualHostCertificates(server.TLSConfig, serverConfig.VirtualHosts, virtualHostCertificates)
+		if serverConfig.OCSPStapling {
+			stapleTLSConfig(server.TLSConfig)
+		}
+		if err := serverConfig.PostQuantumKeyExchange.ApplyTo(server.TLSConfig); err != nil {
+			log.Error().Msgf("%s", err)
+			return
+		}
+		if serverConfig.ClientCertificates != nil {
+			if err := serverConfig.ClientCertificates.ApplyTo(server.TLSConfig); err != nil {
+				log.Error().Msgf("could not load the client certificate authorities: %s", err)
+				return
+			}
+		}
+		if tcpFallback := serverConfig.TCPFallback; tcpFallback != nil {
+			go func() {
+				if err := serveTCPFallback(&server, tcpFallback.BindAddr(*bindAddr), router.Paths()); err != nil {
+					log.Error().Msgf("error while serving the TCP fallback: %s", err)
+				}
+			}()
+		}
+		if proxyConn != nil {
+			err = server.Serve(proxyConn)
+		} else if isPrivsepWorker {
+			err = server.Serve(workerSetup.packetConn)
+		} else if serverConfig.Transport.CustomizesSocket() {
+			err = serveWithReceiveBuffer(&server, serverConfig.Transport)
+		} else {
+			err = server.ListenAndServe()
+		}
 
 		if err != nil {
 			log.Error().Msgf("error while serving HTTP connection: %s", err)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultMaintenanceBanner = "The server is under maintenance, please try again later."
+
+type maintenanceStatus struct {
+	Enabled      bool     `json:"enabled"`
+	Banner       string   `json:"banner"`
+	AllowedUsers []string `json:"allowed_users"`
+}
+
+// when enabled, only the allowed users can start new conversations,
+// the established conversations are kept
+type maintenanceMode struct {
+	enabled      bool
+	banner       string
+	allowedUsers map[string]bool
+	lock         sync.Mutex
+}
+
+var maintenance = &maintenanceMode{banner: defaultMaintenanceBanner, allowedUsers: make(map[string]bool)}
+
+func (m *maintenanceMode) configure(config unix_server.MaintenanceConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.enabled = config.Enabled
+	if config.Banner != "" {
+		m.banner = config.Banner
+	}
+	for _, username := range config.AllowedUsers {
+		m.allowedUsers[username] = true
+	}
+}
+
+func (m *maintenanceMode) status() maintenanceStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	allowedUsers := make([]string, 0, len(m.allowedUsers))
+	for username := range m.allowedUsers {
+		allowedUsers = append(allowedUsers, username)
+	}
+	sort.Strings(allowedUsers)
+	return maintenanceStatus{Enabled: m.enabled, Banner: m.banner, AllowedUsers: allowedUsers}
+}
+
+// an empty banner keeps the current one
+func (m *maintenanceMode) set(enabled bool, banner string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.enabled = enabled
+	if banner != "" {
+		m.banner = banner
+	}
+}
+
+// returns the banner to display and true if username must be refused
+func (m *maintenanceMode) refuses(username string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.enabled || m.allowedUsers[username] {
+		return "", false
+	}
+	return m.banner, true
+}
+
+// refuses the conversations of the users not allowed in maintenance mode
+func maintenanceHandler(handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.AuthenticatedHandlerFunc {
+	return func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+		if banner, refused := maintenance.refuses(authenticatedUsername); refused {
+			log.Info().Msgf("refusing conversation of user %s: the server is in maintenance mode", authenticatedUsername)
+			audit.Log(audit.Event{
+				Type:           audit.EventAccessDenied,
+				Username:       authenticatedUsername,
+				ConversationID: newConv.ConversationID().String(),
+				RemoteAddr:     r.RemoteAddr,
+				Details:        map[string]string{"reason": "maintenance"},
+			})
+			refuseConversation(newConv, w, http.StatusServiceUnavailable, banner)
+			return
+		}
+		handlerFunc(authenticatedUsername, newConv, w, r)
+	}
+}
+
+type maintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Banner  string `json:"banner"`
+}
+
+// GET returns the maintenance status, POST {"enabled": true, "banner": "..."} toggles it
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request maintenanceRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maintenance.set(request.Enabled, request.Banner)
+		log.Info().Msgf("maintenance mode set to %t using the admin socket", request.Enabled)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(maintenance.status()); err != nil {
+		log.Error().Msgf("could not write maintenance status on admin socket: %s", err)
+	}
+}
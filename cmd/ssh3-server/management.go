@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/rs/zerolog/log"
+)
+
+// the time given to the clients of the management API to send the headers of their requests
+const managementReadHeaderTimeout = 10 * time.Second
+
+// returns the bearer tokens listed in the file, one per line, ignoring the empty lines and the
+// comments starting with '#'
+func readManagementTokens(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	return tokens, scanner.Err()
+}
+
+// returns true if the request carries one of the tokens of the file
+func authorizedManagementRequest(tokensFile string, r *http.Request) (bool, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false, nil
+	}
+	tokens, err := readManagementTokens(tokensFile)
+	if err != nil {
+		return false, err
+	}
+	// the hashes have the same length, so that comparing them does not leak the token lengths
+	tokenHash := sha256.Sum256([]byte(token))
+	authorized := false
+	for _, candidate := range tokens {
+		candidateHash := sha256.Sum256([]byte(candidate))
+		if subtle.ConstantTimeCompare(tokenHash[:], candidateHash[:]) == 1 {
+			authorized = true
+		}
+	}
+	return authorized, nil
+}
+
+// only lets the requests carrying one of the bearer tokens of the config through
+func managementAuthHandler(config *unix_server.ManagementAPIConfig, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized, err := authorizedManagementRequest(config.TokensFile, r)
+		if err != nil {
+			log.Error().Msgf("could not read the management API tokens: %s", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !authorized {
+			log.Warn().Msgf("refusing management API request from %s: missing or unknown bearer token", r.RemoteAddr)
+			audit.Log(audit.Event{
+				Type:       audit.EventAccessDenied,
+				RemoteAddr: r.RemoteAddr,
+				Details:    map[string]string{"reason": "management_api", "path": r.URL.Path},
+			})
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ssh3-server"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serves the admin API over HTTPS in background, using the certificate of the server
+func serveManagementAPI(config *unix_server.ManagementAPIConfig, tlsConfig *tls.Config) error {
+	listener, err := tls.Listen("tcp", config.Listen, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %w", config.Listen, err)
+	}
+	server := &http.Server{
+		Handler:           managementAuthHandler(config, newAdminMux()),
+		ReadHeaderTimeout: managementReadHeaderTimeout,
+	}
+	go func() {
+		defer listener.Close()
+		if err := server.Serve(listener); err != nil {
+			log.Error().Msgf("management API stopped serving: %s", err)
+		}
+	}()
+	log.Info().Msgf("serving the management API on %s", config.Listen)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/unix_server"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// records the audited events
+type recordedEvents struct {
+	events []audit.Event
+}
+
+func (r *recordedEvents) Log(event audit.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+var _ = Describe("Management API", func() {
+	var tokensFile string
+	var events *recordedEvents
+
+	BeforeEach(func() {
+		tokensFile = filepath.Join(GinkgoT().TempDir(), "management_tokens")
+		Expect(os.WriteFile(tokensFile, []byte("# the token of the monitoring\n  monitoring-token  \n\nops-token\n"), 0600)).To(Succeed())
+		events = &recordedEvents{}
+		audit.SetDefaultLogger(events)
+		DeferCleanup(func() { audit.SetDefaultLogger(nil) })
+	})
+
+	// returns a request to the management API carrying the Authorization header, if not empty
+	request := func(authorization string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://localhost/conversations", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+
+	It("Reads the tokens without the comments and the empty lines", func() {
+		Expect(readManagementTokens(tokensFile)).To(Equal([]string{"monitoring-token", "ops-token"}))
+	})
+
+	It("Only authorizes the requests carrying one of the tokens", func() {
+		for _, testCase := range []struct {
+			authorization string
+			authorized    bool
+		}{
+			{"Bearer monitoring-token", true},
+			{"Bearer ops-token", true},
+			{"Bearer ops", false},
+			{"Bearer ops-token-2", false},
+			{"Bearer # the token of the monitoring", false},
+			{"Bearer ", false},
+			{"Basic b3BzLXRva2Vu", false},
+			{"ops-token", false},
+			{"", false},
+		} {
+			authorized, err := authorizedManagementRequest(tokensFile, request(testCase.authorization))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authorized).To(Equal(testCase.authorized), testCase.authorization)
+		}
+	})
+
+	It("Only reads the tokens of the requests carrying one", func() {
+		missingFile := filepath.Join(GinkgoT().TempDir(), "missing")
+		authorized, err := authorizedManagementRequest(missingFile, request(""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(authorized).To(BeFalse())
+		_, err = authorizedManagementRequest(missingFile, request("Bearer ops-token"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("Handler", func() {
+		var served bool
+		var handler http.Handler
+
+		BeforeEach(func() {
+			served = false
+			handler = managementAuthHandler(&unix_server.ManagementAPIConfig{TokensFile: tokensFile}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+			}))
+		})
+
+		serve := func(r *http.Request) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, r)
+			return recorder
+		}
+
+		It("Serves the authorized requests", func() {
+			Expect(serve(request("Bearer ops-token")).Code).To(Equal(http.StatusOK))
+			Expect(served).To(BeTrue())
+			Expect(events.events).To(BeEmpty())
+		})
+
+		It("Refuses and audits the unauthorized requests", func() {
+			r := request("Bearer wrong-token")
+			recorder := serve(r)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(recorder.Header().Get("WWW-Authenticate")).To(Equal(`Bearer realm="ssh3-server"`))
+			Expect(served).To(BeFalse())
+			Expect(events.events).To(Equal([]audit.Event{{
+				Type:       audit.EventAccessDenied,
+				RemoteAddr: r.RemoteAddr,
+				Details:    map[string]string{"reason": "management_api", "path": "/conversations"},
+			}}))
+		})
+
+		It("Refuses the requests when the tokens cannot be read", func() {
+			Expect(os.Remove(tokensFile)).To(Succeed())
+			Expect(serve(request("Bearer ops-token")).Code).To(Equal(http.StatusInternalServerError))
+			Expect(served).To(BeFalse())
+		})
+	})
+})
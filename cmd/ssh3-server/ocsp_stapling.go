@@ -0,0 +1,21 @@
+package main
+
+import (
+	"crypto/tls"
+
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+// makes tlsConf staple the OCSP responses about its certificate, either static or obtained using
+// ACME
+func stapleTLSConfig(tlsConf *tls.Config) {
+	getCertificate := tlsConf.GetCertificate
+	if getCertificate == nil {
+		certificate := tlsConf.Certificates[0]
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &certificate, nil
+		}
+	}
+	tlsConf.Certificates = nil
+	tlsConf.GetCertificate = unix_server.NewOCSPStapler(getCertificate, egressHTTPClient()).GetCertificate
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+// the scrollback replayed when reattaching if the config does not set it
+const defaultScrollbackKB = 64
+
+// where the output goroutine of a session writes its output and exit status
+type sessionOutput interface {
+	WriteData(dataBuf []byte, dataType ssh3Messages.SSHDataType) (int, error)
+	SendRequest(r *ssh3Messages.ChannelRequestMessage) error
+}
+
+// a pty session whose command survives the end of its conversation, its output being kept in
+// its scrollback until its user reattaches a channel of another conversation to it
+type persistentSession struct {
+	id        string
+	username  string
+	session   *runningSession
+	title     string
+	startTime time.Time
+	// the number of bytes of output replayed when reattaching
+	scrollbackSize int
+	// if positive, the session is hung up once detached for this long
+	detachedTimeout time.Duration
+
+	lock sync.Mutex
+	// nil while the session is detached
+	channel    ssh3.Channel
+	detachTime time.Time
+	hangUp     *time.Timer
+	scrollback []byte
+	ended      bool
+}
+
+var _ sessionOutput = &persistentSession{}
+
+type persistentSessionsRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*persistentSession
+}
+
+var persistentSessions = &persistentSessionsRegistry{sessions: make(map[string]*persistentSession)}
+
+// returns nil if the session ends along with its conversation, its ID being exported to the
+// command as SSH3_SESSION_ID otherwise
+func newPersistentSession(user *unix_util.User, channel ssh3.Channel, session *runningSession, runningCommand *runningCommand) (*persistentSession, error) {
+	sessionPersistence := settings().sessionPersistence
+	if sessionPersistence == nil || session.pty == nil || !sessionPersistence.AllowsUser(user.Username) {
+		return nil, nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	scrollbackKB := sessionPersistence.ScrollbackKB
+	if scrollbackKB == 0 {
+		scrollbackKB = defaultScrollbackKB
+	}
+	persistent := &persistentSession{
+		id:              hex.EncodeToString(id),
+		username:        user.Username,
+		session:         session,
+		title:           strings.Join(runningCommand.Args, " "),
+		startTime:       time.Now(),
+		scrollbackSize:  scrollbackKB << 10,
+		detachedTimeout: time.Duration(sessionPersistence.DetachedTimeoutMinutes) * time.Minute,
+		channel:         channel,
+	}
+	runningCommand.Env = append(runningCommand.Env, fmt.Sprintf("SSH3_SESSION_ID=%s", persistent.id))
+	return persistent, nil
+}
+
+func (r *persistentSessionsRegistry) add(p *persistentSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sessions[p.id] = p
+}
+
+func (r *persistentSessionsRegistry) remove(p *persistentSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sessions, p.id)
+}
+
+// returns nil if the user has no such session
+func (r *persistentSessionsRegistry) get(username string, id string) *persistentSession {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if p, ok := r.sessions[id]; ok && p.username == username {
+		return p
+	}
+	return nil
+}
+
+// returns the sessions of the user, the oldest first
+func (r *persistentSessionsRegistry) list(username string) []*persistentSession {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sessions []*persistentSession
+	for _, p := range r.sessions {
+		if p.username == username {
+			sessions = append(sessions, p)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].startTime.Before(sessions[j].startTime)
+	})
+	return sessions
+}
+
+// keeps the output in the scrollback and writes it on the attached channel. The session is
+// detached rather than ended if the channel cannot be written anymore.
+func (p *persistentSession) WriteData(buf []byte, dataType ssh3Messages.SSHDataType) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.scrollback = append(p.scrollback, buf...)
+	if len(p.scrollback) > p.scrollbackSize {
+		p.scrollback = p.scrollback[len(p.scrollback)-p.scrollbackSize:]
+	}
+	if p.channel != nil {
+		if _, err := p.channel.WriteData(buf, dataType); err != nil {
+			log.Info().Msgf("could not write the output of session %s on channel %d: %s", p.id, p.channel.ChannelID(), err)
+			p.detachLocked()
+		}
+	}
+	return len(buf), nil
+}
+
+// sends the exit status on the attached channel, it is lost if the command exits while detached
+func (p *persistentSession) SendRequest(r *ssh3Messages.ChannelRequestMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.channel == nil {
+		log.Info().Msgf("the command of detached session %s of %s exited", p.id, p.username)
+		return nil
+	}
+	return p.channel.SendRequest(r)
+}
+
+// detaches the session from channel once the channel ended
+func (p *persistentSession) detach(channel ssh3.Channel) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.ended || p.channel != channel {
+		// the session already exited or was reattached meanwhile
+		return
+	}
+	p.detachLocked()
+}
+
+func (p *persistentSession) detachLocked() {
+	log.Info().Msgf("detached session %s of %s from channel %d (conv %s)", p.id, p.username, p.channel.ChannelID(), p.channel.ConversationID())
+	p.channel = nil
+	p.detachTime = time.Now()
+	if p.detachedTimeout > 0 {
+		detachTime := p.detachTime
+		p.hangUp = time.AfterFunc(p.detachedTimeout, func() { p.hangUpIfDetachedSince(detachTime) })
+	}
+}
+
+// hangs up the command as a terminal would, the shell forwarding the hangup to its jobs
+func (p *persistentSession) hangUpIfDetachedSince(detachTime time.Time) {
+	p.lock.Lock()
+	detached := !p.ended && p.channel == nil && p.detachTime.Equal(detachTime)
+	p.lock.Unlock()
+	if !detached {
+		return
+	}
+	log.Info().Msgf("hanging up session %s of %s, detached since %s", p.id, p.username, detachTime)
+	hangUp, ok := signals["SIGHUP"]
+	if !ok {
+		hangUp = os.Kill
+	}
+	if err := p.session.runningCmd.signal(nil, hangUp); err != nil {
+		log.Warn().Msgf("could not hang up session %s: %s", p.id, err)
+	}
+}
+
+// attaches the session to channel after replaying its scrollback on it. The channel previously
+// attached is returned, e.g. if the conversation dropped without its end being noticed yet.
+func (p *persistentSession) attach(channel ssh3.Channel) (ssh3.Channel, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.ended {
+		return nil, fmt.Errorf("session %s exited", p.id)
+	}
+	if len(p.scrollback) > 0 {
+		if _, err := channel.WriteData(p.scrollback, ssh3Messages.SSH_EXTENDED_DATA_NONE); err != nil {
+			return nil, err
+		}
+	}
+	previous := p.channel
+	p.channel = channel
+	if p.hangUp != nil {
+		p.hangUp.Stop()
+		p.hangUp = nil
+	}
+	return previous, nil
+}
+
+// forgets the session once its command exited and its output was sent
+func (p *persistentSession) end() {
+	persistentSessions.remove(p)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ended = true
+	if p.hangUp != nil {
+		p.hangUp.Stop()
+	}
+}
+
+// detaches the persistent session of the channel once the channel ended, its command still running
+func detachPersistentSession(channel ssh3.Channel) {
+	if session, ok := runningSessions.get(channel); ok && session.runningCmd != nil && session.runningCmd.persistent != nil {
+		session.runningCmd.persistent.detach(channel)
+	}
+}
+
+// the request fails after the reason was sent to the user, as the output of a failed command
+func refuseReattach(channel ssh3.Channel, err error) error {
+	channel.WriteData([]byte(err.Error()+"\n"), ssh3Messages.SSH_EXTENDED_DATA_STDERR)
+	channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+		WantReply:      false,
+		ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: 1},
+	})
+	return err
+}
+
+// attaches the channel to a persistent session of the user, or lists them if the ID is empty
+func newReattachReq(user *unix_util.User, channel ssh3.Channel, request ssh3Messages.ReattachRequest, wantReply bool) error {
+	session, ok := runningSessions.get(channel)
+	if !ok {
+		return fmt.Errorf("internal error: cannot find session for current channel")
+	}
+	if session.channelState != LARVAL {
+		return fmt.Errorf("cannot reattach an already established session")
+	}
+	if session.pty != nil {
+		return fmt.Errorf("cannot reattach a channel with its own pty")
+	}
+	session.channelState = OPEN
+	if sessionPersistence := settings().sessionPersistence; sessionPersistence == nil || !sessionPersistence.AllowsUser(user.Username) {
+		return refuseReattach(channel, ssh3.UnsupportedFeature{Feature: "session_persistence"})
+	}
+	if request.SessionID == "" {
+		return listPersistentSessions(user, channel)
+	}
+	persistent := persistentSessions.get(user.Username, request.SessionID)
+	if persistent == nil {
+		return refuseReattach(channel, fmt.Errorf("no session %s to reattach", request.SessionID))
+	}
+	previous, err := persistent.attach(channel)
+	if err != nil {
+		return refuseReattach(channel, err)
+	}
+	if previous != nil {
+		// the previous client can no longer use the session
+		log.Info().Msgf("session %s of %s taken over from channel %d (conv %s)", persistent.id, user.Username, previous.ChannelID(), previous.ConversationID())
+		previous.CancelRead()
+		previous.Close()
+	}
+	runningCmd := persistent.session.runningCmd
+	// the keystrokes that the new client sends in datagrams
+	typing := ssh3.NewTypingReceiver(channel, runningCmd.stdinW)
+	go typing.Run(session.traceContext)
+	runningCmd.stdinW = typing
+	runningSessions.set(channel, persistent.session)
+	terminals.move(persistent.session.pty, channel.ConversationID())
+	log.Info().Msgf("reattached session %s of %s to channel %d (conv %s)", persistent.id, user.Username, channel.ChannelID(), channel.ConversationID())
+	return nil
+}
+
+func listPersistentSessions(user *unix_util.User, channel ssh3.Channel) error {
+	var list strings.Builder
+	status, dataType := uint64(0), ssh3Messages.SSH_EXTENDED_DATA_NONE
+	sessions := persistentSessions.list(user.Username)
+	if len(sessions) == 0 {
+		list.WriteString("no session to reattach\n")
+		status, dataType = 1, ssh3Messages.SSH_EXTENDED_DATA_STDERR
+	}
+	for _, p := range sessions {
+		p.lock.Lock()
+		state := "attached"
+		if p.channel == nil {
+			state = "detached since " + p.detachTime.Format(time.DateTime)
+		}
+		p.lock.Unlock()
+		fmt.Fprintf(&list, "%s\t%s\t%s\n", p.id, state, p.title)
+	}
+	if _, err := channel.WriteData([]byte(list.String()), dataType); err != nil {
+		return err
+	}
+	return channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+		WantReply:      false,
+		ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: status},
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+// the identity verified by a pre-authorization token
+type preauthIdentity struct{}
+
+func (preauthIdentity) Verify(candidate interface{}, base64ConversationID string) bool {
+	// the token has already been verified
+	return false
+}
+
+// authenticates the pre-authorization tokens, the other credentials being handled by Authenticator
+type preauthAuthenticator struct {
+	unix_server.Authenticator
+	config *unix_server.PreauthConfig
+	keys   []crypto.PublicKey
+}
+
+func newPreauthAuthenticator(authenticator unix_server.Authenticator, config *unix_server.PreauthConfig) (preauthAuthenticator, error) {
+	keys, err := config.LoadVerificationKeys()
+	if err != nil {
+		return preauthAuthenticator{}, err
+	}
+	return preauthAuthenticator{Authenticator: authenticator, config: config, keys: keys}, nil
+}
+
+func (a preauthAuthenticator) AuthenticateBearer(requestedUsername string, user *unix_util.User, bearer string, base64ConversationID string) (unix_server.Identity, error) {
+	if !strings.HasPrefix(bearer, ssh3.PreauthTokenPrefix) {
+		return a.Authenticator.AuthenticateBearer(requestedUsername, user, bearer, base64ConversationID)
+	}
+	if !a.config.AllowsUser(user.Username) {
+		log.Warn().Msgf("refused a pre-authorization token for user %s, not allowed by the config", user.Username)
+		return nil, nil
+	}
+	claims, err := ssh3.VerifyPreauthToken(bearer, a.keys, user.Username, a.config.Host, a.config.MaxLifetime(), time.Now())
+	if err != nil {
+		log.Warn().Msgf("refused a pre-authorization token for user %s: %s", user.Username, err)
+		return nil, nil
+	}
+	log.Info().Msgf("user %s authenticated using pre-authorization token %s", user.Username, claims.ID)
+	audit.Log(audit.Event{
+		Type:           audit.EventPreauth,
+		Username:       user.Username,
+		ConversationID: base64ConversationID,
+		Details: map[string]string{
+			"token_id":   claims.ID,
+			"expires_at": claims.ExpiresAt.UTC().Format(time.RFC3339),
+		},
+	})
+	return preauthIdentity{}, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/privsep"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	"github.com/rs/zerolog/log"
+)
+
+// In privilege separation mode, the server runs as a monitor keeping the privileges and a worker
+// running as an unprivileged user. The worker parses everything received from the network
+// and asks the monitor to authenticate the users and to run their commands.
+
+// the connection of the worker to the monitor, nil if the privileges are not separated
+var monitor *privsep.Client
+
+// the sockets and configs provided by the monitor to the worker
+type privsepWorkerSetup struct {
+	packetConn   net.PacketConn
+	tlsConfig    *tls.Config
+	serverConfig *unix_server.ServerConfig
+	// indexed by the name of the virtual hosts
+	virtualHostCertificates map[string]tls.Certificate
+	// nil if the admin API is disabled
+	adminListener net.Listener
+}
+
+// connects to the monitor and gets the setup of the worker
+func setupPrivsepWorker() (*privsepWorkerSetup, error) {
+	conn, err := privsep.WorkerConn()
+	if err != nil {
+		return nil, err
+	}
+	monitor = privsep.NewClient(conn)
+	var result privsep.SetupResult
+	files, err := monitor.Call(privsep.OpSetup, nil, nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+	if len(files) == 0 || (result.AdminSocket && len(files) != 2) {
+		return nil, fmt.Errorf("unexpected number of descriptors in the setup: %d", len(files))
+	}
+	setup := &privsepWorkerSetup{}
+	setup.serverConfig, err = unix_server.ParseServerConfig(bytes.NewReader(result.ServerConfig))
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := tls.X509KeyPair(result.Certificate, result.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	setup.tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	setup.virtualHostCertificates = make(map[string]tls.Certificate, len(result.VirtualHostCertificates))
+	for _, hostCertificate := range result.VirtualHostCertificates {
+		setup.virtualHostCertificates[hostCertificate.VirtualHost], err = tls.X509KeyPair(hostCertificate.Certificate, hostCertificate.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate of virtual host %s: %w", hostCertificate.VirtualHost, err)
+		}
+	}
+	setup.packetConn, err = net.FilePacketConn(files[0])
+	if err != nil {
+		return nil, err
+	}
+	if result.AdminSocket {
+		setup.adminListener, err = net.FileListener(files[1])
+		if err != nil {
+			setup.packetConn.Close()
+			return nil, err
+		}
+	}
+	return setup, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// authenticates the users in the monitor
+type monitorAuthenticator struct {
+	// the virtual host reached by the client, empty for the default host
+	virtualHost string
+}
+
+// the identity verified by the monitor
+type monitorVerifiedIdentity struct {
+	forcedCommand string
+	method        string
+}
+
+func (i monitorVerifiedIdentity) Verify(candidate interface{}, base64ConversationID string) bool {
+	// the verification has already been performed by the monitor
+	return false
+}
+
+func (i monitorVerifiedIdentity) ForcedCommand() string {
+	return i.forcedCommand
+}
+
+func (i monitorVerifiedIdentity) AuthenticationMethod() string {
+	return i.method
+}
+
+func (a monitorAuthenticator) AuthenticatePassword(username string, password string) (bool, error) {
+	return false, fmt.Errorf("the monitor only authenticates the passwords of conversations")
+}
+
+func (a monitorAuthenticator) AuthenticateConversationPassword(username string, password string, base64ConversationID string) (bool, error) {
+	var result privsep.AuthenticationResult
+	_, err := monitor.Call(privsep.OpAuthenticatePassword, privsep.AuthenticatePasswordParams{
+		Username:             username,
+		Password:             password,
+		Base64ConversationID: base64ConversationID,
+		VirtualHost:          a.virtualHost,
+	}, nil, &result)
+	return result.Authenticated, err
+}
+
+func (a monitorAuthenticator) ConversationRefused(base64ConversationID string) {
+	endMonitoredConversation(base64ConversationID)
+}
+
+func (a monitorAuthenticator) AuthenticateBearer(requestedUsername string, user *unix_util.User, bearer string, base64ConversationID string) (unix_server.Identity, error) {
+	var result privsep.AuthenticationResult
+	_, err := monitor.Call(privsep.OpAuthenticateBearer, privsep.AuthenticateBearerParams{
+		RequestedUsername:    requestedUsername,
+		Username:             user.Username,
+		Token:                bearer,
+		Base64ConversationID: base64ConversationID,
+		VirtualHost:          a.virtualHost,
+	}, nil, &result)
+	if err != nil || !result.Authenticated {
+		return nil, err
+	}
+	return monitorVerifiedIdentity{forcedCommand: result.ForcedCommand, method: result.Method}, nil
+}
+
+func (a monitorAuthenticator) AuthenticateKeyboardInteractive(username string, response string) (bool, error) {
+	return false, fmt.Errorf("the monitor only authenticates the second factor of conversations")
+}
+
+func (a monitorAuthenticator) AuthenticateConversationKeyboardInteractive(username string, response string, base64ConversationID string) (bool, error) {
+	var result privsep.AuthenticationResult
+	_, err := monitor.Call(privsep.OpAuthenticateKeyboardInteractive, privsep.AuthenticateKeyboardInteractiveParams{
+		Username:             username,
+		Response:             response,
+		Base64ConversationID: base64ConversationID,
+		VirtualHost:          a.virtualHost,
+	}, nil, &result)
+	return result.Authenticated, err
+}
+
+// records the audit events in the audit log of the monitor
+type monitorAuditLogger struct{}
+
+func (monitorAuditLogger) Log(event audit.Event) error {
+	// the long details would not fit in the messages to the monitor
+	_, err := monitor.Call(privsep.OpAudit, event.Truncated(), nil, nil)
+	return err
+}
+
+type monitoredExitError struct {
+	exitCode int
+	// the signal that killed the command, if any
+	signal     int
+	coreDumped bool
+}
+
+func (e monitoredExitError) Error() string {
+	if e.signal != 0 {
+		return fmt.Sprintf("killed by signal %d", e.signal)
+	}
+	return fmt.Sprintf("exit status %d", e.exitCode)
+}
+
+func (e monitoredExitError) ExitCode() int {
+	return e.exitCode
+}
+
+// drops what the authentication of the conversation allowed in the monitor
+func endMonitoredConversation(base64ConversationID string) {
+	_, err := monitor.Call(privsep.OpEndConversation, privsep.EndConversationParams{Base64ConversationID: base64ConversationID}, nil, nil)
+	if err != nil {
+		log.Error().Msgf("could not end conversation %s in the monitor: %s", base64ConversationID, err)
+	}
+}
+
+// returns the ID of the conversation as known by the monitor
+func monitoredConversationID(conversationID ssh3.ConversationID) string {
+	return base64.StdEncoding.EncodeToString(conversationID[:])
+}
+
+// asks the monitor to run the command as the user, the monitor applying its confinement
+func startMonitoredCommand(channel ssh3.Channel, user *unix_util.User, runningCommand *runningCommand, openPty *openPty) error {
+	var stdio []*os.File
+	for _, stream := range []interface{}{runningCommand.Stdin, runningCommand.Stdout, runningCommand.Stderr} {
+		file, ok := stream.(*os.File)
+		if !ok {
+			return fmt.Errorf("the standard streams of the commands run by the monitor must be files, got %T", stream)
+		}
+		stdio = append(stdio, file)
+	}
+	// the command inherits its ends of the pipes or the tty
+	defer closeFiles(stdio)
+	if openPty != nil {
+		if err := openPty.resize(); err != nil {
+			return err
+		}
+	}
+	var result privsep.SpawnResult
+	_, err := monitor.Call(privsep.OpSpawn, privsep.SpawnParams{
+		Username:             user.Username,
+		Base64ConversationID: monitoredConversationID(channel.ConversationID()),
+		Path:                 runningCommand.Path,
+		Args:                 runningCommand.Args,
+		Env:                  runningCommand.Env,
+		Dir:                  runningCommand.Dir,
+		Tty:                  openPty != nil,
+	}, stdio, &result)
+	if err != nil {
+		return err
+	}
+	runningCommand.monitoredPid = result.Pid
+	return nil
+}
+
+// returns the path and the listener of a socket owned by the user, created by the monitor
+func monitorAgentSocket(conv *ssh3.Conversation, user *unix_util.User) (string, net.Listener, error) {
+	var result privsep.AgentSocketResult
+	files, err := monitor.Call(privsep.OpAgentSocket, privsep.AgentSocketParams{
+		Username:             user.Username,
+		Base64ConversationID: monitoredConversationID(conv.ConversationID()),
+	}, nil, &result)
+	if err != nil {
+		return "", nil, err
+	}
+	defer closeFiles(files)
+	if len(files) != 1 {
+		return "", nil, fmt.Errorf("expected the agent socket, got %d descriptors", len(files))
+	}
+	listener, err := net.FileListener(files[0])
+	if err != nil {
+		return "", nil, err
+	}
+	return result.Path, listener, nil
+}
+
+// creates the recording file of the session in the monitor
+func monitorRecordingFile(user *unix_util.User, channel ssh3.Channel) (*os.File, error) {
+	conversationID := channel.ConversationID()
+	files, err := monitor.Call(privsep.OpRecording, privsep.RecordingParams{
+		Username:       user.Username,
+		ConversationID: hex.EncodeToString(conversationID[:]),
+		ChannelID:      channel.ChannelID(),
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		closeFiles(files)
+		return nil, fmt.Errorf("expected the recording file, got %d descriptors", len(files))
+	}
+	return files[0], nil
+}
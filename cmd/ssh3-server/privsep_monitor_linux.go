@@ -0,0 +1,557 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/privsep"
+	"github.com/francoismichel/ssh3/recording"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// runs the operations requested by the worker
+type privsepMonitor struct {
+	enablePasswordLogin bool
+	setup               privsep.SetupResult
+	// handed over to the worker on setup
+	setupFiles []*os.File
+
+	// the conversations authenticated by the monitor, the worker only running commands for
+	// their users
+	grants *privsep.Grants
+	// the commands forced by the server config
+	forceCommands []unix_server.ForceCommandConfig
+	// the methods authenticating the users, possibly followed by the second factor
+	authenticationMethods unix_server.AuthenticationMethods
+
+	lock sync.Mutex
+	// the commands started for the worker that were not waited yet, by pid
+	processes map[int]*exec.Cmd
+	// the session tmpdirs of these commands, removed once they are waited
+	tmpDirs map[int]string
+	// authenticates the users, also verifying the break-glass tokens if enabled
+	authenticator unix_server.Authenticator
+	// the authenticators of the virtual hosts, by name
+	virtualHosts map[string]monitoredVirtualHost
+}
+
+type monitoredVirtualHost struct {
+	config        *unix_server.VirtualHostConfig
+	authenticator unix_server.Authenticator
+}
+
+// returns the authenticator of the virtual host and whether its users can log in using their
+// password, refusing the local users not belonging to it
+func (m *privsepMonitor) virtualHost(name string, username string) (unix_server.Authenticator, bool, error) {
+	if name == "" {
+		return m.authenticator, m.enablePasswordLogin, nil
+	}
+	host, ok := m.virtualHosts[name]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown virtual host %s", name)
+	}
+	if !host.config.HasUser(username) {
+		return nil, false, fmt.Errorf("user %s does not belong to virtual host %s", username, name)
+	}
+	return host.authenticator, host.config.PasswordLoginEnabled(m.enablePasswordLogin), nil
+}
+
+// records the authentication of the conversation by identity, which may be nil, using method.
+// The conversation is only granted once the user proved the second factor if the
+// authentication methods require it.
+func (m *privsepMonitor) authenticated(base64ConversationID string, username string, identity unix_server.Identity, method string) error {
+	allowed, secondFactor := m.authenticationMethods.Requirements(method)
+	if !allowed {
+		return fmt.Errorf("the %s authentication of user %s is not allowed by the authentication methods", method, username)
+	}
+	forcedCommand, _ := unix_server.ForcedCommand(m.forceCommands, username, identity)
+	m.grants.Add(base64ConversationID, privsep.Grant{Username: username, ForcedCommand: forcedCommand, Pending: secondFactor})
+	return nil
+}
+
+// returns the user authenticated by the conversation and what it is allowed to do
+func (m *privsepMonitor) authenticatedUser(base64ConversationID string, username string) (*unix_util.User, privsep.Grant, error) {
+	grant, err := m.grants.Get(base64ConversationID, username)
+	if err != nil {
+		return nil, grant, err
+	}
+	user, err := unix_util.GetUser(username)
+	return user, grant, err
+}
+
+func (m *privsepMonitor) process(pid int) (*exec.Cmd, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cmd, ok := m.processes[pid]
+	if !ok {
+		return nil, fmt.Errorf("no command with pid %d was started for the worker", pid)
+	}
+	return cmd, nil
+}
+
+func decodeParams(encoded json.RawMessage, params interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(params)
+}
+
+func (m *privsepMonitor) handleSetup(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.setupFiles == nil {
+		return nil, nil, fmt.Errorf("the worker is already set up")
+	}
+	setupFiles := m.setupFiles
+	m.setupFiles = nil
+	return m.setup, setupFiles, nil
+}
+
+func (m *privsepMonitor) handleAuthenticatePassword(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.AuthenticatePasswordParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	authenticator, enablePasswordLogin, err := m.virtualHost(params.VirtualHost, params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !enablePasswordLogin {
+		return nil, nil, fmt.Errorf("password login is disabled")
+	}
+	if params.Base64ConversationID == "" {
+		return nil, nil, fmt.Errorf("the password authentication is not tied to a conversation")
+	}
+	ok, err := authenticator.AuthenticatePassword(params.Username, params.Password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		if err := m.authenticated(params.Base64ConversationID, params.Username, nil, unix_server.AuthMethodPassword); err != nil {
+			return nil, nil, err
+		}
+	}
+	return privsep.AuthenticationResult{Authenticated: ok}, nil, nil
+}
+
+func (m *privsepMonitor) handleAuthenticateBearer(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.AuthenticateBearerParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	authenticator, _, err := m.virtualHost(params.VirtualHost, params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := unix_util.GetUser(params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	identity, err := authenticator.AuthenticateBearer(params.RequestedUsername, user, params.Token, params.Base64ConversationID)
+	if err != nil || identity == nil {
+		return privsep.AuthenticationResult{}, nil, err
+	}
+	if err := m.authenticated(params.Base64ConversationID, params.Username, identity, unix_server.BearerAuthenticationMethod(params.Token, identity)); err != nil {
+		return nil, nil, err
+	}
+	result := privsep.AuthenticationResult{Authenticated: true, Method: unix_server.IdentityAuthenticationMethod(identity)}
+	if restricted, ok := identity.(unix_server.CommandRestrictedIdentity); ok {
+		result.ForcedCommand = restricted.ForcedCommand()
+	}
+	return result, nil, nil
+}
+
+func (m *privsepMonitor) handleAuthenticateKeyboardInteractive(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.AuthenticateKeyboardInteractiveParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	authenticator, _, err := m.virtualHost(params.VirtualHost, params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the second factor only follows the first one of the same conversation
+	if err := m.grants.CheckPending(params.Base64ConversationID, params.Username); err != nil {
+		return nil, nil, err
+	}
+	ok, err := authenticator.AuthenticateKeyboardInteractive(params.Username, params.Response)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		if err := m.grants.Promote(params.Base64ConversationID, params.Username); err != nil {
+			return nil, nil, err
+		}
+	}
+	return privsep.AuthenticationResult{Authenticated: ok}, nil, nil
+}
+
+func (m *privsepMonitor) handleSpawn(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.SpawnParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	if len(files) != 3 {
+		return nil, nil, fmt.Errorf("expected the stdin, stdout and stderr of the command, got %d descriptors", len(files))
+	}
+	user, grant, err := m.authenticatedUser(params.Base64ConversationID, params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := grant.CheckSpawn(user, params); err != nil {
+		return nil, nil, err
+	}
+	cmd := &exec.Cmd{
+		Path: params.Path,
+		Args: params.Args,
+		// the environment of the user is set by the monitor, overriding the one of the worker
+		Env:    append(privsep.SanitizeEnv(params.Env), userEnvironment(user)...),
+		Dir:    params.Dir,
+		Stdin:  files[0],
+		Stdout: files[1],
+		Stderr: files[2],
+		// the credentials come from the monitor, not from the worker
+		SysProcAttr: &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(user.Uid), Gid: uint32(user.Gid)}},
+	}
+	if params.Tty {
+		// the pty has been opened by the worker
+		if err := files[0].Chown(int(user.Uid), int(user.Gid)); err != nil {
+			return nil, nil, err
+		}
+		if err := files[0].Chmod(0620); err != nil {
+			return nil, nil, err
+		}
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	} else {
+		ownProcessGroup(cmd)
+	}
+	if err := confineCommand(user, cmd); err != nil {
+		return nil, nil, err
+	}
+	if params.Dir != user.Dir {
+		// requested by the client, the worker cannot be trusted to have checked it
+		if cmd.Dir, err = resolveWorkingDirectory(user, params.Dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := limitCommand(user, cmd); err != nil {
+		return nil, nil, err
+	}
+	tmpDir, tmpDirEnv, err := createSessionTmpDir(sessionTmpDir, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Env = append(cmd.Env, tmpDirEnv...)
+	if err := cmd.Start(); err != nil {
+		removeSessionTmpDir(tmpDir)
+		return nil, nil, err
+	}
+	log.Debug().Msgf("started %s for user %s on behalf of the worker (pid %d)", params.Path, user.Username, cmd.Process.Pid)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.processes[cmd.Process.Pid] = cmd
+	if tmpDir != "" {
+		m.tmpDirs[cmd.Process.Pid] = tmpDir
+	}
+	return privsep.SpawnResult{Pid: cmd.Process.Pid}, nil, nil
+}
+
+func (m *privsepMonitor) handleSignal(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.SignalParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	cmd, err := m.process(params.Pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params.ProcessGroup == 0 {
+		return nil, nil, cmd.Process.Signal(syscall.Signal(params.Signal))
+	}
+	// the group must belong to the command: its own or a job of its session if it has a pty
+	if params.ProcessGroup != params.Pid {
+		if sid, err := unix.Getsid(params.ProcessGroup); err != nil || sid != params.Pid {
+			return nil, nil, fmt.Errorf("process group %d is not part of the session of pid %d", params.ProcessGroup, params.Pid)
+		}
+	}
+	return nil, nil, syscall.Kill(-params.ProcessGroup, syscall.Signal(params.Signal))
+}
+
+func (m *privsepMonitor) handleWait(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.WaitParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	cmd, err := m.process(params.Pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Wait()
+	m.lock.Lock()
+	delete(m.processes, params.Pid)
+	tmpDir := m.tmpDirs[params.Pid]
+	delete(m.tmpDirs, params.Pid)
+	m.lock.Unlock()
+	removeSessionTmpDir(tmpDir)
+	if exitError, ok := err.(*exec.ExitError); ok {
+		result := privsep.WaitResult{ExitCode: exitError.ExitCode()}
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Signal, result.CoreDumped = int(status.Signal()), status.CoreDump()
+		}
+		return result, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return privsep.WaitResult{ExitCode: 0}, nil, nil
+}
+
+func (m *privsepMonitor) handleAgentSocket(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.AgentSocketParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	user, _, err := m.authenticatedUser(params.Base64ConversationID, params.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	sockPath, listener, err := listenAgentSocket(context.Background(), user)
+	if err != nil {
+		return nil, nil, err
+	}
+	unixListener := listener.(*net.UnixListener)
+	// the worker cannot remove the socket from the directory of the user, it is left in place
+	// as the directory is in both modes
+	unixListener.SetUnlinkOnClose(false)
+	defer unixListener.Close()
+	file, err := unixListener.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	return privsep.AgentSocketResult{Path: sockPath}, []*os.File{file}, nil
+}
+
+func (m *privsepMonitor) handleRecording(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.RecordingParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	if sessionRecording.Directory == "" {
+		return nil, nil, fmt.Errorf("session recording is disabled")
+	}
+	conversationID, err := hex.DecodeString(params.ConversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := m.authenticatedUser(base64.StdEncoding.EncodeToString(conversationID), params.Username); err != nil {
+		return nil, nil, err
+	}
+	file, err := recording.OpenAsciicastFile(sessionRecording.Directory, params.Username, params.ConversationID, params.ChannelID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, []*os.File{file}, nil
+}
+
+func (m *privsepMonitor) handleEndConversation(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var params privsep.EndConversationParams
+	if err := decodeParams(encoded, &params); err != nil {
+		return nil, nil, err
+	}
+	m.grants.Remove(params.Base64ConversationID)
+	return nil, nil, nil
+}
+
+func (m *privsepMonitor) handleAudit(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+	var event audit.Event
+	if err := decodeParams(encoded, &event); err != nil {
+		return nil, nil, err
+	}
+	audit.Log(event)
+	return nil, nil, nil
+}
+
+// runs the worker as privsepUsername and performs its privileged operations until it exits,
+// returning the exit code of the server
+func runPrivsepMonitor(privsepUsername string, bindAddr string, certPath string, keyPath string, adminSocketPath string,
+	enablePasswordLogin bool, serverConfig *unix_server.ServerConfig, workerStderr io.Writer) int {
+	privsepUser, err := unix_util.GetUser(privsepUsername)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not find the privilege separation user: %s\n", err)
+		return -1
+	}
+	if privsepUser.Uid == 0 {
+		fmt.Fprintf(os.Stderr, "the privilege separation user %s must not be root\n", privsepUsername)
+		return -1
+	}
+
+	// validated along with the config
+	authenticationMethods, _ := unix_server.ParseAuthenticationMethods(serverConfig.AuthenticationMethods)
+	m := &privsepMonitor{
+		enablePasswordLogin:   enablePasswordLogin,
+		grants:                privsep.NewGrants(),
+		forceCommands:         serverConfig.ForceCommands,
+		authenticationMethods: authenticationMethods,
+		processes:             make(map[int]*exec.Cmd),
+		tmpDirs:               make(map[int]string),
+		authenticator:         unix_server.LocalAuthenticator{RevokedKeysFile: serverConfig.RevokedKeys},
+	}
+	m.setup.Certificate, err = os.ReadFile(certPath)
+	if err == nil {
+		m.setup.PrivateKey, err = os.ReadFile(keyPath)
+	}
+	if err == nil {
+		m.setup.ServerConfig, err = json.Marshal(serverConfig)
+	}
+	for _, host := range serverConfig.VirtualHosts {
+		if err != nil || host.CertFile == "" {
+			continue
+		}
+		hostCertificate := privsep.VirtualHostCertificate{VirtualHost: host.Name}
+		hostCertificate.Certificate, err = os.ReadFile(host.CertFile)
+		if err == nil {
+			hostCertificate.PrivateKey, err = os.ReadFile(host.KeyFile)
+		}
+		m.setup.VirtualHostCertificates = append(m.setup.VirtualHostCertificates, hostCertificate)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not prepare the worker setup: %s\n", err)
+		return -1
+	}
+
+	packetConn, err := serverConfig.Transport.ListenUDP(bindAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not listen on %s: %s\n", bindAddr, err)
+		return -1
+	}
+	udpFile, err := packetConn.File()
+	packetConn.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not get the UDP socket: %s\n", err)
+		return -1
+	}
+	m.setupFiles = []*os.File{udpFile}
+	if adminSocketPath != "" {
+		adminListener, err := listenAdminSocket(adminSocketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not listen on admin socket at %s: %s\n", adminSocketPath, err)
+			return -1
+		}
+		// keep the listener open so that the socket is removed when the monitor exits
+		adminFile, err := adminListener.(*net.UnixListener).File()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not get the admin socket: %s\n", err)
+			return -1
+		}
+		m.setupFiles = append(m.setupFiles, adminFile)
+		m.setup.AdminSocket = true
+	}
+
+	if serverConfig.BreakGlass != nil {
+		// the worker does not access the store
+		serverStore, err := unix_server.OpenStore(context.Background(), serverConfig.Store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open the store: %s\n", err)
+			return -1
+		}
+		tokens, err := serveBreakGlassSocket(serverConfig.BreakGlass, serverStore)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not serve break-glass socket at %s: %s\n", serverConfig.BreakGlass.Socket, err)
+			return -1
+		}
+		m.authenticator = breakGlassAuthenticator{Authenticator: m.authenticator, tokens: tokens}
+	}
+	m.virtualHosts = make(map[string]monitoredVirtualHost, len(serverConfig.VirtualHosts))
+	for i := range serverConfig.VirtualHosts {
+		host := &serverConfig.VirtualHosts[i]
+		authenticator, err := withPreauth(m.authenticator, serverConfig, host)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load the pre-authorization verification keys of virtual host %s: %s\n", host.Name, err)
+			return -1
+		}
+		m.virtualHosts[host.Name] = monitoredVirtualHost{config: host, authenticator: authenticator}
+	}
+	m.authenticator, err = withPreauth(m.authenticator, serverConfig, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load the pre-authorization verification keys: %s\n", err)
+		return -1
+	}
+
+	conn, workerSocket, err := privsep.NewSocketPair()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the privilege separation socket: %s\n", err)
+		return -1
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not find the server executable: %s\n", err)
+		return -1
+	}
+	// the worker parses the same args
+	worker := exec.Command(executable, append([]string{privsep.WorkerSubcommand}, os.Args[1:]...)...)
+	worker.Dir = "/"
+	worker.Stdout = os.Stdout
+	worker.Stderr = workerStderr
+	worker.ExtraFiles = []*os.File{workerSocket}
+	worker.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(privsepUser.Uid), Gid: uint32(privsepUser.Gid), Groups: []uint32{}},
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	err = worker.Start()
+	workerSocket.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not start the worker: %s\n", err)
+		return -1
+	}
+	log.Info().Msgf("started the worker as user %s (pid %d)", privsepUsername, worker.Process.Pid)
+
+	// stopping the monitor stops the worker
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			worker.Process.Signal(sig)
+		}
+	}()
+
+	go func() {
+		err := privsep.Serve(conn, map[string]privsep.HandlerFunc{
+			privsep.OpSetup:                           m.handleSetup,
+			privsep.OpAuthenticatePassword:            m.handleAuthenticatePassword,
+			privsep.OpAuthenticateBearer:              m.handleAuthenticateBearer,
+			privsep.OpAuthenticateKeyboardInteractive: m.handleAuthenticateKeyboardInteractive,
+			privsep.OpSpawn:                           m.handleSpawn,
+			privsep.OpSignal:                          m.handleSignal,
+			privsep.OpWait:                            m.handleWait,
+			privsep.OpAgentSocket:                     m.handleAgentSocket,
+			privsep.OpRecording:                       m.handleRecording,
+			privsep.OpAudit:                           m.handleAudit,
+			privsep.OpEndConversation:                 m.handleEndConversation,
+		})
+		log.Debug().Msgf("stopped serving the worker: %s", err)
+	}()
+
+	err = worker.Wait()
+	log.Info().Msgf("the worker exited: %v", err)
+	if err != nil {
+		return 255
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+func runPrivsepMonitor(privsepUsername string, bindAddr string, certPath string, keyPath string, adminSocketPath string,
+	enablePasswordLogin bool, serverConfig *unix_server.ServerConfig, workerStderr io.Writer) int {
+	fmt.Fprintf(os.Stderr, "privilege separation is not implemented on %s/%s systems\n", runtime.GOOS, runtime.GOARCH)
+	return -1
+}
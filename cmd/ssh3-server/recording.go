@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/recording"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+const recordingsCleanupInterval = time.Hour
+
+var sessionRecording unix_server.SessionRecordingConfig
+
+// returns nil if the session must not be recorded
+func startSessionRecording(user *unix_util.User, channel ssh3.Channel, openPty *openPty, runningCommand *runningCommand) *recording.Recorder {
+	if sessionRecording.Directory == "" || (openPty == nil && !sessionRecording.RecordExec) {
+		return nil
+	}
+	// the default size of a terminal for commands run without pty
+	width, height := uint64(80), uint64(24)
+	env := map[string]string{"SHELL": user.Shell}
+	if openPty != nil {
+		width, height = uint64(openPty.winSize.Cols), uint64(openPty.winSize.Rows)
+		env["TERM"] = openPty.term
+	}
+	conversationID := channel.ConversationID()
+	title := strings.Join(runningCommand.Args, " ")
+	var recorder *recording.Recorder
+	var err error
+	if monitor != nil {
+		// the recordings directory is only writable by the monitor
+		var file *os.File
+		file, err = monitorRecordingFile(user, channel)
+		if err == nil {
+			recorder, err = recording.NewAsciicastRecorder(file, width, height, title, env)
+			if err != nil {
+				file.Close()
+			}
+		}
+	} else {
+		recorder, err = recording.CreateAsciicastFile(sessionRecording.Directory, user.Username, hex.EncodeToString(conversationID[:]),
+			channel.ChannelID(), width, height, title, env)
+	}
+	if err != nil {
+		log.Error().Msgf("could not record the session of channel %d (conv %s): %s", channel.ChannelID(), channel.ConversationID(), err)
+		return nil
+	}
+	return recorder
+}
+
+func recordOutput(recorder *recording.Recorder, channel ssh3.Channel, data []byte) {
+	if recorder == nil || len(data) == 0 {
+		return
+	}
+	if err := recorder.Output(data); err != nil {
+		log.Error().Msgf("could not record the output of channel %d (conv %s): %s", channel.ChannelID(), channel.ConversationID(), err)
+	}
+}
+
+func removeExpiredRecordingsInBackground(config unix_server.SessionRecordingConfig) {
+	if config.Directory == "" || config.RetentionDays <= 0 {
+		return
+	}
+	retention := time.Duration(config.RetentionDays) * 24 * time.Hour
+	go func() {
+		for {
+			if err := recording.RemoveExpired(config.Directory, retention); err != nil {
+				log.Error().Msgf("could not remove the expired session recordings: %s", err)
+			}
+			time.Sleep(recordingsCleanupInterval)
+		}
+	}()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// returns true if err was caused by a message that could not be parsed
+func isMalformedMessage(err error) bool {
+	var invalidMessage ssh3Messages.InvalidMessage
+	return errors.As(err, &invalidMessage)
+}
+
+// records a message that could not be parsed. As messages are not length-prefixed,
+// the stream cannot be resynchronized and the caller must close the channel.
+func auditMalformedMessage(username string, channel ssh3.Channel, err error) {
+	log.Warn().Msgf("audit: malformed message from user %s on channel %d (type %s, conv %s), closing the channel: %s",
+		username, channel.ChannelID(), channel.ChannelType(), channel.ConversationID(), err)
+	auditChannelEvent(audit.EventMalformedMessage, username, channel, map[string]string{"error": err.Error()})
+}
+
+// must be deferred by the goroutines handling a channel: a panic while handling
+// a channel closes that channel instead of crashing the whole server
+func recoverChannelPanic(username string, channel ssh3.Channel) {
+	if r := recover(); r != nil {
+		log.Error().Msgf("audit: panic while handling channel %d (type %s, conv %s) of user %s, closing the channel: %v\n%s",
+			channel.ChannelID(), channel.ChannelType(), channel.ConversationID(), username, r, debug.Stack())
+		auditChannelEvent(audit.EventPanic, username, channel, map[string]string{"panic": fmt.Sprint(r)})
+		channel.CancelRead()
+		channel.Close()
+	}
+}
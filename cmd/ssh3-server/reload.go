@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/francoismichel/ssh3/audit"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/rs/zerolog/log"
+)
+
+// the settings of the server config replaced when the config is reloaded. They are read whenever
+// a conversation, channel or command starts, those already running keeping their settings.
+type reloadableSettings struct {
+	accessControl      unix_server.AccessControlConfig
+	forceCommands      []unix_server.ForceCommandConfig
+	forwardingQuotas   unix_server.ForwardingQuotasConfig
+	liveTail           *unix_server.LiveTailConfig
+	sessionPersistence *unix_server.SessionPersistenceConfig
+	// whether the message of the day and the last login are printed at the beginning of the
+	// interactive login sessions
+	printMotd, printLastLog bool
+}
+
+var currentSettings atomic.Pointer[reloadableSettings]
+
+// the path of the -config file, empty if the server runs without config
+var serverConfigPath string
+
+func settings() *reloadableSettings {
+	return currentSettings.Load()
+}
+
+func applyReloadableSettings(config *unix_server.ServerConfig) {
+	currentSettings.Store(&reloadableSettings{
+		accessControl:      config.AccessControl,
+		forceCommands:      config.ForceCommands,
+		forwardingQuotas:   config.ForwardingQuotas,
+		liveTail:           config.LiveTail,
+		sessionPersistence: config.SessionPersistence,
+		printMotd:          config.PrintMotd,
+		printLastLog:       config.PrintLastLog,
+	})
+}
+
+// the settings applied by a reload, the other ones requiring a restart of the server
+var reloadedSettings = []string{
+	"access_control",
+	"force_commands",
+	"forwarding_quotas",
+	"live_tail",
+	"session_persistence",
+	"print_motd",
+	"print_last_log",
+}
+
+type reloadResult struct {
+	Reloaded []string `json:"reloaded"`
+}
+
+// POST re-reads the -config file and applies its reloadable settings, the whole file being
+// refused if it is invalid
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if monitor != nil {
+		http.Error(w, "the config cannot be reloaded when the privileges are separated", http.StatusNotImplemented)
+		return
+	}
+	if serverConfigPath == "" {
+		http.Error(w, "the server runs without config", http.StatusConflict)
+		return
+	}
+	config, err := unix_server.LoadServerConfig(serverConfigPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	applyReloadableSettings(config)
+	log.Info().Msgf("reloaded the server config %s using the admin API", serverConfigPath)
+	audit.Log(audit.Event{
+		Type:    audit.EventAdmin,
+		Details: map[string]string{"action": "reload", "config": serverConfigPath},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reloadResult{Reloaded: reloadedSettings}); err != nil {
+		log.Error().Msgf("could not write reload result on admin API: %s", err)
+	}
+}
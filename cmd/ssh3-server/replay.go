@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3/recording"
+	"golang.org/x/term"
+)
+
+// the width of the output when it is not a terminal
+const defaultReplayWidth = 160
+
+const replayTimeFormat = "15:04:05.000"
+
+func replayRecordings(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dir := flags.String("dir", "", "the session recordings directory, in which the recordings given as <conversation ID>_<channel ID> are looked up (a prefix of the conversation ID is enough)")
+	sync := flags.Bool("sync", false, "replay several recordings side-by-side, their events being ordered by their wall-clock time")
+	speed := flags.Float64("speed", 1, "the playback speed")
+	idleLimit := flags.Float64("idle-limit", 2, "if positive, the longest pause between two events in seconds")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s replay: %s replay [options] [--sync] recording...\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || (flags.NArg() > 1 && !*sync) || *speed <= 0 {
+		flags.Usage()
+		return -1
+	}
+
+	var recordings []*recording.Recording
+	var labels []string
+	for _, name := range flags.Args() {
+		path, err := findRecording(*dir, name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return -1
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not open recording: %s\n", err)
+			return -1
+		}
+		rec, err := recording.Read(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return -1
+		}
+		recordings = append(recordings, rec)
+		labels = append(labels, recordingLabel(path))
+	}
+
+	var last time.Time
+	wait := func(t time.Time) {
+		if !last.IsZero() {
+			delay := t.Sub(last).Seconds()
+			if *idleLimit > 0 && delay > *idleLimit {
+				delay = *idleLimit
+			}
+			time.Sleep(time.Duration(delay / *speed * float64(time.Second)))
+		}
+		last = t
+	}
+
+	events := recording.Synchronize(recordings)
+	if !*sync {
+		for _, event := range events {
+			if event.Type != "o" {
+				continue
+			}
+			wait(event.Time)
+			if _, err := io.WriteString(os.Stdout, event.Data); err != nil {
+				return -1
+			}
+		}
+		return 0
+	}
+
+	width := defaultReplayWidth
+	if terminalWidth, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		width = terminalWidth
+	}
+	columns := newReplayColumns(os.Stdout, width, labels)
+	for i, rec := range recordings {
+		fmt.Fprintf(os.Stdout, "%s: %q started at %s\n", labels[i], rec.Header.Title, rec.Start().Format(time.RFC3339Nano))
+	}
+	columns.writeHeader()
+	splitters := make([]recording.LineSplitter, len(recordings))
+	for _, event := range events {
+		if event.Type != "o" {
+			continue
+		}
+		lines := splitters[event.Recording].Write(event.Data)
+		if len(lines) == 0 {
+			continue
+		}
+		wait(event.Time)
+		for _, line := range lines {
+			columns.writeLine(event.Time, event.Recording, line)
+		}
+	}
+	for i := range splitters {
+		if line := splitters[i].Flush(); line != "" {
+			columns.writeLine(last, i, line)
+		}
+	}
+	return 0
+}
+
+// returns the path of the recording given as a path or as <conversation ID>_<channel ID>, possibly
+// prefixed by the username and with a shortened conversation ID
+func findRecording(dir string, name string) (string, error) {
+	if _, err := os.Stat(name); err == nil || dir == "" {
+		return name, err
+	}
+	id := strings.TrimSuffix(name, recording.FileExtension)
+	pattern := filepath.Join(dir, "*", id)
+	if strings.Contains(id, "/") {
+		pattern = filepath.Join(dir, id)
+	}
+	if matches, _ := filepath.Glob(pattern + recording.FileExtension); len(matches) == 1 {
+		return matches[0], nil
+	}
+	conversationID, channelID, found := strings.Cut(filepath.Base(id), "_")
+	if !found {
+		return "", fmt.Errorf("invalid recording %q, expected a path or <conversation ID>_<channel ID>", name)
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(pattern), conversationID+"*_"+channelID+recording.FileExtension))
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no recording %q in %s", name, dir)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous recording %q: %s", name, strings.Join(matches, ", "))
+	}
+}
+
+// returns <username>/<shortened conversation ID>_<channel ID>
+func recordingLabel(path string) string {
+	id := strings.TrimSuffix(filepath.Base(path), recording.FileExtension)
+	if conversationID, channelID, found := strings.Cut(id, "_"); found && len(conversationID) > 8 {
+		id = conversationID[:8] + "_" + channelID
+	}
+	return filepath.Base(filepath.Dir(path)) + "/" + id
+}
+
+// writes the lines of several recordings in columns next to each other, preceded by their time
+type replayColumns struct {
+	w      io.Writer
+	labels []string
+	width  int
+}
+
+func newReplayColumns(w io.Writer, totalWidth int, labels []string) *replayColumns {
+	width := (totalWidth - len(replayTimeFormat) - 3*len(labels)) / len(labels)
+	if width < 10 {
+		width = 10
+	}
+	return &replayColumns{w: w, labels: labels, width: width}
+}
+
+// cells holds the content of each column
+func (c *replayColumns) writeRow(prefix string, cells [][]rune) {
+	var row strings.Builder
+	row.WriteString(prefix)
+	for i, cell := range cells {
+		row.WriteString(" | ")
+		row.WriteString(string(cell))
+		if i < len(cells)-1 {
+			row.WriteString(strings.Repeat(" ", c.width-len(cell)))
+		}
+	}
+	fmt.Fprintln(c.w, strings.TrimRight(row.String(), " "))
+}
+
+func (c *replayColumns) writeHeader() {
+	cells := make([][]rune, len(c.labels))
+	for i, label := range c.labels {
+		cells[i] = truncate([]rune(label), c.width)
+	}
+	c.writeRow(strings.Repeat(" ", len(replayTimeFormat)), cells)
+}
+
+// the lines longer than the column are wrapped
+func (c *replayColumns) writeLine(t time.Time, column int, line string) {
+	runes := []rune(line)
+	prefix := t.UTC().Format(replayTimeFormat)
+	for {
+		cells := make([][]rune, len(c.labels))
+		cells[column] = truncate(runes, c.width)
+		c.writeRow(prefix, cells)
+		runes = runes[len(cells[column]):]
+		if len(runes) == 0 {
+			return
+		}
+		prefix = strings.Repeat(" ", len(replayTimeFormat))
+	}
+}
+
+func truncate(runes []rune, length int) []rune {
+	if len(runes) > length {
+		return runes[:length]
+	}
+	return runes
+}
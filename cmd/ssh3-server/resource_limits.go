@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os/exec"
+
+	"github.com/francoismichel/ssh3/limits"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+var resourceLimits []unix_server.ResourceLimitsConfig
+
+// the directory of the cgroups of the users
+var cgroupDirectory string
+
+// the resource limits of their users apply before the ones of the server
+var virtualHosts []unix_server.VirtualHostConfig
+
+// applies the resource limits of the server config matching the user, if any, to cmd before it is
+// started. It must be called last, once the confinement and working directory of cmd are set.
+func limitCommand(user *unix_util.User, cmd *exec.Cmd) error {
+	config, ok := unix_server.VirtualHostResourceLimits(virtualHosts, user.Username)
+	if !ok {
+		config, ok = unix_server.ResourceLimits(resourceLimits, user.Username)
+	}
+	if !ok {
+		return nil
+	}
+	limitsConfig, err := config.Limits()
+	if err != nil {
+		return err
+	}
+	if limitsConfig.IsEmpty() {
+		return nil
+	}
+	if limitsConfig.HasCgroupLimits() {
+		// the sessions of the user share the cgroup, and thus the limits
+		if limitsConfig.Cgroup, err = unix_server.UserCgroup(cgroupDirectory, user.Username); err != nil {
+			return err
+		}
+	}
+	log.Debug().Msgf("limiting the resources of the session of user %s", user.Username)
+	return limits.Wrap(cmd, limitsConfig)
+}
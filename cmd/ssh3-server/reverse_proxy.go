@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+// wraps the UDP socket of the server, the one received from the monitor for the privsep workers,
+// to strip the PROXY protocol headers of the datagrams relayed by the trusted load balancers
+func listenProxyProtocol(config *unix_server.ReverseProxyConfig, transport ssh3.TransportConfig, bindAddr string, workerConn net.PacketConn) (*ssh3.ProxyProtocolConn, error) {
+	trustedProxies, err := config.TrustedPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	conn := workerConn
+	if conn == nil {
+		udpConn, err := transport.ListenUDP(bindAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn = udpConn
+	}
+	return ssh3.NewProxyProtocolConn(conn, trustedProxies), nil
+}
+
+// answers the health checks of the load balancers, 503 during a maintenance window so that they
+// route the new conversations to the other servers
+func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if status := maintenance.status(); status.Enabled {
+		http.Error(w, status.Banner, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+)
+
+const previousIdentitySuffix = ".previous"
+
+// replaces the certificate and its key by new ones endorsed by the current key, so that the
+// clients that pinned the current certificate trust the new one and update their known hosts.
+// The current files are kept with the .previous suffix.
+func rotateSelfSignedCert(certPath string, keyPath string) error {
+	previous, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	previousCert, err := x509.ParseCertificate(previous.Certificate[0])
+	if err != nil {
+		return err
+	}
+	previousKey, ok := previous.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", previous.PrivateKey)
+	}
+	pubkey, privkey, err := util.GenerateKey()
+	if err != nil {
+		return err
+	}
+	cert, err := util.GenerateCert(privkey)
+	if err != nil {
+		return err
+	}
+	continuityProof, err := ssh3.NewContinuityProofExtension(pubkey, previousCert, previousKey)
+	if err != nil {
+		return err
+	}
+	cert.ExtraExtensions = append(cert.ExtraExtensions, continuityProof)
+
+	certPEM, keyPEM, err := util.EncodeCertAndKey(cert, pubkey, privkey)
+	if err != nil {
+		return err
+	}
+	previousCertPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	previousKeyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	// all the files are rolled back if one of them cannot be written
+	return util.ReplaceFiles(
+		util.FileReplacement{Path: certPath + previousIdentitySuffix, Data: previousCertPEM, Perm: 0644},
+		util.FileReplacement{Path: keyPath + previousIdentitySuffix, Data: previousKeyPEM, Perm: 0600},
+		util.FileReplacement{Path: certPath, Data: certPEM, Perm: 0644},
+		util.FileReplacement{Path: keyPath, Data: keyPEM, Perm: 0600},
+	)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/rpc"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// the config of the built-in rpc subsystem, nil if disabled
+var rpcSubsystem *unix_server.RPCSubsystemConfig
+
+// runs the rpc subsystem as the user by re-executing the server binary,
+// with the policy of the methods allowed to the user
+func newRPCSubsystem(user *unix_util.User, channel ssh3.Channel) error {
+	if confinement, ok := unix_server.Confinement(confinements, user.Username); ok && confinement.ChrootDirectory != "" {
+		return fmt.Errorf("the %s subsystem is not available to chrooted users", rpc.SubsystemName)
+	}
+	encodedPolicy, err := json.Marshal(rpcSubsystem.Policy(user.Username))
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return newCommand(user, channel, false, executable, rpc.HelperSubcommand, "-policy", string(encodedPolicy))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/rs/zerolog/log"
+)
+
+var sessionTmpDir unix_server.SessionTmpDirConfig
+
+// creates the private temporary directory of a session of the user, if enabled by the
+// server config, and returns its path and the environment pointing to it
+func createSessionTmpDir(config unix_server.SessionTmpDirConfig, user *unix_util.User) (string, []string, error) {
+	if !config.Enabled {
+		return "", nil, nil
+	}
+	if confinement, ok := unix_server.Confinement(confinements, user.Username); ok && confinement.ChrootDirectory != "" {
+		return "", nil, nil
+	}
+	parent := config.Directory
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	// created with mode 0700
+	dir, err := os.MkdirTemp(parent, "ssh3-session-")
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create the session tmpdir of user %s: %w", user.Username, err)
+	}
+	if runtime.GOOS != "windows" {
+		// on Windows, the commands run as the account of the server
+		if err := os.Chown(dir, int(user.Uid), int(user.Gid)); err != nil {
+			os.Remove(dir)
+			return "", nil, fmt.Errorf("could not chown the session tmpdir of user %s: %w", user.Username, err)
+		}
+	}
+	log.Debug().Msgf("created session tmpdir %s for user %s", dir, user.Username)
+	env := []string{fmt.Sprintf("TMPDIR=%s", dir), fmt.Sprintf("XDG_RUNTIME_DIR=%s", dir)}
+	if runtime.GOOS == "windows" {
+		env = append(env, fmt.Sprintf("TEMP=%s", dir), fmt.Sprintf("TMP=%s", dir))
+	}
+	return dir, env, nil
+}
+
+// removes the session tmpdir along with the files left by the session, does nothing if dir is empty
+func removeSessionTmpDir(dir string) {
+	if dir == "" {
+		return
+	}
+	// does not follow the symlinks created by the user
+	if err := os.RemoveAll(dir); err != nil {
+		log.Error().Msgf("could not remove session tmpdir %s: %s", dir, err)
+	}
+}
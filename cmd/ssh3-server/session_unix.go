@@ -0,0 +1,131 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+type pseudoTerminal struct {
+	pty *os.File // pty used by the server/user to communicate with the running process
+	tty *os.File // tty used by the running process to communicate with the server/user
+}
+
+func openPseudoTerminal(winSize *pty.Winsize) (pseudoTerminal, error) {
+	ptyFile, tty, err := pty.Open()
+	if err != nil {
+		return pseudoTerminal{}, err
+	}
+	if err := pty.Setsize(ptyFile, winSize); err != nil {
+		ptyFile.Close()
+		tty.Close()
+		return pseudoTerminal{}, err
+	}
+	return pseudoTerminal{pty: ptyFile, tty: tty}, nil
+}
+
+// applies the modes of the terminal of the client, as OpenSSH does
+func (p *pseudoTerminal) setTerminalModes(modes ssh3Messages.TerminalModes) error {
+	return ssh3Messages.SetTerminalModes(int(p.tty.Fd()), modes)
+}
+
+func (p *openPty) resize() error {
+	return pty.Setsize(p.pty, p.winSize)
+}
+
+// returns the standard streams of the command and the ends of the pty used by the server
+func (p *openPty) commandIO() (stdout io.Writer, stderr io.Writer, stdin io.Reader, stdoutR io.Reader, stdinW io.Writer) {
+	return p.tty, p.tty, p.tty, p.pty, p.pty
+}
+
+func startWithPty(runningCommand *runningCommand, p *openPty) error {
+	return unix_util.StartWithSizeAndPty(&runningCommand.Cmd, p.winSize, p.pty, p.tty)
+}
+
+// the process group of the command, so that its children also receive the signals of the session
+func ownProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// the process group receiving the signals of the session: the foreground job of the pty, as for
+// the signal characters typed in a terminal, or the group of the command
+func (c *runningCommand) processGroup(p *openPty) int {
+	if p != nil {
+		// the master side of the pty gives the foreground job of the session of the command
+		if pgrp, err := unix.IoctlGetInt(int(p.pty.Fd()), unix.TIOCGPGRP); err == nil && pgrp > 0 {
+			return pgrp
+		}
+	}
+	if c.monitoredPid != 0 {
+		return c.monitoredPid
+	}
+	return c.Process.Pid
+}
+
+func signalProcessGroup(pgrp int, sig os.Signal) error {
+	return syscall.Kill(-pgrp, sig.(syscall.Signal))
+}
+
+// ptys have no line to send a break on, so the line discipline is emulated using the modes of
+// the tty: the break is ignored, interrupts the foreground job or is read as a NUL byte
+func (p *openPty) sendBreak(c *runningCommand) error {
+	// the master side of the pty gives the modes of the tty
+	termios, err := unix.IoctlGetTermios(int(p.pty.Fd()), ioctlReadTermios)
+	if err != nil {
+		return err
+	}
+	switch {
+	case termios.Iflag&unix.IGNBRK != 0:
+		return nil
+	case termios.Iflag&unix.BRKINT != 0:
+		return c.signal(p, syscall.SIGINT)
+	case termios.Iflag&unix.PARMRK != 0:
+		_, err = p.pty.Write([]byte{0xff, 0, 0})
+	default:
+		_, err = p.pty.Write([]byte{0})
+	}
+	return err
+}
+
+// writes on the terminal of the command as wall does, the output of the pty carrying the message
+// to the client. A terminal whose output is suspended, e.g. using ^S, does not block the writer.
+func (p *openPty) writeTerminal(message string) error {
+	// the server closed its own descriptor of the tty once the command started
+	tty, err := os.OpenFile(p.tty.Name(), os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	if err := tty.SetWriteDeadline(time.Now().Add(terminalWriteTimeout)); err != nil {
+		return err
+	}
+	_, err = tty.WriteString(message)
+	return err
+}
+
+func (p *openPty) commandExited() {
+	// the output of the pty ends once the tty is closed by the command and its children
+}
+
+// the environment of the commands of the user
+func userEnvironment(user *unix_util.User) []string {
+	return []string{
+		fmt.Sprintf("HOME=%s", user.Dir),
+		fmt.Sprintf("USER=%s", user.Username),
+		fmt.Sprintf("PATH=%s", "/usr/bin:/bin:/usr/sbin:/sbin"),
+	}
+}
@@ -0,0 +1,201 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/windows"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// a ConPTY pseudo console, available since Windows 10 1809
+type pseudoTerminal struct {
+	console windows.Handle
+	// the input and the output of the console, respectively written and read by the server
+	input  *os.File
+	output *os.File
+}
+
+// the size of the console, which cannot be empty
+func consoleSize(winSize *pty.Winsize) windows.Coord {
+	size := windows.Coord{X: int16(winSize.Cols), Y: int16(winSize.Rows)}
+	if size.X <= 0 || size.Y <= 0 {
+		size = windows.Coord{X: 80, Y: 24}
+	}
+	return size
+}
+
+func openPseudoTerminal(winSize *pty.Winsize) (pseudoTerminal, error) {
+	var inputRead, inputWrite, outputRead, outputWrite windows.Handle
+	if err := windows.CreatePipe(&inputRead, &inputWrite, nil, 0); err != nil {
+		return pseudoTerminal{}, err
+	}
+	if err := windows.CreatePipe(&outputRead, &outputWrite, nil, 0); err != nil {
+		windows.CloseHandle(inputRead)
+		windows.CloseHandle(inputWrite)
+		return pseudoTerminal{}, err
+	}
+	var console windows.Handle
+	err := windows.CreatePseudoConsole(consoleSize(winSize), inputRead, outputWrite, 0, &console)
+	// the console keeps its own copies of its ends of the pipes
+	windows.CloseHandle(inputRead)
+	windows.CloseHandle(outputWrite)
+	if err != nil {
+		windows.CloseHandle(inputWrite)
+		windows.CloseHandle(outputRead)
+		return pseudoTerminal{}, err
+	}
+	return pseudoTerminal{
+		console: console,
+		input:   os.NewFile(uintptr(inputWrite), "conpty-input"),
+		output:  os.NewFile(uintptr(outputRead), "conpty-output"),
+	}, nil
+}
+
+// the console has no modes to set, the programs attached to it set their own console modes
+func (p *pseudoTerminal) setTerminalModes(modes ssh3Messages.TerminalModes) error {
+	return nil
+}
+
+func (p *openPty) resize() error {
+	return windows.ResizePseudoConsole(p.console, consoleSize(p.winSize))
+}
+
+// returns the standard streams of the command and the ends of the pty used by the server. The
+// commands attached to the console do not use the streams of exec.Cmd, these placeholders only
+// prevent it from creating pipes.
+func (p *openPty) commandIO() (stdout io.Writer, stderr io.Writer, stdin io.Reader, stdoutR io.Reader, stdinW io.Writer) {
+	return io.Discard, io.Discard, strings.NewReader(""), p.output, p.input
+}
+
+// returns the environment block of CreateProcess
+func environmentBlock(env []string) *uint16 {
+	var block []uint16
+	for _, variable := range env {
+		if variable == "" || strings.ContainsRune(variable, 0) {
+			continue
+		}
+		encoded, err := windows.UTF16FromString(variable)
+		if err != nil {
+			continue
+		}
+		block = append(block, encoded...)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0]
+}
+
+// exec.Cmd cannot attach the command to a pseudo console, so it is started with CreateProcess
+func startWithPty(runningCommand *runningCommand, p *openPty) error {
+	cmd := &runningCommand.Cmd
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	attributes, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return err
+	}
+	defer attributes.Delete()
+	// the value of the attribute is the handle of the console itself, not a pointer to it
+	err = attributes.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, *(*unsafe.Pointer)(unsafe.Pointer(&p.console)), unsafe.Sizeof(p.console))
+	if err != nil {
+		return err
+	}
+	startupInfo := windows.StartupInfoEx{ProcThreadAttributeList: attributes.List()}
+	startupInfo.Cb = uint32(unsafe.Sizeof(startupInfo))
+	// without this flag, the command would inherit the standard handles of the server instead
+	// of using the console
+	startupInfo.Flags = windows.STARTF_USESTDHANDLES
+
+	commandLine := windows.ComposeCommandLine(cmd.Args)
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.CmdLine != "" {
+		commandLine = cmd.SysProcAttr.CmdLine
+	}
+	applicationName, err := windows.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return err
+	}
+	commandLinePtr, err := windows.UTF16PtrFromString(commandLine)
+	if err != nil {
+		return err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		dir, err = windows.UTF16PtrFromString(cmd.Dir)
+		if err != nil {
+			return err
+		}
+	}
+	var processInformation windows.ProcessInformation
+	err = windows.CreateProcess(applicationName, commandLinePtr, nil, nil, false,
+		windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_UNICODE_ENVIRONMENT, environmentBlock(cmd.Env), dir,
+		&startupInfo.StartupInfo, &processInformation)
+	if err != nil {
+		return fmt.Errorf("could not start %s in a pseudo console: %w", cmd.Path, err)
+	}
+	defer windows.CloseHandle(processInformation.Process)
+	windows.CloseHandle(processInformation.Thread)
+	// opens its own handle on the process, so it must be done before closing the current one
+	runningCommand.process, err = os.FindProcess(int(processInformation.ProcessId))
+	return err
+}
+
+func ownProcessGroup(cmd *exec.Cmd) {}
+
+func (c *runningCommand) processGroup(p *openPty) int {
+	if c.process != nil {
+		return c.process.Pid
+	}
+	return c.Process.Pid
+}
+
+func signalProcessGroup(pid int, sig os.Signal) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer process.Release()
+	return process.Signal(sig)
+}
+
+// the console generates a CTRL_C_EVENT for its processes when reading ^C, as for a BRKINT tty
+func (p *openPty) sendBreak(c *runningCommand) error {
+	_, err := p.input.Write([]byte{0x03})
+	return err
+}
+
+// the output of the console is only written by the programs attached to it
+func (p *openPty) writeTerminal(message string) error {
+	return fmt.Errorf("cannot write on a pseudo console")
+}
+
+// closing the console ends its output once the server read what remains in it
+func (p *openPty) commandExited() {
+	windows.ClosePseudoConsole(p.console)
+	p.input.Close()
+}
+
+// the environment of the commands of the user, created by Windows for the account
+func userEnvironment(user *unix_util.User) []string {
+	env, err := user.Environ()
+	if err != nil {
+		return []string{
+			fmt.Sprintf("USERNAME=%s", user.Username),
+			fmt.Sprintf("USERPROFILE=%s", user.Dir),
+			fmt.Sprintf("SystemRoot=%s", os.Getenv("SystemRoot")),
+		}
+	}
+	return env
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// the aliases and signals specific to Linux
+func init() {
+	signals["SIGCLD"] = syscall.SIGCHLD
+	signals["SIGPOLL"] = syscall.SIGIO
+	signals["SIGPWR"] = syscall.SIGPWR
+	signals["SIGSTKFLT"] = syscall.SIGSTKFLT
+	signals["SIGUNUSED"] = syscall.SIGSYS
+}
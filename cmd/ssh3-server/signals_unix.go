@@ -0,0 +1,79 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"golang.org/x/sys/unix"
+)
+
+// the POSIX signals that can be delivered to the commands using signal requests
+var signals = map[string]os.Signal{
+	"SIGABRT":   syscall.SIGABRT,
+	"SIGALRM":   syscall.SIGALRM,
+	"SIGBUS":    syscall.SIGBUS,
+	"SIGCHLD":   syscall.SIGCHLD,
+	"SIGCONT":   syscall.SIGCONT,
+	"SIGFPE":    syscall.SIGFPE,
+	"SIGHUP":    syscall.SIGHUP,
+	"SIGILL":    syscall.SIGILL,
+	"SIGINT":    syscall.SIGINT,
+	"SIGIO":     syscall.SIGIO,
+	"SIGIOT":    syscall.SIGIOT,
+	"SIGKILL":   syscall.SIGKILL,
+	"SIGPIPE":   syscall.SIGPIPE,
+	"SIGPROF":   syscall.SIGPROF,
+	"SIGQUIT":   syscall.SIGQUIT,
+	"SIGSEGV":   syscall.SIGSEGV,
+	"SIGSTOP":   syscall.SIGSTOP,
+	"SIGSYS":    syscall.SIGSYS,
+	"SIGTERM":   syscall.SIGTERM,
+	"SIGTRAP":   syscall.SIGTRAP,
+	"SIGTSTP":   syscall.SIGTSTP,
+	"SIGTTIN":   syscall.SIGTTIN,
+	"SIGTTOU":   syscall.SIGTTOU,
+	"SIGURG":    syscall.SIGURG,
+	"SIGUSR1":   syscall.SIGUSR1,
+	"SIGUSR2":   syscall.SIGUSR2,
+	"SIGVTALRM": syscall.SIGVTALRM,
+	"SIGWINCH":  syscall.SIGWINCH,
+	"SIGXCPU":   syscall.SIGXCPU,
+	"SIGXFSZ":   syscall.SIGXFSZ,
+}
+
+// returns the exit-signal request reporting that the command was killed by a signal,
+// nil if it exited
+func exitSignalRequest(err error) *ssh3Messages.ExitSignalRequest {
+	var sig syscall.Signal
+	coreDumped := false
+	var exitError *exec.ExitError
+	var monitoredError monitoredExitError
+	if errors.As(err, &exitError) {
+		status, ok := exitError.Sys().(syscall.WaitStatus)
+		if !ok || !status.Signaled() {
+			return nil
+		}
+		sig, coreDumped = status.Signal(), status.CoreDump()
+	} else if errors.As(err, &monitoredError) && monitoredError.signal != 0 {
+		sig, coreDumped = syscall.Signal(monitoredError.signal), monitoredError.coreDumped
+	} else {
+		return nil
+	}
+	// the signals without a name (e.g. the real-time signals) are reported using their number
+	name := strings.TrimPrefix(unix.SignalName(sig), "SIG")
+	if name == "" {
+		name = fmt.Sprintf("%d", int(sig))
+	}
+	return &ssh3Messages.ExitSignalRequest{
+		SignalNameWithoutSig: name,
+		CoreDumped:           coreDumped,
+		ErrorMessageUTF8:     sig.String(),
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// Windows processes can only be killed, the console sessions can be interrupted
+// using break requests
+var signals = map[string]os.Signal{
+	"SIGKILL": os.Kill,
+}
+
+// the Windows processes always exit with an exit code, even when killed
+func exitSignalRequest(err error) *ssh3Messages.ExitSignalRequest {
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	ssh3 "github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/rpc"
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// starts a subsystem on the session channel, the forced commands being already checked
+type subsystemHandler func(user *unix_util.User, channel ssh3.Channel) error
+
+// maps subsystem names onto their handlers, filled by registerSubsystems
+var subsystemRegistry = make(map[string]subsystemHandler)
+
+func registerSubsystem(name string, handler subsystemHandler) error {
+	if _, ok := subsystemRegistry[name]; ok {
+		return fmt.Errorf("subsystem %s registered twice", name)
+	}
+	subsystemRegistry[name] = handler
+	return nil
+}
+
+// runs the command line in the user's shell, as the Subsystem directive of sshd
+func commandSubsystem(command string) subsystemHandler {
+	return func(user *unix_util.User, channel ssh3.Channel) error {
+		return newCommand(user, channel, false, user.Shell, user.ShellCommandArgs(command)...)
+	}
+}
+
+// registers the commands of the subsystems section of the config, then the built-in subsystems
+// that are enabled and not overridden by a command
+func registerSubsystems(config *unix_server.ServerConfig) error {
+	for name, command := range config.Subsystems {
+		if err := registerSubsystem(name, commandSubsystem(command)); err != nil {
+			return err
+		}
+	}
+	if config.RPCSubsystem != nil {
+		if _, ok := subsystemRegistry[rpc.SubsystemName]; !ok {
+			return registerSubsystem(rpc.SubsystemName, newRPCSubsystem)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// like server.ListenAndServe, on a UDP socket created with the configured receive buffer size, as
+// quic-go only raises it to its default, and traffic class
+func serveWithReceiveBuffer(server *http3.Server, transport ssh3.TransportConfig) error {
+	conn, err := transport.ListenUDP(server.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return server.Serve(conn)
+}
+
+// serves the QUIC connections tunneled over HTTP/2 on bindAddr by the clients whose network blocks
+// UDP, the tunneling requests being accepted on the URL paths of the server. server.TLSConfig must
+// be set, the HTTP/2 server using the same certificates.
+func serveTCPFallback(server *http3.Server, bindAddr string, paths []string) error {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return err
+	}
+	tunnelServer := ssh3.NewHTTP2TunnelServer(listener.Addr())
+	defer tunnelServer.Close()
+	go func() {
+		if err := server.Serve(tunnelServer); err != nil {
+			log.Error().Msgf("error while serving the tunneled connections: %s", err)
+		}
+	}()
+	mux := http.NewServeMux()
+	for _, path := range paths {
+		mux.Handle(path, tunnelServer)
+	}
+	httpServer := &http.Server{Handler: mux, TLSConfig: server.TLSConfig.Clone()}
+	log.Info().Msgf("accepting the connections tunneled over HTTP/2 on %s", listener.Addr())
+	return httpServer.ServeTLS(listener, "", "")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// the features compiled in this binary for this platform
+func serverFeatures() map[string]bool {
+	return map[string]bool{
+		"password_auth":       unix_util.PasswordAuthAvailable(),
+		"pam":                 false,
+		"fido2":               false,
+		"privsep":             runtime.GOOS == "linux",
+		"break_glass":         checkPeerCredentialsSupport() == nil,
+		"pty":                 runtime.GOOS != "windows",
+		"session_recording":   true,
+		"session_persistence": runtime.GOOS != "windows",
+		"rpc_subsystem":       true,
+		"datagram_typing":     true,
+		"multiple_sessions":   true,
+		"compression":         true,
+		"client_certificates": true,
+		"post_quantum_kex":    ssh3.PostQuantumKeyExchangeSupported(),
+		// the sftp subsystem runs the sftp-server configured in the subsystems
+		"sftp": false,
+	}
+}
+
+// prints the version, or the feature report as JSON if features is set
+func printVersion(features bool) int {
+	if !features {
+		fmt.Printf("ssh3-server %s (%s)\n", ssh3.ReleaseVersion(), ssh3.GetCurrentVersion())
+		return 0
+	}
+	if err := ssh3.NewFeatureReport("ssh3-server", serverFeatures()).Write(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the feature report: %s\n", err)
+		return -1
+	}
+	return 0
+}
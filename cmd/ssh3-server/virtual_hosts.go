@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/francoismichel/ssh3/unix_server"
+)
+
+// adds the pre-authorization tokens of the virtual host to authenticator, or the ones of the
+// server if host is nil or does not set any
+func withPreauth(authenticator unix_server.Authenticator, serverConfig *unix_server.ServerConfig, host *unix_server.VirtualHostConfig) (unix_server.Authenticator, error) {
+	preauth := serverConfig.Preauth
+	if host != nil && host.Preauth != nil {
+		preauth = host.Preauth
+	}
+	if preauth == nil {
+		return authenticator, nil
+	}
+	return newPreauthAuthenticator(authenticator, preauth)
+}
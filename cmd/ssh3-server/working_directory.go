@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/francoismichel/ssh3/unix_server"
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// returns the directory in which the commands of the user start when the client requests dir,
+// as permitted by the access control config
+func resolveWorkingDirectory(user *unix_util.User, dir string) (string, error) {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = filepath.Join(user.Dir, dir[1:])
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(user.Dir, dir)
+	}
+	dir = filepath.Clean(dir)
+	home := user.Dir
+	// the directory of a chrooted user is in the chroot, it cannot be resolved from the server
+	if confinement, ok := unix_server.Confinement(confinements, user.Username); !ok || confinement.ChrootDirectory == "" {
+		// the policy applies to where the symlinks lead
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return "", fmt.Errorf("invalid working directory %s for user %s: %w", dir, user.Username, err)
+		}
+		if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("invalid working directory %s for user %s: not a directory", dir, user.Username)
+		}
+		dir = resolved
+		if resolvedHome, err := filepath.EvalSymlinks(home); err == nil {
+			home = resolvedHome
+		}
+	}
+	if !settings().accessControl.PermitsWorkingDirectory(dir, home) {
+		return "", fmt.Errorf("working directory %s is not permitted for user %s by the access control config", dir, user.Username)
+	}
+	return dir, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+// ssh3-web-gateway serves the web terminals of browsers, which cannot speak SSH3 themselves, e.g.
+//
+//	ssh3-web-gateway -server my-server.example.org:443/ssh3-term -static examples/web-terminal \
+//		-cert cert.pem -key priv.key
+//
+// Each WebSocket connection on -ws-path authenticates to the SSH3 server as the user of the page
+// and runs a shell in a pty, see client.WebSocketBridge. The passwords and tokens of the users
+// transit the WebSockets, which should therefore only be served over TLS.
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/francoismichel/ssh3/client"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	bindAddr := flag.String("bind", "localhost:8080", "the address:port pair on which the gateway serves the browsers")
+	serverURL := flag.String("server", "", "the URL of the SSH3 server, e.g. my-server.example.org:443/ssh3-term")
+	certPath := flag.String("cert", "", "if set along with -key, the filename of the certificate served to the browsers over TLS")
+	keyPath := flag.String("key", "", "the filename of the private key of -cert")
+	wsPath := flag.String("ws-path", "/ws", "the URL path of the WebSocket endpoint")
+	staticDir := flag.String("static", "", "if set, serve the files of this directory (e.g. examples/web-terminal) on the other URL paths")
+	allowedOrigins := flag.String("allowed-origins", "", "the comma-separated origins whose pages may open the WebSockets, "+
+		"e.g. https://console.example.org (default: the pages served by the gateway)")
+	insecure := flag.Bool("insecure", false, "if set, skip the verification of the certificate of the SSH3 server")
+	knownHostsPath := flag.String("known-hosts", "", "also trust the keys pinned for the SSH3 server in this known_hosts file "+
+		"(default: ~/.ssh3/known_hosts)")
+	term := flag.String("term", "", "the TERM of the ptys (default: xterm-256color)")
+	verbose := flag.Bool("v", false, "if set, enable verbose mode")
+	flag.Parse()
+
+	if *verbose {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		util.ConfigureLogger("debug")
+	} else {
+		util.ConfigureLogger(os.Getenv("SSH3_LOG_LEVEL"))
+	}
+
+	if *serverURL == "" {
+		fmt.Fprintln(os.Stderr, "the URL of the SSH3 server must be set using -server")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if (*certPath == "") != (*keyPath == "") {
+		fmt.Fprintln(os.Stderr, "-cert and -key must be set together")
+		os.Exit(2)
+	}
+
+	bridge := &client.WebSocketBridge{
+		ServerURL: *serverURL,
+		Term:      *term,
+	}
+	if *allowedOrigins != "" {
+		for _, origin := range strings.Split(*allowedOrigins, ",") {
+			bridge.AllowedOrigins = append(bridge.AllowedOrigins, strings.TrimSpace(origin))
+		}
+	}
+	if *insecure {
+		bridge.Config.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	bridge.Config.KnownHostsPath = *knownHostsPath
+	if bridge.Config.KnownHostsPath == "" {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			bridge.Config.KnownHostsPath = path.Join(homeDir, ".ssh3", "known_hosts")
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*wsPath, bridge)
+	if *staticDir != "" {
+		mux.Handle("/", http.FileServer(http.Dir(*staticDir)))
+	}
+
+	if *certPath == "" {
+		if host, _, err := net.SplitHostPort(*bindAddr); err != nil || !isLoopback(host) {
+			log.Warn().Msgf("serving the browsers without TLS on %s: the passwords and tokens of the users are sent in cleartext", *bindAddr)
+		}
+		log.Info().Msgf("serving the WebSockets on http://%s%s", *bindAddr, *wsPath)
+		err := http.ListenAndServe(*bindAddr, mux)
+		log.Fatal().Msgf("%s", err)
+	}
+	log.Info().Msgf("serving the WebSockets on https://%s%s", *bindAddr, *wsPath)
+	err := http.ListenAndServeTLS(*bindAddr, *certPath, *keyPath, mux)
+	log.Fatal().Msgf("%s", err)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
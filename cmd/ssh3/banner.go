@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// returns the handler printing the banner of the server once on out, as it may be sent both
+// before and after the authentication
+func newBannerPrinter(out io.Writer) ssh3.BannerHandler {
+	var once sync.Once
+	return func(banner string) {
+		once.Do(func() {
+			banner = sanitizeBanner(banner)
+			if banner != "" && !strings.HasSuffix(banner, "\n") {
+				banner += "\n"
+			}
+			fmt.Fprint(out, banner)
+		})
+	}
+}
+
+// removes the control characters of the banner, except the line feeds and tabs, so that the
+// server cannot send escape sequences to the terminal of the user
+func sanitizeBanner(banner string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, banner)
+}
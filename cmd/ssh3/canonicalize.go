@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/francoismichel/ssh3"
+)
+
+// appends the identity files of the second pass on the config that were not obtained in the
+// first one, e.g. from a Host block matching the canonical name
+func appendNewAuthMethods(authMethods []interface{}, canonicalAuthMethods []interface{}) []interface{} {
+	known := make(map[string]bool)
+	for _, method := range authMethods {
+		if privkeyMethod, ok := method.(*ssh3.PrivkeyFileAuthMethod); ok {
+			known[privkeyMethod.Filename()] = true
+		}
+	}
+	for _, method := range canonicalAuthMethods {
+		if privkeyMethod, ok := method.(*ssh3.PrivkeyFileAuthMethod); ok && !known[privkeyMethod.Filename()] {
+			authMethods = append(authMethods, method)
+		}
+	}
+	return authMethods
+}
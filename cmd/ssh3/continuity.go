@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+func isCryptoError(err error) bool {
+	var transportErr *quic.TransportError
+	return errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError()
+}
+
+// the TLS alert sent when the peers share no parameter, e.g. no key exchange
+const tlsAlertHandshakeFailure = 40
+
+func isHandshakeFailure(err error) bool {
+	var transportErr *quic.TransportError
+	return errors.As(err, &transportErr) && transportErr.ErrorCode == quic.TransportErrorCode(0x100+tlsAlertHandshakeFailure)
+}
+
+// performs a handshake with the server to get its certificate, without trusting it
+// dials the server again using tlsConf, the same way as the first attempt, e.g. over UDP or
+// through an HTTP/2 tunnel
+type redialFunc func(ctx context.Context, tlsConf *tls.Config) (quic.EarlyConnection, error)
+
+func fetchServerCertificate(ctx context.Context, redial redialFunc, tlsConf *tls.Config) (*x509.Certificate, error) {
+	insecureTLSConf := tlsConf.Clone()
+	insecureTLSConf.InsecureSkipVerify = true
+	var peerCertificate *x509.Certificate
+	certError := fmt.Errorf("we don't want to start a totally insecure connection")
+	insecureTLSConf.VerifyConnection = func(state tls.ConnectionState) error {
+		peerCertificate = state.PeerCertificates[0]
+		return certError
+	}
+	_, err := redial(ctx, insecureTLSConf)
+	if !errors.Is(err, certError) {
+		return nil, fmt.Errorf("could not create client QUIC connection: %w", err)
+	}
+	return peerCertificate, nil
+}
+
+// prints a loud warning and returns an error if the key of the certificate is revoked in the
+// known hosts
+func checkRevokedServerCertificate(hostname string, peerCertificate *x509.Certificate, knownHosts *ssh3.KnownHosts, knownHostsPath string) error {
+	if !knownHosts.IsRevoked(hostname, peerCertificate) {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+		"@       WARNING: REVOKED SERVER KEY DETECTED!             @\n"+
+		"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+		"The server %s presented a certificate whose key is marked as revoked in %s.\n"+
+		"IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY: the key could have been stolen!\n"+
+		"Public key fingerprint: SHA256 %s\n",
+		hostname, knownHostsPath, util.Sha256Fingerprint(peerCertificate.RawSubjectPublicKeyInfo))
+	return ssh3.RevokedHostKey{Host: hostname}
+}
+
+// The pinned keys of the host no longer match the certificate of the server. If the new
+// certificate is endorsed by a pinned one, the server legitimately rotated its identity: the known
+// hosts are updated and the connection is established again. Otherwise, alert the user loudly.
+func dialRotatedServer(ctx context.Context, hostname string, redial redialFunc, tlsConf *tls.Config,
+	knownHosts *ssh3.KnownHosts, knownHostsPath string) (quic.EarlyConnection, error) {
+	peerCertificate, err := fetchServerCertificate(ctx, redial, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRevokedServerCertificate(hostname, peerCertificate, knownHosts, knownHostsPath); err != nil {
+		return nil, err
+	}
+	endorsingCertificate, err := ssh3.VerifyIdentityContinuityFunc(peerCertificate, func(previous *x509.Certificate) bool {
+		return knownHosts.VerifyCertificate(hostname, previous) == nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+			"@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n"+
+			"@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"+
+			"The certificate of %s does not match the key pinned in %s and its rotation is not endorsed by it (%s).\n"+
+			"IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY: someone could be eavesdropping on you right now "+
+			"(machine-in-the-middle attack)!\n"+
+			"Public key fingerprint: SHA256 %s\n"+
+			"If the server key was replaced on purpose, remove the line of %s from %s.\n",
+			hostname, knownHostsPath, err, util.Sha256Fingerprint(peerCertificate.RawSubjectPublicKeyInfo), hostname, knownHostsPath)
+		return nil, fmt.Errorf("the server identity changed without continuity proof: %w", err)
+	}
+	if err := ssh3.ReplaceKnownHost(knownHostsPath, hostname, peerCertificate); err != nil {
+		return nil, fmt.Errorf("could not update the known host in %s: %w", knownHostsPath, err)
+	}
+	fmt.Fprintf(os.Stderr, "The server %s rotated its certificate from SHA256 %s to SHA256 %s, endorsed by the previous one: updated %s\n",
+		hostname, util.Sha256Fingerprint(endorsingCertificate.Raw), util.Sha256Fingerprint(peerCertificate.Raw), knownHostsPath)
+
+	// the TLS config verifies the server using knownHosts
+	knownHosts.Add(hostname, peerCertificate)
+	log.Debug().Msgf("dialing QUIC host %s again with the rotated certificate", hostname)
+	return redial(ctx, tlsConf)
+}
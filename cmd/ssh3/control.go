@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog/log"
+)
+
+// The control socket allows to query a running client, similarly to OpenSSH's ControlPath.
+// It serves a small HTTP API on a UNIX socket only accessible by the current user.
+
+// serves the control socket, along with the commands of the server-control mode if control is set
+func serveControlSocket(controlPath string, conv *ssh3.Conversation, control *serverControl) (closeFunc func(), err error) {
+	listener, err := util.ListenPrivateSocket(controlPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(conv.ChannelsStats()); err != nil {
+			log.Error().Msgf("could not write stats on control socket: %s", err)
+		}
+	})
+	if control != nil {
+		control.register(mux)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return func() {
+		server.Close()
+		os.Remove(controlPath)
+	}, nil
+}
+
+func newControlSocketClient(controlPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", controlPath)
+			},
+		},
+	}
+}
+
+func printChannelsStats(out io.Writer, reports []ssh3.ChannelStatsReport) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tTYPE\tREMOTE\tBYTES SENT\tBYTES RECEIVED\tMSGS SENT\tMSGS RECEIVED\tDGRAMS SENT\tDGRAMS RECEIVED\tCOMPRESSION")
+	for _, r := range reports {
+		remote := r.RemoteAddr
+		if remote == "" {
+			remote = "-"
+		}
+		// the size of the compressed data relative to the original data
+		compression := "-"
+		if r.CompressionInputBytes > 0 {
+			compression = fmt.Sprintf("%.0f%%", 100*float64(r.CompressionOutputBytes)/float64(r.CompressionInputBytes))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", r.ChannelID, r.ChannelType, remote,
+			r.BytesSent, r.BytesReceived, r.MessagesSent, r.MessagesReceived, r.DatagramsSent, r.DatagramsReceived, compression)
+	}
+	w.Flush()
+}
+
+// runs the control command (-O) against the client listening on controlPath and returns the exit status
+func runControlCommand(controlPath string, command string) int {
+	if controlPath == "" {
+		fmt.Fprintln(os.Stderr, "a control path must be specified with -control-path to use -O")
+		return -1
+	}
+	client := newControlSocketClient(controlPath)
+	switch command {
+	case "stats":
+		rsp, err := client.Get("http://ssh3-control/stats")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not query control socket %s: %s\n", controlPath, err)
+			return -1
+		}
+		defer rsp.Body.Close()
+		var reports []ssh3.ChannelStatsReport
+		if err := json.NewDecoder(rsp.Body).Decode(&reports); err != nil {
+			fmt.Fprintf(os.Stderr, "could not parse stats from control socket: %s\n", err)
+			return -1
+		}
+		printChannelsStats(os.Stdout, reports)
+		return 0
+	case "exit":
+		rsp, err := client.Post("http://ssh3-control/exit", "", nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not query control socket %s: %s\n", controlPath, err)
+			return -1
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusNoContent {
+			body, _ := io.ReadAll(rsp.Body)
+			fmt.Fprintf(os.Stderr, "could not exit: %s", body)
+			return -1
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown control command \"%s\"\n", command)
+		return -1
+	}
+}
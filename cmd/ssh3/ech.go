@@ -0,0 +1,11 @@
+//go:build go1.23
+
+package main
+
+import "crypto/tls"
+
+// encrypts the ClientHello with the ECH configs of the server, returning false if not supported
+func setECHConfigList(tlsConf *tls.Config, configList []byte) bool {
+	tlsConf.EncryptedClientHelloConfigList = configList
+	return true
+}
@@ -0,0 +1,10 @@
+//go:build !go1.23
+
+package main
+
+import "crypto/tls"
+
+// ECH is only implemented by crypto/tls from Go 1.23
+func setECHConfigList(tlsConf *tls.Config, configList []byte) bool {
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// predicts the echo of the printable characters typed in an interactive session and displays
+// them before the server echoes them, similarly to mosh. The predictions are only displayed once
+// the server echoed a character typed since the last control character (e.g. Enter), so that the
+// input typed without echo (e.g. a password) is never displayed. The echoes of the server
+// confirm the predictions, the predictions that the output contradicts are erased.
+type echoPredictor struct {
+	mutex    sync.Mutex
+	terminal io.Writer
+	// the typed characters whose echo was not received yet
+	pending []byte
+	// the number of pending characters already displayed, they precede the others
+	displayed int
+	// set once the server echoed a character typed since the last control character
+	echoing bool
+	// set after a control character, until the pending characters are echoed: the echo of the
+	// control character (e.g. a new line and a prompt) comes before the next characters
+	blocked bool
+}
+
+func newEchoPredictor(terminal io.Writer) *echoPredictor {
+	return &echoPredictor{terminal: terminal}
+}
+
+// called with the input sent to the server
+func (p *echoPredictor) typed(input []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	start := len(p.pending)
+	for _, c := range input {
+		if c < 0x20 || c > 0x7e {
+			p.echoing = false
+			p.blocked = len(p.pending) > 0
+			if c == 0x1b {
+				// the rest of an escape sequence, e.g. an arrow key, is not echoed
+				break
+			}
+			continue
+		}
+		if p.blocked {
+			continue
+		}
+		p.pending = append(p.pending, c)
+		if p.echoing && p.displayed == len(p.pending)-1 {
+			p.displayed++
+		}
+	}
+	if p.displayed > start {
+		p.terminal.Write(p.pending[start:p.displayed])
+	}
+}
+
+// writes the output of the server
+func (p *echoPredictor) Write(output []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	matched := 0
+	for matched < len(output) && matched < len(p.pending) && output[matched] == p.pending[matched] {
+		matched++
+	}
+	if matched > 0 {
+		p.echoing = true
+	}
+	// the displayed characters are not written again
+	skipped := min(matched, p.displayed)
+	p.pending = p.pending[matched:]
+	p.displayed -= skipped
+	if len(p.pending) == 0 {
+		p.blocked = false
+	}
+	rest := output[skipped:]
+	if matched < len(output) && len(p.pending) > 0 {
+		// the output contradicts the predictions
+		if p.displayed > 0 {
+			// move the cursor back on the first displayed prediction and erase the end of the line
+			if _, err := fmt.Fprintf(p.terminal, "\x1b[%dD\x1b[K", p.displayed); err != nil {
+				return 0, err
+			}
+		}
+		p.pending = nil
+		p.displayed = 0
+		p.echoing = false
+		p.blocked = false
+	}
+	if len(rest) > 0 {
+		if _, err := p.terminal.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(output), nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultEscapeChar = '~'
+
+type escapeCommand struct {
+	description string
+	run         func()
+	// if set, the command reads a line, e.g. for the command line opened by ~C
+	prompt  string
+	runLine func(line string)
+}
+
+// filters the escape sequences out of the input typed in an interactive session. Similarly to
+// OpenSSH, the escape character is only recognized at the beginning of a line.
+type escapeFilter struct {
+	escapeChar byte
+	commands   map[byte]escapeCommand
+	// the terminal is in raw mode, so the messages end with \r\n
+	messages    io.Writer
+	atLineStart bool
+	escaping    bool
+	// the command reading a line, if any
+	lineCommand *escapeCommand
+	line        []byte
+}
+
+func newEscapeFilter(escapeChar byte, messages io.Writer) *escapeFilter {
+	return &escapeFilter{
+		escapeChar:  escapeChar,
+		commands:    make(map[byte]escapeCommand),
+		messages:    messages,
+		atLineStart: true,
+	}
+}
+
+func (f *escapeFilter) addCommand(key byte, description string, run func()) {
+	f.commands[key] = escapeCommand{description: description, run: run}
+}
+
+// adds a command reading a line after displaying the prompt
+func (f *escapeFilter) addLineCommand(key byte, description string, prompt string, runLine func(line string)) {
+	f.commands[key] = escapeCommand{description: description, prompt: prompt, runLine: runLine}
+}
+
+// the name of the key as typed, e.g. ^Z
+func keyName(key byte) string {
+	if key < 0x20 {
+		return fmt.Sprintf("^%c", key+'@')
+	}
+	return string(key)
+}
+
+func (f *escapeFilter) printHelp() {
+	fmt.Fprintf(f.messages, "Supported escape sequences:\r\n")
+	keys := make([]int, 0, len(f.commands))
+	for key := range f.commands {
+		keys = append(keys, int(key))
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		fmt.Fprintf(f.messages, " %c%s - %s\r\n", f.escapeChar, keyName(byte(key)), f.commands[byte(key)].description)
+	}
+	fmt.Fprintf(f.messages, " %c? - this message\r\n", f.escapeChar)
+	fmt.Fprintf(f.messages, " %c%c - send the escape character by typing it twice\r\n", f.escapeChar, f.escapeChar)
+}
+
+// edits the line read by the line command, runs it once the line is entered
+func (f *escapeFilter) readLine(c byte) {
+	switch {
+	case c == '\r' || c == '\n':
+		fmt.Fprintf(f.messages, "\r\n")
+		command, line := f.lineCommand, string(f.line)
+		f.lineCommand, f.line = nil, nil
+		command.runLine(line)
+	case c == 0x03:
+		// ^C cancels the command
+		fmt.Fprintf(f.messages, "^C\r\n")
+		f.lineCommand, f.line = nil, nil
+	case c == 0x7f || c == '\b':
+		if len(f.line) > 0 {
+			f.line = f.line[:len(f.line)-1]
+			fmt.Fprintf(f.messages, "\b \b")
+		}
+	case c >= 0x20:
+		f.line = append(f.line, c)
+		f.messages.Write([]byte{c})
+	}
+}
+
+// returns the input without its escape sequences, running their commands
+func (f *escapeFilter) filter(input []byte) []byte {
+	output := make([]byte, 0, len(input))
+	for _, c := range input {
+		if f.lineCommand != nil {
+			f.readLine(c)
+			continue
+		}
+		if f.escaping {
+			f.escaping = false
+			if c == f.escapeChar {
+				output = append(output, c)
+				f.atLineStart = false
+			} else if c == '?' {
+				f.printHelp()
+			} else if command, ok := f.commands[c]; ok && command.runLine != nil {
+				f.lineCommand = &command
+				fmt.Fprintf(f.messages, "\r\n%s", command.prompt)
+			} else if ok {
+				command.run()
+			} else {
+				// not an escape sequence, sent as is
+				output = append(output, f.escapeChar, c)
+				f.atLineStart = c == '\r' || c == '\n'
+			}
+			continue
+		}
+		if f.atLineStart && c == f.escapeChar {
+			f.escaping = true
+			continue
+		}
+		output = append(output, c)
+		f.atLineStart = c == '\r' || c == '\n'
+	}
+	return output
+}
+
+// translates the line feeds into the line endings of a terminal in raw mode
+type crlfWriter struct {
+	io.Writer
+}
+
+func (w crlfWriter) Write(p []byte) (int, error) {
+	_, err := w.Writer.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n")))
+	return len(p), err
+}
+
+// adds the escape sequences sending a break or a signal to the remote session
+func addSignalEscapes(f *escapeFilter, conv *ssh3.Conversation, channel ssh3.Channel) {
+	f.addCommand('B', "send a break to the remote session", func() {
+		if err := conv.CheckPeerRequestType("break"); err != nil {
+			log.Error().Msgf("server: %s", err)
+			return
+		}
+		err := channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+			WantReply:      false,
+			ChannelRequest: &ssh3Messages.BreakRequest{BreakLengthMs: 1000},
+		})
+		if err != nil {
+			log.Error().Msgf("could not send break request: %s", err)
+		}
+	})
+	for key, signal := range map[byte]string{'I': "INT", 'Q': "QUIT", 'T': "TERM", 'K': "KILL", 'H': "HUP"} {
+		signal := signal
+		f.addCommand(key, fmt.Sprintf("send SIG%s to the remote session", signal), func() {
+			err := channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+				WantReply:      false,
+				ChannelRequest: &ssh3Messages.SignalRequest{SignalNameWithoutSig: signal},
+			})
+			if err != nil {
+				log.Error().Msgf("could not send SIG%s: %s", signal, err)
+			}
+		})
+	}
+}
+
+const commandLineHelp = `Commands:
+ -L localport/remoteip@remoteport - forward a local TCP port
+ -U localport/remoteip@remoteport - forward a local UDP port
+ -KL localport - cancel a TCP forwarding
+ -KU localport - cancel a UDP forwarding
+`
+
+// runs a command typed on the command line opened by ~C
+func runCommandLine(line string, forwards *forwardings) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	var option, argument string
+	for _, candidate := range []string{"-KL", "-KU", "-L", "-U"} {
+		if strings.HasPrefix(line, candidate) {
+			option, argument = candidate, strings.TrimSpace(strings.TrimPrefix(line, candidate))
+			break
+		}
+	}
+	if option == "" || argument == "" {
+		return fmt.Errorf("invalid command %q\n%s", line, commandLineHelp)
+	}
+	protocol := "tcp"
+	if strings.HasSuffix(option, "U") {
+		protocol = "udp"
+	}
+	if strings.HasPrefix(option, "-K") {
+		localPort, err := strconv.Atoi(argument)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", argument)
+		}
+		return forwards.remove(protocol, localPort)
+	}
+	localAddr, remoteAddr, err := parseForwarding(protocol, argument)
+	if err != nil {
+		return err
+	}
+	if protocol == "udp" {
+		return forwards.forwardUDP(localAddr.(*net.UDPAddr), remoteAddr.(*net.UDPAddr))
+	}
+	return forwards.forwardTCP(localAddr.(*net.TCPAddr), remoteAddr.(*net.TCPAddr))
+}
+
+// adds the escape sequences controlling the connection and its forwardings
+func addConnectionEscapes(f *escapeFilter, conv *ssh3.Conversation, forwards *forwardings, terminate func()) {
+	messages := crlfWriter{f.messages}
+	f.addCommand('.', "terminate the connection", terminate)
+	f.addCommand('#', "list the channels and the forwardings", func() {
+		printChannelsStats(messages, conv.ChannelsStats())
+		for _, forwarding := range forwards.list() {
+			fmt.Fprintf(messages, "forwarding %s\n", forwarding)
+		}
+	})
+	f.addLineCommand('C', "open a command line, e.g. to add or cancel forwardings", "ssh3> ", func(line string) {
+		if err := runCommandLine(line, forwards); err != nil {
+			fmt.Fprintf(messages, "%s\n", err)
+		}
+	})
+}
+
+// adds the escape sequence suspending the client, the terminal being restored meanwhile
+func addSuspendEscape(f *escapeFilter, terminal *rawTerminal) {
+	f.addCommand(0x1a, "suspend the client", func() {
+		if err := terminal.suspend(); err != nil {
+			fmt.Fprintf(f.messages, "could not suspend the client: %s\r\n", err)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// the numbers of the signals that can be reported in exit-signal requests (RFC 4254, section 6.10)
+var exitSignals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+}
+
+// returns the exit status of the client when the remote command was killed by the signal:
+// 128 + the number of the signal as a shell would, or 255 if the signal is unknown
+func exitSignalStatus(signalNameWithoutSig string) int {
+	sig, ok := exitSignals[signalNameWithoutSig]
+	if !ok {
+		// the signals without a name are reported using their number
+		number, err := strconv.Atoi(signalNameWithoutSig)
+		if err != nil || number <= 0 || number >= 127 {
+			return 255
+		}
+		sig = syscall.Signal(number)
+	}
+	return 128 + int(sig)
+}
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// the signals that are not defined on every platform, whose number also differs across
+// the UNIX systems
+func init() {
+	exitSignals["USR1"] = syscall.SIGUSR1
+	exitSignals["USR2"] = syscall.SIGUSR2
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/rs/zerolog/log"
+)
+
+type forwarding struct {
+	protocol string
+	local    net.Addr
+	remote   net.Addr
+	listener io.Closer
+}
+
+func (f *forwarding) String() string {
+	return fmt.Sprintf("%s %s -> %s", f.protocol, f.local, f.remote)
+}
+
+// the local port forwardings of the conversation, which can be added and removed while
+// the client is connected
+type forwardings struct {
+	ctx  context.Context
+	conv *ssh3.Conversation
+	// by protocol and local port
+	forwardings map[string]*forwarding
+	lock        sync.Mutex
+}
+
+func newForwardings(ctx context.Context, conv *ssh3.Conversation) *forwardings {
+	return &forwardings{ctx: ctx, conv: conv, forwardings: make(map[string]*forwarding)}
+}
+
+func forwardingKey(protocol string, localPort int) string {
+	return fmt.Sprintf("%s/%d", protocol, localPort)
+}
+
+// returns the loopback address of the same family as remoteIP
+func loopbackFor(remoteIP net.IP) (net.IP, error) {
+	if remoteIP.To4() != nil {
+		return net.IPv4(127, 0, 0, 1), nil
+	} else if remoteIP.To16() != nil {
+		return net.IPv6loopback, nil
+	}
+	return nil, fmt.Errorf("unrecognized IP length %d", len(remoteIP))
+}
+
+// parses a localport/remoteip@remoteport forwarding into the local and remote addresses
+func parseForwarding(protocol string, spec string) (net.Addr, net.Addr, error) {
+	localPort, remoteIP, remotePort, err := parseAddrPort(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	localIP, err := loopbackFor(remoteIP)
+	if err != nil {
+		return nil, nil, err
+	}
+	if protocol == "udp" {
+		return &net.UDPAddr{IP: localIP, Port: localPort}, &net.UDPAddr{IP: remoteIP, Port: remotePort}, nil
+	}
+	return &net.TCPAddr{IP: localIP, Port: localPort}, &net.TCPAddr{IP: remoteIP, Port: remotePort}, nil
+}
+
+func (f *forwardings) add(forwarding *forwarding, localPort int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := forwardingKey(forwarding.protocol, localPort)
+	if _, ok := f.forwardings[key]; ok {
+		return fmt.Errorf("local %s port %d is already forwarded", forwarding.protocol, localPort)
+	}
+	f.forwardings[key] = forwarding
+	return nil
+}
+
+// forwards the datagrams received on localAddr towards remoteAddr, using a channel per source address
+func (f *forwardings) forwardUDP(localAddr *net.UDPAddr, remoteAddr *net.UDPAddr) error {
+	if err := f.conv.CheckPeerChannelType("direct-udp"); err != nil {
+		return err
+	}
+	log.Debug().Msgf("start forwarding from %s to %s", localAddr, remoteAddr)
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return fmt.Errorf("could listen on UDP socket: %w", err)
+	}
+	if err := f.add(&forwarding{protocol: "udp", local: localAddr, remote: remoteAddr, listener: conn}, localAddr.Port); err != nil {
+		conn.Close()
+		return err
+	}
+	channels := make(map[string]ssh3.Channel)
+	go func() {
+		defer func() {
+			for _, channel := range channels {
+				channel.Close()
+			}
+		}()
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Error().Msgf("could read on UDP socket: %s", err)
+				return
+			}
+			channel, ok := channels[addr.String()]
+			if !ok {
+				channel, err = f.conv.OpenUDPForwardingChannel(30000, 10, localAddr, remoteAddr)
+				if err != nil {
+					log.Error().Msgf("could open new UDP forwarding channel: %s", err)
+					return
+				}
+				channels[addr.String()] = channel
+
+				go func() {
+					for {
+						dgram, err := channel.ReceiveDatagram(f.ctx)
+						if err != nil {
+							log.Error().Msgf("could open receive datagram on channel: %s", err)
+							return
+						}
+						_, err = conn.WriteToUDP(dgram, addr)
+						if errors.Is(err, net.ErrClosed) {
+							return
+						} else if err != nil {
+							log.Error().Msgf("could open write datagram on socket: %s", err)
+							return
+						}
+					}
+				}()
+			}
+			err = channel.SendDatagram(buf[:n])
+			if err != nil {
+				log.Error().Msgf("could not send datagram: %s", err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// forwards the connections accepted on localAddr towards remoteAddr
+func (f *forwardings) forwardTCP(localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) error {
+	if err := f.conv.CheckPeerChannelType("direct-tcp"); err != nil {
+		return err
+	}
+	log.Debug().Msgf("start forwarding from %s to %s", localAddr, remoteAddr)
+	listener, err := net.ListenTCP("tcp", localAddr)
+	if err != nil {
+		return fmt.Errorf("could listen on TCP socket: %w", err)
+	}
+	if err := f.add(&forwarding{protocol: "tcp", local: localAddr, remote: remoteAddr, listener: listener}, localAddr.Port); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Error().Msgf("could accept on TCP socket: %s", err)
+				return
+			}
+			forwardingChannel, err := f.conv.OpenTCPForwardingChannel(30000, 10, localAddr, remoteAddr)
+			if err != nil {
+				log.Error().Msgf("could open new TCP forwarding channel: %s", err)
+				conn.Close()
+				return
+			}
+			forwardTCPInBackground(f.ctx, forwardingChannel, conn)
+		}
+	}()
+	return nil
+}
+
+// stops listening on the local port, the connections already forwarded are kept
+func (f *forwardings) remove(protocol string, localPort int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := forwardingKey(protocol, localPort)
+	forwarding, ok := f.forwardings[key]
+	if !ok {
+		return fmt.Errorf("local %s port %d is not forwarded", protocol, localPort)
+	}
+	delete(f.forwardings, key)
+	log.Debug().Msgf("stop forwarding from %s to %s", forwarding.local, forwarding.remote)
+	return forwarding.listener.Close()
+}
+
+func (f *forwardings) list() []*forwarding {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	list := make([]*forwarding, 0, len(f.forwardings))
+	for _, forwarding := range f.forwardings {
+		list = append(list, forwarding)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+	return list
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// the delay before racing the next address while the handshakes with the previous ones are
+// running, as recommended by RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dials the QUIC connection with the server at addr, returning the UDP socket if it was created by
+// the client
+type dialFunc func(ctx context.Context, addr *net.UDPAddr) (quic.EarlyConnection, *net.UDPConn, error)
+
+// parses the AddressFamily option of OpenSSH into the network of the server addresses
+func parseAddressFamily(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "any", "":
+		return "ip", nil
+	case "inet":
+		return "ip4", nil
+	case "inet6":
+		return "ip6", nil
+	default:
+		return "", fmt.Errorf("invalid AddressFamily %q (expected any, inet or inet6)", value)
+	}
+}
+
+// resolves the addresses of the server in network ("ip", "ip4" or "ip6"), interleaving the IPv6 and
+// IPv4 addresses as RFC 8305 does, starting with the family of the preferred address
+func resolveServerAddresses(ctx context.Context, hostname string, port int, network string) ([]*net.UDPAddr, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, strings.Trim(hostname, "[]"))
+	if err != nil {
+		return nil, err
+	}
+	var preferred, other []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for i := 0; i < len(preferred) || i < len(other); i++ {
+		if i < len(preferred) {
+			addrs = append(addrs, &net.UDPAddr{IP: preferred[i], Port: port})
+		}
+		if i < len(other) {
+			addrs = append(addrs, &net.UDPAddr{IP: other[i], Port: port})
+		}
+	}
+	return addrs, nil
+}
+
+// returns true if the dial failed without reaching the server, e.g. on a broken IPv6 path, so that
+// the next address is worth trying. Any answer of the server (e.g. an untrusted certificate) ends
+// the race instead.
+func isUnreachable(err error) bool {
+	var netErr net.Error
+	var opErr *net.OpError
+	return (errors.As(err, &netErr) && netErr.Timeout()) || errors.As(err, &opErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type dialAttempt struct {
+	addr    *net.UDPAddr
+	conn    quic.EarlyConnection
+	udpConn *net.UDPConn
+	err     error
+}
+
+// races the handshakes with the addresses of the server as in RFC 8305 (Happy Eyeballs): the next
+// address is tried when the previous attempt fails or after connectionAttemptDelay, and the first
+// handshake that completes wins, the others being abandoned. Returns the address that answered or,
+// if none did, the one of the first failure.
+func dialHappyEyeballs(ctx context.Context, addrs []*net.UDPAddr, dial dialFunc) (quic.EarlyConnection, *net.UDPConn, *net.UDPAddr, error) {
+	if len(addrs) == 1 {
+		conn, udpConn, err := dial(ctx, addrs[0])
+		return conn, udpConn, addrs[0], err
+	}
+	attemptsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialAttempt, len(addrs))
+	next := 0
+	var nextAttempt <-chan time.Time
+	startAttempt := func() {
+		addr := addrs[next]
+		next++
+		log.Debug().Msgf("starting the QUIC handshake with %s", addr)
+		go func() {
+			conn, udpConn, err := dial(attemptsCtx, addr)
+			results <- dialAttempt{addr: addr, conn: conn, udpConn: udpConn, err: err}
+		}()
+		nextAttempt = nil
+		if next < len(addrs) {
+			nextAttempt = time.After(connectionAttemptDelay)
+		}
+	}
+
+	startAttempt()
+	running := 1
+	var firstFailure *dialAttempt
+	for running > 0 {
+		select {
+		case <-nextAttempt:
+			startAttempt()
+			running++
+		case attempt := <-results:
+			running--
+			if attempt.err == nil || !isUnreachable(attempt.err) {
+				cancel()
+				// close the connections of the attempts completing meanwhile
+				go func(running int) {
+					for ; running > 0; running-- {
+						if loser := <-results; loser.err == nil {
+							loser.conn.CloseWithError(0, "")
+						}
+					}
+				}(running)
+				return attempt.conn, attempt.udpConn, attempt.addr, attempt.err
+			}
+			log.Debug().Msgf("could not reach %s: %s", attempt.addr, attempt.err)
+			if firstFailure == nil {
+				firstFailure = &attempt
+			}
+			if next < len(addrs) {
+				startAttempt()
+				running++
+			}
+		}
+	}
+	return nil, nil, firstFailure.addr, firstFailure.err
+}
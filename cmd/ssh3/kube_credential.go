@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/francoismichel/ssh3/auth"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// the cached tokens expiring sooner are renewed, so that kubectl does not send an expired token
+const kubeTokenMinValidity = time.Minute
+
+const defaultExecCredentialAPIVersion = "client.authentication.k8s.io/v1"
+
+// the ExecCredential objects exchanged with kubectl, see
+// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#client-go-credential-plugins
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp"`
+}
+
+// the API version of the ExecCredential requested by kubectl in KUBERNETES_EXEC_INFO
+func execCredentialAPIVersion() string {
+	var info execCredential
+	if err := json.Unmarshal([]byte(os.Getenv("KUBERNETES_EXEC_INFO")), &info); err != nil || info.APIVersion == "" {
+		return defaultExecCredentialAPIVersion
+	}
+	return info.APIVersion
+}
+
+// the file caching the ID token of the issuer and client, only readable by the user
+func kubeTokenCachePath(ssh3Dir string, config *auth.OIDCConfig) string {
+	key := sha256.Sum256([]byte(config.IssuerUrl + "\x00" + config.ClientID))
+	return path.Join(ssh3Dir, "kube_tokens", hex.EncodeToString(key[:16]))
+}
+
+// returns the cached token and its expiry if it is still valid for a while
+func cachedKubeToken(ctx context.Context, cachePath string, config *auth.OIDCConfig) (string, time.Time, bool) {
+	rawToken, err := os.ReadFile(cachePath)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	idToken, err := auth.VerifyRawToken(ctx, config.ClientID, config.IssuerUrl, string(rawToken))
+	if err != nil {
+		log.Debug().Msgf("discarding the cached token %s: %s", cachePath, err)
+		return "", time.Time{}, false
+	}
+	if time.Until(idToken.Expiry) < kubeTokenMinValidity {
+		return "", time.Time{}, false
+	}
+	return string(rawToken), idToken.Expiry, true
+}
+
+// ssh3 kube-credential is a kubectl credential plugin writing an ExecCredential carrying the ID
+// token of the OpenID Connect issuer on stdout, so that the clusters trusting the issuer accept
+// the same login as the SSH3 servers
+func runKubeCredential(args []string) int {
+	flags := flag.NewFlagSet("ssh3 kube-credential", flag.ContinueOnError)
+	issuerURL := flags.String("issuer", "", "the issuer URL of the OpenID Connect provider, as listed in the OpenID Connect config file")
+	oidcConfigFileName := flags.String("oidc-config", "", "the OpenID Connect config file, ~/.ssh3/oidc_config.json by default")
+	doPKCE := flags.Bool("do-pkce", false, "if set perform PKCE challenge-response with oidc")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *issuerURL == "" {
+		fmt.Fprintf(os.Stderr, "ssh3 kube-credential requires -issuer\n")
+		flags.Usage()
+		return -1
+	}
+	ssh3Dir := path.Join(homedir(), ".ssh3")
+	if *oidcConfigFileName == "" {
+		*oidcConfigFileName = path.Join(ssh3Dir, "oidc_config.json")
+	}
+	data, err := os.ReadFile(*oidcConfigFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read the OpenID Connect config: %s\n", err)
+		return -1
+	}
+	var issuers auth.OIDCIssuerConfig
+	if err := json.Unmarshal(data, &issuers); err != nil {
+		fmt.Fprintf(os.Stderr, "could not parse the OpenID Connect config %s: %s\n", *oidcConfigFileName, err)
+		return -1
+	}
+	var config *auth.OIDCConfig
+	for _, issuerConfig := range issuers {
+		if issuerConfig.IssuerUrl == *issuerURL {
+			config = issuerConfig
+		}
+	}
+	if config == nil {
+		fmt.Fprintf(os.Stderr, "no issuer %s in the OpenID Connect config %s\n", *issuerURL, *oidcConfigFileName)
+		return -1
+	}
+
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	util.ConfigureLogger(os.Getenv("SSH3_LOG_LEVEL"))
+
+	ctx := context.Background()
+	cachePath := kubeTokenCachePath(ssh3Dir, config)
+	token, expiry, ok := cachedKubeToken(ctx, cachePath, config)
+	if !ok {
+		// kubectl only forwards stderr to the user, stdout carrying the credential
+		fmt.Fprintf(os.Stderr, "logging in to %s in the browser\n", config.IssuerUrl)
+		token, err = auth.Connect(ctx, config, config.IssuerUrl, *doPKCE, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not get token: %s\n", err)
+			return -1
+		}
+		idToken, err := auth.VerifyRawToken(ctx, config.ClientID, config.IssuerUrl, token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid token: %s\n", err)
+			return -1
+		}
+		expiry = idToken.Expiry
+		if err := os.MkdirAll(path.Dir(cachePath), 0700); err != nil {
+			log.Warn().Msgf("could not create the token cache directory: %s", err)
+		} else if err := util.WriteFileAtomic(cachePath, []byte(token), 0600); err != nil {
+			log.Warn().Msgf("could not cache the token: %s", err)
+		}
+	}
+	credential := execCredential{
+		APIVersion: execCredentialAPIVersion(),
+		Kind:       "ExecCredential",
+		Status: &execCredentialStatus{
+			Token:               token,
+			ExpirationTimestamp: expiry.UTC().Format(time.RFC3339),
+		},
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(credential); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the credential: %s\n", err)
+		return -1
+	}
+	return 0
+}
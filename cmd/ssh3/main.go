@@ -9,6 +9,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -18,10 +19,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	osuser "os/user"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -38,10 +41,26 @@ import (
 	"github.com/kevinburke/ssh_config"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/francoismichel/ssh3/cmd/ssh3")
+
+// the time allowed to the lookup of the HTTPS records of the server, the connection then using the
+// default port
+const serviceDiscoveryTimeout = 2 * time.Second
+
+// the time given to the disconnect message of the server to arrive once the session channel ended
+const disconnectMessageDelay = 200 * time.Millisecond
+
+// the time given to the server to reply to the requests setting up the session
+const requestReplyTimeout = 30 * time.Second
+
 func homedir() string {
 	user, err := osuser.Current()
 	if err == nil {
@@ -129,6 +148,29 @@ func forwardAgent(parent context.Context, channel ssh3.Channel) error {
 	}
 }
 
+// sends a request setting up the session and waits for the reply of the server, so that a
+// refused request is reported rather than ending the session silently. The older servers do not
+// reply, the request being then assumed to succeed.
+func sendSessionRequest(ctx context.Context, conv *ssh3.Conversation, channel ssh3.Channel, request ssh3Messages.ChannelRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, requestReplyTimeout)
+	defer cancel()
+	err := ssh3.SendRequestWaitReply(ctx, channel, conv.PeerExtInfo(), &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: request})
+	if isUnsupportedFeature(err) {
+		return nil
+	}
+	return err
+}
+
+// prints why the server ended or refused the conversation, e.g. "too many authentication failures"
+func printDisconnect(disconnect ssh3.Disconnect) {
+	fmt.Fprintf(os.Stderr, "Disconnected by the server (%s): %s\n", disconnect.Reason(), disconnect.Description)
+}
+
+func isUnsupportedFeature(err error) bool {
+	_, ok := ssh3.AsUnsupportedFeature(err)
+	return ok
+}
+
 func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net.TCPConn) {
 	go func() {
 		defer conn.CloseWrite()
@@ -141,6 +183,13 @@ func forwardTCPInBackground(ctx context.Context, channel ssh3.Channel, conn *net
 			genericMessage, err := channel.NextMessage()
 			if err == io.EOF {
 				log.Info().Msgf("eof on tcp-forwarding channel %d", channel.ChannelID())
+			} else if unsupported, ok := ssh3.AsUnsupportedFeature(err); ok {
+				fmt.Fprintf(os.Stderr, "server: %s\n", unsupported)
+				return
+			} else if failure, ok := ssh3.AsChannelOpenFailure(err); ok {
+				// e.g. denied by the policy of the server, or the server could not connect
+				fmt.Fprintf(os.Stderr, "server: could not forward the connection of %s (%s): %s\n", conn.RemoteAddr(), failure.Reason(), failure.ErrorMsg)
+				return
 			} else if err != nil {
 				log.Error().Msgf("could get message from tcp forwarding channel: %s", err)
 				return
@@ -228,25 +277,185 @@ func parseAddrPort(addrPort string) (localPort int, remoteIP net.IP, remotePort
 	return localPort, remoteIP, remotePort, err
 }
 
+// splits a user@host[:port][/path]:/dir destination, similar to the scp ones, into the URL
+// and the absolute remote working directory
+func splitRemoteWorkingDirectory(destination string) (string, string) {
+	// the colon before a port is followed by a digit and the colons of IPv6 addresses are in brackets
+	url, dir, found := strings.Cut(destination, ":/")
+	if !found {
+		return destination, ""
+	}
+	return url, "/" + dir
+}
+
 func mainWithStatusCode() int {
+	if len(os.Args) > 1 && os.Args[1] == "preauth" {
+		return runPreauth(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "kube-credential" {
+		return runKubeCredential(os.Args[2:])
+	}
+
 	// verbose := flag.Bool("v", false, "verbose")
 	// quiet := flag.Bool("q", false, "don't print the data")
 	keyLogFile := flag.String("keylog", "", "Write QUIC TLS keys and master secret in the specified keylog file: only for debugging purpose")
 	privKeyFile := flag.String("privkey", "", "private key file")
 	pubkeyForAgent := flag.String("pubkey-for-agent", "", "if set, use an agent key whose public key matches the one in the specified path")
 	passwordAuthentication := flag.Bool("use-password", false, "if set, do classical password authentication")
+	breakGlassAuthentication := flag.Bool("use-break-glass", false, "if set, authenticate using a one-time token issued on the break-glass socket of the server, "+
+		"read from the SSH3_BREAK_GLASS_TOKEN environment variable or prompted")
+	preauthFile := flag.String("use-preauth", "", "if set, authenticate using the pre-authorization token stored in the specified file (see ssh3 preauth)")
+	bearerTokenFile := flag.String("use-bearer-token", "", "if set, authenticate using the bearer token stored in the specified file, e.g. an OAuth2 access token "+
+		"or a base64-encoded SAML assertion validated by the server")
+	clientCertFile := flag.String("client-cert", "", "if set, present the X.509 certificate of the specified PEM file during the TLS handshake and authenticate using it, "+
+		"the server mapping it onto the local users (e.g. for machine-to-machine use)")
+	clientKeyFile := flag.String("client-key", "", "the PEM file of the private key of -client-cert, the -client-cert file itself if not set")
 	insecure := flag.Bool("insecure", false, "if set, skip server certificate verification")
+	revocationCheck := flag.String("revocation-check", string(ssh3.RevocationCheckOff), "whether the OCSP responders of the server certificates verified by a CA are queried when no valid OCSP response is stapled: "+
+		"\"off\", \"soft-fail\" (the certificates whose status cannot be determined are accepted) or \"hard-fail\" (they are refused)")
+	postQuantumKeyExchange := flag.String("post-quantum-kex", string(ssh3.PostQuantumOff), "whether the TLS handshake uses the hybrid post-quantum key exchange (X25519MLKEM768), protecting the recorded sessions from future quantum computers: "+
+		"\"off\", \"prefer\" (falling back to a classical key exchange with the servers not supporting it) or \"require\"")
+	knockSecretFile := flag.String("knock-secret-file", "", "if set, prove to a hidden server that the client knows its knock secret, stored in the specified file, "+
+		"so that it answers the request instead of pretending that there is no SSH3 server")
+	crlFiles := flag.String("crl", "", "if set, refuse the server certificates revoked by the comma-separated list of CRL files (in PEM or DER)")
 	issuerUrl := flag.String("use-oidc", "", "if set, force the use of OpenID Connect with the specified issuer url as parameter (it opens a browser window)")
 	oidcConfigFileName := flag.String("oidc-config", "", "OpenID Connect json config file containing the \"client_id\" and \"client_secret\" fields needed for most identity providers")
 	verbose := flag.Bool("v", false, "if set, enable verbose mode")
+	batchMode := flag.Bool("batch-mode", false, "if set, fail instead of prompting for a password, passphrase or token, or for trusting an unknown server certificate, e.g. in scripts (also set by BatchMode in ~/.ssh/config)")
+	quiet := flag.Bool("quiet", false, "if set, do not display the progress of the connection establishment on the terminal nor the banner of the server")
 	doPKCE := flag.Bool("do-pkce", false, "if set perform PKCE challenge-response with oidc")
 	forwardSSHAgent := flag.Bool("forward-agent", false, "if set, forwards ssh agent to be used with sshv2 connections on the remote host")
 	forwardUDP := flag.String("forward-udp", "", "if set, take a localport/remoteip@remoteport forwarding localhost@localport towards remoteip@remoteport")
+	requestSubsystem := flag.Bool("s", false, "if set, request the invocation of the subsystem given as command (e.g. \"rpc\") on the remote host")
+	forcePty := flag.Bool("t", false, "if set, request a pty for the remote command too, e.g. to run a full-screen program, as long as stdin is a terminal (also set by RequestTTY in ~/.ssh/config)")
+	forcePtyWithoutTerminal := flag.Bool("tt", false, "if set, request a pty even if stdin is not a terminal")
+	loginName := flag.String("l", "", "if set, the user to log in as on the remote host when the destination has no user@ (e.g. passed by rsync)")
+	disablePty := flag.Bool("T", false, "if set, never request a pty, the remote shell or command then reading and writing pipes")
+	execArgv := flag.Bool("exec-argv", false, "if set, run the command on the remote host without a shell, its first argument being the program and each following argument being passed as is, without quoting (e.g. from scripts passing file names)")
+	reattach := flag.String("reattach", "", "if set, continue the pty session with the specified ID that the server kept detached from a previous connection (see SSH3_SESSION_ID), or list these sessions if set to \"list\"")
 	forwardTCP := flag.String("forward-tcp", "", "if set, take a localport/remoteip@remoteport forwarding localhost@localport towards remoteip@remoteport")
-	// enableQlog := flag.Bool("qlog", false, "output a qlog (in the same directory)")
+	controlPath := flag.String("control-path", "", "if set, serve a control socket at the specified path, allowing to query the running client with -O")
+	controlCommand := flag.String("O", "", "send the specified control command (\"stats\" or \"exit\") to the client listening on -control-path and exit")
+	serverControlMode := flag.Bool("server-control", false, "if set, keep the connection open without running a session and run the commands and file copies submitted on the control socket of -control-path, "+
+		"each in a session of its own, until -O exit (e.g. for configuration management tools)")
+	stallTimeout := flag.Duration("stall-timeout", 3*time.Second, "in interactive sessions, report a stalled connection if nothing comes back from the server within this duration after typing (0 disables it)")
+	onStall := flag.String("on-stall", stallActionWarn, "the action when the connection stalls: \"warn\" displays a status line, \"exit\" also closes the connection (e.g. to reconnect from a wrapper script)")
+	qlogDir := flag.String("qlog-dir", "", "if set, write a qlog trace of the QUIC connection in the specified directory: only for debugging purpose")
+	simulateNetwork := flag.String("simulate-network", "", "if set, delay and drop the packets of the QUIC connection according to the specified comma-separated conditions (e.g. \"latency=100ms,jitter=20ms,loss=1%,bandwidth=2mbit,seed=42\"): only for developing and demoing the terminal features on a slow network")
+	quicTransport := flag.String("quic-transport", "", "if set, tune the QUIC connection with the specified comma-separated parameters among initial-stream-window, max-stream-window, initial-connection-window, max-connection-window, max-idle-timeout, max-incoming-streams and udp-receive-buffer (e.g. \"max-stream-window=32MiB,max-connection-window=64MiB,udp-receive-buffer=8MiB\"), e.g. to fill high bandwidth-delay product paths")
+	limitRate := flag.String("limit-rate", "", "if set, limit the data of the channels to the specified rate in bytes per second in each direction (e.g. \"2MiB\"), e.g. so that a backup does not saturate the uplink")
+	forceIPv4 := flag.Bool("4", false, "if set, only connect to the IPv4 addresses of the server")
+	forceIPv6 := flag.Bool("6", false, "if set, only connect to the IPv6 addresses of the server")
+	proxyFlag := flag.String("proxy", "", "if set, connect through the specified proxy: the URI template of an HTTP/3 MASQUE proxy relaying the QUIC connection (e.g. \"https://proxy.example.org/.well-known/masque/udp/{target_host}/{target_port}/\"), or the URL of an HTTP proxy through which the connection is tunneled over HTTP/2 (e.g. \"http://proxy.example.org:3128\"). If not set, the HTTPS_PROXY and NO_PROXY environment variables give the proxy of the TCP fallback")
+	tcpFallback := flag.String("tcp-fallback", tcpFallbackAuto, "tunnel the QUIC connection over HTTP/2 on TCP port 443 (or the port of the server): \"auto\" does it if the server cannot be reached over UDP, e.g. on networks blocking UDP, \"always\" always does it and \"never\" never does it. The server must enable tcp_fallback in its configuration")
+	ipQoSFlag := flag.String("ipqos", "", "if set, mark the packets of the connection with the specified traffic class for the interactive sessions, optionally followed by the one of the other sessions "+
+		"(e.g. \"af21 cs1\"), as the IPQoS option of OpenSSH that is used if not set")
+	compressionFlag := flag.String("compression", "", "if set, request the compression of the data in both directions with the specified algorithm (only \"deflate\" is supported), optionally followed by comma-separated parameters among level (1 to 9) and threshold, the size below which the data is sent uncompressed (e.g. \"deflate,level=1,threshold=1KiB\"), e.g. on low-bandwidth links. The server must allow it in its configuration")
+	qlogSSH3Messages := flag.Bool("qlog-ssh3-messages", false, "if set along with -qlog-dir, also trace the decrypted SSH3 messages (including e.g. the typed passwords) in the qlog directory")
+	datagramTyping := flag.Bool("datagram-typing", false, "in interactive sessions, send the keystrokes in QUIC datagrams and display their echo before the server sends it, similarly to mosh, reducing the perceived latency on lossy links")
+	escapeCharFlag := flag.String("e", string(defaultEscapeChar), "the escape character of interactive sessions (\"none\" disables the escape sequences), type it followed by ? at the start of a line to list the sequences")
+	onPasswordPrompt := flag.String("on-password-prompt", passwordPromptWait, "the action when a remote command run without a terminal prompts for a password: \"wait\" lets it wait for the standard input, \"fail\" exits with an error, \"pty\" allocates a pty for the commands invoking sudo, su or doas so that they prompt on the local terminal")
+	remoteDir := flag.String("remote-dir", "", "if set, start the remote shell or command in the specified directory, relative to the remote home if not absolute (also set by a user@host:/path destination or RemoteWorkingDirectory in ~/.ssh/config)")
+	printVersionFlag := flag.Bool("V", false, "print the version and exit")
+	printFeatures := flag.Bool("features", false, "along with -V, print a JSON report of the compiled-in features, supported protocol versions and build provenance")
+	var options optionsFlag
+	flag.Var(&options, "o", "set an option in the Key=Value format of ~/.ssh/config, can be repeated. Only OutputFilter is supported: it passes the output through a local filter, \"timestamp\" (or \"timestamp=<Go time layout>\") prefixing each line with the time it was received, \"strip-ansi\" removing the ANSI escape sequences or \"highlight=<regexp>\" displaying the matches in bold red")
 	flag.Parse()
 	args := flag.Args()
 
+	if *printVersionFlag {
+		return printVersion(*printFeatures)
+	}
+
+	if *controlCommand != "" {
+		return runControlCommand(*controlPath, *controlCommand)
+	}
+
+	if *escapeCharFlag != "none" && len(*escapeCharFlag) != 1 {
+		fmt.Fprintf(os.Stderr, "invalid escape character %q: expected a single character or \"none\"\n", *escapeCharFlag)
+		return -1
+	}
+
+	if *onPasswordPrompt != passwordPromptWait && *onPasswordPrompt != passwordPromptFail && *onPasswordPrompt != passwordPromptPty {
+		fmt.Fprintf(os.Stderr, "unknown password prompt action %q (expected %q, %q or %q)\n", *onPasswordPrompt, passwordPromptWait, passwordPromptFail, passwordPromptPty)
+		return -1
+	}
+
+	var networkConditions *ssh3.NetworkConditions
+	if *simulateNetwork != "" {
+		conditions, err := ssh3.ParseNetworkConditions(*simulateNetwork)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return -1
+		}
+		networkConditions = &conditions
+	}
+
+	var transport ssh3.TransportConfig
+	if *quicTransport != "" {
+		var err error
+		transport, err = ssh3.ParseTransportConfig(*quicTransport)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return -1
+		}
+	}
+
+	var compression ssh3.CompressionConfig
+	if *compressionFlag != "" {
+		var err error
+		compression, err = ssh3.ParseCompressionConfig(*compressionFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return -1
+		}
+	}
+
+	var bandwidthLimiter *ssh3.BandwidthLimiter
+	if *limitRate != "" {
+		rate, err := ssh3.ParseBandwidthRate(*limitRate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -limit-rate: %s\n", err)
+			return -1
+		}
+		bandwidthLimiter = ssh3.NewBandwidthLimiter(rate, rate)
+	}
+
+	if *forceIPv4 && *forceIPv6 {
+		fmt.Fprintf(os.Stderr, "-4 and -6 cannot be used together\n")
+		return -1
+	}
+	if err := validateTCPFallback(*tcpFallback); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return -1
+	}
+	proxy, err := parseProxy(*proxyFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return -1
+	}
+	if proxy.connectUDPTemplate != "" && *tcpFallback == tcpFallbackAlways {
+		fmt.Fprintf(os.Stderr, "-tcp-fallback always cannot be used along with a MASQUE proxy\n")
+		return -1
+	}
+	if proxy.requiresTunnel {
+		if *tcpFallback == tcpFallbackNever {
+			fmt.Fprintf(os.Stderr, "-tcp-fallback never cannot be used along with an HTTP proxy, which only tunnels the connection over HTTP/2\n")
+			return -1
+		}
+		*tcpFallback = tcpFallbackAlways
+	}
+
+	var ipQoS *ssh3.IPQoS
+	if *ipQoSFlag != "" {
+		value, err := ssh3.ParseIPQoS(*ipQoSFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -ipqos: %s\n", err)
+			return -1
+		}
+		ipQoS = &value
+	}
+
 	useOIDC := *issuerUrl != ""
 
 	ssh3Dir := path.Join(homedir(), ".ssh3")
@@ -259,8 +468,15 @@ func mainWithStatusCode() int {
 		util.ConfigureLogger(os.Getenv("SSH3_LOG_LEVEL"))
 	}
 
+	shutdownTracing, err := util.ConfigureTracing(context.Background(), "ssh3", os.Getenv("SSH3_TRACES_FILE"))
+	if err != nil {
+		log.Error().Msgf("could not configure tracing: %s", err)
+		return -1
+	}
+	defer shutdownTracing(context.Background())
+
 	knownHostsPath := path.Join(ssh3Dir, "known_hosts")
-	knownHosts, skippedLines, err := ssh3.ParseKnownHosts(knownHostsPath)
+	knownHosts, skippedLines, err := ssh3.LoadKnownHosts(knownHostsPath)
 	if len(skippedLines) != 0 {
 		stringSkippedLines := []string{}
 		for _, lineNumber := range skippedLines {
@@ -278,60 +494,60 @@ func mainWithStatusCode() int {
 	}
 
 	urlFromParam := args[0]
+	workingDirectory := *remoteDir
 	if !strings.HasPrefix(urlFromParam, "https://") {
+		var destinationDir string
+		urlFromParam, destinationDir = splitRemoteWorkingDirectory(urlFromParam)
+		if destinationDir != "" {
+			workingDirectory = destinationDir
+		}
 		urlFromParam = fmt.Sprintf("https://%s", urlFromParam)
 	}
 	command := args[1:]
+	if *requestSubsystem && len(command) != 1 {
+		fmt.Fprintf(os.Stderr, "-s expects the name of a single subsystem as command\n")
+		return -1
+	}
+	requestTTY := requestTTYAuto
+	switch {
+	case *disablePty && (*forcePty || *forcePtyWithoutTerminal):
+		fmt.Fprintf(os.Stderr, "-T cannot be used with -t or -tt\n")
+		return -1
+	case *disablePty:
+		requestTTY = requestTTYNo
+	case *forcePtyWithoutTerminal:
+		requestTTY = requestTTYForce
+	case *forcePty:
+		requestTTY = requestTTYYes
+	}
+	if *execArgv && (*requestSubsystem || len(command) == 0) {
+		fmt.Fprintf(os.Stderr, "-exec-argv expects a command and cannot be used with -s\n")
+		return -1
+	}
+	if *reattach != "" && len(command) != 0 {
+		fmt.Fprintf(os.Stderr, "-reattach cannot be used with a command\n")
+		return -1
+	}
+	if *serverControlMode && (*controlPath == "" || len(command) != 0 || *reattach != "") {
+		fmt.Fprintf(os.Stderr, "-server-control requires -control-path and cannot be used with a command or -reattach\n")
+		return -1
+	}
+	// the session to reattach to already has its pty
+	reattachSession := *reattach != "" && *reattach != "list"
 
-	var localUDPAddr *net.UDPAddr = nil
-	var remoteUDPAddr *net.UDPAddr = nil
-	var localTCPAddr *net.TCPAddr = nil
-	var remoteTCPAddr *net.TCPAddr = nil
+	var localUDPAddr, remoteUDPAddr net.Addr
+	var localTCPAddr, remoteTCPAddr net.Addr
 	if *forwardUDP != "" {
-		localPort, remoteIP, remotePort, err := parseAddrPort(*forwardUDP)
+		localUDPAddr, remoteUDPAddr, err = parseForwarding("udp", *forwardUDP)
 		if err != nil {
 			log.Error().Msgf("UDP forwarding parsing error %s", err)
-		}
-		remoteUDPAddr = &net.UDPAddr{
-			IP:   remoteIP,
-			Port: remotePort,
-		}
-		if remoteIP.To4() != nil {
-			localUDPAddr = &net.UDPAddr{
-				IP:   net.IPv4(127, 0, 0, 1),
-				Port: localPort,
-			}
-		} else if remoteIP.To16() != nil {
-			localUDPAddr = &net.UDPAddr{
-				IP:   net.IPv6loopback,
-				Port: localPort,
-			}
-		} else {
-			log.Error().Msgf("Unrecognized IP length %d", len(remoteIP))
 			return -1
 		}
 	}
 	if *forwardTCP != "" {
-		localPort, remoteIP, remotePort, err := parseAddrPort(*forwardTCP)
+		localTCPAddr, remoteTCPAddr, err = parseForwarding("tcp", *forwardTCP)
 		if err != nil {
-			log.Error().Msgf("UDP forwarding parsing error %s", err)
-		}
-		remoteTCPAddr = &net.TCPAddr{
-			IP:   remoteIP,
-			Port: remotePort,
-		}
-		if remoteIP.To4() != nil {
-			localTCPAddr = &net.TCPAddr{
-				IP:   net.IPv4(127, 0, 0, 1),
-				Port: localPort,
-			}
-		} else if remoteIP.To16() != nil {
-			localTCPAddr = &net.TCPAddr{
-				IP:   net.IPv6loopback,
-				Port: localPort,
-			}
-		} else {
-			log.Error().Msgf("Unrecognized IP length %d", len(remoteIP))
+			log.Error().Msgf("TCP forwarding parsing error %s", err)
 			return -1
 		}
 	}
@@ -410,9 +626,116 @@ func mainWithStatusCode() int {
 		hostname = urlHostname
 	}
 
+	// as in OpenSSH, the Host blocks are matched again using the canonical name, the values
+	// obtained first taking precedence
+	configHost := urlHostname
+	canonicalization, err := ssh3.GetCanonicalizationForHost(urlHostname, sshConfig)
+	if err != nil {
+		log.Error().Msgf("could not get the hostname canonicalization for %s: %s", urlHostname, err)
+		return -1
+	}
+	canonicalHostname, err := canonicalization.Canonicalize(context.Background(), net.DefaultResolver, hostname)
+	if err != nil {
+		log.Error().Msgf("could not canonicalize %s: %s", hostname, err)
+		return -1
+	}
+	if canonicalHostname != hostname {
+		log.Debug().Msgf("canonicalized %s to %s", hostname, canonicalHostname)
+		hostname, configHost = canonicalHostname, canonicalHostname
+		canonicalConfigHostname, canonicalPort, canonicalUser, canonicalAuthMethods, err := ssh3.GetConfigForHost(canonicalHostname, sshConfig)
+		if err != nil {
+			log.Error().Msgf("could not get config for %s: %s", canonicalHostname, err)
+			return -1
+		}
+		if configHostname == "" && canonicalConfigHostname != "" {
+			hostname = canonicalConfigHostname
+		}
+		if configPort == -1 {
+			configPort = canonicalPort
+		}
+		if configUser == "" {
+			configUser = canonicalUser
+		}
+		configAuthMethods = appendNewAuthMethods(configAuthMethods, canonicalAuthMethods)
+	}
+
+	if workingDirectory == "" && sshConfig != nil {
+		// not an OpenSSH option, it can be hidden from OpenSSH using IgnoreUnknown
+		workingDirectory, err = sshConfig.Get(configHost, "RemoteWorkingDirectory")
+		if err != nil {
+			log.Warn().Msgf("could not get RemoteWorkingDirectory from config: %s", err)
+		}
+	}
+
+	if parsedUrl.Path == "" && sshConfig != nil {
+		// not an OpenSSH option either, for the tools passing a bare hostname to the client, such
+		// as rsync whose remote paths cannot contain a slash before the colon
+		urlPath, err := sshConfig.Get(configHost, "URLPath")
+		if err != nil {
+			log.Warn().Msgf("could not get URLPath from config: %s", err)
+		} else if urlPath != "" {
+			parsedUrl.Path = "/" + strings.TrimPrefix(urlPath, "/")
+		}
+	}
+
+	// the network of the server addresses, as the AddressFamily option of OpenSSH
+	addressNetwork := "ip"
+	if *forceIPv4 {
+		addressNetwork = "ip4"
+	} else if *forceIPv6 {
+		addressNetwork = "ip6"
+	} else if sshConfig != nil {
+		if value, _ := sshConfig.Get(configHost, "AddressFamily"); value != "" {
+			if addressNetwork, err = parseAddressFamily(value); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return -1
+			}
+		}
+	}
+
+	if ipQoS == nil && sshConfig != nil {
+		if value, _ := sshConfig.Get(configHost, "IPQoS"); value != "" {
+			parsed, err := ssh3.ParseIPQoS(value)
+			if err != nil {
+				log.Warn().Msgf("ignoring IPQoS from config: %s", err)
+			} else {
+				ipQoS = &parsed
+			}
+		}
+	}
+
+	if requestTTY == requestTTYAuto && sshConfig != nil {
+		if value, _ := sshConfig.Get(configHost, "RequestTTY"); value != "" {
+			if requestTTY, err = parseRequestTTY(value); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return -1
+			}
+		}
+	}
+
+	if !*batchMode && sshConfig != nil {
+		value, _ := sshConfig.Get(configHost, "BatchMode")
+		*batchMode = strings.EqualFold(strings.TrimSpace(value), "yes")
+	}
+
+	outputFilters := options.values(outputFilterOption)
+	if len(outputFilters) == 0 && sshConfig != nil {
+		// not an OpenSSH option either
+		outputFilters, err = sshConfig.GetAll(configHost, outputFilterOption)
+		if err != nil {
+			log.Warn().Msgf("could not get %s from config: %s", outputFilterOption, err)
+		}
+	}
+	stdout, stderr, err := filteredOutput(outputFilters)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return -1
+	}
+
 	hostnameIsAnIP := net.ParseIP(hostname) != nil
 
 	var port int
+	portSpecified := true
 	if urlPort != "" {
 		if parsedPort, err := strconv.Atoi(urlPort); err == nil && parsedPort < 0xffff {
 			// There is a port in the CLI and the port is valid. Use the CLI port.
@@ -431,9 +754,36 @@ func mainWithStatusCode() int {
 	} else {
 		// There is no port specified, neither in the CLI, nor in the configuration.
 		port = 443
+		portSpecified = false
+	}
+
+	// the port and the URL path that are not specified are discovered using the HTTPS record of the
+	// server, whose endpoint is then dialed
+	dialHostname := hostname
+	var echConfigList []byte
+	if !hostnameIsAnIP && (!portSpecified || parsedUrl.Path == "") {
+		discoveryCtx, cancelDiscovery := context.WithTimeout(context.Background(), serviceDiscoveryTimeout)
+		endpoints, err := ssh3.LookupServiceEndpoints(discoveryCtx, hostname)
+		cancelDiscovery()
+		if err != nil {
+			log.Debug().Msgf("could not look up the HTTPS records of %s: %s", hostname, err)
+		} else if endpoint, ok := ssh3.SelectServiceEndpoint(endpoints, http3.NextProtoH3); ok {
+			log.Debug().Msgf("discovered the endpoint %s (port %d, URL path %q) of %s", endpoint.Target, endpoint.Port, endpoint.URLPath, hostname)
+			if !portSpecified && endpoint.Port != 0 {
+				port = int(endpoint.Port)
+			}
+			if parsedUrl.Path == "" && endpoint.URLPath != "" {
+				parsedUrl.Path = "/" + strings.TrimPrefix(endpoint.URLPath, "/")
+			}
+			dialHostname = endpoint.Target
+			echConfigList = endpoint.ECHConfigList
+		}
 	}
 
 	username := parsedUrl.User.Username()
+	if username == "" {
+		username = *loginName
+	}
 	if username == "" {
 		username = parsedUrl.Query().Get("user")
 	}
@@ -469,23 +819,56 @@ func mainWithStatusCode() int {
 		KeyLogWriter:       keyLog,
 		NextProtos:         []string{http3.NextProtoH3},
 	}
+	if len(echConfigList) != 0 && !setECHConfigList(tlsConf, echConfigList) {
+		log.Debug().Msgf("ignoring the ECH configs of %s, not supported by this build", hostname)
+	}
+
+	keyExchange, err := ssh3.ParsePostQuantumKeyExchange(*postQuantumKeyExchange)
+	if err == nil {
+		err = keyExchange.ApplyTo(tlsConf)
+	}
+	if err != nil {
+		log.Error().Msgf("%s", err)
+		return -1
+	}
 
-	if certs, ok := knownHosts[hostname]; ok {
-		foundSelfsignedSSH3 := false
+	if *clientCertFile != "" {
+		keyFile := *clientKeyFile
+		if keyFile == "" {
+			keyFile = *clientCertFile
+		}
+		clientCertificate, err := tls.LoadX509KeyPair(*clientCertFile, keyFile)
+		if err != nil {
+			log.Error().Msgf("could not load the client certificate: %s", err)
+			return -1
+		}
+		tlsConf.Certificates = []tls.Certificate{clientCertificate}
+	}
 
-		for _, cert := range certs {
-			pool.AddCert(cert)
-			if cert.VerifyHostname("selfsigned.ssh3") == nil {
-				foundSelfsignedSSH3 = true
+	if knownHosts != nil {
+		revocationPolicy, err := ssh3.ParseRevocationPolicy(*revocationCheck)
+		if err != nil {
+			log.Error().Msgf("%s", err)
+			return -1
+		}
+		var crls []*x509.RevocationList
+		if *crlFiles != "" {
+			if crls, err = ssh3.LoadCRLFiles(strings.Split(*crlFiles, ",")); err != nil {
+				log.Error().Msgf("could not load the CRLs: %s", err)
+				return -1
 			}
 		}
+		// the stapled OCSP responses are always checked
+		knownHosts.SetRevocationChecker(&ssh3.RevocationChecker{Policy: revocationPolicy, CRLs: crls})
+		// accepts the pinned keys of the host, e.g. self-signed certificates, and refuses the revoked ones
+		knownHosts.ConfigureTLS(hostname, tlsConf)
+	}
 
-		// If no IP SAN was in the cert, then assume the self-signed cert at least matches the .ssh3 TLD
-		if foundSelfsignedSSH3 {
-			// Put "ssh3" as ServerName so that the TLS verification can succeed
-			// Otherwise, TLS refuses to validate a certificate without IP SANs
-			// if the hostname is an IP address.
-			tlsConf.ServerName = "selfsigned.ssh3"
+	var knockSecret []byte
+	if *knockSecretFile != "" {
+		if knockSecret, err = ssh3.LoadKnockSecret(*knockSecretFile); err != nil {
+			log.Error().Msgf("could not load the knock secret: %s", err)
+			return -1
 		}
 	}
 
@@ -495,6 +878,16 @@ func mainWithStatusCode() int {
 	qconf.Allow0RTT = true
 	qconf.EnableDatagrams = true
 	qconf.KeepAlivePeriod = 1 * time.Second
+	transport.ApplyTo(&qconf)
+	pathMetrics := &pathMetricsTracer{}
+	qconf.Tracer = func(ctx context.Context, p logging.Perspective, odcid quic.ConnectionID) logging.ConnectionTracer {
+		if *qlogDir != "" {
+			if qlogTracer := util.QlogTracer(*qlogDir)(ctx, p, odcid); qlogTracer != nil {
+				return logging.NewMultiplexedConnectionTracer(pathMetrics, qlogTracer)
+			}
+		}
+		return pathMetrics
+	}
 
 	roundTripper := &http3.RoundTripper{
 		TLSClientConfig: tlsConf,
@@ -503,6 +896,9 @@ func mainWithStatusCode() int {
 	}
 
 	ctx, _ := context.WithCancelCause(context.Background())
+	ctx, span := tracer.Start(ctx, "ssh3.client", trace.WithAttributes(attribute.String("server.address", hostname),
+		attribute.Int("server.port", port)))
+	defer span.End()
 
 	defer roundTripper.Close()
 
@@ -528,7 +924,15 @@ func mainWithStatusCode() int {
 		}
 	}
 
-	log.Debug().Msgf("dialing QUIC host at %s", fmt.Sprintf("%s:%d", hostname, port))
+	var progressOutput io.Writer
+	if !*quiet && term.IsTerminal(int(os.Stderr.Fd())) {
+		progressOutput = os.Stderr
+	}
+	progress := newConnectionProgress(progressOutput)
+	defer progress.stop()
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: progress.statusLineWriter(os.Stderr)})
+	prompts := newPrompter(*batchMode)
+	prompts.beforePrompt = progress.pause
 
 	if hostnameIsAnIP {
 		ip := net.ParseIP(hostname)
@@ -538,42 +942,128 @@ func mainWithStatusCode() int {
 		}
 	}
 
-	qClient, err := quic.DialAddrEarly(ctx,
-		fmt.Sprintf("%s:%d", hostname, port),
-		tlsConf,
-		&qconf)
+	if tlsConf.ServerName == "" && !hostnameIsAnIP {
+		// the server name would otherwise be taken from the dialed address
+		tlsConf.ServerName = hostname
+	}
+
+	dialCtx, dialSpan := tracer.Start(ctx, "ssh3.quic_dial")
+	dialTunnel := newTunnelDialer(dialHostname, port, parsedUrl.Path, addressNetwork, proxy.tunnelProxy, &qconf)
+	var qClient quic.EarlyConnection
+	// udpConn is the socket of the connection if it was created here, to mark its packets
+	var udpConn *net.UDPConn
+	var redial redialFunc
+	if proxy.connectUDPTemplate != "" {
+		// the proxy resolves the name of the server
+		progress.stage(fmt.Sprintf("QUIC handshake with %s through the MASQUE proxy", hostname))
+		redial = newConnectUDPDialer(proxy.connectUDPTemplate, dialHostname, port, &qconf)
+		qClient, err = redial(dialCtx, tlsConf)
+	} else if *tcpFallback == tcpFallbackAlways {
+		progress.stage(fmt.Sprintf("QUIC handshake with %s over HTTP/2", hostname))
+		qClient, err = dialTunnel(dialCtx, tlsConf)
+		redial = dialTunnel
+	} else {
+		progress.stage(fmt.Sprintf("resolving %s", hostname))
+		var serverAddrs []*net.UDPAddr
+		serverAddrs, err = resolveServerAddresses(ctx, dialHostname, port, addressNetwork)
+		if err != nil {
+			dialSpan.End()
+			log.Error().Msgf("could not resolve %s: %s", hostname, err)
+			return -1
+		}
+
+		log.Debug().Msgf("dialing QUIC host at %s (%s)", fmt.Sprintf("%s:%d", hostname, port), serverAddrs)
+		if len(serverAddrs) == 1 {
+			progress.stage(fmt.Sprintf("QUIC handshake with %s", serverAddrs[0]))
+		} else {
+			progress.stage(fmt.Sprintf("QUIC handshake with %s (%d addresses)", hostname, len(serverAddrs)))
+		}
+		var dial dialFunc
+		if networkConditions != nil {
+			log.Warn().Msgf("simulating a degraded network: %s", networkConditions)
+			if ipQoS != nil {
+				log.Warn().Msgf("the packets are not marked with IPQoS when simulating a degraded network")
+			}
+			dial = func(ctx context.Context, addr *net.UDPAddr) (quic.EarlyConnection, *net.UDPConn, error) {
+				qClient, err := dialSimulatedNetwork(ctx, addr.String(), *networkConditions, transport, tlsConf, &qconf)
+				return qClient, nil, err
+			}
+		} else if transport.UDPReceiveBufferSize != 0 || ipQoS != nil {
+			if ipQoS != nil {
+				// the handshake is marked as interactive, as OpenSSH does before knowing the session
+				transport.TrafficClass = fmt.Sprintf("%d", ipQoS.Interactive)
+			}
+			dial = func(ctx context.Context, addr *net.UDPAddr) (quic.EarlyConnection, *net.UDPConn, error) {
+				return dialWithSocket(ctx, addr, transport, tlsConf, &qconf)
+			}
+		} else {
+			dial = func(ctx context.Context, addr *net.UDPAddr) (quic.EarlyConnection, *net.UDPConn, error) {
+				qClient, err := quic.DialAddrEarly(ctx, addr.String(), tlsConf, &qconf)
+				return qClient, nil, err
+			}
+		}
+		probeCtx, cancelProbe := dialCtx, context.CancelFunc(func() {})
+		if *tcpFallback == tcpFallbackAuto {
+			probeCtx, cancelProbe = context.WithTimeout(dialCtx, udpProbeTimeout)
+		}
+		var serverAddr *net.UDPAddr
+		qClient, udpConn, serverAddr, err = dialHappyEyeballs(probeCtx, serverAddrs, dial)
+		cancelProbe()
+		redial = func(ctx context.Context, tlsConf *tls.Config) (quic.EarlyConnection, error) {
+			return quic.DialAddrEarly(ctx, serverAddr.String(), tlsConf, &qconf)
+		}
+		if *tcpFallback == tcpFallbackAuto && isUnreachable(err) {
+			log.Warn().Msgf("could not reach %s over UDP (%s), falling back to HTTP/2 over TCP", hostname, err)
+			progress.stage(fmt.Sprintf("QUIC handshake with %s over HTTP/2", hostname))
+			qClient, err = dialTunnel(dialCtx, tlsConf)
+			redial = dialTunnel
+		}
+	}
+	util.SetSpanError(dialSpan, err)
+	dialSpan.End()
+	if errors.As(err, &ssh3.CertificateRevoked{}) || errors.As(err, &ssh3.UnknownRevocationStatus{}) {
+		log.Error().Msgf("refusing the certificate of the server: %s", err)
+		return -1
+	}
+	if keyExchange == ssh3.PostQuantumRequire && isHandshakeFailure(err) {
+		log.Error().Msgf("the server does not support the post-quantum key exchange required by -post-quantum-kex: %s", err)
+		return -1
+	}
+	if knownHosts != nil && knownHosts.IsKnown(hostname) && isCryptoError(err) {
+		log.Debug().Msgf("the server certificate cannot be verified using the pinned keys: %s", err)
+		udpConn = nil
+		qClient, err = dialRotatedServer(ctx, hostname, redial, tlsConf, knownHosts, knownHostsPath)
+		if err != nil {
+			log.Error().Msgf("%s", err)
+			log.Error().Msgf("Aborting.")
+			return -1
+		}
+	}
 	if err != nil {
 		if transportErr, ok := err.(*quic.TransportError); ok {
 			if transportErr.ErrorCode.IsCryptoError() {
 				log.Debug().Msgf("received QUIC crypto error on first connection attempt: %s", err)
+				progress.pause()
 				if tty == nil {
 					log.Error().Msgf("insecure server cert in non-terminal session, aborting")
 					return -1
 				}
-				if _, ok = knownHosts[hostname]; ok {
-					log.Error().Msgf("The server certificate cannot be verified using the one installed in %s. "+
-						"If you did not change the server certificate, it could be a machine-in-the-middle attack. "+
-						"TLS error: %s", knownHostsPath, err)
-					log.Error().Msgf("Aborting.")
+				if *batchMode {
+					log.Error().Msgf("insecure server cert with -batch-mode, aborting")
 					return -1
 				}
 				// bad certificates, let's mimic the OpenSSH's behaviour similar to host keys
-				tlsConf.InsecureSkipVerify = true
-				var peerCertificate *x509.Certificate
-				certError := fmt.Errorf("we don't want to start a totally insecure connection")
-				tlsConf.VerifyConnection = func(ctx tls.ConnectionState) error {
-					peerCertificate = ctx.PeerCertificates[0]
-					return certError
-				}
-
-				_, err := quic.DialAddrEarly(ctx,
-					fmt.Sprintf("%s:%d", hostname, port),
-					tlsConf,
-					&qconf)
-				if !errors.Is(err, certError) {
-					log.Error().Msgf("could not create client QUIC connection: %s", err)
+				peerCertificate, err := fetchServerCertificate(ctx, redial, tlsConf)
+				if err != nil {
+					log.Error().Msgf("%s", err)
 					return -1
 				}
+				if knownHosts != nil {
+					if err := checkRevokedServerCertificate(hostname, peerCertificate, knownHosts, knownHostsPath); err != nil {
+						log.Error().Msgf("%s", err)
+						return -1
+					}
+				}
 				// let's first check that the certificate is self-signed
 				if err := peerCertificate.CheckSignatureFrom(peerCertificate); err != nil {
 					log.Error().Msgf("the peer provided an unknown, insecure certificate, that is not self-signed: %s", err)
@@ -584,9 +1074,9 @@ func mainWithStatusCode() int {
 				_, err = tty.WriteString("Received an unknown self-signed certificate from the server.\n\r" +
 					"We recommend not using self-signed certificates.\n\r" +
 					"This session is vulnerable a machine-in-the-middle attack.\n\r" +
-					"Certificate fingerprint: " +
-					"SHA256 " + util.Sha256Fingerprint(peerCertificate.Raw) + "\n\r" +
-					"Do you want to add this certificate to ~/.ssh3/known_hosts (yes/no)? ")
+					"Public key fingerprint: " +
+					"SHA256 " + util.Sha256Fingerprint(peerCertificate.RawSubjectPublicKeyInfo) + "\n\r" +
+					"Do you want to add this key to ~/.ssh3/known_hosts (yes/no)? ")
 				if err != nil {
 					log.Error().Msgf("cound not write on /dev/tty: %s", err)
 					return -1
@@ -607,11 +1097,17 @@ func mainWithStatusCode() int {
 					log.Info().Msg("Connection aborted")
 					return 0
 				}
-				if err := ssh3.AppendKnownHost(knownHostsPath, hostname, peerCertificate); err != nil {
+				// as HashKnownHosts in OpenSSH, hide the host names in the known hosts
+				hashKnownHosts := false
+				if sshConfig != nil {
+					value, _ := sshConfig.Get(configHost, "HashKnownHosts")
+					hashKnownHosts = strings.EqualFold(strings.TrimSpace(value), "yes")
+				}
+				if err := ssh3.AppendKnownHostKey(knownHostsPath, hostname, peerCertificate, hashKnownHosts); err != nil {
 					log.Error().Msgf("could not append known host to %s: %s", knownHostsPath, err)
 					return -1
 				}
-				tty.WriteString(fmt.Sprintf("Successfully added the certificate to %s, please rerun the command\n\r", knownHostsPath))
+				tty.WriteString(fmt.Sprintf("Successfully added the key to %s, please rerun the command\n\r", knownHostsPath))
 				return 0
 			}
 		}
@@ -632,19 +1128,50 @@ func mainWithStatusCode() int {
 	log.Debug().Msgf("QUIC handshake complete")
 	// Now, we're 1-RTT, we can get the TLS exporter and create the conversation
 	tls := qClient.ConnectionState().TLS
+	log.Debug().Msgf("negotiated the %s key exchange", ssh3.KeyExchangeName(tls))
+	if postQuantum, known := ssh3.IsPostQuantumKeyExchange(tls); keyExchange == ssh3.PostQuantumPrefer && known && !postQuantum {
+		log.Warn().Msgf("the server does not support the post-quantum key exchange, the session uses %s", ssh3.KeyExchangeName(tls))
+	}
 	conv, err := ssh3.NewClientConversation(30000, 10, &tls)
 	if err != nil {
 		log.Error().Msgf("could not create new client conversation: %s", err)
 		return -1
 	}
+	conv.SetCompression(compression)
+	conv.SetBandwidthLimiter(bandwidthLimiter)
+	if !*quiet {
+		conv.SetBannerHandler(newBannerPrinter(os.Stderr))
+	}
+	if *qlogDir != "" && *qlogSSH3Messages {
+		messageTracer, err := ssh3.CreateQlogMessageTracer(*qlogDir, "client", conv.ConversationID())
+		if err != nil {
+			log.Error().Msgf("could not create SSH3 messages qlog: %s", err)
+			return -1
+		}
+		defer messageTracer.Close()
+		conv.SetMessageTracer(messageTracer)
+	}
 
 	// the connection struct is created, now build the request used to establish the connection
-	req, err := http.NewRequest("CONNECT", requestUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "CONNECT", requestUrl, nil)
 	if err != nil {
 		log.Fatal().Msgf("%s", err)
 	}
 	req.Proto = "ssh3"
 	req.Header.Set("User-Agent", ssh3.GetCurrentVersion())
+	// the only channels that the server can open
+	acceptedChannelTypes := []string{}
+	if *forwardSSHAgent {
+		acceptedChannelTypes = append(acceptedChannelTypes, "agent-connection")
+	}
+	features := []string{"datagrams", ssh3.FeatureRequestReplies}
+	if *serverControlMode {
+		// the conversation is closed by the client, once told to exit
+		features = append(features, ssh3.FeatureMultipleSessions)
+	}
+	extInfo := ssh3.NewExtInfo(acceptedChannelTypes, features...)
+	ssh3.SetExtInfoCompression(extInfo, compression)
+	extInfo.SetHeader(req.Header)
 
 	var authMethods []interface{}
 
@@ -685,6 +1212,25 @@ func mainWithStatusCode() int {
 			authMethods = append(authMethods, ssh3.NewPasswordAuthMethod())
 		}
 
+		if *bearerTokenFile != "" {
+			authMethods = append([]interface{}{ssh3.NewBearerTokenAuthMethod(*bearerTokenFile)}, authMethods...)
+		}
+
+		if *preauthFile != "" {
+			// the other authentication methods may be unavailable from where the token was carried
+			authMethods = append([]interface{}{ssh3.NewPreauthAuthMethod(*preauthFile)}, authMethods...)
+		}
+
+		if *breakGlassAuthentication {
+			// takes precedence as the other authentication methods may be unavailable
+			authMethods = append([]interface{}{ssh3.NewBreakGlassAuthMethod()}, authMethods...)
+		}
+
+		if *clientCertFile != "" {
+			// the certificate has been presented during the TLS handshake
+			authMethods = append([]interface{}{ssh3.NewClientCertificateAuthMethod()}, authMethods...)
+		}
+
 	} else {
 		// for now, only perform OIDC if it was explicitly asked by the user
 		if *issuerUrl != "" {
@@ -709,16 +1255,54 @@ func mainWithStatusCode() int {
 
 	var identity ssh3.Identity
 	for _, method := range authMethods {
+		progress.stage(fmt.Sprintf("authenticating via %s", authMethodName(method)))
 		switch m := method.(type) {
 		case *ssh3.PasswordAuthMethod:
-			fmt.Printf("password for %s:", parsedUrl.String())
-			password, err := term.ReadPassword(int(syscall.Stdin))
-			fmt.Println()
+			progress.pause()
+			if *batchMode {
+				log.Error().Msgf("password authentication requires a prompt, which -batch-mode disables")
+				return -1
+			}
+			if *clientCertFile == "" {
+				// as with sshd, the banner of the server is displayed before prompting for the password,
+				// the unauthenticated request being refused along with it
+				probe := req.Clone(ctx)
+				if knockSecret != nil {
+					ssh3.SetKnockHeader(probe, knockSecret)
+				}
+				if err := conv.EstablishClientConversation(probe, roundTripper); err != nil {
+					log.Debug().Msgf("requested the banner of the server: %s", err)
+				}
+			}
+			password, err := prompts.readSecret(fmt.Sprintf("password for %s:", parsedUrl.String()))
 			if err != nil {
 				log.Error().Msgf("could not get password: %s", err)
 				return -1
 			}
-			identity = m.IntoIdentity(string(password))
+			identity = m.IntoIdentity(password)
+		case *ssh3.BreakGlassAuthMethod:
+			token := os.Getenv("SSH3_BREAK_GLASS_TOKEN")
+			if token == "" {
+				token, err = prompts.readSecret(fmt.Sprintf("break-glass token for %s:", parsedUrl.String()))
+				if err != nil {
+					log.Error().Msgf("could not get break-glass token: %s", err)
+					return -1
+				}
+				token = strings.TrimSpace(token)
+			}
+			identity = m.IntoIdentity(token)
+		case *ssh3.PreauthAuthMethod:
+			identity, err = m.IntoIdentity()
+			if err != nil {
+				log.Error().Msgf("could not load pre-authorization token: %s", err)
+				return -1
+			}
+		case *ssh3.BearerTokenAuthMethod:
+			identity, err = m.IntoIdentity()
+			if err != nil {
+				log.Error().Msgf("could not load bearer token: %s", err)
+				return -1
+			}
 		case *ssh3.PrivkeyFileAuthMethod:
 			identity, err = m.IntoIdentityWithoutPassphrase()
 			// could not identify without passphrase, try agent authentication by using the key's public key
@@ -751,16 +1335,10 @@ func mainWithStatusCode() int {
 
 				// key not handled by agent, let's try to decrypt it ourselves
 				if !foundAgentKey {
-					fmt.Printf("passphrase for private key stored in %s:", m.Filename())
-					var passphraseBytes []byte
-					passphraseBytes, err = term.ReadPassword(int(syscall.Stdin))
-					fmt.Println()
-					if err != nil {
-						log.Error().Msgf("could not get passphrase: %s", err)
-						return -1
-					}
-					passphrase := string(passphraseBytes)
-					identity, err = m.IntoIdentityPassphrase(passphrase)
+					err = prompts.readPassphrase(m.Filename(), func(passphrase string) (err error) {
+						identity, err = m.IntoIdentityPassphrase(passphrase)
+						return err
+					})
 					if err != nil {
 						log.Error().Msgf("could not load private key: %s", err)
 						return -1
@@ -769,10 +1347,14 @@ func mainWithStatusCode() int {
 			} else if err != nil {
 				log.Warn().Msgf("Could not load private key: %s", err)
 			}
+		case *ssh3.ClientCertificateAuthMethod:
+			identity = m.IntoIdentity()
 		case *ssh3.AgentAuthMethod:
 			identity = m.IntoIdentity(agentClient)
 		case *ssh3.OidcAuthMethod:
-			token, err := auth.Connect(context.Background(), m.OIDCConfig(), m.OIDCConfig().IssuerUrl, *doPKCE)
+			// the token carries the conversation ID, so that it cannot be used by another conversation
+			convID := conv.ConversationID()
+			token, err := auth.Connect(context.Background(), m.OIDCConfig(), m.OIDCConfig().IssuerUrl, *doPKCE, base64.StdEncoding.EncodeToString(convID[:]))
 			if err != nil {
 				log.Error().Msgf("could not get token: %s", err)
 				return -1
@@ -795,11 +1377,62 @@ func mainWithStatusCode() int {
 		log.Error().Msgf("could not set authorization header in HTTP request: %s", err)
 	}
 
+	if knockSecret != nil {
+		// the knock token is only valid for a minute, it is computed once the user is done authenticating
+		ssh3.SetKnockHeader(req, knockSecret)
+	}
+
 	log.Debug().Msgf("send CONNECT request to the server")
+	progress.stage("HTTP exchange")
 	err = conv.EstablishClientConversation(req, roundTripper)
-	if errors.Is(err, util.Unauthorized{}) {
+	var keyboardInteractive util.KeyboardInteractiveRequired
+	if errors.As(err, &keyboardInteractive) {
+		// the server accepted the identity and requires a second factor, e.g. a one-time password
+		progress.pause()
+		response, promptErr := prompts.readSecret(keyboardInteractive.Prompt)
+		if promptErr != nil {
+			log.Error().Msgf("could not answer the second authentication factor: %s", promptErr)
+			return -1
+		}
+		req = req.Clone(ctx)
+		// the tokens are built again, as they may have expired while the user was answering
+		if headerErr := identity.SetAuthorizationHeader(req, username, conv); headerErr != nil {
+			log.Error().Msgf("could not set authorization header in HTTP request: %s", headerErr)
+		}
+		if knockSecret != nil {
+			ssh3.SetKnockHeader(req, knockSecret)
+		}
+		ssh3.SetKeyboardInteractiveResponse(req, strings.TrimSpace(response))
+		progress.stage("HTTP exchange")
+		err = conv.EstablishClientConversation(req, roundTripper)
+	}
+	var serviceUnavailable util.ServiceUnavailable
+	var tooManyRequests util.TooManyRequests
+	if disconnect, ok := ssh3.AsDisconnect(err); ok {
+		// the server told why it refused the conversation
+		log.Error().Msgf("the server refused the conversation: %s", err)
+		printDisconnect(disconnect)
+		return -1
+	} else if errors.Is(err, util.Unauthorized{}) {
 		log.Error().Msgf("Access denied from the server: unauthorized")
 		return -1
+	} else if errors.Is(err, util.Forbidden{}) {
+		log.Error().Msgf("Access denied from the server: the user is not allowed to connect")
+		return -1
+	} else if errors.Is(err, util.NotFound{}) {
+		log.Error().Msgf("the server answered 404: wrong URL path, or a hidden server refused the request (wrong knock secret, see -knock-secret-file, or authentication failure)")
+		return -1
+	} else if errors.As(err, &tooManyRequests) {
+		if tooManyRequests.RetryAfter > 0 {
+			log.Error().Msgf("the server refused the attempt after too many authentication failures, retry in %s", tooManyRequests.RetryAfter)
+		} else {
+			log.Error().Msgf("the server refused the attempt after too many authentication failures, retry later")
+		}
+		return -1
+	} else if errors.As(err, &serviceUnavailable) {
+		log.Error().Msgf("the server refused the conversation: %s", serviceUnavailable.Message)
+		fmt.Fprintln(os.Stderr, serviceUnavailable.Message)
+		return -1
 	} else if err != nil {
 		log.Error().Msgf("Could not open channel: %+v", err)
 		return -1
@@ -807,13 +1440,54 @@ func mainWithStatusCode() int {
 
 	ctx = conv.Context()
 
+	if compression.Algorithm != "" && conv.CompressionAlgorithm() == "" {
+		fmt.Fprintf(os.Stderr, "server: %s; continuing without -compression\n", ssh3.UnsupportedFeature{Feature: "compression"})
+	}
+
+	var control *serverControl
+	if *serverControlMode {
+		if !conv.PeerExtInfo().HasFeature(ssh3.FeatureMultipleSessions) {
+			progress.stop()
+			fmt.Fprintf(os.Stderr, "server: %s, cannot use -server-control\n", ssh3.UnsupportedFeature{Feature: "multiple_sessions"})
+			return -1
+		}
+		control = newServerControl(conv)
+		markConversation(udpConn, ipQoS, false)
+	}
+	if *controlPath != "" {
+		closeControlSocket, err := serveControlSocket(*controlPath, conv, control)
+		if err != nil {
+			log.Error().Msgf("could not open control socket at %s: %s", *controlPath, err)
+			return -1
+		}
+		defer closeControlSocket()
+	}
+	if control != nil {
+		progress.finish()
+		defer conv.Close()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		select {
+		case <-control.exited:
+		case <-signals:
+		case <-ctx.Done():
+			fmt.Fprintf(os.Stderr, "Connection to %s closed.\n", parsedUrl.Host)
+			return 255
+		}
+		return 0
+	}
+
+	progress.stage("opening session")
 	channel, err := conv.OpenChannel("session", 30000, 0)
 	if err != nil {
+		progress.stop()
 		fmt.Fprintf(os.Stderr, "Could not open channel: %+v", err)
 		os.Exit(-1)
 	}
 
 	log.Debug().Msgf("opened new session channel")
+	progress.finish()
 
 	if *forwardSSHAgent {
 		_, err := channel.WriteData([]byte("forward-agent"), ssh3Messages.SSH_EXTENDED_DATA_NONE)
@@ -845,21 +1519,175 @@ func mainWithStatusCode() int {
 		}()
 	}
 
+	if workingDirectory != "" {
+		// older servers would end the session on the unknown request
+		if err := conv.CheckPeerRequestType("working-directory"); err != nil {
+			fmt.Fprintf(os.Stderr, "server: %s, cannot start in %s\n", err, workingDirectory)
+			return -1
+		}
+		err = sendSessionRequest(ctx, conv, channel, &ssh3Messages.WorkingDirectoryRequest{Directory: workingDirectory})
+		if errors.As(err, &ssh3.RequestFailure{}) {
+			fmt.Fprintf(os.Stderr, "server refused to start in %s\n", workingDirectory)
+			return -1
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Could send working directory request: %+v", err)
+			return -1
+		}
+		log.Debug().Msgf("sent working directory request for %s", workingDirectory)
+	}
+
+	var stallWatchdog *watchdog
+	var escapes *escapeFilter
+	// set when the user terminates the connection using ~.
+	var terminated atomic.Bool
+	forwards := newForwardings(ctx, conv)
+	// avoid requesting a pty on the other side if stdin is not a pty
+	// similar behaviour to OpenSSH
+	isATTY := term.IsTerminal(int(os.Stdin.Fd()))
+	runsCommand := len(command) != 0 && !*requestSubsystem
+	allocatePty, ptyWarning := ptyAllocation(requestTTY, isATTY, len(command) == 0)
+	if *reattach != "" {
+		allocatePty, ptyWarning = reattachSession, ""
+	}
+	if ptyWarning != "" {
+		fmt.Fprintln(os.Stderr, ptyWarning)
+	}
+	// the commands invoking sudo get a pty on demand, so that the password is typed without echo
+	if requestTTY == requestTTYAuto && isATTY && runsCommand && *onPasswordPrompt == passwordPromptPty && invokesPasswordPrompt(strings.Join(command, " ")) {
+		allocatePty = true
+	}
+	// as OpenSSH, the sessions without a pty (commands, file copies, forwardings) are bulk traffic
+	markConversation(udpConn, ipQoS, allocatePty)
+	var passwordPrompts *passwordPromptDetector
+	if runsCommand && !allocatePty && *onPasswordPrompt != passwordPromptWait {
+		passwordPrompts = newPasswordPromptDetector(os.Stderr, func() { roundTripper.Close() })
+	}
 	if len(command) == 0 {
-		// avoid requesting a pty on the other side if stdin is not a pty
-		// similar behaviour to OpenSSH
-		isATTY := term.IsTerminal(int(os.Stdin.Fd()))
-		if isATTY {
-			windowSize, err := winsize.GetWinsize()
+		if isATTY && *stallTimeout > 0 {
+			stallWatchdog, err = newWatchdog(*stallTimeout, *onStall, pathMetrics, os.Stderr, func() { roundTripper.Close() })
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Could not get window size: %+v", err)
-				os.Exit(-1)
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return -1
 			}
-			err = channel.SendRequest(
+			go stallWatchdog.run(ctx)
+		}
+	}
+	// as with OpenSSH, the escape sequences are only recognized in the sessions with a pty
+	if allocatePty && isATTY && *escapeCharFlag != "none" {
+		escapes = newEscapeFilter((*escapeCharFlag)[0], os.Stderr)
+		addSignalEscapes(escapes, conv, channel)
+		addConnectionEscapes(escapes, conv, forwards, func() {
+			terminated.Store(true)
+			fmt.Fprintf(os.Stderr, "\r\nConnection to %s closed.\r\n", parsedUrl.Host)
+			roundTripper.Close()
+		})
+	}
+	if *reattach != "" {
+		// older servers would end the session on the unknown request
+		if err := conv.CheckPeerRequestType("reattach"); err != nil {
+			fmt.Fprintf(os.Stderr, "server: %s, cannot reattach\n", err)
+			return -1
+		}
+	}
+	if allocatePty && !reattachSession {
+		windowSize, err := winsize.GetWinsize()
+		if err != nil {
+			// the server uses a default size
+			log.Warn().Msgf("could not get window size: %s", err)
+		}
+		// the remote pty behaves as the local terminal, e.g. for the erase character
+		terminalModes, err := ssh3Messages.GetTerminalModes(int(os.Stdin.Fd()))
+		if err != nil {
+			log.Debug().Msgf("could not get the terminal modes, using the defaults of the server: %s", err)
+		}
+		err = sendSessionRequest(ctx, conv, channel, &ssh3Messages.PtyRequest{
+			Term:          terminalType(),
+			CharWidth:     uint64(windowSize.NCols),
+			CharHeight:    uint64(windowSize.NRows),
+			PixelWidth:    uint64(windowSize.PixelWidth),
+			PixelHeight:   uint64(windowSize.PixelHeight),
+			TerminalModes: terminalModes,
+		})
+		if errors.As(err, &ssh3.RequestFailure{}) {
+			fmt.Fprintln(os.Stderr, "PTY allocation request failed")
+			return -1
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Could send pty request: %+v", err)
+			return -1
+		}
+		log.Debug().Msgf("sent pty request for session")
+	}
+
+	if *reattach != "" {
+		request := &ssh3Messages.ReattachRequest{}
+		if reattachSession {
+			request.SessionID = *reattach
+		}
+		err = sendSessionRequest(ctx, conv, channel, request)
+		if err == nil && reattachSession && isATTY {
+			// the pty of the session gets the size of this terminal
+			if windowSize, sizeErr := winsize.GetWinsize(); sizeErr == nil {
+				err = channel.SendRequest(
+					&ssh3Messages.ChannelRequestMessage{
+						WantReply: false,
+						ChannelRequest: &ssh3Messages.WindowChangeRequest{
+							CharWidth:   uint64(windowSize.NCols),
+							CharHeight:  uint64(windowSize.NRows),
+							PixelWidth:  uint64(windowSize.PixelWidth),
+							PixelHeight: uint64(windowSize.PixelHeight),
+						},
+					},
+				)
+			}
+		}
+		log.Debug().Msgf("sent reattach request for session %q", request.SessionID)
+	} else if len(command) == 0 {
+		err = sendSessionRequest(ctx, conv, channel, &ssh3Messages.ShellRequest{})
+		log.Debug().Msgf("sent shell request")
+	} else if *requestSubsystem {
+		err = sendSessionRequest(ctx, conv, channel, &ssh3Messages.SubsystemRequest{SubsystemName: command[0]})
+		log.Debug().Msgf("sent subsystem request for %s", command[0])
+	} else if *execArgv {
+		// older servers would end the session on the unknown request
+		if err := conv.CheckPeerRequestType("exec-argv"); err != nil {
+			fmt.Fprintf(os.Stderr, "server: %s, cannot run the command without a shell\n", err)
+			return -1
+		}
+		request := &ssh3Messages.ExecArgvRequest{Argv: command}
+		err = sendSessionRequest(ctx, conv, channel, request)
+		log.Debug().Msgf("sent exec-argv request for command %s", request.Command())
+	} else {
+		err = sendSessionRequest(ctx, conv, channel, &ssh3Messages.ExecRequest{Command: strings.Join(command, " ")})
+		log.Debug().Msgf("sent exec request for command \"%s\"", strings.Join(command, " "))
+	}
+
+	var failure ssh3.RequestFailure
+	if errors.As(err, &failure) {
+		fmt.Fprintf(os.Stderr, "server refused the %s request\n", failure.RequestType)
+		return -1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Could send shell request: %+v", err)
+		return -1
+	}
+
+	// avoid making the terminal raw if stdin is not a TTY, e.g. with -tt
+	// similar behaviour to OpenSSH
+	if allocatePty && isATTY {
+		rawTerminal, err := makeTerminalRaw()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not make the terminal raw: %+v\n", err)
+			return -1
+		}
+		// the status code is returned rather than exiting, so that the terminal is restored
+		defer rawTerminal.restore()
+		if escapes != nil {
+			addSuspendEscape(escapes, rawTerminal)
+		}
+		go winsize.WatchWinsize(ctx, func(windowSize winsize.WindowSize) {
+			err := channel.SendRequest(
 				&ssh3Messages.ChannelRequestMessage{
-					WantReply: true,
-					ChannelRequest: &ssh3Messages.PtyRequest{
-						Term:        os.Getenv("TERM"),
+					WantReply: false,
+					ChannelRequest: &ssh3Messages.WindowChangeRequest{
 						CharWidth:   uint64(windowSize.NCols),
 						CharHeight:  uint64(windowSize.NRows),
 						PixelWidth:  uint64(windowSize.PixelWidth),
@@ -867,147 +1695,108 @@ func mainWithStatusCode() int {
 					},
 				},
 			)
-
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Could send pty request: %+v", err)
-				return -1
+				log.Error().Msgf("could not send window change request: %s", err)
 			}
-			log.Debug().Msgf("sent pty request for session")
-		}
-
-		err = channel.SendRequest(
-			&ssh3Messages.ChannelRequestMessage{
-				WantReply:      true,
-				ChannelRequest: &ssh3Messages.ShellRequest{},
-			},
-		)
-		log.Debug().Msgf("sent shell request")
-		// avoid making the terminal raw if stdin is not a TTY
-		// similar behaviour to OpenSSH
-		if isATTY {
-			fd := os.Stdin.Fd()
-			oldState, err := term.MakeRaw(int(fd))
-			if err != nil {
-				log.Fatal().Msgf("%s", err)
-			}
-			defer term.Restore(int(fd), oldState)
-		}
-	} else {
-		channel.SendRequest(
-			&ssh3Messages.ChannelRequestMessage{
-				WantReply: true,
-				ChannelRequest: &ssh3Messages.ExecRequest{
-					Command: strings.Join(command, " "),
-				},
-			},
-		)
-		log.Debug().Msgf("sent exec request for command \"%s\"", strings.Join(command, " "))
+		})
 	}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could send shell request: %+v", err)
-		return -1
+	var typing *ssh3.TypingSender
+	var echoPredictions *echoPredictor
+	if *datagramTyping && allocatePty && len(command) == 0 {
+		if conv.PeerExtInfo().HasFeature(ssh3.FeatureDatagramTyping) {
+			typing = ssh3.NewTypingSender(ctx, channel)
+			go typing.Run()
+			echoPredictions = newEchoPredictor(stdout)
+			stdout = echoPredictions
+		} else {
+			fmt.Fprintf(os.Stderr, "server: %s; continuing without -datagram-typing\n", ssh3.UnsupportedFeature{Feature: "datagram_typing"})
+		}
 	}
 
 	go func() {
 		buf := make([]byte, channel.MaxPacketSize())
 		for {
 			n, err := os.Stdin.Read(buf)
-			if n > 0 {
-				_, err2 := channel.WriteData(buf[:n], ssh3Messages.SSH_EXTENDED_DATA_NONE)
+			data := buf[:n]
+			if escapes != nil {
+				data = escapes.filter(data)
+			}
+			if len(data) > 0 {
+				var err2 error
+				if typing != nil {
+					echoPredictions.typed(data)
+					_, err2 = typing.Write(data)
+				} else {
+					_, err2 = channel.WriteData(data, ssh3Messages.SSH_EXTENDED_DATA_NONE)
+				}
 				if err2 != nil {
 					fmt.Fprintf(os.Stderr, "could not write data on channel: %+v", err2)
 					return
 				}
+				if stallWatchdog != nil {
+					stallWatchdog.inputSent(time.Now())
+				}
+				if passwordPrompts != nil {
+					passwordPrompts.inputSent()
+				}
 			}
-			if err != nil {
+			if errors.Is(err, io.EOF) {
+				// the remote command reads the end of its input, e.g. cat in echo foo | ssh3 host cat
+				if err := ssh3.SendEOF(channel, conv.PeerExtInfo()); isUnsupportedFeature(err) {
+					log.Debug().Msgf("reached the end of stdin, the server does not support sending it: %s", err)
+				} else if err != nil {
+					log.Error().Msgf("could not send the end of stdin: %s", err)
+				}
+				return
+			} else if err != nil {
 				fmt.Fprintf(os.Stderr, "could not read data from stdin: %+v", err)
 				return
 			}
 		}
 	}()
 
-	if localUDPAddr != nil && remoteUDPAddr != nil {
-		log.Debug().Msgf("start forwarding from %s to %s", localUDPAddr, remoteUDPAddr)
-		conn, err := net.ListenUDP("udp", localUDPAddr)
-		if err != nil {
-			log.Error().Msgf("could listen on UDP socket: %s", err)
+	// the session goes on without the forwardings that the server does not support
+	if localUDPAddr != nil {
+		if err := forwards.forwardUDP(localUDPAddr.(*net.UDPAddr), remoteUDPAddr.(*net.UDPAddr)); isUnsupportedFeature(err) {
+			fmt.Fprintf(os.Stderr, "server: %s; continuing without -forward-udp\n", err)
+		} else if err != nil {
+			log.Error().Msgf("%s", err)
 			return -1
 		}
-		forwardings := make(map[string]ssh3.Channel)
-		go func() {
-			buf := make([]byte, 1500)
-			for {
-				n, addr, err := conn.ReadFromUDP(buf)
-				if err != nil {
-					log.Error().Msgf("could read on UDP socket: %s", err)
-					return
-				}
-				channel, ok := forwardings[addr.String()]
-				if !ok {
-					channel, err = conv.OpenUDPForwardingChannel(30000, 10, localUDPAddr, remoteUDPAddr)
-					if err != nil {
-						log.Error().Msgf("could open new UDP forwarding channel: %s", err)
-						return
-					}
-					forwardings[addr.String()] = channel
-
-					go func() {
-						for {
-							dgram, err := channel.ReceiveDatagram(ctx)
-							if err != nil {
-								log.Error().Msgf("could open receive datagram on channel: %s", err)
-								return
-							}
-							_, err = conn.WriteToUDP(dgram, addr)
-							if err != nil {
-								log.Error().Msgf("could open write datagram on socket: %s", err)
-								return
-							}
-						}
-					}()
-				}
-				err = channel.SendDatagram(buf[:n])
-				if err != nil {
-					log.Error().Msgf("could not send datagram: %s", err)
-					return
-				}
-			}
-		}()
 	}
 
-	if localTCPAddr != nil && remoteTCPAddr != nil {
-		log.Debug().Msgf("start forwarding from %s to %s", localTCPAddr, remoteTCPAddr)
-		conn, err := net.ListenTCP("tcp", localTCPAddr)
-		if err != nil {
-			log.Error().Msgf("could listen on TCP socket: %s", err)
+	if localTCPAddr != nil {
+		if err := forwards.forwardTCP(localTCPAddr.(*net.TCPAddr), remoteTCPAddr.(*net.TCPAddr)); isUnsupportedFeature(err) {
+			fmt.Fprintf(os.Stderr, "server: %s; continuing without -forward-tcp\n", err)
+		} else if err != nil {
+			log.Error().Msgf("%s", err)
 			return -1
 		}
-		go func() {
-			for {
-				conn, err := conn.AcceptTCP()
-				if err != nil {
-					log.Error().Msgf("could read on UDP socket: %s", err)
-					return
-				}
-				forwardingChannel, err := conv.OpenTCPForwardingChannel(30000, 10, localTCPAddr, remoteTCPAddr)
-				if err != nil {
-					log.Error().Msgf("could open new UDP forwarding channel: %s", err)
-					return
-				}
-				forwardTCPInBackground(ctx, forwardingChannel, conn)
-			}
-		}()
 	}
 
 	defer conv.Close()
-	defer fmt.Printf("\r")
+	// the carriage return only matters on terminals: it would corrupt the binary output of the
+	// commands without a pty (e.g. git) and fail on their pipe once the reader closed it
+	if allocatePty {
+		defer fmt.Printf("\r")
+	}
 
 	for {
 		genericMessage, err := channel.NextMessage()
-		if err != nil {
+		if err != nil && (terminated.Load() || stallWatchdog != nil && stallWatchdog.closedConnection() || passwordPrompts != nil && passwordPrompts.promptDetected()) {
+			// return instead of exiting so that the terminal is restored
+			return 255
+		} else if err != nil {
+			if disconnect, ok := conv.PeerDisconnect(disconnectMessageDelay); ok {
+				printDisconnect(disconnect)
+				return 255
+			}
 			fmt.Fprintf(os.Stderr, "Could not get message: %+v\n", err)
-			os.Exit(-1)
+			return -1
+		}
+		if stallWatchdog != nil {
+			stallWatchdog.dataReceived(time.Now())
 		}
 		switch message := genericMessage.(type) {
 		case *ssh3Messages.ChannelRequestMessage:
@@ -1018,7 +1807,7 @@ func mainWithStatusCode() int {
 				fmt.Fprintf(os.Stderr, "receiving a x11 request on the client is not implemented\n")
 			case *ssh3Messages.ShellRequest:
 				fmt.Fprintf(os.Stderr, "receiving a shell request on the client is not implemented\n")
-			case *ssh3Messages.ExecRequest:
+			case *ssh3Messages.ExecRequest, *ssh3Messages.ExecArgvRequest:
 				fmt.Fprintf(os.Stderr, "receiving a exec request on the client is not implemented\n")
 			case *ssh3Messages.SubsystemRequest:
 				fmt.Fprintf(os.Stderr, "receiving a subsystem request on the client is not implemented\n")
@@ -1028,25 +1817,33 @@ func mainWithStatusCode() int {
 				fmt.Fprintf(os.Stderr, "receiving a signal request on the client is not implemented\n")
 			case *ssh3Messages.ExitStatusRequest:
 				log.Info().Msgf("ssh3: process exited with status: %d\n", requestMessage.ExitStatus)
+				span.SetAttributes(attribute.Int64("ssh3.exit_status", int64(requestMessage.ExitStatus)))
 				// forward the process' status code to the user
 				return int(requestMessage.ExitStatus)
 			case *ssh3Messages.ExitSignalRequest:
 				log.Info().Msgf("ssh3: process exited with signal: %s: %s\n", requestMessage.SignalNameWithoutSig, requestMessage.ErrorMessageUTF8)
-				return -1
+				span.SetAttributes(attribute.String("ssh3.exit_signal", requestMessage.SignalNameWithoutSig))
+				// exit as a shell reports a command killed by a signal
+				return exitSignalStatus(requestMessage.SignalNameWithoutSig)
 			}
 		case *ssh3Messages.DataOrExtendedDataMessage:
+			if passwordPrompts != nil {
+				passwordPrompts.outputReceived([]byte(message.Data))
+			}
 			switch message.DataType {
 			case ssh3Messages.SSH_EXTENDED_DATA_NONE:
-				_, err = os.Stdout.Write([]byte(message.Data))
+				_, err = io.WriteString(stdout, message.Data)
 				if err != nil {
-					log.Fatal().Msgf("%s", err)
+					fmt.Fprintf(os.Stderr, "could not write the output of the session: %s\n", err)
+					return -1
 				}
 
 				log.Debug().Msgf("received data %s", message.Data)
 			case ssh3Messages.SSH_EXTENDED_DATA_STDERR:
-				_, err = os.Stderr.Write([]byte(message.Data))
+				_, err = io.WriteString(stderr, message.Data)
 				if err != nil {
-					log.Fatal().Msgf("%s", err)
+					fmt.Fprintf(os.Stderr, "could not write the output of the session: %s\n", err)
+					return -1
 				}
 
 				log.Debug().Msgf("received stderr data %s", message.Data)
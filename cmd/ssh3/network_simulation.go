@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+)
+
+// dials the QUIC connection on a UDP socket delaying and dropping the packets as specified with
+// -simulate-network
+func dialSimulatedNetwork(ctx context.Context, addr string, conditions ssh3.NetworkConditions, transport ssh3.TransportConfig, tlsConf *tls.Config, qconf *quic.Config) (quic.EarlyConnection, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := transport.ListenUDP(":0")
+	if err != nil {
+		return nil, err
+	}
+	conn := ssh3.NewSimulatedPacketConn(udpConn, conditions)
+	qconn, err := quic.DialEarly(ctx, conn, udpAddr, tlsConf, qconf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// quic-go does not close the sockets it did not create
+	go func() {
+		<-qconn.Context().Done()
+		conn.Close()
+	}()
+	return qconn, nil
+}
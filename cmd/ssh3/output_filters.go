@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/francoismichel/ssh3/client"
+)
+
+const outputFilterOption = "OutputFilter"
+
+// the -o options, in the Key=Value format of ~/.ssh/config. The option can be repeated.
+type optionsFlag []string
+
+func (o *optionsFlag) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *optionsFlag) Set(value string) error {
+	key, _, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("expected Key=Value, got %q", value)
+	}
+	if !strings.EqualFold(key, outputFilterOption) {
+		return fmt.Errorf("unsupported option %q: only %s is supported", key, outputFilterOption)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// returns the values of key, in order
+func (o optionsFlag) values(key string) []string {
+	var values []string
+	for _, option := range o {
+		optionKey, value, _ := strings.Cut(option, "=")
+		if strings.EqualFold(optionKey, key) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// returns the writers of the standard output and error of the session, passing the output
+// through the filters (see client.ParseOutputFilter) in the order they were specified
+func filteredOutput(specs []string) (stdout io.Writer, stderr io.Writer, err error) {
+	filters := make([]client.OutputFilter, 0, len(specs))
+	for _, spec := range specs {
+		filter, err := client.ParseOutputFilter(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, filter)
+	}
+	// the filters are stateful, each stream gets its own
+	return client.FilterOutput(os.Stdout, filters...), client.FilterOutput(os.Stderr, filters...), nil
+}
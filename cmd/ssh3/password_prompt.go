@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the handling of the password prompts of the commands run without a pty, set using
+// -on-password-prompt
+const (
+	// the prompt is displayed and the command waits for the standard input, as before
+	passwordPromptWait = "wait"
+	// exit with an error explaining that the command waits for a password
+	passwordPromptFail = "fail"
+	// allocate a pty for the commands invoking sudo, su or doas, so that they prompt on the
+	// local terminal
+	passwordPromptPty = "pty"
+)
+
+// the output is considered as a prompt if nothing follows it within this delay
+const passwordPromptDelay = time.Second
+
+// e.g. "[sudo] password for alice: ", "Password: " or "Enter passphrase for key: "
+var passwordPromptRegexp = regexp.MustCompile(`(?i)(password|passphrase|passcode)[^\n]*:\s*$`)
+
+// the programs asking for a password on their terminal
+var passwordPromptingPrograms = map[string]bool{"sudo": true, "su": true, "doas": true, "pkexec": true}
+
+// returns whether the shell command line runs a program asking for a password, considering the
+// first word of each command of the line
+func invokesPasswordPrompt(commandLine string) bool {
+	commands := strings.FieldsFunc(commandLine, func(r rune) bool {
+		return strings.ContainsRune(";&|()\n`", r)
+	})
+	for _, command := range commands {
+		for _, word := range strings.Fields(command) {
+			// skip the variable assignments, e.g. LANG=C sudo ...
+			if strings.Contains(word, "=") && !strings.HasPrefix(word, "=") {
+				continue
+			}
+			if passwordPromptingPrograms[path.Base(strings.Trim(word, `"'`))] {
+				return true
+			}
+			break
+		}
+	}
+	return false
+}
+
+// The passwordPromptDetector watches the output of a command run without a pty: a command
+// waiting for a password on its standard input otherwise hangs silently in scripts, or shows a
+// prompt that the user cannot answer without a terminal.
+type passwordPromptDetector struct {
+	out io.Writer
+	// called once when a prompt is detected
+	onPrompt func()
+
+	lock sync.Mutex
+	// the last line of the output
+	lastLine []byte
+	timer    *time.Timer
+	// incremented when the timer is stopped, so that a timer firing concurrently does nothing
+	generation uint64
+	detected   bool
+}
+
+func newPasswordPromptDetector(out io.Writer, onPrompt func()) *passwordPromptDetector {
+	return &passwordPromptDetector{out: out, onPrompt: onPrompt}
+}
+
+// called with the data written by the command on its standard output or error
+func (d *passwordPromptDetector) outputReceived(data []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopTimer()
+	if i := strings.LastIndexByte(string(data), '\n'); i >= 0 {
+		d.lastLine = append(d.lastLine[:0], data[i+1:]...)
+	} else {
+		d.lastLine = append(d.lastLine, data...)
+	}
+	// the prompts fit on a line
+	if len(d.lastLine) > 256 {
+		d.lastLine = d.lastLine[len(d.lastLine)-256:]
+	}
+	if !d.detected && passwordPromptRegexp.Match(d.lastLine) {
+		prompt, generation := strings.TrimSpace(string(d.lastLine)), d.generation
+		d.timer = time.AfterFunc(passwordPromptDelay, func() { d.fire(prompt, generation) })
+	}
+}
+
+// called with the data sent on the standard input of the command, e.g. a password piped to it
+func (d *passwordPromptDetector) inputSent() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopTimer()
+}
+
+// must be called with the lock held
+func (d *passwordPromptDetector) stopTimer() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+		d.generation++
+	}
+}
+
+func (d *passwordPromptDetector) fire(prompt string, generation uint64) {
+	d.lock.Lock()
+	if d.detected || d.generation != generation {
+		d.lock.Unlock()
+		return
+	}
+	d.detected = true
+	d.lock.Unlock()
+	fmt.Fprintf(d.out, "\nssh3: the remote command is waiting for a password (%q) but runs without a terminal, "+
+		"use -on-password-prompt=%s from a terminal to answer it\n", prompt, passwordPromptPty)
+	d.onPrompt()
+}
+
+// returns whether the detector reported a prompt
+func (d *passwordPromptDetector) promptDetected() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.detected
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loads the key signing the pre-authorization tokens, prompting for its passphrase if needed
+func loadPreauthSigner(filename string) (crypto.Signer, error) {
+	pemBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh3.ParseRawPrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		err = newPrompter(false).readPassphrase(filename, func(passphrase string) (err error) {
+			key, err = ssh3.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("the provided key file does not result in a crypto.Signer type")
+	}
+	return signer, nil
+}
+
+// ssh3 preauth writes a pre-authorization token on stdout, to be carried to a client that
+// cannot reach the identity provider and used with -use-preauth
+func runPreauth(args []string) int {
+	flags := flag.NewFlagSet("ssh3 preauth", flag.ContinueOnError)
+	host := flags.String("host", "", "the name of the target server, as set in the preauth section of its config")
+	ttl := flags.Duration("ttl", time.Hour, "the lifetime of the token")
+	username := flags.String("user", "", "the user authenticated by the token on the target server (the current user by default)")
+	privKeyFile := flags.String("privkey", "", "the private key signing the token, whose public key is one of the verification keys of the server")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *host == "" || *privKeyFile == "" {
+		fmt.Fprintf(os.Stderr, "ssh3 preauth requires -host and -privkey\n")
+		flags.Usage()
+		return -1
+	}
+	if *ttl <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid token lifetime %s\n", *ttl)
+		return -1
+	}
+	if *username == "" {
+		u, err := osuser.Current()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not get current username: %s\n", err)
+			return -1
+		}
+		*username = u.Username
+	}
+	signer, err := loadPreauthSigner(*privKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load private key %s: %s\n", *privKeyFile, err)
+		return -1
+	}
+	now := time.Now()
+	token, err := ssh3.NewPreauthToken(signer, *username, *host, *ttl, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the token: %s\n", err)
+		return -1
+	}
+	fmt.Println(token)
+	fmt.Fprintf(os.Stderr, "token for %s on %s valid until %s\n", *username, *host, now.Add(*ttl).Format(time.RFC3339))
+	return 0
+}
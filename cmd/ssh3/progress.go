@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/rs/zerolog/log"
+)
+
+// the progress is only displayed when the connection takes longer, so that it does not flicker
+const progressDisplayDelay = 300 * time.Millisecond
+
+const progressRefreshInterval = 100 * time.Millisecond
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+type connectionStage struct {
+	name     string
+	duration time.Duration
+}
+
+// The connectionProgress reports the stages of the connection establishment (resolving, QUIC
+// handshake, authentication, ...) on a status line with a spinner, so that a slow stage is not
+// mistaken for a hang. The durations of the stages are logged in verbose mode.
+type connectionProgress struct {
+	// nil if the progress is not displayed, e.g. if stderr is not a terminal or with -quiet
+	out io.Writer
+
+	lock         sync.Mutex
+	start        time.Time
+	stages       []connectionStage
+	current      string
+	currentStart time.Time
+	frame        int
+	// whether the status line is displayed
+	displayed bool
+	// set while the user is prompted, until the next stage
+	paused   bool
+	finished bool
+	done     chan struct{}
+}
+
+func newConnectionProgress(out io.Writer) *connectionProgress {
+	p := &connectionProgress{out: out, start: time.Now(), done: make(chan struct{})}
+	if out != nil {
+		go p.run()
+	}
+	return p
+}
+
+// must be called with the lock held
+func (p *connectionProgress) endStage(now time.Time) {
+	if p.current != "" {
+		p.stages = append(p.stages, connectionStage{name: p.current, duration: now.Sub(p.currentStart)})
+	}
+}
+
+// stage ends the current stage and starts the next one
+func (p *connectionProgress) stage(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.finished {
+		return
+	}
+	now := time.Now()
+	p.endStage(now)
+	p.current, p.currentStart = name, now
+	p.paused = false
+	if p.displayed {
+		p.draw(now)
+	}
+}
+
+// pause hides the status line until the next stage, e.g. before prompting for a password
+func (p *connectionProgress) pause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	p.paused = true
+}
+
+// must be called with the lock held
+func (p *connectionProgress) draw(now time.Time) {
+	fmt.Fprintf(p.out, "\r\033[K%s %s (%s)", spinnerFrames[p.frame%len(spinnerFrames)], p.current, now.Sub(p.currentStart).Round(100*time.Millisecond))
+	p.frame++
+	p.displayed = true
+}
+
+// must be called with the lock held
+func (p *connectionProgress) clear() {
+	if p.displayed {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.displayed = false
+	}
+}
+
+func (p *connectionProgress) run() {
+	ticker := time.NewTicker(progressRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.lock.Lock()
+			if !p.finished && !p.paused && now.Sub(p.start) >= progressDisplayDelay {
+				p.draw(now)
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// must be called with the lock held
+func (p *connectionProgress) summary() string {
+	stages := make([]string, 0, len(p.stages))
+	for _, stage := range p.stages {
+		stages = append(stages, fmt.Sprintf("%s: %s", stage.name, stage.duration.Round(time.Millisecond)))
+	}
+	return strings.Join(stages, ", ")
+}
+
+// finish ends the last stage and removes the status line once the session is open
+func (p *connectionProgress) finish() {
+	p.end("connection established")
+}
+
+// stop removes the status line if the connection could not be established, it does nothing
+// once finish was called
+func (p *connectionProgress) stop() {
+	p.end("connection failed")
+}
+
+func (p *connectionProgress) end(outcome string) {
+	p.lock.Lock()
+	if p.finished {
+		p.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	p.endStage(now)
+	p.clear()
+	p.finished = true
+	close(p.done)
+	summary := p.summary()
+	// the logs go through statusLineWriter
+	p.lock.Unlock()
+	log.Debug().Msgf("%s after %s (%s)", outcome, now.Sub(p.start).Round(time.Millisecond), summary)
+}
+
+// statusLineWriter removes the status line before writing to w, e.g. the logs, so that they do
+// not follow the spinner on the same line
+func (p *connectionProgress) statusLineWriter(w io.Writer) io.Writer {
+	return writerFunc(func(b []byte) (int, error) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.clear()
+		return w.Write(b)
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// returns the name of the authentication method displayed in the progress
+func authMethodName(method interface{}) string {
+	switch method.(type) {
+	case *ssh3.PasswordAuthMethod:
+		return "password"
+	case *ssh3.BreakGlassAuthMethod:
+		return "break-glass token"
+	case *ssh3.PreauthAuthMethod:
+		return "pre-authorization token"
+	case *ssh3.BearerTokenAuthMethod:
+		return "bearer token"
+	case *ssh3.ClientCertificateAuthMethod:
+		return "client certificate"
+	case *ssh3.PrivkeyFileAuthMethod:
+		return "private key"
+	case *ssh3.AgentAuthMethod:
+		return "agent key"
+	case *ssh3.OidcAuthMethod:
+		return "OpenID Connect"
+	default:
+		return fmt.Sprintf("%T", method)
+	}
+}
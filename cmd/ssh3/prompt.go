@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// the number of attempts to type the passphrase of a private key, as NumberOfPasswordPrompts
+// in OpenSSH
+const passphraseAttempts = 3
+
+// The prompter asks for the secrets needed to authenticate (passwords, passphrases and tokens)
+// on the terminal of the user without echoing them, or using an askpass helper when there is
+// no terminal, as ssh does. With -batch-mode, it fails instead, so that scripts do not hang.
+type prompter struct {
+	// the terminal on which the secrets are typed, nil if there is none
+	in  *os.File
+	out io.Writer
+	// fail instead of prompting, see -batch-mode
+	batchMode bool
+	// the askpass helper, run with the prompt as argument and writing the secret on its stdout
+	askpass string
+	// when the askpass helper is used, as SSH_ASKPASS_REQUIRE: "never", "prefer", "force", or
+	// empty to only use it without a terminal when a display is available
+	askpassRequire string
+	// called before prompting, e.g. to pause the display of the progress
+	beforePrompt func()
+}
+
+// returns the prompter using /dev/tty, or the standard input if it is a terminal (e.g. on
+// Windows), and the askpass helper of SSH3_ASKPASS or SSH_ASKPASS
+func newPrompter(batchMode bool) *prompter {
+	p := &prompter{
+		batchMode:      batchMode,
+		askpass:        os.Getenv("SSH3_ASKPASS"),
+		askpassRequire: os.Getenv("SSH_ASKPASS_REQUIRE"),
+	}
+	if p.askpass == "" {
+		p.askpass = os.Getenv("SSH_ASKPASS")
+	}
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		p.in, p.out = tty, tty
+	} else if term.IsTerminal(int(os.Stdin.Fd())) {
+		p.in, p.out = os.Stdin, os.Stderr
+	}
+	return p
+}
+
+func (p *prompter) usesAskpass() bool {
+	if p.askpass == "" {
+		return false
+	}
+	switch p.askpassRequire {
+	case "never":
+		return false
+	case "prefer", "force":
+		return true
+	}
+	return p.in == nil && (os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != "")
+}
+
+// asks for a secret using prompt, e.g. "password for https://alice@host/ssh3:"
+func (p *prompter) readSecret(prompt string) (string, error) {
+	if p.batchMode {
+		return "", fmt.Errorf("cannot prompt %q with -batch-mode", prompt)
+	}
+	if p.beforePrompt != nil {
+		p.beforePrompt()
+	}
+	if p.usesAskpass() {
+		return p.runAskpass(prompt)
+	}
+	if p.in == nil {
+		return "", fmt.Errorf("cannot prompt %q without a terminal, set SSH_ASKPASS to use an askpass helper", prompt)
+	}
+	fmt.Fprint(p.out, prompt)
+	secret, err := term.ReadPassword(int(p.in.Fd()))
+	fmt.Fprintln(p.out)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func (p *prompter) runAskpass(prompt string) (string, error) {
+	cmd := exec.Command(p.askpass, prompt)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// e.g. the user cancelled the dialog
+		return "", fmt.Errorf("the askpass helper %s failed: %w", p.askpass, err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// asks for the passphrase of the private key stored in filename until decrypt accepts it or the
+// attempts are exhausted, decrypt returning x509.IncorrectPasswordError for wrong passphrases
+func (p *prompter) readPassphrase(filename string, decrypt func(passphrase string) error) error {
+	var err error
+	for attempt := 1; attempt <= passphraseAttempts; attempt++ {
+		var passphrase string
+		passphrase, err = p.readSecret(fmt.Sprintf("passphrase for private key stored in %s:", filename))
+		if err != nil {
+			return err
+		}
+		err = decrypt(passphrase)
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return err
+		}
+		if attempt < passphraseAttempts {
+			p.notify("Bad passphrase, try again.")
+		}
+	}
+	return err
+}
+
+// displays message where the user is prompted
+func (p *prompter) notify(message string) {
+	if p.out != nil && !p.usesAskpass() {
+		fmt.Fprintln(p.out, message)
+	} else {
+		fmt.Fprintln(os.Stderr, message)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// the proxies of the connection, set using -proxy
+type connectionProxy struct {
+	// the URI template of the MASQUE proxy relaying the QUIC connection, if any
+	connectUDPTemplate string
+	// returns the HTTP proxy of the HTTP/2 tunnels of the TCP fallback, if any
+	tunnelProxy func(*http.Request) (*url.URL, error)
+	// whether the connection must go through the HTTP proxy, UDP being unavailable
+	requiresTunnel bool
+}
+
+// parses -proxy: the URI template of a MASQUE proxy relaying the UDP payloads (RFC 9298) or the URL
+// of an HTTP proxy through which the connection is tunneled over HTTP/2. If not set, the
+// HTTPS_PROXY and NO_PROXY environment variables give the proxy of the TCP fallback.
+func parseProxy(value string) (connectionProxy, error) {
+	if value == "" {
+		return connectionProxy{tunnelProxy: http.ProxyFromEnvironment}, nil
+	}
+	if ssh3.IsConnectUDPTemplate(value) {
+		if _, err := ssh3.ExpandConnectUDPTemplate(value, "localhost", 443); err != nil {
+			return connectionProxy{}, err
+		}
+		return connectionProxy{connectUDPTemplate: value}, nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return connectionProxy{}, fmt.Errorf("invalid proxy %q: expected the URI template of a MASQUE proxy containing {target_host} and {target_port}, "+
+			"or the http:// or https:// URL of an HTTP proxy", value)
+	}
+	return connectionProxy{tunnelProxy: http.ProxyURL(proxyURL), requiresTunnel: true}, nil
+}
+
+// returns a function dialing the QUIC connection with hostname:port through the MASQUE proxy of
+// template, each dial requesting a new relay on the same connection with the proxy
+func newConnectUDPDialer(template string, hostname string, port int, qconf *quic.Config) redialFunc {
+	roundTripper := &http3.RoundTripper{}
+	return func(ctx context.Context, tlsConf *tls.Config) (quic.EarlyConnection, error) {
+		proxyURL, err := ssh3.ExpandConnectUDPTemplate(template, hostname, port)
+		if err != nil {
+			return nil, err
+		}
+		tunnel, err := ssh3.DialConnectUDP(ctx, roundTripper, proxyURL)
+		if err != nil {
+			// not wrapped, so that the TLS errors of the proxy are not taken for the ones of the server
+			return nil, fmt.Errorf("could not connect through the MASQUE proxy: %s", err)
+		}
+		return dialThroughTunnel(ctx, tunnel, tlsConf, qconf)
+	}
+}
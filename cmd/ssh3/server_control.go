@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// In server-control mode (-server-control), the client keeps its connection open without running
+// a session, and runs the commands and file copies submitted on its control socket in session
+// channels of their own, so that configuration management tools run many commands without
+// connecting for each of them.
+
+// the trailer of GET /files carrying the exit status of the command reading the file, so that
+// the clients can tell a complete file from a truncated one
+const exitStatusTrailer = "Ssh3-Exit-Status"
+
+// the stderr of the failed file copies reported to the clients
+const maxControlStderrSize = 64 << 10
+
+type serverControl struct {
+	conv     *ssh3.Conversation
+	exited   chan struct{}
+	exitOnce sync.Once
+}
+
+func newServerControl(conv *ssh3.Conversation) *serverControl {
+	return &serverControl{conv: conv, exited: make(chan struct{})}
+}
+
+func (s *serverControl) register(mux *http.ServeMux) {
+	mux.HandleFunc("/exec", s.handleExec)
+	mux.HandleFunc("/files", s.handleFiles)
+	mux.HandleFunc("/exit", s.handleExit)
+}
+
+// a line of the output of POST /exec, the last one carrying the exit status or signal of the
+// command, or the error that interrupted it
+type execEvent struct {
+	Stdout     []byte  `json:"stdout,omitempty"`
+	Stderr     []byte  `json:"stderr,omitempty"`
+	ExitStatus *uint64 `json:"exit_status,omitempty"`
+	ExitSignal string  `json:"exit_signal,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// the end of a command run on a channel, either its exit status or the signal that killed it
+type commandExit struct {
+	status *uint64
+	signal string
+}
+
+func (e commandExit) success() bool {
+	return e.status != nil && *e.status == 0
+}
+
+func (e commandExit) String() string {
+	if e.status != nil {
+		return fmt.Sprintf("exit status %d", *e.status)
+	}
+	return "signal " + e.signal
+}
+
+// runs the command of request on a new session channel, writing stdin on it and passing its
+// output to output as it arrives. The channel is closed once the command exited or ctx is done.
+func runChannelCommand(ctx context.Context, conv *ssh3.Conversation, request ssh3Messages.ChannelRequest, stdin io.Reader,
+	output func(data []byte, dataType ssh3Messages.SSHDataType) error) (commandExit, error) {
+	channel, err := conv.OpenChannelContext(ctx, "session", 30000, 0)
+	if err != nil {
+		return commandExit{}, err
+	}
+	defer channel.Close()
+	stop := context.AfterFunc(ctx, channel.CancelRead)
+	defer stop()
+	// a refused command is reported as such rather than as the end of the channel
+	err = sendSessionRequest(ctx, conv, channel, request)
+	if err != nil {
+		return commandExit{}, err
+	}
+	go func() {
+		buf := make([]byte, channel.MaxPacketSize())
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if _, err := channel.WriteData(buf[:n], ssh3Messages.SSH_EXTENDED_DATA_NONE); err != nil {
+					log.Debug().Msgf("could not write the input of channel %d: %s", channel.ChannelID(), err)
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				if err := ssh3.SendEOF(channel, conv.PeerExtInfo()); err != nil {
+					log.Debug().Msgf("could not send the end of the input of channel %d: %s", channel.ChannelID(), err)
+				}
+				return
+			} else if err != nil {
+				log.Debug().Msgf("could not read the input of channel %d: %s", channel.ChannelID(), err)
+				return
+			}
+		}
+	}()
+	for {
+		genericMessage, err := channel.NextMessage()
+		if err != nil {
+			return commandExit{}, err
+		} else if genericMessage == nil {
+			return commandExit{}, fmt.Errorf("the channel ended before the command exited")
+		}
+		switch message := genericMessage.(type) {
+		case *ssh3Messages.ChannelRequestMessage:
+			switch requestMessage := message.ChannelRequest.(type) {
+			case *ssh3Messages.ExitStatusRequest:
+				status := requestMessage.ExitStatus
+				return commandExit{status: &status}, nil
+			case *ssh3Messages.ExitSignalRequest:
+				return commandExit{signal: requestMessage.SignalNameWithoutSig}, nil
+			}
+		case *ssh3Messages.DataOrExtendedDataMessage:
+			if err := output([]byte(message.Data), message.DataType); err != nil {
+				return commandExit{}, err
+			}
+		}
+	}
+}
+
+// returns the exec-argv request of the argv parameters, or the exec request of the command run
+// by the shell of the user
+func (s *serverControl) commandRequest(query url.Values) (ssh3Messages.ChannelRequest, error) {
+	argv, command := query["argv"], query.Get("command")
+	switch {
+	case len(argv) > 0 && command != "":
+		return nil, fmt.Errorf("both argv and command are set")
+	case len(argv) > 0:
+		return s.execArgvRequest(argv...)
+	case command != "":
+		return &ssh3Messages.ExecRequest{Command: command}, nil
+	default:
+		return nil, fmt.Errorf("missing argv or command")
+	}
+}
+
+func (s *serverControl) execArgvRequest(argv ...string) (ssh3Messages.ChannelRequest, error) {
+	if err := s.conv.CheckPeerRequestType("exec-argv"); err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	return &ssh3Messages.ExecArgvRequest{Argv: argv}, nil
+}
+
+// POST /exec?command=... or /exec?argv=...&argv=... runs the command with the body of the request
+// as input, and streams its output as JSON lines
+func (s *serverControl) handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request, err := s.commandRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	controller := http.NewResponseController(w)
+	// the output is streamed while the input is still being read
+	if err := controller.EnableFullDuplex(); err != nil {
+		log.Debug().Msgf("could not stream the output of the command along with its input: %s", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	exit, err := runChannelCommand(r.Context(), s.conv, request, r.Body, func(data []byte, dataType ssh3Messages.SSHDataType) error {
+		event := execEvent{Stdout: data}
+		if dataType == ssh3Messages.SSH_EXTENDED_DATA_STDERR {
+			event = execEvent{Stderr: data}
+		}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		return controller.Flush()
+	})
+	last := execEvent{ExitStatus: exit.status, ExitSignal: exit.signal}
+	if err != nil {
+		last = execEvent{Error: err.Error()}
+	}
+	if err := encoder.Encode(last); err != nil {
+		log.Debug().Msgf("could not write the end of the command on the control socket: %s", err)
+	}
+}
+
+// keeps the beginning of the stderr of a command
+type stderrBuffer struct {
+	bytes.Buffer
+}
+
+func (b *stderrBuffer) add(data []byte) {
+	if room := maxControlStderrSize - b.Len(); room > 0 {
+		b.Write(data[:min(len(data), room)])
+	}
+}
+
+// GET /files?path=... sends the content of the remote file, PUT /files?path=...&mode=0644 writes
+// the body of the request in the remote file and optionally sets its mode
+func (s *serverControl) handleFiles(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.download(w, r, path)
+	case http.MethodPut:
+		s.upload(w, r, path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *serverControl) download(w http.ResponseWriter, r *http.Request, path string) {
+	request, err := s.execArgvRequest("cat", "--", path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Trailer", exitStatusTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	var stderr stderrBuffer
+	// the status is only sent with the first data, so that the files that cannot be read fail
+	started := false
+	exit, err := runChannelCommand(r.Context(), s.conv, request, http.NoBody, func(data []byte, dataType ssh3Messages.SSHDataType) error {
+		if dataType == ssh3Messages.SSH_EXTENDED_DATA_STDERR {
+			stderr.add(data)
+			return nil
+		}
+		started = true
+		_, err := w.Write(data)
+		return err
+	})
+	switch {
+	case err != nil && !started:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case err != nil:
+		log.Warn().Msgf("the download of %s was interrupted: %s", path, err)
+	case !started && !exit.success():
+		http.Error(w, fmt.Sprintf("could not read %s: %s: %s", path, exit, stderr.String()), http.StatusBadGateway)
+	default:
+		w.Header().Set(exitStatusTrailer, exit.String())
+	}
+}
+
+func (s *serverControl) upload(w http.ResponseWriter, r *http.Request, path string) {
+	// the shell of the server redirects the output of cat, the path being passed as an argument
+	// so that it is not interpreted
+	argv := []string{"sh", "-c", `cat > "$1"`, "sh", path}
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+			http.Error(w, fmt.Sprintf("invalid mode %q", mode), http.StatusBadRequest)
+			return
+		}
+		argv = []string{"sh", "-c", `cat > "$1" && chmod "$2" "$1"`, "sh", path, mode}
+	}
+	request, err := s.execArgvRequest(argv...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	var stderr stderrBuffer
+	exit, err := runChannelCommand(r.Context(), s.conv, request, r.Body, func(data []byte, dataType ssh3Messages.SSHDataType) error {
+		stderr.add(data)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	} else if !exit.success() {
+		http.Error(w, fmt.Sprintf("could not write %s: %s: %s", path, exit, stderr.String()), http.StatusBadGateway)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /exit closes the connection, e.g. once the configuration management run ended
+func (s *serverControl) handleExit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.exitOnce.Do(func() { close(s.exited) })
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+)
+
+// the modes of the TCP fallback, set using -tcp-fallback
+const (
+	// tunnel the connection over HTTP/2 if the server cannot be reached over UDP
+	tcpFallbackAuto = "auto"
+	// always tunnel the connection over HTTP/2, e.g. on networks known to block UDP
+	tcpFallbackAlways = "always"
+	tcpFallbackNever  = "never"
+)
+
+// the duration of the QUIC handshake over UDP after which the server is considered unreachable
+// over UDP when the TCP fallback is automatic
+const udpProbeTimeout = 3 * time.Second
+
+func validateTCPFallback(mode string) error {
+	if mode != tcpFallbackAuto && mode != tcpFallbackAlways && mode != tcpFallbackNever {
+		return fmt.Errorf("unknown TCP fallback %q (expected %q, %q or %q)", mode, tcpFallbackAuto, tcpFallbackAlways, tcpFallbackNever)
+	}
+	return nil
+}
+
+// returns a function dialing the QUIC connection through a new HTTP/2 tunnel to the URL path of the
+// server at hostname:port, see ssh3.DialHTTP2Tunnel. network restricts the TCP connection to IPv4
+// ("ip4") or IPv6 ("ip6"), and proxy returns the HTTP proxy of the tunnel, if any.
+func newTunnelDialer(hostname string, port int, urlPath string, network string, proxy func(*http.Request) (*url.URL, error), qconf *quic.Config) redialFunc {
+	dialer := &net.Dialer{}
+	tcpNetwork := "tcp" + strings.TrimPrefix(network, "ip")
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, tcpNetwork, addr)
+		},
+		// the tunnel only carries the QUIC packets: the server is authenticated by the QUIC
+		// handshake inside, as when the packets are sent over UDP
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+		Proxy:             proxy,
+	}}
+	tunnelURL := "https://" + net.JoinHostPort(strings.Trim(hostname, "[]"), strconv.Itoa(port)) + urlPath
+	return func(ctx context.Context, tlsConf *tls.Config) (quic.EarlyConnection, error) {
+		tunnel, err := ssh3.DialHTTP2Tunnel(ctx, client, tunnelURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the HTTP/2 tunnel: %w", err)
+		}
+		return dialThroughTunnel(ctx, tunnel, tlsConf, qconf)
+	}
+}
+
+// dials the QUIC connection with the peer of tunnel, closing it along with the connection
+func dialThroughTunnel(ctx context.Context, tunnel *ssh3.TunnelConn, tlsConf *tls.Config, qconf *quic.Config) (quic.EarlyConnection, error) {
+	qconn, err := quic.DialEarly(ctx, tunnel, tunnel.RemoteAddr(), tlsConf, qconf)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	// quic-go does not close the sockets it did not create
+	go func() {
+		<-qconn.Context().Done()
+		tunnel.Close()
+	}()
+	return qconn, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// the local terminal, put in raw mode during interactive sessions
+type rawTerminal struct {
+	fd    int
+	state *term.State
+	// the platform-specific state of the terminal, restored along with state
+	platformState
+	restoreOnce sync.Once
+}
+
+// puts the terminal of stdin in raw mode, the input of the user, including the signal
+// characters, is then sent as is to the remote pty
+func makeTerminalRaw() (*rawTerminal, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	t := &rawTerminal{fd: fd, state: state}
+	if err := t.makePlatformRaw(); err != nil {
+		term.Restore(fd, state)
+		return nil, err
+	}
+	t.restoreOnSignals()
+	return t, nil
+}
+
+// restores the terminal as it was before makeTerminalRaw, can be called several times
+func (t *rawTerminal) restore() {
+	t.restoreOnce.Do(func() {
+		t.restorePlatform()
+		term.Restore(t.fd, t.state)
+	})
+}
+
+// the pty allocation policies, named as the values of the RequestTTY option of OpenSSH
+const (
+	// a pty is requested for the interactive shells run from a terminal
+	requestTTYAuto = "auto"
+	// -t: a pty is also requested for the commands, if stdin is a terminal
+	requestTTYYes = "yes"
+	// -tt: a pty is requested even if stdin is not a terminal
+	requestTTYForce = "force"
+	// -T: no pty is requested, the standard streams of the remote command are then pipes
+	requestTTYNo = "no"
+)
+
+// parses the value of RequestTTY in ~/.ssh/config
+func parseRequestTTY(value string) (string, error) {
+	switch policy := strings.ToLower(strings.TrimSpace(value)); policy {
+	case requestTTYAuto, requestTTYYes, requestTTYForce, requestTTYNo:
+		return policy, nil
+	case "true":
+		return requestTTYYes, nil
+	case "false":
+		return requestTTYNo, nil
+	default:
+		return "", fmt.Errorf("invalid RequestTTY %q, expected auto, yes, force or no", value)
+	}
+}
+
+// returns whether a pty is requested according to the policy, and the warning to display if the
+// policy cannot be honored. The subsystems never get a pty unless it is forced.
+func ptyAllocation(policy string, stdinIsATTY bool, interactive bool) (allocate bool, warning string) {
+	switch policy {
+	case requestTTYForce:
+		return true, ""
+	case requestTTYNo:
+		return false, ""
+	case requestTTYYes:
+		if !stdinIsATTY {
+			return false, "Pseudo-terminal will not be allocated because stdin is not a terminal."
+		}
+		return true, ""
+	default:
+		return stdinIsATTY && interactive, ""
+	}
+}
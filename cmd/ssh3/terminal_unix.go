@@ -0,0 +1,65 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+type platformState struct{}
+
+func (t *rawTerminal) makePlatformRaw() error {
+	return nil
+}
+
+func (t *rawTerminal) restorePlatform() {}
+
+// the signals generated by the terminal are disabled in raw mode, but the client can still be
+// hung up or terminated, which would leave the terminal in raw mode
+func (t *rawTerminal) restoreOnSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		t.restore()
+		// terminates the client as the signal would have
+		signal.Reset(sig)
+		syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+	}()
+}
+
+// the terminal type sent in the pty request
+func terminalType() string {
+	return os.Getenv("TERM")
+}
+
+// suspends the client as ^Z would have outside of raw mode, the terminal being restored
+// until the client is resumed
+func (t *rawTerminal) suspend() error {
+	t.restorePlatform()
+	if err := term.Restore(t.fd, t.state); err != nil {
+		return err
+	}
+	// the other threads may keep running for a while once the signal is sent, so the terminal
+	// is made raw again once SIGCONT is received, or after a delay if the signal was discarded
+	// (e.g. the process group of the client is orphaned)
+	resumed := make(chan os.Signal, 1)
+	signal.Notify(resumed, syscall.SIGCONT)
+	defer signal.Stop(resumed)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTSTP); err != nil {
+		return err
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+	}
+	if _, err := term.MakeRaw(t.fd); err != nil {
+		return err
+	}
+	return t.makePlatformRaw()
+}
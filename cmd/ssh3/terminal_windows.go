@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+type platformState struct {
+	stdoutMode      uint32
+	stdoutModeSaved bool
+}
+
+// the output of the remote pty uses VT sequences, which the console must interpret. This is
+// done by the console itself when its output is not redirected.
+func (t *rawTerminal) makePlatformRaw() error {
+	stdout := windows.Handle(os.Stdout.Fd())
+	if err := windows.GetConsoleMode(stdout, &t.stdoutMode); err != nil {
+		// stdout is redirected
+		return nil
+	}
+	t.stdoutModeSaved = true
+	return windows.SetConsoleMode(stdout, t.stdoutMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING|windows.DISABLE_NEWLINE_AUTO_RETURN)
+}
+
+func (t *rawTerminal) restorePlatform() {
+	if t.stdoutModeSaved {
+		windows.SetConsoleMode(windows.Handle(os.Stdout.Fd()), t.stdoutMode)
+	}
+}
+
+// Ctrl+C and Ctrl+Break are sent as input in raw mode, there is no signal to handle
+func (t *rawTerminal) restoreOnSignals() {}
+
+// the terminal type sent in the pty request, the console does not set TERM but emulates
+// an xterm when processing VT sequences
+func terminalType() string {
+	if term := os.Getenv("TERM"); term != "" {
+		return term
+	}
+	return "xterm-256color"
+}
+
+// the console has no job control
+func (t *rawTerminal) suspend() error {
+	return fmt.Errorf("suspending is not supported on Windows")
+}
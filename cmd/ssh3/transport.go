@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// dials the QUIC connection on a UDP socket created with the receive buffer size specified with
+// -quic-transport, as quic-go only raises it to its default, and returns the socket so that the
+// marking of its packets can be changed (see -ipqos)
+func dialWithSocket(ctx context.Context, addr *net.UDPAddr, transport ssh3.TransportConfig, tlsConf *tls.Config, qconf *quic.Config) (quic.EarlyConnection, *net.UDPConn, error) {
+	conn, err := transport.ListenUDP(":0")
+	if err != nil {
+		return nil, nil, err
+	}
+	qconn, err := quic.DialEarly(ctx, conn, addr, tlsConf, qconf)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// quic-go does not close the sockets it did not create
+	go func() {
+		<-qconn.Context().Done()
+		conn.Close()
+	}()
+	return qconn, conn, nil
+}
+
+// marks the packets of the conversation as interactive or not according to the -ipqos classes,
+// if the socket is known
+func markConversation(conn *net.UDPConn, ipQoS *ssh3.IPQoS, interactive bool) {
+	if conn == nil || ipQoS == nil {
+		return
+	}
+	class := ipQoS.Bulk
+	if interactive {
+		class = ipQoS.Interactive
+	}
+	if err := ssh3.SetTrafficClass(conn, class); err != nil {
+		log.Warn().Msgf("could not mark the packets of the conversation: %s", err)
+	}
+}
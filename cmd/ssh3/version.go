@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// the features compiled in this binary for this platform
+func clientFeatures() map[string]bool {
+	return map[string]bool{
+		"agent_forwarding":    runtime.GOOS != "windows",
+		"fido2":               false,
+		"sftp":                false,
+		"break_glass":         true,
+		"preauth":             true,
+		"control_socket":      true,
+		"datagram_typing":     true,
+		"compression":         true,
+		"client_certificates": true,
+		"post_quantum_kex":    ssh3.PostQuantumKeyExchangeSupported(),
+	}
+}
+
+// prints the version, or the feature report as JSON if features is set
+func printVersion(features bool) int {
+	if !features {
+		fmt.Printf("ssh3 %s (%s)\n", ssh3.ReleaseVersion(), ssh3.GetCurrentVersion())
+		return 0
+	}
+	if err := ssh3.NewFeatureReport("ssh3", clientFeatures()).Write(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the feature report: %s\n", err)
+		return -1
+	}
+	return 0
+}
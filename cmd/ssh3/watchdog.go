@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+)
+
+// the actions of the watchdog when the connection stalls, set using -on-stall
+const (
+	stallActionWarn = "warn"
+	// exit so that a wrapper script can reconnect
+	stallActionExit = "exit"
+)
+
+// records the path metrics of the QUIC connection reported by quic-go
+type pathMetricsTracer struct {
+	logging.NullConnectionTracer
+	latestRTT   atomic.Int64
+	smoothedRTT atomic.Int64
+	lostPackets atomic.Uint64
+	ptoCount    atomic.Uint32
+	// in nanoseconds since the epoch
+	lastPacketReceived atomic.Int64
+}
+
+func (t *pathMetricsTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+	t.latestRTT.Store(int64(rttStats.LatestRTT()))
+	t.smoothedRTT.Store(int64(rttStats.SmoothedRTT()))
+}
+
+func (t *pathMetricsTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	t.lostPackets.Add(1)
+}
+
+func (t *pathMetricsTracer) UpdatedPTOCount(value uint32) {
+	t.ptoCount.Store(value)
+}
+
+func (t *pathMetricsTracer) ReceivedLongHeaderPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {
+	t.lastPacketReceived.Store(time.Now().UnixNano())
+}
+
+func (t *pathMetricsTracer) ReceivedShortHeaderPacket(*logging.ShortHeader, logging.ByteCount, []logging.Frame) {
+	t.lastPacketReceived.Store(time.Now().UnixNano())
+}
+
+// The watchdog detects half-open connections in interactive sessions: if the user typed
+// something and no packet came back from the server within the timeout, it displays a status
+// line describing the path and applies the stall action. Packets are considered rather than
+// data so that typing without echo (e.g. a password) is not mistaken for a stall.
+type watchdog struct {
+	timeout time.Duration
+	action  string
+	metrics *pathMetricsTracer
+	out     io.Writer
+	// called once if the action is to exit
+	closeConnection func()
+
+	lock sync.Mutex
+	// the time of the oldest input not followed by a packet from the server, zero if none
+	awaitingSince time.Time
+	// the number of lost packets when the input was sent
+	lostPacketsSince uint64
+	stalled          bool
+	closed           bool
+}
+
+func newWatchdog(timeout time.Duration, action string, metrics *pathMetricsTracer, out io.Writer, closeConnection func()) (*watchdog, error) {
+	if action != stallActionWarn && action != stallActionExit {
+		return nil, fmt.Errorf("unknown stall action %q (expected %q or %q)", action, stallActionWarn, stallActionExit)
+	}
+	return &watchdog{timeout: timeout, action: action, metrics: metrics, out: out, closeConnection: closeConnection}, nil
+}
+
+func (w *watchdog) inputSent(now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.awaitingSince.IsZero() {
+		w.awaitingSince = now
+		w.lostPacketsSince = w.metrics.lostPackets.Load()
+	}
+}
+
+func (w *watchdog) dataReceived(now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.recovered(now)
+}
+
+// must be called with the lock held
+func (w *watchdog) recovered(now time.Time) {
+	if w.stalled {
+		// the terminal is in raw mode during interactive sessions
+		fmt.Fprintf(w.out, "\r\nssh3: connection recovered after %s\r\n", now.Sub(w.awaitingSince).Round(100*time.Millisecond))
+	}
+	w.awaitingSince = time.Time{}
+	w.stalled = false
+}
+
+// returns whether the watchdog closed the connection
+func (w *watchdog) closedConnection() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closed
+}
+
+func (w *watchdog) stallReason(lostPackets uint64) string {
+	switch {
+	case w.metrics.ptoCount.Load() > 0:
+		return "the server does not acknowledge packets"
+	case lostPackets > 0:
+		return "packet loss"
+	case time.Duration(w.metrics.latestRTT.Load()) > 2*time.Duration(w.metrics.smoothedRTT.Load()):
+		return "RTT spike"
+	default:
+		return "no packets from the server"
+	}
+}
+
+func (w *watchdog) check(now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed || w.awaitingSince.IsZero() {
+		return
+	}
+	if time.Unix(0, w.metrics.lastPacketReceived.Load()).After(w.awaitingSince) {
+		// the server acknowledged the input
+		w.recovered(now)
+		return
+	}
+	if w.stalled || now.Sub(w.awaitingSince) < w.timeout {
+		return
+	}
+	w.stalled = true
+	lostPackets := w.metrics.lostPackets.Load() - w.lostPacketsSince
+	fmt.Fprintf(w.out, "\r\nssh3: connection stalled, no reply for %s: %s (RTT %s, smoothed RTT %s, %d packets lost, %d PTOs)\r\n",
+		now.Sub(w.awaitingSince).Round(100*time.Millisecond), w.stallReason(lostPackets),
+		time.Duration(w.metrics.latestRTT.Load()).Round(time.Millisecond), time.Duration(w.metrics.smoothedRTT.Load()).Round(time.Millisecond),
+		lostPackets, w.metrics.ptoCount.Load())
+	if w.action == stallActionExit {
+		fmt.Fprintf(w.out, "ssh3: closing the stalled connection\r\n")
+		w.closed = true
+		go w.closeConnection()
+	}
+}
+
+func (w *watchdog) run(ctx context.Context) {
+	ticker := time.NewTicker(w.timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
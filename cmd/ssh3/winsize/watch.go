@@ -0,0 +1,29 @@
+//go:build !windows
+
+package winsize
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchWinsize calls onChange with the new window size each time the terminal is resized,
+// until ctx is done
+func WatchWinsize(ctx context.Context, onChange func(WindowSize)) {
+	changes := make(chan os.Signal, 1)
+	signal.Notify(changes, syscall.SIGWINCH)
+	defer signal.Stop(changes)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			ws, err := GetWinsize()
+			if err == nil {
+				onChange(ws)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package winsize
+
+import (
+	"context"
+	"time"
+)
+
+// the console only reports its resizing as an input event, which would be consumed along
+// with the input of the user, so its size is polled instead
+const pollInterval = 250 * time.Millisecond
+
+// WatchWinsize calls onChange with the new window size each time the console is resized,
+// until ctx is done
+func WatchWinsize(ctx context.Context, onChange func(WindowSize)) {
+	previous, _ := GetWinsize()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ws, err := GetWinsize()
+			if err == nil && ws != previous {
+				previous = ws
+				onChange(ws)
+			}
+		}
+	}
+}
@@ -8,7 +8,11 @@ import "golang.org/x/term"
 func GetWinsize() (ws WindowSize, err error) {
 	// for Windows, it is a bit more complicated to get the window size in pixels, so on rely
 	// on window size expressed in columns
+	// the size is only available from the output of the console, which may be redirected
 	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height, err = term.GetSize(int(os.Stderr.Fd()))
+	}
 	if err != nil {
 		return ws, err
 	}
@@ -0,0 +1,196 @@
+package ssh3
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// CompressionDeflate compresses the channel data in the DEFLATE format of RFC 1951. It is the only
+// algorithm implemented: zstd would compress faster but has no implementation in the standard
+// library.
+const CompressionDeflate = "deflate"
+
+// the compression algorithms implemented
+var supportedCompressionAlgorithms = []string{CompressionDeflate}
+
+// DefaultCompressionThreshold is the size below which the data is sent uncompressed by default:
+// the keystrokes and the prompts of the interactive sessions are too short to compress
+const DefaultCompressionThreshold = 512
+
+// CompressionConfig enables the compression of the data of the channels of a conversation. As in
+// SSH, the client requests it and the server allows it: the algorithm is listed in the ExtInfo of
+// both peers, and the data is compressed in both directions if they list the same one. Each peer
+// compresses the data it sends using its own level and threshold.
+type CompressionConfig struct {
+	// the compression algorithm, i.e. CompressionDeflate, compression is disabled if empty
+	Algorithm string `json:"algorithm"`
+	// from 1 (fastest) to 9 (smallest), the default level of the algorithm if 0
+	Level int `json:"level"`
+	// the data messages shorter than Threshold bytes are sent uncompressed,
+	// DefaultCompressionThreshold if 0
+	Threshold int `json:"threshold"`
+}
+
+// Validate returns an error if the algorithm is not supported or a parameter is out of range
+func (c CompressionConfig) Validate() error {
+	if c.Algorithm != "" && !slices.Contains(supportedCompressionAlgorithms, c.Algorithm) {
+		return fmt.Errorf("unsupported compression algorithm %q, supported: %s", c.Algorithm, strings.Join(supportedCompressionAlgorithms, ", "))
+	}
+	if c.Level < 0 || c.Level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d, must be between 1 and %d", c.Level, flate.BestCompression)
+	}
+	if c.Threshold < 0 {
+		return fmt.Errorf("invalid compression threshold %d", c.Threshold)
+	}
+	return nil
+}
+
+// ParseCompressionConfig parses an algorithm optionally followed by comma-separated parameters,
+// e.g. "deflate,level=1,threshold=4KiB"
+func ParseCompressionConfig(s string) (CompressionConfig, error) {
+	fields := strings.Split(s, ",")
+	config := CompressionConfig{Algorithm: strings.TrimSpace(fields[0])}
+	if config.Algorithm == "" {
+		return config, fmt.Errorf("no compression algorithm specified")
+	}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return config, fmt.Errorf("invalid compression parameter %q, expected key=value", field)
+		}
+		switch strings.TrimSpace(key) {
+		case "level":
+			level, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || level == 0 {
+				return config, fmt.Errorf("invalid compression level %q", value)
+			}
+			config.Level = level
+		case "threshold":
+			threshold, err := parseByteSize(strings.TrimSpace(value))
+			if err != nil || threshold > ssh3Messages.MaxDataLength {
+				return config, fmt.Errorf("invalid compression threshold %q", value)
+			}
+			config.Threshold = int(threshold)
+		default:
+			return config, fmt.Errorf("unknown compression parameter %q", key)
+		}
+	}
+	return config, config.Validate()
+}
+
+// compresses the data messages of a channel, safe for concurrent use
+type channelCompressor struct {
+	threshold int
+	mutex     sync.Mutex
+	writer    *flate.Writer
+	buf       bytes.Buffer
+}
+
+// returns nil if the compression is disabled
+func newChannelCompressor(config CompressionConfig) *channelCompressor {
+	if config.Algorithm == "" {
+		return nil
+	}
+	level := config.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	threshold := config.Threshold
+	if threshold == 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	compressor := &channelCompressor{threshold: threshold}
+	// the level was validated
+	compressor.writer, _ = flate.NewWriter(&compressor.buf, level)
+	return compressor
+}
+
+// returns the compressed message carrying data, or nil if data is below the threshold or does not
+// compress
+func (c *channelCompressor) compress(dataType ssh3Messages.SSHDataType, data []byte) (*ssh3Messages.CompressedDataMessage, error) {
+	if len(data) < c.threshold {
+		return nil, nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.buf.Reset()
+	c.writer.Reset(&c.buf)
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	if c.buf.Len() >= len(data) {
+		return nil, nil
+	}
+	return &ssh3Messages.CompressedDataMessage{
+		DataType:           dataType,
+		UncompressedLength: uint64(len(data)),
+		CompressedData:     c.buf.String(),
+	}, nil
+}
+
+// decompresses the compressed messages of a channel, it is not safe for concurrent use
+type channelDecompressor struct {
+	reader io.ReadCloser
+	input  bytes.Reader
+}
+
+func (d *channelDecompressor) decompress(m *ssh3Messages.CompressedDataMessage) (*ssh3Messages.DataOrExtendedDataMessage, error) {
+	// bytes.Reader is an io.ByteReader, so that the decompressor does not read past the data
+	d.input.Reset([]byte(m.CompressedData))
+	if d.reader == nil {
+		d.reader = flate.NewReader(&d.input)
+	} else if err := d.reader.(flate.Resetter).Reset(&d.input, nil); err != nil {
+		return nil, err
+	}
+	// UncompressedLength is bounded by the parser
+	data := make([]byte, m.UncompressedLength)
+	if _, err := io.ReadFull(d.reader, data); err != nil {
+		return nil, ssh3Messages.InvalidMessage{MessageType: ssh3Messages.SSH3_MSG_CHANNEL_COMPRESSED_DATA, Reason: err}
+	}
+	if n, err := d.reader.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, ssh3Messages.InvalidMessage{MessageType: ssh3Messages.SSH3_MSG_CHANNEL_COMPRESSED_DATA,
+			Reason: fmt.Errorf("the data exceeds its announced length of %d bytes", m.UncompressedLength)}
+	}
+	return &ssh3Messages.DataOrExtendedDataMessage{DataType: m.DataType, Data: string(data)}, nil
+}
+
+// SetCompression requests the compression of the data of the conversation, see
+// CompressionConfig. It must be called before establishing the conversation, the algorithm being
+// listed in the ExtInfo set by SetExtInfoCompression.
+func (c *Conversation) SetCompression(config CompressionConfig) {
+	c.compression = config
+}
+
+// SetExtInfoCompression lists the algorithm of config in info, if compression is enabled
+func SetExtInfoCompression(info *ExtInfo, config CompressionConfig) {
+	if config.Algorithm != "" {
+		info.Compression = []string{config.Algorithm}
+	}
+}
+
+// CompressionAlgorithm returns the algorithm compressing the data of the channels, empty if the
+// data is sent uncompressed
+func (c *Conversation) CompressionAlgorithm() string {
+	if c.compression.Algorithm == "" || c.peerExtInfo == nil || !slices.Contains(c.peerExtInfo.Compression, c.compression.Algorithm) {
+		return ""
+	}
+	return c.compression.Algorithm
+}
+
+// sets the compressor of a new channel of the conversation
+func (c *Conversation) setupCompression(channel Channel) {
+	if c.CompressionAlgorithm() != "" {
+		channel.setCompressor(newChannelCompressor(c.compression))
+	}
+}
@@ -0,0 +1,112 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/quic-go/quic-go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// the receiving end of a channel, reading what the other end wrote
+type bufferReceiveStream struct {
+	quic.ReceiveStream
+	*bytes.Buffer
+}
+
+func (s bufferReceiveStream) Read(p []byte) (int, error) {
+	return s.Buffer.Read(p)
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+var _ = Describe("Compression", func() {
+	It("Parses the algorithm and its parameters", func() {
+		config, err := ssh3.ParseCompressionConfig("deflate, level=1,threshold=4KiB")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config).To(Equal(ssh3.CompressionConfig{Algorithm: ssh3.CompressionDeflate, Level: 1, Threshold: 4 << 10}))
+
+		for _, invalid := range []string{"", "zstd", "deflate,level=0", "deflate,level=10", "deflate,threshold=-1", "deflate,threshold=1GiB", "deflate,window=1"} {
+			_, err := ssh3.ParseCompressionConfig(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("Is listed in the ExtInfo only if enabled", func() {
+		header := http.Header{}
+		info := ssh3.NewExtInfo([]string{"session"})
+		ssh3.SetExtInfoCompression(info, ssh3.CompressionConfig{})
+		info.SetHeader(header)
+		Expect(ssh3.ParseExtInfo(header).Compression).To(BeEmpty())
+
+		ssh3.SetExtInfoCompression(info, ssh3.CompressionConfig{Algorithm: ssh3.CompressionDeflate})
+		info.SetHeader(header)
+		Expect(ssh3.ParseExtInfo(header).Compression).To(Equal([]string{ssh3.CompressionDeflate}))
+	})
+
+	It("Compresses the data above the threshold and decompresses it transparently", func() {
+		stream := &bytes.Buffer{}
+		sender := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, nil, nopCloser{stream}, nil, nil, false, true, true, 0, nil)
+		ssh3.EnableCompression(sender, ssh3.CompressionConfig{Algorithm: ssh3.CompressionDeflate, Threshold: 100})
+		receiver := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, bufferReceiveStream{Buffer: stream}, nopCloser{&bytes.Buffer{}}, nil, nil, false, true, true, 0, nil)
+
+		output := strings.Repeat("compiling github.com/francoismichel/ssh3\n", 2000)
+		short := strings.Repeat("a", 99)
+		// the random data is sent uncompressed as it does not compress
+		randomBytes := make([]byte, 1000)
+		rand.Read(randomBytes)
+		random := string(randomBytes)
+		for _, data := range []string{output, short, random} {
+			_, err := sender.WriteData([]byte(data), ssh3Messages.SSH_EXTENDED_DATA_STDERR)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		var received strings.Builder
+		for received.Len() < len(output)+len(short)+len(random) {
+			message, err := receiver.NextMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message).To(BeAssignableToTypeOf(&ssh3Messages.DataOrExtendedDataMessage{}))
+			Expect(message.(*ssh3Messages.DataOrExtendedDataMessage).DataType).To(Equal(ssh3Messages.SSH_EXTENDED_DATA_STDERR))
+			received.WriteString(message.(*ssh3Messages.DataOrExtendedDataMessage).Data)
+		}
+		Expect(received.String()).To(Equal(output + short + random))
+
+		sent := sender.Stats()
+		// the output is split in messages of at most 30000 bytes
+		Expect(sent.CompressedMessagesSent).To(BeEquivalentTo(3))
+		Expect(sent.CompressionInputBytes).To(BeEquivalentTo(len(output)))
+		Expect(sent.CompressionOutputBytes).To(BeNumerically("<", len(output)/10))
+		Expect(sent.BytesSent).To(BeNumerically("<", len(output)/10+len(short)+len(random)+100))
+		Expect(receiver.Stats().CompressedMessagesReceived).To(Equal(sent.CompressedMessagesSent))
+	})
+
+	It("Refuses the data exceeding its announced length", func() {
+		stream := &bytes.Buffer{}
+		sender := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, nil, nopCloser{stream}, nil, nil, false, true, true, 0, nil)
+		ssh3.EnableCompression(sender, ssh3.CompressionConfig{Algorithm: ssh3.CompressionDeflate})
+		_, err := sender.WriteData([]byte(strings.Repeat("a", 1000)), ssh3Messages.SSH_EXTENDED_DATA_NONE)
+		Expect(err).ToNot(HaveOccurred())
+
+		message, err := ssh3Messages.ParseMessage(bytes.NewReader(stream.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		compressed := message.(*ssh3Messages.CompressedDataMessage)
+		compressed.UncompressedLength--
+		tampered := make([]byte, compressed.Length())
+		_, err = compressed.Write(tampered)
+		Expect(err).ToNot(HaveOccurred())
+
+		receiver := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, bufferReceiveStream{Buffer: bytes.NewBuffer(tampered)}, nopCloser{&bytes.Buffer{}}, nil, nil, false, true, true, 0, nil)
+		_, err = receiver.NextMessage()
+		Expect(err).To(BeAssignableToTypeOf(ssh3Messages.InvalidMessage{}))
+	})
+})
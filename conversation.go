@@ -6,20 +6,32 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
+	ssh3Messages "github.com/francoismichel/ssh3/message"
 	"github.com/francoismichel/ssh3/util"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const SSH_FRAME_TYPE = 0xaf3627e6
 
 type ConversationID [32]byte
 
+// the maximum length of the message explaining why a server refuses a conversation
+const maxRefusalMessageLength = 4096
+
 func (cid ConversationID) String() string {
 	return base64.StdEncoding.EncodeToString(cid[:])
 }
@@ -36,6 +48,19 @@ type Conversation struct {
 	conversationID            ConversationID // generated using TLS exporters
 
 	channelsAcceptQueue *util.AcceptQueue[Channel]
+	channelOpenFilter   ChannelOpenFilter
+	// the types of the channels confirmed by their handlers rather than by AcceptChannel
+	deferredChannelTypes map[string]bool
+	// sent by the peer during the setup, nil if the peer predates it
+	peerExtInfo *ExtInfo
+	// the wire format of the messages of the channels
+	protocolVersion ssh3Messages.ProtocolVersion
+	// the compression of the data sent, if the peer supports it
+	compression CompressionConfig
+	// called with the banners sent by the server, if set
+	bannerHandler BannerHandler
+	// throttles the data of the channels, if set
+	bandwidthLimiter atomic.Pointer[BandwidthLimiter]
 }
 
 func GenerateConversationID(tls *tls.ConnectionState) (convID ConversationID, err error) {
@@ -67,11 +92,23 @@ func NewClientConversation(maxPacketsize uint64, defaultDatagramsQueueSize uint6
 		context:                   backgroundCtx,
 		cancelContext:             backgroundCancelCauseFunc,
 		conversationID:            convID,
+		protocolVersion:           ssh3Messages.MaxProtocolVersion,
 	}
 	return conv, nil
 }
 
-func (c *Conversation) EstablishClientConversation(req *http.Request, roundTripper *http3.RoundTripper) error {
+// The span context of req, if any, becomes the parent of the spans of the conversation.
+// Canceling the context of req aborts the establishment, the conversation outlives it once
+// established.
+func (c *Conversation) EstablishClientConversation(req *http.Request, roundTripper *http3.RoundTripper) (err error) {
+	ctx, span := tracer.Start(req.Context(), "ssh3.establish_conversation", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ssh3.conversation_id", c.conversationID.String())))
+	defer func() {
+		util.SetSpanError(span, err)
+		span.End()
+	}()
+	// propagate the trace context to the server
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	roundTripper.StreamHijacker = func(frameType http3.FrameType, qconn quic.Connection, stream quic.Stream, err error) (bool, error) {
 		if err != nil {
@@ -103,9 +140,18 @@ func (c *Conversation) EstablishClientConversation(req *http.Request, roundTripp
 
 		newChannel := NewChannel(channelInfo.ConversationStreamID, channelInfo.ConversationID, uint64(stream.StreamID()), channelInfo.ChannelType, channelInfo.MaxPacketSize, &StreamByteReader{stream}, stream, nil, c.channelsManager, false, false, true, c.defaultDatagramsQueueSize, nil)
 		newChannel.setDatagramSender(c.getDatagramSenderForChannel(newChannel.ChannelID()))
+		newChannel.setProtocolVersion(c.protocolVersion)
+		c.setupCompression(newChannel)
+		newChannel.setBandwidthLimiter(c.bandwidthLimiter.Load)
+		newChannel, err = parseChannelTypeHeader(c, newChannel, &StreamByteReader{stream})
+		if err != nil {
+			log.Warn().Msgf("malformed %s header on channel %d, resetting the stream: %s", channelInfo.ChannelType, channelInfo.ChannelID, err)
+			return false, err
+		}
 		c.channelsAcceptQueue.Add(newChannel)
 		return true, nil
 	}
+	SetProtocolVersionsHeader(req.Header)
 	rsp, err := roundTripper.RoundTripOpt(req, http3.RoundTripOpt{DontCloseRequestStream: true})
 	if err != nil {
 		return err
@@ -124,11 +170,20 @@ func (c *Conversation) EstablishClientConversation(req *http.Request, roundTripp
 	}
 
 	if rsp.StatusCode == 200 {
+		c.protocolVersion, err = checkServerProtocolVersion(rsp.Header)
+		if err != nil {
+			return err
+		}
+		c.peerExtInfo = ParseExtInfo(rsp.Header)
 		c.controlStream = rsp.Body.(http3.HTTPStreamer).HTTPStream()
 		c.streamCreator = rsp.Body.(http3.Hijacker).StreamCreator()
 		qconn := c.streamCreator.(quic.Connection)
 		c.messageSender = qconn
 		c.context, c.cancelContext = context.WithCancelCause(qconn.Context())
+		c.context = trace.ContextWithSpanContext(c.context, trace.SpanContextFromContext(req.Context()))
+		// the body of the response remains open along with the conversation, a disconnect
+		// message cancels its context
+		go c.handleConversationMessages(rsp, 0)
 		go func() {
 			// TODO: this hijacks the datagrams for the whole quic connection, so the server
 			//		 currently does not work for several conversations in the same QUIC connection
@@ -160,12 +215,37 @@ func (c *Conversation) EstablishClientConversation(req *http.Request, roundTripp
 		}()
 		return nil
 	} else if rsp.StatusCode == http.StatusUnauthorized {
+		// the server sends its banner before the end of the refusal
+		c.handleConversationMessages(rsp, 1)
+		if prompt := rsp.Header.Get(KeyboardInteractivePromptHeader); prompt != "" {
+			return util.KeyboardInteractiveRequired{Prompt: prompt}
+		}
 		return util.Unauthorized{}
+	} else if rsp.StatusCode == http.StatusForbidden {
+		return c.refusalError(rsp, util.Forbidden{})
+	} else if rsp.StatusCode == http.StatusNotFound {
+		return util.NotFound{}
+	} else if rsp.StatusCode == http.StatusServiceUnavailable {
+		// the body explains why the server refused the conversation
+		message, _ := io.ReadAll(io.LimitReader(rsp.Body, maxRefusalMessageLength))
+		return util.ServiceUnavailable{Message: string(message)}
+	} else if rsp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := strconv.Atoi(rsp.Header.Get("Retry-After"))
+		return c.refusalError(rsp, util.TooManyRequests{RetryAfter: time.Duration(max(retryAfter, 0)) * time.Second})
 	} else {
 		return fmt.Errorf("returned non-200 and non-401 status code: %d", rsp.StatusCode)
 	}
 }
 
+// returns refusal along with the Disconnect sent by the server in the body of the refusal, if any
+func (c *Conversation) refusalError(rsp *http.Response, refusal error) error {
+	c.handleConversationMessages(rsp, 0)
+	if disconnect, ok := AsDisconnect(context.Cause(c.context)); ok {
+		return fmt.Errorf("%w: %w", refusal, disconnect)
+	}
+	return refusal
+}
+
 func NewServerConversation(ctx context.Context, controlStream http3.Stream, qconn quic.Connection, messageSender util.MessageSender, maxPacketsize uint64) (*Conversation, error) {
 	backgroundContext, backgroundCancelFunc := context.WithCancelCause(ctx)
 
@@ -186,6 +266,7 @@ func NewServerConversation(ctx context.Context, controlStream http3.Stream, qcon
 		context:             backgroundContext,
 		cancelContext:       backgroundCancelFunc,
 		conversationID:      convID,
+		protocolVersion:     ssh3Messages.MaxProtocolVersion,
 	}
 	return conv, nil
 }
@@ -196,7 +277,11 @@ type StreamByteReader struct {
 
 func (r *StreamByteReader) ReadByte() (byte, error) {
 	buf := [1]byte{0}
-	_, err := r.Stream.Read(buf[:])
+	n, err := r.Stream.Read(buf[:])
+	// the last byte of the stream can be returned along with io.EOF
+	if n == 1 && err == io.EOF {
+		err = nil
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -208,9 +293,49 @@ func (c *Conversation) OpenChannel(channelType string, maxPacketSize uint64, dat
 	if err != nil {
 		return nil, err
 	}
+	return c.newChannel(str, channelType, maxPacketSize, datagramsQueueSize), nil
+}
+
+// OpenChannelContext opens a channel as OpenChannel does, but waits until ctx is done for the
+// peer to allow a new stream instead of failing when the stream limit is reached
+func (c *Conversation) OpenChannelContext(ctx context.Context, channelType string, maxPacketSize uint64, datagramsQueueSize uint64) (Channel, error) {
+	str, err := c.streamCreator.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.newChannel(str, channelType, maxPacketSize, datagramsQueueSize), nil
+}
+
+// OpenExtensionChannelContext opens a channel of a type registered using RegisterChannelType,
+// header being the type-specific header parsed by the peer. See OpenChannelContext.
+func (c *Conversation) OpenExtensionChannelContext(ctx context.Context, channelType string, maxPacketSize uint64, datagramsQueueSize uint64, header []byte) (Channel, error) {
+	str, err := c.streamCreator.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	channel := NewChannel(uint64(c.controlStream.StreamID()), c.conversationID, uint64(str.StreamID()), channelType, maxPacketSize, &StreamByteReader{str}, str, nil, c.channelsManager, true, true, false, datagramsQueueSize, header)
+	channel.setProtocolVersion(c.protocolVersion)
+	c.setupCompression(channel)
+	channel.setBandwidthLimiter(c.bandwidthLimiter.Load)
+	channel.setDatagramSender(c.getDatagramSenderForChannel(channel.ChannelID()))
+	channel.maybeSendHeader()
+	c.addOpenedChannel(channel)
+	return channel, nil
+}
+
+func (c *Conversation) newChannel(str quic.Stream, channelType string, maxPacketSize uint64, datagramsQueueSize uint64) Channel {
 	channel := NewChannel(uint64(c.controlStream.StreamID()), c.conversationID, uint64(str.StreamID()), channelType, maxPacketSize, &StreamByteReader{str}, str, nil, c.channelsManager, true, true, false, datagramsQueueSize, nil)
+	channel.setProtocolVersion(c.protocolVersion)
+	c.setupCompression(channel)
+	channel.setBandwidthLimiter(c.bandwidthLimiter.Load)
+	c.addOpenedChannel(channel)
+	return channel
+}
+
+func (c *Conversation) addOpenedChannel(channel Channel) {
 	c.channelsManager.addChannel(channel)
-	return channel, nil
+	_, span := tracer.Start(c.context, "ssh3.open_channel", trace.WithAttributes(ChannelAttributes(channel)...))
+	span.End()
 }
 
 func (c *Conversation) OpenUDPForwardingChannel(maxPacketSize uint64, datagramsQueueSize uint64, localAddr *net.UDPAddr, remoteAddr *net.UDPAddr) (Channel, error) {
@@ -219,13 +344,33 @@ func (c *Conversation) OpenUDPForwardingChannel(maxPacketSize uint64, datagramsQ
 	if err != nil {
 		return nil, err
 	}
+	return c.newUDPForwardingChannel(str, maxPacketSize, datagramsQueueSize, remoteAddr), nil
+}
+
+// OpenUDPForwardingChannelContext waits until ctx is done for a new stream, see OpenChannelContext
+func (c *Conversation) OpenUDPForwardingChannelContext(ctx context.Context, maxPacketSize uint64, datagramsQueueSize uint64, localAddr *net.UDPAddr, remoteAddr *net.UDPAddr) (Channel, error) {
+	str, err := c.streamCreator.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.newUDPForwardingChannel(str, maxPacketSize, datagramsQueueSize, remoteAddr), nil
+}
+
+func (c *Conversation) newUDPForwardingChannel(str quic.Stream, maxPacketSize uint64, datagramsQueueSize uint64, remoteAddr *net.UDPAddr) Channel {
 	additionalBytes := buildForwardingChannelAdditionalBytes(remoteAddr.IP, uint16(remoteAddr.Port))
 
 	channel := NewChannel(uint64(c.controlStream.StreamID()), c.conversationID, uint64(str.StreamID()), "direct-udp", maxPacketSize, &StreamByteReader{str}, str, nil, c.channelsManager, true, true, false, datagramsQueueSize, additionalBytes)
+	channel.setProtocolVersion(c.protocolVersion)
+	c.setupCompression(channel)
+	channel.setBandwidthLimiter(c.bandwidthLimiter.Load)
 	channel.setDatagramSender(c.getDatagramSenderForChannel(channel.ChannelID()))
 	channel.maybeSendHeader()
-	c.channelsManager.addChannel(channel)
-	return &UDPForwardingChannelImpl{Channel: channel, RemoteAddr: remoteAddr}, nil
+	forwardingChannel := &UDPForwardingChannelImpl{Channel: channel, RemoteAddr: remoteAddr}
+	c.channelsManager.addChannel(forwardingChannel)
+	_, span := tracer.Start(c.context, "ssh3.open_channel", trace.WithAttributes(ChannelAttributes(forwardingChannel)...),
+		trace.WithAttributes(attribute.String("ssh3.remote_addr", remoteAddr.String())))
+	span.End()
+	return forwardingChannel
 }
 
 func (c *Conversation) OpenTCPForwardingChannel(maxPacketSize uint64, datagramsQueueSize uint64, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (Channel, error) {
@@ -234,19 +379,93 @@ func (c *Conversation) OpenTCPForwardingChannel(maxPacketSize uint64, datagramsQ
 	if err != nil {
 		return nil, err
 	}
+	return c.newTCPForwardingChannel(str, maxPacketSize, datagramsQueueSize, remoteAddr), nil
+}
+
+// OpenTCPForwardingChannelContext waits until ctx is done for a new stream, see OpenChannelContext
+func (c *Conversation) OpenTCPForwardingChannelContext(ctx context.Context, maxPacketSize uint64, datagramsQueueSize uint64, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (Channel, error) {
+	str, err := c.streamCreator.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.newTCPForwardingChannel(str, maxPacketSize, datagramsQueueSize, remoteAddr), nil
+}
+
+func (c *Conversation) newTCPForwardingChannel(str quic.Stream, maxPacketSize uint64, datagramsQueueSize uint64, remoteAddr *net.TCPAddr) Channel {
 	additionalBytes := buildForwardingChannelAdditionalBytes(remoteAddr.IP, uint16(remoteAddr.Port))
 
 	channel := NewChannel(uint64(c.controlStream.StreamID()), c.conversationID, uint64(str.StreamID()), "direct-tcp", maxPacketSize, &StreamByteReader{str}, str, nil, c.channelsManager, true, true, false, datagramsQueueSize, additionalBytes)
+	channel.setProtocolVersion(c.protocolVersion)
+	c.setupCompression(channel)
+	channel.setBandwidthLimiter(c.bandwidthLimiter.Load)
 	channel.maybeSendHeader()
-	c.channelsManager.addChannel(channel)
-	return &TCPForwardingChannelImpl{Channel: channel, RemoteAddr: remoteAddr}, nil
+	forwardingChannel := &TCPForwardingChannelImpl{Channel: channel, RemoteAddr: remoteAddr}
+	c.channelsManager.addChannel(forwardingChannel)
+	_, span := tracer.Start(c.context, "ssh3.open_channel", trace.WithAttributes(ChannelAttributes(forwardingChannel)...),
+		trace.WithAttributes(attribute.String("ssh3.remote_addr", remoteAddr.String())))
+	span.End()
+	return forwardingChannel
+}
+
+// ChannelOpenFilter is called on new channels before confirming them. A non-nil
+// ChannelOpenFailure refuses the channel with its reason code and error message.
+type ChannelOpenFilter func(channel Channel) *ChannelOpenFailure
+
+// SetChannelOpenFilter sets the filter applied by AcceptChannel, it must be set before
+// accepting channels
+func (c *Conversation) SetChannelOpenFilter(filter ChannelOpenFilter) {
+	c.channelOpenFilter = filter
+}
+
+// DeferChannelConfirmation makes AcceptChannel return the channels of these types without
+// confirming them, their handlers then confirming them using ConfirmChannel or refusing them
+// using RejectChannel, e.g. once the destination of a forwarding is reached. It must be called
+// before accepting channels.
+func (c *Conversation) DeferChannelConfirmation(channelTypes ...string) {
+	if c.deferredChannelTypes == nil {
+		c.deferredChannelTypes = make(map[string]bool)
+	}
+	for _, channelType := range channelTypes {
+		c.deferredChannelTypes[channelType] = true
+	}
+}
+
+// ConfirmChannel confirms a channel whose confirmation was deferred, see DeferChannelConfirmation
+func (c *Conversation) ConfirmChannel(channel Channel) error {
+	if err := channel.confirmChannel(c.maxPacketSize); err != nil {
+		return err
+	}
+	_, span := tracer.Start(c.context, "ssh3.accept_channel", trace.WithAttributes(ChannelAttributes(channel)...))
+	span.End()
+	return nil
+}
+
+// RejectChannel refuses a channel whose confirmation was deferred with the reason code and error
+// message of failure, then closes it
+func (c *Conversation) RejectChannel(channel Channel, failure *ChannelOpenFailure) error {
+	log.Info().Msgf("refusing %s channel %d: %s", channel.ChannelType(), channel.ChannelID(), failure.ErrorMsg)
+	err := channel.rejectChannel(failure.ReasonCode, failure.ErrorMsg)
+	c.channelsManager.removeChannel(channel)
+	_, span := tracer.Start(c.context, "ssh3.reject_channel", trace.WithAttributes(ChannelAttributes(channel)...),
+		trace.WithAttributes(attribute.Int64("ssh3.reason_code", int64(failure.ReasonCode))))
+	span.End()
+	return err
 }
 
 func (c *Conversation) AcceptChannel(ctx context.Context) (Channel, error) {
 	for {
 		if channel := c.channelsAcceptQueue.Next(); channel != nil {
-			channel.confirmChannel(c.maxPacketSize)
+			// add the channel first so that its confirmation is traced
 			c.channelsManager.addChannel(channel)
+			if c.channelOpenFilter != nil {
+				if failure := c.channelOpenFilter(channel); failure != nil {
+					c.RejectChannel(channel, failure)
+					continue
+				}
+			}
+			if !c.deferredChannelTypes[channel.ChannelType()] {
+				c.ConfirmChannel(channel)
+			}
 			return channel, nil
 		}
 		select {
@@ -281,6 +500,18 @@ func (c *Conversation) Close() {
 	c.cancelContext(nil)
 }
 
+// SetBandwidthLimiter throttles the data of the channels of the conversation, including the ones
+// already open, using limiter. A nil limiter lifts the limits.
+func (c *Conversation) SetBandwidthLimiter(limiter *BandwidthLimiter) {
+	c.bandwidthLimiter.Store(limiter)
+}
+
+// SetMessageTracer traces the messages of the channels opened or accepted afterwards.
+// The caller remains responsible for closing the tracer.
+func (c *Conversation) SetMessageTracer(tracer MessageTracer) {
+	c.channelsManager.setMessageTracer(tracer)
+}
+
 func (c *Conversation) Context() context.Context {
 	return c.context
 }
@@ -294,6 +525,11 @@ func (c *Conversation) getDatagramSenderForChannel(channelID util.ChannelID) fun
 	}
 }
 
+// Channels returns the channels currently registered in the conversation
+func (c *Conversation) Channels() []Channel {
+	return c.channelsManager.getChannels()
+}
+
 func (c *Conversation) ConversationID() ConversationID {
 	return c.conversationID
 }
@@ -0,0 +1,110 @@
+package ssh3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Disconnect is the reason why the server ended the conversation or refused to establish it,
+// sent in a disconnect message as SSH_MSG_DISCONNECT (RFC 4253), e.g.
+// SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE after too many authentication failures
+type Disconnect struct {
+	ReasonCode  uint64
+	Description string
+	LanguageTag string
+}
+
+func (d Disconnect) Error() string {
+	return fmt.Sprintf("Disconnected: reason: %d (%s): %s", d.ReasonCode, d.Reason(), d.Description)
+}
+
+// Reason returns the name of the reason code
+func (d Disconnect) Reason() string {
+	switch d.ReasonCode {
+	case ssh3Messages.SSH_DISCONNECT_HOST_NOT_ALLOWED_TO_CONNECT:
+		return "host not allowed to connect"
+	case ssh3Messages.SSH_DISCONNECT_PROTOCOL_ERROR:
+		return "protocol error"
+	case ssh3Messages.SSH_DISCONNECT_KEY_EXCHANGE_FAILED:
+		return "key exchange failed"
+	case ssh3Messages.SSH_DISCONNECT_MAC_ERROR:
+		return "MAC error"
+	case ssh3Messages.SSH_DISCONNECT_COMPRESSION_ERROR:
+		return "compression error"
+	case ssh3Messages.SSH_DISCONNECT_SERVICE_NOT_AVAILABLE:
+		return "service not available"
+	case ssh3Messages.SSH_DISCONNECT_PROTOCOL_VERSION_NOT_SUPPORTED:
+		return "protocol version not supported"
+	case ssh3Messages.SSH_DISCONNECT_HOST_KEY_NOT_VERIFIABLE:
+		return "host key not verifiable"
+	case ssh3Messages.SSH_DISCONNECT_CONNECTION_LOST:
+		return "connection lost"
+	case ssh3Messages.SSH_DISCONNECT_BY_APPLICATION:
+		return "disconnected by application"
+	case ssh3Messages.SSH_DISCONNECT_TOO_MANY_CONNECTIONS:
+		return "too many connections"
+	case ssh3Messages.SSH_DISCONNECT_AUTH_CANCELLED_BY_USER:
+		return "authentication cancelled by user"
+	case ssh3Messages.SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE:
+		return "no more authentication methods available"
+	case ssh3Messages.SSH_DISCONNECT_ILLEGAL_USER_NAME:
+		return "illegal user name"
+	default:
+		return "unknown reason"
+	}
+}
+
+func (d Disconnect) message() *ssh3Messages.DisconnectMessage {
+	return &ssh3Messages.DisconnectMessage{ReasonCode: d.ReasonCode, DescriptionUTF8: d.Description, LanguageTag: d.LanguageTag}
+}
+
+// AsDisconnect returns the reason why the server ended the conversation if err is a Disconnect,
+// e.g. to print it rather than the error of the channel that ended along with the conversation
+func AsDisconnect(err error) (Disconnect, bool) {
+	var disconnect Disconnect
+	if errors.As(err, &disconnect) {
+		return disconnect, true
+	}
+	return Disconnect{}, false
+}
+
+// Disconnect sends disconnect to the client before closing the conversation, the client then
+// telling its user why the conversation ended. It is called by the servers, which do not read
+// the messages sent by the clients on the control stream.
+func (c *Conversation) Disconnect(disconnect Disconnect) error {
+	defer c.Close()
+	log.Debug().Msgf("disconnecting conversation %s: %s", c.conversationID, disconnect)
+	_, err := NewMessageWriter(c.controlStream).WriteMessage(disconnect.message())
+	return err
+}
+
+// PeerDisconnect returns the reason why the server ended the conversation, if it sent one. As
+// the disconnect message may arrive after the end of the channels, it waits up to timeout for
+// the end of the conversation.
+func (c *Conversation) PeerDisconnect(timeout time.Duration) (Disconnect, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.context.Done():
+	case <-timer.C:
+	}
+	return AsDisconnect(context.Cause(c.context))
+}
+
+// WriteDisconnectResponse refuses the request establishing a conversation with statusCode, its
+// body carrying disconnect to tell the client why
+func WriteDisconnectResponse(w http.ResponseWriter, statusCode int, disconnect Disconnect) {
+	message := disconnect.message()
+	encoded := make([]byte, message.Length())
+	// the buffer has the length of the message
+	message.Write(encoded)
+	w.Header().Set("Content-Type", ConversationMessagesContentType)
+	w.WriteHeader(statusCode)
+	w.Write(encoded)
+}
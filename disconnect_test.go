@@ -0,0 +1,64 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Disconnect", func() {
+	tooManyFailures := ssh3.Disconnect{
+		ReasonCode:  ssh3Messages.SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE,
+		Description: "too many authentication failures, retry in 1m0s",
+		LanguageTag: "en",
+	}
+
+	It("Names the reason codes", func() {
+		Expect(tooManyFailures.Reason()).To(Equal("no more authentication methods available"))
+		Expect(tooManyFailures.Error()).To(ContainSubstring("too many authentication failures"))
+		Expect(ssh3.Disconnect{ReasonCode: ssh3Messages.SSH_DISCONNECT_PROTOCOL_VERSION_NOT_SUPPORTED}.Reason()).To(Equal("protocol version not supported"))
+		Expect(ssh3.Disconnect{ReasonCode: 0xFE000001}.Reason()).To(Equal("unknown reason"))
+	})
+
+	It("Carries the reason of the refusals in their body", func() {
+		recorder := httptest.NewRecorder()
+		ssh3.WriteDisconnectResponse(recorder, http.StatusTooManyRequests, tooManyFailures)
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal(ssh3.ConversationMessagesContentType))
+		message, err := ssh3Messages.ParseMessage(bytes.NewReader(recorder.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message).To(Equal(&ssh3Messages.DisconnectMessage{
+			ReasonCode:      ssh3Messages.SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE,
+			DescriptionUTF8: "too many authentication failures, retry in 1m0s",
+			LanguageTag:     "en",
+		}))
+
+		// the refusal can still be told apart
+		err = ssh3.RefusalError(recorder.Result(), util.TooManyRequests{RetryAfter: time.Minute})
+		disconnect, ok := ssh3.AsDisconnect(err)
+		Expect(ok).To(BeTrue())
+		Expect(disconnect).To(Equal(tooManyFailures))
+		var tooManyRequests util.TooManyRequests
+		Expect(errors.As(err, &tooManyRequests)).To(BeTrue())
+		Expect(tooManyRequests.RetryAfter).To(Equal(time.Minute))
+	})
+
+	It("Ignores the bodies of the servers predating the disconnect messages", func() {
+		recorder := httptest.NewRecorder()
+		recorder.WriteHeader(http.StatusForbidden)
+		recorder.Write([]byte("Unsupported version"))
+		err := ssh3.RefusalError(recorder.Result(), util.Forbidden{})
+		Expect(err).To(Equal(util.Forbidden{}))
+		_, ok := ssh3.AsDisconnect(err)
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,185 @@
+package ssh3
+
+import (
+	"context"
+	"reflect"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ChannelRequestHandler handles the channel requests of a type, see HandleChannelRequest
+type ChannelRequestHandler interface {
+	HandleChannelRequest(ctx context.Context, channel Channel, request ssh3Messages.ChannelRequest, wantReply bool) error
+}
+
+// ChannelRequestHandlerFunc handles the channel requests of type R, e.g. *message.PtyRequest
+type ChannelRequestHandlerFunc[R ssh3Messages.ChannelRequest] func(ctx context.Context, channel Channel, request R, wantReply bool) error
+
+func (f ChannelRequestHandlerFunc[R]) HandleChannelRequest(ctx context.Context, channel Channel, request ssh3Messages.ChannelRequest, wantReply bool) error {
+	return f(ctx, channel, request.(R), wantReply)
+}
+
+// DataHandler handles the data and extended data messages of the channels
+type DataHandler interface {
+	HandleData(ctx context.Context, channel Channel, message *ssh3Messages.DataOrExtendedDataMessage) error
+}
+
+type DataHandlerFunc func(ctx context.Context, channel Channel, message *ssh3Messages.DataOrExtendedDataMessage) error
+
+func (f DataHandlerFunc) HandleData(ctx context.Context, channel Channel, message *ssh3Messages.DataOrExtendedDataMessage) error {
+	return f(ctx, channel, message)
+}
+
+// EOFHandler handles the channel EOF messages, sent by the peers after their last data
+type EOFHandler interface {
+	HandleEOF(ctx context.Context, channel Channel) error
+}
+
+type EOFHandlerFunc func(ctx context.Context, channel Channel) error
+
+func (f EOFHandlerFunc) HandleEOF(ctx context.Context, channel Channel) error {
+	return f(ctx, channel)
+}
+
+// PreRequestHook is called before the handler of each channel request, e.g. by a policy plugin.
+// A non-nil error refuses the request: it is not handled and Dispatch returns the error.
+type PreRequestHook func(ctx context.Context, channel Channel, message *ssh3Messages.ChannelRequestMessage) error
+
+// PostRequestHook is called after each channel request with the error of its handler or of the
+// hook that refused it, e.g. to audit the requests
+type PostRequestHook func(ctx context.Context, channel Channel, message *ssh3Messages.ChannelRequestMessage, err error)
+
+// ChannelDispatcher dispatches the messages of the channels to the handlers of their types,
+// running the hooks registered around the channel requests. It also chains the channel open
+// filters of the conversations. The handlers and hooks must be registered before dispatching.
+type ChannelDispatcher struct {
+	requestHandlers    map[reflect.Type]ChannelRequestHandler
+	dataHandler        DataHandler
+	eofHandler         EOFHandler
+	preRequestHooks    []PreRequestHook
+	postRequestHooks   []PostRequestHook
+	channelOpenFilters []ChannelOpenFilter
+	// replies to the requests sent with WantReply, if the peer advertised FeatureRequestReplies
+	replyToRequests bool
+}
+
+func NewChannelDispatcher() *ChannelDispatcher {
+	return &ChannelDispatcher{requestHandlers: make(map[reflect.Type]ChannelRequestHandler)}
+}
+
+// HandleChannelRequest registers the handler of the channel requests of type R, replacing the
+// previous one, e.g.
+//
+//	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *message.PtyRequest, wantReply bool) error {
+//		...
+//	})
+func HandleChannelRequest[R ssh3Messages.ChannelRequest](d *ChannelDispatcher, handler ChannelRequestHandlerFunc[R]) {
+	d.requestHandlers[reflect.TypeOf((*R)(nil)).Elem()] = handler
+}
+
+// HandleData registers the handler of the data messages, which are dropped without handler
+func (d *ChannelDispatcher) HandleData(handler DataHandler) {
+	d.dataHandler = handler
+}
+
+// HandleEOF registers the handler of the channel EOF messages, which are ignored without handler
+func (d *ChannelDispatcher) HandleEOF(handler EOFHandler) {
+	d.eofHandler = handler
+}
+
+// AddPreRequestHook adds a hook called before the handlers of the channel requests, in the order
+// of registration
+func (d *ChannelDispatcher) AddPreRequestHook(hook PreRequestHook) {
+	d.preRequestHooks = append(d.preRequestHooks, hook)
+}
+
+// AddPostRequestHook adds a hook called after the handlers of the channel requests, in the order
+// of registration
+func (d *ChannelDispatcher) AddPostRequestHook(hook PostRequestHook) {
+	d.postRequestHooks = append(d.postRequestHooks, hook)
+}
+
+// ReplyToRequests makes the dispatcher reply to the channel requests sent with WantReply if peer
+// advertised FeatureRequestReplies: with a success if the request was handled without error, and
+// with a failure if it was refused, failed or has no handler
+func (d *ChannelDispatcher) ReplyToRequests(peer *ExtInfo) {
+	d.replyToRequests = peer.HasFeature(FeatureRequestReplies)
+}
+
+// AddChannelOpenFilter adds a filter to the ones returned by ChannelOpenFilter, the channels
+// being refused by the first filter that refuses them
+func (d *ChannelDispatcher) AddChannelOpenFilter(filter ChannelOpenFilter) {
+	d.channelOpenFilters = append(d.channelOpenFilters, filter)
+}
+
+// ChannelOpenFilter returns the chain of the filters of the dispatcher, to be set on the
+// conversations using Conversation.SetChannelOpenFilter
+func (d *ChannelDispatcher) ChannelOpenFilter() ChannelOpenFilter {
+	filters := d.channelOpenFilters
+	return func(channel Channel) *ChannelOpenFailure {
+		for _, filter := range filters {
+			if failure := filter(channel); failure != nil {
+				return failure
+			}
+		}
+		return nil
+	}
+}
+
+// Dispatch handles a message received on channel, returning the error of its handler. The
+// channel requests without handler are ignored, their hooks being still run, and refused if the
+// dispatcher replies to the requests.
+func (d *ChannelDispatcher) Dispatch(ctx context.Context, channel Channel, message ssh3Messages.Message) error {
+	switch message := message.(type) {
+	case *ssh3Messages.ChannelRequestMessage:
+		return d.dispatchRequest(ctx, channel, message)
+	case *ssh3Messages.DataOrExtendedDataMessage:
+		if d.dataHandler != nil {
+			return d.dataHandler.HandleData(ctx, channel, message)
+		}
+		log.Debug().Msgf("dropping data on %s channel %d", channel.ChannelType(), channel.ChannelID())
+	case *ssh3Messages.ChannelEOFMessage:
+		if d.eofHandler != nil {
+			return d.eofHandler.HandleEOF(ctx, channel)
+		}
+	}
+	return nil
+}
+
+func (d *ChannelDispatcher) dispatchRequest(ctx context.Context, channel Channel, message *ssh3Messages.ChannelRequestMessage) error {
+	ctx, span := tracer.Start(ctx, "ssh3.channel_request", trace.WithAttributes(
+		attribute.String("ssh3.request_type", message.ChannelRequest.RequestTypeStr()),
+		attribute.Bool("ssh3.want_reply", message.WantReply)))
+	defer span.End()
+	var err error
+	for _, hook := range d.preRequestHooks {
+		if err = hook(ctx, channel, message); err != nil {
+			log.Info().Msgf("refusing %s request on %s channel %d: %s", message.ChannelRequest.RequestTypeStr(), channel.ChannelType(), channel.ChannelID(), err)
+			break
+		}
+	}
+	handled := false
+	if err == nil {
+		if handler, ok := d.requestHandlers[reflect.TypeOf(message.ChannelRequest)]; ok {
+			err = handler.HandleChannelRequest(ctx, channel, message.ChannelRequest, message.WantReply)
+			handled = true
+		} else {
+			log.Debug().Msgf("ignoring request of type %T on %s channel %d", message.ChannelRequest, channel.ChannelType(), channel.ChannelID())
+		}
+	}
+	if d.replyToRequests && message.WantReply {
+		if replyErr := ReplyRequest(channel, handled && err == nil); replyErr != nil {
+			log.Warn().Msgf("could not reply to %s request on %s channel %d: %s", message.ChannelRequest.RequestTypeStr(), channel.ChannelType(), channel.ChannelID(), replyErr)
+		}
+	}
+	for _, hook := range d.postRequestHooks {
+		hook(ctx, channel, message, err)
+	}
+	util.SetSpanError(span, err)
+	return err
+}
@@ -0,0 +1,113 @@
+package ssh3_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Channel dispatcher", func() {
+	var channel ssh3.Channel
+
+	BeforeEach(func() {
+		channel = ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, nil, nil, nil, nil, true, true, true, 0, nil)
+	})
+
+	requestMessage := func(request ssh3Messages.ChannelRequest) *ssh3Messages.ChannelRequestMessage {
+		return &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: request}
+	}
+
+	It("Dispatches the messages to the handlers of their types", func() {
+		dispatcher := ssh3.NewChannelDispatcher()
+		var pty *ssh3Messages.PtyRequest
+		var wantReply bool
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.PtyRequest, w bool) error {
+			pty, wantReply = request, w
+			return nil
+		})
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.ExecRequest, w bool) error {
+			return errors.New("exec failed")
+		})
+		var data string
+		dispatcher.HandleData(ssh3.DataHandlerFunc(func(ctx context.Context, c ssh3.Channel, message *ssh3Messages.DataOrExtendedDataMessage) error {
+			data += message.Data
+			return nil
+		}))
+		eof := false
+		dispatcher.HandleEOF(ssh3.EOFHandlerFunc(func(ctx context.Context, c ssh3.Channel) error {
+			eof = true
+			return nil
+		}))
+
+		ctx := context.Background()
+		Expect(dispatcher.Dispatch(ctx, channel, requestMessage(&ssh3Messages.PtyRequest{Term: "xterm"}))).To(Succeed())
+		Expect(pty.Term).To(Equal("xterm"))
+		Expect(wantReply).To(BeTrue())
+		Expect(dispatcher.Dispatch(ctx, channel, requestMessage(&ssh3Messages.ExecRequest{Command: "ls"}))).To(MatchError("exec failed"))
+		// the requests without handler are ignored
+		Expect(dispatcher.Dispatch(ctx, channel, requestMessage(&ssh3Messages.ShellRequest{}))).To(Succeed())
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.DataOrExtendedDataMessage{Data: "hello"})).To(Succeed())
+		Expect(data).To(Equal("hello"))
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelEOFMessage{})).To(Succeed())
+		Expect(eof).To(BeTrue())
+	})
+
+	It("Runs the hooks around the requests", func() {
+		dispatcher := ssh3.NewChannelDispatcher()
+		var events []string
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.ExecRequest, wantReply bool) error {
+			events = append(events, "exec "+request.Command)
+			return nil
+		})
+		dispatcher.AddPreRequestHook(func(ctx context.Context, c ssh3.Channel, message *ssh3Messages.ChannelRequestMessage) error {
+			events = append(events, "pre "+message.ChannelRequest.RequestTypeStr())
+			if exec, ok := message.ChannelRequest.(*ssh3Messages.ExecRequest); ok && exec.Command == "reboot" {
+				return errors.New("not permitted")
+			}
+			return nil
+		})
+		dispatcher.AddPreRequestHook(func(ctx context.Context, c ssh3.Channel, message *ssh3Messages.ChannelRequestMessage) error {
+			events = append(events, "second pre")
+			return nil
+		})
+		dispatcher.AddPostRequestHook(func(ctx context.Context, c ssh3.Channel, message *ssh3Messages.ChannelRequestMessage, err error) {
+			events = append(events, "post "+message.ChannelRequest.RequestTypeStr())
+			if err != nil {
+				events = append(events, "refused: "+err.Error())
+			}
+		})
+
+		Expect(dispatcher.Dispatch(context.Background(), channel, requestMessage(&ssh3Messages.ExecRequest{Command: "ls"}))).To(Succeed())
+		Expect(dispatcher.Dispatch(context.Background(), channel, requestMessage(&ssh3Messages.ExecRequest{Command: "reboot"}))).To(MatchError("not permitted"))
+		Expect(events).To(Equal([]string{
+			"pre exec", "second pre", "exec ls", "post exec",
+			"pre exec", "post exec", "refused: not permitted",
+		}))
+	})
+
+	It("Chains the channel open filters", func() {
+		dispatcher := ssh3.NewChannelDispatcher()
+		Expect(dispatcher.ChannelOpenFilter()(channel)).To(BeNil())
+
+		calls := 0
+		dispatcher.AddChannelOpenFilter(func(c ssh3.Channel) *ssh3.ChannelOpenFailure {
+			calls++
+			return nil
+		})
+		dispatcher.AddChannelOpenFilter(func(c ssh3.Channel) *ssh3.ChannelOpenFailure {
+			return ssh3.UnsupportedChannelType(c.ChannelType())
+		})
+		dispatcher.AddChannelOpenFilter(func(c ssh3.Channel) *ssh3.ChannelOpenFailure {
+			Fail("the channel was already refused")
+			return nil
+		})
+		failure := dispatcher.ChannelOpenFilter()(channel)
+		Expect(failure).ToNot(BeNil())
+		Expect(calls).To(Equal(1))
+	})
+})
@@ -0,0 +1,48 @@
+package ssh3
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EnableCompression makes channel compress the data it sends as if its conversation negotiated
+// config, for the tests of the ssh3_test package
+func EnableCompression(channel Channel, config CompressionConfig) {
+	channel.setCompressor(newChannelCompressor(config))
+}
+
+// SetBandwidthLimiter throttles the data of channel as if its conversation had limiter, for the
+// tests of the ssh3_test package
+func SetBandwidthLimiter(channel Channel, limiter *BandwidthLimiter) {
+	channel.setBandwidthLimiter(func() *BandwidthLimiter { return limiter })
+}
+
+// ReserveSendBandwidth reserves n bytes to send on limiter at now and returns how long to wait
+// before sending them
+func ReserveSendBandwidth(limiter *BandwidthLimiter, n int, now time.Time) time.Duration {
+	return limiter.send.reserve(n, now)
+}
+
+// LookupServiceEndpointsWith looks up the HTTPS records of host using the RDATA returned by query,
+// for the tests of the ssh3_test package
+func LookupServiceEndpointsWith(ctx context.Context, host string, query func(name string) [][]byte) ([]ServiceEndpoint, error) {
+	return lookupServiceEndpoints(ctx, host, func(ctx context.Context, name string, _ dnsmessage.Type) ([][]byte, error) {
+		return query(name), nil
+	})
+}
+
+// QueryHTTPSRecords returns the RDATA of the HTTPS records of name answered by nameserver
+func QueryHTTPSRecords(ctx context.Context, nameserver string, name string) ([][]byte, error) {
+	return queryNameserver(ctx, nameserver, name, dnsTypeHTTPS)
+}
+
+// RefusalError returns the error of a conversation refused with rsp, for the tests of the
+// ssh3_test package
+func RefusalError(rsp *http.Response, refusal error) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	conv := &Conversation{context: ctx, cancelContext: cancel}
+	return conv.refusalError(rsp, refusal)
+}
@@ -0,0 +1,143 @@
+package ssh3
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// ExtInfoHeader carries the ExtInfo of a peer on the CONNECT request establishing a conversation
+// and on its response, similarly to the ext-info message of RFC 8308
+const ExtInfoHeader = "Ssh3-Ext-Info"
+
+// ExtInfo lists what a peer supports, so that newer peers do not send what older ones cannot
+// parse, e.g. an unknown request type that would end the channel
+type ExtInfo struct {
+	// the channel types that the peer accepts
+	ChannelTypes []string
+	// the channel request types that the peer parses
+	RequestTypes []string
+	// the optional features that the peer enables, e.g. "datagrams"
+	Features []string
+	// the compression algorithms that the peer enabled, the data being compressed in both
+	// directions if both peers list the algorithm, see CompressionConfig
+	Compression []string
+}
+
+// NewExtInfo returns the ExtInfo of this implementation, accepting the given channel types
+func NewExtInfo(channelTypes []string, features ...string) *ExtInfo {
+	requestTypes := make([]string, 0, len(ssh3Messages.ChannelRequestParseFuncs))
+	for requestType := range ssh3Messages.ChannelRequestParseFuncs {
+		requestTypes = append(requestTypes, requestType)
+	}
+	for requestType := range ssh3Messages.VersionedChannelRequestParseFuncs {
+		requestTypes = append(requestTypes, requestType)
+	}
+	slices.Sort(requestTypes)
+	requestTypes = slices.Compact(requestTypes)
+	return &ExtInfo{
+		ChannelTypes: channelTypes,
+		RequestTypes: requestTypes,
+		Features:     features,
+	}
+}
+
+// String encodes the lists as "name=value,value; name=value", the empty lists being kept so
+// that the peer knows that nothing is supported
+func (e *ExtInfo) String() string {
+	return fmt.Sprintf("channel-types=%s; request-types=%s; features=%s; compression=%s",
+		strings.Join(e.ChannelTypes, ","), strings.Join(e.RequestTypes, ","), strings.Join(e.Features, ","), strings.Join(e.Compression, ","))
+}
+
+// SetHeader sets the ExtInfoHeader of the CONNECT request or of its response
+func (e *ExtInfo) SetHeader(header http.Header) {
+	header.Set(ExtInfoHeader, e.String())
+}
+
+// ParseExtInfo parses the ExtInfoHeader of header, it returns nil if the peer did not send it.
+// The unknown lists are ignored, so that newer peers can add some. The missing lists are nil.
+func ParseExtInfo(header http.Header) *ExtInfo {
+	if _, ok := header[http.CanonicalHeaderKey(ExtInfoHeader)]; !ok {
+		return nil
+	}
+	info := &ExtInfo{}
+	for _, entry := range strings.Split(header.Get(ExtInfoHeader), ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		values := []string{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		switch name {
+		case "channel-types":
+			info.ChannelTypes = values
+		case "request-types":
+			info.RequestTypes = values
+		case "features":
+			info.Features = values
+		case "compression":
+			info.Compression = values
+		}
+	}
+	return info
+}
+
+// the features of the optional request types
+var requestTypeFeatures = map[string]string{
+	"working-directory": "remote_working_directory",
+	"break":             "break",
+	"x11-req":           "x11_forwarding",
+	"reattach":          "session_persistence",
+}
+
+// CheckChannelType returns an UnsupportedFeature, or an error for the extension types, if the
+// channel types are listed without channelType. A nil ExtInfo, as sent by the peers predating
+// it, supports everything.
+func (e *ExtInfo) CheckChannelType(channelType string) error {
+	if e == nil || e.ChannelTypes == nil || slices.Contains(e.ChannelTypes, channelType) {
+		return nil
+	}
+	if feature, ok := channelTypeFeatures[channelType]; ok {
+		return UnsupportedFeature{Feature: feature}
+	}
+	return fmt.Errorf("the peer does not accept %s channels", channelType)
+}
+
+// CheckRequestType returns an UnsupportedFeature if the request types are listed without
+// requestType, see CheckChannelType
+func (e *ExtInfo) CheckRequestType(requestType string) error {
+	if e == nil || e.RequestTypes == nil || slices.Contains(e.RequestTypes, requestType) {
+		return nil
+	}
+	feature, ok := requestTypeFeatures[requestType]
+	if !ok {
+		feature = requestType + " requests"
+	}
+	return UnsupportedFeature{Feature: feature}
+}
+
+// HasFeature reports whether the peer listed the optional feature. Unlike the checks, it
+// returns false for a nil ExtInfo.
+func (e *ExtInfo) HasFeature(feature string) bool {
+	return e != nil && slices.Contains(e.Features, feature)
+}
+
+// PeerExtInfo returns the ExtInfo sent by the peer when establishing the conversation, nil if the
+// peer predates it
+func (c *Conversation) PeerExtInfo() *ExtInfo {
+	return c.peerExtInfo
+}
+
+// PeerChannelTypes returns the channel types that the peer advertised during the conversation
+// setup. It returns false if the peer did not advertise them, e.g. if it runs an older version,
+// in which case it may only accept the built-in types.
+func (c *Conversation) PeerChannelTypes() ([]string, bool) {
+	if c.peerExtInfo == nil || c.peerExtInfo.ChannelTypes == nil {
+		return nil, false
+	}
+	return c.peerExtInfo.ChannelTypes, true
+}
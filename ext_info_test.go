@@ -0,0 +1,44 @@
+package ssh3_test
+
+import (
+	"net/http"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ExtInfo", func() {
+	It("Is carried by a header", func() {
+		header := http.Header{}
+		ssh3.NewExtInfo([]string{"session", "tunnel@example.com"}, "datagrams").SetHeader(header)
+		info := ssh3.ParseExtInfo(header)
+		Expect(info.ChannelTypes).To(Equal([]string{"session", "tunnel@example.com"}))
+		Expect(info.RequestTypes).To(ContainElements("pty-req", "shell", "exec", "working-directory"))
+		Expect(info.HasFeature("datagrams")).To(BeTrue())
+		Expect(info.HasFeature("compression")).To(BeFalse())
+	})
+
+	It("Keeps the empty lists and ignores the unknown ones", func() {
+		header := http.Header{}
+		header.Set(ssh3.ExtInfoHeader, "channel-types=; resumption-tokens=abc; request-types=shell, exec")
+		info := ssh3.ParseExtInfo(header)
+		Expect(info.ChannelTypes).To(BeEmpty())
+		Expect(info.ChannelTypes).ToNot(BeNil())
+		Expect(info.RequestTypes).To(Equal([]string{"shell", "exec"}))
+		Expect(info.Features).To(BeNil())
+
+		Expect(info.CheckChannelType("direct-tcp")).To(MatchError(ssh3.UnsupportedFeature{Feature: "tcp_forwarding"}))
+		Expect(info.CheckRequestType("exec")).To(Succeed())
+		Expect(info.CheckRequestType("working-directory")).To(MatchError(ssh3.UnsupportedFeature{Feature: "remote_working_directory"}))
+	})
+
+	It("Supports everything for the peers predating it", func() {
+		info := ssh3.ParseExtInfo(http.Header{})
+		Expect(info).To(BeNil())
+		Expect(info.CheckChannelType("direct-udp")).To(Succeed())
+		Expect(info.CheckRequestType("break")).To(Succeed())
+		Expect(info.HasFeature("datagrams")).To(BeFalse())
+	})
+})
@@ -0,0 +1,44 @@
+package ssh3
+
+import (
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Unlike SSH (RFC 4254, section 5.2), SSH3 does not need window adjustment messages: each
+// channel being a QUIC stream, its data messages are subject to the stream flow control, and
+// the channels of a conversation to the connection flow control. A peer that does not read the
+// messages of a channel (e.g. a slow consumer of the output of a command) blocks the writes on
+// the channel once its receive window is full, instead of making the writer buffer them.
+//
+// FlowControl sets the receive windows advertised to the peer, bounding the memory used to buffer
+// the received messages that were not read yet. Zero values keep the defaults of quic-go, which
+// grows the windows up to 6MB per channel and 15MB per conversation for fast connections.
+type FlowControl struct {
+	// the receive window of each channel in bytes
+	ChannelReceiveWindow uint64 `json:"channel_receive_window,omitempty"`
+	// the receive window of all the channels of a conversation in bytes
+	ConversationReceiveWindow uint64 `json:"conversation_receive_window,omitempty"`
+}
+
+func (f FlowControl) Validate() error {
+	if f.ChannelReceiveWindow != 0 && f.ConversationReceiveWindow != 0 && f.ConversationReceiveWindow < f.ChannelReceiveWindow {
+		return fmt.Errorf("the conversation receive window (%d bytes) is smaller than the channel receive window (%d bytes)",
+			f.ConversationReceiveWindow, f.ChannelReceiveWindow)
+	}
+	return nil
+}
+
+// ApplyTo sets the receive windows of the QUIC connections using quicConf. The windows are
+// fixed so that they are not increased beyond the configured sizes.
+func (f FlowControl) ApplyTo(quicConf *quic.Config) {
+	if f.ChannelReceiveWindow != 0 {
+		quicConf.InitialStreamReceiveWindow = f.ChannelReceiveWindow
+		quicConf.MaxStreamReceiveWindow = f.ChannelReceiveWindow
+	}
+	if f.ConversationReceiveWindow != 0 {
+		quicConf.InitialConnectionReceiveWindow = f.ConversationReceiveWindow
+		quicConf.MaxConnectionReceiveWindow = f.ConversationReceiveWindow
+	}
+}
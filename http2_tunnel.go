@@ -0,0 +1,472 @@
+package ssh3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog/log"
+)
+
+// When UDP is blocked, the QUIC packets of the conversations can be tunneled over TCP in the body
+// of an HTTP/2 request, as the DATAGRAM capsules of RFC 9297 carrying the UDP payloads of RFC 9298.
+// The QUIC connection, and thus the authentication of the server, is unchanged, the HTTP/2
+// connection only carrying its packets. The Go HTTP/2 clients cannot send Extended CONNECT
+// requests, so the tunnel is a full-duplex POST request to the URL path of the server.
+
+// the header announcing the capsules in the bodies of the tunneling requests and responses
+const capsuleProtocolHeader = "Capsule-Protocol"
+
+// the type of the DATAGRAM capsules
+const capsuleTypeDatagram = 0x00
+
+// the context ID of the UDP payloads in the DATAGRAM capsules
+const udpPayloadContextID = 0
+
+// the largest capsule accepted, the QUIC packets being far smaller
+const maxCapsuleLength = 1 << 16
+
+// the packets waiting to be written to a tunnel, the next ones being dropped as UDP would drop
+// them so that a slow tunnel does not stall the other connections
+const tunnelSendQueueSize = 256
+
+func appendDatagramCapsule(b []byte, payload []byte) []byte {
+	b = util.AppendVarInt(b, capsuleTypeDatagram)
+	b = util.AppendVarInt(b, util.VarIntLen(udpPayloadContextID)+uint64(len(payload)))
+	b = util.AppendVarInt(b, udpPayloadContextID)
+	return append(b, payload...)
+}
+
+// reads the next UDP payload, skipping the other capsules and contexts as required by RFC 9297
+func readDatagramCapsule(r *bufio.Reader) ([]byte, error) {
+	for {
+		capsuleType, err := util.ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := util.ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		if length > maxCapsuleLength {
+			return nil, fmt.Errorf("capsule too large: %d bytes", length)
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		if capsuleType != capsuleTypeDatagram {
+			continue
+		}
+		payload := &util.BytesReadCloser{Reader: bytes.NewReader(value)}
+		contextID, err := util.ReadVarInt(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed DATAGRAM capsule: %w", err)
+		}
+		if contextID != udpPayloadContextID {
+			continue
+		}
+		return value[len(value)-payload.Len():], nil
+	}
+}
+
+// the address of a tunnel, whose string is the address of the HTTP peer so that the server
+// handlers see the address of the client
+type tunnelAddr struct {
+	id     uint64
+	remote string
+}
+
+func (a *tunnelAddr) Network() string { return "http-tunnel" }
+func (a *tunnelAddr) String() string  { return a.remote }
+
+type tunneledPacket struct {
+	payload []byte
+	addr    net.Addr
+}
+
+// delivers the packets received from the tunnels to ReadFrom, as a UDP socket does
+type tunneledPackets struct {
+	packets chan tunneledPacket
+	closed  chan struct{}
+
+	lock            sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+	closeOnce       sync.Once
+}
+
+func newTunneledPackets() *tunneledPackets {
+	return &tunneledPackets{
+		packets:         make(chan tunneledPacket, tunnelSendQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// waits for the packet to be read, returns false if the packets are closed
+func (p *tunneledPackets) deliver(ctx context.Context, packet tunneledPacket) bool {
+	select {
+	case p.packets <- packet:
+		return true
+	case <-p.closed:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *tunneledPackets) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		p.lock.Lock()
+		deadline, deadlineChanged := p.readDeadline, p.deadlineChanged
+		p.lock.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		stopTimer := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+		select {
+		case packet := <-p.packets:
+			stopTimer()
+			return copy(b, packet.payload), packet.addr, nil
+		case <-p.closed:
+			stopTimer()
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineChanged:
+			stopTimer()
+		}
+	}
+}
+
+func (p *tunneledPackets) SetReadDeadline(t time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readDeadline = t
+	close(p.deadlineChanged)
+	p.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetReadBuffer does nothing, the packets being queued rather than buffered by a socket, so that
+// quic-go does not warn that the buffer cannot be set
+func (p *tunneledPackets) SetReadBuffer(bytes int) error { return nil }
+
+// SetWriteBuffer does nothing, the packets being queued rather than buffered by a socket
+func (p *tunneledPackets) SetWriteBuffer(bytes int) error { return nil }
+
+func (p *tunneledPackets) close() {
+	p.closeOnce.Do(func() { close(p.closed) })
+}
+
+// writes the queued packets of a tunnel as capsules
+type tunnelWriter struct {
+	queue chan []byte
+}
+
+func newTunnelWriter() *tunnelWriter {
+	return &tunnelWriter{queue: make(chan []byte, tunnelSendQueueSize)}
+}
+
+// queues a copy of the packet, dropping it if the tunnel is congested
+func (w *tunnelWriter) send(payload []byte) {
+	select {
+	case w.queue <- appendDatagramCapsule(nil, payload):
+	default:
+	}
+}
+
+// writes the capsules until done is closed or a write fails
+func (w *tunnelWriter) run(done <-chan struct{}, writer io.Writer, flush func()) error {
+	for {
+		select {
+		case capsule := <-w.queue:
+			if _, err := writer.Write(capsule); err != nil {
+				return err
+			}
+			// the next packets of a burst are written along
+			for pending := len(w.queue); pending > 0; pending-- {
+				if _, err := writer.Write(<-w.queue); err != nil {
+					return err
+				}
+			}
+			if flush != nil {
+				flush()
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// TunnelConn is the socket of a QUIC connection tunneled in an HTTP request, over HTTP/2 (see
+// DialHTTP2Tunnel) or through a MASQUE proxy (see DialConnectUDP), all its packets being sent to the
+// peer of the tunnel whatever their address
+type TunnelConn struct {
+	*tunneledPackets
+	writer      *tunnelWriter
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	closeTunnel func()
+}
+
+var _ net.PacketConn = &TunnelConn{}
+
+// relays the capsules read from body to ReadFrom and the packets of WriteTo to requestBody, until
+// the tunnel is closed, closeTunnel then aborting the request
+func newTunnelConn(remote string, body io.Reader, requestBody io.WriteCloser, closeTunnel func()) *TunnelConn {
+	conn := &TunnelConn{
+		tunneledPackets: newTunneledPackets(),
+		writer:          newTunnelWriter(),
+		localAddr:       &tunnelAddr{remote: "local"},
+		remoteAddr:      &tunnelAddr{remote: remote},
+		closeTunnel:     closeTunnel,
+	}
+	go func() {
+		defer conn.Close()
+		reader := bufio.NewReader(body)
+		for {
+			payload, err := readDatagramCapsule(reader)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+					log.Debug().Msgf("the tunnel to %s closed: %s", remote, err)
+				}
+				return
+			}
+			if !conn.deliver(context.Background(), tunneledPacket{payload: payload, addr: conn.remoteAddr}) {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer conn.Close()
+		defer requestBody.Close()
+		if err := conn.writer.run(conn.closed, requestBody, nil); err != nil {
+			log.Debug().Msgf("could not write to the tunnel to %s: %s", remote, err)
+		}
+	}()
+	return conn
+}
+
+// sends the request opening a tunnel, that outlives ctx as it only bounds the establishment of
+// the tunnel, cancelTunnel aborting the request if ctx is done first
+func doTunnelRequest(ctx context.Context, do func() (*http.Response, error), cancelTunnel func()) (*http.Response, error) {
+	type result struct {
+		rsp *http.Response
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		rsp, err := do()
+		results <- result{rsp, err}
+	}()
+	select {
+	case result := <-results:
+		return result.rsp, result.err
+	case <-ctx.Done():
+		cancelTunnel()
+		return nil, ctx.Err()
+	}
+}
+
+// DialHTTP2Tunnel opens a tunnel to the server at url (e.g. "https://my-server.example.org/ssh3")
+// for the networks blocking UDP, using client whose transport must negotiate HTTP/2. The QUIC
+// connection is then dialed using the returned socket and its RemoteAddr.
+func DialHTTP2Tunnel(ctx context.Context, client *http.Client, url string) (*TunnelConn, error) {
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(tunnelCtx, http.MethodPost, url, bodyReader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set(capsuleProtocolHeader, "?1")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", GetCurrentVersion())
+
+	rsp, err := doTunnelRequest(ctx, func() (*http.Response, error) { return client.Do(req) }, cancel)
+	if err != nil {
+		cancel()
+		bodyWriter.Close()
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK || rsp.ProtoMajor != 2 {
+		cancel()
+		bodyWriter.Close()
+		rsp.Body.Close()
+		if rsp.ProtoMajor != 2 {
+			return nil, fmt.Errorf("the server answered the tunnel request using %s instead of HTTP/2", rsp.Proto)
+		}
+		return nil, fmt.Errorf("the server refused the tunnel: %s", rsp.Status)
+	}
+	return newTunnelConn(req.URL.Host, rsp.Body, bodyWriter, cancel), nil
+}
+
+func (c *TunnelConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.writer.send(b)
+	return len(b), nil
+}
+
+func (c *TunnelConn) Close() error {
+	c.close()
+	c.closeTunnel()
+	return nil
+}
+
+func (c *TunnelConn) LocalAddr() net.Addr { return c.localAddr }
+
+// RemoteAddr returns the address of the peer to dial the QUIC connection with
+func (c *TunnelConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *TunnelConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// the packets are queued, so that the writes never block
+func (c *TunnelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// HTTP2TunnelServer receives the QUIC packets tunneled by the clients over HTTP/2 (see
+// DialHTTP2Tunnel). It serves the tunneling requests as an http.Handler and is the socket of the
+// QUIC connections tunneled inside, to pass to http3.Server.Serve.
+type HTTP2TunnelServer struct {
+	*tunneledPackets
+	localAddr net.Addr
+
+	lock    sync.Mutex
+	tunnels map[uint64]*tunnelWriter
+	nextID  uint64
+}
+
+var _ net.PacketConn = &HTTP2TunnelServer{}
+
+// NewHTTP2TunnelServer returns a tunnel server whose socket has localAddr, e.g. the TCP address
+// of the HTTP/2 server
+func NewHTTP2TunnelServer(localAddr net.Addr) *HTTP2TunnelServer {
+	return &HTTP2TunnelServer{
+		tunneledPackets: newTunneledPackets(),
+		localAddr:       localAddr,
+		tunnels:         make(map[uint64]*tunnelWriter),
+	}
+}
+
+// IsHTTP2TunnelRequest returns true if r requests a tunnel, the other requests being left to the
+// other handlers
+func IsHTTP2TunnelRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.Header.Get(capsuleProtocolHeader) == "?1"
+}
+
+// ServeHTTP tunnels the QUIC packets of the request until the client or the server closes it
+func (s *HTTP2TunnelServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsHTTP2TunnelRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "the tunnels require HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "cannot stream the response", http.StatusInternalServerError)
+		return
+	}
+	s.lock.Lock()
+	id := s.nextID
+	s.nextID++
+	writer := newTunnelWriter()
+	s.tunnels[id] = writer
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.tunnels, id)
+		s.lock.Unlock()
+	}()
+	addr := &tunnelAddr{id: id, remote: r.RemoteAddr}
+	log.Debug().Msgf("tunneling the QUIC packets of %s over HTTP/2", r.RemoteAddr)
+
+	w.Header().Set(capsuleProtocolHeader, "?1")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		reader := bufio.NewReader(r.Body)
+		for {
+			payload, err := readDatagramCapsule(reader)
+			if err != nil {
+				return
+			}
+			if !s.deliver(ctx, tunneledPacket{payload: payload, addr: addr}) {
+				return
+			}
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.closed:
+		}
+		close(done)
+	}()
+	// the response cannot be written once the handler returns
+	if err := writer.run(done, w, flusher.Flush); err != nil {
+		log.Debug().Msgf("could not write to the tunnel of %s: %s", r.RemoteAddr, err)
+	}
+}
+
+func (s *HTTP2TunnelServer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	tunnel, ok := addr.(*tunnelAddr)
+	if !ok {
+		return 0, fmt.Errorf("not the address of a tunnel: %s", addr)
+	}
+	s.lock.Lock()
+	writer, ok := s.tunnels[tunnel.id]
+	s.lock.Unlock()
+	// the packets to the closed tunnels are lost, as on a broken path
+	if ok {
+		writer.send(b)
+	}
+	return len(b), nil
+}
+
+// Close closes the socket and all the tunnels
+func (s *HTTP2TunnelServer) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *HTTP2TunnelServer) LocalAddr() net.Addr { return s.localAddr }
+
+func (s *HTTP2TunnelServer) SetDeadline(t time.Time) error { return s.SetReadDeadline(t) }
+
+// the packets are queued, so that the writes never block
+func (s *HTTP2TunnelServer) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,80 @@
+package ssh3_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP/2 tunnels", func() {
+	It("Carries a QUIC connection", func() {
+		httpServer := httptest.NewUnstartedServer(nil)
+		httpServer.EnableHTTP2 = true
+		tunnelServer := ssh3.NewHTTP2TunnelServer(httpServer.Listener.Addr())
+		defer tunnelServer.Close()
+		httpServer.Config.Handler = tunnelServer
+		httpServer.StartTLS()
+		defer httpServer.Close()
+
+		quicTLSConf := &tls.Config{Certificates: httpServer.TLS.Certificates, NextProtos: []string{"ssh3-test"}}
+		listener, err := quic.ListenEarly(tunnelServer, quicTLSConf, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			stream, err := conn.AcceptStream(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		tunnelConn, err := ssh3.DialHTTP2Tunnel(ctx, httpServer.Client(), httpServer.URL+"/ssh3")
+		Expect(err).ToNot(HaveOccurred())
+		defer tunnelConn.Close()
+		conn, err := quic.DialEarly(ctx, tunnelConn, tunnelConn.RemoteAddr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"ssh3-test"}}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.CloseWithError(0, "")
+		stream, err := conn.OpenStreamSync(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		data := make([]byte, 256<<10)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		go func() {
+			stream.Write(data)
+			stream.Close()
+		}()
+		echo, err := io.ReadAll(stream)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(echo).To(Equal(data))
+	})
+
+	It("Refuses the other requests", func() {
+		httpServer := httptest.NewUnstartedServer(nil)
+		httpServer.EnableHTTP2 = true
+		tunnelServer := ssh3.NewHTTP2TunnelServer(httpServer.Listener.Addr())
+		defer tunnelServer.Close()
+		httpServer.Config.Handler = tunnelServer
+		httpServer.StartTLS()
+		defer httpServer.Close()
+
+		rsp, err := httpServer.Client().Get(httpServer.URL + "/ssh3")
+		Expect(err).ToNot(HaveOccurred())
+		rsp.Body.Close()
+		Expect(rsp.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(ssh3.IsHTTP2TunnelRequest(&http.Request{Method: http.MethodPost, Header: http.Header{"Capsule-Protocol": {"?1"}}})).To(BeTrue())
+	})
+})
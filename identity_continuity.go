@@ -0,0 +1,161 @@
+package ssh3
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// IdentityContinuityOID identifies the X.509 extension of a rotated server certificate proving
+// that the previous identity of the server endorsed the new one. As the proof is carried by the
+// certificate itself, it reaches the clients during the TLS handshake, before they trust it.
+var IdentityContinuityOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59206, 3, 1}
+
+// a rotated certificate may endorse a certificate that was itself rotated, up to this depth
+const maxContinuityChainLength = 8
+
+const continuityProofContext = "SSH3 identity continuity\x00"
+
+// the content of the extension
+type continuityProof struct {
+	// the DER of the previous certificate, possibly carrying its own continuity proof
+	PreviousCertificate []byte
+	SignatureAlgorithm  int
+	// the signature of the public key of the new certificate using the previous private key
+	Signature []byte
+}
+
+type MissingContinuityProof struct{}
+
+func (e MissingContinuityProof) Error() string {
+	return "the certificate does not carry any identity continuity proof"
+}
+
+type InvalidContinuityProof struct {
+	Reason string
+}
+
+func (e InvalidContinuityProof) Error() string {
+	return fmt.Sprintf("invalid identity continuity proof: %s", e.Reason)
+}
+
+func continuitySignedBytes(publicKey crypto.PublicKey) ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(continuityProofContext), spki...), nil
+}
+
+// NewContinuityProofExtension returns the extension to add to the certificate of newPublicKey
+// so that the clients that pinned previousCert trust it and update their known hosts
+func NewContinuityProofExtension(newPublicKey crypto.PublicKey, previousCert *x509.Certificate, previousKey crypto.Signer) (pkix.Extension, error) {
+	signed, err := continuitySignedBytes(newPublicKey)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	proof := continuityProof{PreviousCertificate: previousCert.Raw}
+	var signature []byte
+	switch previousKey.Public().(type) {
+	case ed25519.PublicKey:
+		proof.SignatureAlgorithm = int(x509.PureEd25519)
+		signature, err = previousKey.Sign(rand.Reader, signed, crypto.Hash(0))
+	case *rsa.PublicKey:
+		proof.SignatureAlgorithm = int(x509.SHA256WithRSA)
+		digest := sha256.Sum256(signed)
+		signature, err = previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case *ecdsa.PublicKey:
+		proof.SignatureAlgorithm = int(x509.ECDSAWithSHA256)
+		digest := sha256.Sum256(signed)
+		signature, err = previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return pkix.Extension{}, fmt.Errorf("unsupported previous key type %T", previousKey.Public())
+	}
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	proof.Signature = signature
+	value, err := asn1.Marshal(proof)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: IdentityContinuityOID, Value: value}, nil
+}
+
+func parseContinuityProof(cert *x509.Certificate) (*continuityProof, error) {
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(IdentityContinuityOID) {
+			continue
+		}
+		proof := &continuityProof{}
+		rest, err := asn1.Unmarshal(extension.Value, proof)
+		if err != nil {
+			return nil, InvalidContinuityProof{Reason: err.Error()}
+		}
+		if len(rest) > 0 {
+			return nil, InvalidContinuityProof{Reason: "trailing data"}
+		}
+		return proof, nil
+	}
+	return nil, MissingContinuityProof{}
+}
+
+// VerifyIdentityContinuity checks that cert has been endorsed by one of the pinned certificates,
+// possibly through a chain of successive rotations, and returns that pinned certificate.
+// It returns MissingContinuityProof if the rotation of the server identity is not endorsed at all.
+func VerifyIdentityContinuity(cert *x509.Certificate, pinned []*x509.Certificate) (*x509.Certificate, error) {
+	var endorsing *x509.Certificate
+	_, err := VerifyIdentityContinuityFunc(cert, func(previous *x509.Certificate) bool {
+		for _, pinnedCert := range pinned {
+			if bytes.Equal(pinnedCert.Raw, previous.Raw) {
+				endorsing = pinnedCert
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endorsing, nil
+}
+
+// VerifyIdentityContinuityFunc is like VerifyIdentityContinuity but the certificates of the chain
+// of rotations are trusted if isPinned returns true, e.g. if their public key is pinned. It
+// returns the certificate of the chain that was trusted.
+func VerifyIdentityContinuityFunc(cert *x509.Certificate, isPinned func(*x509.Certificate) bool) (*x509.Certificate, error) {
+	current := cert
+	for i := 0; i < maxContinuityChainLength; i++ {
+		proof, err := parseContinuityProof(current)
+		if _, missing := err.(MissingContinuityProof); missing && i > 0 {
+			return nil, InvalidContinuityProof{Reason: "the proof does not lead to any known certificate"}
+		} else if err != nil {
+			return nil, err
+		}
+		previous, err := x509.ParseCertificate(proof.PreviousCertificate)
+		if err != nil {
+			return nil, InvalidContinuityProof{Reason: fmt.Sprintf("invalid previous certificate: %s", err)}
+		}
+		signed, err := continuitySignedBytes(current.PublicKey)
+		if err != nil {
+			return nil, InvalidContinuityProof{Reason: err.Error()}
+		}
+		err = previous.CheckSignature(x509.SignatureAlgorithm(proof.SignatureAlgorithm), signed, proof.Signature)
+		if err != nil {
+			return nil, InvalidContinuityProof{Reason: fmt.Sprintf("bad signature by the previous certificate: %s", err)}
+		}
+		if isPinned(previous) {
+			return previous, nil
+		}
+		current = previous
+	}
+	return nil, InvalidContinuityProof{Reason: "the proof does not lead to any known certificate"}
+}
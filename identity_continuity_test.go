@@ -0,0 +1,117 @@
+package ssh3_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type identity struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newIdentity(key crypto.Signer, extensions ...pkix.Extension) identity {
+	template, err := util.GenerateCert(key)
+	Expect(err).ToNot(HaveOccurred())
+	template.ExtraExtensions = extensions
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return identity{cert: cert, key: key}
+}
+
+func newEd25519Identity(extensions ...pkix.Extension) identity {
+	_, key, err := util.GenerateKey()
+	Expect(err).ToNot(HaveOccurred())
+	return newIdentity(key.(crypto.Signer), extensions...)
+}
+
+// rotates the identity, the new one being endorsed by the previous one
+func rotate(previous identity) identity {
+	_, key, err := util.GenerateKey()
+	Expect(err).ToNot(HaveOccurred())
+	signer := key.(crypto.Signer)
+	extension, err := ssh3.NewContinuityProofExtension(signer.Public(), previous.cert, previous.key)
+	Expect(err).ToNot(HaveOccurred())
+	return newIdentity(signer, extension)
+}
+
+var _ = Describe("Identity continuity", func() {
+	It("Accepts a rotation endorsed by the pinned certificate", func() {
+		pinned := newEd25519Identity()
+		rotated := rotate(pinned)
+		endorsing, err := ssh3.VerifyIdentityContinuity(rotated.cert, []*x509.Certificate{pinned.cert})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endorsing).To(Equal(pinned.cert))
+	})
+
+	It("Follows successive rotations", func() {
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		pinned := newIdentity(ecdsaKey)
+		rotated := rotate(rotate(rotate(pinned)))
+		endorsing, err := ssh3.VerifyIdentityContinuity(rotated.cert, []*x509.Certificate{newEd25519Identity().cert, pinned.cert})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endorsing).To(Equal(pinned.cert))
+	})
+
+	It("Reports the certificates without proof", func() {
+		pinned := newEd25519Identity()
+		_, err := ssh3.VerifyIdentityContinuity(newEd25519Identity().cert, []*x509.Certificate{pinned.cert})
+		Expect(err).To(Equal(ssh3.MissingContinuityProof{}))
+	})
+
+	It("Refuses the rotations endorsed by another certificate", func() {
+		pinned := newEd25519Identity()
+		_, err := ssh3.VerifyIdentityContinuity(rotate(newEd25519Identity()).cert, []*x509.Certificate{pinned.cert})
+		Expect(err).To(BeAssignableToTypeOf(ssh3.InvalidContinuityProof{}))
+	})
+
+	It("Refuses a proof copied into the certificate of another key", func() {
+		pinned := newEd25519Identity()
+		_, attackerKey, err := util.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		var stolenProof pkix.Extension
+		for _, extension := range rotate(pinned).cert.Extensions {
+			if extension.Id.Equal(ssh3.IdentityContinuityOID) {
+				stolenProof = extension
+			}
+		}
+		forged := newIdentity(attackerKey.(crypto.Signer), stolenProof)
+		_, err = ssh3.VerifyIdentityContinuity(forged.cert, []*x509.Certificate{pinned.cert})
+		Expect(err).To(BeAssignableToTypeOf(ssh3.InvalidContinuityProof{}))
+	})
+
+	It("Replaces the pinned certificates of the host only", func() {
+		knownHostsPath := filepath.Join(GinkgoT().TempDir(), "known_hosts")
+		pinned, other := newEd25519Identity(), newEd25519Identity()
+		Expect(ssh3.AppendKnownHost(knownHostsPath, "server.example", pinned.cert)).To(Succeed())
+		Expect(ssh3.AppendKnownHost(knownHostsPath, "other.example", other.cert)).To(Succeed())
+		Expect(ssh3.AppendKnownHost(knownHostsPath, "server.example", newEd25519Identity().cert)).To(Succeed())
+		rotated := rotate(pinned)
+		Expect(ssh3.ReplaceKnownHost(knownHostsPath, "server.example", rotated.cert)).To(Succeed())
+
+		knownHosts, invalidLines, err := ssh3.ParseKnownHosts(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(invalidLines).To(BeEmpty())
+		Expect(knownHosts["server.example"]).To(HaveLen(1))
+		Expect(knownHosts["server.example"][0].Raw).To(Equal(rotated.cert.Raw))
+		Expect(knownHosts["other.example"][0].Raw).To(Equal(other.cert.Raw))
+		info, err := os.Stat(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+})
@@ -0,0 +1,210 @@
+package integration_tests
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+	. "github.com/onsi/gomega/gexec"
+)
+
+// a channel request whose content is sent as is, allowing to send malformed requests
+type rawChannelRequest struct {
+	requestType string
+	content     []byte
+}
+
+func (r *rawChannelRequest) Write(buf []byte) (int, error) {
+	return copy(buf, r.content), nil
+}
+
+func (r *rawChannelRequest) Length() int {
+	return len(r.content)
+}
+
+func (r *rawChannelRequest) RequestTypeStr() string {
+	return r.requestType
+}
+
+func sshString(s string) []byte {
+	buf := make([]byte, util.SSHStringLen(s))
+	_, err := util.WriteSSHString(buf, s)
+	Expect(err).ToNot(HaveOccurred())
+	return buf
+}
+
+func encodedRequest(request ssh3Messages.ChannelRequest) []byte {
+	buf := make([]byte, request.Length())
+	_, err := request.Write(buf)
+	Expect(err).ToNot(HaveOccurred())
+	return buf
+}
+
+// establishes a conversation with the test server using the ssh3 library directly
+func establishConversation(ctx context.Context) (*ssh3.Conversation, *http3.RoundTripper) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http3.NextProtoH3},
+	}
+	qconf := &quic.Config{EnableDatagrams: true}
+	qconn, err := quic.DialAddrEarly(ctx, serverBind, tlsConf, qconf)
+	Expect(err).ToNot(HaveOccurred())
+	<-qconn.HandshakeComplete()
+
+	roundTripper := &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig:      qconf,
+		EnableDatagrams: true,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return qconn, nil
+		},
+	}
+
+	tlsState := qconn.ConnectionState().TLS
+	conv, err := ssh3.NewClientConversation(30000, 10, &tlsState)
+	Expect(err).ToNot(HaveOccurred())
+
+	req, err := http.NewRequestWithContext(ctx, "CONNECT", fmt.Sprintf("https://%s%s?user=%s", serverBind, DEFAULT_URL_PATH, username), nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Proto = "ssh3"
+	req.Header.Set("User-Agent", ssh3.GetCurrentVersion())
+
+	identity, err := ssh3.NewPrivkeyFileAuthMethod(rsaPrivKeyPath).IntoIdentityWithoutPassphrase()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(identity.SetAuthorizationHeader(req, username, conv)).To(Succeed())
+	Expect(conv.EstablishClientConversation(req, roundTripper)).To(Succeed())
+	return conv, roundTripper
+}
+
+var _ = Describe("Malformed messages", func() {
+	BeforeEach(func() {
+		if os.Getenv("SSH3_INTEGRATION_TESTS_WITH_SERVER_ENABLED") != "1" {
+			Skip("skipping integration tests")
+		}
+		Consistently(serverSession, "200ms").ShouldNot(Exit())
+	})
+
+	validPtyRequest := encodedRequest(&ssh3Messages.PtyRequest{Term: "xterm", CharWidth: 80, CharHeight: 24})
+
+	hugeString := util.AppendVarInt(nil, 1<<62-1)
+	hugeString = append(hugeString, []byte("ls")...)
+
+	corpus := []struct {
+		description string
+		request     *rawChannelRequest
+	}{
+		{"unknown request type", &rawChannelRequest{requestType: "not-a-request", content: []byte("hello")}},
+		{"truncated SSH string", &rawChannelRequest{requestType: "pty-req", content: append(util.AppendVarInt(nil, 10), []byte("xte")...)}},
+		{"huge SSH string length", &rawChannelRequest{requestType: "exec", content: hugeString}},
+		{"truncated varint", &rawChannelRequest{requestType: "window-change", content: []byte{0xc0, 0x01}}},
+		{"missing request content", &rawChannelRequest{requestType: "exit-status", content: nil}},
+		{"message of unknown type after a valid request", &rawChannelRequest{requestType: "pty-req", content: append(validPtyRequest, 0x3e)}},
+		{"signal request with invalid string length", &rawChannelRequest{requestType: "signal", content: append(util.AppendVarInt(nil, 1000), sshString("TERM")...)}},
+	}
+
+	for _, entry := range corpus {
+		entry := entry
+		It(fmt.Sprintf("closes the channel without crashing on %s", entry.description), func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conv, roundTripper := establishConversation(ctx)
+			defer roundTripper.Close()
+
+			channel, err := conv.OpenChannel("session", 30000, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(channel.SendRequest(&ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: entry.request})).To(Succeed())
+			// end the stream so that the server sees truncated messages as such
+			channel.Close()
+
+			// the server must close the channel
+			closed := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(closed)
+				for {
+					if _, err := channel.NextMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			Eventually(closed, "5s").Should(BeClosed())
+
+			Eventually(serverSession.Err).Should(Say("audit: malformed message from user %s", username))
+			Consistently(serverSession, "200ms").ShouldNot(Exit())
+		})
+	}
+
+	It("keeps the conversation of the clients running a single session", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// the conversation is established without ExtInfo, as by the clients predating FeatureMultipleSessions
+		conv, roundTripper := establishConversation(ctx)
+		defer roundTripper.Close()
+
+		// returns the output of the channel once the server sends its exit status, nil if it
+		// closes the channel without it
+		drain := func(channel ssh3.Channel) (string, *ssh3Messages.ExitStatusRequest) {
+			output, done := "", make(chan *ssh3Messages.ExitStatusRequest, 1)
+			go func() {
+				defer GinkgoRecover()
+				var exitStatus *ssh3Messages.ExitStatusRequest
+				defer func() { done <- exitStatus }()
+				for {
+					message, err := channel.NextMessage()
+					if err != nil || message == nil {
+						return
+					}
+					switch m := message.(type) {
+					case *ssh3Messages.DataOrExtendedDataMessage:
+						output += m.Data
+					case *ssh3Messages.ChannelRequestMessage:
+						if request, ok := m.ChannelRequest.(*ssh3Messages.ExitStatusRequest); ok {
+							exitStatus = request
+							return
+						}
+					}
+				}
+			}()
+			var exitStatus *ssh3Messages.ExitStatusRequest
+			Eventually(done, "5s").Should(Receive(&exitStatus))
+			return output, exitStatus
+		}
+
+		channel, err := conv.OpenChannel("session", 30000, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(channel.SendRequest(&ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &rawChannelRequest{requestType: "not-a-request", content: []byte("hello")}})).To(Succeed())
+		channel.Close()
+		_, exitStatus := drain(channel)
+		Expect(exitStatus).To(Equal(&ssh3Messages.ExitStatusRequest{ExitStatus: 255}))
+		Eventually(serverSession.Err).Should(Say("audit: malformed message from user %s", username))
+
+		channel, err = conv.OpenChannel("session", 30000, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(channel.SendRequest(&ssh3Messages.ChannelRequestMessage{WantReply: false, ChannelRequest: &ssh3Messages.ExecRequest{Command: "echo Hello, World!"}})).To(Succeed())
+		output, exitStatus := drain(channel)
+		Expect(output).To(Equal("Hello, World!\n"))
+		Expect(exitStatus).To(Equal(&ssh3Messages.ExitStatusRequest{ExitStatus: 0}))
+	})
+
+	It("still serves new conversations after the malformed ones", func() {
+		command := exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+			fmt.Sprintf("%s@%s%s", username, serverBind, DEFAULT_URL_PATH), "echo", "Hello, World!")
+		session, err := Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(session).Should(Exit(0))
+		Eventually(session).Should(Say("Hello, World!\n"))
+	})
+})
@@ -0,0 +1,287 @@
+package integration_tests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+	. "github.com/onsi/gomega/gexec"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// the scenarios run by default, SSH3_SCENARIOS overrides it with another glob
+const defaultScenarios = "scenarios/*.yaml"
+
+const defaultScenarioTimeout = 5 * time.Second
+
+// scenario is a regression case described in YAML: a client connects to the test server and
+// the steps drive it and check its behaviour
+type scenario struct {
+	Name string `yaml:"name"`
+	// if set, the scenario is skipped with this reason
+	Skip  string         `yaml:"skip"`
+	Steps []scenarioStep `yaml:"steps"`
+}
+
+// scenarioStep holds exactly one action
+type scenarioStep struct {
+	Connect *connectStep `yaml:"connect"`
+	Expect  *expectStep  `yaml:"expect"`
+	// written to the standard input of the client, e.g. "stty size\r"
+	Send   *string     `yaml:"send"`
+	Resize *resizeStep `yaml:"resize"`
+	// the name of a signal without the SIG prefix, e.g. TERM
+	Signal *string        `yaml:"signal"`
+	Wait   *time.Duration `yaml:"wait"`
+	// closes the session and waits for the client to exit, whatever its exit code
+	Disconnect *bool `yaml:"disconnect"`
+	// waits for the client to exit with this code
+	ExitCode *int `yaml:"exit_code"`
+}
+
+type connectStep struct {
+	// rsa (by default) or ed25519
+	Key string `yaml:"key"`
+	// the options of the client, placed before the destination
+	Options []string `yaml:"options"`
+	Command []string `yaml:"command"`
+	// runs the client in a terminal whose size is rows x cols (24 x 80 by default)
+	TTY  bool   `yaml:"tty"`
+	Rows uint16 `yaml:"rows"`
+	Cols uint16 `yaml:"cols"`
+}
+
+type expectStep struct {
+	// stdout (by default) or stderr, both are read from the terminal when the client runs in one
+	Stream string `yaml:"stream"`
+	// a regular expression, matched after the output matched by the previous expectations
+	Match   string        `yaml:"match"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type resizeStep struct {
+	Rows uint16 `yaml:"rows"`
+	Cols uint16 `yaml:"cols"`
+}
+
+// the escape sequences sending the signals to the remote session, see cmd/ssh3/escape.go
+var signalEscapes = map[string]string{"INT": "~I", "QUIT": "~Q", "TERM": "~T", "KILL": "~K", "HUP": "~H"}
+
+func parseScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var s scenario
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(path)
+	}
+	if len(s.Steps) == 0 || s.Steps[0].Connect == nil {
+		return nil, fmt.Errorf("%s: the first step must be a connect step", path)
+	}
+	for i, step := range s.Steps {
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %w", path, i+1, err)
+		}
+	}
+	return &s, nil
+}
+
+func (step *scenarioStep) validate() error {
+	actions := 0
+	for _, set := range []bool{step.Connect != nil, step.Expect != nil, step.Send != nil, step.Resize != nil,
+		step.Signal != nil, step.Wait != nil, step.Disconnect != nil, step.ExitCode != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("expected exactly one action, got %d", actions)
+	}
+	switch {
+	case step.Connect != nil && step.Connect.Key != "" && step.Connect.Key != "rsa" && step.Connect.Key != "ed25519":
+		return fmt.Errorf("unknown key %q", step.Connect.Key)
+	case step.Expect != nil && step.Expect.Stream != "" && step.Expect.Stream != "stdout" && step.Expect.Stream != "stderr":
+		return fmt.Errorf("unknown stream %q", step.Expect.Stream)
+	case step.Expect != nil && step.Expect.Match == "":
+		return fmt.Errorf("expect without match")
+	case step.Signal != nil && unix.SignalNum("SIG"+*step.Signal) == 0:
+		return fmt.Errorf("unknown signal %q", *step.Signal)
+	}
+	return nil
+}
+
+func scenarioPaths() []string {
+	pattern := os.Getenv("SSH3_SCENARIOS")
+	if pattern == "" {
+		pattern = defaultScenarios
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return paths
+}
+
+// scenarioClient is the client process driven by a scenario
+type scenarioClient struct {
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *Buffer
+	stderr  *Buffer
+	// nil if the client does not run in a terminal
+	ptmx   *os.File
+	exited chan struct{}
+}
+
+func startScenarioClient(step *connectStep) *scenarioClient {
+	privKeyPath := rsaPrivKeyPath
+	if step.Key == "ed25519" {
+		privKeyPath = ed25519PrivKeyPath
+	}
+	args := append([]string{"-insecure", "-privkey", privKeyPath}, step.Options...)
+	args = append(args, fmt.Sprintf("%s@%s%s", username, serverBind, DEFAULT_URL_PATH))
+	command := exec.Command(ssh3Path, append(args, step.Command...)...)
+	client := &scenarioClient{command: command, stdout: NewBuffer(), stderr: NewBuffer(), exited: make(chan struct{})}
+	if step.TTY {
+		ptmx, tty, err := pty.Open()
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(ptmx.Close)
+		defer tty.Close()
+		size := &pty.Winsize{Rows: 24, Cols: 80}
+		if step.Rows != 0 && step.Cols != 0 {
+			size.Rows, size.Cols = step.Rows, step.Cols
+		}
+		Expect(pty.Setsize(ptmx, size)).To(Succeed())
+		command.Stdin, command.Stdout, command.Stderr = tty, tty, tty
+		// the client must be in the foreground of the terminal to be notified of its resizing
+		command.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		client.ptmx, client.stdin = ptmx, ptmx
+		go io.Copy(io.MultiWriter(client.stdout, GinkgoWriter), ptmx)
+	} else {
+		stdin, err := command.StdinPipe()
+		Expect(err).ToNot(HaveOccurred())
+		client.stdin = stdin
+		command.Stdout = io.MultiWriter(client.stdout, GinkgoWriter)
+		command.Stderr = io.MultiWriter(client.stderr, GinkgoWriter)
+	}
+	Expect(command.Start()).To(Succeed())
+	go func() {
+		command.Wait()
+		close(client.exited)
+	}()
+	DeferCleanup(func() {
+		select {
+		case <-client.exited:
+		default:
+			command.Process.Kill()
+			<-client.exited
+		}
+	})
+	return client
+}
+
+func (c *scenarioClient) waitExit() int {
+	Eventually(c.exited, defaultScenarioTimeout).Should(BeClosed(), "the client did not exit")
+	return c.command.ProcessState.ExitCode()
+}
+
+func runScenario(s *scenario) {
+	var client *scenarioClient
+	for i, step := range s.Steps {
+		description := fmt.Sprintf("step %d of %s", i+1, s.Name)
+		if step.Connect == nil && client == nil {
+			Fail(fmt.Sprintf("%s: the client is not connected", description))
+		}
+		switch {
+		case step.Connect != nil:
+			client = startScenarioClient(step.Connect)
+		case step.Expect != nil:
+			buffer := client.stdout
+			if step.Expect.Stream == "stderr" && client.ptmx == nil {
+				buffer = client.stderr
+			}
+			timeout := step.Expect.Timeout
+			if timeout == 0 {
+				timeout = defaultScenarioTimeout
+			}
+			Eventually(buffer, timeout).Should(Say(step.Expect.Match), description)
+		case step.Send != nil:
+			_, err := io.WriteString(client.stdin, *step.Send)
+			Expect(err).ToNot(HaveOccurred(), description)
+		case step.Resize != nil:
+			Expect(client.ptmx).ToNot(BeNil(), "%s: resizing a client that does not run in a terminal", description)
+			Expect(pty.Setsize(client.ptmx, &pty.Winsize{Rows: step.Resize.Rows, Cols: step.Resize.Cols})).To(Succeed(), description)
+		case step.Signal != nil:
+			if client.ptmx != nil {
+				// typed at the start of a line, as a user would
+				escape, ok := signalEscapes[*step.Signal]
+				Expect(ok).To(BeTrue(), "%s: SIG%s has no escape sequence", description, *step.Signal)
+				_, err := io.WriteString(client.ptmx, escape)
+				Expect(err).ToNot(HaveOccurred(), description)
+			} else {
+				Expect(client.command.Process.Signal(unix.SignalNum("SIG"+*step.Signal))).To(Succeed(), description)
+			}
+		case step.Wait != nil:
+			time.Sleep(*step.Wait)
+		case step.Disconnect != nil:
+			if client.ptmx != nil {
+				_, err := io.WriteString(client.ptmx, "~.")
+				Expect(err).ToNot(HaveOccurred(), description)
+			} else {
+				Expect(client.stdin.Close()).To(Succeed(), description)
+			}
+			client.waitExit()
+		case step.ExitCode != nil:
+			Expect(client.waitExit()).To(Equal(*step.ExitCode), description)
+		}
+	}
+}
+
+var _ = Describe("Scenarios", func() {
+	paths := scenarioPaths()
+
+	It("Should parse the scenarios", func() {
+		for _, path := range paths {
+			_, err := parseScenario(path)
+			Expect(err).ToNot(HaveOccurred())
+		}
+	})
+
+	Context("With running server", func() {
+		BeforeEach(func() {
+			if os.Getenv("SSH3_INTEGRATION_TESTS_WITH_SERVER_ENABLED") != "1" {
+				Skip("skipping integration tests")
+			}
+			Consistently(serverSession, "200ms").ShouldNot(Exit())
+		})
+
+		for _, path := range paths {
+			path := path
+			It(fmt.Sprintf("Should run the scenario %s", filepath.Base(path)), func() {
+				s, err := parseScenario(path)
+				Expect(err).ToNot(HaveOccurred())
+				if s.Skip != "" {
+					Skip(s.Skip)
+				}
+				By(s.Name)
+				runScenario(s)
+			})
+		}
+	})
+})
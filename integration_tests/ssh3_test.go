@@ -1,18 +1,38 @@
 package integration_tests
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/creack/pty"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	. "github.com/onsi/gomega/gbytes"
 	. "github.com/onsi/gomega/gexec"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
 )
 
 var ssh3Path string
@@ -26,6 +46,12 @@ var rsaPrivKeyPath string
 var ed25519PrivKeyPath string
 var attackerPrivKeyPath string
 var username string
+var auditLogPath string
+var adminSocketPath string
+var recordingsDir string
+
+// mapped onto username by the server config
+const usernameAlias = "ssh3-test-alias"
 
 // must exist on the machine to successfully run the tests
 const serverBind = "127.0.0.1:4433"
@@ -47,22 +73,122 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// runs producer | consumer
+func pipeCommands(producer *exec.Cmd, consumer *exec.Cmd) {
+	r, w, err := os.Pipe()
+	Expect(err).ToNot(HaveOccurred())
+	producer.Stdout, consumer.Stdin = w, r
+	Expect(producer.Start()).To(Succeed())
+	Expect(consumer.Start()).To(Succeed())
+	w.Close()
+	r.Close()
+	Expect(producer.Wait()).To(Succeed())
+	Expect(consumer.Wait()).To(Succeed())
+}
+
+// writes files of random binary data, an executable, a subdirectory and a symlink in dir
+func writeBinaryTree(dir string) {
+	random := rand.New(rand.NewSource(42))
+	for name, size := range map[string]int{"empty": 0, "small": 1, "medium": 100000, "subdir/large": 3 << 20} {
+		data := make([]byte, size)
+		random.Read(data)
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, name), data, 0644)).To(Succeed())
+	}
+	Expect(os.WriteFile(filepath.Join(dir, "script"), []byte("#!/bin/sh\r\necho hello\r\n"), 0755)).To(Succeed())
+	Expect(os.Symlink("subdir/large", filepath.Join(dir, "link"))).To(Succeed())
+}
+
+// expects the files of actual to have the same content, type and permissions as those of expected
+func expectSameTree(expected string, actual string) {
+	err := filepath.WalkDir(expected, func(path string, entry os.DirEntry, err error) error {
+		Expect(err).ToNot(HaveOccurred())
+		relative, err := filepath.Rel(expected, path)
+		Expect(err).ToNot(HaveOccurred())
+		expectedInfo, err := os.Lstat(path)
+		Expect(err).ToNot(HaveOccurred())
+		actualInfo, err := os.Lstat(filepath.Join(actual, relative))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(actualInfo.Mode().Type()).To(Equal(expectedInfo.Mode().Type()), relative)
+		switch {
+		case expectedInfo.Mode().IsRegular():
+			Expect(actualInfo.Mode().Perm()).To(Equal(expectedInfo.Mode().Perm()), relative)
+			expectedData, err := os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			actualData, err := os.ReadFile(filepath.Join(actual, relative))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actualData).To(Equal(expectedData), relative)
+		case expectedInfo.Mode().Type() == os.ModeSymlink:
+			expectedTarget, err := os.Readlink(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Readlink(filepath.Join(actual, relative))).To(Equal(expectedTarget), relative)
+		}
+		return nil
+	})
+	Expect(err).ToNot(HaveOccurred())
+}
+
 var _ = BeforeSuite(func() {
 	var err error
-	ssh3Path, err = Build("../cmd/ssh3/main.go")
+	ssh3Path, err = Build("../cmd/ssh3")
 	Expect(err).ToNot(HaveOccurred())
 	if os.Getenv("SSH3_INTEGRATION_TESTS_WITH_SERVER_ENABLED") == "1" {
 		// Tests implying a server will only work on Linux
 		// (the server currently only builds on Linux)
 		// and the server needs root priviledges, so we only
 		// run them is they are enabled explicitly.
-		ssh3ServerPath, err = BuildWithEnvironment("../cmd/ssh3-server/main.go", []string{fmt.Sprintf("CGO_ENABLED=%s", os.Getenv("CGO_ENABLED"))})
+		ssh3ServerPath, err = BuildWithEnvironment("../cmd/ssh3-server", []string{fmt.Sprintf("CGO_ENABLED=%s", os.Getenv("CGO_ENABLED"))})
+		Expect(err).ToNot(HaveOccurred())
+		// the rpc subsystem re-executes the server binary as the user
+		for dir := filepath.Dir(ssh3ServerPath); dir != os.TempDir() && dir != "/"; dir = filepath.Dir(dir) {
+			Expect(os.Chmod(dir, 0755)).To(Succeed())
+		}
+		username = os.Getenv("TESTUSER_USERNAME")
+		serverDir := GinkgoT().TempDir()
+		auditLogPath = filepath.Join(serverDir, "audit.log")
+		adminSocketPath = filepath.Join(serverDir, "admin.sock")
+		recordingsDir = filepath.Join(serverDir, "recordings")
+		serverConfigPath := filepath.Join(serverDir, "server_config.json")
+		err = os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+			"username_canonicalization": {
+				"case_folding": true,
+				"strip_domains": ["CORP"],
+				"aliases": {"%s": "%s"}
+			},
+			"maintenance": {
+				"allowed_users": ["root"]
+			},
+			"access_control": {
+				"permit_open": ["127.0.0.1:*", "[::1]:*"]
+			},
+			"forwarding_quotas": {
+				"max_connections": 1
+			},
+			"rpc_subsystem": {
+				"methods": {
+					"exec": {"users": ["%s"], "commands": ["/usr/bin/echo", "/bin/echo"]},
+					"stat": {"users": ["*"], "paths": ["/etc"]}
+				}
+			},
+			"session_recording": {
+				"directory": "%s",
+				"record_exec": true,
+				"retention_days": 30
+			},
+			"live_tail": {
+				"users": ["%s"],
+				"notice": "[an auditor is watching this session]"
+			}
+		}`, usernameAlias, username, username, recordingsDir, username)), 0600)
 		Expect(err).ToNot(HaveOccurred())
 		serverCommand = exec.Command(ssh3ServerPath,
 			"-bind", serverBind,
 			"-v",
 			"-enable-password-login",
 			"-url-path", DEFAULT_URL_PATH,
+			"-config", serverConfigPath,
+			"-audit-log", auditLogPath,
+			"-admin-socket", adminSocketPath,
 			"-cert", os.Getenv("CERT_PEM"),
 			"-key", os.Getenv("CERT_PRIV_KEY"))
 		serverCommand.Env = append(serverCommand.Env, "SSH3_LOG_LEVEL=debug")
@@ -72,7 +198,6 @@ var _ = BeforeSuite(func() {
 		rsaPrivKeyPath = os.Getenv("TESTUSER_PRIVKEY")
 		ed25519PrivKeyPath = os.Getenv("TESTUSER_ED25519_PRIVKEY")
 		attackerPrivKeyPath = os.Getenv("ATTACKER_PRIVKEY")
-		username = os.Getenv("TESTUSER_USERNAME")
 		Expect(fileExists(rsaPrivKeyPath)).To(BeTrue())
 		Expect(fileExists(attackerPrivKeyPath)).To(BeTrue())
 		err = os.WriteFile(fmt.Sprintf("/home/%s/.profile", username), []byte("echo 'hello from .profile'"), 0777)
@@ -107,6 +232,548 @@ var _ = Describe("Testing the ssh3 cli", func() {
 			Consistently(serverSession, "200ms").ShouldNot(Exit())
 		})
 
+		Context("sshd_config import", func() {
+			It("Should translate the supported directives", func() {
+				sshdConfigPath := filepath.Join(GinkgoT().TempDir(), "sshd_config")
+				err := os.WriteFile(sshdConfigPath, []byte(strings.Join([]string{
+					"# comment",
+					"Port 22",
+					"AllowUsers alice bob@10.0.0.1 ops-*",
+					"DenyUsers mallory",
+					"PermitOpen localhost:8080 [::1]:*",
+					"Subsystem sftp /usr/lib/openssh/sftp-server -l INFO",
+					"PasswordAuthentication no",
+					"PermitRootLogin no",
+					"Match User alice",
+					"    PermitOpen any",
+				}, "\n")), 0600)
+				Expect(err).ToNot(HaveOccurred())
+
+				session, err := Start(exec.Command(ssh3ServerPath, "import-sshd", sshdConfigPath), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(1))
+				Expect(session.Out.Contents()).To(MatchJSON(`{
+					"username_canonicalization": {},
+					"maintenance": {},
+					"access_control": {
+						"allow_users": ["alice", "ops-*"],
+						"deny_users": ["mallory"],
+						"permit_open": ["localhost:8080", "[::1]:*"]
+					},
+					"subsystems": {"sftp": "/usr/lib/openssh/sftp-server -l INFO"},
+					"session_recording": {},
+					"forwarding_quotas": {},
+					"session_tmpdir": {},
+					"flow_control": {}
+				}`))
+				Expect(session.Err).To(Say(`:2: Port: flag: use the -bind arg`))
+				Expect(session.Err).To(Say(`:3: AllowUsers: unsupported: host restrictions are not supported, "bob@10.0.0.1" is not imported`))
+				Expect(session.Err).To(Say(`:3: AllowUsers: translated: access_control.allow_users`))
+				Expect(session.Err).To(Say(`:7: PasswordAuthentication: equivalent`))
+				Expect(session.Err).To(Say(`:8: PermitRootLogin: unsupported`))
+				Expect(session.Err).To(Say(`:10: PermitOpen: unsupported: not imported as it is part of a Match block`))
+				Expect(session.Err).To(Say(`4 directives could not be translated`))
+			})
+		})
+
+		Context("Confined sessions", func() {
+			It("Should sandbox the sessions", func() {
+				const sandboxedServerBind = "127.0.0.1:4434"
+				serverDir := GinkgoT().TempDir()
+				serverConfigPath := filepath.Join(serverDir, "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"confinements": [{"users": ["%s"], "sandbox": {}}]
+				}`, username)), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", sandboxedServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+
+				// the network namespace of the session only contains the loopback interface
+				command := exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, sandboxedServerBind, DEFAULT_URL_PATH),
+					"grep -c : /proc/net/dev; unshare --user true || echo unshare refused")
+				session, err := Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(0))
+				Expect(session.Out).To(Say("1\n"))
+				Expect(session.Out).To(Say("unshare refused"))
+				Expect(session.Err).To(Say("Operation not permitted"))
+			})
+		})
+
+		Context("Session temporary directories", func() {
+			It("Should provide a private tmpdir removed after the session", func() {
+				const tmpDirServerBind = "127.0.0.1:4434"
+				serverDir := GinkgoT().TempDir()
+				tmpDirsParent := filepath.Join(serverDir, "sessions")
+				Expect(os.Mkdir(tmpDirsParent, 0755)).To(Succeed())
+				// the users must be able to reach their directory
+				Expect(os.Chmod(serverDir, 0755)).To(Succeed())
+				serverConfigPath := filepath.Join(serverDir, "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"session_tmpdir": {"enabled": true, "directory": "%s"}
+				}`, tmpDirsParent)), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", tmpDirServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+
+				command := exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, tmpDirServerBind, DEFAULT_URL_PATH),
+					`echo "$TMPDIR $XDG_RUNTIME_DIR"; stat -c "%a %U" "$TMPDIR"; touch "$TMPDIR/file"`)
+				session, err := Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(0))
+				tmpDir := filepath.Join(tmpDirsParent, "ssh3-session-")
+				Expect(session.Out).To(Say(fmt.Sprintf(`(%s\S+) %s\S+\n`, tmpDir, tmpDir)))
+				Expect(session.Out).To(Say(fmt.Sprintf("700 %s\n", username)))
+				Eventually(func() ([]os.DirEntry, error) { return os.ReadDir(tmpDirsParent) }).Should(BeEmpty())
+			})
+		})
+
+		Context("Flow control", func() {
+			It("Should transfer data through small receive windows", func() {
+				const flowControlServerBind = "127.0.0.1:4434"
+				serverConfigPath := filepath.Join(GinkgoT().TempDir(), "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(`{
+					"flow_control": {"channel_receive_window": 65536, "conversation_receive_window": 131072}
+				}`), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", flowControlServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+
+				const size = 20 << 20
+				command := exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, flowControlServerBind, DEFAULT_URL_PATH), fmt.Sprintf("head -c %d | wc -c", size))
+				command.Stdin = io.LimitReader(rand.New(rand.NewSource(42)), size)
+				session, err := Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session, 30*time.Second).Should(Exit(0))
+				Expect(session.Out).To(Say(fmt.Sprintf("^%d\n", size)))
+			})
+		})
+
+		Context("Egress proxy", func() {
+			It("Should forward the TCP connections through the proxy", func() {
+				const egressProxyServerBind = "127.0.0.1:4434"
+				target, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9093})
+				Expect(err).ToNot(HaveOccurred())
+				defer target.Close()
+				go func() {
+					defer GinkgoRecover()
+					conn, err := target.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+
+				// a minimal HTTP CONNECT proxy requiring basic authentication
+				proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				connectTargets := make(chan string, 1)
+				proxy := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != http.MethodConnect {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("bastion:secret")) {
+						w.WriteHeader(http.StatusProxyAuthRequired)
+						return
+					}
+					upstream, err := net.Dial("tcp", r.Host)
+					if err != nil {
+						w.WriteHeader(http.StatusBadGateway)
+						return
+					}
+					defer upstream.Close()
+					connectTargets <- r.Host
+					conn, buffered, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+					go io.Copy(upstream, buffered)
+					io.Copy(conn, upstream)
+				})}
+				go proxy.Serve(proxyListener)
+				defer proxy.Close()
+
+				serverConfigPath := filepath.Join(GinkgoT().TempDir(), "server_config.json")
+				err = os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"egress_proxy": {"url": "http://%s", "username": "bastion", "password": "secret"}
+				}`, proxyListener.Addr())), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", egressProxyServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+
+				client, err := Start(exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					"-forward-tcp", "8084/127.0.0.1@9093", "-forward-udp", "8085/127.0.0.1@9094",
+					fmt.Sprintf("%s@%s%s", username, egressProxyServerBind, DEFAULT_URL_PATH)), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer client.Terminate()
+
+				var conn net.Conn
+				Eventually(func() error {
+					var err error
+					conn, err = net.Dial("tcp", "127.0.0.1:8084")
+					return err
+				}).ShouldNot(HaveOccurred())
+				defer conn.Close()
+				_, err = conn.Write([]byte("through the proxy"))
+				Expect(err).ToNot(HaveOccurred())
+				buffer := make([]byte, len("through the proxy"))
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				_, err = io.ReadFull(conn, buffer)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buffer)).To(Equal("through the proxy"))
+				Expect(connectTargets).To(Receive(Equal("127.0.0.1:9093")))
+
+				// the proxy cannot relay UDP, the server does not advertise UDP forwarding
+				Eventually(client.Err).Should(Say("UDP forwarding is not supported; continuing without -forward-udp"))
+			})
+		})
+
+		Context("Working directories", func() {
+			It("Should start the commands in the permitted requested directories", func() {
+				const workingDirServerBind = "127.0.0.1:4434"
+				serverDir := GinkgoT().TempDir()
+				serverConfigPath := filepath.Join(serverDir, "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(`{
+					"access_control": {"permit_working_directories": ["~", "/usr"]}
+				}`), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				// the monitor checks the directories requested through the worker
+				for _, privsepArgs := range [][]string{nil, {"-privsep-user", "nobody"}} {
+					serverArgs := append([]string{
+						"-bind", workingDirServerBind,
+						"-v",
+						"-url-path", DEFAULT_URL_PATH,
+						"-config", serverConfigPath,
+						"-cert", os.Getenv("CERT_PEM"),
+						"-key", os.Getenv("CERT_PRIV_KEY")}, privsepArgs...)
+					server, err := Start(exec.Command(ssh3ServerPath, serverArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(server.Err).Should(Say("Server started"))
+					destination := fmt.Sprintf("%s@%s%s", username, workingDirServerBind, DEFAULT_URL_PATH)
+
+					session, err := Start(exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath, destination+":/usr/bin", "pwd"), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say("^/usr/bin\n"))
+
+					// relative to the home of the user
+					session, err = Start(exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath, "-remote-dir", ".", destination, "pwd"), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say(fmt.Sprintf("^/home/%s\n", username)))
+
+					session, err = Start(exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath, "-remote-dir", "/usr/../etc", destination, "pwd"), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit())
+					Expect(session.ExitCode()).ToNot(Equal(0))
+					Expect(session.Out.Contents()).ToNot(ContainSubstring("/etc"))
+
+					server.Terminate()
+					Eventually(server).Should(Exit())
+				}
+			})
+		})
+
+		Context("Pre-authorization tokens", func() {
+			It("Should authenticate using a token signed in advance for the server", func() {
+				const preauthServerBind = "127.0.0.1:4434"
+				pubkey, privkey, err := ed25519.GenerateKey(nil)
+				Expect(err).ToNot(HaveOccurred())
+				sshPubkey, err := ssh.NewPublicKey(pubkey)
+				Expect(err).ToNot(HaveOccurred())
+				pemPrivkey, err := ssh.MarshalPrivateKey(privkey, "")
+				Expect(err).ToNot(HaveOccurred())
+				dir := GinkgoT().TempDir()
+				signingKeyPath := filepath.Join(dir, "preauth_key")
+				Expect(os.WriteFile(signingKeyPath, pem.EncodeToMemory(pemPrivkey), 0600)).To(Succeed())
+				verificationKeysPath := filepath.Join(dir, "preauth_keys.pub")
+				Expect(os.WriteFile(verificationKeysPath, ssh.MarshalAuthorizedKey(sshPubkey), 0644)).To(Succeed())
+
+				serverConfigPath := filepath.Join(dir, "server_config.json")
+				err = os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"preauth": {"verification_keys": %q, "host": "lab", "users": [%q]}
+				}`, verificationKeysPath, username)), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", preauthServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+				destination := fmt.Sprintf("%s@%s%s", username, preauthServerBind, DEFAULT_URL_PATH)
+
+				for host, expectedStatus := range map[string]int{"lab": 0, "another-lab": 255} {
+					preauth, err := Start(exec.Command(ssh3Path, "preauth", "-host", host, "-ttl", "10m", "-user", username, "-privkey", signingKeyPath), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(preauth).Should(Exit(0))
+					tokenPath := filepath.Join(dir, host+".token")
+					Expect(os.WriteFile(tokenPath, preauth.Out.Contents(), 0600)).To(Succeed())
+
+					session, err := Start(exec.Command(ssh3Path, "-insecure", "-use-preauth", tokenPath, destination, "echo", "preauthorized"), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(expectedStatus))
+					if expectedStatus == 0 {
+						Expect(session.Out).To(Say("preauthorized"))
+					}
+				}
+			})
+		})
+
+		Context("Client certificates", func() {
+			It("Should authenticate the client certificates mapped onto the user", func() {
+				const clientCertificatesServerBind = "127.0.0.1:4434"
+				dir := GinkgoT().TempDir()
+				// writes a certificate and its key in the same PEM file
+				writeCertificate := func(filename string, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+					_, key, err := ed25519.GenerateKey(nil)
+					Expect(err).ToNot(HaveOccurred())
+					if parent == nil {
+						parent, parentKey = template, key
+					}
+					der, err := x509.CreateCertificate(cryptorand.Reader, template, parent, key.Public(), parentKey)
+					Expect(err).ToNot(HaveOccurred())
+					keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+					Expect(err).ToNot(HaveOccurred())
+					content := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+					Expect(os.WriteFile(filename, content, 0600)).To(Succeed())
+					cert, err := x509.ParseCertificate(der)
+					Expect(err).ToNot(HaveOccurred())
+					return cert, key
+				}
+				newTemplate := func(serial int64, commonName string) *x509.Certificate {
+					return &x509.Certificate{
+						SerialNumber: big.NewInt(serial),
+						Subject:      pkix.Name{CommonName: commonName},
+						NotBefore:    time.Now().Add(-time.Hour),
+						NotAfter:     time.Now().Add(time.Hour),
+						ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+					}
+				}
+				caTemplate := newTemplate(1, "ssh3 test CA")
+				caTemplate.IsCA, caTemplate.BasicConstraintsValid, caTemplate.KeyUsage = true, true, x509.KeyUsageCertSign
+				caPath := filepath.Join(dir, "ca.pem")
+				ca, caKey := writeCertificate(caPath, caTemplate, nil, nil)
+				mappedPath, unmappedPath, untrustedPath := filepath.Join(dir, "mapped.pem"), filepath.Join(dir, "unmapped.pem"), filepath.Join(dir, "untrusted.pem")
+				mappedTemplate := newTemplate(2, "backup bot")
+				mappedTemplate.DNSNames = []string{"backup.example.com"}
+				writeCertificate(mappedPath, mappedTemplate, ca, caKey)
+				writeCertificate(unmappedPath, newTemplate(3, "another bot"), ca, caKey)
+				writeCertificate(untrustedPath, mappedTemplate, nil, nil)
+				mappingPath := filepath.Join(dir, "client_certificates")
+				Expect(os.WriteFile(mappingPath, []byte(fmt.Sprintf("# machine-to-machine\ndns:backup.example.com %s\n", username)), 0644)).To(Succeed())
+
+				serverConfigPath := filepath.Join(dir, "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"client_certificates": {"ca_file": %q, "mapping_file": %q}
+				}`, caPath, mappingPath)), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", clientCertificatesServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+				destination := fmt.Sprintf("%s@%s%s", username, clientCertificatesServerBind, DEFAULT_URL_PATH)
+
+				for certPath, expectedStatus := range map[string]int{mappedPath: 0, unmappedPath: 255, untrustedPath: 255} {
+					session, err := Start(exec.Command(ssh3Path, "-insecure", "-client-cert", certPath, destination, "echo", "authenticated"), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(expectedStatus))
+					if expectedStatus == 0 {
+						Expect(session.Out).To(Say("authenticated"))
+					}
+				}
+				// the users without certificate still authenticate using the other methods
+				session, err := Start(exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath, destination, "echo", "authenticated"), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(0))
+
+				// the monitor cannot trust the certificates verified by the worker
+				privsepServer, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", clientCertificatesServerBind,
+					"-url-path", DEFAULT_URL_PATH,
+					"-config", serverConfigPath,
+					"-privsep-user", "nobody",
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(privsepServer).Should(Exit())
+				Expect(privsepServer.ExitCode()).ToNot(Equal(0))
+				Expect(privsepServer.Err).To(Say("the client certificates cannot be used along with -privsep-user"))
+			})
+		})
+
+		Context("Break-glass tokens", func() {
+			It("Should authenticate the users once with the tokens issued on the break-glass socket", func() {
+				const breakGlassServerBind = "127.0.0.1:4434"
+				serverDir := GinkgoT().TempDir()
+				socketPath := filepath.Join(serverDir, "break-glass.sock")
+				serverAuditLogPath := filepath.Join(serverDir, "audit.log")
+				serverConfigPath := filepath.Join(serverDir, "server_config.json")
+				err := os.WriteFile(serverConfigPath, []byte(fmt.Sprintf(`{
+					"break_glass": {"socket": "%s", "users": ["%s"], "max_tokens_per_hour": 2}
+				}`, socketPath, username)), 0600)
+				Expect(err).ToNot(HaveOccurred())
+				socketClient := &http.Client{Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+					},
+				}}
+				issueToken := func(username string) (int, string) {
+					response, err := socketClient.Post("http://break-glass/tokens", "application/json",
+						strings.NewReader(fmt.Sprintf(`{"username": "%s", "reason": "identity provider down"}`, username)))
+					Expect(err).ToNot(HaveOccurred())
+					defer response.Body.Close()
+					body, err := io.ReadAll(response.Body)
+					Expect(err).ToNot(HaveOccurred())
+					token := regexp.MustCompile(`"token":"([^"]+)"`).FindSubmatch(body)
+					if token == nil {
+						return response.StatusCode, ""
+					}
+					return response.StatusCode, string(token[1])
+				}
+				// the tokens are redeemed by the monitor if the privileges are separated
+				for _, privsepArgs := range [][]string{nil, {"-privsep-user", "nobody"}} {
+					serverArgs := append([]string{
+						"-bind", breakGlassServerBind,
+						"-v",
+						"-url-path", DEFAULT_URL_PATH,
+						"-config", serverConfigPath,
+						"-audit-log", serverAuditLogPath,
+						"-cert", os.Getenv("CERT_PEM"),
+						"-key", os.Getenv("CERT_PRIV_KEY")}, privsepArgs...)
+					server, err := Start(exec.Command(ssh3ServerPath, serverArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(server.Err).Should(Say("Server started"))
+					destination := fmt.Sprintf("%s@%s%s", username, breakGlassServerBind, DEFAULT_URL_PATH)
+
+					status, _ := issueToken("root")
+					Expect(status).To(Equal(http.StatusForbidden))
+					status, token := issueToken(username)
+					Expect(status).To(Equal(http.StatusOK))
+					Expect(token).To(HavePrefix("ssh3-break-glass-"))
+
+					// no private key nor OpenID Connect provider is needed
+					for _, expectedExitCode := range []int{0, 255} {
+						command := exec.Command(ssh3Path, "-insecure", "-use-break-glass", destination, "whoami")
+						command.Env = append(os.Environ(), "SSH3_BREAK_GLASS_TOKEN="+token)
+						session, err := Start(command, GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						Eventually(session).Should(Exit(expectedExitCode))
+						if expectedExitCode == 0 {
+							Expect(session.Out).To(Say(fmt.Sprintf("^%s\n", username)))
+						}
+					}
+
+					// rate-limited
+					status, _ = issueToken(username)
+					Expect(status).To(Equal(http.StatusOK))
+					status, _ = issueToken(username)
+					Expect(status).To(Equal(http.StatusTooManyRequests))
+
+					server.Terminate()
+					Eventually(server).Should(Exit())
+				}
+
+				auditLog, err := os.ReadFile(serverAuditLogPath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(auditLog)).To(ContainSubstring(`"type":"break_glass"`))
+				Expect(string(auditLog)).To(ContainSubstring(`"action":"redeem"`))
+				Expect(string(auditLog)).To(ContainSubstring(`"method":"break-glass"`))
+			})
+		})
+
+		Context("Privilege separation", func() {
+			It("Should parse the network traffic as an unprivileged user", func() {
+				const privsepServerBind = "127.0.0.1:4434"
+				server, err := Start(exec.Command(ssh3ServerPath,
+					"-bind", privsepServerBind,
+					"-v",
+					"-url-path", DEFAULT_URL_PATH,
+					"-privsep-user", "nobody",
+					"-cert", os.Getenv("CERT_PEM"),
+					"-key", os.Getenv("CERT_PRIV_KEY")), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				defer server.Terminate()
+				Eventually(server.Err).Should(Say("Server started"))
+
+				// the worker is the only child of the monitor before any session
+				ps, err := Start(exec.Command("ps", "-o", "user=,args=", "--ppid", fmt.Sprint(server.Command.Process.Pid)), GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(ps).Should(Exit(0))
+				Expect(ps.Out).To(Say("nobody +.*privsep-worker"))
+
+				// the monitor authenticates the user and runs the command
+				command := exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, privsepServerBind, DEFAULT_URL_PATH), "whoami; exit 3")
+				session, err := Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(3))
+				Expect(session.Out).To(Say(fmt.Sprintf("%s\n", username)))
+
+				// the monitor reports the signal that killed the command
+				command = exec.Command(ssh3Path, "-insecure", "-privkey", rsaPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, privsepServerBind, DEFAULT_URL_PATH), "kill -TERM $$")
+				session, err = Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit(143))
+
+				command = exec.Command(ssh3Path, "-insecure", "-privkey", attackerPrivKeyPath,
+					fmt.Sprintf("%s@%s%s", username, privsepServerBind, DEFAULT_URL_PATH), "whoami")
+				session, err = Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(session).Should(Exit())
+				Expect(session.ExitCode()).ToNot(Equal(0))
+			})
+		})
+
 		Context("Insecure", func() {
 			var clientArgs []string
 			getClientArgs := func(privKeyPath string, additionalArgs ...string) []string {
@@ -138,6 +805,449 @@ var _ = Describe("Testing the ssh3 cli", func() {
 					Eventually(session).Should(Say("Hello, World!\n"))
 				})
 
+				It("Should forward the window size changes and restore the terminal", func() {
+					ptmx, tty, err := pty.Open()
+					Expect(err).ToNot(HaveOccurred())
+					defer ptmx.Close()
+					defer tty.Close()
+					Expect(pty.Setsize(ptmx, &pty.Winsize{Rows: 24, Cols: 80})).To(Succeed())
+					initialState, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+					Expect(err).ToNot(HaveOccurred())
+
+					command := exec.Command(ssh3Path, getClientArgs(rsaPrivKeyPath)...)
+					command.Stdin, command.Stdout, command.Stderr = tty, tty, tty
+					// the client must be in the foreground of the terminal to be notified of its resizing
+					command.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+					output := NewBuffer()
+					go io.Copy(output, ptmx)
+					Expect(command.Start()).To(Succeed())
+
+					ptmx.Write([]byte("stty size\r"))
+					Eventually(output).Should(Say("24 80"))
+					Expect(pty.Setsize(ptmx, &pty.Winsize{Rows: 30, Cols: 100})).To(Succeed())
+					Eventually(func() *Buffer {
+						ptmx.Write([]byte("stty size\r"))
+						return output
+					}, "5s", "500ms").Should(Say("30 100"))
+					ptmx.Write([]byte("exit\r"))
+					Expect(command.Wait()).To(Succeed())
+
+					state, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(state.Lflag).To(Equal(initialState.Lflag))
+					Expect(state.Iflag).To(Equal(initialState.Iflag))
+				})
+
+				It("Should apply the local terminal modes to the remote pty", func() {
+					ptmx, tty, err := pty.Open()
+					Expect(err).ToNot(HaveOccurred())
+					defer ptmx.Close()
+					defer tty.Close()
+					termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+					Expect(err).ToNot(HaveOccurred())
+					termios.Cc[unix.VERASE] = 0x08
+					termios.Iflag &^= unix.IXON
+					Expect(unix.IoctlSetTermios(int(tty.Fd()), unix.TCSETS, termios)).To(Succeed())
+
+					command := exec.Command(ssh3Path, getClientArgs(rsaPrivKeyPath)...)
+					command.Stdin, command.Stdout, command.Stderr = tty, tty, tty
+					output := NewBuffer()
+					go io.Copy(output, ptmx)
+					Expect(command.Start()).To(Succeed())
+
+					ptmx.Write([]byte("stty -a; exit\r"))
+					Eventually(output).Should(Say(`erase = \^H;`))
+					Eventually(output).Should(Say(` -ixon `))
+					Expect(command.Wait()).To(Succeed())
+				})
+
+				It("Should send breaks and signals to the remote foreground job with escape sequences", func() {
+					ptmx, tty, err := pty.Open()
+					Expect(err).ToNot(HaveOccurred())
+					defer ptmx.Close()
+					defer tty.Close()
+
+					command := exec.Command(ssh3Path, getClientArgs(rsaPrivKeyPath)...)
+					command.Stdin, command.Stdout, command.Stderr = tty, tty, tty
+					output := NewBuffer()
+					go io.Copy(output, ptmx)
+					Expect(command.Start()).To(Succeed())
+
+					// the break interrupts the job when BRKINT is set, as on a serial line
+					ptmx.Write([]byte("stty brkint; sleep 100\r"))
+					time.Sleep(500 * time.Millisecond)
+					ptmx.Write([]byte("~B"))
+					ptmx.Write([]byte("echo status $?\r"))
+					Eventually(output, 5*time.Second).Should(Say(`status 130`))
+
+					ptmx.Write([]byte("sleep 100\r"))
+					time.Sleep(500 * time.Millisecond)
+					ptmx.Write([]byte("~T"))
+					ptmx.Write([]byte("echo status $?\r"))
+					Eventually(output, 5*time.Second).Should(Say(`status 143`))
+
+					// the escape character is sent when typed twice or not at the start of a line
+					ptmx.Write([]byte("~~echo a~b\r"))
+					Eventually(output).Should(Say(`\$ ~echo a~b\r\n`))
+					ptmx.Write([]byte("exit\r"))
+					Expect(command.Wait()).ToNot(Succeed())
+				})
+
+				It("Should control the connection and its forwardings with escape sequences", func() {
+					target, err := net.Listen("tcp", "127.0.0.1:0")
+					Expect(err).ToNot(HaveOccurred())
+					defer target.Close()
+					go func() {
+						for {
+							conn, err := target.Accept()
+							if err != nil {
+								return
+							}
+							conn.Write([]byte("hello from target\n"))
+							conn.Close()
+						}
+					}()
+					ptmx, tty, err := pty.Open()
+					Expect(err).ToNot(HaveOccurred())
+					defer ptmx.Close()
+					defer tty.Close()
+
+					command := exec.Command(ssh3Path, getClientArgs(rsaPrivKeyPath)...)
+					command.Stdin, command.Stdout, command.Stderr = tty, tty, tty
+					output := NewBuffer()
+					go io.Copy(output, ptmx)
+					Expect(command.Start()).To(Succeed())
+					Eventually(output).Should(Say(`\$ `))
+
+					// the command line is opened at the start of a line
+					ptmx.Write([]byte(fmt.Sprintf("\r~C-L 4480/127.0.0.1@%d\r", target.Addr().(*net.TCPAddr).Port)))
+					Eventually(output).Should(Say(`ssh3> -L 4480`))
+					Eventually(func() error {
+						conn, err := net.Dial("tcp", "127.0.0.1:4480")
+						if err == nil {
+							defer conn.Close()
+							var content []byte
+							content, err = io.ReadAll(conn)
+							if err == nil && string(content) != "hello from target\n" {
+								err = fmt.Errorf("unexpected content %q", content)
+							}
+						}
+						return err
+					}).Should(Succeed())
+					ptmx.Write([]byte("~#"))
+					Eventually(output).Should(Say(`CHANNEL +TYPE`))
+					Eventually(output).Should(Say(`forwarding tcp 127.0.0.1:4480 -> 127.0.0.1:`))
+					ptmx.Write([]byte("~C-KL 4480\r"))
+					Eventually(func() error {
+						conn, err := net.Dial("tcp", "127.0.0.1:4480")
+						if err == nil {
+							conn.Close()
+						}
+						return err
+					}).ShouldNot(Succeed())
+
+					// the terminal is restored while the client is suspended
+					ptmx.Write([]byte("~\x1a"))
+					Eventually(func() string {
+						stat, _ := os.ReadFile(fmt.Sprintf("/proc/%d/stat", command.Process.Pid))
+						return strings.Fields(strings.SplitN(string(stat), ") ", 2)[1])[0]
+					}).Should(Equal("T"))
+					termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(termios.Lflag & unix.ECHO).ToNot(BeZero())
+					Expect(command.Process.Signal(syscall.SIGCONT)).To(Succeed())
+					Eventually(func() uint32 {
+						termios, _ := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+						return termios.Lflag & unix.ECHO
+					}).Should(BeZero())
+
+					ptmx.Write([]byte("echo resumed\r"))
+					Eventually(output).Should(Say(`[^ ]resumed\r\n`))
+					ptmx.Write([]byte("~."))
+					Eventually(output).Should(Say(`Connection to 127.0.0.1:4433 closed.`))
+					err = command.Wait()
+					Expect(err).To(HaveOccurred())
+					Expect(err.(*exec.ExitError).ExitCode()).To(Equal(255))
+				})
+
+				It("Should canonicalize the requested username", func() {
+					for _, requestedUsername := range []string{fmt.Sprintf("%s@corp", strings.ToUpper(username)), strings.ToUpper(usernameAlias)} {
+						clientArgs = []string{"-insecure", "-privkey", rsaPrivKeyPath,
+							fmt.Sprintf("%s@%s%s", requestedUsername, serverBind, DEFAULT_URL_PATH), "whoami"}
+						command := exec.Command(ssh3Path, clientArgs...)
+						session, err := Start(command, GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						Eventually(session).Should(Exit(0))
+						Eventually(session).Should(Say(fmt.Sprintf("%s\n", username)))
+					}
+				})
+
+				It("Should not strip unknown domains", func() {
+					clientArgs = []string{"-insecure", "-privkey", rsaPrivKeyPath,
+						fmt.Sprintf("%s@example.org@%s%s", username, serverBind, DEFAULT_URL_PATH), "whoami"}
+					command := exec.Command(ssh3Path, clientArgs...)
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit())
+					Expect(session.ExitCode()).ToNot(Equal(0))
+				})
+
+				It("Should write qlog traces", func() {
+					qlogDir := GinkgoT().TempDir()
+					clientArgs = append(getClientArgs(rsaPrivKeyPath, "-qlog-dir", qlogDir, "-qlog-ssh3-messages"), "echo", "Hello, World!")
+					command := exec.Command(ssh3Path, clientArgs...)
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+
+					// one trace for the QUIC connection and one for the SSH3 messages
+					traces, err := filepath.Glob(filepath.Join(qlogDir, "*_client.qlog"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(traces).To(HaveLen(2))
+					for _, trace := range traces {
+						content, err := os.ReadFile(trace)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(string(content)).To(ContainSubstring(`"qlog_version":"draft-02"`))
+						if strings.HasPrefix(filepath.Base(trace), "ssh3_") {
+							Expect(string(content)).To(ContainSubstring(`"request_type":"exec"`))
+							Expect(string(content)).To(ContainSubstring(`"name":"ssh3:message_received"`))
+						} else {
+							Expect(string(content)).To(ContainSubstring(`"name":"transport:packet_sent"`))
+						}
+					}
+				})
+
+				It("Should record the session in the audit log", func() {
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo", "audited")
+					command := exec.Command(ssh3Path, clientArgs...)
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+
+					Eventually(func() string {
+						content, err := os.ReadFile(auditLogPath)
+						Expect(err).ToNot(HaveOccurred())
+						return string(content)
+					}).Should(And(
+						MatchRegexp(`"type":"authentication","username":"%s".*"method":"bearer".*"result":"success"`, username),
+						MatchRegexp(`"type":"exec","username":"%s".*"command":"echo audited"`, username),
+					))
+
+					verifyCommand := exec.Command(ssh3ServerPath, "-verify-audit-log", auditLogPath)
+					verifySession, err := Start(verifyCommand, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(verifySession).Should(Exit(0))
+					Expect(verifySession.Out).To(Say("records verified"))
+				})
+
+				It("Should record the sessions", func() {
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo", "recorded session")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+
+					Eventually(func() []string {
+						var recordings []string
+						casts, err := filepath.Glob(filepath.Join(recordingsDir, username, "*.cast"))
+						Expect(err).ToNot(HaveOccurred())
+						for _, cast := range casts {
+							content, err := os.ReadFile(cast)
+							Expect(err).ToNot(HaveOccurred())
+							recordings = append(recordings, string(content))
+						}
+						return recordings
+					}).Should(ContainElement(And(
+						MatchRegexp(`^\{"version":2,"width":80,"height":24,`),
+						ContainSubstring(`echo recorded session`),
+						MatchRegexp(`\n\[[0-9.e-]+,"o","recorded session\\n"\]\n`),
+					)))
+
+					// replays the related sessions side-by-side
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo", "next session")
+					session, err = Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					findRecording := func(output string) string {
+						casts, err := filepath.Glob(filepath.Join(recordingsDir, username, "*.cast"))
+						Expect(err).ToNot(HaveOccurred())
+						for _, cast := range casts {
+							content, err := os.ReadFile(cast)
+							Expect(err).ToNot(HaveOccurred())
+							if strings.Contains(string(content), `"o","`+output) {
+								return cast
+							}
+						}
+						return ""
+					}
+					Eventually(func() string { return findRecording("next session") }).ShouldNot(BeEmpty())
+					first, next := findRecording("recorded session"), findRecording("next session")
+					replay, err := Start(exec.Command(ssh3ServerPath, "replay", "-dir", recordingsDir, "--sync", "-speed", "1000",
+						strings.TrimSuffix(filepath.Base(next), ".cast"), first), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(replay).Should(Exit(0))
+					Expect(replay.Out).To(Say(`\| ` + username + `/\S+ +\| ` + username + `/\S+\n`))
+					Expect(replay.Out).To(Say(`[0-9:.]+ \| +\| recorded session\n`))
+					Expect(replay.Out).To(Say(`[0-9:.]+ \| next session +\|\n`))
+				})
+
+				It("Should refuse non-allowed users in maintenance mode", func() {
+					adminClient := &http.Client{Transport: &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							return (&net.Dialer{}).DialContext(ctx, "unix", adminSocketPath)
+						},
+					}}
+					setMaintenance := func(enabled bool) {
+						rsp, err := adminClient.Post("http://admin/maintenance", "application/json",
+							strings.NewReader(fmt.Sprintf(`{"enabled": %t, "banner": "patching, back soon"}`, enabled)))
+						Expect(err).ToNot(HaveOccurred())
+						defer rsp.Body.Close()
+						Expect(rsp.StatusCode).To(Equal(http.StatusOK))
+					}
+					setMaintenance(true)
+					defer setMaintenance(false)
+
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo", "Hello, World!")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit())
+					Expect(session.ExitCode()).ToNot(Equal(0))
+					Expect(session.Err).To(Say("patching, back soon"))
+
+					setMaintenance(false)
+					session, err = Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+				})
+
+				It("Should tell the clients why the administrator terminated their conversation", func() {
+					adminClient := &http.Client{Transport: &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							return (&net.Dialer{}).DialContext(ctx, "unix", adminSocketPath)
+						},
+					}}
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo started; sleep 30")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session.Out).Should(Say("started\n"))
+
+					rsp, err := adminClient.Post("http://admin/conversations/terminate", "application/json",
+						strings.NewReader(fmt.Sprintf(`{"username": "%s"}`, username)))
+					Expect(err).ToNot(HaveOccurred())
+					rsp.Body.Close()
+					Expect(rsp.StatusCode).To(Equal(http.StatusNoContent))
+					Eventually(session).Should(Exit(255))
+					Expect(session.Err).To(Say(`Disconnected by the server \(disconnected by application\): terminated by the administrator`))
+				})
+
+				It("Should let the auditors tail the live output of the sessions", func() {
+					adminClient := &http.Client{Transport: &http.Transport{
+						DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+							return (&net.Dialer{}).DialContext(ctx, "unix", adminSocketPath)
+						},
+					}}
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "for i in $(seq 20); do echo tick$i; sleep 0.2; done")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session.Out).Should(Say("tick1\n"))
+
+					rsp, err := adminClient.Get("http://admin/stats")
+					Expect(err).ToNot(HaveOccurred())
+					var stats []struct {
+						ConversationID string `json:"conversation_id"`
+						Username       string `json:"username"`
+						Channels       []struct {
+							ChannelID   uint64 `json:"channel_id"`
+							ChannelType string `json:"channel_type"`
+						} `json:"channels"`
+					}
+					Expect(json.NewDecoder(rsp.Body).Decode(&stats)).To(Succeed())
+					rsp.Body.Close()
+					Expect(stats).To(HaveLen(1))
+					Expect(stats[0].Username).To(Equal(username))
+					Expect(stats[0].Channels).To(HaveLen(1))
+
+					tailURL := fmt.Sprintf("http://admin/sessions/tail?conversation=%s&channel=%d&auditor=%s",
+						url.QueryEscape(stats[0].ConversationID), stats[0].Channels[0].ChannelID, "incident-42")
+					rsp, err = adminClient.Get(tailURL + "&format=asciicast")
+					Expect(err).ToNot(HaveOccurred())
+					defer rsp.Body.Close()
+					Expect(rsp.StatusCode).To(Equal(http.StatusOK))
+					tail := NewBuffer()
+					tailEnded := make(chan struct{})
+					go func() {
+						defer close(tailEnded)
+						io.Copy(tail, rsp.Body)
+					}()
+					Eventually(tail).Should(Say(`^\{"version":2,`))
+					Eventually(tail).Should(Say(`\[[0-9.e-]+,"o","tick[0-9]+\\n"\]\n`))
+					// the user is notified
+					Eventually(session.Err).Should(Say(`\[an auditor is watching this session\]`))
+					Eventually(session, 10*time.Second).Should(Exit(0))
+					// the stream ends with the session
+					Eventually(tailEnded).Should(BeClosed())
+
+					rsp, err = adminClient.Get(tailURL)
+					Expect(err).ToNot(HaveOccurred())
+					rsp.Body.Close()
+					Expect(rsp.StatusCode).To(Equal(http.StatusNotFound))
+					Eventually(func() ([]byte, error) { return os.ReadFile(auditLogPath) }).Should(And(
+						MatchRegexp(`"type":"live_tail".*"auditor":"incident-42","result":"attached"`),
+						MatchRegexp(`"type":"live_tail".*"auditor":"incident-42","result":"detached"`)))
+				})
+
+				It("Should run the command forced by the authorized key", func() {
+					pubkey, privkey, err := ed25519.GenerateKey(nil)
+					Expect(err).ToNot(HaveOccurred())
+					sshPubkey, err := ssh.NewPublicKey(pubkey)
+					Expect(err).ToNot(HaveOccurred())
+					pemPrivkey, err := ssh.MarshalPrivateKey(privkey, "")
+					Expect(err).ToNot(HaveOccurred())
+					forcedPrivKeyPath := filepath.Join(GinkgoT().TempDir(), "forced_id_ed25519")
+					Expect(os.WriteFile(forcedPrivKeyPath, pem.EncodeToMemory(pemPrivkey), 0600)).To(Succeed())
+
+					identitiesPath := fmt.Sprintf("/home/%s/.ssh3/authorized_identities", username)
+					identities, err := os.ReadFile(identitiesPath)
+					Expect(err).ToNot(HaveOccurred())
+					DeferCleanup(os.WriteFile, identitiesPath, identities, os.FileMode(0644))
+					forcedIdentity := fmt.Sprintf(`command="echo \"forced instead of $SSH3_ORIGINAL_COMMAND\"" %s`, ssh.MarshalAuthorizedKey(sshPubkey))
+					Expect(os.WriteFile(identitiesPath, append(identities, []byte("\n"+forcedIdentity)...), 0644)).To(Succeed())
+
+					clientArgs = append(getClientArgs(forcedPrivKeyPath), "echo", "Hello, World!")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say("forced instead of echo Hello, World!"))
+
+					// the other keys are not restricted
+					clientArgs = append(getClientArgs(rsaPrivKeyPath), "echo", "Hello, World!")
+					session, err = Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say("Hello, World!"))
+					Expect(session.Out.Contents()).ToNot(ContainSubstring("forced"))
+				})
+
+				It("Should serve the rpc subsystem", func() {
+					clientArgs = append(getClientArgs(rsaPrivKeyPath, "-s"), "rpc")
+					command := exec.Command(ssh3Path, clientArgs...)
+					stdin, err := command.StdinPipe()
+					Expect(err).ToNot(HaveOccurred())
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					defer session.Terminate()
+
+					_, err = fmt.Fprintln(stdin, `{"jsonrpc": "2.0", "id": 1, "method": "exec", "params": {"argv": ["echo", "no $shell 'quoting'"]}}`)
+					Expect(err).ToNot(HaveOccurred())
+					// base64 of "no $shell 'quoting'\n"
+					Eventually(session.Out).Should(Say(regexp.QuoteMeta(`{"jsonrpc":"2.0","id":1,"result":{"exit_status":0,"stdout":"bm8gJHNoZWxsICdxdW90aW5nJwo=","stderr":""}}`)))
+					_, err = fmt.Fprintln(stdin, `{"jsonrpc": "2.0", "id": 2, "method": "stat", "params": {"path": "/root"}}`)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session.Out).Should(Say(regexp.QuoteMeta(`{"jsonrpc":"2.0","id":2,"error":{"code":-32001,"message":"stat: permission denied: /root is not an allowed path"}}`)))
+					_, err = fmt.Fprintln(stdin, `{"jsonrpc": "2.0", "id": 3, "method": "list_dir", "params": {"path": "/etc"}}`)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session.Out).Should(Say(regexp.QuoteMeta(`{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"method list_dir not found"}}`)))
+				})
+
 				It("Should return the correct exit status", func() {
 					clientArgs0 := append(getClientArgs(rsaPrivKeyPath), "exit", "0")
 					clientArgs1 := append(getClientArgs(rsaPrivKeyPath), "exit", "1")
@@ -165,6 +1275,151 @@ var _ = Describe("Testing the ssh3 cli", func() {
 					Eventually(session).Should(Exit(255))
 				})
 
+				It("Should keep the standard error of the remote command separate", func() {
+					clientArgs := append(getClientArgs(rsaPrivKeyPath), "echo out 1; echo err 1 >&2; echo out 2; echo err 2 >&2")
+					session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say("^out 1\nout 2\n"))
+					Expect(session.Err).To(Say("err 1\nerr 2\n"))
+					Expect(string(session.Out.Contents())).ToNot(ContainSubstring("err"))
+				})
+
+				It("Should send the end of the input to the remote command", func() {
+					command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), "cat; echo done")...)
+					command.Stdin = strings.NewReader("foo\n")
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+					Expect(session.Out).To(Say("^foo\ndone\n"))
+				})
+
+				It("Should pipe binary data unmodified", func() {
+					// every byte value, along with the line endings and escape sequences that a pty
+					// or a terminal would translate
+					data := []byte("\r\n~.\n~?\r\x00\x03\x04\x1a\r\n")
+					for i := 0; i < 256; i++ {
+						data = append(data, byte(i))
+					}
+					random := make([]byte, 4<<20)
+					rand.New(rand.NewSource(42)).Read(random)
+					data = append(data, random...)
+
+					command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), "cat")...)
+					command.Stdin = bytes.NewReader(data)
+					command.Stderr = GinkgoWriter
+					output, err := command.Output()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(len(output)).To(Equal(len(data)))
+					Expect(bytes.Equal(output, data)).To(BeTrue())
+				})
+
+				It("Should copy directories with tar", func() {
+					src, dst := GinkgoT().TempDir(), GinkgoT().TempDir()
+					writeBinaryTree(src)
+					remoteDir := fmt.Sprintf("ssh3-tar-test-%d", time.Now().UnixNano())
+
+					upload := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), fmt.Sprintf("mkdir %s && tar x -C %s", remoteDir, remoteDir))...)
+					upload.Stderr = GinkgoWriter
+					pipeCommands(exec.Command("tar", "c", "-C", src, "."), upload)
+
+					download := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), fmt.Sprintf("tar c -C %s . && rm -r %s", remoteDir, remoteDir))...)
+					download.Stderr = GinkgoWriter
+					pipeCommands(download, exec.Command("tar", "x", "-C", dst))
+					expectSameTree(src, dst)
+				})
+
+				It("Should synchronize directories with rsync", func() {
+					if _, err := exec.LookPath("rsync"); err != nil {
+						Skip("rsync is not installed")
+					}
+					src, dst := GinkgoT().TempDir(), GinkgoT().TempDir()
+					writeBinaryTree(src)
+					remoteDir := fmt.Sprintf("ssh3-rsync-test-%d", time.Now().UnixNano())
+					// rsync passes the host followed by the command to run, the test server having a
+					// port and a URL path
+					rsh := filepath.Join(GinkgoT().TempDir(), "rsh")
+					err := os.WriteFile(rsh, []byte(fmt.Sprintf("#!/bin/sh\nshift\nexec %s %s \"$@\"\n", ssh3Path, strings.Join(getClientArgs(rsaPrivKeyPath), " "))), 0755)
+					Expect(err).ToNot(HaveOccurred())
+
+					rsync := func(args ...string) {
+						session, err := Start(exec.Command("rsync", append([]string{"-rlpt", "--rsh", rsh}, args...)...), GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						Eventually(session, "30s").Should(Exit(0))
+					}
+					rsync(src+"/", "server:"+remoteDir+"/")
+					// the second run sends the differences of the modified file
+					large := filepath.Join(src, "subdir", "large")
+					file, err := os.OpenFile(large, os.O_WRONLY, 0)
+					Expect(err).ToNot(HaveOccurred())
+					_, err = file.WriteAt([]byte("modified"), 1<<20)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(file.Close()).To(Succeed())
+					Expect(os.Chtimes(large, time.Now(), time.Now().Add(time.Minute))).To(Succeed())
+					rsync(src+"/", "server:"+remoteDir+"/")
+
+					rsync("server:"+remoteDir+"/", dst+"/")
+					expectSameTree(src, dst)
+
+					session, err := Start(exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), "rm -r "+remoteDir)...), GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session).Should(Exit(0))
+				})
+
+				It("Should block the remote command while its output is not consumed", func() {
+					marker := fmt.Sprintf("/tmp/ssh3-flow-control-%d", time.Now().UnixNano())
+					defer os.Remove(marker)
+					stdout, stdoutW, err := os.Pipe()
+					Expect(err).ToNot(HaveOccurred())
+					defer stdout.Close()
+					command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), fmt.Sprintf("head -c 100000000 /dev/zero; touch %s", marker))...)
+					command.Stdout = stdoutW
+					Expect(command.Start()).To(Succeed())
+					stdoutW.Close()
+
+					// neither the client nor the server buffer the output that is not read
+					Consistently(func() bool { _, err := os.Stat(marker); return err == nil }, 3*time.Second).Should(BeFalse())
+					n, err := io.Copy(io.Discard, stdout)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(n).To(BeNumerically(">=", 100000000))
+					Expect(command.Wait()).To(Succeed())
+					Expect(marker).To(BeAnExistingFile())
+				})
+
+				It("Should fail fast when a command without terminal waits for a password", func() {
+					// the standard input stays open, as in a script waiting for the command
+					stdin, stdinW, err := os.Pipe()
+					Expect(err).ToNot(HaveOccurred())
+					defer stdin.Close()
+					defer stdinW.Close()
+					command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath, "-on-password-prompt", "fail"), `printf "[sudo] password for alice: " >&2; read password`)...)
+					command.Stdin = stdin
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session, "5s").Should(Exit(255))
+					Expect(session.Err).To(Say(`the remote command is waiting for a password \("\[sudo\] password for alice:"\) but runs without a terminal`))
+				})
+
+				It("Should run a command on a simulated lossy network", func() {
+					command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath, "-simulate-network", "latency=50ms,jitter=10ms,loss=5%,seed=1"), "echo hello")...)
+					session, err := Start(command, GinkgoWriter, GinkgoWriter)
+					Expect(err).ToNot(HaveOccurred())
+					Eventually(session, "20s").Should(Exit(0))
+					Expect(session.Out).To(Say("^hello\n"))
+					Expect(session.Err).To(Say("simulating a degraded network"))
+				})
+
+				It("Should exit with 128 + the number of the signal that killed the remote command", func() {
+					for signal, status := range map[string]int{"TERM": 143, "KILL": 137, "SEGV": 139} {
+						command := exec.Command(ssh3Path, append(getClientArgs(rsaPrivKeyPath), "echo before; kill -"+signal+" $$; echo after")...)
+						session, err := Start(command, GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						Eventually(session).Should(Exit(status))
+						Expect(session.Out).To(Say("^before\n"))
+						Expect(session.Out.Contents()).ToNot(ContainSubstring("after"))
+					}
+				})
+
 				It("Should run the interactive shell in login mode and read .profile", func() {
 					clientArgs = getClientArgs(rsaPrivKeyPath)
 					command := exec.Command(ssh3Path, clientArgs...)
@@ -290,6 +1545,74 @@ var _ = Describe("Testing the ssh3 cli", func() {
 						}
 						testTCPPortForwarding(8082, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 9091}, "hello from client", "hello from server")
 					})
+
+					It("refuses the connections exceeding the quotas", func() {
+						listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9092})
+						Expect(err).ToNot(HaveOccurred())
+						defer listener.Close()
+						accepted := make(chan net.Conn, 2)
+						go func() {
+							for {
+								conn, err := listener.Accept()
+								if err != nil {
+									return
+								}
+								accepted <- conn
+							}
+						}()
+
+						clientArgs := getClientArgs(rsaPrivKeyPath, "-forward-tcp", "8083/127.0.0.1@9092")
+						session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						defer session.Terminate()
+
+						var first net.Conn
+						Eventually(func() error {
+							var err error
+							first, err = net.Dial("tcp", "127.0.0.1:8083")
+							return err
+						}).ShouldNot(HaveOccurred())
+						defer first.Close()
+						_, err = first.Write([]byte("first"))
+						Expect(err).ToNot(HaveOccurred())
+						var forwarded net.Conn
+						Eventually(accepted).Should(Receive(&forwarded))
+						defer forwarded.Close()
+
+						// the server allows a single forwarded connection per conversation
+						second, err := net.Dial("tcp", "127.0.0.1:8083")
+						Expect(err).ToNot(HaveOccurred())
+						defer second.Close()
+						_, err = second.Write([]byte("second"))
+						Expect(err).ToNot(HaveOccurred())
+						second.SetReadDeadline(time.Now().Add(2 * time.Second))
+						n, err := second.Read(make([]byte, 1))
+						Expect(n).To(Equal(0))
+						Expect(err).To(Equal(io.EOF))
+						Consistently(accepted, "200ms").ShouldNot(Receive())
+						Expect(session.Err).To(Say("too many forwarded connections"))
+					})
+
+					It("reports the destinations that the server could not connect to", func() {
+						// nothing listens on the port
+						clientArgs := getClientArgs(rsaPrivKeyPath, "-forward-tcp", "8084/127.0.0.1@9093")
+						session, err := Start(exec.Command(ssh3Path, clientArgs...), GinkgoWriter, GinkgoWriter)
+						Expect(err).ToNot(HaveOccurred())
+						defer session.Terminate()
+
+						var conn net.Conn
+						Eventually(func() error {
+							var err error
+							conn, err = net.Dial("tcp", "127.0.0.1:8084")
+							return err
+						}).ShouldNot(HaveOccurred())
+						defer conn.Close()
+						conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+						n, err := conn.Read(make([]byte, 1))
+						Expect(n).To(Equal(0))
+						Expect(err).To(Equal(io.EOF))
+						Eventually(session.Err).Should(Say(`\(connect failed\): could not connect to 127.0.0.1:9093`))
+					})
 				})
 			})
 
@@ -0,0 +1,226 @@
+package ssh3
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a JSON Web Key (RFC 7517) holding an Ed25519, ECDSA or RSA public key, and its private
+// key if D is set
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	// the Ed25519 and ECDSA keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	// the RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// the private key, and the CRT values of the RSA ones
+	D  string `json:"d,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	DP string `json:"dp,omitempty"`
+	DQ string `json:"dq,omitempty"`
+	QI string `json:"qi,omitempty"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func encodeJWKInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// the coordinates and private keys of the ECDSA keys have the size of the curve
+func encodeJWKFixedInt(i *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(i.FillBytes(make([]byte, size)))
+}
+
+func decodeJWKInt(value string, name string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid JWK parameter %q", name)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// NewJWK returns the JWK of an Ed25519, ECDSA or RSA public or private key, as returned by
+// ParseRawPrivateKey. The signing algorithm is set as in the authentication JWTs of the client.
+func NewJWK(key interface{}) (*JWK, error) {
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return NewJWK(*k)
+	case ed25519.PrivateKey:
+		jwk, err := NewJWK(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		jwk.D = base64.RawURLEncoding.EncodeToString(k.Seed())
+		return jwk, nil
+	case ed25519.PublicKey:
+		return &JWK{Kty: "OKP", Crv: "Ed25519", Alg: "EdDSA", X: base64.RawURLEncoding.EncodeToString(k)}, nil
+	case *ecdsa.PrivateKey:
+		jwk, err := NewJWK(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		jwk.D = encodeJWKFixedInt(k.D, (k.Curve.Params().BitSize+7)/8)
+		return jwk, nil
+	case *ecdsa.PublicKey:
+		name := k.Curve.Params().Name
+		if _, ok := jwkCurves[name]; !ok {
+			return nil, fmt.Errorf("unsupported curve %s", name)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		algs := map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+		return &JWK{Kty: "EC", Crv: name, Alg: algs[name], X: encodeJWKFixedInt(k.X, size), Y: encodeJWKFixedInt(k.Y, size)}, nil
+	case *rsa.PrivateKey:
+		jwk, err := NewJWK(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("multi-prime RSA keys are not supported")
+		}
+		k.Precompute()
+		jwk.D, jwk.P, jwk.Q = encodeJWKInt(k.D), encodeJWKInt(k.Primes[0]), encodeJWKInt(k.Primes[1])
+		jwk.DP, jwk.DQ, jwk.QI = encodeJWKInt(k.Precomputed.Dp), encodeJWKInt(k.Precomputed.Dq), encodeJWKInt(k.Precomputed.Qinv)
+		return jwk, nil
+	case *rsa.PublicKey:
+		return &JWK{Kty: "RSA", Alg: "RS256", N: encodeJWKInt(k.N), E: encodeJWKInt(big.NewInt(int64(k.E)))}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// ParseJWK parses a JSON Web Key
+func ParseJWK(data []byte) (*JWK, error) {
+	var jwk JWK
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	if _, err := jwk.PublicKey(); err != nil {
+		return nil, err
+	}
+	return &jwk, nil
+}
+
+// IsPrivate returns true if the JWK holds a private key
+func (k *JWK) IsPrivate() bool {
+	return k.D != ""
+}
+
+// PublicKey returns the ed25519.PublicKey, *ecdsa.PublicKey or *rsa.PublicKey of the JWK
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported JWK curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid JWK parameter %q", "x")
+		}
+		return ed25519.PublicKey(x), nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported JWK curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X, "x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y, "y")
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("the JWK point is not on the curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decodeJWKInt(k.N, "n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E, "e")
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid JWK parameter %q", "e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type %q", k.Kty)
+	}
+}
+
+// PrivateKey returns the ed25519.PrivateKey, *ecdsa.PrivateKey or *rsa.PrivateKey of the JWK
+func (k *JWK) PrivateKey() (crypto.Signer, error) {
+	if !k.IsPrivate() {
+		return nil, fmt.Errorf("the JWK holds no private key")
+	}
+	public, err := k.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	switch public := public.(type) {
+	case ed25519.PublicKey:
+		seed, err := base64.RawURLEncoding.DecodeString(k.D)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid JWK parameter %q", "d")
+		}
+		private := ed25519.NewKeyFromSeed(seed)
+		if !public.Equal(private.Public()) {
+			return nil, fmt.Errorf("the JWK private key does not match its public key")
+		}
+		return private, nil
+	case *ecdsa.PublicKey:
+		d, err := decodeJWKInt(k.D, "d")
+		if err != nil {
+			return nil, err
+		}
+		private := &ecdsa.PrivateKey{PublicKey: *public, D: d}
+		x, y := public.Curve.ScalarBaseMult(d.Bytes())
+		if x.Cmp(public.X) != 0 || y.Cmp(public.Y) != 0 {
+			return nil, fmt.Errorf("the JWK private key does not match its public key")
+		}
+		return private, nil
+	case *rsa.PublicKey:
+		d, err := decodeJWKInt(k.D, "d")
+		if err != nil {
+			return nil, err
+		}
+		p, err := decodeJWKInt(k.P, "p")
+		if err != nil {
+			return nil, err
+		}
+		q, err := decodeJWKInt(k.Q, "q")
+		if err != nil {
+			return nil, err
+		}
+		private := &rsa.PrivateKey{PublicKey: *public, D: d, Primes: []*big.Int{p, q}}
+		if err := private.Validate(); err != nil {
+			return nil, err
+		}
+		private.Precompute()
+		return private, nil
+	}
+	return nil, fmt.Errorf("unsupported JWK key type %q", k.Kty)
+}
@@ -0,0 +1,73 @@
+package ssh3_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON Web Keys", func() {
+	generators := map[string]func() (crypto.Signer, error){
+		"Ed25519": func() (crypto.Signer, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			return key, err
+		},
+		"ECDSA P-256": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+		"ECDSA P-521": func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P521(), rand.Reader) },
+		"RSA":         func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+	}
+	for name, generate := range generators {
+		generate := generate
+		It("encodes and decodes the "+name+" keys", func() {
+			key, err := generate()
+			Expect(err).ToNot(HaveOccurred())
+
+			private, err := ssh3.NewJWK(key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(private.IsPrivate()).To(BeTrue())
+			data, err := json.Marshal(private)
+			Expect(err).ToNot(HaveOccurred())
+			parsed, err := ssh3.ParseJWK(data)
+			Expect(err).ToNot(HaveOccurred())
+			decoded, err := parsed.PrivateKey()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.Public()).To(Equal(key.Public()))
+
+			public, err := ssh3.NewJWK(key.Public())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(public.IsPrivate()).To(BeFalse())
+			Expect(public.Alg).To(Equal(private.Alg))
+			publicKey, err := public.PublicKey()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(publicKey).To(Equal(key.Public()))
+		})
+	}
+
+	It("refuses the private keys not matching their public key", func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, other, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		jwk, err := ssh3.NewJWK(key)
+		Expect(err).ToNot(HaveOccurred())
+		otherJWK, err := ssh3.NewJWK(other)
+		Expect(err).ToNot(HaveOccurred())
+		jwk.D = otherJWK.D
+		_, err = jwk.PrivateKey()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("refuses the EC points that are not on the curve", func() {
+		_, err := ssh3.ParseJWK([]byte(`{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
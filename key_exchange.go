@@ -0,0 +1,85 @@
+package ssh3
+
+import (
+	"crypto/tls"
+	"fmt"
+	"runtime"
+	"slices"
+)
+
+// PostQuantumKeyExchange tells whether the TLS 1.3 handshakes use the hybrid key exchanges
+// combining X25519 with ML-KEM, protecting the recorded connections from being decrypted once
+// quantum computers are available
+type PostQuantumKeyExchange string
+
+const (
+	// only the classical key exchanges are used
+	PostQuantumOff PostQuantumKeyExchange = "off"
+	// the hybrid key exchange is used with the peers supporting it, the other ones using a
+	// classical key exchange
+	PostQuantumPrefer PostQuantumKeyExchange = "prefer"
+	// only the hybrid key exchange is used, the handshakes with the peers not supporting it fail
+	PostQuantumRequire PostQuantumKeyExchange = "require"
+)
+
+var classicalKeyExchanges = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// ParsePostQuantumKeyExchange parses "off", "prefer" or "require", the empty string being "off"
+func ParsePostQuantumKeyExchange(s string) (PostQuantumKeyExchange, error) {
+	switch PostQuantumKeyExchange(s) {
+	case "", PostQuantumOff:
+		return PostQuantumOff, nil
+	case PostQuantumPrefer, PostQuantumRequire:
+		return PostQuantumKeyExchange(s), nil
+	}
+	return "", fmt.Errorf("unknown post-quantum key exchange option %q, expected off, prefer or require", s)
+}
+
+// PostQuantumKeyExchangeSupported returns true if the TLS stack the program was built with
+// implements the hybrid key exchanges (from Go 1.24)
+func PostQuantumKeyExchangeSupported() bool {
+	return len(hybridKeyExchanges) > 0
+}
+
+func (p PostQuantumKeyExchange) Validate() error {
+	if _, err := ParsePostQuantumKeyExchange(string(p)); err != nil {
+		return err
+	}
+	if (p == PostQuantumPrefer || p == PostQuantumRequire) && !PostQuantumKeyExchangeSupported() {
+		return fmt.Errorf("the post-quantum key exchanges are not supported by the TLS stack of %s, rebuild it with Go 1.24 or later", runtime.Version())
+	}
+	return nil
+}
+
+// ApplyTo sets the key exchanges offered or accepted by tlsConf
+func (p PostQuantumKeyExchange) ApplyTo(tlsConf *tls.Config) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	switch p {
+	case PostQuantumPrefer:
+		tlsConf.CurvePreferences = append(slices.Clone(hybridKeyExchanges), classicalKeyExchanges...)
+	case PostQuantumRequire:
+		tlsConf.CurvePreferences = slices.Clone(hybridKeyExchanges)
+	default:
+		tlsConf.CurvePreferences = slices.Clone(classicalKeyExchanges)
+	}
+	return nil
+}
+
+// KeyExchangeName returns the name of the key exchange negotiated during the handshake, or
+// "unknown" if the TLS stack does not tell it (before Go 1.25)
+func KeyExchangeName(state tls.ConnectionState) string {
+	keyExchange, ok := negotiatedKeyExchange(state)
+	if !ok {
+		return "unknown"
+	}
+	return keyExchange.String()
+}
+
+// IsPostQuantumKeyExchange returns true if the handshake used a hybrid key exchange, known being
+// false if the TLS stack does not tell it
+func IsPostQuantumKeyExchange(state tls.ConnectionState) (postQuantum bool, known bool) {
+	keyExchange, known := negotiatedKeyExchange(state)
+	return known && slices.Contains(hybridKeyExchanges, keyExchange), known
+}
@@ -0,0 +1,8 @@
+//go:build !go1.24
+
+package ssh3
+
+import "crypto/tls"
+
+// ML-KEM is only implemented by crypto/tls from Go 1.24
+var hybridKeyExchanges []tls.CurveID
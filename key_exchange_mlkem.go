@@ -0,0 +1,7 @@
+//go:build go1.24
+
+package ssh3
+
+import "crypto/tls"
+
+var hybridKeyExchanges = []tls.CurveID{tls.X25519MLKEM768}
@@ -0,0 +1,9 @@
+//go:build go1.25
+
+package ssh3
+
+import "crypto/tls"
+
+func negotiatedKeyExchange(state tls.ConnectionState) (tls.CurveID, bool) {
+	return state.CurveID, state.CurveID != 0
+}
@@ -0,0 +1,10 @@
+//go:build !go1.25
+
+package ssh3
+
+import "crypto/tls"
+
+// the negotiated key exchange is only exposed by crypto/tls from Go 1.25
+func negotiatedKeyExchange(state tls.ConnectionState) (tls.CurveID, bool) {
+	return 0, false
+}
@@ -0,0 +1,72 @@
+package ssh3_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Post-quantum key exchange", func() {
+	// performs a TLS handshake between a client and a server using the options
+	handshake := func(clientOption ssh3.PostQuantumKeyExchange, serverOption ssh3.PostQuantumKeyExchange) (tls.ConnectionState, error) {
+		server := newEd25519Identity()
+		serverConf := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{server.cert.Raw}, PrivateKey: server.key}}}
+		Expect(serverOption.ApplyTo(serverConf)).To(Succeed())
+		roots := x509.NewCertPool()
+		roots.AddCert(server.cert)
+		clientConf := &tls.Config{RootCAs: roots, ServerName: "selfsigned.ssh3"}
+		Expect(clientOption.ApplyTo(clientConf)).To(Succeed())
+
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- tls.Server(serverConn, serverConf).Handshake()
+			serverConn.Close()
+		}()
+		client := tls.Client(clientConn, clientConf)
+		err := client.Handshake()
+		<-serverErr
+		return client.ConnectionState(), err
+	}
+
+	It("Parses the options", func() {
+		for _, option := range []string{"", "off", "prefer", "require"} {
+			_, err := ssh3.ParsePostQuantumKeyExchange(option)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := ssh3.ParsePostQuantumKeyExchange("kyber")
+		Expect(err).To(HaveOccurred())
+		Expect(ssh3.PostQuantumKeyExchange("kyber").Validate()).ToNot(Succeed())
+	})
+
+	It("Negotiates the hybrid key exchange with the peers supporting it", func() {
+		if !ssh3.PostQuantumKeyExchangeSupported() {
+			Skip("the TLS stack does not support the post-quantum key exchanges")
+		}
+		state, err := handshake(ssh3.PostQuantumPrefer, ssh3.PostQuantumRequire)
+		Expect(err).ToNot(HaveOccurred())
+		if postQuantum, known := ssh3.IsPostQuantumKeyExchange(state); known {
+			Expect(postQuantum).To(BeTrue())
+			Expect(ssh3.KeyExchangeName(state)).To(Equal("X25519MLKEM768"))
+		}
+
+		state, err = handshake(ssh3.PostQuantumPrefer, ssh3.PostQuantumOff)
+		Expect(err).ToNot(HaveOccurred())
+		if postQuantum, known := ssh3.IsPostQuantumKeyExchange(state); known {
+			Expect(postQuantum).To(BeFalse())
+			Expect(ssh3.KeyExchangeName(state)).To(Equal("X25519"))
+		}
+
+		_, err = handshake(ssh3.PostQuantumRequire, ssh3.PostQuantumOff)
+		Expect(err).To(HaveOccurred())
+		_, err = handshake(ssh3.PostQuantumOff, ssh3.PostQuantumRequire)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,70 @@
+package ssh3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// KnockHeader carries the knock token proving that the client knows the knock secret of a server
+// hiding its endpoint, which answers 404 to the other requests
+const KnockHeader = "Ssh3-Knock"
+
+// the knock tokens change at each time step, the tokens of the previous and next steps being
+// accepted to tolerate the clock skews
+const knockTimeStep = 30 * time.Second
+
+// the minimum size of the knock secrets
+const minKnockSecretSize = 16
+
+// LoadKnockSecret reads the knock secret shared by the server and its clients, the surrounding
+// whitespace being ignored, e.g. generated using "head -c 32 /dev/urandom | base64"
+func LoadKnockSecret(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(content)
+	if len(secret) < minKnockSecretSize {
+		return nil, fmt.Errorf("the knock secret %s is shorter than %d bytes", filename, minKnockSecretSize)
+	}
+	return secret, nil
+}
+
+func knockMAC(secret []byte, step int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	return mac.Sum(nil)
+}
+
+// NewKnockToken returns the knock token of secret at the given time
+func NewKnockToken(secret []byte, now time.Time) string {
+	return base64.RawURLEncoding.EncodeToString(knockMAC(secret, now.Unix()/int64(knockTimeStep.Seconds())))
+}
+
+// VerifyKnockToken returns true if token is the knock token of secret at the given time, or at
+// the previous or next time step. The token is compared in constant time.
+func VerifyKnockToken(secret []byte, token string, now time.Time) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	step := now.Unix() / int64(knockTimeStep.Seconds())
+	valid := 0
+	for delta := int64(-1); delta <= 1; delta++ {
+		valid |= subtle.ConstantTimeCompare(decoded, knockMAC(secret, step+delta))
+	}
+	return valid == 1
+}
+
+// SetKnockHeader adds the current knock token of secret to the request
+func SetKnockHeader(req *http.Request, secret []byte) {
+	req.Header.Set(KnockHeader, NewKnockToken(secret, time.Now()))
+}
@@ -0,0 +1,48 @@
+package ssh3_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Knock tokens", func() {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	It("Accepts the tokens of the surrounding time steps", func() {
+		now := time.Unix(1700000000, 0)
+		token := ssh3.NewKnockToken(secret, now)
+		Expect(ssh3.VerifyKnockToken(secret, token, now)).To(BeTrue())
+		Expect(ssh3.VerifyKnockToken(secret, token, now.Add(30*time.Second))).To(BeTrue())
+		Expect(ssh3.VerifyKnockToken(secret, token, now.Add(-30*time.Second))).To(BeTrue())
+		Expect(ssh3.VerifyKnockToken(secret, token, now.Add(2*time.Minute))).To(BeFalse())
+		Expect(ssh3.VerifyKnockToken(secret, token, now.Add(-2*time.Minute))).To(BeFalse())
+	})
+
+	It("Refuses the tokens of other secrets and the malformed tokens", func() {
+		now := time.Now()
+		otherToken := ssh3.NewKnockToken([]byte("fedcba9876543210fedcba9876543210"), now)
+		Expect(ssh3.VerifyKnockToken(secret, otherToken, now)).To(BeFalse())
+		Expect(ssh3.VerifyKnockToken(secret, "", now)).To(BeFalse())
+		Expect(ssh3.VerifyKnockToken(secret, "not base64!", now)).To(BeFalse())
+		token := ssh3.NewKnockToken(secret, now)
+		Expect(ssh3.VerifyKnockToken(secret, token[:len(token)-2], now)).To(BeFalse())
+	})
+
+	It("Loads the secrets and refuses the short ones", func() {
+		dir := GinkgoT().TempDir()
+		filename := filepath.Join(dir, "knock")
+		Expect(os.WriteFile(filename, append(secret, '\n'), 0600)).To(Succeed())
+		loaded, err := ssh3.LoadKnockSecret(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded).To(Equal(secret))
+		Expect(os.WriteFile(filename, []byte("short\n"), 0600)).To(Succeed())
+		_, err = ssh3.LoadKnockSecret(filename)
+		Expect(err).To(HaveOccurred())
+	})
+})
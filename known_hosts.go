@@ -2,14 +2,44 @@ package ssh3
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
-	"syscall"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// the types of the known host lines, "<host> <type> <base64 value>"
+const (
+	// pins a certificate, given in DER
+	knownHostCertificate = "x509-certificate"
+	// pins the public key of the certificates, given as the SHA-256 hash of their
+	// SubjectPublicKeyInfo, so that the certificate can be renewed with the same key
+	knownHostPublicKeySHA256 = "sha256-spki"
 )
 
+// marks the revoked keys, e.g. "@revoked * sha256-spki <hash>", refused even if they are pinned
+// or signed by a trusted authority
+const revokedMarker = "@revoked"
+
+// the prefix of the hashed hosts, "|1|<base64 salt>|<base64 HMAC-SHA1 of the host>" as in the
+// known_hosts of OpenSSH, so that the file does not reveal the hosts connected to
+const hashedHostPrefix = "|1|"
+
+// the host of the revoked keys refused for every host
+const anyHost = "*"
+
 type InvalidKnownHost struct {
 	line string
 }
@@ -18,8 +48,143 @@ func (e InvalidKnownHost) Error() string {
 	return fmt.Sprintf("invalid known host line: %s", e.line)
 }
 
-func ParseKnownHosts(filename string) (knownHosts map[string][]*x509.Certificate, invalidLines []int, err error) {
-	knownHosts = make(map[string][]*x509.Certificate)
+// HostKeyChanged is returned when the certificate of a host matches none of its pinned keys
+type HostKeyChanged struct {
+	Host string
+}
+
+func (e HostKeyChanged) Error() string {
+	return fmt.Sprintf("the certificate of %s matches none of its known keys", e.Host)
+}
+
+// RevokedHostKey is returned when a host presents a revoked key
+type RevokedHostKey struct {
+	Host string
+}
+
+func (e RevokedHostKey) Error() string {
+	return fmt.Sprintf("the key of %s is revoked", e.Host)
+}
+
+// UnknownHost is returned when no key is pinned for a host
+type UnknownHost struct {
+	Host string
+}
+
+func (e UnknownHost) Error() string {
+	return fmt.Sprintf("no known key for %s", e.Host)
+}
+
+// PublicKeySHA256 returns the hash pinning the public key of cert
+func PublicKeySHA256(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// HashKnownHost returns host hashed with a random salt, as written in the known hosts
+func HashKnownHost(host string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashHostWithSalt(host, salt), nil
+}
+
+func hashHostWithSalt(host string, salt []byte) string {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hashedHostPrefix + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type knownHostEntry struct {
+	// a host name, a hashed host or anyHost for the revoked keys
+	host    string
+	revoked bool
+	// nil for the public key pins
+	certificate     *x509.Certificate
+	publicKeySHA256 []byte
+}
+
+func parseKnownHostLine(line string) (knownHostEntry, error) {
+	fields := strings.Fields(line)
+	entry := knownHostEntry{}
+	if len(fields) > 0 && fields[0] == revokedMarker {
+		entry.revoked = true
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return entry, InvalidKnownHost{line: line}
+	}
+	entry.host = fields[0]
+	if entry.host == anyHost && !entry.revoked {
+		return entry, InvalidKnownHost{line: line}
+	}
+	if hashed, ok := strings.CutPrefix(entry.host, hashedHostPrefix); ok {
+		salt, hash, ok := strings.Cut(hashed, "|")
+		if !ok {
+			return entry, InvalidKnownHost{line: line}
+		}
+		if _, err := base64.StdEncoding.DecodeString(salt); err != nil {
+			return entry, InvalidKnownHost{line: line}
+		}
+		if _, err := base64.StdEncoding.DecodeString(hash); err != nil {
+			return entry, InvalidKnownHost{line: line}
+		}
+	}
+	value, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return entry, InvalidKnownHost{line: line}
+	}
+	switch fields[1] {
+	case knownHostCertificate:
+		entry.certificate, err = x509.ParseCertificate(value)
+		if err != nil {
+			return entry, InvalidKnownHost{line: line}
+		}
+		entry.publicKeySHA256 = PublicKeySHA256(entry.certificate)
+	case knownHostPublicKeySHA256:
+		if len(value) != sha256.Size {
+			return entry, InvalidKnownHost{line: line}
+		}
+		entry.publicKeySHA256 = value
+	default:
+		return entry, InvalidKnownHost{line: line}
+	}
+	return entry, nil
+}
+
+func (e knownHostEntry) matchesHost(host string) bool {
+	if e.revoked && e.host == anyHost {
+		return true
+	}
+	hashed, ok := strings.CutPrefix(e.host, hashedHostPrefix)
+	if !ok {
+		return e.host == host
+	}
+	encodedSalt, _, _ := strings.Cut(hashed, "|")
+	// the hashed hosts are validated when parsed
+	salt, _ := base64.StdEncoding.DecodeString(encodedSalt)
+	return hmac.Equal([]byte(hashHostWithSalt(host, salt)), []byte(e.host))
+}
+
+func (e knownHostEntry) matchesKey(cert *x509.Certificate) bool {
+	return bytes.Equal(e.publicKeySHA256, PublicKeySHA256(cert))
+}
+
+// KnownHosts holds the keys pinned for the hosts in ~/.ssh3/known_hosts and the revoked ones
+type KnownHosts struct {
+	entries []knownHostEntry
+	// checks the revocation status of the certificates verified using the root CAs, if set
+	revocationChecker *RevocationChecker
+}
+
+// the maximum duration of the revocation checks performed during the handshakes
+const revocationCheckTimeout = 10 * time.Second
+
+// LoadKnownHosts parses the known hosts file, which may not exist yet. The numbers of the lines
+// that could not be parsed are returned along with the valid entries.
+func LoadKnownHosts(filename string) (knownHosts *KnownHosts, invalidLines []int, err error) {
+	knownHosts = &KnownHosts{}
 	file, err := os.Open(filename)
 	if os.IsNotExist(err) {
 		// the known hosts file simply does not exist yet, so there is no known host
@@ -28,42 +193,203 @@ func ParseKnownHosts(filename string) (knownHosts map[string][]*x509.Certificate
 	if err != nil {
 		return nil, nil, err
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
-
 	for i := 0; scanner.Scan(); i++ {
-		knownHost := strings.TrimSpace(scanner.Text())
-		fields := strings.Fields(knownHost)
-		if len(fields) != 3 || fields[1] != "x509-certificate" {
-			invalidLines = append(invalidLines, i)
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		certBytes, err := base64.StdEncoding.DecodeString(fields[2])
+		entry, err := parseKnownHostLine(line)
 		if err != nil {
 			invalidLines = append(invalidLines, i)
 			continue
 		}
-		cert, err := x509.ParseCertificate(certBytes)
-		if err != nil {
-			invalidLines = append(invalidLines, i)
-			continue
+		knownHosts.entries = append(knownHosts.entries, entry)
+	}
+	return knownHosts, invalidLines, scanner.Err()
+}
+
+// ParseKnownHosts returns the certificates pinned for the hosts stored in clear, see
+// LoadKnownHosts for the hashed hosts, the public key pins and the revoked keys
+func ParseKnownHosts(filename string) (knownHosts map[string][]*x509.Certificate, invalidLines []int, err error) {
+	loaded, invalidLines, err := LoadKnownHosts(filename)
+	if err != nil {
+		return nil, invalidLines, err
+	}
+	knownHosts = make(map[string][]*x509.Certificate)
+	for _, entry := range loaded.entries {
+		if !entry.revoked && entry.certificate != nil && !strings.HasPrefix(entry.host, hashedHostPrefix) {
+			knownHosts[entry.host] = append(knownHosts[entry.host], entry.certificate)
 		}
-		certs := knownHosts[fields[0]]
-		certs = append(certs, cert)
-		knownHosts[fields[0]] = certs
 	}
 	return knownHosts, invalidLines, nil
 }
 
-func AppendKnownHost(filename string, host string, cert *x509.Certificate) error {
-	encodedCert := base64.StdEncoding.EncodeToString(cert.Raw)
-	knownHosts, err := os.OpenFile(filename, os.O_CREATE|syscall.O_APPEND|syscall.O_WRONLY, 0600)
-	if err != nil {
-		return err
+// IsKnown returns true if a key is pinned for host
+func (k *KnownHosts) IsKnown(host string) bool {
+	for _, entry := range k.entries {
+		if !entry.revoked && entry.matchesHost(host) {
+			return true
+		}
 	}
-	_, err = knownHosts.WriteString(fmt.Sprintf("%s x509-certificate %s\n", host, encodedCert))
-	if err != nil {
-		return err
+	return false
+}
+
+// Certificates returns the certificates pinned for host, used to verify the rotations of its
+// identity
+func (k *KnownHosts) Certificates(host string) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, entry := range k.entries {
+		if !entry.revoked && entry.certificate != nil && entry.matchesHost(host) {
+			certs = append(certs, entry.certificate)
+		}
+	}
+	return certs
+}
+
+// IsRevoked returns true if the key of cert is revoked for host
+func (k *KnownHosts) IsRevoked(host string, cert *x509.Certificate) bool {
+	for _, entry := range k.entries {
+		if entry.revoked && entry.matchesHost(host) && entry.matchesKey(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyCertificate returns nil if the key of cert is pinned for host. It returns RevokedHostKey
+// if the key is revoked, HostKeyChanged if other keys are pinned for host and UnknownHost
+// otherwise.
+func (k *KnownHosts) VerifyCertificate(host string, cert *x509.Certificate) error {
+	if k.IsRevoked(host, cert) {
+		return RevokedHostKey{Host: host}
+	}
+	known := false
+	for _, entry := range k.entries {
+		if entry.revoked || !entry.matchesHost(host) {
+			continue
+		}
+		if entry.matchesKey(cert) {
+			return nil
+		}
+		known = true
+	}
+	if known {
+		return HostKeyChanged{Host: host}
 	}
+	return UnknownHost{Host: host}
+}
+
+// Add pins cert for host until the known hosts are loaded again, e.g. once its rotation was
+// written using ReplaceKnownHost
+func (k *KnownHosts) Add(host string, cert *x509.Certificate) {
+	k.entries = append(k.entries, knownHostEntry{host: host, certificate: cert, publicKeySHA256: PublicKeySHA256(cert)})
+}
+
+// SetRevocationChecker makes ConfigureTLS check the revocation status of the certificates verified
+// using the root CAs. The pinned keys are revoked in the known hosts file instead.
+func (k *KnownHosts) SetRevocationChecker(checker *RevocationChecker) {
+	k.revocationChecker = checker
+}
+
+// ConfigureTLS makes tlsConf accept the certificates of host whose key is pinned, along with the
+// ones verified by its root CAs as before, whose revocation status is then checked if
+// SetRevocationChecker was called. The revoked keys are refused, even if InsecureSkipVerify
+// is set. A certificate refused because of the known hosts fails the handshake with a
+// HostKeyChanged, RevokedHostKey or UnknownHost error.
+func (k *KnownHosts) ConfigureTLS(host string, tlsConf *tls.Config) {
+	insecure := tlsConf.InsecureSkipVerify
+	roots := tlsConf.RootCAs
+	// the certificates are verified by VerifyConnection
+	tlsConf.InsecureSkipVerify = true
+	tlsConf.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("the server sent no certificate")
+		}
+		leaf := state.PeerCertificates[0]
+		err := k.VerifyCertificate(host, leaf)
+		if err == nil || errors.As(err, &RevokedHostKey{}) {
+			return err
+		}
+		if insecure {
+			return nil
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, verifyErr := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: host})
+		if verifyErr != nil {
+			return fmt.Errorf("%w: %s", err, verifyErr)
+		}
+		if k.revocationChecker == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), revocationCheckTimeout)
+		defer cancel()
+		return k.revocationChecker.Check(ctx, chains[0], state.OCSPResponse)
+	}
+}
+
+// AppendKnownHost adds cert to the certificates of host. The file is locked and replaced
+// atomically, so that concurrent clients cannot corrupt it.
+func AppendKnownHost(filename string, host string, cert *x509.Certificate) error {
+	return appendKnownHostLine(filename, knownHostLine(host, cert))
+}
+
+// AppendKnownHostKey pins the public key of cert for host, which is hashed if hashHost is set (see
+// the HashKnownHosts option of OpenSSH), so that the server can renew its certificate with the
+// same key
+func AppendKnownHostKey(filename string, host string, cert *x509.Certificate, hashHost bool) error {
+	if hashHost {
+		var err error
+		if host, err = HashKnownHost(host); err != nil {
+			return err
+		}
+	}
+	return appendKnownHostLine(filename, fmt.Sprintf("%s %s %s\n", host, knownHostPublicKeySHA256, base64.StdEncoding.EncodeToString(PublicKeySHA256(cert))))
+}
+
+func appendKnownHostLine(filename string, line string) error {
+	return util.UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		return append(content, line...), nil
+	})
+}
+
+// ReplaceKnownHost replaces the keys pinned for host by cert, e.g. once the rotation of the server
+// certificate has been proven. The new line is hashed if the replaced ones were. The revoked keys
+// and the other lines are kept as they are and the file is replaced atomically.
+func ReplaceKnownHost(filename string, host string, cert *x509.Certificate) error {
+	return util.UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+		var lines []string
+		hashed := false
+		for _, line := range strings.SplitAfter(string(content), "\n") {
+			if entry, err := parseKnownHostLine(strings.TrimSpace(line)); err == nil && !entry.revoked && entry.matchesHost(host) {
+				hashed = hashed || strings.HasPrefix(entry.host, hashedHostPrefix)
+				continue
+			}
+			if line != "" && !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if hashed {
+			var err error
+			if host, err = HashKnownHost(host); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, knownHostLine(host, cert))
+		return []byte(strings.Join(lines, "")), nil
+	})
+}
 
-	return nil
+func knownHostLine(host string, cert *x509.Certificate) string {
+	return fmt.Sprintf("%s %s %s\n", host, knownHostCertificate, base64.StdEncoding.EncodeToString(cert.Raw))
 }
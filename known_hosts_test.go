@@ -0,0 +1,160 @@
+package ssh3_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Known hosts", func() {
+	var knownHostsPath string
+
+	BeforeEach(func() {
+		knownHostsPath = filepath.Join(GinkgoT().TempDir(), "known_hosts")
+	})
+
+	load := func() *ssh3.KnownHosts {
+		knownHosts, invalidLines, err := ssh3.LoadKnownHosts(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(invalidLines).To(BeEmpty())
+		return knownHosts
+	}
+
+	publicKeyHash := func(cert *x509.Certificate) string {
+		return base64.StdEncoding.EncodeToString(ssh3.PublicKeySHA256(cert))
+	}
+
+	It("Pins the public key of the certificates", func() {
+		pinned := newEd25519Identity()
+		Expect(ssh3.AppendKnownHostKey(knownHostsPath, "server.example", pinned.cert, false)).To(Succeed())
+		knownHosts := load()
+		Expect(knownHosts.IsKnown("server.example")).To(BeTrue())
+		Expect(knownHosts.VerifyCertificate("server.example", pinned.cert)).To(Succeed())
+		// the renewed certificate keeps the same key
+		Expect(knownHosts.VerifyCertificate("server.example", newIdentity(pinned.key).cert)).To(Succeed())
+		Expect(knownHosts.VerifyCertificate("server.example", newEd25519Identity().cert)).To(MatchError(ssh3.HostKeyChanged{Host: "server.example"}))
+		Expect(knownHosts.VerifyCertificate("other.example", pinned.cert)).To(MatchError(ssh3.UnknownHost{Host: "other.example"}))
+	})
+
+	It("Hashes the host names", func() {
+		pinned := newEd25519Identity()
+		Expect(ssh3.AppendKnownHostKey(knownHostsPath, "server.example", pinned.cert, true)).To(Succeed())
+		content, err := os.ReadFile(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(HavePrefix("|1|"))
+		Expect(string(content)).ToNot(ContainSubstring("server.example"))
+		knownHosts := load()
+		Expect(knownHosts.VerifyCertificate("server.example", pinned.cert)).To(Succeed())
+		Expect(knownHosts.IsKnown("other.example")).To(BeFalse())
+	})
+
+	It("Refuses the revoked keys of a host or of any host", func() {
+		pinned, revoked, revokedEverywhere := newEd25519Identity(), newEd25519Identity(), newEd25519Identity()
+		Expect(ssh3.AppendKnownHost(knownHostsPath, "server.example", pinned.cert)).To(Succeed())
+		Expect(ssh3.AppendKnownHost(knownHostsPath, "server.example", revoked.cert)).To(Succeed())
+		hashedHost, err := ssh3.HashKnownHost("server.example")
+		Expect(err).ToNot(HaveOccurred())
+		lines := fmt.Sprintf("@revoked %s sha256-spki %s\n@revoked * sha256-spki %s\n",
+			hashedHost, publicKeyHash(revoked.cert), publicKeyHash(revokedEverywhere.cert))
+		file, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0600)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = file.WriteString(lines)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file.Close()).To(Succeed())
+
+		knownHosts := load()
+		Expect(knownHosts.VerifyCertificate("server.example", pinned.cert)).To(Succeed())
+		Expect(knownHosts.VerifyCertificate("server.example", revoked.cert)).To(MatchError(ssh3.RevokedHostKey{Host: "server.example"}))
+		Expect(knownHosts.IsRevoked("other.example", revoked.cert)).To(BeFalse())
+		Expect(knownHosts.IsRevoked("other.example", revokedEverywhere.cert)).To(BeTrue())
+		// the revoked lines are not pins
+		Expect(knownHosts.IsKnown("other.example")).To(BeFalse())
+		Expect(knownHosts.Certificates("server.example")).To(HaveLen(2))
+	})
+
+	It("Reports the invalid lines", func() {
+		pinned := newEd25519Identity()
+		content := strings.Join([]string{
+			"# a comment",
+			"server.example sha256-spki " + publicKeyHash(pinned.cert),
+			"server.example sha256-spki dG9vIHNob3J0",
+			"* sha256-spki " + publicKeyHash(pinned.cert),
+			"|1|invalid server.example sha256-spki " + publicKeyHash(pinned.cert),
+			"server.example ssh-ed25519 " + publicKeyHash(pinned.cert),
+		}, "\n")
+		Expect(os.WriteFile(knownHostsPath, []byte(content), 0600)).To(Succeed())
+		knownHosts, invalidLines, err := ssh3.LoadKnownHosts(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(invalidLines).To(Equal([]int{2, 3, 4, 5}))
+		Expect(knownHosts.IsKnown("server.example")).To(BeTrue())
+	})
+
+	It("Keeps the hashing and the revoked keys when replacing the pins of a host", func() {
+		pinned, revoked, rotated := newEd25519Identity(), newEd25519Identity(), newEd25519Identity()
+		Expect(ssh3.AppendKnownHostKey(knownHostsPath, "server.example", pinned.cert, true)).To(Succeed())
+		content, err := os.ReadFile(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		content = append(content, "@revoked * sha256-spki "+publicKeyHash(revoked.cert)+"\n"...)
+		Expect(os.WriteFile(knownHostsPath, content, 0600)).To(Succeed())
+
+		Expect(ssh3.ReplaceKnownHost(knownHostsPath, "server.example", rotated.cert)).To(Succeed())
+		content, err = os.ReadFile(knownHostsPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).ToNot(ContainSubstring("server.example"))
+		knownHosts := load()
+		Expect(knownHosts.VerifyCertificate("server.example", rotated.cert)).To(Succeed())
+		Expect(knownHosts.VerifyCertificate("server.example", pinned.cert)).To(MatchError(ssh3.HostKeyChanged{Host: "server.example"}))
+		Expect(knownHosts.IsRevoked("server.example", revoked.cert)).To(BeTrue())
+	})
+
+	It("Accepts a rotation endorsed by a pinned public key", func() {
+		pinned := newEd25519Identity()
+		Expect(ssh3.AppendKnownHostKey(knownHostsPath, "server.example", pinned.cert, false)).To(Succeed())
+		knownHosts := load()
+		endorsing, err := ssh3.VerifyIdentityContinuityFunc(rotate(pinned).cert, func(previous *x509.Certificate) bool {
+			return knownHosts.VerifyCertificate("server.example", previous) == nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endorsing.Raw).To(Equal(pinned.cert.Raw))
+	})
+
+	Context("Verifying the TLS connections", func() {
+		verify := func(knownHosts *ssh3.KnownHosts, tlsConf *tls.Config, cert *x509.Certificate) error {
+			knownHosts.ConfigureTLS("server.example", tlsConf)
+			Expect(tlsConf.InsecureSkipVerify).To(BeTrue())
+			return tlsConf.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+		}
+
+		It("Accepts the pinned keys and verifies the other certificates using the roots", func() {
+			pinned, trusted := newEd25519Identity(), newEd25519Identity()
+			Expect(ssh3.AppendKnownHostKey(knownHostsPath, "server.example", pinned.cert, false)).To(Succeed())
+			knownHosts := load()
+			roots := x509.NewCertPool()
+			roots.AddCert(trusted.cert)
+
+			Expect(verify(knownHosts, &tls.Config{RootCAs: roots}, pinned.cert)).To(Succeed())
+			// the certificates generated by util.GenerateCert are valid for selfsigned.ssh3 only
+			Expect(verify(knownHosts, &tls.Config{RootCAs: roots}, trusted.cert)).To(MatchError(ContainSubstring("matches none of its known keys")))
+			Expect(verify(knownHosts, &tls.Config{RootCAs: roots}, newEd25519Identity().cert)).ToNot(Succeed())
+			Expect(verify(knownHosts, &tls.Config{RootCAs: roots, InsecureSkipVerify: true}, newEd25519Identity().cert)).To(Succeed())
+		})
+
+		It("Refuses the revoked keys even if the verification is skipped", func() {
+			revoked := newEd25519Identity()
+			Expect(os.WriteFile(knownHostsPath, []byte("@revoked * sha256-spki "+publicKeyHash(revoked.cert)+"\n"), 0600)).To(Succeed())
+			knownHosts := load()
+			roots := x509.NewCertPool()
+			roots.AddCert(revoked.cert)
+			Expect(verify(knownHosts, &tls.Config{RootCAs: roots, InsecureSkipVerify: true}, revoked.cert)).To(MatchError(ssh3.RevokedHostKey{Host: "server.example"}))
+		})
+	})
+})
@@ -0,0 +1,152 @@
+package ssh3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// the magic string starting the binary KRLs, see PROTOCOL.krl in OpenSSH
+const krlMagic = "SSHKRL\n\x00"
+
+const krlFormatVersion = 1
+
+// the sections of the binary KRLs
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+)
+
+// KeyRevocationList lists the revoked SSH public keys, as the RevokedKeys file of sshd
+type KeyRevocationList struct {
+	// indexed by the wire format of the keys
+	keys map[string]bool
+	// indexed by the SHA-1 and SHA-256 hashes of the wire format of the keys
+	sha1Hashes   map[string]bool
+	sha256Hashes map[string]bool
+}
+
+// ParseKeyRevocationList parses either a binary KRL generated by ssh-keygen -k or a text file
+// listing one public key per line in the authorized_keys format. The certificate sections of the
+// KRLs are ignored as the SSH certificates are not supported, and so are their signatures.
+func ParseKeyRevocationList(data []byte) (*KeyRevocationList, error) {
+	krl := &KeyRevocationList{keys: make(map[string]bool), sha1Hashes: make(map[string]bool), sha256Hashes: make(map[string]bool)}
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		return krl, krl.parseBinary(data[len(krlMagic):])
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		krl.keys[string(key.Marshal())] = true
+	}
+	return krl, scanner.Err()
+}
+
+func LoadKeyRevocationList(filename string) (*KeyRevocationList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	krl, err := ParseKeyRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key revocation list %s: %w", filename, err)
+	}
+	return krl, nil
+}
+
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("truncated KRL")
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *krlReader) readUint32() uint32 {
+	if value := r.read(4); value != nil {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+func (r *krlReader) readString() []byte {
+	return r.read(int(r.readUint32()))
+}
+
+func (krl *KeyRevocationList) parseBinary(data []byte) error {
+	r := &krlReader{data: data}
+	if version := r.readUint32(); r.err == nil && version != krlFormatVersion {
+		return fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	// the version of the KRL, its generation date and its flags
+	r.read(3 * 8)
+	// the reserved field and the comment
+	r.readString()
+	r.readString()
+	for r.err == nil && len(r.data) > 0 {
+		sectionType := r.read(1)
+		section := &krlReader{data: r.readString()}
+		if r.err != nil {
+			break
+		}
+		switch sectionType[0] {
+		case krlSectionCertificates:
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			for section.err == nil && len(section.data) > 0 {
+				value := string(section.readString())
+				switch sectionType[0] {
+				case krlSectionExplicitKey:
+					krl.keys[value] = true
+				case krlSectionFingerprintSHA1:
+					krl.sha1Hashes[value] = true
+				case krlSectionFingerprintSHA256:
+					krl.sha256Hashes[value] = true
+				}
+			}
+			if section.err != nil {
+				return section.err
+			}
+		case krlSectionSignature:
+			// the signatures end the KRL
+			return nil
+		default:
+			return fmt.Errorf("unsupported KRL section type %d", sectionType[0])
+		}
+	}
+	return r.err
+}
+
+// IsRevoked returns true if key is listed, either explicitly or by hash
+func (krl *KeyRevocationList) IsRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	sha1Hash := sha1.Sum(blob)
+	sha256Hash := sha256.Sum256(blob)
+	return krl.keys[string(blob)] || krl.sha1Hashes[string(sha1Hash[:])] || krl.sha256Hashes[string(sha256Hash[:])]
+}
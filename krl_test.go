@@ -0,0 +1,90 @@
+package ssh3_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHPublicKey() ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	key, err := ssh.NewPublicKey(public)
+	Expect(err).ToNot(HaveOccurred())
+	return key
+}
+
+func sshString(value []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(value))), value...)
+}
+
+// builds a KRL as generated by ssh-keygen -k, see PROTOCOL.krl in OpenSSH
+func buildKRL(sections ...[]byte) []byte {
+	krl := []byte("SSHKRL\n\x00")
+	krl = binary.BigEndian.AppendUint32(krl, 1)
+	// the version, the generation date and the flags
+	krl = append(krl, make([]byte, 3*8)...)
+	// the reserved field and the comment
+	krl = append(krl, sshString(nil)...)
+	krl = append(krl, sshString([]byte("test"))...)
+	for _, section := range sections {
+		krl = append(krl, section...)
+	}
+	return krl
+}
+
+func krlSection(sectionType byte, values ...[]byte) []byte {
+	var data []byte
+	for _, value := range values {
+		data = append(data, sshString(value)...)
+	}
+	return append([]byte{sectionType}, sshString(data)...)
+}
+
+var _ = Describe("Key revocation lists", func() {
+	It("Parses the binary KRLs", func() {
+		explicit, bySHA1, bySHA256, valid := newSSHPublicKey(), newSSHPublicKey(), newSSHPublicKey(), newSSHPublicKey()
+		sha1Hash := sha1.Sum(bySHA1.Marshal())
+		sha256Hash := sha256.Sum256(bySHA256.Marshal())
+		krl, err := ssh3.ParseKeyRevocationList(buildKRL(
+			// the certificate sections are ignored
+			krlSection(1, []byte("ignored")),
+			krlSection(2, explicit.Marshal()),
+			krlSection(3, sha1Hash[:]),
+			krlSection(5, sha256Hash[:]),
+			// the signatures end the KRL
+			krlSection(4, []byte("signature")),
+			[]byte("trailing data"),
+		))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(krl.IsRevoked(explicit)).To(BeTrue())
+		Expect(krl.IsRevoked(bySHA1)).To(BeTrue())
+		Expect(krl.IsRevoked(bySHA256)).To(BeTrue())
+		Expect(krl.IsRevoked(valid)).To(BeFalse())
+	})
+
+	It("Refuses the invalid KRLs", func() {
+		_, err := ssh3.ParseKeyRevocationList(buildKRL(krlSection(2, newSSHPublicKey().Marshal()))[:60])
+		Expect(err).To(HaveOccurred())
+		_, err = ssh3.ParseKeyRevocationList(buildKRL(krlSection(42)))
+		Expect(err).To(MatchError(ContainSubstring("unsupported KRL section")))
+	})
+
+	It("Parses the lists of public keys", func() {
+		revoked, valid := newSSHPublicKey(), newSSHPublicKey()
+		krl, err := ssh3.ParseKeyRevocationList([]byte("# revoked on 2026-10-15\n\n" + string(ssh.MarshalAuthorizedKey(revoked))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(krl.IsRevoked(revoked)).To(BeTrue())
+		Expect(krl.IsRevoked(valid)).To(BeFalse())
+		_, err = ssh3.ParseKeyRevocationList([]byte("not a key\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+	})
+})
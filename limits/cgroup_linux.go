@@ -0,0 +1,55 @@
+//go:build linux
+
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the period of the CPU quota of cpu.max, in microseconds
+const cgroupCPUPeriod = 100000
+
+// moves the current process into the cgroup of the config, so that the processes it spawns are
+// accounted and limited together, e.g. the sessions of a user
+func joinCgroup(config Config) error {
+	var controllers []string
+	limitFiles := make(map[string]string)
+	if config.CPUs != nil {
+		controllers = append(controllers, "+cpu")
+		limitFiles["cpu.max"] = strconv.Itoa(int(*config.CPUs*cgroupCPUPeriod)) + " " + strconv.Itoa(cgroupCPUPeriod)
+	}
+	if config.MaxMemory != nil {
+		controllers = append(controllers, "+memory")
+		limitFiles["memory.max"] = strconv.FormatUint(*config.MaxMemory, 10)
+	}
+	if config.MaxPids != nil {
+		controllers = append(controllers, "+pids")
+		limitFiles["pids.max"] = strconv.FormatUint(*config.MaxPids, 10)
+	}
+	parent := filepath.Dir(config.Cgroup)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	if len(controllers) > 0 {
+		// the controllers must be delegated by the parent for the limit files to exist
+		subtreeControl := filepath.Join(parent, "cgroup.subtree_control")
+		if err := os.WriteFile(subtreeControl, []byte(strings.Join(controllers, " ")), 0); err != nil {
+			return fmt.Errorf("could not delegate the %s controllers, are they enabled in the parent cgroup? %w", strings.Join(controllers, " "), err)
+		}
+	}
+	if err := os.Mkdir(config.Cgroup, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	// the limits are rewritten at each session, so that the changes of the config apply
+	for file, value := range limitFiles {
+		if err := os.WriteFile(filepath.Join(config.Cgroup, file), []byte(value), 0); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(config.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0)
+}
@@ -0,0 +1,9 @@
+//go:build unix && !linux
+
+package limits
+
+import "fmt"
+
+func joinCgroup(config Config) error {
+	return fmt.Errorf("cgroups are only available on Linux")
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package limits
+
+import "golang.org/x/sys/unix"
+
+// from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// sets the I/O priority of the current thread
+func setIOPriority(class IOClass, priority int) error {
+	if class == IOClassIdle {
+		priority = 0
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(class)<<ioprioClassShift|uintptr(priority))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build unix && !linux
+
+package limits
+
+import "fmt"
+
+func setIOPriority(class IOClass, priority int) error {
+	return fmt.Errorf("I/O scheduling classes are only available on Linux")
+}
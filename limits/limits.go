@@ -0,0 +1,107 @@
+// Package limits applies resource limits, a scheduling priority and a umask to the processes
+// spawned by the server. As os/exec cannot set them on a child only, they are applied by a helper
+// re-executing the server binary, which then drops the privileges of the command and executes it.
+package limits
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// the first argument of the server binary telling it to run as the limits helper
+const HelperSubcommand = "limits-exec"
+
+// IOClass is an I/O scheduling class of ioprio_set(2)
+type IOClass int
+
+const (
+	// keeps the I/O scheduling class of the server
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
+var ioClassNames = map[string]IOClass{
+	"realtime":    IOClassRealtime,
+	"best-effort": IOClassBestEffort,
+	"idle":        IOClassIdle,
+}
+
+// ParseIOClass parses "realtime", "best-effort" or "idle"
+func ParseIOClass(name string) (IOClass, error) {
+	class, ok := ioClassNames[name]
+	if !ok {
+		return IOClassNone, fmt.Errorf("unknown I/O scheduling class %q", name)
+	}
+	return class, nil
+}
+
+// ParseUmask parses an octal umask, e.g. "027"
+func ParseUmask(umask string) (uint32, error) {
+	value, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid umask %q: it must be an octal number up to 0777", umask)
+	}
+	return uint32(value), nil
+}
+
+// The nil fields keep the values of the server. The limits are set as both the soft and the hard
+// limits, so that the users cannot raise them.
+type Config struct {
+	// RLIMIT_NOFILE
+	MaxOpenFiles *uint64
+	// RLIMIT_NPROC, it counts all the processes of the user
+	MaxProcesses *uint64
+	// RLIMIT_CORE, in bytes
+	MaxCoreSize *uint64
+	// from -20 (highest priority) to 19 (lowest priority)
+	Nice *int
+	// Linux only
+	IOClass IOClass
+	// from 0 (highest priority) to 7 (lowest priority), ignored with IOClassNone and IOClassIdle
+	IOPriority int
+	Umask      *uint32
+	// the cgroup v2 directory of the command, created if needed, its parent directory being
+	// created as well and delegating the controllers of the limits below (Linux only)
+	Cgroup string
+	// the CPU time of the cgroup, in CPUs (cpu.max)
+	CPUs *float64
+	// the memory of the cgroup, in bytes (memory.max)
+	MaxMemory *uint64
+	// the processes and threads of the cgroup (pids.max)
+	MaxPids *uint64
+}
+
+func (c Config) Validate() error {
+	if c.Nice != nil && (*c.Nice < -20 || *c.Nice > 19) {
+		return fmt.Errorf("invalid nice value %d: it must be between -20 and 19", *c.Nice)
+	}
+	if c.IOClass < IOClassNone || c.IOClass > IOClassIdle {
+		return fmt.Errorf("invalid I/O scheduling class %d", c.IOClass)
+	}
+	if c.IOPriority < 0 || c.IOPriority > 7 {
+		return fmt.Errorf("invalid I/O priority %d: it must be between 0 and 7", c.IOPriority)
+	}
+	if c.Umask != nil && *c.Umask > 0777 {
+		return fmt.Errorf("invalid umask %o", *c.Umask)
+	}
+	if c.CPUs != nil && *c.CPUs <= 0 {
+		return fmt.Errorf("invalid number of CPUs %g: it must be positive", *c.CPUs)
+	}
+	if c.Cgroup != "" && !filepath.IsAbs(c.Cgroup) {
+		return fmt.Errorf("the cgroup directory must be an absolute path: %q", c.Cgroup)
+	}
+	return nil
+}
+
+// HasCgroupLimits returns true if the config sets limits applied using a cgroup
+func (c Config) HasCgroupLimits() bool {
+	return c.CPUs != nil || c.MaxMemory != nil || c.MaxPids != nil
+}
+
+// IsEmpty returns true if the config does not change anything
+func (c Config) IsEmpty() bool {
+	return c.MaxOpenFiles == nil && c.MaxProcesses == nil && c.MaxCoreSize == nil && c.Nice == nil && c.IOClass == IOClassNone && c.Umask == nil && !c.HasCgroupLimits()
+}
@@ -0,0 +1,92 @@
+//go:build linux
+
+package limits
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resource limits", func() {
+	It("Parses the umasks and the I/O scheduling classes", func() {
+		umask, err := ParseUmask("027")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(umask).To(Equal(uint32(0027)))
+		for _, invalid := range []string{"", "8", "1000", "-1", "u=rwx"} {
+			_, err := ParseUmask(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+
+		class, err := ParseIOClass("idle")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(class).To(Equal(IOClassIdle))
+		_, err = ParseIOClass("none")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Rejects the out of range priorities", func() {
+		nice := -21
+		Expect(Config{Nice: &nice}.Validate()).ToNot(Succeed())
+		nice = 19
+		Expect(Config{Nice: &nice}.Validate()).To(Succeed())
+		Expect(Config{IOClass: IOClassBestEffort, IOPriority: 8}.Validate()).ToNot(Succeed())
+	})
+
+	It("Moves the chroot, credentials and working directory of the command to the helper", func() {
+		maxOpenFiles, nice, umask := uint64(1024), 10, uint32(0077)
+		config := Config{MaxOpenFiles: &maxOpenFiles, Nice: &nice, IOClass: IOClassIdle, Umask: &umask}
+		cmd := exec.Command("/bin/sh", "-c", "ls")
+		cmd.Dir = "/home/user"
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Chroot:     "/srv/jail",
+			Credential: &syscall.Credential{Uid: 1000, Gid: 1000, Groups: []uint32{27, 100}},
+			Setsid:     true,
+		}
+		Expect(Wrap(cmd, config)).To(Succeed())
+
+		executable, err := os.Executable()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cmd.Path).To(Equal(executable))
+		Expect(cmd.Dir).To(Equal("/"))
+		Expect(cmd.SysProcAttr).To(Equal(&syscall.SysProcAttr{Setsid: true}))
+		Expect(cmd.Args[1]).To(Equal(HelperSubcommand))
+
+		parsedConfig, creds, argv, err := parseHelperArgs(cmd.Args[2:])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsedConfig).To(Equal(config))
+		Expect(creds).To(Equal(credentials{chrootDirectory: "/srv/jail", uid: 1000, gid: 1000, groups: []int{27, 100}, dir: "/home/user"}))
+		Expect(argv).To(Equal([]string{"/bin/sh", "/bin/sh", "-c", "ls"}))
+	})
+
+	It("Passes the cgroup limits to the helper", func() {
+		cpus, maxMemory, maxPids := 1.5, uint64(1<<30), uint64(256)
+		config := Config{CPUs: &cpus, MaxMemory: &maxMemory, MaxPids: &maxPids}
+		Expect(Wrap(exec.Command("/bin/true"), config)).ToNot(Succeed())
+
+		config.Cgroup = "/sys/fs/cgroup/ssh3/alice"
+		cmd := exec.Command("/bin/true")
+		Expect(Wrap(cmd, config)).To(Succeed())
+		parsedConfig, _, _, err := parseHelperArgs(cmd.Args[2:])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsedConfig).To(Equal(config))
+
+		cpus = 0
+		Expect(config.Validate()).ToNot(Succeed())
+	})
+
+	It("Keeps the credentials of the helper if the command has none", func() {
+		umask := uint32(0022)
+		cmd := exec.Command("/bin/true")
+		cmd.Dir = "/tmp"
+		Expect(Wrap(cmd, Config{Umask: &umask})).To(Succeed())
+		Expect(cmd.Dir).To(Equal("/tmp"))
+
+		_, creds, _, err := parseHelperArgs(cmd.Args[2:])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(credentials{uid: -1, gid: -1}))
+	})
+})
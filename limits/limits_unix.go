@@ -0,0 +1,268 @@
+//go:build unix
+
+package limits
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Wrap rewrites cmd so that it is run by the limits helper. The chroot directory, credentials
+// and working directory of cmd are applied by the helper once the limits are set, so that the
+// limits can be raised and the priority increased when the server runs as root.
+func Wrap(cmd *exec.Cmd, config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.IOClass != IOClassNone && runtime.GOOS != "linux" {
+		return fmt.Errorf("I/O scheduling classes are only available on Linux")
+	}
+	if config.HasCgroupLimits() && config.Cgroup == "" {
+		return fmt.Errorf("the CPU, memory and pids limits need a cgroup")
+	}
+	if config.Cgroup != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("cgroups are only available on Linux")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := append([]string{filepath.Base(executable), HelperSubcommand}, config.args()...)
+	if attr := cmd.SysProcAttr; attr != nil && (attr.Chroot != "" || attr.Credential != nil) {
+		if attr.Chroot != "" {
+			args = append(args, "-chroot", attr.Chroot)
+			attr.Chroot = ""
+		}
+		if credential := attr.Credential; credential != nil {
+			args = append(args,
+				"-uid", strconv.FormatUint(uint64(credential.Uid), 10),
+				"-gid", strconv.FormatUint(uint64(credential.Gid), 10),
+			)
+			if !credential.NoSetGroups {
+				groups := make([]string, 0, len(credential.Groups))
+				for _, group := range credential.Groups {
+					groups = append(groups, strconv.FormatUint(uint64(group), 10))
+				}
+				args = append(args, "-groups", strings.Join(groups, ","))
+			}
+			attr.Credential = nil
+		}
+		// relative to the chroot directory and accessed with the credentials of the command
+		args = append(args, "-dir", cmd.Dir)
+		cmd.Dir = "/"
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = executable
+	return nil
+}
+
+func (c Config) args() []string {
+	var args []string
+	if c.MaxOpenFiles != nil {
+		args = append(args, "-nofile", strconv.FormatUint(*c.MaxOpenFiles, 10))
+	}
+	if c.MaxProcesses != nil {
+		args = append(args, "-nproc", strconv.FormatUint(*c.MaxProcesses, 10))
+	}
+	if c.MaxCoreSize != nil {
+		args = append(args, "-core", strconv.FormatUint(*c.MaxCoreSize, 10))
+	}
+	if c.Nice != nil {
+		args = append(args, "-nice", strconv.Itoa(*c.Nice))
+	}
+	for name, class := range ioClassNames {
+		if class == c.IOClass {
+			args = append(args, "-ioclass", name, "-ioprio", strconv.Itoa(c.IOPriority))
+		}
+	}
+	if c.Umask != nil {
+		args = append(args, "-umask", strconv.FormatUint(uint64(*c.Umask), 8))
+	}
+	if c.Cgroup != "" {
+		args = append(args, "-cgroup", c.Cgroup)
+	}
+	if c.CPUs != nil {
+		args = append(args, "-cpus", strconv.FormatFloat(*c.CPUs, 'g', -1, 64))
+	}
+	if c.MaxMemory != nil {
+		args = append(args, "-memory", strconv.FormatUint(*c.MaxMemory, 10))
+	}
+	if c.MaxPids != nil {
+		args = append(args, "-pids", strconv.FormatUint(*c.MaxPids, 10))
+	}
+	return args
+}
+
+// the privileges dropped by the helper once the limits are set
+type credentials struct {
+	chrootDirectory string
+	// -1 if the credentials of the helper are kept
+	uid int
+	gid int
+	// nil if the groups of the helper are kept
+	groups []int
+	dir    string
+}
+
+func parseHelperArgs(args []string) (config Config, creds credentials, argv []string, err error) {
+	flags := flag.NewFlagSet(HelperSubcommand, flag.ContinueOnError)
+	uint64Flag := func(name string, usage string, value **uint64) {
+		flags.Func(name, usage, func(s string) error {
+			parsed, err := strconv.ParseUint(s, 10, 64)
+			*value = &parsed
+			return err
+		})
+	}
+	uint64Flag("nofile", "the maximum number of open files", &config.MaxOpenFiles)
+	uint64Flag("nproc", "the maximum number of processes of the user", &config.MaxProcesses)
+	uint64Flag("core", "the maximum size of the core dumps", &config.MaxCoreSize)
+	flags.Func("nice", "the niceness of the command", func(s string) error {
+		nice, err := strconv.Atoi(s)
+		config.Nice = &nice
+		return err
+	})
+	flags.Func("ioclass", "the I/O scheduling class of the command", func(s string) (err error) {
+		config.IOClass, err = ParseIOClass(s)
+		return err
+	})
+	flags.IntVar(&config.IOPriority, "ioprio", 0, "the priority within the I/O scheduling class")
+	flags.Func("umask", "the umask of the command, in octal", func(s string) error {
+		umask, err := ParseUmask(s)
+		config.Umask = &umask
+		return err
+	})
+	flags.StringVar(&config.Cgroup, "cgroup", "", "if set, the cgroup directory of the command")
+	flags.Func("cpus", "the CPU time of the cgroup, in CPUs", func(s string) error {
+		cpus, err := strconv.ParseFloat(s, 64)
+		config.CPUs = &cpus
+		return err
+	})
+	uint64Flag("memory", "the memory of the cgroup, in bytes", &config.MaxMemory)
+	uint64Flag("pids", "the processes and threads of the cgroup", &config.MaxPids)
+	flags.StringVar(&creds.chrootDirectory, "chroot", "", "if set, chroot in the specified directory")
+	flags.IntVar(&creds.uid, "uid", -1, "the uid of the command")
+	flags.IntVar(&creds.gid, "gid", -1, "the gid of the command")
+	flags.Func("groups", "the comma-separated supplementary groups of the command", func(s string) error {
+		creds.groups = []int{}
+		for _, group := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' }) {
+			gid, err := strconv.Atoi(group)
+			if err != nil {
+				return err
+			}
+			creds.groups = append(creds.groups, gid)
+		}
+		return nil
+	})
+	flags.StringVar(&creds.dir, "dir", "", "the working directory of the command")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, credentials{}, nil, err
+	}
+	if flags.NArg() < 2 || (creds.uid < 0) != (creds.gid < 0) {
+		return Config{}, credentials{}, nil, fmt.Errorf("usage: %s [LIMITS...] [-chroot DIR] [-uid UID -gid GID [-groups GIDS]] [-dir DIR] -- PATH ARGV...", HelperSubcommand)
+	}
+	return config, creds, flags.Args(), config.Validate()
+}
+
+// RunHelper sets the limits of the current process and executes the command given in args,
+// it only returns on error
+func RunHelper(args []string) int {
+	config, creds, argv, err := parseHelperArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return -1
+	}
+	// the priorities only apply to the current thread, which must then run execve(2)
+	runtime.LockOSThread()
+	if err := apply(config); err != nil {
+		fmt.Fprintf(os.Stderr, "could not set the limits of the session: %s\n", err)
+		return 1
+	}
+	if err := creds.drop(); err != nil {
+		fmt.Fprintf(os.Stderr, "could not drop the privileges of the session: %s\n", err)
+		return 1
+	}
+	path, argv := argv[0], argv[1:]
+	err = syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "could not execute %s: %s\n", path, err)
+	return 1
+}
+
+func apply(config Config) error {
+	rlimits := []struct {
+		resource int
+		name     string
+		value    *uint64
+	}{
+		{syscall.RLIMIT_NOFILE, "RLIMIT_NOFILE", config.MaxOpenFiles},
+		{unix.RLIMIT_NPROC, "RLIMIT_NPROC", config.MaxProcesses},
+		{syscall.RLIMIT_CORE, "RLIMIT_CORE", config.MaxCoreSize},
+	}
+	for _, rlimit := range rlimits {
+		if rlimit.value == nil {
+			continue
+		}
+		// syscall.Setrlimit, unlike unix.Setrlimit, keeps the Go runtime from restoring the
+		// original RLIMIT_NOFILE on execve(2)
+		if err := syscall.Setrlimit(rlimit.resource, newRlimit(*rlimit.value)); err != nil {
+			return fmt.Errorf("%s: %w", rlimit.name, err)
+		}
+	}
+	if config.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, *config.Nice); err != nil {
+			return fmt.Errorf("setpriority: %w", err)
+		}
+	}
+	if config.IOClass != IOClassNone {
+		if err := setIOPriority(config.IOClass, config.IOPriority); err != nil {
+			return fmt.Errorf("ioprio_set: %w", err)
+		}
+	}
+	if config.Umask != nil {
+		unix.Umask(int(*config.Umask))
+	}
+	if config.Cgroup != "" {
+		if err := joinCgroup(config); err != nil {
+			return fmt.Errorf("cgroup %s: %w", config.Cgroup, err)
+		}
+	}
+	return nil
+}
+
+func (c credentials) drop() error {
+	if c.chrootDirectory != "" {
+		if err := syscall.Chroot(c.chrootDirectory); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if c.uid >= 0 {
+		// Setgroups, Setgid and Setuid apply to all the threads of the process
+		if c.groups != nil {
+			if err := syscall.Setgroups(c.groups); err != nil {
+				return fmt.Errorf("setgroups: %w", err)
+			}
+		}
+		if err := syscall.Setgid(c.gid); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(c.uid); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	if c.dir != "" {
+		return syscall.Chdir(c.dir)
+	}
+	return nil
+}
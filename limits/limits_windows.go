@@ -0,0 +1,18 @@
+//go:build windows
+
+package limits
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func Wrap(cmd *exec.Cmd, config Config) error {
+	return fmt.Errorf("resource limits are not implemented on Windows")
+}
+
+func RunHelper(args []string) int {
+	fmt.Fprintln(os.Stderr, "resource limits are not implemented on Windows")
+	return -1
+}
@@ -0,0 +1,9 @@
+//go:build freebsd || dragonfly
+
+package limits
+
+import "syscall"
+
+func newRlimit(value uint64) *syscall.Rlimit {
+	return &syscall.Rlimit{Cur: int64(value), Max: int64(value)}
+}
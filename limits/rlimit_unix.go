@@ -0,0 +1,9 @@
+//go:build unix && !freebsd && !dragonfly
+
+package limits
+
+import "syscall"
+
+func newRlimit(value uint64) *syscall.Rlimit {
+	return &syscall.Rlimit{Cur: value, Max: value}
+}
@@ -0,0 +1,88 @@
+package ssh3
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// The clients behind the egress proxies can reach the servers through a MASQUE proxy, relaying the
+// UDP payloads of their QUIC connection as in RFC 9298 (Proxying UDP in HTTP). quic-go does not
+// expose the HTTP/3 datagrams of the requests, so the payloads are sent as DATAGRAM capsules on
+// the request stream, which RFC 9298 allows as well.
+
+// the protocol of the Extended CONNECT requests of RFC 9298
+const connectUDPProtocol = "connect-udp"
+
+// IsConnectUDPTemplate returns true if s is the URI template of a MASQUE proxy rather than the
+// URL of an HTTP proxy
+func IsConnectUDPTemplate(s string) bool {
+	return strings.Contains(s, "{target_host}")
+}
+
+// ExpandConnectUDPTemplate returns the URL to request to proxy the UDP payloads to host:port from
+// the URI template of a MASQUE proxy, e.g.
+// "https://proxy.example.org/.well-known/masque/udp/{target_host}/{target_port}/"
+func ExpandConnectUDPTemplate(template string, host string, port int) (string, error) {
+	if !strings.Contains(template, "{target_host}") || !strings.Contains(template, "{target_port}") {
+		return "", fmt.Errorf("the URI template of the MASQUE proxy must contain {target_host} and {target_port}: %q", template)
+	}
+	// the colons of the IPv6 addresses are percent-encoded as RFC 9298 requires
+	escapedHost := strings.ReplaceAll(url.PathEscape(strings.Trim(host, "[]")), ":", "%3A")
+	expanded := strings.NewReplacer("{target_host}", escapedHost, "{target_port}", strconv.Itoa(port)).Replace(template)
+	proxyURL, err := url.Parse(expanded)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI template of the MASQUE proxy %q: %w", template, err)
+	}
+	if proxyURL.Scheme != "https" {
+		return "", fmt.Errorf("the MASQUE proxy must be reached using https: %q", template)
+	}
+	return expanded, nil
+}
+
+// DialConnectUDP asks the MASQUE proxy to relay the UDP payloads to the target of url (see
+// ExpandConnectUDPTemplate) using roundTripper. The credentials of url, if any, are sent in the
+// Proxy-Authorization header. The QUIC connection is then dialed using the returned socket and its
+// RemoteAddr.
+func DialConnectUDP(ctx context.Context, roundTripper *http3.RoundTripper, url string) (*TunnelConn, error) {
+	tunnelCtx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(tunnelCtx, http.MethodConnect, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Proto = connectUDPProtocol
+	req.Header.Set(capsuleProtocolHeader, "?1")
+	req.Header.Set("User-Agent", GetCurrentVersion())
+	if user := req.URL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		req.URL.User = nil
+	}
+
+	rsp, err := doTunnelRequest(ctx, func() (*http.Response, error) {
+		return roundTripper.RoundTripOpt(req, http3.RoundTripOpt{DontCloseRequestStream: true})
+	}, cancel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		cancel()
+		rsp.Body.Close()
+		return nil, fmt.Errorf("the MASQUE proxy refused to relay the packets: %s", rsp.Status)
+	}
+	stream := rsp.Body.(http3.HTTPStreamer).HTTPStream()
+	return newTunnelConn(req.URL.Host, stream, stream, func() {
+		stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		cancel()
+	}), nil
+}
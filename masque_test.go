@@ -0,0 +1,156 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// relays the UDP payloads of a CONNECT-UDP request to its target, as DATAGRAM capsules on the
+// request stream
+func handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	defer GinkgoRecover()
+	Expect(r.Method).To(Equal(http.MethodConnect))
+	Expect(r.Proto).To(Equal("connect-udp"))
+	Expect(r.Header.Get("Capsule-Protocol")).To(Equal("?1"))
+	Expect(r.Header.Get("Proxy-Authorization")).To(Equal("Basic dXNlcjpzZWNyZXQ="))
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/.well-known/masque/udp/"), "/")
+	target, err := net.ResolveUDPAddr("udp", net.JoinHostPort(segments[0], segments[1]))
+	Expect(err).ToNot(HaveOccurred())
+	udpConn, err := net.DialUDP("udp", nil, target)
+	Expect(err).ToNot(HaveOccurred())
+	defer udpConn.Close()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	stream := r.Body.(http3.HTTPStreamer).HTTPStream()
+	defer stream.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				return
+			}
+			capsule := quicvarint.Append(nil, 0)
+			capsule = quicvarint.Append(capsule, uint64(n+1))
+			capsule = quicvarint.Append(capsule, 0)
+			if _, err := stream.Write(append(capsule, buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	reader := quicvarint.NewReader(stream)
+	for {
+		capsuleType, err := quicvarint.Read(reader)
+		if err != nil {
+			return
+		}
+		length, err := quicvarint.Read(reader)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return
+		}
+		Expect(capsuleType).To(BeZero())
+		contextID, err := quicvarint.Read(bytes.NewReader(payload))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(contextID).To(BeZero())
+		udpConn.Write(payload[1:])
+	}
+}
+
+var _ = Describe("MASQUE proxies", func() {
+	It("Relay a QUIC connection", func() {
+		pub, priv, err := util.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		template, err := util.GenerateCert(priv)
+		Expect(err).ToNot(HaveOccurred())
+		certDER, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+		Expect(err).ToNot(HaveOccurred())
+		certificates := []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: priv}}
+
+		listener, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{Certificates: certificates, NextProtos: []string{"ssh3-test"}}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			stream, err := conn.AcceptStream(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+
+		proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		defer proxyConn.Close()
+		proxy := &http3.Server{TLSConfig: &tls.Config{Certificates: certificates}, Handler: http.HandlerFunc(handleConnectUDP)}
+		go proxy.Serve(proxyConn)
+		defer proxy.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		roundTripper := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		defer roundTripper.Close()
+		proxyTemplate := fmt.Sprintf("https://user:secret@%s/.well-known/masque/udp/{target_host}/{target_port}/", proxyConn.LocalAddr())
+		Expect(ssh3.IsConnectUDPTemplate(proxyTemplate)).To(BeTrue())
+		targetPort := listener.Addr().(*net.UDPAddr).Port
+		proxyURL, err := ssh3.ExpandConnectUDPTemplate(proxyTemplate, "127.0.0.1", targetPort)
+		Expect(err).ToNot(HaveOccurred())
+		tunnelConn, err := ssh3.DialConnectUDP(ctx, roundTripper, proxyURL)
+		Expect(err).ToNot(HaveOccurred())
+		defer tunnelConn.Close()
+		conn, err := quic.DialEarly(ctx, tunnelConn, tunnelConn.RemoteAddr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"ssh3-test"}}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.CloseWithError(0, "")
+		stream, err := conn.OpenStreamSync(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		data := make([]byte, 64<<10)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		go func() {
+			stream.Write(data)
+			stream.Close()
+		}()
+		echo, err := io.ReadAll(stream)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(echo).To(Equal(data))
+	})
+
+	It("Expands the URI templates", func() {
+		proxyTemplate := "https://proxy.example.org/.well-known/masque/udp/{target_host}/{target_port}/"
+		proxyURL, err := ssh3.ExpandConnectUDPTemplate(proxyTemplate, "[2001:db8::1]", 443)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyURL).To(Equal("https://proxy.example.org/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/"))
+		proxyURL, err = ssh3.ExpandConnectUDPTemplate(proxyTemplate, "my-server.example.org", 4443)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyURL).To(Equal("https://proxy.example.org/.well-known/masque/udp/my-server.example.org/4443/"))
+
+		_, err = ssh3.ExpandConnectUDPTemplate("https://proxy.example.org/{target_host}/", "my-server.example.org", 443)
+		Expect(err).To(HaveOccurred())
+		_, err = ssh3.ExpandConnectUDPTemplate("http://proxy.example.org/{target_host}/{target_port}/", "my-server.example.org", 443)
+		Expect(err).To(HaveOccurred())
+		Expect(ssh3.IsConnectUDPTemplate("http://proxy.example.org:3128")).To(BeFalse())
+	})
+})
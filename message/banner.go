@@ -0,0 +1,50 @@
+package message
+
+import (
+	"errors"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// BannerMessage is a conversation-level message carrying the text that the server displays to
+// the clients before their authentication, as SSH_MSG_USERAUTH_BANNER (RFC 4252). It is sent in
+// the body of the response to the request establishing the conversation.
+type BannerMessage struct {
+	MessageUTF8 string
+	LanguageTag string
+}
+
+var _ Message = &BannerMessage{}
+
+func ParseBannerMessage(buf util.Reader) (*BannerMessage, error) {
+	messageUTF8, err := parseString(buf, "banner", MaxStringLength)
+	if err != nil {
+		return nil, err
+	}
+	languageTag, err := parseString(buf, "language tag", MaxNameLength)
+	if err != nil {
+		return nil, err
+	}
+	return &BannerMessage{MessageUTF8: messageUTF8, LanguageTag: languageTag}, nil
+}
+
+func (m *BannerMessage) Length() int {
+	return int(util.VarIntLen(SSH_MSG_USERAUTH_BANNER)) + util.SSHStringLen(m.MessageUTF8) + util.SSHStringLen(m.LanguageTag)
+}
+
+func (m *BannerMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write banner message")
+	}
+	consumed = copy(buf, util.AppendVarInt(nil, SSH_MSG_USERAUTH_BANNER))
+	n, err := util.WriteSSHString(buf[consumed:], m.MessageUTF8)
+	if err != nil {
+		return 0, err
+	}
+	consumed += n
+	n, err = util.WriteSSHString(buf[consumed:], m.LanguageTag)
+	if err != nil {
+		return 0, err
+	}
+	return consumed + n, nil
+}
@@ -1,26 +1,30 @@
 package message
 
 import (
-	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	util "github.com/francoismichel/ssh3/util"
 )
 
 var ChannelRequestParseFuncs = map[string]func(util.Reader) (ChannelRequest, error){
-	"pty-req":       ParsePtyRequest,
-	"x11-req":       ParseX11Request,
-	"shell":         ParseShellRequest,
-	"exec":          ParseExecRequest,
-	"subsystem":     ParseSubsystemRequest,
-	"window-change": ParseWindowChangeRequest,
-	"signal":        ParseSignalRequest,
-	"exit-status":   ParseExitStatusRequest,
-	"exit-signal":   ParseExitSignalRequest,
+	"pty-req":           ParsePtyRequest,
+	"x11-req":           ParseX11Request,
+	"shell":             ParseShellRequest,
+	"exec":              ParseExecRequest,
+	"exec-argv":         ParseExecArgvRequest,
+	"subsystem":         ParseSubsystemRequest,
+	"window-change":     ParseWindowChangeRequest,
+	"signal":            ParseSignalRequest,
+	"exit-status":       ParseExitStatusRequest,
+	"exit-signal":       ParseExitSignalRequest,
+	"working-directory": ParseWorkingDirectoryRequest,
+	"break":             ParseBreakRequest,
+	"reattach":          ParseReattachRequest,
 }
 
 type ChannelRequestMessage struct {
@@ -30,14 +34,24 @@ type ChannelRequestMessage struct {
 
 var _ Message = &ChannelRequestMessage{}
 
+var _ VersionedMessage = &ChannelRequestMessage{}
+
 func (m *ChannelRequestMessage) Length() (n int) {
+	return m.LengthVersion(MaxProtocolVersion)
+}
+
+func (m *ChannelRequestMessage) LengthVersion(version ProtocolVersion) int {
 	// msg type + request type + wantReply + request content
-	return int(util.VarIntLen(SSH_MSG_CHANNEL_REQUEST)) + util.SSHStringLen(m.ChannelRequest.RequestTypeStr()) + 1 + m.ChannelRequest.Length()
+	return int(util.VarIntLen(SSH_MSG_CHANNEL_REQUEST)) + util.SSHStringLen(m.ChannelRequest.RequestTypeStr()) + 1 + channelRequestLength(m.ChannelRequest, version)
 }
 
 func (m *ChannelRequestMessage) Write(buf []byte) (consumed int, err error) {
-	if len(buf) < m.Length() {
-		return 0, fmt.Errorf("buffer too small to write message for channel request of type %T: %d < %d", m.ChannelRequest, len(buf), m.Length())
+	return m.WriteVersion(buf, MaxProtocolVersion)
+}
+
+func (m *ChannelRequestMessage) WriteVersion(buf []byte, version ProtocolVersion) (consumed int, err error) {
+	if len(buf) < m.LengthVersion(version) {
+		return 0, fmt.Errorf("buffer too small to write message for channel request of type %T: %d < %d", m.ChannelRequest, len(buf), m.LengthVersion(version))
 	}
 
 	msgTypeBuf := util.AppendVarInt(nil, uint64(SSH_MSG_CHANNEL_REQUEST))
@@ -56,7 +70,7 @@ func (m *ChannelRequestMessage) Write(buf []byte) (consumed int, err error) {
 	}
 	consumed += 1
 
-	n, err = m.ChannelRequest.Write(buf[consumed:])
+	n, err = writeChannelRequest(buf[consumed:], m.ChannelRequest, version)
 	if err != nil {
 		return 0, err
 	}
@@ -67,7 +81,11 @@ func (m *ChannelRequestMessage) Write(buf []byte) (consumed int, err error) {
 
 // The buffer points to the request-type attribute
 func ParseRequestMessage(buf util.Reader) (*ChannelRequestMessage, error) {
-	requestType, err := util.ParseSSHString(buf)
+	return parseRequestMessage(buf, MaxProtocolVersion)
+}
+
+func parseRequestMessage(buf util.Reader, version ProtocolVersion) (*ChannelRequestMessage, error) {
+	requestType, err := parseString(buf, "request type", MaxNameLength)
 	if err != nil {
 		return nil, err
 	}
@@ -76,14 +94,21 @@ func ParseRequestMessage(buf util.Reader) (*ChannelRequestMessage, error) {
 	if err != nil {
 		return nil, err
 	}
-	parseFunc, ok := ChannelRequestParseFuncs[requestType]
-	if !ok {
-		return nil, fmt.Errorf("invalid request message type %s", requestType)
+	var channelRequest ChannelRequest
+	if parseFunc, ok := VersionedChannelRequestParseFuncs[requestType]; ok {
+		channelRequest, err = parseFunc(buf, version)
+	} else if parseFunc, ok := ChannelRequestParseFuncs[requestType]; ok {
+		channelRequest, err = parseFunc(buf)
+	} else {
+		return nil, UnknownRequestType{RequestType: requestType}
 	}
-	channelRequest, err := parseFunc(buf)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if channelRequest == nil {
+		// the stream ended before the request content
+		return nil, io.ErrUnexpectedEOF
+	}
 	return &ChannelRequestMessage{
 		WantReply:      wantReply,
 		ChannelRequest: channelRequest,
@@ -98,18 +123,19 @@ type ChannelRequest interface {
 
 // see RFC4254 Sec 6.2
 type PtyRequest struct {
-	Term                 string
-	CharWidth            uint64
-	CharHeight           uint64
-	PixelWidth           uint64
-	PixelHeight          uint64
-	EncodedTerminalModes string
+	Term        string
+	CharWidth   uint64
+	CharHeight  uint64
+	PixelWidth  uint64
+	PixelHeight uint64
+	// encoded as in RFC4254 Sec 8 on the wire
+	TerminalModes TerminalModes
 }
 
 var _ ChannelRequest = &PtyRequest{}
 
 func ParsePtyRequest(buf util.Reader) (ChannelRequest, error) {
-	term, err := util.ParseSSHString(buf)
+	term, err := parseString(buf, "terminal type", MaxNameLength)
 	if err != nil {
 		return nil, err
 	}
@@ -129,17 +155,21 @@ func ParsePtyRequest(buf util.Reader) (ChannelRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	encodedTerminalModes, err := util.ParseSSHString(buf)
+	encodedTerminalModes, err := parseString(buf, "terminal modes", 5*MaxTerminalModes+1)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	terminalModes, parseErr := ParseTerminalModes([]byte(encodedTerminalModes))
+	if parseErr != nil {
+		return nil, parseErr
+	}
 	return &PtyRequest{
-		Term:                 term,
-		CharWidth:            charWidth,
-		CharHeight:           charHeight,
-		PixelWidth:           pixelWidth,
-		PixelHeight:          pixelHeight,
-		EncodedTerminalModes: encodedTerminalModes,
+		Term:          term,
+		CharWidth:     charWidth,
+		CharHeight:    charHeight,
+		PixelWidth:    pixelWidth,
+		PixelHeight:   pixelHeight,
+		TerminalModes: terminalModes,
 	}, err
 }
 
@@ -149,7 +179,7 @@ func (r *PtyRequest) Length() int {
 		int(util.VarIntLen(r.CharHeight)) +
 		int(util.VarIntLen(r.PixelWidth)) +
 		int(util.VarIntLen(r.PixelHeight)) +
-		util.SSHStringLen(r.EncodedTerminalModes)
+		int(util.VarIntLen(uint64(r.TerminalModes.EncodedLength()))) + r.TerminalModes.EncodedLength()
 }
 
 func (r *PtyRequest) RequestTypeStr() string {
@@ -173,7 +203,7 @@ func (r *PtyRequest) Write(buf []byte) (consumed int, err error) {
 	}
 	consumed += copy(buf[consumed:], attrs)
 
-	n, err = util.WriteSSHString(buf[consumed:], r.EncodedTerminalModes)
+	n, err = util.WriteSSHString(buf[consumed:], string(r.TerminalModes.Encode()))
 	if err != nil {
 		return 0, err
 	}
@@ -198,11 +228,11 @@ func ParseX11Request(buf util.Reader) (ChannelRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	x11AuthenticationProtocol, err := util.ParseSSHString(buf)
+	x11AuthenticationProtocol, err := parseString(buf, "x11 authentication protocol", MaxNameLength)
 	if err != nil {
 		return nil, err
 	}
-	x11AuthenticationCookie, err := util.ParseSSHString(buf)
+	x11AuthenticationCookie, err := parseString(buf, "x11 authentication cookie", MaxNameLength)
 	if err != nil {
 		return nil, err
 	}
@@ -287,9 +317,9 @@ type ExecRequest struct {
 var _ ChannelRequest = &ExecRequest{}
 
 func ParseExecRequest(buf util.Reader) (ChannelRequest, error) {
-	command, err := util.ParseSSHString(buf)
+	command, err := parseString(buf, "command", MaxStringLength)
 	if err != nil && err != io.EOF {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 	return &ExecRequest{
 		Command: command,
@@ -308,6 +338,140 @@ func (r *ExecRequest) Write(buf []byte) (int, error) {
 	return util.WriteSSHString(buf, r.Command)
 }
 
+// ExecArgvRequest runs Argv without a shell: Argv[0] is executed with the arguments as is, so
+// that they need no quoting. It is encoded as the number of arguments followed by each of them.
+type ExecArgvRequest struct {
+	Argv []string
+}
+
+var _ ChannelRequest = &ExecArgvRequest{}
+
+func ParseExecArgvRequest(buf util.Reader) (ChannelRequest, error) {
+	count, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.New("empty argument vector")
+	}
+	if count > MaxArguments {
+		return nil, TooManyFields{Field: "arguments", MaxCount: MaxArguments}
+	}
+	argv := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var arg string
+		arg, err = parseString(buf, "argument", MaxStringLength)
+		// only the last argument may end the stream
+		if err != nil && (err != io.EOF || i != count-1) {
+			return nil, err
+		}
+		argv = append(argv, arg)
+	}
+	return &ExecArgvRequest{
+		Argv: argv,
+	}, err
+}
+
+func (r *ExecArgvRequest) Length() int {
+	length := int(util.VarIntLen(uint64(len(r.Argv))))
+	for _, arg := range r.Argv {
+		length += util.SSHStringLen(arg)
+	}
+	return length
+}
+
+// Command returns the arguments quoted for a POSIX shell, e.g. for the logs
+func (r *ExecArgvRequest) Command() string {
+	quoted := make([]string, len(r.Argv))
+	for i, arg := range r.Argv {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=/.,:@%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (r *ExecArgvRequest) RequestTypeStr() string {
+	return "exec-argv"
+}
+
+func (r *ExecArgvRequest) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < r.Length() {
+		return 0, errors.New("buffer too small to write exec-argv request")
+	}
+	consumed += copy(buf, util.AppendVarInt(nil, uint64(len(r.Argv))))
+	for _, arg := range r.Argv {
+		n, err := util.WriteSSHString(buf[consumed:], arg)
+		if err != nil {
+			return 0, err
+		}
+		consumed += n
+	}
+	return consumed, nil
+}
+
+// sent before the shell, exec or subsystem request so that the command starts in Directory,
+// e.g. the directory opened by an IDE. A relative directory is relative to the home of the user.
+type WorkingDirectoryRequest struct {
+	Directory string
+}
+
+var _ ChannelRequest = &WorkingDirectoryRequest{}
+
+func ParseWorkingDirectoryRequest(buf util.Reader) (ChannelRequest, error) {
+	directory, err := parseString(buf, "directory", MaxStringLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &WorkingDirectoryRequest{
+		Directory: directory,
+	}, err
+}
+
+func (r *WorkingDirectoryRequest) Length() int {
+	return util.SSHStringLen(r.Directory)
+}
+
+func (r *WorkingDirectoryRequest) RequestTypeStr() string {
+	return "working-directory"
+}
+
+func (r *WorkingDirectoryRequest) Write(buf []byte) (int, error) {
+	return util.WriteSSHString(buf, r.Directory)
+}
+
+// sent instead of the shell, exec or subsystem request so that the channel continues a pty session
+// of the user detached from its previous conversation. An empty SessionID lists these sessions.
+type ReattachRequest struct {
+	SessionID string
+}
+
+var _ ChannelRequest = &ReattachRequest{}
+
+func ParseReattachRequest(buf util.Reader) (ChannelRequest, error) {
+	sessionID, err := parseString(buf, "session ID", MaxNameLength)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &ReattachRequest{
+		SessionID: sessionID,
+	}, err
+}
+
+func (r *ReattachRequest) Length() int {
+	return util.SSHStringLen(r.SessionID)
+}
+
+func (r *ReattachRequest) RequestTypeStr() string {
+	return "reattach"
+}
+
+func (r *ReattachRequest) Write(buf []byte) (int, error) {
+	return util.WriteSSHString(buf, r.SessionID)
+}
+
 type SubsystemRequest struct {
 	SubsystemName string
 }
@@ -315,9 +479,9 @@ type SubsystemRequest struct {
 var _ ChannelRequest = &SubsystemRequest{}
 
 func ParseSubsystemRequest(buf util.Reader) (ChannelRequest, error) {
-	subsystemName, err := util.ParseSSHString(buf)
+	subsystemName, err := parseString(buf, "subsystem name", MaxNameLength)
 	if err != nil && err != io.EOF {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 	return &SubsystemRequest{
 		SubsystemName: subsystemName,
@@ -402,9 +566,9 @@ type SignalRequest struct {
 var _ ChannelRequest = &SignalRequest{}
 
 func ParseSignalRequest(buf util.Reader) (ChannelRequest, error) {
-	signalNameWithoutSig, err := util.ParseSSHString(buf)
+	signalNameWithoutSig, err := parseString(buf, "signal name", MaxNameLength)
 	if err != nil && err != io.EOF {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 	return &SignalRequest{
 		SignalNameWithoutSig: signalNameWithoutSig,
@@ -423,6 +587,38 @@ func (r *SignalRequest) Write(buf []byte) (int, error) {
 	return util.WriteSSHString(buf, r.SignalNameWithoutSig)
 }
 
+// see RFC 4335, the server emulates the break condition on its pty
+type BreakRequest struct {
+	BreakLengthMs uint64
+}
+
+var _ ChannelRequest = &BreakRequest{}
+
+func ParseBreakRequest(buf util.Reader) (ChannelRequest, error) {
+	breakLength, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &BreakRequest{
+		BreakLengthMs: breakLength,
+	}, nil
+}
+
+func (r *BreakRequest) Length() int {
+	return int(util.VarIntLen(r.BreakLengthMs))
+}
+
+func (r *BreakRequest) RequestTypeStr() string {
+	return "break"
+}
+
+func (r *BreakRequest) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < r.Length() {
+		return 0, errors.New("buffer too small to write break request")
+	}
+	return copy(buf, util.AppendVarInt(nil, r.BreakLengthMs)), nil
+}
+
 type ExitStatusRequest struct {
 	ExitStatus uint64
 }
@@ -431,12 +627,12 @@ var _ ChannelRequest = &ExitStatusRequest{}
 
 func ParseExitStatusRequest(buf util.Reader) (ChannelRequest, error) {
 	exitStatus, err := util.ReadVarInt(buf)
-	if err != nil && err != io.EOF {
+	if err != nil {
 		return nil, err
 	}
 	return &ExitStatusRequest{
 		ExitStatus: exitStatus,
-	}, err
+	}, nil
 }
 
 func (r *ExitStatusRequest) Length() int {
@@ -449,7 +645,7 @@ func (r *ExitStatusRequest) RequestTypeStr() string {
 
 func (r *ExitStatusRequest) Write(buf []byte) (int, error) {
 	if len(buf) < r.Length() {
-		return 0, errors.New("buffer too small to write PTY request")
+		return 0, errors.New("buffer too small to write exit-status request")
 	}
 	attrBuf := util.AppendVarInt(nil, r.ExitStatus)
 	n := copy(buf, attrBuf)
@@ -466,9 +662,9 @@ type ExitSignalRequest struct {
 var _ ChannelRequest = &ExitSignalRequest{}
 
 func ParseExitSignalRequest(buf util.Reader) (ChannelRequest, error) {
-	signalNameWithoutSig, err := util.ParseSSHString(buf)
+	signalNameWithoutSig, err := parseString(buf, "signal name", MaxNameLength)
 	if err != nil {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 	coreDumped := false
 	err = binary.Read(buf, binary.BigEndian, &coreDumped)
@@ -476,21 +672,22 @@ func ParseExitSignalRequest(buf util.Reader) (ChannelRequest, error) {
 		return nil, err
 	}
 
-	errorMessageUTF8, err := util.ParseSSHString(buf)
+	errorMessageUTF8, err := parseString(buf, "error message", MaxStringLength)
 	if err != nil {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 
-	languageTag, err := util.ParseSSHString(buf)
+	// the language tag may be omitted
+	languageTag, err := parseString(buf, "language tag", MaxNameLength)
 	if err != nil && err != io.EOF {
-		return nil, bufio.ErrAdvanceTooFar
+		return nil, err
 	}
 	return &ExitSignalRequest{
 		SignalNameWithoutSig: signalNameWithoutSig,
 		CoreDumped:           coreDumped,
 		ErrorMessageUTF8:     errorMessageUTF8,
 		LanguageTag:          languageTag,
-	}, err
+	}, nil
 }
 
 func (r *ExitSignalRequest) Length() int {
@@ -506,7 +703,7 @@ func (r *ExitSignalRequest) RequestTypeStr() string {
 
 func (r *ExitSignalRequest) Write(buf []byte) (consumed int, err error) {
 	if len(buf) < r.Length() {
-		return 0, errors.New("buffer too small to write PTY request")
+		return 0, errors.New("buffer too small to write exit-signal request")
 	}
 	n, err := util.WriteSSHString(buf[consumed:], r.SignalNameWithoutSig)
 	if err != nil {
@@ -569,14 +766,14 @@ func ParseForwardingRequest(buf util.Reader) (ChannelRequest, error) {
 		return nil, fmt.Errorf("invalid address family: %d", addressFamily)
 	}
 
-	_, err = buf.Read(address)
+	_, err = io.ReadFull(buf, address)
 	if err != nil {
 		return nil, err
 	}
 
 	var portBuf [2]byte
-	_, err = buf.Read(portBuf[:])
-	if err != nil && err != io.EOF {
+	_, err = io.ReadFull(buf, portBuf[:])
+	if err != nil {
 		return nil, err
 	}
 	port := binary.BigEndian.Uint16(portBuf[:])
@@ -606,12 +803,12 @@ func (r *ForwardingRequest) Write(buf []byte) (consumed int, err error) {
 	}
 
 	var attrs []byte
-	for _, attr := range []uint64{r.AddressFamily, r.Protocol} {
+	for _, attr := range []uint64{r.Protocol, r.AddressFamily} {
 		attrs = util.AppendVarInt(attrs, attr)
 	}
 
 	consumed += copy(buf[consumed:], attrs)
-	consumed += copy(r.IpAddress, attrs)
+	consumed += copy(buf[consumed:], r.IpAddress)
 	binary.BigEndian.PutUint16(buf[consumed:], r.Port)
 	consumed += 2
 
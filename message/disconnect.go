@@ -0,0 +1,75 @@
+package message
+
+import (
+	"errors"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// reason codes of the disconnect messages, as in RFC 4253
+const SSH_DISCONNECT_HOST_NOT_ALLOWED_TO_CONNECT = 1
+const SSH_DISCONNECT_PROTOCOL_ERROR = 2
+const SSH_DISCONNECT_KEY_EXCHANGE_FAILED = 3
+const SSH_DISCONNECT_RESERVED = 4
+const SSH_DISCONNECT_MAC_ERROR = 5
+const SSH_DISCONNECT_COMPRESSION_ERROR = 6
+const SSH_DISCONNECT_SERVICE_NOT_AVAILABLE = 7
+const SSH_DISCONNECT_PROTOCOL_VERSION_NOT_SUPPORTED = 8
+const SSH_DISCONNECT_HOST_KEY_NOT_VERIFIABLE = 9
+const SSH_DISCONNECT_CONNECTION_LOST = 10
+const SSH_DISCONNECT_BY_APPLICATION = 11
+const SSH_DISCONNECT_TOO_MANY_CONNECTIONS = 12
+const SSH_DISCONNECT_AUTH_CANCELLED_BY_USER = 13
+const SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE = 14
+const SSH_DISCONNECT_ILLEGAL_USER_NAME = 15
+
+// DisconnectMessage is a conversation-level message telling why the server ends the conversation
+// or refuses to establish it, as SSH_MSG_DISCONNECT (RFC 4253). It is the last message of the
+// body of the response to the request establishing the conversation.
+type DisconnectMessage struct {
+	ReasonCode      uint64
+	DescriptionUTF8 string
+	LanguageTag     string
+}
+
+var _ Message = &DisconnectMessage{}
+
+func ParseDisconnectMessage(buf util.Reader) (*DisconnectMessage, error) {
+	reasonCode, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	description, err := parseString(buf, "description", MaxStringLength)
+	if err != nil {
+		return nil, err
+	}
+	languageTag, err := parseString(buf, "language tag", MaxNameLength)
+	if err != nil {
+		return nil, err
+	}
+	return &DisconnectMessage{ReasonCode: reasonCode, DescriptionUTF8: description, LanguageTag: languageTag}, nil
+}
+
+func (m *DisconnectMessage) Length() int {
+	return int(util.VarIntLen(SSH_MSG_DISCONNECT)) + int(util.VarIntLen(m.ReasonCode)) +
+		util.SSHStringLen(m.DescriptionUTF8) + util.SSHStringLen(m.LanguageTag)
+}
+
+func (m *DisconnectMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write disconnect message")
+	}
+	varintBuf := util.AppendVarInt(nil, SSH_MSG_DISCONNECT)
+	varintBuf = util.AppendVarInt(varintBuf, m.ReasonCode)
+	consumed = copy(buf, varintBuf)
+	n, err := util.WriteSSHString(buf[consumed:], m.DescriptionUTF8)
+	if err != nil {
+		return 0, err
+	}
+	consumed += n
+	n, err = util.WriteSSHString(buf[consumed:], m.LanguageTag)
+	if err != nil {
+		return 0, err
+	}
+	return consumed + n, nil
+}
@@ -0,0 +1,223 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// The fuzz targets of the parse functions, e.g. `go test ./message -fuzz FuzzParseMessage`.
+// Besides not panicking on any input, the values parsed successfully must be parsed to the same
+// value once written back. Without -fuzz, `go test` runs them on their seed corpus.
+
+// the number of random values of each type in the seed corpus
+const fuzzSeeds = 8
+
+func seedMessages() []Message {
+	rng := rand.New(rand.NewSource(1))
+	var messages []Message
+	for i := 0; i < fuzzSeeds; i++ {
+		messages = append(messages, randomMessages(rng)...)
+	}
+	return messages
+}
+
+func seedChannelRequests() []ChannelRequest {
+	rng := rand.New(rand.NewSource(1))
+	var requests []ChannelRequest
+	for i := 0; i < fuzzSeeds; i++ {
+		requests = append(requests, randomChannelRequests(rng)...)
+	}
+	return requests
+}
+
+func encodeWireValue(tb testing.TB, v wireValue) []byte {
+	tb.Helper()
+	buf := make([]byte, v.Length())
+	n, err := v.Write(buf)
+	if err != nil {
+		tb.Fatalf("cannot write %#v: %v", v, err)
+	}
+	if n != len(buf) {
+		tb.Fatalf("%T wrote %d bytes instead of its length %d", v, n, len(buf))
+	}
+	return buf
+}
+
+// the parse functions return a nil pointer along with io.EOF when the input ends before the value
+func isNil(v any) bool {
+	value := reflect.ValueOf(v)
+	return !value.IsValid() || value.IsNil()
+}
+
+func parsedSuccessfully(v any, err error) bool {
+	return (err == nil || err == io.EOF) && !isNil(v)
+}
+
+// fuzzes the parse function of the content of the messages of type typeId
+func fuzzMessage[T Message](f *testing.F, typeId uint64, parse func(util.Reader) (T, error)) {
+	for _, message := range seedMessages() {
+		encoded := encodeWireValue(f, message)
+		if id, err := util.ReadVarInt(bytes.NewReader(encoded)); err == nil && id == typeId {
+			f.Add(encoded[util.VarIntLen(typeId):])
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := parse(bytes.NewReader(data))
+		if !parsedSuccessfully(message, err) {
+			return
+		}
+		// the messages are written with their type
+		reparsed, err := ParseMessage(bytes.NewReader(encodeWireValue(t, message)))
+		if err != nil {
+			t.Fatalf("cannot parse the written %#v: %v", message, err)
+		}
+		if !reflect.DeepEqual(Message(message), reparsed) {
+			t.Fatalf("%#v was parsed back as %#v", message, reparsed)
+		}
+	})
+}
+
+// fuzzes the parse function of the content of the channel requests of type requestType
+func fuzzChannelRequest(f *testing.F, requestType string, parse func(util.Reader) (ChannelRequest, error)) {
+	for _, request := range seedChannelRequests() {
+		if request.RequestTypeStr() == requestType {
+			f.Add(encodeWireValue(f, request))
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		request, err := parse(bytes.NewReader(data))
+		if !parsedSuccessfully(request, err) {
+			return
+		}
+		reparsed, err := parse(bytes.NewReader(encodeWireValue(t, request)))
+		if err != nil {
+			t.Fatalf("cannot parse the written %#v: %v", request, err)
+		}
+		if !reflect.DeepEqual(request, reparsed) {
+			t.Fatalf("%#v was parsed back as %#v", request, reparsed)
+		}
+	})
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, message := range seedMessages() {
+		f.Add(encodeWireValue(f, message))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := ParseMessage(bytes.NewReader(data))
+		if !parsedSuccessfully(message, err) {
+			return
+		}
+		reparsed, err := ParseMessage(bytes.NewReader(encodeWireValue(t, message)))
+		if err != nil {
+			t.Fatalf("cannot parse the written %#v: %v", message, err)
+		}
+		if !reflect.DeepEqual(message, reparsed) {
+			t.Fatalf("%#v was parsed back as %#v", message, reparsed)
+		}
+	})
+}
+
+func FuzzParseRequestMessage(f *testing.F) {
+	fuzzMessage(f, SSH_MSG_CHANNEL_REQUEST, ParseRequestMessage)
+}
+
+func FuzzParseChannelOpenConfirmationMessage(f *testing.F) {
+	fuzzMessage(f, SSH_MSG_CHANNEL_OPEN_CONFIRMATION, ParseChannelOpenConfirmationMessage)
+}
+
+func FuzzParseChannelOpenFailureMessage(f *testing.F) {
+	fuzzMessage(f, SSH_MSG_CHANNEL_OPEN_FAILURE, ParseChannelOpenFailureMessage)
+}
+
+func FuzzParseDataMessage(f *testing.F) {
+	fuzzMessage(f, SSH_MSG_CHANNEL_DATA, ParseDataMessage)
+}
+
+func FuzzParseExtendedDataMessage(f *testing.F) {
+	fuzzMessage(f, SSH_MSG_CHANNEL_EXTENDED_DATA, ParseExtendedDataMessage)
+}
+
+func FuzzParseCompressedDataMessage(f *testing.F) {
+	fuzzMessage(f, SSH3_MSG_CHANNEL_COMPRESSED_DATA, ParseCompressedDataMessage)
+}
+
+func FuzzParsePtyRequest(f *testing.F) {
+	fuzzChannelRequest(f, "pty-req", ParsePtyRequest)
+}
+
+func FuzzParseX11Request(f *testing.F) {
+	fuzzChannelRequest(f, "x11-req", ParseX11Request)
+}
+
+func FuzzParseShellRequest(f *testing.F) {
+	fuzzChannelRequest(f, "shell", ParseShellRequest)
+}
+
+func FuzzParseExecRequest(f *testing.F) {
+	fuzzChannelRequest(f, "exec", ParseExecRequest)
+}
+
+func FuzzParseExecArgvRequest(f *testing.F) {
+	fuzzChannelRequest(f, "exec-argv", ParseExecArgvRequest)
+}
+
+func FuzzParseSubsystemRequest(f *testing.F) {
+	fuzzChannelRequest(f, "subsystem", ParseSubsystemRequest)
+}
+
+func FuzzParseWorkingDirectoryRequest(f *testing.F) {
+	fuzzChannelRequest(f, "working-directory", ParseWorkingDirectoryRequest)
+}
+
+func FuzzParseReattachRequest(f *testing.F) {
+	fuzzChannelRequest(f, "reattach", ParseReattachRequest)
+}
+
+func FuzzParseWindowChangeRequest(f *testing.F) {
+	fuzzChannelRequest(f, "window-change", ParseWindowChangeRequest)
+}
+
+func FuzzParseSignalRequest(f *testing.F) {
+	fuzzChannelRequest(f, "signal", ParseSignalRequest)
+}
+
+func FuzzParseBreakRequest(f *testing.F) {
+	fuzzChannelRequest(f, "break", ParseBreakRequest)
+}
+
+func FuzzParseExitStatusRequest(f *testing.F) {
+	fuzzChannelRequest(f, "exit-status", ParseExitStatusRequest)
+}
+
+func FuzzParseExitSignalRequest(f *testing.F) {
+	fuzzChannelRequest(f, "exit-signal", ParseExitSignalRequest)
+}
+
+func FuzzParseForwardingRequest(f *testing.F) {
+	fuzzChannelRequest(f, "forward-port", ParseForwardingRequest)
+}
+
+func FuzzParseTerminalModes(f *testing.F) {
+	f.Add(CookedMode().Encode())
+	f.Add(RawMode().Encode())
+	f.Add([]byte{byte(TTY_OP_END)})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		modes, err := ParseTerminalModes(data)
+		if err != nil {
+			return
+		}
+		reparsed, err := ParseTerminalModes(modes.Encode())
+		if err != nil {
+			t.Fatalf("cannot parse the encoded %v: %v", modes, err)
+		}
+		if !reflect.DeepEqual(modes, reparsed) {
+			t.Fatalf("%v was parsed back as %v", modes, reparsed)
+		}
+	})
+}
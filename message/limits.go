@@ -0,0 +1,104 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// The limits applied when parsing the messages sent by the peer. As the messages are not
+// length-prefixed, the parser would otherwise allocate the length announced by each field, so
+// that a malicious peer could make it allocate gigabytes.
+const (
+	// the maximum length of a message, including its type. It also bounds the requests parsed
+	// by the functions registered by the extensions.
+	MaxMessageLength = MaxDataLength + 4096
+	// the maximum length of the data of the data messages, far above the max packet sizes
+	MaxDataLength = 8 << 20
+	// the maximum length of the free-form strings, e.g. the commands and the error messages
+	MaxStringLength = 64 << 10
+	// the maximum length of the names, e.g. the request types, the terminal types and the
+	// signal names
+	MaxNameLength = 1024
+	// the maximum number of terminal modes of a pty request
+	MaxTerminalModes = 256
+	// the maximum number of arguments of an exec-argv request
+	MaxArguments = 4096
+)
+
+// MessageTooLong is returned when a message exceeds MaxMessageLength
+type MessageTooLong struct {
+	MaxLength int
+}
+
+func (e MessageTooLong) Error() string {
+	return fmt.Sprintf("message exceeds the maximum length of %d bytes", e.MaxLength)
+}
+
+// FieldTooLong is returned when a field of a message exceeds its maximum length
+type FieldTooLong struct {
+	Field     string
+	Length    uint64
+	MaxLength uint64
+}
+
+func (e FieldTooLong) Error() string {
+	return fmt.Sprintf("%s of %d bytes exceeds the maximum length of %d bytes", e.Field, e.Length, e.MaxLength)
+}
+
+// TooManyFields is returned when a message repeats a field more than allowed, e.g. the
+// terminal modes of a pty request
+type TooManyFields struct {
+	Field    string
+	MaxCount int
+}
+
+func (e TooManyFields) Error() string {
+	return fmt.Sprintf("more than %d %s", e.MaxCount, e.Field)
+}
+
+// parses the SSH string of the field, of at most maxLength bytes
+func parseString(buf util.Reader, field string, maxLength uint64) (string, error) {
+	s, err := util.ParseSSHStringMaxLength(buf, maxLength)
+	var tooLong util.SSHStringTooLong
+	if errors.As(err, &tooLong) {
+		return "", FieldTooLong{Field: field, Length: tooLong.Length, MaxLength: maxLength}
+	}
+	return s, err
+}
+
+// messageReader fails with MessageTooLong once the message exceeds MaxMessageLength
+type messageReader struct {
+	r         util.Reader
+	remaining int
+}
+
+var _ util.Reader = &messageReader{}
+
+func newMessageReader(r util.Reader) *messageReader {
+	return &messageReader{r: r, remaining: MaxMessageLength}
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, MessageTooLong{MaxLength: MaxMessageLength}
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= n
+	return n, err
+}
+
+func (r *messageReader) ReadByte() (byte, error) {
+	if r.remaining <= 0 {
+		return 0, MessageTooLong{MaxLength: MaxMessageLength}
+	}
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.remaining--
+	}
+	return b, err
+}
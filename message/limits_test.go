@@ -0,0 +1,132 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// a request parsing its content without bounds, as the requests of an extension could
+func parseUnboundedTestRequest(buf util.Reader) (ChannelRequest, error) {
+	value, err := util.ParseSSHString(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecRequest{Command: value}, nil
+}
+
+var _ = Describe("Parsing limits", func() {
+	appendString := func(b []byte, s string) []byte {
+		return append(util.AppendVarInt(b, uint64(len(s))), s...)
+	}
+
+	requestMessage := func(requestType string, content []byte) []byte {
+		encoded := util.AppendVarInt(nil, SSH_MSG_CHANNEL_REQUEST)
+		encoded = appendString(encoded, requestType)
+		encoded = append(encoded, 0)
+		return append(encoded, content...)
+	}
+
+	It("Rejects the data announcing more than MaxDataLength bytes without reading them", func() {
+		encoded := util.AppendVarInt(nil, SSH_MSG_CHANNEL_DATA)
+		encoded = util.AppendVarInt(encoded, 4<<30)
+		_, err := ParseMessage(bytes.NewReader(encoded))
+		var tooLong FieldTooLong
+		Expect(errors.As(err, &tooLong)).To(BeTrue())
+		Expect(tooLong.Field).To(Equal("data"))
+		Expect(tooLong.Length).To(Equal(uint64(4 << 30)))
+		var invalid InvalidMessage
+		Expect(errors.As(err, &invalid)).To(BeTrue())
+		Expect(invalid.MessageType).To(Equal(uint64(SSH_MSG_CHANNEL_DATA)))
+	})
+
+	It("Rejects the truncated data", func() {
+		for _, length := range []int{1000, 1 << 20} {
+			encoded := util.AppendVarInt(nil, SSH_MSG_CHANNEL_DATA)
+			encoded = util.AppendVarInt(encoded, uint64(length))
+			encoded = append(encoded, make([]byte, length-1)...)
+			_, err := ParseMessage(bytes.NewReader(encoded))
+			var invalid util.InvalidSSHString
+			Expect(errors.As(err, &invalid)).To(BeTrue(), "length %d", length)
+
+			message, err := ParseMessage(bytes.NewReader(append(encoded, 'a')))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message.(*DataOrExtendedDataMessage).Data).To(HaveLen(length))
+		}
+	})
+
+	It("Rejects the request types longer than MaxNameLength", func() {
+		_, err := ParseMessage(bytes.NewReader(requestMessage(strings.Repeat("a", MaxNameLength+1), nil)))
+		var tooLong FieldTooLong
+		Expect(errors.As(err, &tooLong)).To(BeTrue())
+		Expect(tooLong.Field).To(Equal("request type"))
+	})
+
+	It("Rejects the commands longer than MaxStringLength", func() {
+		command := strings.Repeat("a", MaxStringLength+1)
+		_, err := ParseMessage(bytes.NewReader(requestMessage("exec", appendString(nil, command))))
+		var tooLong FieldTooLong
+		Expect(errors.As(err, &tooLong)).To(BeTrue())
+		Expect(tooLong.Field).To(Equal("command"))
+
+		command = strings.Repeat("a", MaxStringLength)
+		message, err := ParseMessage(bytes.NewReader(requestMessage("exec", appendString(nil, command))))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.(*ChannelRequestMessage).ChannelRequest.(*ExecRequest).Command).To(Equal(command))
+	})
+
+	It("Rejects more than MaxTerminalModes terminal modes", func() {
+		encoded := bytes.Repeat([]byte{byte(VINTR), 0, 0, 0, 3}, MaxTerminalModes+1)
+		_, err := ParseTerminalModes(encoded)
+		Expect(err).To(Equal(TooManyFields{Field: "terminal modes", MaxCount: MaxTerminalModes}))
+
+		modes, err := ParseTerminalModes(encoded[5:])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(modes).To(HaveLen(1))
+	})
+
+	It("Rejects the empty argument vectors and those of more than MaxArguments arguments", func() {
+		_, err := ParseMessage(bytes.NewReader(requestMessage("exec-argv", util.AppendVarInt(nil, MaxArguments+1))))
+		var tooMany TooManyFields
+		Expect(errors.As(err, &tooMany)).To(BeTrue())
+		Expect(tooMany.Field).To(Equal("arguments"))
+
+		_, err = ParseMessage(bytes.NewReader(requestMessage("exec-argv", util.AppendVarInt(nil, 0))))
+		Expect(err).To(HaveOccurred())
+
+		// the arguments are kept as is, without shell quoting
+		content := util.AppendVarInt(nil, 3)
+		for _, arg := range []string{"printf", "%s\n", "a b; rm -rf ~"} {
+			content = appendString(content, arg)
+		}
+		message, err := ParseMessage(bytes.NewReader(requestMessage("exec-argv", content)))
+		Expect(err).ToNot(HaveOccurred())
+		request := message.(*ChannelRequestMessage).ChannelRequest.(*ExecArgvRequest)
+		Expect(request.Argv).To(Equal([]string{"printf", "%s\n", "a b; rm -rf ~"}))
+		Expect(request.Command()).To(Equal("printf '%s\n' 'a b; rm -rf ~'"))
+		Expect((&ExecArgvRequest{Argv: []string{"echo", "it's", ""}}).Command()).To(Equal(`echo 'it'\''s' ''`))
+	})
+
+	It("Rejects the messages longer than MaxMessageLength", func() {
+		ChannelRequestParseFuncs["unbounded-test@ssh3"] = parseUnboundedTestRequest
+		DeferCleanup(func() { delete(ChannelRequestParseFuncs, "unbounded-test@ssh3") })
+
+		content := appendString(nil, strings.Repeat("a", MaxMessageLength))
+		_, err := ParseMessage(bytes.NewReader(requestMessage("unbounded-test@ssh3", content)))
+		Expect(errors.As(err, &MessageTooLong{})).To(BeTrue())
+
+		// the limit applies to each message of the stream
+		content = appendString(nil, strings.Repeat("a", MaxMessageLength/2))
+		stream := append(requestMessage("unbounded-test@ssh3", content), requestMessage("unbounded-test@ssh3", content)...)
+		reader := bytes.NewReader(stream)
+		for i := 0; i < 2; i++ {
+			_, err := ParseMessage(reader)
+			Expect(err).ToNot(HaveOccurred())
+		}
+	})
+})
@@ -2,6 +2,7 @@ package message
 
 import (
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/francoismichel/ssh3/util"
@@ -35,6 +36,20 @@ const SSH_MSG_CHANNEL_REQUEST = 98
 const SSH_MSG_CHANNEL_SUCCESS = 99
 const SSH_MSG_CHANNEL_FAILURE = 100
 
+// carries compressed channel data, from the local extensions range of RFC 4250. It is only sent
+// to the peers listing the compression algorithm in their ExtInfo.
+const SSH3_MSG_CHANNEL_COMPRESSED_DATA = 192
+
+// reason codes of the channel open failure messages, as in RFC 4254
+const SSH_OPEN_ADMINISTRATIVELY_PROHIBITED = 1
+const SSH_OPEN_CONNECT_FAILED = 2
+const SSH_OPEN_UNKNOWN_CHANNEL_TYPE = 3
+const SSH_OPEN_RESOURCE_SHORTAGE = 4
+
+// refuses a channel using a feature that the peer does not implement or that its configuration
+// disables, from the private use range of RFC 4250. The error message names the feature.
+const SSH3_OPEN_UNSUPPORTED_FEATURE = 0xFE000001
+
 type SSHDataType uint64
 
 const (
@@ -47,6 +62,38 @@ type Message interface {
 	Length() int
 }
 
+type UnknownMessageType struct {
+	MessageType uint64
+}
+
+func (e UnknownMessageType) Error() string {
+	return fmt.Sprintf("unknown message type %d", e.MessageType)
+}
+
+type UnknownRequestType struct {
+	RequestType string
+}
+
+func (e UnknownRequestType) Error() string {
+	return fmt.Sprintf("invalid request message type %s", e.RequestType)
+}
+
+// InvalidMessage is returned when a message could not be parsed.
+// As messages are not length-prefixed, the stream cannot be used
+// anymore once such an error occurred.
+type InvalidMessage struct {
+	MessageType uint64
+	Reason      error
+}
+
+func (e InvalidMessage) Error() string {
+	return fmt.Sprintf("invalid message of type %d: %s", e.MessageType, e.Reason)
+}
+
+func (e InvalidMessage) Unwrap() error {
+	return e.Reason
+}
+
 type ChannelOpenConfirmationMessage struct {
 	MaxPacketSize uint64
 }
@@ -64,6 +111,9 @@ func ParseChannelOpenConfirmationMessage(buf util.Reader) (*ChannelOpenConfirmat
 }
 
 func (m *ChannelOpenConfirmationMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write channel open confirmation message")
+	}
 	varintBuf := util.AppendVarInt(nil, uint64(SSH_MSG_CHANNEL_OPEN_CONFIRMATION))
 	varintBuf = util.AppendVarInt(varintBuf, m.MaxPacketSize)
 	consumed = copy(buf, varintBuf)
@@ -89,12 +139,12 @@ func ParseChannelOpenFailureMessage(buf util.Reader) (*ChannelOpenFailureMessage
 	if err != nil {
 		return nil, err
 	}
-	errorMessageUTF8, err := util.ParseSSHString(buf)
+	errorMessageUTF8, err := parseString(buf, "error message", MaxStringLength)
 	if err != nil {
 		return nil, err
 	}
 
-	languageTag, err := util.ParseSSHString(buf)
+	languageTag, err := parseString(buf, "language tag", MaxNameLength)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +193,7 @@ type DataOrExtendedDataMessage struct {
 var _ Message = &DataOrExtendedDataMessage{}
 
 func ParseDataMessage(buf util.Reader) (*DataOrExtendedDataMessage, error) {
-	data, err := util.ParseSSHString(buf)
+	data, err := parseString(buf, "data", MaxDataLength)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
@@ -154,30 +204,37 @@ func ParseDataMessage(buf util.Reader) (*DataOrExtendedDataMessage, error) {
 }
 
 func (m *DataOrExtendedDataMessage) Write(buf []byte) (consumed int, err error) {
-	if m.DataType == SSH_EXTENDED_DATA_NONE {
-		msgTypeBuf := util.AppendVarInt(nil, uint64(SSH_MSG_CHANNEL_DATA))
-		consumed += copy(buf[consumed:], msgTypeBuf)
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write data message")
+	}
+	// buf is large enough, the header is appended in place
+	header := AppendDataHeader(buf[:0], m.DataType, len(m.Data))
+	return len(header) + copy(buf[len(header):], m.Data), nil
+}
+
+// AppendDataHeader appends the encoding of a data message of dataType carrying dataLength bytes
+// up to its data, so that the data can be written right after from the buffer of the caller
+// instead of being copied in the message
+func AppendDataHeader(buf []byte, dataType SSHDataType, dataLength int) []byte {
+	if dataType == SSH_EXTENDED_DATA_NONE {
+		buf = util.AppendVarInt(buf, SSH_MSG_CHANNEL_DATA)
 	} else {
-		msgTypeBuf := util.AppendVarInt(nil, uint64(SSH_MSG_CHANNEL_EXTENDED_DATA))
-		consumed += copy(buf[consumed:], msgTypeBuf)
-		dataTypeBuf := util.AppendVarInt(nil, uint64(m.DataType))
-		consumed += copy(buf[consumed:], dataTypeBuf)
+		buf = util.AppendVarInt(buf, SSH_MSG_CHANNEL_EXTENDED_DATA)
+		buf = util.AppendVarInt(buf, uint64(dataType))
 	}
-	n, err := util.WriteSSHString(buf[consumed:], m.Data)
-	if err != nil {
-		return 0, err
+	return util.AppendVarInt(buf, uint64(dataLength))
+}
+
+// DataHeaderLength returns the length of the header appended by AppendDataHeader
+func DataHeaderLength(dataType SSHDataType, dataLength int) int {
+	if dataType == SSH_EXTENDED_DATA_NONE {
+		return int(util.VarIntLen(SSH_MSG_CHANNEL_DATA) + util.VarIntLen(uint64(dataLength)))
 	}
-	consumed += n
-	return consumed, nil
+	return int(util.VarIntLen(SSH_MSG_CHANNEL_EXTENDED_DATA) + util.VarIntLen(uint64(dataType)) + util.VarIntLen(uint64(dataLength)))
 }
 
 func (m *DataOrExtendedDataMessage) Length() int {
-	if m.DataType == SSH_EXTENDED_DATA_NONE {
-		messageTypeLen := util.VarIntLen(SSH_MSG_CHANNEL_DATA)
-		return int(messageTypeLen) + int(util.SSHStringLen(m.Data))
-	}
-	messageTypeLen := util.VarIntLen(SSH_MSG_CHANNEL_EXTENDED_DATA)
-	return int(messageTypeLen) + int(util.VarIntLen(uint64(m.DataType))) + int(util.SSHStringLen(m.Data))
+	return DataHeaderLength(m.DataType, len(m.Data)) + len(m.Data)
 }
 
 func ParseExtendedDataMessage(buf util.Reader) (*DataOrExtendedDataMessage, error) {
@@ -185,7 +242,7 @@ func ParseExtendedDataMessage(buf util.Reader) (*DataOrExtendedDataMessage, erro
 	if err != nil {
 		return nil, err
 	}
-	data, err := util.ParseSSHString(buf)
+	data, err := parseString(buf, "data", MaxDataLength)
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
@@ -195,14 +252,125 @@ func ParseExtendedDataMessage(buf util.Reader) (*DataOrExtendedDataMessage, erro
 	}, err
 }
 
-func ParseMessage(r util.Reader) (Message, error) {
-	typeId, err := util.ReadVarInt(r)
+// CompressedDataMessage carries the data of a data or extended data message, compressed with the
+// algorithm negotiated by the conversation. Each message is compressed independently.
+type CompressedDataMessage struct {
+	DataType SSHDataType
+	// the length of the data once decompressed, at most MaxDataLength
+	UncompressedLength uint64
+	CompressedData     string
+}
+
+var _ Message = &CompressedDataMessage{}
+
+func ParseCompressedDataMessage(buf util.Reader) (*CompressedDataMessage, error) {
+	dataType, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	uncompressedLength, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	if uncompressedLength > MaxDataLength {
+		return nil, FieldTooLong{Field: "uncompressed data", Length: uncompressedLength, MaxLength: MaxDataLength}
+	}
+	compressedData, err := parseString(buf, "compressed data", MaxDataLength)
 	if err != nil {
 		return nil, err
 	}
+	return &CompressedDataMessage{
+		DataType:           SSHDataType(dataType),
+		UncompressedLength: uncompressedLength,
+		CompressedData:     compressedData,
+	}, nil
+}
+
+func (m *CompressedDataMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write compressed data message")
+	}
+	header := util.AppendVarInt(buf[:0], SSH3_MSG_CHANNEL_COMPRESSED_DATA)
+	header = util.AppendVarInt(header, uint64(m.DataType))
+	header = util.AppendVarInt(header, m.UncompressedLength)
+	consumed = len(header)
+	n, err := util.WriteSSHString(buf[consumed:], m.CompressedData)
+	if err != nil {
+		return 0, err
+	}
+	return consumed + n, nil
+}
+
+func (m *CompressedDataMessage) Length() int {
+	return int(util.VarIntLen(SSH3_MSG_CHANNEL_COMPRESSED_DATA)+util.VarIntLen(uint64(m.DataType))+util.VarIntLen(m.UncompressedLength)) +
+		util.SSHStringLen(m.CompressedData)
+}
+
+// ChannelEOFMessage tells the peer that no more data will be sent on the channel, as
+// SSH_MSG_CHANNEL_EOF (RFC 4254 Sec 5.3), e.g. at the end of the standard input of a remote
+// command. Unlike the end of the stream, which closes the channel in that direction, the
+// requests can still be sent afterwards, e.g. signals.
+type ChannelEOFMessage struct{}
+
+var _ Message = &ChannelEOFMessage{}
+
+func (m *ChannelEOFMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write channel EOF message")
+	}
+	return copy(buf, util.AppendVarInt(nil, SSH_MSG_CHANNEL_EOF)), nil
+}
+
+func (m *ChannelEOFMessage) Length() int {
+	return int(util.VarIntLen(SSH_MSG_CHANNEL_EOF))
+}
+
+// ChannelSuccessMessage replies to a request sent with WantReply that the peer handled
+// successfully, as SSH_MSG_CHANNEL_SUCCESS (RFC 4254 Sec 5.4). The replies are sent in the order
+// of the requests.
+type ChannelSuccessMessage struct{}
+
+var _ Message = &ChannelSuccessMessage{}
+
+func (m *ChannelSuccessMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write channel success message")
+	}
+	return copy(buf, util.AppendVarInt(nil, SSH_MSG_CHANNEL_SUCCESS)), nil
+}
+
+func (m *ChannelSuccessMessage) Length() int {
+	return int(util.VarIntLen(SSH_MSG_CHANNEL_SUCCESS))
+}
+
+// ChannelFailureMessage replies to a request sent with WantReply that the peer refused or could
+// not handle, as SSH_MSG_CHANNEL_FAILURE (RFC 4254 Sec 5.4), e.g. a pty request on a server
+// running out of ptys
+type ChannelFailureMessage struct{}
+
+var _ Message = &ChannelFailureMessage{}
+
+func (m *ChannelFailureMessage) Write(buf []byte) (consumed int, err error) {
+	if len(buf) < m.Length() {
+		return 0, errors.New("buffer too small to write channel failure message")
+	}
+	return copy(buf, util.AppendVarInt(nil, SSH_MSG_CHANNEL_FAILURE)), nil
+}
+
+func (m *ChannelFailureMessage) Length() int {
+	return int(util.VarIntLen(SSH_MSG_CHANNEL_FAILURE))
+}
+
+// ParseMessage parses a message sent in the wire format of MaxProtocolVersion, see
+// ParseMessageVersion
+func ParseMessage(r util.Reader) (Message, error) {
+	return ParseMessageVersion(r, MaxProtocolVersion)
+}
+
+func parseMessageContent(typeId uint64, r util.Reader, version ProtocolVersion) (Message, error) {
 	switch typeId {
 	case SSH_MSG_CHANNEL_REQUEST:
-		return ParseRequestMessage(r)
+		return parseRequestMessage(r, version)
 	case SSH_MSG_CHANNEL_OPEN_CONFIRMATION:
 		return ParseChannelOpenConfirmationMessage(r)
 	case SSH_MSG_CHANNEL_OPEN_FAILURE:
@@ -213,7 +381,19 @@ func ParseMessage(r util.Reader) (Message, error) {
 		} else {
 			return ParseExtendedDataMessage(r)
 		}
+	case SSH3_MSG_CHANNEL_COMPRESSED_DATA:
+		return ParseCompressedDataMessage(r)
+	case SSH_MSG_USERAUTH_BANNER:
+		return ParseBannerMessage(r)
+	case SSH_MSG_DISCONNECT:
+		return ParseDisconnectMessage(r)
+	case SSH_MSG_CHANNEL_EOF:
+		return &ChannelEOFMessage{}, nil
+	case SSH_MSG_CHANNEL_SUCCESS:
+		return &ChannelSuccessMessage{}, nil
+	case SSH_MSG_CHANNEL_FAILURE:
+		return &ChannelFailureMessage{}, nil
 	default:
-		panic("not implemented")
+		return nil, UnknownMessageType{MessageType: typeId}
 	}
 }
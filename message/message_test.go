@@ -3,6 +3,7 @@ package message
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	mathrand "math/rand"
 
 	"github.com/francoismichel/ssh3/util"
@@ -197,7 +198,8 @@ var _ = Describe("Messages", func() {
 		largeString := string(largeStringBytes)
 		term := largeString[:100]
 		wantReply, wantReplyByte := generateSSHBool()
-		encodedModes := largeString[100:600]
+		terminalModes := CookedMode().Merge(TerminalModes{VERASE: 0x08, TTY_OP_ISPEED: 38400, TTY_OP_OSPEED: 38400})
+		encodedModes := terminalModes.Encode()
 		charWidth, charHeight, pixelWidth, pixelHeight := mathrand.Uint64()%(1<<60), mathrand.Uint64()%(1<<60), mathrand.Uint64()%(1<<60), mathrand.Uint64()%(1<<60)
 
 		pty_req_binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
@@ -216,12 +218,12 @@ var _ = Describe("Messages", func() {
 		pty_req_message := &ChannelRequestMessage{
 			WantReply: wantReply,
 			ChannelRequest: &PtyRequest{
-				Term:                 term,
-				CharWidth:            charWidth,
-				CharHeight:           charHeight,
-				PixelWidth:           pixelWidth,
-				PixelHeight:          pixelHeight,
-				EncodedTerminalModes: encodedModes,
+				Term:          term,
+				CharWidth:     charWidth,
+				CharHeight:    charHeight,
+				PixelWidth:    pixelWidth,
+				PixelHeight:   pixelHeight,
+				TerminalModes: terminalModes,
 			},
 		}
 
@@ -295,6 +297,22 @@ var _ = Describe("Messages", func() {
 			},
 		}
 
+		wantReply, wantReplyByte = generateSSHBool()
+		workingDirectory := largeString[:200]
+		working_directory_req_binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+		working_directory_req_binary = util.AppendVarInt(working_directory_req_binary, uint64(len("working-directory")))
+		working_directory_req_binary = append(working_directory_req_binary, "working-directory"...)
+		working_directory_req_binary = append(working_directory_req_binary, wantReplyByte)
+		working_directory_req_binary = util.AppendVarInt(working_directory_req_binary, uint64(len(workingDirectory)))
+		working_directory_req_binary = append(working_directory_req_binary, workingDirectory...)
+
+		working_directory_req_message := &ChannelRequestMessage{
+			WantReply: wantReply,
+			ChannelRequest: &WorkingDirectoryRequest{
+				Directory: workingDirectory,
+			},
+		}
+
 		wantReply, wantReplyByte = generateSSHBool()
 		window_change_req_binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
 		window_change_req_binary = util.AppendVarInt(window_change_req_binary, uint64(len("window-change")))
@@ -331,6 +349,21 @@ var _ = Describe("Messages", func() {
 			},
 		}
 
+		wantReply, wantReplyByte = generateSSHBool()
+		breakLength := mathrand.Uint64() % (1 << 30)
+		break_req_binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+		break_req_binary = util.AppendVarInt(break_req_binary, uint64(len("break")))
+		break_req_binary = append(break_req_binary, "break"...)
+		break_req_binary = append(break_req_binary, wantReplyByte)
+		break_req_binary = util.AppendVarInt(break_req_binary, breakLength)
+
+		break_req_message := &ChannelRequestMessage{
+			WantReply: wantReply,
+			ChannelRequest: &BreakRequest{
+				BreakLengthMs: breakLength,
+			},
+		}
+
 		wantReply, wantReplyByte = generateSSHBool()
 		exitStatus := mathrand.Uint64() % (1 << 60)
 		exit_status_req_binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
@@ -409,6 +442,13 @@ var _ = Describe("Messages", func() {
 				Expect(msg).To(Equal(subsystem_req_message))
 			})
 
+			It("Parses a working directory request", func() {
+				r := bytes.NewReader(working_directory_req_binary)
+				msg, err := ParseMessage(&util.BytesReadCloser{Reader: r})
+				Expect(err).To(BeNil())
+				Expect(msg).To(Equal(working_directory_req_message))
+			})
+
 			It("Parses a window change request", func() {
 				r := bytes.NewReader(window_change_req_binary)
 				msg, err := ParseMessage(&util.BytesReadCloser{Reader: r})
@@ -423,6 +463,13 @@ var _ = Describe("Messages", func() {
 				Expect(msg).To(Equal(signal_req_message))
 			})
 
+			It("Parses a break request", func() {
+				r := bytes.NewReader(break_req_binary)
+				msg, err := ParseMessage(&util.BytesReadCloser{Reader: r})
+				Expect(err).To(BeNil())
+				Expect(msg).To(Equal(break_req_message))
+			})
+
 			It("Parses an exit status request", func() {
 				r := bytes.NewReader(exit_status_req_binary)
 				msg, err := ParseMessage(&util.BytesReadCloser{Reader: r})
@@ -479,6 +526,14 @@ var _ = Describe("Messages", func() {
 				Expect(buf).To(Equal(subsystem_req_binary))
 			})
 
+			It("Writes a working directory request", func() {
+				buf := make([]byte, working_directory_req_message.Length())
+				n, err := working_directory_req_message.Write(buf)
+				Expect(err).To(BeNil())
+				Expect(n).To(BeEquivalentTo(len(buf)))
+				Expect(buf).To(Equal(working_directory_req_binary))
+			})
+
 			It("Writes a window change request", func() {
 				buf := make([]byte, window_change_req_message.Length())
 				n, err := window_change_req_message.Write(buf)
@@ -495,6 +550,14 @@ var _ = Describe("Messages", func() {
 				Expect(buf).To(Equal(signal_req_binary))
 			})
 
+			It("Writes a break request", func() {
+				buf := make([]byte, break_req_message.Length())
+				n, err := break_req_message.Write(buf)
+				Expect(err).To(BeNil())
+				Expect(n).To(BeEquivalentTo(len(buf)))
+				Expect(buf).To(Equal(break_req_binary))
+			})
+
 			It("Writes an exit status request", func() {
 				buf := make([]byte, exit_status_req_message.Length())
 				n, err := exit_status_req_message.Write(buf)
@@ -582,4 +645,92 @@ var _ = Describe("Messages", func() {
 		})
 	})
 
+	Context("Terminal modes", func() {
+		It("Encodes the modes sorted by opcode and terminated by TTY_OP_END", func() {
+			encoded := TerminalModes{ECHO: 1, VINTR: 3, TTY_OP_OSPEED: 38400}.Encode()
+			Expect(encoded).To(Equal([]byte{
+				byte(VINTR), 0, 0, 0, 3,
+				byte(ECHO), 0, 0, 0, 1,
+				byte(TTY_OP_OSPEED), 0, 0, 0x96, 0,
+				byte(TTY_OP_END),
+			}))
+			Expect(TerminalModes{ECHO: 1, VINTR: 3, TTY_OP_OSPEED: 38400}.EncodedLength()).To(Equal(len(encoded)))
+			Expect(TerminalModes(nil).Encode()).To(Equal([]byte{byte(TTY_OP_END)}))
+		})
+
+		It("Parses encoded modes", func() {
+			modes := CookedMode().Merge(RawMode())
+			parsed, err := ParseTerminalModes(modes.Encode())
+			Expect(err).To(BeNil())
+			Expect(parsed).To(Equal(modes))
+			Expect(parsed[ECHO]).To(BeEquivalentTo(0))
+			Expect(parsed[VERASE]).To(BeEquivalentTo(0x7f))
+
+			parsed, err = ParseTerminalModes(nil)
+			Expect(err).To(BeNil())
+			Expect(parsed).To(BeEmpty())
+		})
+
+		It("Stops parsing at the first undefined opcode", func() {
+			parsed, err := ParseTerminalModes([]byte{byte(ECHO), 0, 0, 0, 1, 200, 1, byte(ICANON), 0, 0, 0, 1})
+			Expect(err).To(BeNil())
+			Expect(parsed).To(Equal(TerminalModes{ECHO: 1}))
+		})
+
+		It("Returns an error on a truncated argument", func() {
+			_, err := ParseTerminalModes([]byte{byte(ECHO), 0, 0})
+			Expect(err).ToNot(BeNil())
+
+			binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+			binary = util.AppendVarInt(binary, uint64(len("pty-req")))
+			binary = append(binary, "pty-req"...)
+			binary = append(binary, 1)
+			binary = util.AppendVarInt(binary, uint64(len("xterm")))
+			binary = append(binary, "xterm"...)
+			binary = append(binary, util.AppendVarInt(util.AppendVarInt(util.AppendVarInt(util.AppendVarInt(nil, 80), 24), 0), 0)...)
+			binary = util.AppendVarInt(binary, 3)
+			binary = append(binary, byte(ECHO), 0, 0)
+			_, err = ParseMessage(&util.BytesReadCloser{Reader: bytes.NewReader(binary)})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("Malformed messages", func() {
+		It("Returns an error on unknown message types", func() {
+			r := bytes.NewReader(util.AppendVarInt(nil, 0x3e))
+			_, err := ParseMessage(&util.BytesReadCloser{Reader: r})
+			Expect(err).To(BeAssignableToTypeOf(InvalidMessage{}))
+			Expect(errors.As(err, &UnknownMessageType{})).To(BeTrue())
+		})
+
+		It("Returns an error on unknown request types", func() {
+			binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+			binary = util.AppendVarInt(binary, uint64(len("not-a-request")))
+			binary = append(binary, "not-a-request"...)
+			binary = append(binary, 1)
+			_, err := ParseMessage(&util.BytesReadCloser{Reader: bytes.NewReader(binary)})
+			Expect(errors.As(err, &UnknownRequestType{})).To(BeTrue())
+		})
+
+		It("Does not allocate the length announced by a truncated string", func() {
+			binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+			binary = util.AppendVarInt(binary, uint64(len("exec")))
+			binary = append(binary, "exec"...)
+			binary = append(binary, 1)
+			binary = util.AppendVarInt(binary, 1<<62-1)
+			binary = append(binary, "ls"...)
+			_, err := ParseMessage(&util.BytesReadCloser{Reader: bytes.NewReader(binary)})
+			Expect(err).To(BeAssignableToTypeOf(InvalidMessage{}))
+		})
+
+		It("Returns an error on a request without content", func() {
+			binary := util.AppendVarInt(nil, CHANNEL_REQUEST)
+			binary = util.AppendVarInt(binary, uint64(len("exit-status")))
+			binary = append(binary, "exit-status"...)
+			binary = append(binary, 0)
+			_, err := ParseMessage(&util.BytesReadCloser{Reader: bytes.NewReader(binary)})
+			Expect(err).To(BeAssignableToTypeOf(InvalidMessage{}))
+		})
+	})
+
 })
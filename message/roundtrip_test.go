@@ -0,0 +1,214 @@
+package message
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// the values written on the wire, i.e. the messages and the channel requests
+type wireValue interface {
+	Length() int
+	Write(buf []byte) (int, error)
+}
+
+// returns a value of random length among the varint lengths
+func randomVarInt(rng *rand.Rand) uint64 {
+	bounds := []int64{1 << 6, 1 << 14, 1 << 30, 1 << 62}
+	return uint64(rng.Int63n(bounds[rng.Intn(len(bounds))]))
+}
+
+func randomString(rng *rand.Rand, maxLength int) string {
+	s := make([]byte, rng.Intn(maxLength+1))
+	rng.Read(s)
+	return string(s)
+}
+
+func randomTerminalModes(rng *rand.Rand) TerminalModes {
+	modes := TerminalModes{}
+	for i := rng.Intn(10); i > 0; i-- {
+		modes[TerminalModeOpcode(1+rng.Intn(firstUndefinedTerminalModeOpcode-1))] = rng.Uint32()
+	}
+	return modes
+}
+
+func randomArgv(rng *rand.Rand) []string {
+	argv := make([]string, 1+rng.Intn(8))
+	for i := range argv {
+		argv[i] = randomString(rng, 64)
+	}
+	return argv
+}
+
+// returns a random request of each type
+func randomChannelRequests(rng *rand.Rand) []ChannelRequest {
+	addressFamily, ipAddress := util.SSHAFIpv4, make(net.IP, 4)
+	if rng.Intn(2) == 0 {
+		addressFamily, ipAddress = util.SSHAFIpv6, make(net.IP, 16)
+	}
+	rng.Read(ipAddress)
+	return []ChannelRequest{
+		&PtyRequest{
+			Term:          randomString(rng, 32),
+			CharWidth:     randomVarInt(rng),
+			CharHeight:    randomVarInt(rng),
+			PixelWidth:    randomVarInt(rng),
+			PixelHeight:   randomVarInt(rng),
+			TerminalModes: randomTerminalModes(rng),
+		},
+		&X11Request{
+			SingleConnection:          rng.Intn(2) == 0,
+			X11AuthenticationProtocol: randomString(rng, 32),
+			X11AuthenticationCookie:   randomString(rng, 32),
+			X11ScreenNumber:           randomVarInt(rng),
+		},
+		&ShellRequest{},
+		&ExecRequest{Command: randomString(rng, 256)},
+		&ExecArgvRequest{Argv: randomArgv(rng)},
+		&SubsystemRequest{SubsystemName: randomString(rng, 32)},
+		&WorkingDirectoryRequest{Directory: randomString(rng, 256)},
+		&ReattachRequest{SessionID: randomString(rng, 32)},
+		&WindowChangeRequest{
+			CharWidth:   randomVarInt(rng),
+			CharHeight:  randomVarInt(rng),
+			PixelWidth:  randomVarInt(rng),
+			PixelHeight: randomVarInt(rng),
+		},
+		&SignalRequest{SignalNameWithoutSig: randomString(rng, 16)},
+		&BreakRequest{BreakLengthMs: randomVarInt(rng)},
+		&ExitStatusRequest{ExitStatus: randomVarInt(rng)},
+		&ExitSignalRequest{
+			SignalNameWithoutSig: randomString(rng, 16),
+			CoreDumped:           rng.Intn(2) == 0,
+			ErrorMessageUTF8:     randomString(rng, 256),
+			LanguageTag:          randomString(rng, 16),
+		},
+		&ForwardingRequest{
+			Protocol:      util.SSHForwardingProtocol(rng.Intn(2)),
+			AddressFamily: addressFamily,
+			IpAddress:     ipAddress,
+			Port:          uint16(rng.Intn(1 << 16)),
+		},
+	}
+}
+
+// returns a random message of each type, and a channel request message for each request
+// parsed by ParseRequestMessage
+func randomMessages(rng *rand.Rand) []Message {
+	messages := []Message{
+		&ChannelOpenConfirmationMessage{MaxPacketSize: randomVarInt(rng)},
+		&ChannelOpenFailureMessage{
+			ReasonCode:       randomVarInt(rng),
+			ErrorMessageUTF8: randomString(rng, 256),
+			LanguageTag:      randomString(rng, 16),
+		},
+		&DataOrExtendedDataMessage{DataType: SSH_EXTENDED_DATA_NONE, Data: randomString(rng, 256)},
+		&DataOrExtendedDataMessage{DataType: SSHDataType(max(1, randomVarInt(rng))), Data: randomString(rng, 256)},
+		&CompressedDataMessage{
+			DataType:           SSHDataType(randomVarInt(rng)),
+			UncompressedLength: uint64(rng.Intn(MaxDataLength + 1)),
+			CompressedData:     randomString(rng, 256),
+		},
+		&BannerMessage{MessageUTF8: randomString(rng, 256), LanguageTag: randomString(rng, 16)},
+		&DisconnectMessage{
+			ReasonCode:      randomVarInt(rng),
+			DescriptionUTF8: randomString(rng, 256),
+			LanguageTag:     randomString(rng, 16),
+		},
+		&ChannelEOFMessage{},
+		&ChannelSuccessMessage{},
+		&ChannelFailureMessage{},
+	}
+	for _, request := range randomChannelRequests(rng) {
+		if _, ok := ChannelRequestParseFuncs[request.RequestTypeStr()]; ok {
+			messages = append(messages, &ChannelRequestMessage{WantReply: rng.Intn(2) == 0, ChannelRequest: request})
+		}
+	}
+	return messages
+}
+
+// returns the parse function of the request type, including the requests that are not parsed
+// by ParseRequestMessage
+func channelRequestParseFunc(requestType string) func(util.Reader) (ChannelRequest, error) {
+	if requestType == "forward-port" {
+		return ParseForwardingRequest
+	}
+	return ChannelRequestParseFuncs[requestType]
+}
+
+var _ = Describe("Round trips", func() {
+	const iterations = 100
+	var rng *rand.Rand
+
+	BeforeEach(func() {
+		rng = rand.New(rand.NewSource(GinkgoRandomSeed()))
+	})
+
+	encode := func(v wireValue) []byte {
+		buf := make([]byte, v.Length())
+		n, err := v.Write(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(buf)), "%T wrote %d bytes instead of its length", v, n)
+		return buf
+	}
+
+	It("Parses the channel requests it writes", func() {
+		for i := 0; i < iterations; i++ {
+			for _, request := range randomChannelRequests(rng) {
+				parse := channelRequestParseFunc(request.RequestTypeStr())
+				Expect(parse).ToNot(BeNil())
+				parsed, err := parse(bytes.NewReader(encode(request)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(parsed).To(Equal(request))
+			}
+		}
+	})
+
+	It("Parses the messages it writes", func() {
+		for i := 0; i < iterations; i++ {
+			for _, message := range randomMessages(rng) {
+				parsed, err := ParseMessage(bytes.NewReader(encode(message)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(parsed).To(Equal(message))
+			}
+		}
+	})
+
+	It("Writes the data messages as their header followed by their data", func() {
+		for i := 0; i < iterations; i++ {
+			for _, dataType := range []SSHDataType{SSH_EXTENDED_DATA_NONE, SSH_EXTENDED_DATA_STDERR, SSHDataType(randomVarInt(rng))} {
+				message := &DataOrExtendedDataMessage{DataType: dataType, Data: randomString(rng, 1<<rng.Intn(17))}
+				header := AppendDataHeader(nil, dataType, len(message.Data))
+				Expect(header).To(HaveLen(DataHeaderLength(dataType, len(message.Data))))
+				Expect(append(header, message.Data...)).To(Equal(encode(message)))
+			}
+		}
+	})
+
+	It("Parses the messages written back to back", func() {
+		messages := randomMessages(rng)
+		var stream []byte
+		for _, message := range messages {
+			stream = append(stream, encode(message)...)
+		}
+		r := bytes.NewReader(stream)
+		for _, message := range messages {
+			parsed, err := ParseMessage(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed).To(Equal(message))
+		}
+		Expect(r.Len()).To(BeZero())
+	})
+
+	It("Refuses to write in a buffer shorter than the length", func() {
+		for _, message := range randomMessages(rng) {
+			_, err := message.Write(make([]byte, message.Length()-1))
+			Expect(err).To(HaveOccurred(), "%T", message)
+		}
+	})
+})
@@ -0,0 +1,179 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+type TerminalModeOpcode uint8
+
+// terminal mode opcodes, see RFC4254 Sec 8 and RFC8160
+const (
+	TTY_OP_END TerminalModeOpcode = 0
+
+	// special characters
+	VINTR    TerminalModeOpcode = 1
+	VQUIT    TerminalModeOpcode = 2
+	VERASE   TerminalModeOpcode = 3
+	VKILL    TerminalModeOpcode = 4
+	VEOF     TerminalModeOpcode = 5
+	VEOL     TerminalModeOpcode = 6
+	VEOL2    TerminalModeOpcode = 7
+	VSTART   TerminalModeOpcode = 8
+	VSTOP    TerminalModeOpcode = 9
+	VSUSP    TerminalModeOpcode = 10
+	VDSUSP   TerminalModeOpcode = 11
+	VREPRINT TerminalModeOpcode = 12
+	VWERASE  TerminalModeOpcode = 13
+	VLNEXT   TerminalModeOpcode = 14
+	VFLUSH   TerminalModeOpcode = 15
+	VSWTCH   TerminalModeOpcode = 16
+	VSTATUS  TerminalModeOpcode = 17
+	VDISCARD TerminalModeOpcode = 18
+
+	// input flags
+	IGNPAR  TerminalModeOpcode = 30
+	PARMRK  TerminalModeOpcode = 31
+	INPCK   TerminalModeOpcode = 32
+	ISTRIP  TerminalModeOpcode = 33
+	INLCR   TerminalModeOpcode = 34
+	IGNCR   TerminalModeOpcode = 35
+	ICRNL   TerminalModeOpcode = 36
+	IUCLC   TerminalModeOpcode = 37
+	IXON    TerminalModeOpcode = 38
+	IXANY   TerminalModeOpcode = 39
+	IXOFF   TerminalModeOpcode = 40
+	IMAXBEL TerminalModeOpcode = 41
+	IUTF8   TerminalModeOpcode = 42
+
+	// local flags
+	ISIG    TerminalModeOpcode = 50
+	ICANON  TerminalModeOpcode = 51
+	XCASE   TerminalModeOpcode = 52
+	ECHO    TerminalModeOpcode = 53
+	ECHOE   TerminalModeOpcode = 54
+	ECHOK   TerminalModeOpcode = 55
+	ECHONL  TerminalModeOpcode = 56
+	NOFLSH  TerminalModeOpcode = 57
+	TOSTOP  TerminalModeOpcode = 58
+	IEXTEN  TerminalModeOpcode = 59
+	ECHOCTL TerminalModeOpcode = 60
+	ECHOKE  TerminalModeOpcode = 61
+	PENDIN  TerminalModeOpcode = 62
+
+	// output flags
+	OPOST  TerminalModeOpcode = 70
+	OLCUC  TerminalModeOpcode = 71
+	ONLCR  TerminalModeOpcode = 72
+	OCRNL  TerminalModeOpcode = 73
+	ONOCR  TerminalModeOpcode = 74
+	ONLRET TerminalModeOpcode = 75
+
+	// control flags
+	CS7    TerminalModeOpcode = 90
+	CS8    TerminalModeOpcode = 91
+	PARENB TerminalModeOpcode = 92
+	PARODD TerminalModeOpcode = 93
+
+	// baud rates, in bits per second
+	TTY_OP_ISPEED TerminalModeOpcode = 128
+	TTY_OP_OSPEED TerminalModeOpcode = 129
+)
+
+// the opcodes from this one are not defined yet and stop the parsing of the modes, as their
+// argument has no known size
+const firstUndefinedTerminalModeOpcode = 160
+
+// TerminalModes are the modes of the terminal of the client that the server applies to the
+// pty it allocates, by opcode. Special characters are given by their code (e.g. 0x7f for
+// VERASE), flags are 1 when set and 0 when cleared. The modes that are not present are left
+// to the default of the server.
+type TerminalModes map[TerminalModeOpcode]uint32
+
+// RawMode returns the modes of a terminal passing input and output through untouched, e.g.
+// for a full-screen application: no echo, no line editing, no signal characters and no
+// output processing
+func RawMode() TerminalModes {
+	return TerminalModes{
+		IGNPAR: 0, PARMRK: 0, INPCK: 0, ISTRIP: 0, INLCR: 0, IGNCR: 0, ICRNL: 0, IXON: 0, IXOFF: 0,
+		ISIG: 0, ICANON: 0, ECHO: 0, ECHOE: 0, ECHOK: 0, ECHONL: 0, IEXTEN: 0,
+		OPOST: 0, CS8: 1, PARENB: 0,
+	}
+}
+
+// CookedMode returns the usual modes of an interactive terminal, as set by `stty sane` with
+// the special characters of Linux
+func CookedMode() TerminalModes {
+	return TerminalModes{
+		VINTR: 0x03, VQUIT: 0x1c, VERASE: 0x7f, VKILL: 0x15, VEOF: 0x04, VSTART: 0x11, VSTOP: 0x13,
+		VSUSP: 0x1a, VREPRINT: 0x12, VWERASE: 0x17, VLNEXT: 0x16, VDISCARD: 0x0f,
+		IGNPAR: 0, ISTRIP: 0, INLCR: 0, IGNCR: 0, ICRNL: 1, IXON: 1, IXOFF: 0, IMAXBEL: 1, IUTF8: 1,
+		ISIG: 1, ICANON: 1, ECHO: 1, ECHOE: 1, ECHOK: 1, ECHONL: 0, NOFLSH: 0, TOSTOP: 0, IEXTEN: 1,
+		ECHOCTL: 1, ECHOKE: 1,
+		OPOST: 1, ONLCR: 1, OCRNL: 0,
+		CS8: 1, PARENB: 0,
+	}
+}
+
+// Merge returns a copy of the modes in which the ones of override replace them, e.g. to
+// start from a preset and change a few modes
+func (m TerminalModes) Merge(override TerminalModes) TerminalModes {
+	merged := make(TerminalModes, len(m)+len(override))
+	for op, value := range m {
+		merged[op] = value
+	}
+	for op, value := range override {
+		merged[op] = value
+	}
+	return merged
+}
+
+func (m TerminalModes) sortedOpcodes() []TerminalModeOpcode {
+	opcodes := make([]TerminalModeOpcode, 0, len(m))
+	for op := range m {
+		if op != TTY_OP_END && op < firstUndefinedTerminalModeOpcode {
+			opcodes = append(opcodes, op)
+		}
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+	return opcodes
+}
+
+// EncodedLength returns the length of the encoded modes
+func (m TerminalModes) EncodedLength() int {
+	return 5*len(m.sortedOpcodes()) + 1
+}
+
+// Encode returns the modes in the format of RFC4254 Sec 8, sorted by opcode and terminated
+// by TTY_OP_END. The opcodes that have no known argument size are omitted.
+func (m TerminalModes) Encode() []byte {
+	opcodes := m.sortedOpcodes()
+	encoded := make([]byte, 0, 5*len(opcodes)+1)
+	for _, op := range opcodes {
+		encoded = append(encoded, byte(op))
+		encoded = binary.BigEndian.AppendUint32(encoded, m[op])
+	}
+	return append(encoded, byte(TTY_OP_END))
+}
+
+// ParseTerminalModes decodes modes in the format of RFC4254 Sec 8. As mandated by the RFC,
+// the parsing stops at the first opcode that is not defined yet. Empty modes are valid.
+func ParseTerminalModes(encoded []byte) (TerminalModes, error) {
+	modes := TerminalModes{}
+	for count := 0; len(encoded) > 0; count++ {
+		op := TerminalModeOpcode(encoded[0])
+		if op == TTY_OP_END || op >= firstUndefinedTerminalModeOpcode {
+			break
+		}
+		if count == MaxTerminalModes {
+			return nil, TooManyFields{Field: "terminal modes", MaxCount: MaxTerminalModes}
+		}
+		if len(encoded) < 5 {
+			return nil, fmt.Errorf("truncated argument for terminal mode opcode %d", op)
+		}
+		modes[op] = binary.BigEndian.Uint32(encoded[1:5])
+		encoded = encoded[5:]
+	}
+	return modes, nil
+}
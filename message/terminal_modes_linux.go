@@ -0,0 +1,135 @@
+//go:build linux
+
+package message
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+var terminalModeSpecialCharacters = map[TerminalModeOpcode]int{
+	VINTR: unix.VINTR, VQUIT: unix.VQUIT, VERASE: unix.VERASE, VKILL: unix.VKILL, VEOF: unix.VEOF,
+	VEOL: unix.VEOL, VEOL2: unix.VEOL2, VSTART: unix.VSTART, VSTOP: unix.VSTOP, VSUSP: unix.VSUSP,
+	VREPRINT: unix.VREPRINT, VWERASE: unix.VWERASE, VLNEXT: unix.VLNEXT, VDISCARD: unix.VDISCARD,
+}
+
+type terminalModeFlag struct {
+	flags *uint32
+	mask  uint32
+}
+
+func terminalModeFlags(termios *unix.Termios) map[TerminalModeOpcode]terminalModeFlag {
+	return map[TerminalModeOpcode]terminalModeFlag{
+		IGNPAR: {&termios.Iflag, unix.IGNPAR}, PARMRK: {&termios.Iflag, unix.PARMRK},
+		INPCK: {&termios.Iflag, unix.INPCK}, ISTRIP: {&termios.Iflag, unix.ISTRIP},
+		INLCR: {&termios.Iflag, unix.INLCR}, IGNCR: {&termios.Iflag, unix.IGNCR},
+		ICRNL: {&termios.Iflag, unix.ICRNL}, IUCLC: {&termios.Iflag, unix.IUCLC},
+		IXON: {&termios.Iflag, unix.IXON}, IXANY: {&termios.Iflag, unix.IXANY},
+		IXOFF: {&termios.Iflag, unix.IXOFF}, IMAXBEL: {&termios.Iflag, unix.IMAXBEL},
+		IUTF8: {&termios.Iflag, unix.IUTF8},
+		ISIG:  {&termios.Lflag, unix.ISIG}, ICANON: {&termios.Lflag, unix.ICANON},
+		XCASE: {&termios.Lflag, unix.XCASE}, ECHO: {&termios.Lflag, unix.ECHO},
+		ECHOE: {&termios.Lflag, unix.ECHOE}, ECHOK: {&termios.Lflag, unix.ECHOK},
+		ECHONL: {&termios.Lflag, unix.ECHONL}, NOFLSH: {&termios.Lflag, unix.NOFLSH},
+		TOSTOP: {&termios.Lflag, unix.TOSTOP}, IEXTEN: {&termios.Lflag, unix.IEXTEN},
+		ECHOCTL: {&termios.Lflag, unix.ECHOCTL}, ECHOKE: {&termios.Lflag, unix.ECHOKE},
+		PENDIN: {&termios.Lflag, unix.PENDIN},
+		OPOST:  {&termios.Oflag, unix.OPOST}, OLCUC: {&termios.Oflag, unix.OLCUC},
+		ONLCR: {&termios.Oflag, unix.ONLCR}, OCRNL: {&termios.Oflag, unix.OCRNL},
+		ONOCR: {&termios.Oflag, unix.ONOCR}, ONLRET: {&termios.Oflag, unix.ONLRET},
+		PARENB: {&termios.Cflag, unix.PARENB}, PARODD: {&termios.Cflag, unix.PARODD},
+	}
+}
+
+var terminalBaudRates = map[uint32]uint32{
+	unix.B50: 50, unix.B75: 75, unix.B110: 110, unix.B134: 134, unix.B150: 150, unix.B200: 200,
+	unix.B300: 300, unix.B600: 600, unix.B1200: 1200, unix.B1800: 1800, unix.B2400: 2400,
+	unix.B4800: 4800, unix.B9600: 9600, unix.B19200: 19200, unix.B38400: 38400,
+	unix.B57600: 57600, unix.B115200: 115200, unix.B230400: 230400, unix.B460800: 460800,
+	unix.B500000: 500000, unix.B576000: 576000, unix.B921600: 921600, unix.B1000000: 1000000,
+	unix.B1152000: 1152000, unix.B1500000: 1500000, unix.B2000000: 2000000,
+	unix.B2500000: 2500000, unix.B3000000: 3000000, unix.B3500000: 3500000,
+	unix.B4000000: 4000000,
+}
+
+// TerminalModesFromTermios returns the modes of a termios, all the opcodes supported by Linux
+// being present
+func TerminalModesFromTermios(termios *unix.Termios) TerminalModes {
+	modes := TerminalModes{}
+	for op, index := range terminalModeSpecialCharacters {
+		modes[op] = uint32(termios.Cc[index])
+	}
+	for op, flag := range terminalModeFlags(termios) {
+		modes[op] = 0
+		if *flag.flags&flag.mask != 0 {
+			modes[op] = 1
+		}
+	}
+	modes[CS7], modes[CS8] = 0, 0
+	switch termios.Cflag & unix.CSIZE {
+	case unix.CS7:
+		modes[CS7] = 1
+	case unix.CS8:
+		modes[CS8] = 1
+	}
+	if speed, ok := terminalBaudRates[termios.Cflag&unix.CBAUD]; ok {
+		// as for cfgetispeed, the input speed is the output one
+		modes[TTY_OP_ISPEED], modes[TTY_OP_OSPEED] = speed, speed
+	}
+	return modes
+}
+
+// GetTerminalModes captures the current modes of the terminal open at fd, e.g. the standard
+// input of the client
+func GetTerminalModes(fd int) (TerminalModes, error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	return TerminalModesFromTermios(termios), nil
+}
+
+// ApplyToTermios sets the modes on termios, the opcodes absent from modes or not supported by
+// Linux are left unchanged
+func (modes TerminalModes) ApplyToTermios(termios *unix.Termios) {
+	for op, index := range terminalModeSpecialCharacters {
+		if value, ok := modes[op]; ok {
+			termios.Cc[index] = uint8(value)
+		}
+	}
+	for op, flag := range terminalModeFlags(termios) {
+		if value, ok := modes[op]; ok {
+			if value != 0 {
+				*flag.flags |= flag.mask
+			} else {
+				*flag.flags &^= flag.mask
+			}
+		}
+	}
+	if modes[CS8] != 0 {
+		termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS8
+	} else if modes[CS7] != 0 {
+		termios.Cflag = termios.Cflag&^unix.CSIZE | unix.CS7
+	}
+	speed, ok := modes[TTY_OP_OSPEED]
+	if !ok {
+		speed, ok = modes[TTY_OP_ISPEED]
+	}
+	if ok {
+		for baud, rate := range terminalBaudRates {
+			if rate == speed {
+				termios.Cflag = termios.Cflag&^unix.CBAUD | baud
+				termios.Ispeed, termios.Ospeed = speed, speed
+			}
+		}
+	}
+}
+
+// SetTerminalModes applies modes to the terminal open at fd, e.g. the tty of a pty
+func SetTerminalModes(fd int, modes TerminalModes) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	modes.ApplyToTermios(termios)
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package message
+
+import (
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Terminal modes of a termios", func() {
+	It("Captures the special characters, flags and speed", func() {
+		termios := &unix.Termios{
+			Iflag: unix.ICRNL | unix.IUTF8,
+			Oflag: unix.OPOST | unix.ONLCR,
+			Cflag: unix.CS8 | unix.B9600,
+			Lflag: unix.ICANON | unix.ECHO,
+		}
+		termios.Cc[unix.VERASE] = 0x08
+		termios.Cc[unix.VINTR] = 0x03
+		modes := TerminalModesFromTermios(termios)
+		Expect(modes).To(HaveKeyWithValue(VERASE, BeEquivalentTo(0x08)))
+		Expect(modes).To(HaveKeyWithValue(VINTR, BeEquivalentTo(0x03)))
+		Expect(modes).To(HaveKeyWithValue(ICRNL, BeEquivalentTo(1)))
+		Expect(modes).To(HaveKeyWithValue(IXON, BeEquivalentTo(0)))
+		Expect(modes).To(HaveKeyWithValue(ECHO, BeEquivalentTo(1)))
+		Expect(modes).To(HaveKeyWithValue(ISIG, BeEquivalentTo(0)))
+		Expect(modes).To(HaveKeyWithValue(ONLCR, BeEquivalentTo(1)))
+		Expect(modes).To(HaveKeyWithValue(CS8, BeEquivalentTo(1)))
+		Expect(modes).To(HaveKeyWithValue(CS7, BeEquivalentTo(0)))
+		Expect(modes).To(HaveKeyWithValue(TTY_OP_ISPEED, BeEquivalentTo(9600)))
+		Expect(modes).To(HaveKeyWithValue(TTY_OP_OSPEED, BeEquivalentTo(9600)))
+	})
+
+	It("Applies the modes on a termios", func() {
+		termios := &unix.Termios{
+			Iflag: unix.IXON,
+			Cflag: unix.CS7 | unix.B9600,
+			Lflag: unix.ICANON | unix.ECHO,
+		}
+		termios.Cc[unix.VERASE] = 0x7f
+		termios.Cc[unix.VINTR] = 0x03
+		TerminalModes{VERASE: 0x08, ICRNL: 1, ECHO: 0, CS8: 1, TTY_OP_OSPEED: 38400}.ApplyToTermios(termios)
+		Expect(termios.Cc[unix.VERASE]).To(BeEquivalentTo(0x08))
+		Expect(termios.Iflag).To(Equal(uint32(unix.IXON | unix.ICRNL)))
+		Expect(termios.Lflag).To(Equal(uint32(unix.ICANON)))
+		Expect(termios.Cflag).To(Equal(uint32(unix.CS8 | unix.B38400)))
+
+		// the opcodes absent from the modes are left unchanged
+		Expect(termios.Cc[unix.VINTR]).To(BeEquivalentTo(0x03))
+		Expect(TerminalModesFromTermios(termios)).To(HaveKeyWithValue(IXON, BeEquivalentTo(1)))
+	})
+})
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package message
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// GetTerminalModes captures the current modes of the terminal open at fd, e.g. the standard
+// input of the client
+func GetTerminalModes(fd int) (TerminalModes, error) {
+	return nil, fmt.Errorf("capturing terminal modes is not implemented on %s", runtime.GOOS)
+}
+
+// SetTerminalModes applies modes to the terminal open at fd, e.g. the tty of a pty
+func SetTerminalModes(fd int, modes TerminalModes) error {
+	return fmt.Errorf("setting terminal modes is not implemented on %s", runtime.GOOS)
+}
@@ -0,0 +1,86 @@
+package message
+
+import (
+	"io"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// ProtocolVersion is the version of the wire format of the messages, negotiated when
+// establishing the conversation. The peers use the highest version that both implement, so
+// that a message gaining a field (e.g. a new varint) in a version is still sent in the format
+// known by the older peers.
+type ProtocolVersion uint64
+
+const (
+	// the wire format of the first releases, used with the peers that predate the negotiation
+	ProtocolVersion1 ProtocolVersion = 1
+
+	// the range of versions implemented by this package
+	MinProtocolVersion = ProtocolVersion1
+	MaxProtocolVersion = ProtocolVersion1
+)
+
+// VersionedMessage is implemented by the messages whose wire format depends on the protocol
+// version. Their Length and Write methods use MaxProtocolVersion.
+type VersionedMessage interface {
+	Message
+	LengthVersion(version ProtocolVersion) int
+	WriteVersion(buf []byte, version ProtocolVersion) (int, error)
+}
+
+// VersionedChannelRequest is implemented by the channel requests whose wire format depends on
+// the protocol version. Their Length and Write methods use MaxProtocolVersion.
+type VersionedChannelRequest interface {
+	ChannelRequest
+	LengthVersion(version ProtocolVersion) int
+	WriteVersion(buf []byte, version ProtocolVersion) (int, error)
+}
+
+// VersionedChannelRequestParseFuncs parse the channel requests whose wire format depends on the
+// protocol version, they take precedence over ChannelRequestParseFuncs
+var VersionedChannelRequestParseFuncs = map[string]func(util.Reader, ProtocolVersion) (ChannelRequest, error){}
+
+// MessageLength returns the length of m in the wire format of version
+func MessageLength(m Message, version ProtocolVersion) int {
+	if versioned, ok := m.(VersionedMessage); ok {
+		return versioned.LengthVersion(version)
+	}
+	return m.Length()
+}
+
+// WriteMessage writes m in the wire format of version
+func WriteMessage(buf []byte, m Message, version ProtocolVersion) (int, error) {
+	if versioned, ok := m.(VersionedMessage); ok {
+		return versioned.WriteVersion(buf, version)
+	}
+	return m.Write(buf)
+}
+
+func channelRequestLength(request ChannelRequest, version ProtocolVersion) int {
+	if versioned, ok := request.(VersionedChannelRequest); ok {
+		return versioned.LengthVersion(version)
+	}
+	return request.Length()
+}
+
+func writeChannelRequest(buf []byte, request ChannelRequest, version ProtocolVersion) (int, error) {
+	if versioned, ok := request.(VersionedChannelRequest); ok {
+		return versioned.WriteVersion(buf, version)
+	}
+	return request.Write(buf)
+}
+
+// ParseMessageVersion parses a message sent in the wire format of version
+func ParseMessageVersion(r util.Reader, version ProtocolVersion) (Message, error) {
+	r = newMessageReader(r)
+	typeId, err := util.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	message, err := parseMessageContent(typeId, r, version)
+	if err != nil && err != io.EOF {
+		return nil, InvalidMessage{MessageType: typeId, Reason: err}
+	}
+	return message, err
+}
@@ -0,0 +1,100 @@
+package message
+
+import (
+	"bytes"
+
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// a request gaining the Extra field in version 2
+type versionedTestRequest struct {
+	Value uint64
+	Extra uint64
+}
+
+func (r *versionedTestRequest) RequestTypeStr() string { return "versioned-test@ssh3" }
+func (r *versionedTestRequest) Length() int            { return r.LengthVersion(MaxProtocolVersion) }
+func (r *versionedTestRequest) Write(buf []byte) (int, error) {
+	return r.WriteVersion(buf, MaxProtocolVersion)
+}
+
+func (r *versionedTestRequest) LengthVersion(version ProtocolVersion) int {
+	if version < 2 {
+		return int(util.VarIntLen(r.Value))
+	}
+	return int(util.VarIntLen(r.Value) + util.VarIntLen(r.Extra))
+}
+
+func (r *versionedTestRequest) WriteVersion(buf []byte, version ProtocolVersion) (int, error) {
+	encoded := util.AppendVarInt(nil, r.Value)
+	if version >= 2 {
+		encoded = util.AppendVarInt(encoded, r.Extra)
+	}
+	return copy(buf, encoded), nil
+}
+
+func parseVersionedTestRequest(buf util.Reader, version ProtocolVersion) (ChannelRequest, error) {
+	r := &versionedTestRequest{}
+	var err error
+	if r.Value, err = util.ReadVarInt(buf); err != nil {
+		return nil, err
+	}
+	if version >= 2 {
+		if r.Extra, err = util.ReadVarInt(buf); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+var _ = Describe("Protocol versions", func() {
+	BeforeEach(func() {
+		VersionedChannelRequestParseFuncs["versioned-test@ssh3"] = parseVersionedTestRequest
+		DeferCleanup(func() { delete(VersionedChannelRequestParseFuncs, "versioned-test@ssh3") })
+	})
+
+	encode := func(version ProtocolVersion, messages ...Message) []byte {
+		var encoded []byte
+		for _, m := range messages {
+			buf := make([]byte, MessageLength(m, version))
+			n, err := WriteMessage(buf, m, version)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(buf)))
+			encoded = append(encoded, buf...)
+		}
+		return encoded
+	}
+
+	It("Omits the fields introduced after the negotiated version", func() {
+		request := &ChannelRequestMessage{WantReply: true, ChannelRequest: &versionedTestRequest{Value: 42, Extra: 1000}}
+		data := &DataOrExtendedDataMessage{DataType: SSH_EXTENDED_DATA_NONE, Data: "next"}
+		reader := util.NewReader(bytes.NewReader(encode(1, request, data)))
+
+		parsed, err := ParseMessageVersion(reader, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed).To(Equal(&ChannelRequestMessage{WantReply: true, ChannelRequest: &versionedTestRequest{Value: 42}}))
+		// the stream stays in sync with the peer
+		parsed, err = ParseMessageVersion(reader, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed).To(Equal(data))
+	})
+
+	It("Sends the fields of the negotiated version", func() {
+		request := &ChannelRequestMessage{ChannelRequest: &versionedTestRequest{Value: 42, Extra: 1000}}
+		parsed, err := ParseMessageVersion(util.NewReader(bytes.NewReader(encode(2, request))), 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed).To(Equal(request))
+	})
+
+	It("Encodes the unversioned messages identically in every version", func() {
+		exec := &ChannelRequestMessage{ChannelRequest: &ExecRequest{Command: "ls"}}
+		Expect(encode(1, exec)).To(Equal(encode(MaxProtocolVersion, exec)))
+		buf := make([]byte, exec.Length())
+		_, err := exec.Write(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(encode(1, exec)).To(Equal(buf))
+	})
+})
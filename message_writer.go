@@ -0,0 +1,176 @@
+package ssh3
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	ssh3 "github.com/francoismichel/ssh3/message"
+)
+
+// MessageWriter writes the messages of a channel on its stream. It is safe for concurrent use:
+// each call writes its messages at once, so that the messages of concurrent senders (e.g. a
+// window change racing with data) are never interleaved nor torn.
+type MessageWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	// the wire format of the messages
+	version ssh3.ProtocolVersion
+	// the channel header, written before the first message
+	header []byte
+	// called for each message, with the number of bytes written and whether the message was
+	// written entirely
+	onSent func(m ssh3.Message, n int, complete bool)
+	// whether onSent needs the messages written by WriteData, they are otherwise passed as nil to
+	// avoid copying their data
+	traceData bool
+	// the vectors of the data messages, kept to write them without allocating
+	vectors [2][]byte
+	buffers net.Buffers
+}
+
+// the buffers in which the messages are encoded, shared by all the writers
+var messageBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// larger buffers are not pooled, so that a few large messages do not keep the memory in use
+const maxPooledBufferSize = 64 << 10
+
+// returns a buffer of length bytes, to be released with putMessageBuffer
+func getMessageBuffer(length int) *[]byte {
+	buf := messageBuffers.Get().(*[]byte)
+	if cap(*buf) < length {
+		*buf = make([]byte, length)
+	}
+	*buf = (*buf)[:length]
+	return buf
+}
+
+func putMessageBuffer(buf *[]byte) {
+	if cap(*buf) <= maxPooledBufferSize {
+		messageBuffers.Put(buf)
+	}
+}
+
+// NewMessageWriter returns a writer using the wire format of ssh3.MaxProtocolVersion, the
+// channels use the version negotiated by their conversation
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{w: w, version: ssh3.MaxProtocolVersion}
+}
+
+// WriteMessage writes m, see WriteMessages
+func (w *MessageWriter) WriteMessage(m ssh3.Message) (int, error) {
+	return w.WriteMessages(m)
+}
+
+// WriteMessages encodes the messages in a single buffer, written at once so that no other
+// message is written in between. It returns the number of bytes written, channel header
+// excluded.
+func (w *MessageWriter) WriteMessages(messages ...ssh3.Message) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ends := make([]int, len(messages))
+	length := 0
+	for i, m := range messages {
+		length += ssh3.MessageLength(m, w.version)
+		ends[i] = length
+	}
+	pooled := getMessageBuffer(length)
+	defer putMessageBuffer(pooled)
+	buf := *pooled
+	start := 0
+	for i, m := range messages {
+		if _, err := ssh3.WriteMessage(buf[start:ends[i]], m, w.version); err != nil {
+			return 0, err
+		}
+		start = ends[i]
+	}
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(buf)
+	if w.onSent != nil {
+		start := 0
+		for i, end := range ends {
+			if end > n {
+				w.onSent(messages[i], n-start, false)
+				break
+			}
+			w.onSent(messages[i], end-start, true)
+			start = end
+		}
+	}
+	return n, err
+}
+
+// WriteData writes a data message carrying data without copying it: the header of the message
+// and data are written with a single vectored write (see net.Buffers), i.e. a writev(2) on the
+// connections supporting it and two writes on the QUIC streams. It returns the number of bytes
+// written, channel header excluded.
+func (w *MessageWriter) WriteData(dataType ssh3.SSHDataType, data []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	pooled := getMessageBuffer(0)
+	defer putMessageBuffer(pooled)
+	header := ssh3.AppendDataHeader(*pooled, dataType, len(data))
+	*pooled = header
+	if err := w.writeHeader(); err != nil {
+		return 0, err
+	}
+	w.vectors = [2][]byte{header, data}
+	w.buffers = w.vectors[:]
+	written, err := w.buffers.WriteTo(w.w)
+	// does not retain the data of the caller if the write failed
+	w.vectors = [2][]byte{}
+	n := int(written)
+	if w.onSent != nil {
+		var m ssh3.Message
+		if w.traceData {
+			m = &ssh3.DataOrExtendedDataMessage{DataType: dataType, Data: string(data)}
+		}
+		w.onSent(m, n, n == len(header)+len(data))
+	}
+	return n, err
+}
+
+// ProtocolVersion returns the version of the wire format of the messages
+func (w *MessageWriter) ProtocolVersion() ssh3.ProtocolVersion {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.version
+}
+
+func (w *MessageWriter) setProtocolVersion(version ssh3.ProtocolVersion) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.version = version
+}
+
+func (w *MessageWriter) setTraceData(traceData bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.traceData = traceData
+}
+
+// WriteHeader writes the channel header if it has not been written yet
+func (w *MessageWriter) WriteHeader() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writeHeader()
+}
+
+// the lock must be held
+func (w *MessageWriter) writeHeader() error {
+	for len(w.header) > 0 {
+		n, err := w.w.Write(w.header)
+		w.header = w.header[n:]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writes one byte at a time, yielding in between so that unserialized writers interleave
+type bytewiseWriter struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (w *bytewiseWriter) Write(p []byte) (int, error) {
+	for i := range p {
+		w.lock.Lock()
+		w.buf.WriteByte(p[i])
+		w.lock.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func parseAll(buf []byte) []ssh3Messages.Message {
+	reader := util.NewReader(bytes.NewReader(buf))
+	var messages []ssh3Messages.Message
+	for {
+		message, err := ssh3Messages.ParseMessage(reader)
+		if errors.Is(err, io.EOF) {
+			return messages
+		}
+		Expect(err).ToNot(HaveOccurred())
+		messages = append(messages, message)
+	}
+}
+
+var _ = Describe("Message writer", func() {
+	It("Never interleaves the messages of concurrent writers", func() {
+		destination := &bytewiseWriter{}
+		writer := ssh3.NewMessageWriter(destination)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, err := writer.WriteMessage(&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "some data"})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, err := writer.WriteMessage(&ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.WindowChangeRequest{CharWidth: 80, CharHeight: 24}})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}()
+		}
+		wg.Wait()
+		messages := parseAll(destination.buf.Bytes())
+		Expect(messages).To(HaveLen(160))
+		for _, message := range messages {
+			Expect(message).To(SatisfyAny(
+				Equal(&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "some data"}),
+				Equal(&ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.WindowChangeRequest{CharWidth: 80, CharHeight: 24}}),
+			))
+		}
+	})
+
+	It("Writes several messages at once", func() {
+		var destination bytes.Buffer
+		writer := ssh3.NewMessageWriter(&destination)
+		first := &ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_STDERR, Data: "bye"}
+		second := &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: 1}}
+		n, err := writer.WriteMessages(first, second)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(first.Length() + second.Length()))
+		Expect(parseAll(destination.Bytes())).To(Equal([]ssh3Messages.Message{first, second}))
+	})
+
+	It("Writes the data without copying it in a message", func() {
+		var destination bytes.Buffer
+		writer := ssh3.NewMessageWriter(&destination)
+		data := bytes.Repeat([]byte("data"), 10000)
+		n, err := writer.WriteData(ssh3Messages.SSH_EXTENDED_DATA_STDERR, data)
+		Expect(err).ToNot(HaveOccurred())
+		expected := &ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_STDERR, Data: string(data)}
+		Expect(n).To(Equal(expected.Length()))
+		Expect(parseAll(destination.Bytes())).To(Equal([]ssh3Messages.Message{expected}))
+	})
+
+	It("Never interleaves the data with the messages of concurrent writers", func() {
+		destination := &bytewiseWriter{}
+		writer := ssh3.NewMessageWriter(destination)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, err := writer.WriteData(ssh3Messages.SSH_EXTENDED_DATA_NONE, []byte("some data"))
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					_, err := writer.WriteMessage(&ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.WindowChangeRequest{CharWidth: 80, CharHeight: 24}})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(parseAll(destination.buf.Bytes())).To(HaveLen(160))
+	})
+
+	It("Reuses its buffers", func() {
+		writer := ssh3.NewMessageWriter(io.Discard)
+		data := make([]byte, 1200)
+		message := &ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: string(data)}
+		// warms the pool up
+		_, err := writer.WriteMessage(message)
+		Expect(err).ToNot(HaveOccurred())
+		// the only allocations left are the message ends and the variadic arguments, not the
+		// encoded messages
+		Expect(testing.AllocsPerRun(100, func() { writer.WriteMessage(message) })).To(BeNumerically("<=", 2))
+		Expect(testing.AllocsPerRun(100, func() { writer.WriteData(ssh3Messages.SSH_EXTENDED_DATA_NONE, data) })).To(BeZero())
+	})
+})
@@ -0,0 +1,7 @@
+package ssh3
+
+// FeatureMultipleSessions is the ExtInfo feature of the peers running several session channels
+// in a conversation, one after the other or concurrently. The servers advertising it keep the
+// conversations of the clients advertising it once a session ends, these clients closing the
+// conversation themselves. The older servers end the conversation along with its first session.
+const FeatureMultipleSessions = "multiple-sessions"
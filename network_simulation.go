@@ -0,0 +1,295 @@
+package ssh3
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NetworkConditions describes the network simulated by a SimulatedPacketConn, so that the
+// terminal features depending on the latency (e.g. the keystroke batching) can be developed and
+// demoed reproducibly without netem
+type NetworkConditions struct {
+	// the delay added to the packets in each direction: the round-trip time grows by twice
+	// the latency
+	Latency time.Duration
+	// the maximum random variation of the latency of each packet, so packets can be reordered
+	Jitter time.Duration
+	// the probability to drop a packet in each direction, between 0 and 1
+	Loss float64
+	// the throughput in each direction in bits per second, 0 if unlimited
+	Bandwidth uint64
+	// the seed of the jitter and the losses, so that a run can be replayed, random if 0
+	Seed int64
+}
+
+var bandwidthUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}}
+
+// ParseNetworkConditions parses comma-separated conditions, e.g.
+// "latency=100ms,jitter=20ms,loss=1%,bandwidth=2mbit,seed=42"
+func ParseNetworkConditions(s string) (NetworkConditions, error) {
+	var conditions NetworkConditions
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return NetworkConditions{}, fmt.Errorf("invalid network condition %q: expected key=value", field)
+		}
+		var err error
+		switch key {
+		case "latency":
+			conditions.Latency, err = time.ParseDuration(value)
+			if err == nil && conditions.Latency < 0 {
+				err = fmt.Errorf("negative latency")
+			}
+		case "jitter":
+			conditions.Jitter, err = time.ParseDuration(value)
+			if err == nil && conditions.Jitter < 0 {
+				err = fmt.Errorf("negative jitter")
+			}
+		case "loss":
+			if percent, isPercent := strings.CutSuffix(value, "%"); isPercent {
+				conditions.Loss, err = strconv.ParseFloat(percent, 64)
+				conditions.Loss /= 100
+			} else {
+				conditions.Loss, err = strconv.ParseFloat(value, 64)
+			}
+			if err == nil && (conditions.Loss < 0 || conditions.Loss > 1) {
+				err = fmt.Errorf("loss out of range")
+			}
+		case "bandwidth":
+			conditions.Bandwidth, err = parseBandwidth(value)
+		case "seed":
+			conditions.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown network condition")
+		}
+		if err != nil {
+			return NetworkConditions{}, fmt.Errorf("invalid network condition %q: %w", field, err)
+		}
+	}
+	return conditions, nil
+}
+
+// parses a bandwidth such as "2mbit" or "512kbit"
+func parseBandwidth(value string) (uint64, error) {
+	lower := strings.ToLower(value)
+	for _, unit := range bandwidthUnits {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			bandwidth, err := strconv.ParseFloat(number, 64)
+			if err != nil || bandwidth <= 0 {
+				return 0, fmt.Errorf("invalid bandwidth %q", value)
+			}
+			return uint64(bandwidth * float64(unit.multiplier)), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid bandwidth %q: expected a unit among gbit, mbit, kbit and bit", value)
+}
+
+func (c NetworkConditions) String() string {
+	return fmt.Sprintf("latency=%s,jitter=%s,loss=%g%%,bandwidth=%dbit,seed=%d", c.Latency, c.Jitter, c.Loss*100, c.Bandwidth, c.Seed)
+}
+
+type simulatedPacket struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// SimulatedPacketConn delays and drops the packets sent and received on a PacketConn
+// according to its NetworkConditions
+type SimulatedPacketConn struct {
+	net.PacketConn
+	conditions NetworkConditions
+
+	lock sync.Mutex
+	rng  *rand.Rand
+	// when the packets queued in each direction are transmitted, to limit the bandwidth
+	sendQueueEnd    time.Time
+	receiveQueueEnd time.Time
+	readDeadline    time.Time
+	// closed when the read deadline changes, to wake up the blocked readers
+	deadlineChanged chan struct{}
+
+	received  chan simulatedPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.PacketConn = &SimulatedPacketConn{}
+
+// NewSimulatedPacketConn wraps conn, which must not be read by others from now on
+func NewSimulatedPacketConn(conn net.PacketConn, conditions NetworkConditions) *SimulatedPacketConn {
+	seed := conditions.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := &SimulatedPacketConn{
+		PacketConn:      conn,
+		conditions:      conditions,
+		rng:             rand.New(rand.NewSource(seed)),
+		deadlineChanged: make(chan struct{}),
+		received:        make(chan simulatedPacket, 1024),
+		closed:          make(chan struct{}),
+	}
+	go c.receiveLoop()
+	return c
+}
+
+// returns whether the packet is lost and when it arrives otherwise, must be called with the
+// lock held
+func (c *SimulatedPacketConn) transmit(size int, queueEnd *time.Time) (lost bool, delay time.Duration) {
+	if c.conditions.Loss > 0 && c.rng.Float64() < c.conditions.Loss {
+		return true, 0
+	}
+	now := time.Now()
+	delay = c.conditions.Latency
+	if c.conditions.Jitter > 0 {
+		delay += time.Duration(c.rng.Int63n(2*int64(c.conditions.Jitter)+1)) - c.conditions.Jitter
+		delay = max(delay, 0)
+	}
+	if c.conditions.Bandwidth > 0 {
+		start := now
+		if queueEnd.After(now) {
+			start = *queueEnd
+		}
+		*queueEnd = start.Add(time.Duration(uint64(size) * 8 * uint64(time.Second) / c.conditions.Bandwidth))
+		delay += queueEnd.Sub(now)
+	}
+	return false, delay
+}
+
+func (c *SimulatedPacketConn) receiveLoop() {
+	for {
+		buf := make([]byte, 64<<10)
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case c.received <- simulatedPacket{err: err}:
+			case <-c.closed:
+			}
+			return
+		}
+		c.lock.Lock()
+		lost, delay := c.transmit(n, &c.receiveQueueEnd)
+		c.lock.Unlock()
+		if lost {
+			continue
+		}
+		packet := simulatedPacket{data: buf[:n], addr: addr}
+		time.AfterFunc(delay, func() {
+			select {
+			case c.received <- packet:
+			case <-c.closed:
+			}
+		})
+	}
+}
+
+func (c *SimulatedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+		c.lock.Lock()
+		deadline, deadlineChanged := c.readDeadline, c.deadlineChanged
+		c.lock.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			if !time.Now().Before(deadline) {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case packet := <-c.received:
+			if timer != nil {
+				timer.Stop()
+			}
+			if packet.err != nil {
+				return 0, nil, packet.err
+			}
+			return copy(p, packet.data), packet.addr, nil
+		case <-timeout:
+		case <-deadlineChanged:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+func (c *SimulatedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.lock.Lock()
+	lost, delay := c.transmit(len(p), &c.sendQueueEnd)
+	c.lock.Unlock()
+	if lost {
+		return len(p), nil
+	}
+	if delay == 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	data := append([]byte(nil), p...)
+	time.AfterFunc(delay, func() {
+		// the errors of the delayed packets are the ones of a lossy network
+		_, _ = c.PacketConn.WriteTo(data, addr)
+	})
+	return len(p), nil
+}
+
+func (c *SimulatedPacketConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (c *SimulatedPacketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+func (c *SimulatedPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.PacketConn.Close()
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection, e.g. of a *net.UDPConn
+func (c *SimulatedPacketConn) SetReadBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("cannot set the receive buffer of a %T", c.PacketConn)
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the send buffer of the wrapped connection, e.g. of a *net.UDPConn
+func (c *SimulatedPacketConn) SetWriteBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("cannot set the send buffer of a %T", c.PacketConn)
+	}
+	return conn.SetWriteBuffer(bytes)
+}
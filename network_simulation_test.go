@@ -0,0 +1,113 @@
+package ssh3_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network simulation", func() {
+	Context("Parsing the conditions", func() {
+		It("Parses all the conditions", func() {
+			conditions, err := ssh3.ParseNetworkConditions("latency=100ms, jitter=20ms,loss=1.5%,bandwidth=2Mbit,seed=42")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conditions).To(Equal(ssh3.NetworkConditions{
+				Latency:   100 * time.Millisecond,
+				Jitter:    20 * time.Millisecond,
+				Loss:      0.015,
+				Bandwidth: 2e6,
+				Seed:      42,
+			}))
+
+			conditions, err = ssh3.ParseNetworkConditions("loss=0.5,bandwidth=512kbit")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conditions).To(Equal(ssh3.NetworkConditions{Loss: 0.5, Bandwidth: 512e3}))
+		})
+
+		It("Rejects the invalid conditions", func() {
+			for _, invalid := range []string{"", "latency", "latency=-1s", "latency=fast", "loss=150%", "bandwidth=2mb", "bandwidth=0bit", "mtu=1200"} {
+				_, err := ssh3.ParseNetworkConditions(invalid)
+				Expect(err).To(HaveOccurred(), invalid)
+			}
+		})
+	})
+
+	Context("Simulated connections", func() {
+		var sender, receiver net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			sender, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			receiver, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(func() {
+				sender.Close()
+				receiver.Close()
+			})
+		})
+
+		// sends count packets of size bytes and returns how long it took to receive them
+		transfer := func(count int, size int) time.Duration {
+			start := time.Now()
+			for i := 0; i < count; i++ {
+				_, err := sender.WriteTo(make([]byte, size), receiver.LocalAddr())
+				Expect(err).ToNot(HaveOccurred())
+			}
+			buf := make([]byte, 2048)
+			for i := 0; i < count; i++ {
+				Expect(receiver.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+				n, _, err := receiver.ReadFrom(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(size))
+			}
+			return time.Since(start)
+		}
+
+		It("Delays the packets sent", func() {
+			sender = ssh3.NewSimulatedPacketConn(sender, ssh3.NetworkConditions{Latency: 100 * time.Millisecond})
+			Expect(transfer(1, 100)).To(BeNumerically(">=", 100*time.Millisecond))
+		})
+
+		It("Delays the packets received", func() {
+			receiver = ssh3.NewSimulatedPacketConn(receiver, ssh3.NetworkConditions{Latency: 100 * time.Millisecond})
+			Expect(transfer(1, 100)).To(BeNumerically(">=", 100*time.Millisecond))
+		})
+
+		It("Limits the bandwidth", func() {
+			// 10 packets of 1000 bytes at 800 kbit/s take 10ms each
+			sender = ssh3.NewSimulatedPacketConn(sender, ssh3.NetworkConditions{Bandwidth: 800e3})
+			Expect(transfer(10, 1000)).To(BeNumerically(">=", 100*time.Millisecond))
+		})
+
+		It("Drops the packets", func() {
+			sender = ssh3.NewSimulatedPacketConn(sender, ssh3.NetworkConditions{Loss: 1})
+			_, err := sender.WriteTo([]byte("lost"), receiver.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))).To(Succeed())
+			_, _, err = receiver.ReadFrom(make([]byte, 16))
+			Expect(errors.Is(err, os.ErrDeadlineExceeded)).To(BeTrue())
+		})
+
+		It("Unblocks the reads when the read deadline changes", func() {
+			receiver = ssh3.NewSimulatedPacketConn(receiver, ssh3.NetworkConditions{Latency: time.Second})
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(50 * time.Millisecond)
+				Expect(receiver.SetReadDeadline(time.Now())).To(Succeed())
+			}()
+			_, _, err := receiver.ReadFrom(make([]byte, 16))
+			Expect(errors.Is(err, os.ErrDeadlineExceeded)).To(BeTrue())
+
+			Expect(receiver.Close()).To(Succeed())
+			_, _, err = receiver.ReadFrom(make([]byte, 16))
+			Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+		})
+	})
+})
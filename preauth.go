@@ -0,0 +1,94 @@
+package ssh3
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// PreauthTokenPrefix prefixes the pre-authorization tokens, telling them apart from the JWTs
+// verified using the authorized identities
+const PreauthTokenPrefix = "ssh3-preauth-"
+
+const preauthIssuer = "ssh3-preauth"
+
+type InvalidPreauthToken struct {
+	Reason string
+}
+
+func (e InvalidPreauthToken) Error() string {
+	return fmt.Sprintf("invalid pre-authorization token: %s", e.Reason)
+}
+
+// NewPreauthToken returns a token authenticating username on the servers named host that trust
+// the public key of signer, until ttl elapses. Unlike the tokens of the authorized identities,
+// it is not bound to a conversation: it can be issued on a connected machine and carried to a
+// client that cannot reach the identity provider, and it can be used several times.
+func NewPreauthToken(signer crypto.Signer, username string, host string, ttl time.Duration, now time.Time) (string, error) {
+	signingMethod, err := util.JWTSigningMethodFromCryptoPubkey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	// identifies the token in the audit log of the server
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(signingMethod, jwt.RegisteredClaims{
+		Issuer:    preauthIssuer,
+		Subject:   username,
+		Audience:  jwt.ClaimStrings{host},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+	})
+	signedString, err := token.SignedString(signer)
+	if err != nil {
+		return "", fmt.Errorf("could not sign token: %w", err)
+	}
+	return PreauthTokenPrefix + signedString, nil
+}
+
+// VerifyPreauthToken checks that token has been signed using one of the keys for username on
+// host, and that it was issued for at most maxLifetime. It returns the claims of the token.
+func VerifyPreauthToken(token string, keys []crypto.PublicKey, username string, host string, maxLifetime time.Duration, now time.Time) (*jwt.RegisteredClaims, error) {
+	signedString, ok := strings.CutPrefix(token, PreauthTokenPrefix)
+	if !ok {
+		return nil, InvalidPreauthToken{Reason: "missing prefix"}
+	}
+	for _, key := range keys {
+		claims := &jwt.RegisteredClaims{}
+		_, err := jwt.ParseWithClaims(signedString, claims, func(unvalidatedToken *jwt.Token) (interface{}, error) {
+			return key, nil
+		},
+			jwt.WithIssuer(preauthIssuer),
+			jwt.WithSubject(username),
+			jwt.WithAudience(host),
+			jwt.WithIssuedAt(),
+			jwt.WithTimeFunc(func() time.Time { return now }),
+			jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
+		if errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, jwt.ErrTokenUnverifiable) {
+			// signed by another key
+			continue
+		} else if err != nil {
+			return nil, InvalidPreauthToken{Reason: err.Error()}
+		}
+		if claims.ExpiresAt == nil || claims.IssuedAt == nil {
+			return nil, InvalidPreauthToken{Reason: "the token does not expire"}
+		}
+		if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime > maxLifetime {
+			return nil, InvalidPreauthToken{Reason: fmt.Sprintf("lifetime of %s exceeding the maximum of %s", lifetime, maxLifetime)}
+		}
+		return claims, nil
+	}
+	return nil, InvalidPreauthToken{Reason: "not signed by any verification key"}
+}
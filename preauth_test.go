@@ -0,0 +1,71 @@
+package ssh3_test
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pre-authorization tokens", func() {
+	var signer crypto.Signer
+	var keys []crypto.PublicKey
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		signer = key
+		// the first key does not sign the token
+		otherPubkey, _, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		keys = []crypto.PublicKey{otherPubkey, signer.Public()}
+	})
+
+	It("Authenticates the user on the host until the token expires", func() {
+		token, err := ssh3.NewPreauthToken(signer, "alice", "lab", 2*time.Hour, now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(HavePrefix(ssh3.PreauthTokenPrefix))
+
+		claims, err := ssh3.VerifyPreauthToken(token, keys, "alice", "lab", 24*time.Hour, now.Add(time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(claims.ID).ToNot(BeEmpty())
+
+		_, err = ssh3.VerifyPreauthToken(token, keys, "alice", "lab", 24*time.Hour, now.Add(3*time.Hour))
+		Expect(err).To(BeAssignableToTypeOf(ssh3.InvalidPreauthToken{}))
+	})
+
+	It("Refuses the tokens of other users and hosts", func() {
+		token, err := ssh3.NewPreauthToken(signer, "alice", "lab", time.Hour, now)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ssh3.VerifyPreauthToken(token, keys, "bob", "lab", 24*time.Hour, now)
+		Expect(err).To(HaveOccurred())
+		_, err = ssh3.VerifyPreauthToken(token, keys, "alice", "prod", 24*time.Hour, now)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Refuses the tokens outliving the maximum lifetime", func() {
+		token, err := ssh3.NewPreauthToken(signer, "alice", "lab", 48*time.Hour, now)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ssh3.VerifyPreauthToken(token, keys, "alice", "lab", 24*time.Hour, now)
+		Expect(err).To(MatchError(ContainSubstring("exceeding the maximum")))
+	})
+
+	It("Refuses the tokens signed by unknown keys", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		token, err := ssh3.NewPreauthToken(rsaKey, "alice", "lab", time.Hour, now)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = ssh3.VerifyPreauthToken(token, keys, "alice", "lab", 24*time.Hour, now)
+		Expect(err).To(MatchError(ContainSubstring("not signed by any verification key")))
+
+		_, err = ssh3.VerifyPreauthToken(token, []crypto.PublicKey{rsaKey.Public()}, "alice", "lab", 24*time.Hour, now)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
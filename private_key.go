@@ -0,0 +1,444 @@
+package ssh3
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseRawPrivateKey parses the private keys supported by ParseRawPrivateKeyWithPassphrase. If
+// the private key is encrypted, it returns an ssh.PassphraseMissingError, whose PublicKey is
+// nil for the PKCS#8 keys.
+func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, &ssh.PassphraseMissingError{}
+	}
+	if block != nil && block.Type == "OPENSSH PRIVATE KEY" {
+		// the ssh package cannot parse the keys encrypted using the AEAD ciphers
+		if container, ok := parseOpenSSHPrivateKeyContainer(block.Bytes); ok && container.CipherName != "none" {
+			err := &ssh.PassphraseMissingError{}
+			err.PublicKey, _ = ssh.ParsePublicKey(container.PubKey)
+			return nil, err
+		}
+	}
+	return ssh.ParseRawPrivateKey(pemBytes)
+}
+
+// ParseRawPrivateKeyWithPassphrase parses the private keys supported by
+// ssh.ParseRawPrivateKeyWithPassphrase, the OpenSSH keys encrypted using any of the ciphers of
+// ssh-keygen -Z and the encrypted PKCS#8 keys. If the passphrase is wrong, it returns
+// x509.IncorrectPasswordError.
+func ParseRawPrivateKeyWithPassphrase(pemBytes []byte, passphrase []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("ssh3: no key found")
+	}
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		return parseEncryptedPKCS8PrivateKey(block.Bytes, passphrase)
+	case "OPENSSH PRIVATE KEY":
+		decrypted, err := decryptOpenSSHPrivateKey(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if decrypted != nil {
+			return ssh.ParseRawPrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: decrypted}))
+		}
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+}
+
+// the magic string starting the OpenSSH private keys, see PROTOCOL.key in OpenSSH
+const openSSHPrivateKeyMagic = "openssh-key-v1\x00"
+
+type openSSHPrivateKeyContainer struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+	// the authentication tag of the AEAD ciphers follows the private key block
+	Rest []byte `ssh:"rest"`
+}
+
+// the ciphers of the OpenSSH private keys, with their key, IV and authentication tag lengths
+var openSSHKeyCiphers = map[string]struct{ keyLen, ivLen, tagLen int }{
+	"aes128-ctr":                    {16, aes.BlockSize, 0},
+	"aes192-ctr":                    {24, aes.BlockSize, 0},
+	"aes256-ctr":                    {32, aes.BlockSize, 0},
+	"aes128-cbc":                    {16, aes.BlockSize, 0},
+	"aes192-cbc":                    {24, aes.BlockSize, 0},
+	"aes256-cbc":                    {32, aes.BlockSize, 0},
+	"aes128-gcm@openssh.com":        {16, 12, 16},
+	"aes256-gcm@openssh.com":        {32, 12, 16},
+	"chacha20-poly1305@openssh.com": {64, 0, 16},
+}
+
+func parseOpenSSHPrivateKeyContainer(data []byte) (*openSSHPrivateKeyContainer, bool) {
+	if !bytes.HasPrefix(data, []byte(openSSHPrivateKeyMagic)) {
+		return nil, false
+	}
+	var container openSSHPrivateKeyContainer
+	if err := ssh.Unmarshal(data[len(openSSHPrivateKeyMagic):], &container); err != nil {
+		return nil, false
+	}
+	return &container, true
+}
+
+// decrypts the OpenSSH private keys whose cipher is not supported by the ssh package, and
+// returns them unencrypted in the same format. Returns nil if the ssh package supports the key.
+func decryptOpenSSHPrivateKey(data []byte, passphrase []byte) ([]byte, error) {
+	container, ok := parseOpenSSHPrivateKeyContainer(data)
+	if !ok {
+		return nil, nil
+	}
+	// the ones of ssh.ParseRawPrivateKeyWithPassphrase
+	if container.CipherName == "none" || container.CipherName == "aes256-ctr" || container.CipherName == "aes256-cbc" {
+		return nil, nil
+	}
+	params, ok := openSSHKeyCiphers[container.CipherName]
+	if !ok {
+		return nil, fmt.Errorf("ssh3: unknown cipher %q", container.CipherName)
+	}
+	if container.KdfName != "bcrypt" {
+		return nil, fmt.Errorf("ssh3: unknown KDF %q, only supports %q", container.KdfName, "bcrypt")
+	}
+	var kdfOpts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	if err := ssh.Unmarshal([]byte(container.KdfOpts), &kdfOpts); err != nil {
+		return nil, err
+	}
+	if len(container.Rest) < params.tagLen {
+		return nil, errors.New("ssh3: missing authentication tag of the private key")
+	}
+	derived := bcryptPBKDF(passphrase, kdfOpts.Salt, int(kdfOpts.Rounds), params.keyLen+params.ivLen)
+	key, iv := derived[:params.keyLen], derived[params.keyLen:]
+	encrypted := container.PrivKeyBlock
+	tag := container.Rest[:params.tagLen]
+	var privKeyBlock []byte
+	switch container.CipherName {
+	case "chacha20-poly1305@openssh.com":
+		// as the SSH transport, with the sequence number 0 as nonce and without the length
+		stream, err := chacha20.NewUnauthenticatedCipher(key[:32], make([]byte, chacha20.NonceSize))
+		if err != nil {
+			return nil, err
+		}
+		var polyKey [32]byte
+		stream.XORKeyStream(polyKey[:], polyKey[:])
+		if !poly1305.Verify((*[16]byte)(tag), encrypted, &polyKey) {
+			return nil, x509.IncorrectPasswordError
+		}
+		stream.SetCounter(1)
+		privKeyBlock = make([]byte, len(encrypted))
+		stream.XORKeyStream(privKeyBlock, encrypted)
+	default:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		privKeyBlock = make([]byte, len(encrypted))
+		switch container.CipherName[len(container.CipherName)-3:] {
+		case "ctr":
+			cipher.NewCTR(block, iv).XORKeyStream(privKeyBlock, encrypted)
+		case "cbc":
+			if len(encrypted)%aes.BlockSize != 0 {
+				return nil, errors.New("ssh3: invalid encrypted private key length, not a multiple of the block size")
+			}
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(privKeyBlock, encrypted)
+		default:
+			gcm, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, err
+			}
+			privKeyBlock, err = gcm.Open(nil, iv, append(encrypted[:len(encrypted):len(encrypted)], tag...), nil)
+			if err != nil {
+				return nil, x509.IncorrectPasswordError
+			}
+		}
+	}
+	// the two check integers starting the decrypted block are equal
+	if len(privKeyBlock) < 8 || !bytes.Equal(privKeyBlock[:4], privKeyBlock[4:8]) {
+		return nil, x509.IncorrectPasswordError
+	}
+	container.CipherName, container.KdfName, container.KdfOpts = "none", "none", ""
+	container.PrivKeyBlock, container.Rest = privKeyBlock, nil
+	return append([]byte(openSSHPrivateKeyMagic), ssh.Marshal(container)...), nil
+}
+
+// the bcrypt_pbkdf of OpenSSH deriving the keys of the private keys from their passphrase
+func bcryptPBKDF(password, salt []byte, rounds, keyLen int) []byte {
+	const blockSize = 32
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+	h := sha512.New()
+	h.Write(password)
+	shaPassword := h.Sum(nil)
+	counter := make([]byte, 4)
+	tmp := make([]byte, blockSize)
+	for block := 1; block <= numBlocks; block++ {
+		h.Reset()
+		h.Write(salt)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		h.Write(counter)
+		bcryptHash(tmp, shaPassword, h.Sum(nil))
+		out := make([]byte, blockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			bcryptHash(tmp, shaPassword, h.Sum(nil))
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+		// the output blocks are interleaved
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+	return key[:keyLen]
+}
+
+func bcryptHash(out, shaPassword, shaSalt []byte) {
+	c, err := blowfish.NewSaltedCipher(shaPassword, shaSalt)
+	if err != nil {
+		// the SHA-512 hashes are valid keys
+		panic(err)
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shaSalt, c)
+		blowfish.ExpandKey(shaPassword, c)
+	}
+	copy(out, "OxychromaticBlowfishSwatDynamite")
+	for i := 0; i < 32; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// the words are little-endian in OpenSSH
+	for i := 0; i < 32; i += 4 {
+		out[i+3], out[i+2], out[i+1], out[i] = out[i], out[i+1], out[i+2], out[i+3]
+	}
+}
+
+// the OIDs of the encrypted PKCS#8 keys, see RFC 8018 and RFC 7914
+var (
+	oidPBES2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt       = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidDESEDE3CBC   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+var pbkdf2PRFs = map[string]func() hash.Hash{
+	oidHMACWithSHA1.String():                                 sha1.New,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}.String():  sha256.New224,
+	oidHMACWithSHA256.String():                               sha256.New,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}.String(): sha512.New384,
+	asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}.String(): sha512.New,
+}
+
+// the key lengths of the AES-CBC encryption schemes
+var pkcs8AESKeyLengths = map[string]int{
+	asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}.String():  16,
+	asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}.String(): 24,
+	oidAES256CBC.String(): 32,
+}
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt            []byte
+	CostParameter   int
+	BlockSize       int
+	Parallelization int
+	KeyLength       int `asn1:"optional"`
+}
+
+// the PBKDF2 iterations of the PKCS#8 keys encrypted by MarshalEncryptedPKCS8PrivateKey
+const pkcs8PBKDF2Iterations = 600000
+
+var (
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// MarshalEncryptedPKCS8PrivateKey returns the ENCRYPTED PRIVATE KEY PEM block of key, encrypted
+// using PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC as openssl pkcs8 -topk8 does
+func MarshalEncryptedPKCS8PrivateKey(key interface{}, passphrase []byte) (*pem.Block, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, pkcs8PBKDF2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	encrypted := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	prf, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue})
+	if err != nil {
+		return nil, err
+	}
+	kdfParams, err := asn1.Marshal(struct {
+		Salt           []byte
+		IterationCount int
+		PRF            asn1.RawValue
+	}{salt, pkcs8PBKDF2Iterations, asn1.RawValue{FullBytes: prf}})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData:       encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info}, nil
+}
+
+// decrypts the PKCS#8 keys encrypted using PBES2, as openssl pkcs8 -topk8 does
+func parseEncryptedPKCS8PrivateKey(der []byte, passphrase []byte) (interface{}, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("ssh3: invalid encrypted PKCS#8 key: %w", err)
+	}
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("ssh3: unsupported encryption %s of the PKCS#8 key, only PBES2 is supported", info.EncryptionAlgorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("ssh3: invalid PBES2 parameters: %w", err)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("ssh3: invalid IV of the PKCS#8 key: %w", err)
+	}
+	scheme := params.EncryptionScheme.Algorithm
+	keyLen, isAES := pkcs8AESKeyLengths[scheme.String()]
+	if !isAES {
+		if !scheme.Equal(oidDESEDE3CBC) {
+			return nil, fmt.Errorf("ssh3: unsupported encryption scheme %s of the PKCS#8 key", scheme)
+		}
+		keyLen = 24
+	}
+	key, err := derivePKCS8Key(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	var block cipher.Block
+	if isAES {
+		block, err = aes.NewCipher(key)
+	} else {
+		block, err = des.NewTripleDESCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("ssh3: invalid encrypted PKCS#8 key length")
+	}
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+	// a wrong passphrase gives an invalid padding, or more rarely an invalid key
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(decrypted[len(decrypted)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, x509.IncorrectPasswordError
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(decrypted[:len(decrypted)-padding])
+	if err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+	return privateKey, nil
+}
+
+func derivePKCS8Key(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("ssh3: invalid PBKDF2 parameters: %w", err)
+		}
+		prf := oidHMACWithSHA1
+		if len(params.PRF.Algorithm) > 0 {
+			prf = params.PRF.Algorithm
+		}
+		newHash, ok := pbkdf2PRFs[prf.String()]
+		if !ok {
+			return nil, fmt.Errorf("ssh3: unsupported PBKDF2 pseudorandom function %s", prf)
+		}
+		if params.IterationCount <= 0 {
+			return nil, errors.New("ssh3: invalid PBKDF2 iteration count")
+		}
+		return pbkdf2.Key(passphrase, params.Salt, params.IterationCount, keyLen, newHash), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("ssh3: invalid scrypt parameters: %w", err)
+		}
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.Parallelization, keyLen)
+	default:
+		return nil, fmt.Errorf("ssh3: unsupported key derivation function %s of the PKCS#8 key", kdf.Algorithm)
+	}
+}
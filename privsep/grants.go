@@ -0,0 +1,118 @@
+package privsep
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/francoismichel/ssh3/util/unix_util"
+)
+
+// Grant is what the authentication of a conversation by the monitor allows the worker to do
+type Grant struct {
+	Username string
+	// the command the user is restricted to, by the server config or the authenticating
+	// identity, empty if none
+	ForcedCommand string
+	// set until the user proves the second factor, the worker then not being allowed anything
+	Pending bool
+}
+
+// CheckSpawn returns an error if the grant does not allow the worker to run the command of
+// params, a user restricted to a forced command only running it with its shell
+func (g Grant) CheckSpawn(user *unix_util.User, params SpawnParams) error {
+	if params.Username != g.Username {
+		return fmt.Errorf("the conversation did not authenticate user %s", params.Username)
+	}
+	if g.ForcedCommand == "" {
+		return nil
+	}
+	forcedArgs := append([]string{user.Shell}, user.ShellCommandArgs(g.ForcedCommand)...)
+	if params.Path != user.Shell || !slices.Equal(params.Args, forcedArgs) {
+		return fmt.Errorf("user %s is restricted to the command %q", g.Username, g.ForcedCommand)
+	}
+	return nil
+}
+
+// Grants are the ongoing conversations authenticated by the monitor, by base64-encoded ID.
+// The worker can only act on behalf of their users.
+type Grants struct {
+	lock   sync.Mutex
+	grants map[string]Grant
+}
+
+func NewGrants() *Grants {
+	return &Grants{grants: make(map[string]Grant)}
+}
+
+// Add records the successful authentication of the conversation
+func (g *Grants) Add(base64ConversationID string, grant Grant) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.grants[base64ConversationID] = grant
+}
+
+// Remove drops the grant of the conversation once it ended
+func (g *Grants) Remove(base64ConversationID string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.grants, base64ConversationID)
+}
+
+// Get returns the grant of the conversation, if it authenticated username
+func (g *Grants) Get(base64ConversationID string, username string) (Grant, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	grant, ok := g.grants[base64ConversationID]
+	if !ok || grant.Username != username || grant.Pending {
+		return Grant{}, fmt.Errorf("user %s has not been authenticated by the monitor for conversation %s", username, base64ConversationID)
+	}
+	return grant, nil
+}
+
+// CheckPending returns an error unless the conversation authenticated username with its
+// first factor and waits for the second one
+func (g *Grants) CheckPending(base64ConversationID string, username string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	grant, ok := g.grants[base64ConversationID]
+	if !ok || grant.Username != username || !grant.Pending {
+		return fmt.Errorf("conversation %s does not wait for the second factor of user %s", base64ConversationID, username)
+	}
+	return nil
+}
+
+// Promote grants the pending authentication of the conversation once the user proved the
+// second factor
+func (g *Grants) Promote(base64ConversationID string, username string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	grant, ok := g.grants[base64ConversationID]
+	if !ok || grant.Username != username || !grant.Pending {
+		return fmt.Errorf("conversation %s does not wait for the second factor of user %s", base64ConversationID, username)
+	}
+	grant.Pending = false
+	g.grants[base64ConversationID] = grant
+	return nil
+}
+
+// the variables of the environment changing how the loader or the shells start the commands,
+// that the worker cannot set
+var unsafeEnvPrefixes = []string{"LD_", "BASH_FUNC_"}
+var unsafeEnvNames = []string{"BASH_ENV", "ENV", "SHELLOPTS", "BASHOPTS", "PS4", "IFS", "GCONV_PATH", "LOCPATH"}
+
+// SanitizeEnv returns the environment requested by the worker without the unsafe variables
+// and the malformed entries
+func SanitizeEnv(env []string) []string {
+	var sanitized []string
+	for _, variable := range env {
+		name, _, ok := strings.Cut(variable, "=")
+		if !ok || name == "" || slices.Contains(unsafeEnvNames, name) ||
+			slices.ContainsFunc(unsafeEnvPrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+			continue
+		}
+		sanitized = append(sanitized, variable)
+	}
+	return sanitized
+}
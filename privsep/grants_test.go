@@ -0,0 +1,92 @@
+package privsep
+
+import (
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("grants of the conversations", func() {
+	user := &unix_util.User{Username: "alice", Shell: "/bin/sh"}
+	var grants *Grants
+
+	BeforeEach(func() {
+		grants = NewGrants()
+		grants.Add("conv-1", Grant{Username: "alice", ForcedCommand: "/usr/bin/backup"})
+		grants.Add("conv-2", Grant{Username: "alice"})
+	})
+
+	It("Runs the forced command of the conversation", func() {
+		grant, err := grants.Get("conv-1", "alice")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(grant.CheckSpawn(user, SpawnParams{
+			Username: "alice",
+			Path:     "/bin/sh",
+			Args:     []string{"/bin/sh", "-c", "/usr/bin/backup"},
+		})).To(Succeed())
+	})
+
+	It("Refuses the worker requests bypassing the forced command", func() {
+		grant, err := grants.Get("conv-1", "alice")
+		Expect(err).ToNot(HaveOccurred())
+		for _, params := range []SpawnParams{
+			{Username: "alice", Path: "/bin/sh", Args: []string{"-sh"}},
+			{Username: "alice", Path: "/bin/sh", Args: []string{"/bin/sh", "-c", "/usr/bin/backup; id"}},
+			{Username: "alice", Path: "/usr/bin/id", Args: []string{"/bin/sh", "-c", "/usr/bin/backup"}},
+		} {
+			Expect(grant.CheckSpawn(user, params)).ToNot(Succeed())
+		}
+	})
+
+	It("Runs any command of the users without forced command", func() {
+		grant, err := grants.Get("conv-2", "alice")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(grant.CheckSpawn(user, SpawnParams{Username: "alice", Path: "/usr/bin/id", Args: []string{"id"}})).To(Succeed())
+		// but only as the authenticated user
+		Expect(grant.CheckSpawn(user, SpawnParams{Username: "root", Path: "/usr/bin/id", Args: []string{"id"}})).ToNot(Succeed())
+	})
+
+	It("Only grants the users authenticated by the ongoing conversations", func() {
+		_, err := grants.Get("conv-2", "bob")
+		Expect(err).To(HaveOccurred())
+		_, err = grants.Get("conv-3", "alice")
+		Expect(err).To(HaveOccurred())
+
+		grants.Remove("conv-1")
+		_, err = grants.Get("conv-1", "alice")
+		Expect(err).To(HaveOccurred())
+		_, err = grants.Get("conv-2", "alice")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Only grants the conversations waiting for the second factor once it is proven", func() {
+		grants.Add("conv-3", Grant{Username: "alice", Pending: true})
+		_, err := grants.Get("conv-3", "alice")
+		Expect(err).To(HaveOccurred())
+
+		// the second factor completes the first one of the same conversation and user
+		Expect(grants.CheckPending("conv-3", "alice")).To(Succeed())
+		Expect(grants.CheckPending("conv-3", "bob")).ToNot(Succeed())
+		Expect(grants.CheckPending("conv-2", "alice")).ToNot(Succeed())
+		Expect(grants.CheckPending("conv-4", "alice")).ToNot(Succeed())
+		Expect(grants.Promote("conv-3", "bob")).ToNot(Succeed())
+
+		Expect(grants.Promote("conv-3", "alice")).To(Succeed())
+		_, err = grants.Get("conv-3", "alice")
+		Expect(err).ToNot(HaveOccurred())
+		// once granted, the conversation does not wait for a second factor anymore
+		Expect(grants.CheckPending("conv-3", "alice")).ToNot(Succeed())
+	})
+
+	It("Drops the variables changing how the commands start", func() {
+		Expect(SanitizeEnv([]string{
+			"TERM=xterm",
+			"LD_PRELOAD=/tmp/evil.so",
+			"BASH_ENV=/tmp/evil.sh",
+			"BASH_FUNC_ls%%=() { id; }",
+			"malformed",
+			"SSH_ORIGINAL_COMMAND=ls",
+		})).To(Equal([]string{"TERM=xterm", "SSH_ORIGINAL_COMMAND=ls"}))
+	})
+})
@@ -0,0 +1,339 @@
+// Package privsep implements the protocol between the privileged monitor of the server and
+// its unprivileged worker. The worker parses everything received from the network and asks
+// the monitor to perform the operations requiring the privileges of the server. Requests and
+// responses are JSON messages exchanged over a UNIX seqpacket socket, along with the file
+// descriptors they carry (e.g. the UDP socket of the server or the pipes of a command).
+package privsep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// the first argument of the server binary telling it to run as the worker
+const WorkerSubcommand = "privsep-worker"
+
+// the descriptor of the socket connected to the monitor, inherited by the worker
+const workerSocketFd = 3
+
+const (
+	// the maximum size of a message
+	maxMessageSize = 1 << 16
+	// the maximum number of file descriptors carried by a message
+	maxFiles = 4
+)
+
+// the operations performed by the monitor, see the params and result types below
+const (
+	// returns the UDP socket of the server, followed by the listening socket of the admin API
+	// if enabled. Can only be performed once.
+	OpSetup                = "setup"
+	OpAuthenticatePassword = "authenticate_password"
+	OpAuthenticateBearer   = "authenticate_bearer"
+	// verifies the second factor of a user that authenticated using the first one
+	OpAuthenticateKeyboardInteractive = "authenticate_keyboard_interactive"
+	// runs a command as an authenticated user, its stdin, stdout and stderr being passed along
+	OpSpawn  = "spawn"
+	OpSignal = "signal"
+	// returns once the command exited
+	OpWait = "wait"
+	// returns a listening socket for the agent of an authenticated user, owned by the user
+	OpAgentSocket = "agent_socket"
+	// returns a new file recording a session of an authenticated user
+	OpRecording = "recording"
+	// records an audit event in the audit log of the monitor
+	OpAudit = "audit"
+	// drops what the authentication of a conversation allowed once it ended
+	OpEndConversation = "end_conversation"
+)
+
+type SetupResult struct {
+	// the configuration loaded by the monitor
+	ServerConfig json.RawMessage `json:"server_config"`
+	// the certificate and its private key, PEM-encoded
+	Certificate []byte `json:"certificate"`
+	PrivateKey  []byte `json:"private_key"`
+	AdminSocket bool   `json:"admin_socket,omitempty"`
+	// the certificates of the virtual hosts setting one
+	VirtualHostCertificates []VirtualHostCertificate `json:"virtual_host_certificates,omitempty"`
+}
+
+type VirtualHostCertificate struct {
+	VirtualHost string `json:"virtual_host"`
+	// the certificate and its private key, PEM-encoded
+	Certificate []byte `json:"certificate"`
+	PrivateKey  []byte `json:"private_key"`
+}
+
+type AuthenticatePasswordParams struct {
+	Username             string `json:"username"`
+	Password             string `json:"password"`
+	Base64ConversationID string `json:"conversation_id"`
+	// the virtual host reached by the client, empty for the default host
+	VirtualHost string `json:"virtual_host,omitempty"`
+}
+
+type AuthenticateBearerParams struct {
+	// the username the token was issued for
+	RequestedUsername    string `json:"requested_username"`
+	Username             string `json:"username"`
+	Token                string `json:"token"`
+	Base64ConversationID string `json:"conversation_id"`
+	// the virtual host reached by the client, empty for the default host
+	VirtualHost string `json:"virtual_host,omitempty"`
+}
+
+type AuthenticateKeyboardInteractiveParams struct {
+	Username string `json:"username"`
+	Response string `json:"response"`
+	// the conversation authenticated by the first factor
+	Base64ConversationID string `json:"conversation_id"`
+	// the virtual host reached by the client, empty for the default host
+	VirtualHost string `json:"virtual_host,omitempty"`
+}
+
+type AuthenticationResult struct {
+	Authenticated bool `json:"authenticated"`
+	// set by the command="..." option of the identity that authenticated the user, if any
+	ForcedCommand string `json:"forced_command,omitempty"`
+	// the authentication method of the identity that authenticated the user, e.g. publickey
+	Method string `json:"method,omitempty"`
+}
+
+type SpawnParams struct {
+	Username string `json:"username"`
+	// the conversation that authenticated the user
+	Base64ConversationID string   `json:"conversation_id"`
+	Path                 string   `json:"path"`
+	Args                 []string `json:"args"`
+	Env                  []string `json:"env"`
+	Dir                  string   `json:"dir"`
+	// if set, the descriptors are the tty of a pty that becomes the controlling terminal of the command
+	Tty bool `json:"tty,omitempty"`
+}
+
+type SpawnResult struct {
+	Pid int `json:"pid"`
+}
+
+type SignalParams struct {
+	Pid    int `json:"pid"`
+	Signal int `json:"signal"`
+	// if set, the signal is delivered to this process group of the command, e.g. the foreground
+	// job of its pty
+	ProcessGroup int `json:"process_group,omitempty"`
+}
+
+type WaitParams struct {
+	Pid int `json:"pid"`
+}
+
+type WaitResult struct {
+	// -1 if the command was killed by a signal
+	ExitCode int `json:"exit_code"`
+	// the signal that killed the command, if any
+	Signal     int  `json:"signal,omitempty"`
+	CoreDumped bool `json:"core_dumped,omitempty"`
+}
+
+type AgentSocketParams struct {
+	Username             string `json:"username"`
+	Base64ConversationID string `json:"conversation_id"`
+}
+
+type AgentSocketResult struct {
+	Path string `json:"path"`
+}
+
+type RecordingParams struct {
+	Username       string `json:"username"`
+	ConversationID string `json:"conversation_id"`
+	ChannelID      uint64 `json:"channel_id"`
+}
+
+type EndConversationParams struct {
+	Base64ConversationID string `json:"conversation_id"`
+}
+
+type request struct {
+	ID     uint64          `json:"id"`
+	Op     string          `json:"op"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	ID     uint64          `json:"id"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// RemoteError is returned by the client when the monitor failed to perform an operation
+type RemoteError struct {
+	Op      string
+	Message string
+}
+
+func (e RemoteError) Error() string {
+	return fmt.Sprintf("monitor could not perform %s: %s", e.Op, e.Message)
+}
+
+type message struct {
+	data  []byte
+	files []*os.File
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// HandlerFunc performs an operation with the params and descriptors of a request. The
+// descriptors are closed once it returns, as well as the returned ones once sent.
+type HandlerFunc func(params json.RawMessage, files []*os.File) (result interface{}, returnedFiles []*os.File, err error)
+
+// Serve handles the requests of the worker until its socket is closed, each request being
+// handled in its own goroutine
+func Serve(s *Conn, handlers map[string]HandlerFunc) error {
+	for {
+		msg, err := s.receive()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer closeFiles(msg.files)
+			var req request
+			resp := response{}
+			var result interface{}
+			var returnedFiles []*os.File
+			err := json.Unmarshal(msg.data, &req)
+			resp.ID = req.ID
+			if err == nil {
+				handler, ok := handlers[req.Op]
+				if !ok {
+					err = fmt.Errorf("unknown operation %q", req.Op)
+				} else {
+					result, returnedFiles, err = handler(req.Params, msg.files)
+				}
+			}
+			defer closeFiles(returnedFiles)
+			if err == nil && result != nil {
+				resp.Result, err = json.Marshal(result)
+			}
+			if err != nil {
+				resp.Error = err.Error()
+				returnedFiles = nil
+			}
+			encoded, err := json.Marshal(resp)
+			if err != nil {
+				return
+			}
+			s.send(message{data: encoded, files: returnedFiles})
+		}()
+	}
+}
+
+type reply struct {
+	resp  response
+	files []*os.File
+}
+
+// Client sends the requests of the worker to the monitor. It is safe for concurrent use.
+type Client struct {
+	socket *Conn
+	lock   sync.Mutex
+	nextID uint64
+	// the requests waiting for their response, by ID
+	pending map[uint64]chan reply
+	// set once the socket is closed
+	err error
+}
+
+func NewClient(s *Conn) *Client {
+	client := &Client{socket: s, pending: make(map[uint64]chan reply)}
+	go client.receiveResponses()
+	return client
+}
+
+func (c *Client) receiveResponses() {
+	for {
+		msg, err := c.socket.receive()
+		var resp response
+		if err == nil {
+			err = json.Unmarshal(msg.data, &resp)
+		}
+		if err != nil {
+			closeFiles(msg.files)
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			c.err = fmt.Errorf("connection to the monitor lost: %w", err)
+			for _, pending := range c.pending {
+				close(pending)
+			}
+			c.pending = nil
+			return
+		}
+		c.lock.Lock()
+		pending, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.lock.Unlock()
+		if !ok {
+			closeFiles(msg.files)
+			continue
+		}
+		pending <- reply{resp: resp, files: msg.files}
+	}
+}
+
+// Call asks the monitor to perform op and decodes its result in result, if not nil. It returns
+// the descriptors sent along with the result, to be closed by the caller.
+func (c *Client) Call(op string, params interface{}, files []*os.File, result interface{}) ([]*os.File, error) {
+	req := request{Op: op}
+	if params != nil {
+		encoded, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req.Params = encoded
+	}
+	pending := make(chan reply, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	c.nextID += 1
+	req.ID = c.nextID
+	c.pending[req.ID] = pending
+	c.lock.Unlock()
+
+	encoded, err := json.Marshal(req)
+	if err == nil {
+		err = c.socket.send(message{data: encoded, files: files})
+	}
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, req.ID)
+		c.lock.Unlock()
+		return nil, err
+	}
+	r, ok := <-pending
+	if !ok {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return nil, c.err
+	}
+	if r.resp.Error != "" {
+		closeFiles(r.files)
+		return nil, RemoteError{Op: op, Message: r.resp.Error}
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.resp.Result, result); err != nil {
+			closeFiles(r.files)
+			return nil, err
+		}
+	}
+	return r.files, nil
+}
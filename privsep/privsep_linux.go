@@ -0,0 +1,112 @@
+//go:build linux
+
+package privsep
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Conn is one end of the socket between the monitor and the worker
+type Conn struct {
+	conn      *net.UnixConn
+	writeLock sync.Mutex
+}
+
+func newConn(file *os.File) (*Conn, error) {
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%s is not a UNIX socket", file.Name())
+	}
+	return &Conn{conn: unixConn}, nil
+}
+
+// NewSocketPair returns the end of the socket used by the monitor and the one to pass
+// to the worker as the first of its exec.Cmd.ExtraFiles
+func NewSocketPair() (*Conn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	monitorConn, err := newConn(os.NewFile(uintptr(fds[0]), "privsep-monitor"))
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return monitorConn, os.NewFile(uintptr(fds[1]), "privsep-worker"), nil
+}
+
+// WorkerConn returns the socket inherited from the monitor
+func WorkerConn() (*Conn, error) {
+	return newConn(os.NewFile(workerSocketFd, "privsep-worker"))
+}
+
+func (c *Conn) send(msg message) error {
+	if len(msg.data) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum size of %d bytes", len(msg.data), maxMessageSize)
+	}
+	if len(msg.files) > maxFiles {
+		return fmt.Errorf("cannot send more than %d descriptors in a message", maxFiles)
+	}
+	var oob []byte
+	if len(msg.files) > 0 {
+		fds := make([]int, len(msg.files))
+		for i, file := range msg.files {
+			fds[i] = int(file.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, _, err := c.conn.WriteMsgUnix(msg.data, oob, nil)
+	return err
+}
+
+func (c *Conn) receive() (message, error) {
+	data := make([]byte, maxMessageSize)
+	oob := make([]byte, syscall.CmsgSpace(maxFiles*4))
+	n, oobn, flags, _, err := c.conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		return message{}, err
+	}
+	var files []*os.File
+	if oobn > 0 {
+		controlMessages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return message{}, err
+		}
+		for i := range controlMessages {
+			fds, err := syscall.ParseUnixRights(&controlMessages[i])
+			if err != nil {
+				closeFiles(files)
+				return message{}, err
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "privsep"))
+			}
+		}
+	}
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		closeFiles(files)
+		return message{}, fmt.Errorf("truncated message")
+	}
+	// the peer closed the socket
+	if n == 0 && len(files) == 0 {
+		return message{}, io.EOF
+	}
+	return message{data: data[:n], files: files}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+package privsep
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+type Conn struct{}
+
+var errNotImplemented = fmt.Errorf("privilege separation is not implemented on %s/%s systems", runtime.GOOS, runtime.GOARCH)
+
+func NewSocketPair() (*Conn, *os.File, error) {
+	return nil, nil, errNotImplemented
+}
+
+func WorkerConn() (*Conn, error) {
+	return nil, errNotImplemented
+}
+
+func (c *Conn) send(msg message) error {
+	return errNotImplemented
+}
+
+func (c *Conn) receive() (message, error) {
+	return message{}, errNotImplemented
+}
+
+func (c *Conn) Close() error {
+	return nil
+}
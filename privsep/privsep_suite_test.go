@@ -0,0 +1,13 @@
+package privsep
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestPrivsep(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Privsep Suite")
+}
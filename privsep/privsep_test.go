@@ -0,0 +1,145 @@
+//go:build linux
+
+package privsep
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("privilege separation protocol", func() {
+	var monitorConn *Conn
+	var client *Client
+	var served chan error
+
+	serve := func(handlers map[string]HandlerFunc) {
+		var workerFile *os.File
+		var err error
+		monitorConn, workerFile, err = NewSocketPair()
+		Expect(err).ToNot(HaveOccurred())
+		workerConn, err := newConn(workerFile)
+		Expect(err).ToNot(HaveOccurred())
+		client = NewClient(workerConn)
+		served = make(chan error, 1)
+		go func() {
+			served <- Serve(monitorConn, handlers)
+		}()
+	}
+
+	AfterEach(func() {
+		client.socket.Close()
+		// the socket of the worker is closed unless the monitor closed its own
+		Eventually(served).Should(Receive())
+		monitorConn.Close()
+	})
+
+	It("returns the results of the operations", func() {
+		serve(map[string]HandlerFunc{
+			OpWait: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				var params WaitParams
+				if err := json.Unmarshal(encoded, &params); err != nil {
+					return nil, nil, err
+				}
+				return WaitResult{ExitCode: params.Pid + 1}, nil, nil
+			},
+		})
+		var result WaitResult
+		files, err := client.Call(OpWait, WaitParams{Pid: 41}, nil, &result)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(BeEmpty())
+		Expect(result.ExitCode).To(Equal(42))
+	})
+
+	It("passes file descriptors in both directions", func() {
+		serve(map[string]HandlerFunc{
+			OpSpawn: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				if len(files) != 1 {
+					return nil, nil, fmt.Errorf("expected a descriptor")
+				}
+				if _, err := files[0].Write([]byte("from the monitor")); err != nil {
+					return nil, nil, err
+				}
+				r, w, err := os.Pipe()
+				if err != nil {
+					return nil, nil, err
+				}
+				defer w.Close()
+				if _, err := w.Write([]byte("returned pipe")); err != nil {
+					return nil, nil, err
+				}
+				return nil, []*os.File{r}, nil
+			},
+		})
+		r, w, err := os.Pipe()
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		files, err := client.Call(OpSpawn, nil, []*os.File{w}, nil)
+		w.Close()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(io.ReadAll(r)).To(Equal([]byte("from the monitor")))
+		Expect(files).To(HaveLen(1))
+		defer files[0].Close()
+		Expect(io.ReadAll(files[0])).To(Equal([]byte("returned pipe")))
+	})
+
+	It("reports the errors of the monitor", func() {
+		serve(map[string]HandlerFunc{
+			OpSignal: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				return nil, nil, fmt.Errorf("no such process")
+			},
+		})
+		_, err := client.Call(OpSignal, SignalParams{Pid: 1, Signal: 9}, nil, nil)
+		Expect(err).To(Equal(RemoteError{Op: OpSignal, Message: "no such process"}))
+		_, err = client.Call(OpSpawn, nil, nil, nil)
+		Expect(err).To(MatchError(ContainSubstring(`unknown operation "spawn"`)))
+	})
+
+	It("stops serving when the worker closes the socket", func() {
+		serve(map[string]HandlerFunc{})
+		client.socket.Close()
+		Eventually(served).Should(Receive(Equal(io.EOF)))
+		served <- nil
+	})
+
+	It("handles concurrent requests", func() {
+		release := make(chan struct{})
+		serve(map[string]HandlerFunc{
+			OpWait: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				<-release
+				return WaitResult{ExitCode: 1}, nil, nil
+			},
+			OpSignal: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				return nil, nil, nil
+			},
+		})
+		waited := make(chan error, 1)
+		go func() {
+			_, err := client.Call(OpWait, WaitParams{Pid: 1}, nil, nil)
+			waited <- err
+		}()
+		// a pending wait does not block the other requests
+		_, err := client.Call(OpSignal, SignalParams{Pid: 1, Signal: 15}, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Consistently(waited).ShouldNot(Receive())
+		close(release)
+		Eventually(waited).Should(Receive(BeNil()))
+	})
+
+	It("fails the pending requests when the monitor exits", func() {
+		serve(map[string]HandlerFunc{
+			OpWait: func(encoded json.RawMessage, files []*os.File) (interface{}, []*os.File, error) {
+				monitorConn.Close()
+				return nil, nil, nil
+			},
+		})
+		_, err := client.Call(OpWait, WaitParams{Pid: 1}, nil, nil)
+		Expect(err).To(MatchError(ContainSubstring("connection to the monitor lost")))
+		_, err = client.Call(OpWait, WaitParams{Pid: 1}, nil, nil)
+		Expect(err).To(MatchError(ContainSubstring("connection to the monitor lost")))
+	})
+})
@@ -0,0 +1,93 @@
+package ssh3
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// the range of protocol versions implemented by the client, e.g. "1-2"
+const ProtocolVersionsHeader = "Ssh3-Protocol-Versions"
+
+// the protocol version chosen by the server
+const ProtocolVersionHeader = "Ssh3-Protocol-Version"
+
+func formatProtocolVersions(lowest, highest ssh3Messages.ProtocolVersion) string {
+	if lowest == highest {
+		return strconv.FormatUint(uint64(lowest), 10)
+	}
+	return fmt.Sprintf("%d-%d", lowest, highest)
+}
+
+// parses a version ("2") or a range of versions ("1-2")
+func parseProtocolVersions(value string) (lowest, highest ssh3Messages.ProtocolVersion, err error) {
+	minStr, maxStr, isRange := strings.Cut(strings.TrimSpace(value), "-")
+	if !isRange {
+		maxStr = minStr
+	}
+	minVersion, err := strconv.ParseUint(minStr, 10, 64)
+	if err != nil {
+		return 0, 0, InvalidSSHVersion{versionString: value}
+	}
+	maxVersion, err := strconv.ParseUint(maxStr, 10, 64)
+	if err != nil || minVersion == 0 || minVersion > maxVersion {
+		return 0, 0, InvalidSSHVersion{versionString: value}
+	}
+	return ssh3Messages.ProtocolVersion(minVersion), ssh3Messages.ProtocolVersion(maxVersion), nil
+}
+
+// SetProtocolVersionsHeader advertises the protocol versions implemented by the client when
+// establishing a conversation
+func SetProtocolVersionsHeader(header http.Header) {
+	header.Set(ProtocolVersionsHeader, formatProtocolVersions(ssh3Messages.MinProtocolVersion, ssh3Messages.MaxProtocolVersion))
+}
+
+// NegotiateProtocolVersion returns the highest protocol version implemented by both the server
+// and the client sending r. The clients that predate the negotiation speak the version 1 and
+// are only accepted if they run the same major and minor version as the server.
+func NegotiateProtocolVersion(r *http.Request) (ssh3Messages.ProtocolVersion, error) {
+	offered := r.Header.Get(ProtocolVersionsHeader)
+	if offered == "" {
+		major, minor, _, err := ParseVersion(r.UserAgent())
+		if err != nil {
+			return 0, err
+		}
+		if major != MAJOR || minor != MINOR {
+			return 0, UnsupportedSSHVersion{versionString: r.UserAgent()}
+		}
+		return ssh3Messages.ProtocolVersion1, nil
+	}
+	lowest, highest, err := parseProtocolVersions(offered)
+	if err != nil {
+		return 0, err
+	}
+	if highest < ssh3Messages.MinProtocolVersion || lowest > ssh3Messages.MaxProtocolVersion {
+		return 0, UnsupportedSSHVersion{versionString: fmt.Sprintf("protocol versions %s", offered)}
+	}
+	return min(highest, ssh3Messages.MaxProtocolVersion), nil
+}
+
+// checks the protocol version chosen by the server in its response, the servers that predate
+// the negotiation speak the version 1
+func checkServerProtocolVersion(header http.Header) (ssh3Messages.ProtocolVersion, error) {
+	chosen := header.Get(ProtocolVersionHeader)
+	if chosen == "" {
+		return ssh3Messages.ProtocolVersion1, nil
+	}
+	version, highest, err := parseProtocolVersions(chosen)
+	if err != nil || version != highest {
+		return 0, InvalidSSHVersion{versionString: chosen}
+	}
+	if version < ssh3Messages.MinProtocolVersion || version > ssh3Messages.MaxProtocolVersion {
+		return 0, UnsupportedSSHVersion{versionString: fmt.Sprintf("protocol version %s", chosen)}
+	}
+	return version, nil
+}
+
+// ProtocolVersion returns the protocol version negotiated when establishing the conversation
+func (c *Conversation) ProtocolVersion() ssh3Messages.ProtocolVersion {
+	return c.protocolVersion
+}
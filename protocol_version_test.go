@@ -0,0 +1,53 @@
+package ssh3_test
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Protocol version negotiation", func() {
+	request := func(userAgent string, versions string) *http.Request {
+		r, err := http.NewRequest(http.MethodConnect, "https://localhost/ssh3", nil)
+		Expect(err).ToNot(HaveOccurred())
+		r.Header.Set("User-Agent", userAgent)
+		if versions != "" {
+			r.Header.Set(ssh3.ProtocolVersionsHeader, versions)
+		}
+		return r
+	}
+
+	It("Advertises the versions implemented by the client", func() {
+		r := request(ssh3.GetCurrentVersion(), "")
+		ssh3.SetProtocolVersionsHeader(r.Header)
+		version, err := ssh3.NegotiateProtocolVersion(r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(ssh3Messages.MaxProtocolVersion))
+	})
+
+	It("Chooses the highest common version", func() {
+		version, err := ssh3.NegotiateProtocolVersion(request(fmt.Sprintf("SSH 3.0 francoismichel/ssh3 %d.%d.0", ssh3.MAJOR, ssh3.MINOR+1), "1-1000"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(ssh3Messages.MaxProtocolVersion))
+	})
+
+	It("Refuses the clients without a common version", func() {
+		_, err := ssh3.NegotiateProtocolVersion(request(ssh3.GetCurrentVersion(), "999-1000"))
+		Expect(err).To(BeAssignableToTypeOf(ssh3.UnsupportedSSHVersion{}))
+		_, err = ssh3.NegotiateProtocolVersion(request(ssh3.GetCurrentVersion(), "2-1"))
+		Expect(err).To(BeAssignableToTypeOf(ssh3.InvalidSSHVersion{}))
+	})
+
+	It("Speaks the version 1 with the clients of the same minor version predating the negotiation", func() {
+		version, err := ssh3.NegotiateProtocolVersion(request(fmt.Sprintf("SSH 3.0 francoismichel/ssh3 %d.%d.0", ssh3.MAJOR, ssh3.MINOR), ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(version).To(Equal(ssh3Messages.ProtocolVersion1))
+		_, err = ssh3.NegotiateProtocolVersion(request(fmt.Sprintf("SSH 3.0 francoismichel/ssh3 %d.%d.0", ssh3.MAJOR, ssh3.MINOR+1), ""))
+		Expect(err).To(BeAssignableToTypeOf(ssh3.UnsupportedSSHVersion{}))
+	})
+})
@@ -0,0 +1,161 @@
+package ssh3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// the signature starting the headers of the version 2 of the PROXY protocol
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolHeaderSize   = 16
+	proxyProtocolCommandLocal = 0x20
+	proxyProtocolCommandProxy = 0x21
+	proxyProtocolFamilyInet   = 0x1
+	proxyProtocolFamilyInet6  = 0x2
+	// the client addresses not seen for this long are forgotten
+	proxyProtocolAddressLifetime = 10 * time.Minute
+)
+
+// ParseProxyProtocolHeader parses the PROXY protocol v2 header starting data, returning its size
+// and the source address it carries. The source is not valid if the header is a LOCAL one, e.g.
+// for the health checks of the proxy, or if the addresses are not IPv4 or IPv6 ones.
+func ParseProxyProtocolHeader(data []byte) (size int, source netip.AddrPort, err error) {
+	if len(data) < proxyProtocolHeaderSize || !bytes.HasPrefix(data, proxyProtocolSignature) {
+		return 0, netip.AddrPort{}, fmt.Errorf("no PROXY protocol v2 header")
+	}
+	size = proxyProtocolHeaderSize + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < size {
+		return 0, netip.AddrPort{}, fmt.Errorf("truncated PROXY protocol header of %d bytes", size)
+	}
+	switch data[12] {
+	case proxyProtocolCommandLocal:
+		return size, netip.AddrPort{}, nil
+	case proxyProtocolCommandProxy:
+	default:
+		return 0, netip.AddrPort{}, fmt.Errorf("unsupported PROXY protocol version and command 0x%x", data[12])
+	}
+	addresses := data[proxyProtocolHeaderSize:size]
+	switch data[13] >> 4 {
+	case proxyProtocolFamilyInet:
+		if len(addresses) < 12 {
+			return 0, netip.AddrPort{}, fmt.Errorf("truncated IPv4 addresses in the PROXY protocol header")
+		}
+		source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addresses[0:4])), binary.BigEndian.Uint16(addresses[8:10]))
+	case proxyProtocolFamilyInet6:
+		if len(addresses) < 36 {
+			return 0, netip.AddrPort{}, fmt.Errorf("truncated IPv6 addresses in the PROXY protocol header")
+		}
+		source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addresses[0:16])), binary.BigEndian.Uint16(addresses[32:34]))
+	}
+	return size, source, nil
+}
+
+// ProxyProtocolConn strips the PROXY protocol v2 headers prefixing the datagrams relayed by
+// trusted UDP load balancers and remembers the client addresses they carry. The datagrams keep
+// the address of the load balancer, to which the replies are sent.
+type ProxyProtocolConn struct {
+	net.PacketConn
+	trustedProxies []netip.Prefix
+
+	lock        sync.Mutex
+	clientAddrs map[string]proxiedClient
+	lastPruning time.Time
+}
+
+type proxiedClient struct {
+	addr     netip.AddrPort
+	lastSeen time.Time
+}
+
+var _ net.PacketConn = &ProxyProtocolConn{}
+
+// NewProxyProtocolConn wraps conn, only the datagrams from trustedProxies being parsed
+func NewProxyProtocolConn(conn net.PacketConn, trustedProxies []netip.Prefix) *ProxyProtocolConn {
+	return &ProxyProtocolConn{PacketConn: conn, trustedProxies: trustedProxies, clientAddrs: make(map[string]proxiedClient), lastPruning: time.Now()}
+}
+
+// ContainsAddr returns whether addr belongs to one of the prefixes, the IPv4-mapped IPv6
+// addresses being compared as IPv4 addresses
+func ContainsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ProxyProtocolConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !ContainsAddr(c.trustedProxies, udpAddr.AddrPort().Addr()) || !bytes.HasPrefix(p[:n], proxyProtocolSignature) {
+			return n, addr, nil
+		}
+		size, source, err := ParseProxyProtocolHeader(p[:n])
+		if err != nil {
+			// a QUIC packet cannot start with the signature, the datagram is dropped
+			continue
+		}
+		if source.IsValid() {
+			c.remember(addr.String(), source)
+		}
+		if size == n {
+			continue
+		}
+		return copy(p, p[size:n]), addr, nil
+	}
+}
+
+func (c *ProxyProtocolConn) remember(proxyAddr string, source netip.AddrPort) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	c.clientAddrs[proxyAddr] = proxiedClient{addr: source, lastSeen: now}
+	if now.Sub(c.lastPruning) > proxyProtocolAddressLifetime {
+		for key, client := range c.clientAddrs {
+			if now.Sub(client.lastSeen) > proxyProtocolAddressLifetime {
+				delete(c.clientAddrs, key)
+			}
+		}
+		c.lastPruning = now
+	}
+}
+
+// ClientAddr returns the address of the client whose datagrams are relayed from proxyAddr, e.g.
+// the RemoteAddr of an HTTP request, and false if they carry no PROXY protocol header
+func (c *ProxyProtocolConn) ClientAddr(proxyAddr string) (netip.AddrPort, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	client, ok := c.clientAddrs[proxyAddr]
+	return client.addr, ok
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection, e.g. of a *net.UDPConn
+func (c *ProxyProtocolConn) SetReadBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("cannot set the receive buffer of a %T", c.PacketConn)
+	}
+	return conn.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the send buffer of the wrapped connection, e.g. of a *net.UDPConn
+func (c *ProxyProtocolConn) SetWriteBuffer(bytes int) error {
+	conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("cannot set the send buffer of a %T", c.PacketConn)
+	}
+	return conn.SetWriteBuffer(bytes)
+}
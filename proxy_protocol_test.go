@@ -0,0 +1,89 @@
+package ssh3_test
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// builds a PROXY protocol v2 header relaying a UDP datagram from source to destination
+func proxyProtocolHeader(source netip.AddrPort, destination netip.AddrPort) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21")
+	if source.Addr().Is4() {
+		header = append(header, 0x12)
+	} else {
+		header = append(header, 0x22)
+	}
+	addresses := append(source.Addr().AsSlice(), destination.Addr().AsSlice()...)
+	addresses = binary.BigEndian.AppendUint16(addresses, source.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, destination.Port())
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+var _ = Describe("PROXY protocol", func() {
+	It("Parses the IPv4, IPv6 and LOCAL headers", func() {
+		source := netip.MustParseAddrPort("192.0.2.1:4711")
+		header := proxyProtocolHeader(source, netip.MustParseAddrPort("198.51.100.1:443"))
+		size, parsed, err := ssh3.ParseProxyProtocolHeader(append(header, "payload"...))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(Equal(len(header)))
+		Expect(parsed).To(Equal(source))
+
+		source = netip.MustParseAddrPort("[2001:db8::1]:4711")
+		header = proxyProtocolHeader(source, netip.MustParseAddrPort("[2001:db8::2]:443"))
+		size, parsed, err = ssh3.ParseProxyProtocolHeader(header)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(Equal(len(header)))
+		Expect(parsed).To(Equal(source))
+
+		local := []byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")
+		size, parsed, err = ssh3.ParseProxyProtocolHeader(local)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(Equal(16))
+		Expect(parsed.IsValid()).To(BeFalse())
+
+		_, _, err = ssh3.ParseProxyProtocolHeader(header[:len(header)-1])
+		Expect(err).To(HaveOccurred())
+		_, _, err = ssh3.ParseProxyProtocolHeader([]byte("not a PROXY protocol header"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Strips the headers of the datagrams relayed by the trusted proxies", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		proxy, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer proxy.Close()
+		conn := ssh3.NewProxyProtocolConn(listener, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+		defer conn.Close()
+
+		client := netip.MustParseAddrPort("192.0.2.1:4711")
+		_, err = proxy.WriteTo(append(proxyProtocolHeader(client, netip.MustParseAddrPort("198.51.100.1:443")), "payload"...), listener.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 1500)
+		n, addr, err := conn.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("payload"))
+		Expect(addr.String()).To(Equal(proxy.LocalAddr().String()))
+		clientAddr, ok := conn.ClientAddr(proxy.LocalAddr().String())
+		Expect(ok).To(BeTrue())
+		Expect(clientAddr).To(Equal(client))
+
+		// the headers of the other sources are not parsed
+		conn = ssh3.NewProxyProtocolConn(listener, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+		datagram := append(proxyProtocolHeader(client, netip.MustParseAddrPort("198.51.100.1:443")), "payload"...)
+		_, err = proxy.WriteTo(datagram, listener.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		n, _, err = conn.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf[:n]).To(Equal(datagram))
+		_, ok = conn.ClientAddr(proxy.LocalAddr().String())
+		Expect(ok).To(BeFalse())
+	})
+})
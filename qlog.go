@@ -0,0 +1,159 @@
+package ssh3
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	ssh3 "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+)
+
+// MessageTracer is notified of the SSH3 messages sent and received on the channels of a conversation
+type MessageTracer interface {
+	MessageSent(channel Channel, message ssh3.Message)
+	MessageReceived(channel Channel, message ssh3.Message)
+}
+
+type qlogVantagePoint struct {
+	Type string `json:"type"`
+}
+
+type qlogCommonFields struct {
+	GroupID       string  `json:"group_id"`
+	ReferenceTime float64 `json:"reference_time"`
+	TimeFormat    string  `json:"time_format"`
+}
+
+type qlogTrace struct {
+	VantagePoint qlogVantagePoint `json:"vantage_point"`
+	CommonFields qlogCommonFields `json:"common_fields"`
+}
+
+type qlogHeader struct {
+	QlogFormat    string            `json:"qlog_format"`
+	QlogVersion   string            `json:"qlog_version"`
+	Title         string            `json:"title"`
+	Configuration map[string]string `json:"configuration"`
+	Trace         qlogTrace         `json:"trace"`
+}
+
+type qlogMessageEvent struct {
+	ChannelID   uint64       `json:"channel_id"`
+	ChannelType string       `json:"channel_type"`
+	MessageType string       `json:"message_type"`
+	RequestType string       `json:"request_type,omitempty"`
+	Length      int          `json:"length"`
+	Message     ssh3.Message `json:"message"`
+}
+
+type qlogEvent struct {
+	Time float64          `json:"time"`
+	Name string           `json:"name"`
+	Data qlogMessageEvent `json:"data"`
+}
+
+// QlogMessageTracer writes the SSH3 messages of a conversation in the NDJSON qlog
+// format used by quic-go, so that they can be loaded in qvis alongside the QUIC traces.
+// The messages are written with their decrypted content, including e.g. the typed keystrokes.
+type QlogMessageTracer struct {
+	lock          sync.Mutex
+	w             io.WriteCloser
+	encoder       *json.Encoder
+	referenceTime time.Time
+	err           error
+}
+
+var _ MessageTracer = &QlogMessageTracer{}
+
+// vantagePoint is either "client" or "server"
+func NewQlogMessageTracer(w io.WriteCloser, vantagePoint string, conversationID ConversationID) (*QlogMessageTracer, error) {
+	t := &QlogMessageTracer{
+		w:             w,
+		encoder:       json.NewEncoder(w),
+		referenceTime: time.Now(),
+	}
+	err := t.encoder.Encode(qlogHeader{
+		QlogFormat:    "NDJSON",
+		QlogVersion:   "draft-02",
+		Title:         "ssh3 messages",
+		Configuration: map[string]string{"code_version": GetCurrentVersion()},
+		Trace: qlogTrace{
+			VantagePoint: qlogVantagePoint{Type: vantagePoint},
+			CommonFields: qlogCommonFields{
+				GroupID:       hex.EncodeToString(conversationID[:]),
+				ReferenceTime: float64(t.referenceTime.UnixNano()) / 1e6,
+				TimeFormat:    "relative",
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// CreateQlogMessageTracer traces the messages of a conversation in qlogDir,
+// in a file named after the conversation ID and the vantage point
+func CreateQlogMessageTracer(qlogDir string, vantagePoint string, conversationID ConversationID) (*QlogMessageTracer, error) {
+	filename := filepath.Join(qlogDir, fmt.Sprintf("ssh3_%s_%s.qlog", hex.EncodeToString(conversationID[:]), vantagePoint))
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	tracer, err := NewQlogMessageTracer(util.NewBufferedWriteCloser(file), vantagePoint, conversationID)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return tracer, nil
+}
+
+func (t *QlogMessageTracer) recordMessage(name string, channel Channel, message ssh3.Message) {
+	event := qlogEvent{
+		Name: name,
+		Data: qlogMessageEvent{
+			ChannelID:   channel.ChannelID(),
+			ChannelType: channel.ChannelType(),
+			MessageType: reflect.Indirect(reflect.ValueOf(message)).Type().Name(),
+			Length:      message.Length(),
+			Message:     message,
+		},
+	}
+	if request, ok := message.(*ssh3.ChannelRequestMessage); ok {
+		event.Data.RequestType = request.ChannelRequest.RequestTypeStr()
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// if writing failed once, stop tracing
+	if t.err != nil {
+		return
+	}
+	event.Time = float64(time.Since(t.referenceTime).Nanoseconds()) / 1e6
+	t.err = t.encoder.Encode(event)
+}
+
+func (t *QlogMessageTracer) MessageSent(channel Channel, message ssh3.Message) {
+	t.recordMessage("ssh3:message_sent", channel, message)
+}
+
+func (t *QlogMessageTracer) MessageReceived(channel Channel, message ssh3.Message) {
+	t.recordMessage("ssh3:message_received", channel, message)
+}
+
+// Close closes the underlying writer and returns the first error encountered while tracing, if any
+func (t *QlogMessageTracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := t.w.Close()
+	if t.err != nil {
+		return t.err
+	}
+	return err
+}
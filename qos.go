@@ -0,0 +1,79 @@
+package ssh3
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IPQoS is the marking of the packets of the interactive conversations (running a pty) and of the
+// other ones (e.g. running a command or forwarding connections), as the IPQoS option of OpenSSH.
+// The values are the type of service (IPv4) or traffic class (IPv6) byte, i.e. the DSCP shifted
+// left by 2 bits.
+type IPQoS struct {
+	Interactive uint8
+	Bulk        uint8
+}
+
+// the names of the DSCP code points and of the legacy type of service values accepted by OpenSSH
+var trafficClassNames = map[string]uint8{
+	"af11": 10 << 2, "af12": 12 << 2, "af13": 14 << 2,
+	"af21": 18 << 2, "af22": 20 << 2, "af23": 22 << 2,
+	"af31": 26 << 2, "af32": 28 << 2, "af33": 30 << 2,
+	"af41": 34 << 2, "af42": 36 << 2, "af43": 38 << 2,
+	"cs0": 0, "cs1": 8 << 2, "cs2": 16 << 2, "cs3": 24 << 2,
+	"cs4": 32 << 2, "cs5": 40 << 2, "cs6": 48 << 2, "cs7": 56 << 2,
+	"ef": 46 << 2, "le": 1 << 2,
+	"lowdelay": 0x10, "throughput": 0x08, "reliability": 0x04,
+	"none": 0,
+}
+
+// ParseTrafficClass parses a DSCP name (e.g. "af21", "cs1" or "ef"), a legacy type of service name
+// (e.g. "lowdelay") or a number, the type of service byte itself (e.g. "0x48")
+func ParseTrafficClass(value string) (uint8, error) {
+	if class, ok := trafficClassNames[strings.ToLower(value)]; ok {
+		return class, nil
+	}
+	class, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid traffic class %q: expected a DSCP name such as af21, cs1 or ef, or the type of service byte", value)
+	}
+	return uint8(class), nil
+}
+
+// ParseIPQoS parses the traffic class of the interactive conversations optionally followed by the
+// one of the other conversations, separated by a space or a comma (e.g. "af21 cs1"). A single
+// value applies to both.
+func ParseIPQoS(value string) (IPQoS, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) == 0 || len(fields) > 2 {
+		return IPQoS{}, fmt.Errorf("invalid IPQoS %q: expected the traffic class of the interactive conversations, optionally followed by the one of the other conversations", value)
+	}
+	interactive, err := ParseTrafficClass(fields[0])
+	if err != nil {
+		return IPQoS{}, err
+	}
+	bulk := interactive
+	if len(fields) == 2 {
+		if bulk, err = ParseTrafficClass(fields[1]); err != nil {
+			return IPQoS{}, err
+		}
+	}
+	return IPQoS{Interactive: interactive, Bulk: bulk}, nil
+}
+
+// SetTrafficClass marks the packets sent on conn with class, as the type of service of IPv4 and
+// the traffic class of IPv6 so that the dual-stack sockets mark both
+func SetTrafficClass(conn *net.UDPConn, class uint8) error {
+	errIPv4 := ipv4.NewConn(conn).SetTOS(int(class))
+	errIPv6 := ipv6.NewConn(conn).SetTrafficClass(int(class))
+	if errIPv4 != nil && errIPv6 != nil {
+		return fmt.Errorf("could not set the traffic class of the socket: %w", errors.Join(errIPv4, errIPv6))
+	}
+	return nil
+}
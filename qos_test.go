@@ -0,0 +1,47 @@
+package ssh3_test
+
+import (
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IPQoS", func() {
+	It("Parses the DSCP names and the type of service bytes", func() {
+		for value, expected := range map[string]uint8{"af21": 0x48, "CS1": 0x20, "ef": 0xb8, "lowdelay": 0x10, "none": 0, "0x48": 0x48, "32": 32} {
+			class, err := ssh3.ParseTrafficClass(value)
+			Expect(err).ToNot(HaveOccurred(), value)
+			Expect(class).To(Equal(expected), value)
+		}
+		for _, invalid := range []string{"", "af5", "256", "-1"} {
+			_, err := ssh3.ParseTrafficClass(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("Parses the interactive and bulk classes", func() {
+		ipQoS, err := ssh3.ParseIPQoS("af21 cs1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ipQoS).To(Equal(ssh3.IPQoS{Interactive: 0x48, Bulk: 0x20}))
+		ipQoS, err = ssh3.ParseIPQoS("ef")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ipQoS).To(Equal(ssh3.IPQoS{Interactive: 0xb8, Bulk: 0xb8}))
+		for _, invalid := range []string{"", "af21,cs1,ef", "af21 bulk"} {
+			_, err := ssh3.ParseIPQoS(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("Marks the UDP sockets", func() {
+		conn, err := ssh3.TransportConfig{TrafficClass: "af21"}.ListenUDP("127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(ssh3.SetTrafficClass(conn, 0x20)).To(Succeed())
+	})
+
+	It("Rejects the invalid traffic classes in the transport config", func() {
+		Expect(ssh3.TransportConfig{TrafficClass: "cs1"}.Validate()).To(Succeed())
+		Expect(ssh3.TransportConfig{TrafficClass: "bulk"}.Validate()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,161 @@
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const FileExtension = ".cast"
+
+// the asciicast v2 header, see https://docs.asciinema.org/manual/asciicast/v2/
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint64            `json:"width"`
+	Height    uint64            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	// the wall-clock time at which the recording started with a nanosecond precision, the events
+	// being timed using a monotonic clock: the recordings of related sessions can be synchronized
+	// even if the system clock is adjusted while they run
+	Start *time.Time `json:"ssh3_start,omitempty"`
+}
+
+// Recorder writes the output of a session in the asciicast v2 format,
+// each event being timed relatively to the creation of the recorder
+type Recorder struct {
+	lock  sync.Mutex
+	w     io.WriteCloser
+	start time.Time
+	// the beginning of an UTF-8 sequence split between two outputs
+	pending []byte
+}
+
+func NewAsciicastRecorder(w io.WriteCloser, width, height uint64, title string, env map[string]string) (*Recorder, error) {
+	start := time.Now()
+	// strips the monotonic clock reading, only meaningful to this process
+	anchor := start.Round(0).UTC()
+	encoded, err := json.Marshal(Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       env,
+		Start:     &anchor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(encoded, '\n')); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w, start: start}, nil
+}
+
+// OpenAsciicastFile creates the file <dir>/<username>/<conversationID>_<channelID>.cast
+func OpenAsciicastFile(dir string, username string, conversationID string, channelID uint64) (*os.File, error) {
+	if username == "" || strings.ContainsAny(username, `/\`) || username == "." || username == ".." {
+		return nil, fmt.Errorf("invalid username for a recording directory: %q", username)
+	}
+	userDir := filepath.Join(dir, username)
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(userDir, fmt.Sprintf("%s_%d%s", conversationID, channelID, FileExtension))
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// CreateAsciicastFile records in <dir>/<username>/<conversationID>_<channelID>.cast
+func CreateAsciicastFile(dir string, username string, conversationID string, channelID uint64, width, height uint64, title string, env map[string]string) (*Recorder, error) {
+	file, err := OpenAsciicastFile(dir, username, conversationID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := NewAsciicastRecorder(file, width, height, title, env)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recorder, nil
+}
+
+// returns the length of the longest prefix of data ending on a complete UTF-8 sequence
+func completeUTF8Prefix(data []byte) int {
+	// an UTF-8 sequence is at most utf8.UTFMax bytes long
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return len(data)
+			}
+			return i
+		}
+	}
+	return len(data)
+}
+
+// Output records data written by the session. asciicast events contain UTF-8 strings,
+// so a sequence split between two outputs is only recorded once complete.
+func (r *Recorder) Output(data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	data = append(r.pending, data...)
+	complete := completeUTF8Prefix(data)
+	r.pending = append([]byte{}, data[complete:]...)
+	if complete == 0 {
+		return nil
+	}
+	return r.writeEvent("o", data[:complete])
+}
+
+func (r *Recorder) writeEvent(eventType string, data []byte) error {
+	elapsed := time.Since(r.start).Seconds()
+	encoded, err := json.Marshal([]interface{}{elapsed, eventType, string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(append(encoded, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.pending) > 0 {
+		// invalid sequences are replaced by U+FFFD when encoded
+		r.writeEvent("o", r.pending)
+		r.pending = nil
+	}
+	return r.w.Close()
+}
+
+// RemoveExpired removes the recordings of dir that were last modified more than retention ago
+func RemoveExpired(dir string, retention time.Duration) error {
+	expiration := time.Now().Add(-retention)
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != FileExtension {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(expiration) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,111 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+var _ = Describe("asciicast recordings", func() {
+	var buf *bufferCloser
+	var recorder *Recorder
+
+	BeforeEach(func() {
+		buf = &bufferCloser{}
+		var err error
+		recorder, err = NewAsciicastRecorder(buf, 120, 40, "bash", map[string]string{"TERM": "xterm"})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	lines := func() []string {
+		return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	events := func() [][]interface{} {
+		var events [][]interface{}
+		for _, line := range lines()[1:] {
+			var event []interface{}
+			Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+			Expect(event).To(HaveLen(3))
+			events = append(events, event)
+		}
+		return events
+	}
+
+	It("Writes the header", func() {
+		var header Header
+		Expect(json.Unmarshal([]byte(lines()[0]), &header)).To(Succeed())
+		Expect(header.Version).To(Equal(2))
+		Expect(header.Width).To(BeEquivalentTo(120))
+		Expect(header.Height).To(BeEquivalentTo(40))
+		Expect(header.Title).To(Equal("bash"))
+		Expect(header.Env).To(Equal(map[string]string{"TERM": "xterm"}))
+		Expect(time.Unix(header.Timestamp, 0)).To(BeTemporally("~", time.Now(), 5*time.Second))
+	})
+
+	It("Records timed outputs", func() {
+		Expect(recorder.Output([]byte("hello\r\n"))).To(Succeed())
+		time.Sleep(20 * time.Millisecond)
+		Expect(recorder.Output([]byte("world"))).To(Succeed())
+		Expect(recorder.Close()).To(Succeed())
+		Expect(buf.closed).To(BeTrue())
+
+		recorded := events()
+		Expect(recorded).To(HaveLen(2))
+		Expect(recorded[0][1:]).To(Equal([]interface{}{"o", "hello\r\n"}))
+		Expect(recorded[1][1:]).To(Equal([]interface{}{"o", "world"}))
+		Expect(recorded[1][0]).To(BeNumerically(">=", recorded[0][0].(float64)+0.02))
+	})
+
+	It("Does not split UTF-8 sequences between events", func() {
+		data := []byte("é€")
+		Expect(recorder.Output(data[:1])).To(Succeed())
+		Expect(recorder.Output(data[1:3])).To(Succeed())
+		Expect(recorder.Output(data[3:])).To(Succeed())
+		Expect(recorder.Close()).To(Succeed())
+
+		recorded := events()
+		Expect(recorded).To(HaveLen(2))
+		Expect(recorded[0][2]).To(Equal("é"))
+		Expect(recorded[1][2]).To(Equal("€"))
+	})
+
+	It("Removes the expired recordings", func() {
+		dir := GinkgoT().TempDir()
+		recorder, err := CreateAsciicastFile(dir, "alice", "conv", 4, 80, 24, "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorder.Close()).To(Succeed())
+		recent := filepath.Join(dir, "alice", "conv_4.cast")
+		Expect(recent).To(BeAnExistingFile())
+
+		expired := filepath.Join(dir, "alice", "old_4.cast")
+		Expect(os.WriteFile(expired, nil, 0600)).To(Succeed())
+		old := time.Now().Add(-48 * time.Hour)
+		Expect(os.Chtimes(expired, old, old)).To(Succeed())
+
+		Expect(RemoveExpired(dir, 24*time.Hour)).To(Succeed())
+		Expect(recent).To(BeAnExistingFile())
+		Expect(expired).ToNot(BeAnExistingFile())
+	})
+
+	It("Refuses usernames escaping the recordings directory", func() {
+		_, err := CreateAsciicastFile(GinkgoT().TempDir(), "../alice", "conv", 4, 80, 24, "", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
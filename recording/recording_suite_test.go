@@ -0,0 +1,13 @@
+package recording
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRecording(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Recording Suite")
+}
@@ -0,0 +1,209 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event is an event of an asciicast recording, timed in seconds relatively to its start
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+type Recording struct {
+	Header Header
+	Events []Event
+}
+
+type InvalidRecording struct {
+	Line   int
+	Reason string
+}
+
+func (e InvalidRecording) Error() string {
+	return fmt.Sprintf("invalid asciicast recording at line %d: %s", e.Line, e.Reason)
+}
+
+// Read parses an asciicast v2 recording
+func Read(r io.Reader) (*Recording, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	recording := &Recording{}
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &recording.Header); err != nil {
+				return nil, InvalidRecording{Line: line, Reason: err.Error()}
+			}
+			if recording.Header.Version != 2 {
+				return nil, InvalidRecording{Line: line, Reason: fmt.Sprintf("unsupported asciicast version %d", recording.Header.Version)}
+			}
+			continue
+		}
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var fields []json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return nil, InvalidRecording{Line: line, Reason: err.Error()}
+		}
+		if len(fields) != 3 {
+			return nil, InvalidRecording{Line: line, Reason: fmt.Sprintf("expected 3 fields, got %d", len(fields))}
+		}
+		var event Event
+		for i, field := range []interface{}{&event.Time, &event.Type, &event.Data} {
+			if err := json.Unmarshal(fields[i], field); err != nil {
+				return nil, InvalidRecording{Line: line, Reason: err.Error()}
+			}
+		}
+		recording.Events = append(recording.Events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, InvalidRecording{Line: 1, Reason: "missing header"}
+	}
+	return recording, nil
+}
+
+// Start returns the wall-clock time at which the recording started. The recordings that do
+// not carry an anchor are only precise to the second.
+func (r *Recording) Start() time.Time {
+	if r.Header.Start != nil {
+		return *r.Header.Start
+	}
+	return time.Unix(r.Header.Timestamp, 0).UTC()
+}
+
+// SyncedEvent is an event of one of several synchronized recordings
+type SyncedEvent struct {
+	// the index of the recording of the event
+	Recording int
+	Time      time.Time
+	Event
+}
+
+// Synchronize returns the events of all the recordings ordered by their wall-clock time
+func Synchronize(recordings []*Recording) []SyncedEvent {
+	var events []SyncedEvent
+	for i, recording := range recordings {
+		start := recording.Start()
+		for _, event := range recording.Events {
+			events = append(events, SyncedEvent{
+				Recording: i,
+				Time:      start.Add(time.Duration(event.Time * float64(time.Second))),
+				Event:     event,
+			})
+		}
+	}
+	// the events of a same recording keep their order, the events of the recordings are
+	// interleaved as they happened
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
+
+const tabWidth = 8
+
+// LineSplitter turns the output of a terminal session into lines of plain text, dropping the
+// escape sequences and applying the carriage returns and backspaces, e.g. to display several
+// sessions next to each other
+type LineSplitter struct {
+	line []rune
+	// the escape sequence being skipped, possibly split across several outputs
+	escape []byte
+	// the beginning of an UTF-8 sequence split across two outputs
+	pending []byte
+	// the next characters overwrite the line (e.g. a progress bar), unless a newline follows
+	carriageReturn bool
+}
+
+// Write returns the lines completed by data
+func (s *LineSplitter) Write(data string) []string {
+	var lines []string
+	buf := append(s.pending, data...)
+	s.pending = nil
+	for len(buf) > 0 {
+		if len(s.escape) > 0 {
+			s.escape = append(s.escape, buf[0])
+			buf = buf[1:]
+			if escapeSequenceComplete(s.escape) {
+				s.escape = nil
+			}
+			continue
+		}
+		if !utf8.FullRune(buf) {
+			s.pending = append([]byte{}, buf...)
+			break
+		}
+		r, size := utf8.DecodeRune(buf)
+		buf = buf[size:]
+		if s.carriageReturn && r != '\n' && r != '\r' {
+			s.line = s.line[:0]
+		}
+		s.carriageReturn = false
+		switch r {
+		case '\x1b':
+			s.escape = []byte{'\x1b'}
+		case '\n':
+			lines = append(lines, string(s.line))
+			s.line = s.line[:0]
+		case '\r':
+			s.carriageReturn = true
+		case '\b':
+			if len(s.line) > 0 {
+				s.line = s.line[:len(s.line)-1]
+			}
+		case '\t':
+			for {
+				s.line = append(s.line, ' ')
+				if len(s.line)%tabWidth == 0 {
+					break
+				}
+			}
+		default:
+			if r >= ' ' && r != '\x7f' {
+				s.line = append(s.line, r)
+			}
+		}
+	}
+	return lines
+}
+
+// Flush returns the last incomplete line
+func (s *LineSplitter) Flush() string {
+	line := string(s.line)
+	s.line = s.line[:0]
+	return line
+}
+
+// returns true once the escape sequence ends: CSI sequences end with a final byte, OSC
+// sequences with BEL or ST and the other ones after a single character
+func escapeSequenceComplete(sequence []byte) bool {
+	if len(sequence) < 2 {
+		return false
+	}
+	last := sequence[len(sequence)-1]
+	switch sequence[1] {
+	case '[':
+		return len(sequence) > 2 && last >= 0x40 && last <= 0x7e
+	case ']', 'P', '_', '^':
+		return last == '\a' || (last == '\\' && sequence[len(sequence)-2] == '\x1b')
+	case '(', ')', '*', '+':
+		// designates a character set
+		return len(sequence) > 2
+	default:
+		return true
+	}
+}
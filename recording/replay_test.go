@@ -0,0 +1,71 @@
+package recording
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session replay", func() {
+	It("Reads the recordings it wrote", func() {
+		buf := &bufferCloser{}
+		recorder, err := NewAsciicastRecorder(buf, 120, 40, "bash", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorder.Output([]byte("hello\r\n"))).To(Succeed())
+		Expect(recorder.Close()).To(Succeed())
+
+		recording, err := Read(strings.NewReader(buf.String()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recording.Header.Title).To(Equal("bash"))
+		Expect(recording.Header.Start).ToNot(BeNil())
+		Expect(recording.Start()).To(BeTemporally("~", time.Now(), 5*time.Second))
+		Expect(recording.Events).To(HaveLen(1))
+		Expect(recording.Events[0].Type).To(Equal("o"))
+		Expect(recording.Events[0].Data).To(Equal("hello\r\n"))
+	})
+
+	It("Refuses invalid recordings", func() {
+		_, err := Read(strings.NewReader(`{"version": 1}`))
+		Expect(err).To(Equal(InvalidRecording{Line: 1, Reason: "unsupported asciicast version 1"}))
+		_, err = Read(strings.NewReader("{\"version\": 2}\n[0.5, \"o\"]\n"))
+		Expect(err).To(Equal(InvalidRecording{Line: 2, Reason: "expected 3 fields, got 2"}))
+		_, err = Read(strings.NewReader(""))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Orders the events of several recordings by their wall-clock time", func() {
+		first, err := Read(strings.NewReader(`{"version": 2, "timestamp": 1700000000, "ssh3_start": "2023-11-14T22:13:20.5Z"}
+[0.1, "o", "a1"]
+[1.0, "o", "a2"]
+`))
+		Expect(err).ToNot(HaveOccurred())
+		// recorded by an older server, only precise to the second
+		second, err := Read(strings.NewReader(`{"version": 2, "timestamp": 1700000000}
+[0.7, "o", "b1"]
+[0.7, "o", "b2"]
+[2.0, "o", "b3"]
+`))
+		Expect(err).ToNot(HaveOccurred())
+
+		var order []string
+		for _, event := range Synchronize([]*Recording{first, second}) {
+			order = append(order, event.Data)
+		}
+		Expect(order).To(Equal([]string{"a1", "b1", "b2", "a2", "b3"}))
+		Expect(Synchronize([]*Recording{first, second})[3].Time).To(Equal(time.Date(2023, 11, 14, 22, 13, 21, 500000000, time.UTC)))
+	})
+
+	It("Turns the output of the terminal into plain text lines", func() {
+		splitter := &LineSplitter{}
+		Expect(splitter.Write("\x1b[1;32muser@host\x1b[0m:~$ ls\r\n")).To(Equal([]string{"user@host:~$ ls"}))
+		// the sequences may be split across outputs
+		Expect(splitter.Write("\x1b]0;title")).To(BeEmpty())
+		Expect(splitter.Write("\a10%\r")).To(BeEmpty())
+		Expect(splitter.Write("100%\r\n")).To(Equal([]string{"100%"}))
+		Expect(splitter.Write("a\tb\bc\r\nd\r\n\xc3")).To(Equal([]string{"a       c", "d"}))
+		Expect(splitter.Write("\xa9")).To(BeEmpty())
+		Expect(splitter.Flush()).To(Equal("é"))
+	})
+})
@@ -0,0 +1,181 @@
+package ssh3
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/rs/zerolog/log"
+)
+
+// FeatureRequestReplies is the ExtInfo feature of the peers replying to the channel requests sent
+// with WantReply, with a ChannelSuccessMessage or a ChannelFailureMessage, see
+// SendRequestWaitReply
+const FeatureRequestReplies = "request-replies"
+
+// RequestFailure is returned when the peer refused a channel request or could not handle it,
+// e.g. a pty request on a server running out of ptys
+type RequestFailure struct {
+	RequestType string
+}
+
+func (f RequestFailure) Error() string {
+	return fmt.Sprintf("the peer refused the %s request", f.RequestType)
+}
+
+// SendRequestWaitReply sends r and waits for the reply of the peer until ctx is done, returning a
+// RequestFailure if the peer refused it. It returns an UnsupportedFeature once r is sent if the
+// peer did not advertise FeatureRequestReplies, the older peers never replying.
+func SendRequestWaitReply(ctx context.Context, channel Channel, peer *ExtInfo, r *ssh3Messages.ChannelRequestMessage) error {
+	if !peer.HasFeature(FeatureRequestReplies) {
+		if err := channel.SendRequestContext(ctx, r); err != nil {
+			return err
+		}
+		return UnsupportedFeature{Feature: "request_replies"}
+	}
+	return channel.SendRequestWaitReply(ctx, r)
+}
+
+// ReplyRequest replies to a request sent with WantReply by a peer that advertised
+// FeatureRequestReplies, the replies being sent in the order of the requests
+func ReplyRequest(channel Channel, success bool) error {
+	var reply ssh3Messages.Message = &ssh3Messages.ChannelFailureMessage{}
+	if success {
+		reply = &ssh3Messages.ChannelSuccessMessage{}
+	}
+	_, err := channel.MessageWriter().WriteMessage(reply)
+	return err
+}
+
+// a message read while waiting for a reply, handed over by the next call to NextMessage
+type receivedMessage struct {
+	message ssh3Messages.Message
+	err     error
+}
+
+// requestReplies routes the replies of the peer to the requests waiting for them, in the order
+// of the requests
+type requestReplies struct {
+	mutex   sync.Mutex
+	waiting []chan bool
+	pending []receivedMessage
+}
+
+// returns the channel receiving the reply to the next request sent
+func (r *requestReplies) wait() chan bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reply := make(chan bool, 1)
+	r.waiting = append(r.waiting, reply)
+	return reply
+}
+
+// stops waiting for a reply to a request that could not be sent
+func (r *requestReplies) cancel(reply chan bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, waiting := range r.waiting {
+		if waiting == reply {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// hands over a reply to the oldest request, returning false if no request waits for it
+func (r *requestReplies) deliver(success bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.waiting) == 0 {
+		return false
+	}
+	r.waiting[0] <- success
+	r.waiting = r.waiting[1:]
+	return true
+}
+
+func (r *requestReplies) addPending(message ssh3Messages.Message, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending = append(r.pending, receivedMessage{message: message, err: err})
+}
+
+func (r *requestReplies) popPending() (receivedMessage, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pending) == 0 {
+		return receivedMessage{}, false
+	}
+	message := r.pending[0]
+	r.pending = r.pending[1:]
+	return message, true
+}
+
+// SendRequestWaitReply sends r with WantReply and waits for the reply of the peer until ctx is
+// done. If no one reads the messages of the channel meanwhile, it reads them itself, the other
+// messages being returned by the next calls to NextMessage. The peer must have advertised
+// FeatureRequestReplies, see the SendRequestWaitReply function.
+func (c *channelImpl) SendRequestWaitReply(ctx context.Context, r *ssh3Messages.ChannelRequestMessage) error {
+	reply := c.replies.wait()
+	request := *r
+	request.WantReply = true
+	if err := c.SendRequestContext(ctx, &request); err != nil {
+		c.replies.cancel(reply)
+		return err
+	}
+	for {
+		select {
+		case success := <-reply:
+			if !success {
+				return RequestFailure{RequestType: r.ChannelRequest.RequestTypeStr()}
+			}
+			return nil
+		case <-ctx.Done():
+			// the reply stays expected, so that it is not taken for the one of the next request
+			return ctx.Err()
+		case c.readToken <- struct{}{}:
+			read := make(chan error, 1)
+			go func() {
+				defer func() { <-c.readToken }()
+				// a single message is read, so that the channel is not read once the reply arrived
+				message, err := c.readMessage()
+				if err != nil || !c.receiveReply(message) {
+					c.replies.addPending(message, err)
+				}
+				read <- err
+			}()
+			select {
+			case success := <-reply:
+				if !success {
+					return RequestFailure{RequestType: r.ChannelRequest.RequestTypeStr()}
+				}
+				return nil
+			case err := <-read:
+				if err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// hands over message to the request waiting for it if it is a reply, dropping the unexpected
+// ones. It returns false if message is not a reply.
+func (c *channelImpl) receiveReply(message ssh3Messages.Message) bool {
+	var success bool
+	switch message.(type) {
+	case *ssh3Messages.ChannelSuccessMessage:
+		success = true
+	case *ssh3Messages.ChannelFailureMessage:
+		success = false
+	default:
+		return false
+	}
+	if !c.replies.deliver(success) {
+		log.Debug().Msgf("dropping unexpected request reply on %s channel %d", c.ChannelType(), c.ChannelID())
+	}
+	return true
+}
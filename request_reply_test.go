@@ -0,0 +1,158 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/quic-go/quic-go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// the receiving end of a channel, reading what the other end writes in the pipe
+type pipeReceiveStream struct {
+	quic.ReceiveStream
+	*io.PipeReader
+}
+
+func (s pipeReceiveStream) Read(p []byte) (int, error) {
+	return s.PipeReader.Read(p)
+}
+
+var _ = Describe("Request replies", func() {
+	peer := &ssh3.ExtInfo{Features: []string{ssh3.FeatureRequestReplies}}
+
+	// returns a channel receiving the messages sent by the peer and writing its own in sent
+	channelWithPeer := func(sent *bytes.Buffer, messages ...ssh3Messages.Message) ssh3.Channel {
+		stream := &bytes.Buffer{}
+		_, err := ssh3.NewMessageWriter(stream).WriteMessages(messages...)
+		Expect(err).ToNot(HaveOccurred())
+		return ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, bufferReceiveStream{Buffer: stream}, nopCloser{sent}, nil, nil, false, true, true, 0, nil)
+	}
+
+	// returns the messages written in sent
+	sentMessages := func(sent *bytes.Buffer) []ssh3Messages.Message {
+		var messages []ssh3Messages.Message
+		for sent.Len() > 0 {
+			message, err := ssh3Messages.ParseMessage(sent)
+			Expect(err).ToNot(HaveOccurred())
+			messages = append(messages, message)
+		}
+		return messages
+	}
+
+	It("Waits for the reply while keeping the other messages", func() {
+		sent := &bytes.Buffer{}
+		channel := channelWithPeer(sent,
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello"},
+			&ssh3Messages.ChannelFailureMessage{},
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "bye"},
+		)
+		err := ssh3.SendRequestWaitReply(context.Background(), channel, peer, &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.PtyRequest{Term: "xterm"}})
+		Expect(err).To(MatchError(ssh3.RequestFailure{RequestType: "pty-req"}))
+		request := sentMessages(sent)[0].(*ssh3Messages.ChannelRequestMessage)
+		Expect(request.WantReply).To(BeTrue())
+
+		message, err := channel.NextMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.(*ssh3Messages.DataOrExtendedDataMessage).Data).To(Equal("hello"))
+		message, err = channel.NextMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.(*ssh3Messages.DataOrExtendedDataMessage).Data).To(Equal("bye"))
+	})
+
+	It("Does not wait for the older peers", func() {
+		sent := &bytes.Buffer{}
+		channel := channelWithPeer(sent)
+		err := ssh3.SendRequestWaitReply(context.Background(), channel, nil, &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &ssh3Messages.ShellRequest{}})
+		Expect(errors.As(err, &ssh3.UnsupportedFeature{})).To(BeTrue())
+		Expect(sentMessages(sent)).To(HaveLen(1))
+	})
+
+	It("Gives up when the context is done", func() {
+		channel := channelWithPeer(&bytes.Buffer{},
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello"},
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := channel.SendRequestWaitReply(ctx, &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.ShellRequest{}})
+		Expect(err).To(MatchError(context.Canceled))
+	})
+
+	It("Attributes the replies to their requests when a request is refused", func() {
+		toServer, fromClient := io.Pipe()
+		toClient, fromServer := io.Pipe()
+		client := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, pipeReceiveStream{PipeReader: toClient}, fromClient, nil, nil, false, true, true, 0, nil)
+		server := ssh3.NewChannel(0, ssh3.ConversationID{}, 4, "session", 30000, pipeReceiveStream{PipeReader: toServer}, fromServer, nil, nil, false, true, true, 0, nil)
+		defer fromClient.Close()
+		defer fromServer.Close()
+
+		dispatcher := ssh3.NewChannelDispatcher()
+		dispatcher.ReplyToRequests(peer)
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.WorkingDirectoryRequest, wantReply bool) error {
+			return errors.New("no such directory")
+		})
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.ExecRequest, wantReply bool) error {
+			_, err := c.WriteData([]byte("output"), ssh3Messages.SSH_EXTENDED_DATA_NONE)
+			return err
+		})
+		go func() {
+			defer GinkgoRecover()
+			for {
+				message, err := server.NextMessage()
+				if err != nil {
+					return
+				}
+				dispatcher.Dispatch(context.Background(), server, message)
+			}
+		}()
+
+		ctx := context.Background()
+		err := ssh3.SendRequestWaitReply(ctx, client, peer, &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.WorkingDirectoryRequest{Directory: "/nonexistent"}})
+		Expect(err).To(MatchError(ssh3.RequestFailure{RequestType: "working-directory"}))
+		Expect(ssh3.SendRequestWaitReply(ctx, client, peer, &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.ExecRequest{Command: "ls"}})).To(Succeed())
+		// the output sent before the reply is kept
+		message, err := client.NextMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(message.(*ssh3Messages.DataOrExtendedDataMessage).Data).To(Equal("output"))
+	})
+
+	It("Replies to the requests dispatched", func() {
+		sent := &bytes.Buffer{}
+		channel := channelWithPeer(sent)
+		dispatcher := ssh3.NewChannelDispatcher()
+		dispatcher.ReplyToRequests(peer)
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.PtyRequest, wantReply bool) error {
+			return nil
+		})
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.ExecRequest, wantReply bool) error {
+			return errors.New("exec failed")
+		})
+		ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, c ssh3.Channel, request *ssh3Messages.WindowChangeRequest, wantReply bool) error {
+			return nil
+		})
+
+		ctx := context.Background()
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &ssh3Messages.PtyRequest{}})).To(Succeed())
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &ssh3Messages.ExecRequest{Command: "ls"}})).ToNot(Succeed())
+		// without handler
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &ssh3Messages.ShellRequest{}})).To(Succeed())
+		// without WantReply
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelRequestMessage{ChannelRequest: &ssh3Messages.WindowChangeRequest{}})).To(Succeed())
+		Expect(sentMessages(sent)).To(Equal([]ssh3Messages.Message{
+			&ssh3Messages.ChannelSuccessMessage{},
+			&ssh3Messages.ChannelFailureMessage{},
+			&ssh3Messages.ChannelFailureMessage{},
+		}))
+
+		// the peers that did not advertise the feature get no reply
+		dispatcher.ReplyToRequests(nil)
+		Expect(dispatcher.Dispatch(ctx, channel, &ssh3Messages.ChannelRequestMessage{WantReply: true, ChannelRequest: &ssh3Messages.PtyRequest{}})).To(Succeed())
+		Expect(sent.Len()).To(BeZero())
+	})
+})
@@ -41,6 +41,7 @@ func (m *conversationsManager) removeConversation(conversation *Conversation) {
 type channelsManager struct {
 	channels            map[util.ChannelID]Channel
 	danglingDgramQueues map[util.ChannelID]*util.DatagramsQueue
+	messageTracer       MessageTracer
 	lock                sync.Mutex
 }
 
@@ -55,6 +56,9 @@ func (m *channelsManager) addChannel(channel Channel) {
 		channel.setDgramQueue(dgramsQueue)
 		delete(m.danglingDgramQueues, channel.ChannelID())
 	}
+	if m.messageTracer != nil {
+		channel.setMessageTracer(m.messageTracer)
+	}
 	m.channels[util.ChannelID(channel.ChannelID())] = channel
 }
 
@@ -72,6 +76,12 @@ func (m *channelsManager) addDanglingDatagramsQueue(id util.ChannelID, queue *ut
 	}
 }
 
+func (m *channelsManager) setMessageTracer(tracer MessageTracer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messageTracer = tracer
+}
+
 func (m *channelsManager) getChannel(id util.ChannelID) (Channel, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -79,6 +89,16 @@ func (m *channelsManager) getChannel(id util.ChannelID) (Channel, bool) {
 	return channel, ok
 }
 
+func (m *channelsManager) getChannels() []Channel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	channels := make([]Channel, 0, len(m.channels))
+	for _, channel := range m.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
 func (m *channelsManager) removeChannel(channel Channel) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
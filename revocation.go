@@ -0,0 +1,236 @@
+package ssh3
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationPolicy tells what to do with the certificates whose revocation status cannot be
+// determined, e.g. because the OCSP responder is unreachable. The certificates known to be
+// revoked, by a CRL file or an OCSP response, are always refused.
+type RevocationPolicy string
+
+const (
+	// only the CRL files and the stapled OCSP responses are checked, the OCSP responders are not
+	// queried
+	RevocationCheckOff RevocationPolicy = "off"
+	// the OCSP responders are queried, the certificates are accepted if their status cannot be
+	// determined
+	RevocationSoftFail RevocationPolicy = "soft-fail"
+	// the OCSP responders are queried, the certificates are refused if their status cannot be
+	// determined
+	RevocationHardFail RevocationPolicy = "hard-fail"
+)
+
+// ParseRevocationPolicy parses "off", "soft-fail" or "hard-fail", the empty string being "off"
+func ParseRevocationPolicy(policy string) (RevocationPolicy, error) {
+	switch RevocationPolicy(policy) {
+	case "", RevocationCheckOff:
+		return RevocationCheckOff, nil
+	case RevocationSoftFail, RevocationHardFail:
+		return RevocationPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown revocation policy %q, expected off, soft-fail or hard-fail", policy)
+}
+
+// the maximum size of the OCSP responses
+const maxOCSPResponseSize = 1 << 20
+
+type CertificateRevoked struct {
+	Subject string
+	Serial  *big.Int
+	// "CRL" or "OCSP"
+	Source string
+}
+
+func (e CertificateRevoked) Error() string {
+	return fmt.Sprintf("the certificate %q (serial %s) has been revoked according to its %s", e.Subject, e.Serial, e.Source)
+}
+
+// UnknownRevocationStatus refuses the certificates whose revocation status could not be determined
+// under the hard-fail policy
+type UnknownRevocationStatus struct {
+	Subject string
+	Err     error
+}
+
+func (e UnknownRevocationStatus) Error() string {
+	return fmt.Sprintf("could not determine the revocation status of the certificate %q: %s", e.Subject, e.Err)
+}
+
+func (e UnknownRevocationStatus) Unwrap() error {
+	return e.Err
+}
+
+// RevocationChecker checks the revocation status of the certificates using CRLs and OCSP
+type RevocationChecker struct {
+	Policy RevocationPolicy
+	// the CRLs of the certificate authorities, each one is only used for the certificates issued
+	// by the authority that signed it
+	CRLs []*x509.RevocationList
+	// queries the OCSP responders, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// LoadCRLFiles parses the CRLs, given in DER or in PEM, several PEM CRLs being allowed per file
+func LoadCRLFiles(filenames []string) ([]*x509.RevocationList, error) {
+	var crls []*x509.RevocationList
+	for _, filename := range filenames {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Contains(content, []byte("-----BEGIN")) {
+			crl, err := x509.ParseRevocationList(content)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CRL %s: %w", filename, err)
+			}
+			crls = append(crls, crl)
+			continue
+		}
+		for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CRL %s: %w", filename, err)
+			}
+			crls = append(crls, crl)
+		}
+	}
+	return crls, nil
+}
+
+// Check checks the revocation status of the verified chain, leaf first. Every certificate is
+// looked up in the CRLs but only the status of the leaf is queried using OCSP, ocspStaple being
+// the OCSP response stapled to the leaf during the TLS handshake, if any.
+func (c *RevocationChecker) Check(ctx context.Context, chain []*x509.Certificate, ocspStaple []byte) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		determined, err := c.checkCRLs(cert, issuer)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			continue
+		}
+		if len(ocspStaple) > 0 {
+			response, err := ocsp.ParseResponseForCert(ocspStaple, cert, issuer)
+			if err != nil {
+				log.Warn().Msgf("ignoring the invalid OCSP staple of %q: %s", cert.Subject, err)
+			} else if good, err := checkOCSPResponse(cert, response); err != nil {
+				return err
+			} else {
+				determined = good
+			}
+		}
+		if determined || c.Policy == RevocationCheckOff || c.Policy == "" {
+			continue
+		}
+		var queryErr error
+		if len(cert.OCSPServer) == 0 {
+			queryErr = fmt.Errorf("no CRL covers it and it has no OCSP responder")
+		} else {
+			var response *ocsp.Response
+			response, _, queryErr = FetchOCSPResponse(ctx, c.HTTPClient, cert, issuer)
+			if queryErr == nil {
+				if good, err := checkOCSPResponse(cert, response); err != nil {
+					return err
+				} else if !good {
+					queryErr = fmt.Errorf("the OCSP responder %s gave no current status", cert.OCSPServer[0])
+				}
+			}
+		}
+		if queryErr == nil {
+			continue
+		}
+		if c.Policy == RevocationHardFail {
+			return UnknownRevocationStatus{Subject: cert.Subject.String(), Err: queryErr}
+		}
+		log.Warn().Msgf("accepting the certificate %q whose revocation status could not be determined: %s", cert.Subject, queryErr)
+	}
+	return nil
+}
+
+// returns whether a CRL signed by the issuer of cert and still valid determines its status
+func (c *RevocationChecker) checkCRLs(cert *x509.Certificate, issuer *x509.Certificate) (determined bool, err error) {
+	now := time.Now()
+	for _, crl := range c.CRLs {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true, CertificateRevoked{Subject: cert.Subject.String(), Serial: cert.SerialNumber, Source: "CRL"}
+			}
+		}
+		if crl.NextUpdate.IsZero() || now.Before(crl.NextUpdate) {
+			determined = true
+		} else {
+			log.Warn().Msgf("the CRL of %q expired on %s", crl.Issuer, crl.NextUpdate)
+		}
+	}
+	return determined, nil
+}
+
+// returns whether the response tells that cert is not revoked, a CertificateRevoked error if it
+// is. The expired responses tell nothing.
+func checkOCSPResponse(cert *x509.Certificate, response *ocsp.Response) (good bool, err error) {
+	if response.Status == ocsp.Revoked {
+		return false, CertificateRevoked{Subject: cert.Subject.String(), Serial: cert.SerialNumber, Source: "OCSP"}
+	}
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		log.Warn().Msgf("ignoring the OCSP response about %q that expired on %s", cert.Subject, response.NextUpdate)
+		return false, nil
+	}
+	return response.Status == ocsp.Good, nil
+}
+
+// FetchOCSPResponse queries the first OCSP responder of cert using httpClient, or
+// http.DefaultClient if nil, and returns the parsed response along with its DER, e.g. to staple it
+func FetchOCSPResponse(ctx context.Context, httpClient *http.Client, cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, nil, fmt.Errorf("the certificate %q has no OCSP responder", cert.Subject)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+	httpResponse, err := httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("the OCSP responder %s answered %s", cert.OCSPServer[0], httpResponse.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid OCSP response from %s: %w", cert.OCSPServer[0], err)
+	}
+	return response, der, nil
+}
@@ -0,0 +1,194 @@
+package ssh3_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ocsp"
+)
+
+// a certificate authority issuing certificates and answering OCSP requests about them
+type testCA struct {
+	identity
+	nextSerial int64
+	revoked    map[int64]bool
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return &testCA{identity: identity{cert: cert, key: key}, nextSerial: 2, revoked: make(map[int64]bool)}
+}
+
+func (ca *testCA) issue(dnsName string, ocspServer string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.nextSerial),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	ca.nextSerial++
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return cert
+}
+
+func (ca *testCA) crl(revoked ...*x509.Certificate) *x509.RevocationList {
+	template := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now().Add(-time.Minute), NextUpdate: time.Now().Add(time.Hour)}
+	for _, cert := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+	crl, err := x509.ParseRevocationList(der)
+	Expect(err).ToNot(HaveOccurred())
+	return crl
+}
+
+func (ca *testCA) ocspResponse(cert *x509.Certificate) []byte {
+	template := ocsp.Response{SerialNumber: cert.SerialNumber, Status: ocsp.Good, ThisUpdate: time.Now().Add(-time.Minute), NextUpdate: time.Now().Add(time.Hour)}
+	if ca.revoked[cert.SerialNumber.Int64()] {
+		template.Status, template.RevokedAt = ocsp.Revoked, time.Now().Add(-time.Minute)
+	}
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+	return der
+}
+
+// answers the OCSP requests about the certificates issued by ca
+func (ca *testCA) serveOCSP() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		Expect(err).ToNot(HaveOccurred())
+		request, err := ocsp.ParseRequest(body)
+		Expect(err).ToNot(HaveOccurred())
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ca.ocspResponse(&x509.Certificate{SerialNumber: request.SerialNumber}))
+	}))
+}
+
+var _ = Describe("Revocation checks", func() {
+	var ca *testCA
+
+	BeforeEach(func() {
+		ca = newTestCA()
+	})
+
+	check := func(checker *ssh3.RevocationChecker, cert *x509.Certificate, staple []byte) error {
+		return checker.Check(context.Background(), []*x509.Certificate{cert, ca.cert}, staple)
+	}
+
+	It("Refuses the certificates revoked by the CRLs of their issuer", func() {
+		revoked, valid := ca.issue("revoked.example", ""), ca.issue("valid.example", "")
+		otherCA := newTestCA()
+		checker := &ssh3.RevocationChecker{Policy: ssh3.RevocationHardFail, CRLs: []*x509.RevocationList{otherCA.crl(revoked), ca.crl(revoked)}}
+		Expect(check(checker, revoked, nil)).To(MatchError(ssh3.CertificateRevoked{Subject: "CN=revoked.example", Serial: revoked.SerialNumber, Source: "CRL"}))
+		// the CRL determines the status of the certificate without OCSP responder
+		Expect(check(checker, valid, nil)).To(Succeed())
+		// the CRLs signed by another authority are not used
+		checker.CRLs = checker.CRLs[:1]
+		Expect(check(checker, revoked, nil)).To(BeAssignableToTypeOf(ssh3.UnknownRevocationStatus{}))
+	})
+
+	It("Loads the CRLs in PEM and in DER", func() {
+		crl := ca.crl(ca.issue("revoked.example", ""))
+		dir := GinkgoT().TempDir()
+		pemFile, derFile := filepath.Join(dir, "crl.pem"), filepath.Join(dir, "crl.der")
+		pemCRL := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw})
+		Expect(os.WriteFile(pemFile, append(pemCRL, pemCRL...), 0600)).To(Succeed())
+		Expect(os.WriteFile(derFile, crl.Raw, 0600)).To(Succeed())
+		crls, err := ssh3.LoadCRLFiles([]string{pemFile, derFile})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(crls).To(HaveLen(3))
+		for _, loaded := range crls {
+			Expect(loaded.Raw).To(Equal(crl.Raw))
+		}
+	})
+
+	It("Uses the stapled OCSP responses", func() {
+		revoked, valid := ca.issue("revoked.example", ""), ca.issue("valid.example", "")
+		ca.revoked[revoked.SerialNumber.Int64()] = true
+		checker := &ssh3.RevocationChecker{Policy: ssh3.RevocationHardFail}
+		Expect(check(checker, revoked, ca.ocspResponse(revoked))).To(BeAssignableToTypeOf(ssh3.CertificateRevoked{}))
+		Expect(check(checker, valid, ca.ocspResponse(valid))).To(Succeed())
+		// the response about another certificate is ignored
+		Expect(check(checker, valid, ca.ocspResponse(revoked))).To(BeAssignableToTypeOf(ssh3.UnknownRevocationStatus{}))
+		checker.Policy = ssh3.RevocationCheckOff
+		Expect(check(checker, revoked, ca.ocspResponse(revoked))).To(BeAssignableToTypeOf(ssh3.CertificateRevoked{}))
+	})
+
+	It("Queries the OCSP responders according to the policy", func() {
+		responder := ca.serveOCSP()
+		defer responder.Close()
+		revoked, valid := ca.issue("revoked.example", responder.URL), ca.issue("valid.example", responder.URL)
+		ca.revoked[revoked.SerialNumber.Int64()] = true
+		unreachable := ca.issue("unreachable.example", "http://127.0.0.1:1")
+
+		checker := &ssh3.RevocationChecker{Policy: ssh3.RevocationHardFail}
+		Expect(check(checker, revoked, nil)).To(BeAssignableToTypeOf(ssh3.CertificateRevoked{}))
+		Expect(check(checker, valid, nil)).To(Succeed())
+		Expect(check(checker, unreachable, nil)).To(BeAssignableToTypeOf(ssh3.UnknownRevocationStatus{}))
+		checker.Policy = ssh3.RevocationSoftFail
+		Expect(check(checker, revoked, nil)).To(BeAssignableToTypeOf(ssh3.CertificateRevoked{}))
+		Expect(check(checker, unreachable, nil)).To(Succeed())
+		checker.Policy = ssh3.RevocationCheckOff
+		Expect(check(checker, revoked, nil)).To(Succeed())
+	})
+
+	It("Checks the server certificates verified by the root CAs", func() {
+		responder := ca.serveOCSP()
+		defer responder.Close()
+		revoked, valid := ca.issue("server.example", responder.URL), ca.issue("server.example", responder.URL)
+		ca.revoked[revoked.SerialNumber.Int64()] = true
+		knownHosts, _, err := ssh3.LoadKnownHosts(filepath.Join(GinkgoT().TempDir(), "known_hosts"))
+		Expect(err).ToNot(HaveOccurred())
+		knownHosts.SetRevocationChecker(&ssh3.RevocationChecker{Policy: ssh3.RevocationHardFail})
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		tlsConf := &tls.Config{RootCAs: roots}
+		knownHosts.ConfigureTLS("server.example", tlsConf)
+		Expect(tlsConf.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{valid}})).To(Succeed())
+		Expect(tlsConf.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked}})).To(BeAssignableToTypeOf(ssh3.CertificateRevoked{}))
+		Expect(tlsConf.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked}, OCSPResponse: ca.ocspResponse(revoked)})).ToNot(Succeed())
+	})
+})
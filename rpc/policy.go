@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// the methods of the rpc subsystem
+const (
+	// runs argv without a shell: {"argv": ["ls", "-l"], "stdin": "<base64>"}
+	MethodExec = "exec"
+	// reads up to length bytes of a file from offset: {"path": "/etc/hosts", "offset": 0, "length": 4096}
+	MethodReadFile = "read_file"
+	// {"path": "/etc/hosts"}
+	MethodStat = "stat"
+	// {"path": "/etc"}
+	MethodListDir = "list_dir"
+)
+
+var Methods = []string{MethodExec, MethodReadFile, MethodStat, MethodListDir}
+
+// restricts what an allowed method can access, empty lists meaning no restriction
+type MethodPolicy struct {
+	// patterns of the paths the file methods can access, that may contain the '*' and '?'
+	// wildcards. A pattern matching a directory also matches its content.
+	Paths []string `json:"paths,omitempty"`
+	// patterns of the executables the exec method can run
+	Commands []string `json:"commands,omitempty"`
+}
+
+// maps the methods allowed to the user onto their policy
+type Policy map[string]MethodPolicy
+
+type PermissionDenied struct {
+	Method string
+	Reason string
+}
+
+func (e PermissionDenied) Error() string {
+	return fmt.Sprintf("%s: permission denied: %s", e.Method, e.Reason)
+}
+
+func matchesOneOf(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// resolves the symbolic links of filename before matching it so that
+// they cannot be used to escape the allowed directories
+func (p MethodPolicy) checkPath(method string, filename string) (string, error) {
+	if !filepath.IsAbs(filename) {
+		return "", PermissionDenied{Method: method, Reason: fmt.Sprintf("%q is not an absolute path", filename)}
+	}
+	resolved, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return "", err
+	}
+	if len(p.Paths) == 0 {
+		return resolved, nil
+	}
+	for candidate := resolved; ; candidate = filepath.Dir(candidate) {
+		if matchesOneOf(p.Paths, candidate) {
+			return resolved, nil
+		}
+		if candidate == "/" {
+			return "", PermissionDenied{Method: method, Reason: fmt.Sprintf("%s is not an allowed path", resolved)}
+		}
+	}
+}
+
+// returns the path of the executable named by argv0, searching it in $PATH if needed
+func (p MethodPolicy) checkCommand(method string, argv0 string) (string, error) {
+	executable, err := exec.LookPath(argv0)
+	if err != nil {
+		return "", err
+	}
+	if executable, err = filepath.Abs(executable); err != nil {
+		return "", err
+	}
+	if len(p.Commands) > 0 && !matchesOneOf(p.Commands, executable) {
+		return "", PermissionDenied{Method: method, Reason: fmt.Sprintf("%s is not an allowed command", executable)}
+	}
+	return executable, nil
+}
@@ -0,0 +1,312 @@
+// Package rpc implements the built-in "rpc" subsystem, a JSON-RPC 2.0 server reading one
+// request per line on its input and writing one response per line on its output. It lets
+// automation run commands and access files without going through a shell, each method
+// being restricted by a policy.
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const SubsystemName = "rpc"
+
+// the first argument of the server binary telling it to serve the rpc subsystem
+const HelperSubcommand = "rpc-subsystem"
+
+const (
+	// the maximum size of a request line
+	maxRequestSize = 4 << 20
+	// the maximum number of bytes returned by read_file
+	maxReadLength = 1 << 20
+	// the maximum number of bytes of each output stream of exec
+	maxOutputLength = 4 << 20
+)
+
+// JSON-RPC 2.0 error codes, the server errors being in [-32099, -32000]
+const (
+	ErrorCodeParseError       = -32700
+	ErrorCodeInvalidRequest   = -32600
+	ErrorCodeMethodNotFound   = -32601
+	ErrorCodeInvalidParams    = -32602
+	ErrorCodePermissionDenied = -32001
+	ErrorCodeOSError          = -32002
+)
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type ExecParams struct {
+	Argv  []string `json:"argv"`
+	Stdin []byte   `json:"stdin,omitempty"`
+}
+
+type ExecResult struct {
+	// -1 if the command was killed by a signal
+	ExitStatus int    `json:"exit_status"`
+	Stdout     []byte `json:"stdout"`
+	Stderr     []byte `json:"stderr"`
+	// set if the output exceeded the maximum length and was truncated
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type PathParams struct {
+	Path string `json:"path"`
+}
+
+type ReadFileParams struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	// defaults to the maximum length of 1MiB
+	Length int64 `json:"length,omitempty"`
+}
+
+type ReadFileResult struct {
+	Data []byte `json:"data"`
+	EOF  bool   `json:"eof"`
+}
+
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+type ListDirResult struct {
+	Entries []FileInfo `json:"entries"`
+}
+
+func newFileInfo(info fs.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+type Server struct {
+	policy Policy
+}
+
+func NewServer(policy Policy) *Server {
+	return &Server{policy: policy}
+}
+
+// Serve handles the requests read from r until EOF. Notifications (requests without an ID)
+// are handled but not answered, as specified by JSON-RPC.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRequestSize)
+	encoder := json.NewEncoder(w)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		response := Response{JSONRPC: "2.0", ID: json.RawMessage("null")}
+		var request Request
+		if err := json.Unmarshal(line, &request); err != nil {
+			response.Error = &Error{Code: ErrorCodeParseError, Message: err.Error()}
+		} else if request.JSONRPC != "2.0" || request.Method == "" {
+			if request.ID != nil {
+				response.ID = request.ID
+			}
+			response.Error = &Error{Code: ErrorCodeInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+		} else {
+			response.Result, response.Error = s.handle(request)
+			if request.ID == nil {
+				continue
+			}
+			response.ID = request.ID
+		}
+		if err := encoder.Encode(response); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Server) handle(request Request) (interface{}, *Error) {
+	policy, ok := s.policy[request.Method]
+	if !ok {
+		return nil, &Error{Code: ErrorCodeMethodNotFound, Message: fmt.Sprintf("method %s not found", request.Method)}
+	}
+	var result interface{}
+	var err error
+	switch request.Method {
+	case MethodExec:
+		var params ExecParams
+		if err := json.Unmarshal(request.Params, &params); err != nil || len(params.Argv) == 0 {
+			return nil, &Error{Code: ErrorCodeInvalidParams, Message: "exec expects a non-empty argv"}
+		}
+		result, err = s.exec(policy, params)
+	case MethodReadFile:
+		var params ReadFileParams
+		if err := json.Unmarshal(request.Params, &params); err != nil || params.Offset < 0 {
+			return nil, &Error{Code: ErrorCodeInvalidParams, Message: "read_file expects a path and a positive offset"}
+		}
+		result, err = s.readFile(policy, params)
+	case MethodStat, MethodListDir:
+		var params PathParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &Error{Code: ErrorCodeInvalidParams, Message: fmt.Sprintf("%s expects a path", request.Method)}
+		}
+		if request.Method == MethodStat {
+			result, err = s.stat(policy, params)
+		} else {
+			result, err = s.listDir(policy, params)
+		}
+	default:
+		return nil, &Error{Code: ErrorCodeMethodNotFound, Message: fmt.Sprintf("method %s not found", request.Method)}
+	}
+	if errors.As(err, &PermissionDenied{}) {
+		return nil, &Error{Code: ErrorCodePermissionDenied, Message: err.Error()}
+	} else if err != nil {
+		return nil, &Error{Code: ErrorCodeOSError, Message: err.Error()}
+	}
+	return result, nil
+}
+
+// keeps the first max bytes written to it
+type truncatingBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *truncatingBuffer) Write(p []byte) (int, error) {
+	if remaining := b.max - b.Len(); len(p) > remaining {
+		b.Buffer.Write(p[:remaining])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (s *Server) exec(policy MethodPolicy, params ExecParams) (*ExecResult, error) {
+	executable, err := policy.checkCommand(MethodExec, params.Argv[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, params.Argv[1:]...)
+	cmd.Args[0] = params.Argv[0]
+	cmd.Stdin = bytes.NewReader(params.Stdin)
+	stdout := &truncatingBuffer{max: maxOutputLength}
+	stderr := &truncatingBuffer{max: maxOutputLength}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil && !errors.As(err, new(*exec.ExitError)) {
+		return nil, err
+	}
+	return &ExecResult{
+		ExitStatus: cmd.ProcessState.ExitCode(),
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+		Truncated:  stdout.truncated || stderr.truncated,
+	}, nil
+}
+
+func (s *Server) readFile(policy MethodPolicy, params ReadFileParams) (*ReadFileResult, error) {
+	filename, err := policy.checkPath(MethodReadFile, params.Path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	length := params.Length
+	if length <= 0 || length > maxReadLength {
+		length = maxReadLength
+	}
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, params.Offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &ReadFileResult{Data: data[:n], EOF: err == io.EOF}, nil
+}
+
+func (s *Server) stat(policy MethodPolicy, params PathParams) (*FileInfo, error) {
+	filename, err := policy.checkPath(MethodStat, params.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo := newFileInfo(info)
+	return &fileInfo, nil
+}
+
+func (s *Server) listDir(policy MethodPolicy, params PathParams) (*ListDirResult, error) {
+	dirname, err := policy.checkPath(MethodListDir, params.Path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	result := &ListDirResult{Entries: []FileInfo{}}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// the entry may have been removed in the meantime
+			continue
+		}
+		result.Entries = append(result.Entries, newFileInfo(info))
+	}
+	return result, nil
+}
+
+// RunHelper serves the rpc subsystem on the standard input and output
+// with the JSON-encoded policy given in args
+func RunHelper(args []string) int {
+	flags := flag.NewFlagSet(HelperSubcommand, flag.ContinueOnError)
+	encodedPolicy := flags.String("policy", "{}", "the JSON-encoded policy of the methods allowed to the user")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	var policy Policy
+	if err := json.Unmarshal([]byte(*encodedPolicy), &policy); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid rpc policy: %s\n", err)
+		return -1
+	}
+	if err := NewServer(policy).Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "rpc subsystem error: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+package rpc
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRPC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RPC Suite")
+}
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rpc subsystem", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		// the paths are compared once their symbolic links are resolved
+		dir, err = filepath.EvalSymlinks(GinkgoT().TempDir())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello, world"), 0600)).To(Succeed())
+		Expect(os.Mkdir(filepath.Join(dir, "subdir"), 0700)).To(Succeed())
+	})
+
+	serve := func(policy Policy, requests ...string) []Response {
+		var output bytes.Buffer
+		Expect(NewServer(policy).Serve(strings.NewReader(strings.Join(requests, "\n")), &output)).To(Succeed())
+		var responses []Response
+		decoder := json.NewDecoder(&output)
+		for decoder.More() {
+			var response Response
+			Expect(decoder.Decode(&response)).To(Succeed())
+			responses = append(responses, response)
+		}
+		return responses
+	}
+
+	result := func(response Response, value interface{}) {
+		Expect(response.Error).To(BeNil())
+		encoded, err := json.Marshal(response.Result)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(encoded, value)).To(Succeed())
+	}
+
+	It("reads file ranges", func() {
+		responses := serve(Policy{MethodReadFile: {}},
+			`{"jsonrpc": "2.0", "id": 1, "method": "read_file", "params": {"path": "`+filepath.Join(dir, "file.txt")+`", "offset": 7, "length": 3}}`,
+			`{"jsonrpc": "2.0", "id": 2, "method": "read_file", "params": {"path": "`+filepath.Join(dir, "file.txt")+`", "offset": 7}}`)
+		Expect(responses).To(HaveLen(2))
+		Expect(responses[0].ID).To(MatchJSON("1"))
+		var read ReadFileResult
+		result(responses[0], &read)
+		Expect(read).To(Equal(ReadFileResult{Data: []byte("wor"), EOF: false}))
+		result(responses[1], &read)
+		Expect(read).To(Equal(ReadFileResult{Data: []byte("world"), EOF: true}))
+	})
+
+	It("stats and lists directories", func() {
+		responses := serve(Policy{MethodStat: {}, MethodListDir: {}},
+			`{"jsonrpc": "2.0", "id": 1, "method": "stat", "params": {"path": "`+filepath.Join(dir, "file.txt")+`"}}`,
+			`{"jsonrpc": "2.0", "id": 2, "method": "list_dir", "params": {"path": "`+dir+`"}}`)
+		Expect(responses).To(HaveLen(2))
+		var info FileInfo
+		result(responses[0], &info)
+		Expect(info.Name).To(Equal("file.txt"))
+		Expect(info.Size).To(Equal(int64(len("hello, world"))))
+		Expect(info.Mode).To(Equal("-rw-------"))
+		var list ListDirResult
+		result(responses[1], &list)
+		Expect(list.Entries).To(HaveLen(2))
+		Expect(list.Entries[0].Name).To(Equal("file.txt"))
+		Expect(list.Entries[1].Name).To(Equal("subdir"))
+		Expect(list.Entries[1].IsDir).To(BeTrue())
+	})
+
+	It("runs commands without a shell", func() {
+		responses := serve(Policy{MethodExec: {}},
+			`{"jsonrpc": "2.0", "id": 1, "method": "exec", "params": {"argv": ["echo", "$HOME; 'quoted'"]}}`,
+			`{"jsonrpc": "2.0", "id": 2, "method": "exec", "params": {"argv": ["cat"], "stdin": "aW5wdXQ="}}`,
+			`{"jsonrpc": "2.0", "id": 3, "method": "exec", "params": {"argv": ["false"]}}`)
+		Expect(responses).To(HaveLen(3))
+		var execResult ExecResult
+		result(responses[0], &execResult)
+		Expect(execResult.ExitStatus).To(Equal(0))
+		Expect(string(execResult.Stdout)).To(Equal("$HOME; 'quoted'\n"))
+		result(responses[1], &execResult)
+		Expect(string(execResult.Stdout)).To(Equal("input"))
+		result(responses[2], &execResult)
+		Expect(execResult.ExitStatus).To(Equal(1))
+	})
+
+	It("enforces the policy", func() {
+		Expect(os.Symlink("/", filepath.Join(dir, "subdir", "root"))).To(Succeed())
+		responses := serve(Policy{
+			MethodStat: {Paths: []string{filepath.Join(dir, "sub*")}},
+			MethodExec: {Commands: []string{"/usr/bin/echo"}},
+		},
+			`{"jsonrpc": "2.0", "id": 1, "method": "stat", "params": {"path": "`+filepath.Join(dir, "subdir")+`"}}`,
+			`{"jsonrpc": "2.0", "id": 2, "method": "stat", "params": {"path": "`+filepath.Join(dir, "file.txt")+`"}}`,
+			`{"jsonrpc": "2.0", "id": 3, "method": "stat", "params": {"path": "`+filepath.Join(dir, "subdir", "root", "etc")+`"}}`,
+			`{"jsonrpc": "2.0", "id": 4, "method": "stat", "params": {"path": "subdir"}}`,
+			`{"jsonrpc": "2.0", "id": 5, "method": "exec", "params": {"argv": ["true"]}}`,
+			`{"jsonrpc": "2.0", "id": 6, "method": "read_file", "params": {"path": "`+filepath.Join(dir, "file.txt")+`"}}`)
+		Expect(responses).To(HaveLen(6))
+		Expect(responses[0].Error).To(BeNil())
+		for _, response := range responses[1:5] {
+			Expect(response.Error).ToNot(BeNil())
+			Expect(response.Error.Code).To(Equal(ErrorCodePermissionDenied))
+		}
+		Expect(responses[5].Error.Code).To(Equal(ErrorCodeMethodNotFound))
+	})
+
+	It("reports the invalid requests and ignores the notifications", func() {
+		responses := serve(Policy{MethodStat: {}},
+			`not json`,
+			`{"id": 1, "method": "stat"}`,
+			`{"jsonrpc": "2.0", "id": 2, "method": "stat", "params": []}`,
+			`{"jsonrpc": "2.0", "method": "stat", "params": {"path": "/"}}`,
+			`{"jsonrpc": "2.0", "id": 3, "method": "stat", "params": {"path": "`+filepath.Join(dir, "missing")+`"}}`)
+		Expect(responses).To(HaveLen(4))
+		Expect(responses[0].ID).To(MatchJSON("null"))
+		Expect(responses[0].Error.Code).To(Equal(ErrorCodeParseError))
+		Expect(responses[1].ID).To(MatchJSON("1"))
+		Expect(responses[1].Error.Code).To(Equal(ErrorCodeInvalidRequest))
+		Expect(responses[2].Error.Code).To(Equal(ErrorCodeInvalidParams))
+		Expect(responses[3].ID).To(MatchJSON("3"))
+		Expect(responses[3].Error.Code).To(Equal(ErrorCodeOSError))
+	})
+})
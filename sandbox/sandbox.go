@@ -0,0 +1,15 @@
+// Package sandbox confines the processes spawned by the server in new namespaces
+// with a seccomp filter. The confinement is applied by a helper re-executing the
+// server binary, so that the privileges are dropped in the right order: chroot(2),
+// then setgid(2) and setuid(2), then no_new_privs and the seccomp filter.
+package sandbox
+
+// the first argument of the server binary telling it to run as the sandbox helper
+const HelperSubcommand = "sandbox-exec"
+
+type Config struct {
+	// if set, chroot(2) the command in this directory before dropping the privileges
+	ChrootDirectory string
+	// keep the network namespace of the server instead of an empty one
+	AllowNetwork bool
+}
@@ -0,0 +1,108 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Wrap rewrites cmd so that it is run by the sandbox helper in new mount, IPC, UTS and
+// (unless allowed) network namespaces. The credentials and working directory of cmd are
+// applied by the helper, the working directory being relative to the chroot directory if any.
+func Wrap(cmd *exec.Cmd, config Config) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return fmt.Errorf("cannot sandbox a command without credentials")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	credential := cmd.SysProcAttr.Credential
+	helperArgs := []string{filepath.Base(executable), HelperSubcommand,
+		"-uid", strconv.FormatUint(uint64(credential.Uid), 10),
+		"-gid", strconv.FormatUint(uint64(credential.Gid), 10),
+		"-dir", cmd.Dir,
+	}
+	if config.ChrootDirectory != "" {
+		helperArgs = append(helperArgs, "-chroot", config.ChrootDirectory)
+	}
+	helperArgs = append(helperArgs, "--", cmd.Path)
+	cmd.Args = append(helperArgs, cmd.Args...)
+	cmd.Path = executable
+	cmd.Dir = "/"
+
+	// the helper needs the privileges of the server to chroot
+	cmd.SysProcAttr.Credential = nil
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !config.AllowNetwork {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return nil
+}
+
+// RunHelper confines the current process and executes the command given in args,
+// it only returns on error
+func RunHelper(args []string) int {
+	flags := flag.NewFlagSet(HelperSubcommand, flag.ContinueOnError)
+	uid := flags.Int("uid", -1, "the uid of the command")
+	gid := flags.Int("gid", -1, "the gid of the command")
+	dir := flags.String("dir", "/", "the working directory of the command")
+	chrootDirectory := flags.String("chroot", "", "if set, chroot in the specified directory")
+	if err := flags.Parse(args); err != nil {
+		return -1
+	}
+	if *uid < 0 || *gid < 0 || flags.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s -uid UID -gid GID [-dir DIR] [-chroot DIR] -- PATH ARGV...\n", HelperSubcommand)
+		return -1
+	}
+
+	// the seccomp filter only applies to the current thread, which must then run execve(2)
+	runtime.LockOSThread()
+	if err := confine(*chrootDirectory, *uid, *gid, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "could not sandbox the session: %s\n", err)
+		return 1
+	}
+	path, argv := flags.Arg(0), flags.Args()[1:]
+	err := syscall.Exec(path, argv, os.Environ())
+	fmt.Fprintf(os.Stderr, "could not execute %s: %s\n", path, err)
+	return 1
+}
+
+func confine(chrootDirectory string, uid int, gid int, dir string) error {
+	if chrootDirectory != "" {
+		if err := syscall.Chroot(chrootDirectory); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	// Setgroups, Setgid and Setuid apply to all the threads of the process
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if err := syscall.Chdir(dir); err != nil {
+		return err
+	}
+	// no_new_privs prevents setuid binaries from regaining privileges
+	// and allows installing a seccomp filter without CAP_SYS_ADMIN
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	return installSeccompFilter()
+}
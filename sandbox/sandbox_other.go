@@ -0,0 +1,19 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+func Wrap(cmd *exec.Cmd, config Config) error {
+	return fmt.Errorf("sandboxing is not implemented on %s/%s systems", runtime.GOOS, runtime.GOARCH)
+}
+
+func RunHelper(args []string) int {
+	fmt.Fprintf(os.Stderr, "sandboxing is not implemented on %s/%s systems\n", runtime.GOOS, runtime.GOARCH)
+	return -1
+}
@@ -0,0 +1,87 @@
+//go:build linux && (amd64 || arm64)
+
+package sandbox
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// see seccomp(2)
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	// the lower 32 bits of the first argument on little-endian architectures
+	seccompDataArg0 = 16
+
+	// the x32 syscalls of amd64 are numbered from this value
+	x32SyscallBit = 0x40000000
+)
+
+// the syscalls allowing to escape the sandbox or to interfere with the server or the kernel,
+// they fail with EPERM
+var deniedSyscalls = []uint32{
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_FSOPEN, unix.SYS_FSMOUNT, unix.SYS_MOVE_MOUNT, unix.SYS_OPEN_TREE,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KEXEC_LOAD, unix.SYS_KEXEC_FILE_LOAD, unix.SYS_REBOOT,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT,
+}
+
+const namespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUTS | unix.CLONE_NEWCGROUP
+
+func bpfStatement(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jumpTrue, jumpFalse uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jumpTrue, Jf: jumpFalse, K: k}
+}
+
+func seccompFilter() []unix.SockFilter {
+	filter := []unix.SockFilter{
+		// a process switching to another ABI could bypass the filter
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, auditArch, 1, 0),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+	}
+	for _, syscall := range deniedSyscalls {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, syscall, 0, 1),
+			bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)))
+	}
+	filter = append(filter,
+		// the flags of clone3 cannot be inspected as they are passed in memory,
+		// the libc falls back to clone when clone3 is not available
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE3, 0, 1),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.ENOSYS)),
+		// clone can create new namespaces
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE, 0, 3),
+		bpfStatement(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArg0),
+		bpfJump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, namespaceFlags, 0, 1),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+		bpfStatement(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+	)
+	return filter
+}
+
+// installs the filter on the current thread, it is then inherited by execve(2)
+func installSeccompFilter() error {
+	filter := seccompFilter()
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&program)), 0, 0)
+}
@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installSeccompFilter() error {
+	return fmt.Errorf("seccomp filters are not implemented on %s/%s systems", runtime.GOOS, runtime.GOARCH)
+}
@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"runtime/debug"
 	"sync"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/francoismichel/ssh3/util"
 )
@@ -25,6 +28,10 @@ type Server struct {
 	conversationHandler ServerConversationHandler
 	lock                sync.Mutex
 	// conversations map[]
+
+	extInfo *ExtInfo
+	// allows the clients to request compression
+	compression CompressionConfig
 }
 
 // Creates a new server handling http requests for SSH conversations
@@ -55,6 +62,7 @@ func NewServer(maxPacketSize uint64, defaultDatagramQueueSize uint64, h3Server *
 
 		conversationControlStreamID, channelType, maxPacketSize, err := parseHeader(uint64(stream.StreamID()), &StreamByteReader{stream})
 		if err != nil {
+			log.Warn().Msgf("malformed channel header on stream %d, resetting the stream: %s", stream.StreamID(), err)
 			return false, err
 		}
 
@@ -76,21 +84,15 @@ func NewServer(maxPacketSize uint64, defaultDatagramQueueSize uint64, h3Server *
 
 		newChannel := NewChannel(channelInfo.ConversationStreamID, channelInfo.ConversationID, uint64(stream.StreamID()), channelInfo.ChannelType, channelInfo.MaxPacketSize, &StreamByteReader{stream},
 			stream, nil, conversation.channelsManager, false, false, true, defaultDatagramQueueSize, nil)
+		newChannel.setProtocolVersion(conversation.protocolVersion)
+		conversation.setupCompression(newChannel)
+		newChannel.setBandwidthLimiter(conversation.bandwidthLimiter.Load)
 
-		switch channelInfo.ChannelType {
-		case "direct-udp":
-			udpAddr, err := parseUDPForwardingHeader(channelInfo.ChannelID, &StreamByteReader{stream})
-			if err != nil {
-				return false, err
-			}
-			newChannel.setDatagramSender(conversation.getDatagramSenderForChannel(channelInfo.ChannelID))
-			newChannel = &UDPForwardingChannelImpl{Channel: newChannel, RemoteAddr: udpAddr}
-		case "direct-tcp":
-			tcpAddr, err := parseTCPForwardingHeader(channelInfo.ChannelID, &StreamByteReader{stream})
-			if err != nil {
-				return false, err
-			}
-			newChannel = &TCPForwardingChannelImpl{Channel: newChannel, RemoteAddr: tcpAddr}
+		// e.g. the forwarding headers of the direct-udp and direct-tcp channels
+		newChannel, err = parseChannelTypeHeader(conversation, newChannel, &StreamByteReader{stream})
+		if err != nil {
+			log.Warn().Msgf("malformed %s header on channel %d, resetting the stream: %s", channelInfo.ChannelType, channelInfo.ChannelID, err)
+			return false, err
 		}
 		conversation.channelsAcceptQueue.Add(newChannel)
 		return true, nil
@@ -122,6 +124,19 @@ func (s *Server) removeConnection(streamCreator http3.StreamCreator) {
 	delete(s.conversations, streamCreator)
 }
 
+// AdvertiseChannelTypes sets the channel types and the optional features (e.g.
+// FeatureDatagramTyping) listed in the ExtInfo sent to the clients when establishing the
+// conversations, see Conversation.PeerChannelTypes. It must be called before serving requests.
+func (s *Server) AdvertiseChannelTypes(types []string, features ...string) {
+	s.extInfo = NewExtInfo(types, append([]string{"datagrams"}, features...)...)
+}
+
+// SetCompression allows the clients to request the compression of the data of their
+// conversations, see CompressionConfig. It must be called before serving requests.
+func (s *Server) SetCompression(config CompressionConfig) {
+	s.compression = config
+}
+
 type AuthenticatedHandlerFunc func(authenticatedUserName string, newConv *Conversation, w http.ResponseWriter, r *http.Request)
 
 type UnauthenticatedBearerFunc func(unauthenticatedBearerString string, base64ConversationID string, w http.ResponseWriter, r *http.Request)
@@ -138,9 +153,32 @@ func (s *Server) GetHTTPHandlerFunc(ctx context.Context) AuthenticatedHandlerFun
 			}
 			streamCreator := hijacker.StreamCreator()
 			qconn := streamCreator.(quic.Connection)
+			// the conversation span lasts until the conversation is torn down
+			var span trace.Span
+			newConv.context, span = tracer.Start(newConv.context, "ssh3.conversation", trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("ssh3.conversation_id", newConv.ConversationID().String()),
+					attribute.String("enduser.id", authenticatedUsername)))
+			version, err := NegotiateProtocolVersion(r)
+			if err != nil {
+				// the authentication handlers refuse these clients first
+				log.Error().Msgf("could not negotiate the protocol version: %s", err)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			newConv.protocolVersion = version
 			conversationsManager := s.getOrCreateConversationsManager(streamCreator)
+			newConv.peerExtInfo = ParseExtInfo(r.Header)
+			newConv.compression = s.compression
 			conversationsManager.addConversation(newConv)
 
+			w.Header().Set(ProtocolVersionHeader, formatProtocolVersions(version, version))
+			if s.extInfo != nil {
+				extInfo := *s.extInfo
+				SetExtInfoCompression(&extInfo, s.compression)
+				extInfo.SetHeader(w.Header())
+			}
+			// the disconnect message ending the conversation is sent in the body of the response
+			w.Header().Set("Content-Type", ConversationMessagesContentType)
 			w.WriteHeader(200)
 
 			go func() {
@@ -177,13 +215,23 @@ func (s *Server) GetHTTPHandlerFunc(ctx context.Context) AuthenticatedHandlerFun
 				}
 			}()
 			go func() {
+				defer span.End()
 				defer newConv.Close()
 				defer conversationsManager.removeConversation(newConv)
 				defer s.removeConnection(streamCreator)
+				// a panic in the handler only terminates this conversation
+				defer func() {
+					if r := recover(); r != nil {
+						log.Error().Msgf("panic while handling conversation %s of user %s: %v\n%s", newConv.ConversationID(), authenticatedUsername, r, debug.Stack())
+						util.SetSpanError(span, fmt.Errorf("panic: %v", r))
+					}
+				}()
 				if err := s.conversationHandler(authenticatedUsername, newConv); err != nil {
 					if errors.Is(err, context.Canceled) {
+						span.AddEvent("conversation canceled")
 						log.Info().Msgf("conversation canceled for conversation id %s, user %s", newConv.ConversationID(), authenticatedUsername)
 					} else {
+						util.SetSpanError(span, err)
 						log.Error().Msgf("error while handing new conversation: %s for user %s: %s", newConv.ConversationID(), authenticatedUsername, err)
 					}
 					return
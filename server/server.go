@@ -0,0 +1,229 @@
+// Package server lets Go programs serve SSH3 conversations on their own HTTP/3 server, without
+// the Unix accounts and processes of the ssh3-server command: the application authenticates the
+// users and handles their sessions with callbacks, as golang.org/x/crypto/ssh servers do.
+package server
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMaxPacketSize = 30000
+	datagramsQueueSize   = 10
+)
+
+// Authenticator authenticates the users of the CONNECT requests
+type Authenticator interface {
+	// Authenticate returns the name of the user authenticated by r, or an error if r does not
+	// authenticate any user. The bearer tokens built from private keys are bound to the
+	// conversation identified by base64ConversationID.
+	Authenticate(r *http.Request, base64ConversationID string) (string, error)
+}
+
+type AuthenticatorFunc func(r *http.Request, base64ConversationID string) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request, base64ConversationID string) (string, error) {
+	return f(r, base64ConversationID)
+}
+
+// the user is requested in the URL as user@host or using the user query parameter
+func requestedUsername(r *http.Request) string {
+	if username := r.URL.User.Username(); username != "" {
+		return username
+	}
+	return r.URL.Query().Get("user")
+}
+
+// PasswordAuthenticator authenticates the users using HTTP Basic authentication, checking the
+// password with checkPassword
+func PasswordAuthenticator(checkPassword func(username string, password string) bool) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request, base64ConversationID string) (string, error) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return "", errors.New("no basic authentication")
+		}
+		if !checkPassword(username, password) {
+			return "", fmt.Errorf("wrong password for user %s", username)
+		}
+		return username, nil
+	})
+}
+
+// PublicKeyAuthenticator authenticates the users presenting a bearer token signed by one of
+// their authorizedKeys, as built by the ssh3 command using -privkey or an agent
+func PublicKeyAuthenticator(authorizedKeys func(username string) []crypto.PublicKey) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request, base64ConversationID string) (string, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return "", errors.New("no bearer token")
+		}
+		username := requestedUsername(r)
+		for _, key := range authorizedKeys(username) {
+			if ssh3.VerifyJWTBearerToken(token, key, username, base64ConversationID) == nil {
+				return username, nil
+			}
+		}
+		return "", fmt.Errorf("the token is not signed by any key authorized for user %s", username)
+	})
+}
+
+// ChannelHandler handles a channel of an extension type opened by an authenticated user, the
+// channel being closed when it returns
+type ChannelHandler func(user string, conv *ssh3.Conversation, channel ssh3.Channel)
+
+type Config struct {
+	Authenticator Authenticator
+	// handles the shell and exec requests, which exit with status 127 if it is nil
+	SessionHandler SessionHandler
+	// handles the subsystem requests, by subsystem name (e.g. "sftp"). The unknown subsystems
+	// exit with status 127. New creates an empty registry if it is nil.
+	Subsystems *SubsystemRegistry
+	// in-process handlers added to Subsystems by New, by subsystem name
+	SubsystemHandlers map[string]SessionHandler
+	// handles the channels of extension types, by channel type (e.g. "tunnel@example.com").
+	// The types whose channels have a specific header must be registered using
+	// ssh3.RegisterChannelType. The other types than session are refused.
+	ChannelHandlers map[string]ChannelHandler
+	// the maximum size of the messages on the channels, defaults to the one of ssh3-server
+	MaxPacketSize uint64
+	// if set, filters the channels of the accepted types before accepting them, e.g. to apply
+	// the policy of the application
+	ChannelOpenFilter ssh3.ChannelOpenFilter
+	// if set, called before handling each request of the session channels. A non-nil error
+	// refuses the request and closes the session channel.
+	PreRequestHook ssh3.PreRequestHook
+	// if set, called after handling each request of the session channels, e.g. to audit them
+	PostRequestHook ssh3.PostRequestHook
+}
+
+// Server serves SSH3 conversations on an HTTP/3 server
+type Server struct {
+	config Config
+}
+
+func New(config Config) (*Server, error) {
+	if config.Authenticator == nil {
+		return nil, errors.New("no authenticator in the config")
+	}
+	if config.MaxPacketSize == 0 {
+		config.MaxPacketSize = defaultMaxPacketSize
+	}
+	if config.Subsystems == nil {
+		config.Subsystems = NewSubsystemRegistry()
+	}
+	for name, handler := range config.SubsystemHandlers {
+		if err := config.Subsystems.Register(name, handler); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{config: config}, nil
+}
+
+// Handler returns the handler of the CONNECT requests establishing the conversations, to be
+// mounted on the URL path of the server, e.g. mux.Handle("/ssh3", s.Handler(h3Server)). It
+// takes over the StreamHijacker of h3Server, which must enable datagrams, and must then be
+// called once per HTTP/3 server.
+func (s *Server) Handler(h3Server *http3.Server) http.HandlerFunc {
+	ssh3Server := ssh3.NewServer(s.config.MaxPacketSize, datagramsQueueSize, h3Server, s.handleConversation)
+	channelTypes := []string{"session"}
+	for channelType := range s.config.ChannelHandlers {
+		channelTypes = append(channelTypes, channelType)
+	}
+	slices.Sort(channelTypes)
+	ssh3Server.AdvertiseChannelTypes(channelTypes, ssh3.FeatureChannelEOF, ssh3.FeatureMultipleSessions, ssh3.FeatureRequestReplies)
+	handleConversation := ssh3Server.GetHTTPHandlerFunc(context.Background())
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer w.(http.Flusher).Flush()
+		if r.Method != http.MethodConnect || r.Proto != "ssh3" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Server", ssh3.GetCurrentVersion())
+		// the same version rules as ssh3-server
+		if _, err := ssh3.NegotiateProtocolVersion(r); err != nil {
+			ssh3.WriteDisconnectResponse(w, http.StatusForbidden, ssh3.Disconnect{
+				ReasonCode:  ssh3Messages.SSH_DISCONNECT_PROTOCOL_VERSION_NOT_SUPPORTED,
+				Description: fmt.Sprintf("%s, the server is in version %s", err, ssh3.GetCurrentVersion()),
+				LanguageTag: "en",
+			})
+			return
+		}
+		hijacker, ok := w.(http3.Hijacker)
+		if !ok {
+			log.Error().Msgf("failed to hijack")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		qconn := hijacker.StreamCreator().(quic.Connection)
+		if !qconn.ConnectionState().TLS.HandshakeComplete {
+			// do not authenticate using early data (0-RTT), which can be replayed
+			w.WriteHeader(http.StatusTooEarly)
+			return
+		}
+		str := r.Body.(http3.HTTPStreamer).HTTPStream()
+		conv, err := ssh3.NewServerConversation(context.Background(), str, qconn, qconn, s.config.MaxPacketSize)
+		if err != nil {
+			log.Error().Msgf("could not create new server conversation: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		convID := conv.ConversationID()
+		username, err := s.config.Authenticator.Authenticate(r, base64.StdEncoding.EncodeToString(convID[:]))
+		if err != nil || username == "" {
+			log.Info().Msgf("authentication failed from %s: %v", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handleConversation(username, conv, w, r)
+	}
+}
+
+func (s *Server) handleConversation(authenticatedUsername string, conv *ssh3.Conversation) error {
+	dispatcher := ssh3.NewChannelDispatcher()
+	dispatcher.AddChannelOpenFilter(func(channel ssh3.Channel) *ssh3.ChannelOpenFailure {
+		if _, ok := s.config.ChannelHandlers[channel.ChannelType()]; channel.ChannelType() != "session" && !ok {
+			return ssh3.UnsupportedChannelType(channel.ChannelType())
+		}
+		return nil
+	})
+	if s.config.ChannelOpenFilter != nil {
+		dispatcher.AddChannelOpenFilter(s.config.ChannelOpenFilter)
+	}
+	conv.SetChannelOpenFilter(dispatcher.ChannelOpenFilter())
+	for {
+		channel, err := conv.AcceptChannel(conv.Context())
+		if err != nil {
+			return err
+		}
+		if handler, ok := s.config.ChannelHandlers[channel.ChannelType()]; ok {
+			go s.serveChannel(handler, authenticatedUsername, conv, channel)
+			continue
+		}
+		go s.serveSession(newSession(conv.Context(), authenticatedUsername, conv, channel))
+	}
+}
+
+func (s *Server) serveChannel(handler ChannelHandler, user string, conv *ssh3.Conversation, channel ssh3.Channel) {
+	defer channel.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("panic while handling %s channel of user %s: %v\n%s", channel.ChannelType(), user, r, debug.Stack())
+		}
+	}()
+	handler(user, conv, channel)
+}
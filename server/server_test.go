@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	"github.com/golang-jwt/jwt/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// replays the messages sent by a client, which then half-closes the channel
+type fakeChannel struct {
+	ssh3.Channel
+	messages []ssh3Messages.Message
+
+	lock     sync.Mutex
+	requests []ssh3Messages.ChannelRequest
+	stdout   []byte
+	stderr   []byte
+	closed   bool
+}
+
+func (c *fakeChannel) NextMessage() (ssh3Messages.Message, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.messages) == 0 {
+		return nil, io.EOF
+	}
+	message := c.messages[0]
+	c.messages = c.messages[1:]
+	return message, nil
+}
+
+func (c *fakeChannel) SendRequest(r *ssh3Messages.ChannelRequestMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, r.ChannelRequest)
+	return nil
+}
+
+func (c *fakeChannel) WriteData(dataBuf []byte, dataType ssh3Messages.SSHDataType) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if dataType == ssh3Messages.SSH_EXTENDED_DATA_STDERR {
+		c.stderr = append(c.stderr, dataBuf...)
+	} else {
+		c.stdout = append(c.stdout, dataBuf...)
+	}
+	return len(dataBuf) + 8, nil
+}
+
+func (c *fakeChannel) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+}
+
+func (c *fakeChannel) ChannelID() uint64 {
+	return 2
+}
+
+func (c *fakeChannel) ChannelType() string {
+	return "session"
+}
+
+func request(channelRequest ssh3Messages.ChannelRequest) *ssh3Messages.ChannelRequestMessage {
+	return &ssh3Messages.ChannelRequestMessage{ChannelRequest: channelRequest}
+}
+
+func serve(config Config, messages ...ssh3Messages.Message) *fakeChannel {
+	channel := &fakeChannel{messages: messages}
+	config.Authenticator = AuthenticatorFunc(func(r *http.Request, base64ConversationID string) (string, error) {
+		return "alice", nil
+	})
+	server, err := New(config)
+	Expect(err).ToNot(HaveOccurred())
+	server.serveSession(newSession(context.Background(), "alice", nil, channel))
+	return channel
+}
+
+var _ = Describe("Session", func() {
+	It("Runs the command on the input of the client", func() {
+		var command string
+		channel := serve(Config{SessionHandler: func(session *Session) {
+			command = session.Command()
+			io.Copy(session, session)
+			session.Stderr().Write([]byte("done\n"))
+		}},
+			request(&ssh3Messages.ExecRequest{Command: "cat"}),
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello "},
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "world\n"},
+		)
+		Expect(command).To(Equal("cat"))
+		Expect(string(channel.stdout)).To(Equal("hello world\n"))
+		Expect(string(channel.stderr)).To(Equal("done\n"))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 0}}))
+		Expect(channel.closed).To(BeTrue())
+	})
+
+	It("Passes the argument vector of the exec-argv requests", func() {
+		var command string
+		var argv []string
+		serve(Config{SessionHandler: func(session *Session) {
+			command, argv = session.Command(), session.Argv()
+		}}, request(&ssh3Messages.ExecArgvRequest{Argv: []string{"touch", "a file"}}))
+		Expect(argv).To(Equal([]string{"touch", "a file"}))
+		Expect(command).To(Equal("touch 'a file'"))
+	})
+
+	It("Sends the exit status of the handler", func() {
+		channel := serve(Config{SessionHandler: func(session *Session) {
+			session.Exit(3)
+		}}, request(&ssh3Messages.ShellRequest{}))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 3}}))
+	})
+
+	It("Dispatches the subsystems by name", func() {
+		var subsystem string
+		config := Config{SubsystemHandlers: map[string]SessionHandler{"sftp": func(session *Session) {
+			subsystem = session.Subsystem()
+		}}}
+		channel := serve(config, request(&ssh3Messages.SubsystemRequest{SubsystemName: "sftp"}))
+		Expect(subsystem).To(Equal("sftp"))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 0}}))
+
+		channel = serve(config, request(&ssh3Messages.SubsystemRequest{SubsystemName: "unknown"}))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 127}}))
+		Expect(channel.stderr).ToNot(BeEmpty())
+	})
+
+	It("Looks up the subsystems registered while the server runs", func() {
+		registry := NewSubsystemRegistry()
+		channel := serve(Config{Subsystems: registry}, request(&ssh3Messages.SubsystemRequest{SubsystemName: "echo"}))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 127}}))
+
+		Expect(registry.Register("echo", func(session *Session) { io.Copy(session, session) })).To(Succeed())
+		Expect(registry.Register("echo", func(session *Session) {})).ToNot(Succeed())
+		Expect(registry.Names()).To(Equal([]string{"echo"}))
+		channel = serve(Config{Subsystems: registry},
+			request(&ssh3Messages.SubsystemRequest{SubsystemName: "echo"}),
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello"},
+		)
+		Expect(string(channel.stdout)).To(Equal("hello"))
+
+		registry.Unregister("echo")
+		_, ok := registry.Lookup("echo")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Runs the subsystems served by external commands", func() {
+		if runtime.GOOS == "windows" {
+			Skip("requires a POSIX shell")
+		}
+		registry := NewSubsystemRegistry()
+		Expect(registry.RegisterCommand("upper", "/bin/sh", "-c", "tr a-z A-Z; echo failed >&2; exit 4")).To(Succeed())
+		channel := serve(Config{Subsystems: registry},
+			request(&ssh3Messages.SubsystemRequest{SubsystemName: "upper"}),
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello\n"},
+		)
+		Expect(string(channel.stdout)).To(Equal("HELLO\n"))
+		Expect(string(channel.stderr)).To(Equal("failed\n"))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 4}}))
+
+		Expect(registry.RegisterCommand("missing", "/nonexistent/subsystem")).To(Succeed())
+		channel = serve(Config{Subsystems: registry}, request(&ssh3Messages.SubsystemRequest{SubsystemName: "missing"}))
+		Expect(channel.requests).To(Equal([]ssh3Messages.ChannelRequest{&ssh3Messages.ExitStatusRequest{ExitStatus: 127}}))
+	})
+
+	It("Ends the input on a channel EOF while still receiving the requests", func() {
+		var input []byte
+		var signal string
+		serve(Config{SessionHandler: func(session *Session) {
+			input, _ = io.ReadAll(session)
+			select {
+			case signal = <-session.Signals():
+			case <-time.After(5 * time.Second):
+			}
+		}},
+			request(&ssh3Messages.ExecRequest{Command: "cat"}),
+			&ssh3Messages.DataOrExtendedDataMessage{DataType: ssh3Messages.SSH_EXTENDED_DATA_NONE, Data: "hello"},
+			&ssh3Messages.ChannelEOFMessage{},
+			request(&ssh3Messages.SignalRequest{SignalNameWithoutSig: "TERM"}),
+		)
+		Expect(string(input)).To(Equal("hello"))
+		Expect(signal).To(Equal("TERM"))
+	})
+
+	It("Passes the pty and its window changes to the handler", func() {
+		var pty *ssh3Messages.PtyRequest
+		var windowChange *ssh3Messages.WindowChangeRequest
+		serve(Config{SessionHandler: func(session *Session) {
+			pty, _ = session.Pty()
+			select {
+			case windowChange = <-session.WindowChanges():
+			case <-time.After(5 * time.Second):
+			}
+		}},
+			request(&ssh3Messages.PtyRequest{Term: "xterm", CharWidth: 80, CharHeight: 24}),
+			request(&ssh3Messages.ShellRequest{}),
+			request(&ssh3Messages.WindowChangeRequest{CharWidth: 120, CharHeight: 40}),
+		)
+		Expect(pty).ToNot(BeNil())
+		Expect(pty.Term).To(Equal("xterm"))
+		Expect(windowChange).To(Equal(&ssh3Messages.WindowChangeRequest{CharWidth: 120, CharHeight: 40}))
+	})
+
+	It("Does not run the handler without request", func() {
+		handled := false
+		channel := serve(Config{SessionHandler: func(session *Session) { handled = true }})
+		Expect(handled).To(BeFalse())
+		Expect(channel.requests).To(BeEmpty())
+		Expect(channel.closed).To(BeTrue())
+	})
+
+	It("Runs the request hooks and closes the session on refusal", func() {
+		handled := false
+		var audited []error
+		channel := serve(Config{
+			SessionHandler: func(session *Session) { handled = true },
+			PreRequestHook: func(ctx context.Context, channel ssh3.Channel, message *ssh3Messages.ChannelRequestMessage) error {
+				if _, ok := message.ChannelRequest.(*ssh3Messages.ExecRequest); ok {
+					return errors.New("exec not permitted")
+				}
+				return nil
+			},
+			PostRequestHook: func(ctx context.Context, channel ssh3.Channel, message *ssh3Messages.ChannelRequestMessage, err error) {
+				audited = append(audited, err)
+			},
+		},
+			request(&ssh3Messages.WorkingDirectoryRequest{Directory: "/tmp"}),
+			request(&ssh3Messages.ExecRequest{Command: "rm -rf /"}),
+			request(&ssh3Messages.ShellRequest{}),
+		)
+		Expect(handled).To(BeFalse())
+		Expect(audited).To(HaveLen(2))
+		Expect(audited[0]).ToNot(HaveOccurred())
+		Expect(audited[1]).To(MatchError("exec not permitted"))
+		Expect(channel.closed).To(BeTrue())
+	})
+})
+
+var _ = Describe("Extension channels", func() {
+	It("Closes the channel when the handler returns", func() {
+		channel := &fakeChannel{}
+		var user string
+		(&Server{}).serveChannel(func(u string, conv *ssh3.Conversation, c ssh3.Channel) {
+			user = u
+			c.WriteData([]byte("pong"), ssh3Messages.SSH_EXTENDED_DATA_NONE)
+		}, "alice", nil, channel)
+		Expect(user).To(Equal("alice"))
+		Expect(string(channel.stdout)).To(Equal("pong"))
+		Expect(channel.closed).To(BeTrue())
+	})
+
+	It("Recovers the panics of the handler", func() {
+		channel := &fakeChannel{}
+		(&Server{}).serveChannel(func(string, *ssh3.Conversation, ssh3.Channel) { panic("bug") }, "alice", nil, channel)
+		Expect(channel.closed).To(BeTrue())
+	})
+})
+
+var _ = Describe("Authenticators", func() {
+	It("Checks the passwords", func() {
+		authenticator := PasswordAuthenticator(func(username string, password string) bool {
+			return username == "alice" && password == "secret"
+		})
+		r := httptest.NewRequest(http.MethodConnect, "https://example.org/ssh3?user=alice", nil)
+		r.SetBasicAuth("alice", "secret")
+		username, err := authenticator.Authenticate(r, "convID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("alice"))
+
+		r.SetBasicAuth("alice", "wrong")
+		_, err = authenticator.Authenticate(r, "convID")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Verifies the tokens of the authorized keys", func() {
+		pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+			"iss":       "alice",
+			"iat":       jwt.NewNumericDate(time.Now()),
+			"exp":       jwt.NewNumericDate(time.Now().Add(10 * time.Second)),
+			"sub":       "ssh3",
+			"aud":       "unused",
+			"client_id": "ssh3-alice",
+			"jti":       "convID",
+		}).SignedString(privkey)
+		Expect(err).ToNot(HaveOccurred())
+		authenticator := PublicKeyAuthenticator(func(username string) []crypto.PublicKey {
+			if username == "alice" {
+				return []crypto.PublicKey{pubkey}
+			}
+			return nil
+		})
+		r := httptest.NewRequest(http.MethodConnect, "https://example.org/ssh3?user=alice", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		username, err := authenticator.Authenticate(r, "convID")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(username).To(Equal("alice"))
+
+		// bound to another conversation
+		_, err = authenticator.Authenticate(r, "otherConvID")
+		Expect(err).To(HaveOccurred())
+
+		r = httptest.NewRequest(http.MethodConnect, "https://example.org/ssh3?user=bob", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err = authenticator.Authenticate(r, "convID")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Are required by the server", func() {
+		_, err := New(Config{})
+		Expect(err).To(HaveOccurred())
+	})
+})
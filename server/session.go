@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime/debug"
+	"sync"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SessionHandler handles a shell, exec or subsystem request. The session exits with status 0
+// when it returns, unless Exit was called.
+type SessionHandler func(session *Session)
+
+// Session is a session channel opened by an authenticated user. Reading it reads the data sent
+// by the client, writing it writes the standard output of the session.
+type Session struct {
+	ctx     context.Context
+	user    string
+	conv    *ssh3.Conversation
+	channel ssh3.Channel
+
+	command          string
+	argv             []string
+	subsystem        string
+	workingDirectory string
+	pty              *ssh3Messages.PtyRequest
+	windowChanges    chan *ssh3Messages.WindowChangeRequest
+	signals          chan string
+
+	stdin       *io.PipeReader
+	stdinWriter *io.PipeWriter
+
+	lock   sync.Mutex
+	exited bool
+}
+
+func newSession(ctx context.Context, user string, conv *ssh3.Conversation, channel ssh3.Channel) *Session {
+	stdin, stdinWriter := io.Pipe()
+	return &Session{
+		ctx:           ctx,
+		user:          user,
+		conv:          conv,
+		channel:       channel,
+		windowChanges: make(chan *ssh3Messages.WindowChangeRequest, 1),
+		signals:       make(chan string, 1),
+		stdin:         stdin,
+		stdinWriter:   stdinWriter,
+	}
+}
+
+// User returns the name of the authenticated user
+func (s *Session) User() string {
+	return s.user
+}
+
+// Conversation returns the conversation of the session, e.g. to open channels to the client
+func (s *Session) Conversation() *ssh3.Conversation {
+	return s.conv
+}
+
+// Context is canceled when the conversation ends
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Command returns the command of an exec request, it is empty for shell requests
+func (s *Session) Command() string {
+	return s.command
+}
+
+// Argv returns the argument vector of an exec-argv request, which the handler should run without
+// a shell. Command then returns it quoted for a POSIX shell.
+func (s *Session) Argv() []string {
+	return s.argv
+}
+
+// Subsystem returns the name of the subsystem requested, if any
+func (s *Session) Subsystem() string {
+	return s.subsystem
+}
+
+// WorkingDirectory returns the directory requested by the client, if any
+func (s *Session) WorkingDirectory() string {
+	return s.workingDirectory
+}
+
+// Pty returns the pty requested by the client before starting the session, if any
+func (s *Session) Pty() (*ssh3Messages.PtyRequest, bool) {
+	return s.pty, s.pty != nil
+}
+
+// WindowChanges receives the new sizes of the terminal of the client. Only the latest size is
+// kept if it is not received in time.
+func (s *Session) WindowChanges() <-chan *ssh3Messages.WindowChangeRequest {
+	return s.windowChanges
+}
+
+// Signals receives the names of the signals sent by the client, without the SIG prefix. The
+// signals are dropped if they are not received in time.
+func (s *Session) Signals() <-chan string {
+	return s.signals
+}
+
+// Read reads the standard input sent by the client
+func (s *Session) Read(p []byte) (int, error) {
+	return s.stdin.Read(p)
+}
+
+// Write writes the standard output of the session
+func (s *Session) Write(p []byte) (int, error) {
+	return s.write(p, ssh3Messages.SSH_EXTENDED_DATA_NONE)
+}
+
+// Stderr returns a writer of the standard error of the session
+func (s *Session) Stderr() io.Writer {
+	return stderrWriter{s}
+}
+
+func (s *Session) write(p []byte, dataType ssh3Messages.SSHDataType) (int, error) {
+	// WriteData counts the bytes of the messages, headers included
+	if _, err := s.channel.WriteData(p, dataType); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Exit sends the exit status of the session to the client, which then stops reading its output
+func (s *Session) Exit(status int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.exited {
+		return errors.New("the session already exited")
+	}
+	s.exited = true
+	return s.channel.SendRequest(&ssh3Messages.ChannelRequestMessage{
+		WantReply:      false,
+		ChannelRequest: &ssh3Messages.ExitStatusRequest{ExitStatus: uint64(status)},
+	})
+}
+
+type stderrWriter struct {
+	session *Session
+}
+
+func (w stderrWriter) Write(p []byte) (int, error) {
+	return w.session.write(p, ssh3Messages.SSH_EXTENDED_DATA_STDERR)
+}
+
+// serveSession dispatches the messages of the session channel until the client closes it
+func (s *Server) serveSession(session *Session) {
+	started := false
+	handlerDone := make(chan struct{})
+	start := func(handler SessionHandler) {
+		if started {
+			log.Warn().Msgf("ignoring new request on already started session channel %d", session.channel.ChannelID())
+			return
+		}
+		started = true
+		go func() {
+			defer close(handlerDone)
+			defer session.channel.Close()
+			// the input that is not read anymore is discarded
+			defer session.stdin.Close()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Error().Msgf("panic while handling session of user %s: %v\n%s", session.user, r, debug.Stack())
+					session.Exit(1)
+				}
+			}()
+			if handler == nil {
+				session.Stderr().Write([]byte("request not supported by the server\n"))
+				session.Exit(127)
+				return
+			}
+			handler(session)
+			session.lock.Lock()
+			exited := session.exited
+			session.lock.Unlock()
+			if !exited {
+				session.Exit(0)
+			}
+		}()
+	}
+
+	dispatcher := ssh3.NewChannelDispatcher()
+	if session.conv != nil {
+		dispatcher.ReplyToRequests(session.conv.PeerExtInfo())
+	}
+	if s.config.PreRequestHook != nil {
+		dispatcher.AddPreRequestHook(s.config.PreRequestHook)
+	}
+	if s.config.PostRequestHook != nil {
+		dispatcher.AddPostRequestHook(s.config.PostRequestHook)
+	}
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.PtyRequest, wantReply bool) error {
+		session.pty = request
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.WorkingDirectoryRequest, wantReply bool) error {
+		session.workingDirectory = request.Directory
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ShellRequest, wantReply bool) error {
+		start(s.config.SessionHandler)
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExecRequest, wantReply bool) error {
+		if !started {
+			session.command = request.Command
+		}
+		start(s.config.SessionHandler)
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.ExecArgvRequest, wantReply bool) error {
+		if !started {
+			session.command, session.argv = request.Command(), request.Argv
+		}
+		start(s.config.SessionHandler)
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.SubsystemRequest, wantReply bool) error {
+		if !started {
+			session.subsystem = request.SubsystemName
+		}
+		handler, _ := s.config.Subsystems.Lookup(request.SubsystemName)
+		start(handler)
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.WindowChangeRequest, wantReply bool) error {
+		// keep the latest size only
+		select {
+		case <-session.windowChanges:
+		default:
+		}
+		session.windowChanges <- request
+		return nil
+	})
+	ssh3.HandleChannelRequest(dispatcher, func(ctx context.Context, channel ssh3.Channel, request *ssh3Messages.SignalRequest, wantReply bool) error {
+		select {
+		case session.signals <- request.SignalNameWithoutSig:
+		default:
+			log.Warn().Msgf("dropping signal %s on session channel %d", request.SignalNameWithoutSig, channel.ChannelID())
+		}
+		return nil
+	})
+	dispatcher.HandleEOF(ssh3.EOFHandlerFunc(func(ctx context.Context, channel ssh3.Channel) error {
+		// the handler reads the end of the input, the client can still send requests
+		return session.stdinWriter.Close()
+	}))
+	dispatcher.HandleData(ssh3.DataHandlerFunc(func(ctx context.Context, channel ssh3.Channel, message *ssh3Messages.DataOrExtendedDataMessage) error {
+		// blocks until the handler reads the input
+		if _, err := session.stdinWriter.Write([]byte(message.Data)); err != nil {
+			log.Debug().Msgf("discarding input of session channel %d: %s", channel.ChannelID(), err)
+		}
+		return nil
+	}))
+
+	for {
+		genericMessage, err := session.channel.NextMessage()
+		if err == nil && genericMessage != nil {
+			err = dispatcher.Dispatch(session.ctx, session.channel, genericMessage)
+			if err == nil {
+				continue
+			}
+			// the session ends along with its channel
+			session.channel.Close()
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Debug().Msgf("session channel %d ended: %s", session.channel.ChannelID(), err)
+		}
+		// the handler reads the end of the input
+		session.stdinWriter.Close()
+		if !started {
+			session.channel.Close()
+		} else {
+			<-handlerDone
+		}
+		return
+	}
+}
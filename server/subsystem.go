@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SubsystemRegistry maps subsystem names onto their handlers, either in-process Go handlers or
+// external commands. It is safe for concurrent use, so that subsystems can be registered and
+// unregistered while the server runs.
+type SubsystemRegistry struct {
+	lock     sync.RWMutex
+	handlers map[string]SessionHandler
+}
+
+func NewSubsystemRegistry() *SubsystemRegistry {
+	return &SubsystemRegistry{handlers: make(map[string]SessionHandler)}
+}
+
+// Register registers the handler of the subsystem requests named name (e.g. "sftp"). It fails
+// if a handler is already registered for that name.
+func (r *SubsystemRegistry) Register(name string, handler SessionHandler) error {
+	if name == "" {
+		return errors.New("empty subsystem name")
+	}
+	if handler == nil {
+		return fmt.Errorf("nil handler for subsystem %s", name)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.handlers[name]; ok {
+		return fmt.Errorf("subsystem %s already registered", name)
+	}
+	r.handlers[name] = handler
+	return nil
+}
+
+// RegisterCommand registers a subsystem served by an external command, similarly to the
+// Subsystem directive of sshd (e.g. RegisterCommand("sftp", "/usr/lib/openssh/sftp-server")).
+// See CommandHandler.
+func (r *SubsystemRegistry) RegisterCommand(name string, command string, args ...string) error {
+	return r.Register(name, CommandHandler(command, args...))
+}
+
+// Unregister removes the handler of name, the sessions already started are not affected
+func (r *SubsystemRegistry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.handlers, name)
+}
+
+// Lookup returns the handler registered for name, if any
+func (r *SubsystemRegistry) Lookup(name string) (SessionHandler, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	handler, ok := r.handlers[name]
+	return handler, ok
+}
+
+// Names returns the sorted names of the registered subsystems
+func (r *SubsystemRegistry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.handlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// CommandHandler returns a handler running the command with the standard input, output and error
+// of the session, in the working directory requested by the client. The command runs as the
+// user of the server process, and the session exits with the exit status of the command, or
+// 127 if it cannot be started. The command is killed when the conversation ends.
+func CommandHandler(command string, args ...string) SessionHandler {
+	return func(session *Session) {
+		cmd := exec.CommandContext(session.Context(), command, args...)
+		cmd.Dir = session.WorkingDirectory()
+		cmd.Stdout = session
+		cmd.Stderr = session.Stderr()
+		// unlike cmd.Stdin, the pipe does not make Wait wait for the end of the input, which is
+		// only closed when the handler returns
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Error().Msgf("could not start subsystem %s: %s", session.Subsystem(), err)
+			fmt.Fprintf(session.Stderr(), "could not start subsystem %s\n", session.Subsystem())
+			session.Exit(127)
+			return
+		}
+		go func() {
+			io.Copy(stdin, session)
+			stdin.Close()
+		}()
+		err = cmd.Wait()
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			session.Exit(exitError.ExitCode())
+		} else if err != nil {
+			log.Error().Msgf("error while running subsystem %s: %s", session.Subsystem(), err)
+			session.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package ssh3
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// the type of the HTTPS records, the SVCB records of the HTTP servers (RFC 9460)
+const dnsTypeHTTPS dnsmessage.Type = 65
+
+// the keys of the service parameters of the SVCB and HTTPS records
+const (
+	svcParamMandatory     = 0
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+	// SVCParamURLPath is the private-use key carrying the URL path of the SSH3 server in its HTTPS
+	// record, "key65280" in the zone files (e.g. key65280="/ssh3")
+	SVCParamURLPath = 65280
+)
+
+// the number of alias records followed before giving up, as a loop would never end
+const maxServiceAliases = 8
+
+// ServiceEndpoint is an alternative endpoint of a server advertised in its HTTPS record (RFC 9460),
+// e.g. "my-server.example.org. HTTPS 1 . alpn=h3 port=4443 key65280=/ssh3"
+type ServiceEndpoint struct {
+	// the lowest priorities are preferred, 0 being an alias to Target
+	Priority uint16
+	// the name to resolve to reach the endpoint, "" for the owner of the record
+	Target string
+	ALPN   []string
+	// 0 if the default port applies
+	Port      uint16
+	IPv4Hints []net.IP
+	IPv6Hints []net.IP
+	// the ECHConfigList to encrypt the ClientHello with, if the server supports it
+	ECHConfigList []byte
+	// the URL path of the SSH3 server (see SVCParamURLPath), "" if not advertised
+	URLPath string
+}
+
+// IsAlias returns true if the record is an alias to another name (AliasMode)
+func (e ServiceEndpoint) IsAlias() bool {
+	return e.Priority == 0
+}
+
+// ParseServiceEndpoint parses the RDATA of an SVCB or HTTPS record. The records whose mandatory
+// parameters are not understood are refused, as the clients must ignore them.
+func ParseServiceEndpoint(data []byte) (ServiceEndpoint, error) {
+	var endpoint ServiceEndpoint
+	if len(data) < 2 {
+		return endpoint, fmt.Errorf("truncated service binding")
+	}
+	endpoint.Priority = binary.BigEndian.Uint16(data)
+	target, rest, err := parseUncompressedName(data[2:])
+	if err != nil {
+		return endpoint, err
+	}
+	endpoint.Target = target
+	var mandatory []uint16
+	lastKey := -1
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return endpoint, fmt.Errorf("truncated service parameter")
+		}
+		key, length := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if len(rest) < 4+length {
+			return endpoint, fmt.Errorf("truncated value of service parameter key%d", key)
+		}
+		if int(key) <= lastKey {
+			return endpoint, fmt.Errorf("service parameters not in strictly increasing order (key%d)", key)
+		}
+		lastKey = int(key)
+		value := rest[4 : 4+length]
+		rest = rest[4+length:]
+		switch key {
+		case svcParamMandatory:
+			if length == 0 || length%2 != 0 {
+				return endpoint, fmt.Errorf("invalid mandatory service parameters")
+			}
+			for i := 0; i < length; i += 2 {
+				mandatory = append(mandatory, binary.BigEndian.Uint16(value[i:]))
+			}
+		case svcParamALPN:
+			for len(value) > 0 {
+				if int(value[0]) == 0 || len(value) < 1+int(value[0]) {
+					return endpoint, fmt.Errorf("invalid alpn service parameter")
+				}
+				endpoint.ALPN = append(endpoint.ALPN, string(value[1:1+value[0]]))
+				value = value[1+value[0]:]
+			}
+		case svcParamPort:
+			if length != 2 {
+				return endpoint, fmt.Errorf("invalid port service parameter")
+			}
+			endpoint.Port = binary.BigEndian.Uint16(value)
+		case svcParamIPv4Hint, svcParamIPv6Hint:
+			size := net.IPv4len
+			if key == svcParamIPv6Hint {
+				size = net.IPv6len
+			}
+			if length == 0 || length%size != 0 {
+				return endpoint, fmt.Errorf("invalid address hints in key%d", key)
+			}
+			for i := 0; i < length; i += size {
+				ip := net.IP(slices.Clone(value[i : i+size]))
+				if key == svcParamIPv6Hint {
+					endpoint.IPv6Hints = append(endpoint.IPv6Hints, ip)
+				} else {
+					endpoint.IPv4Hints = append(endpoint.IPv4Hints, ip)
+				}
+			}
+		case svcParamECH:
+			endpoint.ECHConfigList = slices.Clone(value)
+		case SVCParamURLPath:
+			endpoint.URLPath = string(value)
+		}
+	}
+	for _, key := range mandatory {
+		if key == svcParamMandatory || key > svcParamIPv6Hint && key != SVCParamURLPath {
+			return endpoint, fmt.Errorf("unsupported mandatory service parameter key%d", key)
+		}
+	}
+	return endpoint, nil
+}
+
+// the target names are not compressed in the service bindings
+func parseUncompressedName(data []byte) (string, []byte, error) {
+	var labels []string
+	for {
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return "", nil, fmt.Errorf("truncated target name")
+		}
+		length := int(data[0])
+		if length > 63 {
+			return "", nil, fmt.Errorf("invalid label in target name")
+		}
+		label := data[1 : 1+length]
+		data = data[1+length:]
+		if length == 0 {
+			return strings.Join(labels, "."), data, nil
+		}
+		labels = append(labels, string(label))
+	}
+}
+
+// SelectServiceEndpoint returns the preferred endpoint of the service mode records supporting alpn
+// (e.g. "h3"), the endpoints being sorted by priority
+func SelectServiceEndpoint(endpoints []ServiceEndpoint, alpn string) (ServiceEndpoint, bool) {
+	for _, endpoint := range endpoints {
+		if !endpoint.IsAlias() && slices.Contains(endpoint.ALPN, alpn) {
+			return endpoint, true
+		}
+	}
+	return ServiceEndpoint{}, false
+}
+
+// queries the RDATA of the records of type recordType of name
+type serviceBindingQuerier func(ctx context.Context, name string, recordType dnsmessage.Type) ([][]byte, error)
+
+// LookupServiceEndpoints returns the service mode endpoints of the HTTPS records of host, sorted by
+// priority, following its alias records. The targets of the endpoints are resolved to the name
+// owning the records, so that they can be dialed. The system resolvers of /etc/resolv.conf are
+// queried, the Go resolver not supporting these records.
+func LookupServiceEndpoints(ctx context.Context, host string) ([]ServiceEndpoint, error) {
+	return lookupServiceEndpoints(ctx, host, queryServiceBindings)
+}
+
+func lookupServiceEndpoints(ctx context.Context, host string, query serviceBindingQuerier) ([]ServiceEndpoint, error) {
+	name := strings.TrimSuffix(host, ".")
+	for aliases := 0; aliases <= maxServiceAliases; aliases++ {
+		records, err := query(ctx, name, dnsTypeHTTPS)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []ServiceEndpoint
+		var alias *ServiceEndpoint
+		for _, record := range records {
+			endpoint, err := ParseServiceEndpoint(record)
+			if err != nil {
+				// as required by RFC 9460, the malformed records are ignored
+				continue
+			}
+			if endpoint.IsAlias() {
+				alias = &endpoint
+				continue
+			}
+			if endpoint.Target == "" {
+				endpoint.Target = name
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		// the service mode records take precedence over the alias ones
+		if len(endpoints) > 0 || alias == nil {
+			slices.SortStableFunc(endpoints, func(a, b ServiceEndpoint) int { return int(a.Priority) - int(b.Priority) })
+			return endpoints, nil
+		}
+		if alias.Target == "" {
+			// an alias to "." means that the service is not available
+			return nil, nil
+		}
+		name = alias.Target
+	}
+	return nil, fmt.Errorf("too many HTTPS alias records from %s", host)
+}
+
+// the resolver configuration whose nameservers are queried
+const resolvConfPath = "/etc/resolv.conf"
+
+// returns the nameservers of resolv.conf, the local one if none, as the Go resolver does
+func systemNameservers() ([]string, error) {
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var nameservers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			// the link-local addresses may have a zone, that JoinHostPort brackets as well
+			nameservers = append(nameservers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	if len(nameservers) == 0 {
+		nameservers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return nameservers, scanner.Err()
+}
+
+func queryServiceBindings(ctx context.Context, name string, recordType dnsmessage.Type) ([][]byte, error) {
+	nameservers, err := systemNameservers()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the nameservers: %w", err)
+	}
+	var errs []error
+	for _, nameserver := range nameservers {
+		records, err := queryNameserver(ctx, nameserver, name, recordType)
+		if err == nil {
+			return records, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// sends the query over UDP, and over TCP if the answer was truncated
+func queryNameserver(ctx context.Context, nameserver string, name string, recordType dnsmessage.Type) ([][]byte, error) {
+	dnsName, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: dnsName, Type: recordType, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	// the ECH configs do not fit in the 512 bytes of the plain DNS messages
+	var optHeader dnsmessage.ResourceHeader
+	if err := optHeader.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := builder.OPTResource(optHeader, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	records, truncated, err := exchangeDNS(ctx, "udp", nameserver, query, id, recordType)
+	if err == nil && truncated {
+		records, _, err = exchangeDNS(ctx, "tcp", nameserver, query, id, recordType)
+	}
+	return records, err
+}
+
+func exchangeDNS(ctx context.Context, network string, nameserver string, query []byte, id uint16, recordType dnsmessage.Type) ([][]byte, bool, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, nameserver)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	var response []byte
+	if network == "tcp" {
+		message := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(message, query...)); err != nil {
+			return nil, false, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, false, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, false, err
+		}
+		response = make([]byte, 65535)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				return nil, false, err
+			}
+			// the answers to other queries are ignored
+			if n >= 2 && binary.BigEndian.Uint16(response) == id {
+				response = response[:n]
+				break
+			}
+		}
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, false, err
+	}
+	if header.ID != id {
+		return nil, false, fmt.Errorf("unexpected DNS answer from %s", nameserver)
+	}
+	if header.Truncated {
+		return nil, true, nil
+	}
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, false, nil
+	} else if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, false, fmt.Errorf("DNS error from %s: %s", nameserver, header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, false, err
+	}
+	var records [][]byte
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return records, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		// the CNAME records are followed by the resolver, that also answers the records of the target
+		if answer.Type != recordType {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		resource, err := parser.UnknownResource()
+		if err != nil {
+			return nil, false, err
+		}
+		records = append(records, resource.Data)
+	}
+}
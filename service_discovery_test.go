@@ -0,0 +1,123 @@
+package ssh3_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+	"golang.org/x/net/dns/dnsmessage"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// builds the RDATA of an SVCB or HTTPS record, the parameters being given in order
+func serviceBinding(priority uint16, target string, params ...any) []byte {
+	data := binary.BigEndian.AppendUint16(nil, priority)
+	if target != "" {
+		for _, label := range strings.Split(target, ".") {
+			data = append(append(data, byte(len(label))), label...)
+		}
+	}
+	data = append(data, 0)
+	for i := 0; i < len(params); i += 2 {
+		value := params[i+1].([]byte)
+		data = binary.BigEndian.AppendUint16(data, uint16(params[i].(int)))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+		data = append(data, value...)
+	}
+	return data
+}
+
+var _ = Describe("Service discovery", func() {
+	alpn := []byte("\x02h3\x02h2")
+
+	It("Parses the service parameters", func() {
+		endpoint, err := ssh3.ParseServiceEndpoint(serviceBinding(1, "ssh3.example.org",
+			1, alpn, 3, []byte{0x11, 0x5b}, 4, []byte{192, 0, 2, 1}, 5, []byte("ech-configs"), ssh3.SVCParamURLPath, []byte("/ssh3")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoint).To(Equal(ssh3.ServiceEndpoint{
+			Priority:      1,
+			Target:        "ssh3.example.org",
+			ALPN:          []string{"h3", "h2"},
+			Port:          4443,
+			IPv4Hints:     []net.IP{{192, 0, 2, 1}},
+			ECHConfigList: []byte("ech-configs"),
+			URLPath:       "/ssh3",
+		}))
+		Expect(endpoint.IsAlias()).To(BeFalse())
+	})
+
+	It("Refuses the malformed records and the unsupported mandatory parameters", func() {
+		for _, invalid := range [][]byte{
+			{0},
+			serviceBinding(1, "", 3, []byte{1}),
+			serviceBinding(1, "", 3, []byte{0x11, 0x5b}, 1, alpn),
+			serviceBinding(1, "", 0, []byte{0, 7}, 1, alpn),
+			serviceBinding(1, "", 4, []byte{192, 0, 2}),
+		} {
+			_, err := ssh3.ParseServiceEndpoint(invalid)
+			Expect(err).To(HaveOccurred(), "%x", invalid)
+		}
+		_, err := ssh3.ParseServiceEndpoint(serviceBinding(1, "", 0, []byte{0, 3}, 3, []byte{0x11, 0x5b}))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Follows the aliases and selects the preferred HTTP/3 endpoint", func() {
+		records := map[string][][]byte{
+			"example.org": {serviceBinding(0, "cdn.example.net")},
+			"cdn.example.net": {
+				serviceBinding(2, "", 1, []byte("\x02h3"), 3, []byte{0x11, 0x5c}),
+				serviceBinding(1, "backup.example.net", 1, []byte("\x02h2")),
+				serviceBinding(3, "", 1, []byte("\x02h3"), 3, []byte{0x11, 0x5b}),
+			},
+		}
+		endpoints, err := ssh3.LookupServiceEndpointsWith(context.Background(), "example.org.", func(name string) [][]byte { return records[name] })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoints).To(HaveLen(3))
+		endpoint, ok := ssh3.SelectServiceEndpoint(endpoints, "h3")
+		Expect(ok).To(BeTrue())
+		Expect(endpoint.Target).To(Equal("cdn.example.net"))
+		Expect(endpoint.Port).To(BeEquivalentTo(4444))
+
+		records["loop.example.org"] = [][]byte{serviceBinding(0, "loop.example.org")}
+		_, err = ssh3.LookupServiceEndpointsWith(context.Background(), "loop.example.org", func(name string) [][]byte { return records[name] })
+		Expect(err).To(HaveOccurred())
+		endpoints, err = ssh3.LookupServiceEndpointsWith(context.Background(), "none.example.org", func(name string) [][]byte { return records[name] })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoints).To(BeEmpty())
+	})
+
+	It("Queries the HTTPS records of a nameserver", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		record := serviceBinding(1, "", 1, []byte("\x02h3"), ssh3.SVCParamURLPath, []byte("/ssh3"))
+		go func() {
+			defer GinkgoRecover()
+			buf := make([]byte, 1500)
+			n, addr, err := conn.ReadFrom(buf)
+			Expect(err).ToNot(HaveOccurred())
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			Expect(err).ToNot(HaveOccurred())
+			question, err := parser.Question()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(question.Type).To(BeEquivalentTo(65))
+			builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true})
+			Expect(builder.StartQuestions()).To(Succeed())
+			Expect(builder.Question(question)).To(Succeed())
+			Expect(builder.StartAnswers()).To(Succeed())
+			Expect(builder.UnknownResource(dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60},
+				dnsmessage.UnknownResource{Type: question.Type, Data: record})).To(Succeed())
+			response, err := builder.Finish()
+			Expect(err).ToNot(HaveOccurred())
+			conn.WriteTo(response, addr)
+		}()
+		records, err := ssh3.QueryHTTPSRecords(context.Background(), conn.LocalAddr().String(), "my-server.example.org")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(records).To(Equal([][]byte{record}))
+	})
+})
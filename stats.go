@@ -0,0 +1,45 @@
+package ssh3
+
+import (
+	"sort"
+)
+
+// ChannelStatsReport describes a channel and its counters in a machine-readable way
+type ChannelStatsReport struct {
+	ConversationID string `json:"conversation_id"`
+	ChannelID      uint64 `json:"channel_id"`
+	ChannelType    string `json:"channel_type"`
+	// RemoteAddr is only set for forwarding channels
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	ChannelStats
+}
+
+func NewChannelStatsReport(channel Channel) ChannelStatsReport {
+	report := ChannelStatsReport{
+		ConversationID: channel.ConversationID().String(),
+		ChannelID:      channel.ChannelID(),
+		ChannelType:    channel.ChannelType(),
+		ChannelStats:   channel.Stats(),
+	}
+	switch c := channel.(type) {
+	case *UDPForwardingChannelImpl:
+		report.RemoteAddr = c.RemoteAddr.String()
+	case *TCPForwardingChannelImpl:
+		report.RemoteAddr = c.RemoteAddr.String()
+	}
+	return report
+}
+
+// ChannelsStats returns the statistics of all the channels of the conversation,
+// sorted by channel ID
+func (c *Conversation) ChannelsStats() []ChannelStatsReport {
+	channels := c.Channels()
+	reports := make([]ChannelStatsReport, 0, len(channels))
+	for _, channel := range channels {
+		reports = append(reports, NewChannelStatsReport(channel))
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ChannelID < reports[j].ChannelID
+	})
+	return reports
+}
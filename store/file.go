@@ -0,0 +1,51 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+)
+
+// File keeps the state in memory and rewrites it in a JSON file after each modification, so
+// that it survives a restart of the server. It must not be shared by several processes.
+type File struct {
+	*Memory
+	path string
+}
+
+// OpenFile loads the state saved in path, if any
+func OpenFile(path string) (*File, error) {
+	memory := NewMemory()
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(content, &memory.entries); err != nil {
+			return nil, fmt.Errorf("could not parse store file %s: %w", path, err)
+		}
+		now := time.Now()
+		for key, entry := range memory.entries {
+			if entry.expired(now) {
+				delete(memory.entries, key)
+			}
+		}
+	}
+	file := &File{Memory: memory, path: path}
+	memory.onChange = file.save
+	return file, nil
+}
+
+// writes the entries in a temporary file renamed over path, so that a crash never leaves a
+// truncated file
+func (f *File) save(entries map[string]memoryEntry) error {
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(f.path, content, 0600)
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisConfig configures the connection to a Redis server (version 6.2 or later)
+type RedisConfig struct {
+	// host:port
+	Address  string
+	Password string
+	Database int
+	// prefixes the keys, so that several clusters can share a Redis server
+	KeyPrefix string
+}
+
+// Redis keeps the state in a Redis server shared by the servers of a cluster. It uses a single
+// connection, dialed again after an error.
+type Redis struct {
+	config RedisConfig
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type RedisError struct {
+	Message string
+}
+
+func (e RedisError) Error() string {
+	return fmt.Sprintf("redis error: %s", e.Message)
+}
+
+// DialRedis connects to the Redis server and authenticates if a password is configured
+func DialRedis(ctx context.Context, config RedisConfig) (*Redis, error) {
+	r := &Redis{config: config}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.connect(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// the lock must be held
+func (r *Redis) connect(ctx context.Context) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", r.config.Address)
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+	if r.config.Password != "" {
+		if _, err := r.roundTrip(ctx, "AUTH", r.config.Password); err != nil {
+			r.disconnect()
+			return err
+		}
+	}
+	if r.config.Database != 0 {
+		if _, err := r.roundTrip(ctx, "SELECT", strconv.Itoa(r.config.Database)); err != nil {
+			r.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) disconnect() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn, r.reader = nil, nil
+	}
+}
+
+// sends a command and returns its reply: nil, a string, an int64 or a []interface{}
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(ctx, args...)
+	var redisError RedisError
+	if err != nil && !errors.As(err, &redisError) {
+		// the connection may be desynchronized
+		r.disconnect()
+	}
+	return reply, err
+}
+
+// the lock must be held
+func (r *Redis) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	r.conn.SetDeadline(deadline)
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r.reader)
+}
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError{Message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		} else if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		} else if length < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, length)
+		for i := range elements {
+			if elements[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+func (r *Redis) setArgs(key string, value []byte, ttl time.Duration) []string {
+	args := []string{"SET", r.config.KeyPrefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	return args
+}
+
+func (r *Redis) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := r.do(ctx, r.setArgs(key, value, ttl)...)
+	return err
+}
+
+func (r *Redis) PutIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := r.do(ctx, append(r.setArgs(key, value, ttl), "NX")...)
+	// nil if the key is already set
+	return reply != nil, err
+}
+
+func (r *Redis) getReply(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return []byte(value), nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	return r.getReply(r.do(ctx, "GET", r.config.KeyPrefix+key))
+}
+
+func (r *Redis) Take(ctx context.Context, key string) ([]byte, error) {
+	return r.getReply(r.do(ctx, "GETDEL", r.config.KeyPrefix+key))
+}
+
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", r.config.KeyPrefix+key)
+	return err
+}
+
+// escapes the glob special characters of SCAN patterns
+var redisPatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+func (r *Redis) Count(ctx context.Context, prefix string) (int, error) {
+	pattern := redisPatternEscaper.Replace(r.config.KeyPrefix+prefix) + "*"
+	// SCAN may return a key several times
+	keys := make(map[string]struct{})
+	cursor := "0"
+	for {
+		reply, err := r.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return 0, err
+		}
+		elements, ok := reply.([]interface{})
+		if !ok || len(elements) != 2 {
+			return 0, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		scanned, ok := elements[1].([]interface{})
+		if !ok {
+			return 0, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		for _, key := range scanned {
+			if key, ok := key.(string); ok {
+				keys[key] = struct{}{}
+			}
+		}
+		if cursor, ok = elements[0].(string); !ok || cursor == "0" {
+			return len(keys), nil
+		}
+	}
+}
+
+func (r *Redis) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.disconnect()
+	return nil
+}
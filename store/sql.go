@@ -0,0 +1,112 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS ssh3_store (
+	key TEXT PRIMARY KEY,
+	value BLOB NOT NULL,
+	expires_at INTEGER NOT NULL
+)`
+
+// SQL keeps the state in an SQL database, e.g. an SQLite file shared by the servers of a host.
+// The queries use the SQLite dialect, with ? placeholders and upserts.
+type SQL struct {
+	db *sql.DB
+}
+
+// OpenSQL opens the database using the database/sql driver registered as driverName (e.g.
+// "sqlite" by modernc.org/sqlite or "sqlite3" by github.com/mattn/go-sqlite3), which must be
+// linked in the binary, and creates the table of the store if needed
+func OpenSQL(driverName string, dataSourceName string) (*SQL, error) {
+	if !slices.Contains(sql.Drivers(), driverName) {
+		return nil, fmt.Errorf("no database/sql driver registered as %q in this binary, build it with one (registered: %v)", driverName, sql.Drivers())
+	}
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create the store table: %w", err)
+	}
+	return &SQL{db: db}, nil
+}
+
+// the expiry in Unix nanoseconds, 0 if the value does not expire
+func sqlExpiry(ttl time.Duration, now time.Time) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+const sqlNotExpired = "(expires_at = 0 OR expires_at > ?)"
+
+func (s *SQL) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO ssh3_store (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, value, sqlExpiry(ttl, time.Now()))
+	return err
+}
+
+func (s *SQL) PutIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// an expired value does not prevent the insertion
+	result, err := s.db.ExecContext(ctx, `INSERT INTO ssh3_store (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+		WHERE NOT `+sqlNotExpired,
+		key, value, sqlExpiry(ttl, now), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+func (s *SQL) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM ssh3_store WHERE key = ? AND "+sqlNotExpired, key, time.Now().UnixNano()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *SQL) Take(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, "DELETE FROM ssh3_store WHERE key = ? AND "+sqlNotExpired+" RETURNING value", key, time.Now().UnixNano()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *SQL) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM ssh3_store WHERE key = ?", key)
+	return err
+}
+
+func (s *SQL) Count(ctx context.Context, prefix string) (int, error) {
+	now := time.Now().UnixNano()
+	// the expired values are only purged here, Get and Take ignore them
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM ssh3_store WHERE NOT "+sqlNotExpired, now); err != nil {
+		return 0, err
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM ssh3_store WHERE key LIKE ? ESCAPE '\' AND `+sqlNotExpired,
+		escaper.Replace(prefix)+"%", now).Scan(&count)
+	return count, err
+}
+
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
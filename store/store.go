@@ -0,0 +1,147 @@
+// Package store keeps the state that the SSH3 servers share and that outlives a conversation,
+// e.g. the one-time tokens and the rate-limiting counters. Memory suits a single server, File
+// persists the state of a single server across restarts, and SQL and Redis share it between the
+// servers of a cluster.
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Store maps keys to values that optionally expire. The implementations are safe for concurrent
+// use, and the atomic operations are atomic across the servers sharing the store.
+type Store interface {
+	// Put sets the value of key, which expires after ttl if it is positive
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// PutIfAbsent sets the value of key as Put does, unless key is already set. It returns
+	// false in that case, e.g. to detect replayed nonces.
+	PutIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Get returns ErrNotFound if key is not set or expired
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Take gets and deletes the value of key atomically, so that a one-time token can only be
+	// redeemed once
+	Take(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// Count returns the number of keys starting with prefix that did not expire
+	Count(ctx context.Context, prefix string) (int, error)
+	Close() error
+}
+
+type memoryEntry struct {
+	Value []byte `json:"value"`
+	// the zero time if the entry does not expire
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.Expiry.IsZero() && !now.Before(e.Expiry)
+}
+
+func newMemoryEntry(value []byte, ttl time.Duration, now time.Time) memoryEntry {
+	entry := memoryEntry{Value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.Expiry = now.Add(ttl)
+	}
+	return entry
+}
+
+// Memory keeps the state in the memory of the process, it is lost on restart
+type Memory struct {
+	entries map[string]memoryEntry
+	lock    sync.Mutex
+	// called with the lock held after each modification, used by File
+	onChange func(entries map[string]memoryEntry) error
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry)}
+}
+
+// returns the entry of key if it did not expire, the lock must be held
+func (m *Memory) get(key string, now time.Time) (memoryEntry, bool) {
+	entry, ok := m.entries[key]
+	if ok && entry.expired(now) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (m *Memory) changed() error {
+	if m.onChange == nil {
+		return nil
+	}
+	return m.onChange(m.entries)
+}
+
+func (m *Memory) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries[key] = newMemoryEntry(value, ttl, time.Now())
+	return m.changed()
+}
+
+func (m *Memory) PutIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if _, ok := m.get(key, now); ok {
+		return false, nil
+	}
+	m.entries[key] = newMemoryEntry(value, ttl, now)
+	return true, m.changed()
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.get(key, time.Now())
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), entry.Value...), nil
+}
+
+func (m *Memory) Take(ctx context.Context, key string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.get(key, time.Now())
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.entries, key)
+	return entry.Value, m.changed()
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[key]; !ok {
+		return nil
+	}
+	delete(m.entries, key)
+	return m.changed()
+}
+
+func (m *Memory) Count(ctx context.Context, prefix string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	count := 0
+	for key := range m.entries {
+		if _, ok := m.get(key, now); ok && strings.HasPrefix(key, prefix) {
+			count += 1
+		}
+	}
+	return count, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// serves the commands used by Redis on a Memory store, as a Redis server would
+func serveFakeRedis(listener net.Listener, password string) {
+	memory := NewMemory()
+	ctx := context.Background()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			authenticated := password == ""
+			for {
+				reply, err := readRedisReply(reader)
+				if err != nil {
+					return
+				}
+				var args []string
+				for _, arg := range reply.([]interface{}) {
+					args = append(args, arg.(string))
+				}
+				response := "+OK\r\n"
+				bulk := func(value []byte, err error) string {
+					if err != nil {
+						return "$-1\r\n"
+					}
+					return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+				}
+				switch {
+				case args[0] == "AUTH":
+					authenticated = args[1] == password
+					if !authenticated {
+						response = "-WRONGPASS invalid password\r\n"
+					}
+				case !authenticated:
+					response = "-NOAUTH Authentication required.\r\n"
+				case args[0] == "SET":
+					var ttl time.Duration
+					nx := false
+					for i := 3; i < len(args); i++ {
+						switch args[i] {
+						case "PX":
+							ms, _ := strconv.Atoi(args[i+1])
+							ttl = time.Duration(ms) * time.Millisecond
+							i++
+						case "NX":
+							nx = true
+						}
+					}
+					if nx {
+						if ok, _ := memory.PutIfAbsent(ctx, args[1], []byte(args[2]), ttl); !ok {
+							response = "$-1\r\n"
+						}
+					} else {
+						memory.Put(ctx, args[1], []byte(args[2]), ttl)
+					}
+				case args[0] == "GET":
+					response = bulk(memory.Get(ctx, args[1]))
+				case args[0] == "GETDEL":
+					response = bulk(memory.Take(ctx, args[1]))
+				case args[0] == "DEL":
+					memory.Delete(ctx, args[1])
+					response = ":1\r\n"
+				case args[0] == "SCAN":
+					// returns all the keys at once
+					prefix := strings.ReplaceAll(strings.TrimSuffix(args[3], "*"), `\`, "")
+					var keys []string
+					memory.lock.Lock()
+					for key := range memory.entries {
+						if strings.HasPrefix(key, prefix) {
+							if _, ok := memory.get(key, time.Now()); ok {
+								keys = append(keys, key)
+							}
+						}
+					}
+					memory.lock.Unlock()
+					response = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+					for _, key := range keys {
+						response += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+					}
+				default:
+					response = "-ERR unknown command\r\n"
+				}
+				if _, err := conn.Write([]byte(response)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+var _ = Describe("Store", func() {
+	ctx := context.Background()
+
+	specs := func(newStore func() Store) {
+		It("Expires the values", func() {
+			store := newStore()
+			defer store.Close()
+			Expect(store.Put(ctx, "a", []byte("1"), 0)).To(Succeed())
+			Expect(store.Put(ctx, "b", []byte("2"), 50*time.Millisecond)).To(Succeed())
+			Expect(store.Get(ctx, "a")).To(Equal([]byte("1")))
+			Expect(store.Get(ctx, "b")).To(Equal([]byte("2")))
+			time.Sleep(100 * time.Millisecond)
+			_, err := store.Get(ctx, "b")
+			Expect(err).To(Equal(ErrNotFound))
+			Expect(store.Delete(ctx, "a")).To(Succeed())
+			_, err = store.Get(ctx, "a")
+			Expect(err).To(Equal(ErrNotFound))
+		})
+
+		It("Takes the values once", func() {
+			store := newStore()
+			defer store.Close()
+			Expect(store.Put(ctx, "token", []byte("alice"), time.Minute)).To(Succeed())
+			Expect(store.Take(ctx, "token")).To(Equal([]byte("alice")))
+			_, err := store.Take(ctx, "token")
+			Expect(err).To(Equal(ErrNotFound))
+		})
+
+		It("Puts the absent values only", func() {
+			store := newStore()
+			defer store.Close()
+			Expect(store.PutIfAbsent(ctx, "nonce", []byte("1"), 50*time.Millisecond)).To(BeTrue())
+			Expect(store.PutIfAbsent(ctx, "nonce", []byte("2"), time.Minute)).To(BeFalse())
+			Expect(store.Get(ctx, "nonce")).To(Equal([]byte("1")))
+			time.Sleep(100 * time.Millisecond)
+			Expect(store.PutIfAbsent(ctx, "nonce", []byte("3"), time.Minute)).To(BeTrue())
+		})
+
+		It("Counts the keys by prefix", func() {
+			store := newStore()
+			defer store.Close()
+			Expect(store.Put(ctx, "issued/1", nil, time.Minute)).To(Succeed())
+			Expect(store.Put(ctx, "issued/2", nil, 50*time.Millisecond)).To(Succeed())
+			Expect(store.Put(ctx, "other", nil, time.Minute)).To(Succeed())
+			Expect(store.Count(ctx, "issued/")).To(Equal(2))
+			time.Sleep(100 * time.Millisecond)
+			Expect(store.Count(ctx, "issued/")).To(Equal(1))
+		})
+	}
+
+	Context("Memory", func() {
+		specs(func() Store { return NewMemory() })
+	})
+
+	Context("File", func() {
+		var path string
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "store.json")
+		})
+
+		specs(func() Store {
+			store, err := OpenFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			return store
+		})
+
+		It("Restores the values after a restart", func() {
+			store, err := OpenFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Put(ctx, "kept", []byte("1"), time.Minute)).To(Succeed())
+			Expect(store.Put(ctx, "expired", []byte("2"), time.Millisecond)).To(Succeed())
+			Expect(store.Close()).To(Succeed())
+			time.Sleep(10 * time.Millisecond)
+
+			store, err = OpenFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Get(ctx, "kept")).To(Equal([]byte("1")))
+			Expect(store.Count(ctx, "")).To(Equal(1))
+		})
+	})
+
+	Context("Redis", func() {
+		var listener net.Listener
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			go serveFakeRedis(listener, "secret")
+			DeferCleanup(listener.Close)
+		})
+
+		specs(func() Store {
+			store, err := DialRedis(ctx, RedisConfig{Address: listener.Addr().String(), Password: "secret", KeyPrefix: "ssh3:"})
+			Expect(err).ToNot(HaveOccurred())
+			return store
+		})
+
+		It("Fails with a wrong password", func() {
+			_, err := DialRedis(ctx, RedisConfig{Address: listener.Addr().String(), Password: "wrong"})
+			Expect(err).To(BeAssignableToTypeOf(RedisError{}))
+		})
+	})
+})
@@ -0,0 +1,114 @@
+package ssh3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// When the server requires a second factor after the first one, it refuses the request with
+// 401 Unauthorized and the prompt in KeyboardInteractivePromptHeader. The client then sends the
+// request again with the first factor and the answer of the user in KeyboardInteractiveResponseHeader.
+const (
+	KeyboardInteractivePromptHeader   = "Ssh3-Keyboard-Interactive-Prompt"
+	KeyboardInteractiveResponseHeader = "Ssh3-Keyboard-Interactive-Response"
+)
+
+// the time-based one-time passwords (RFC 6238) are those of the authenticator apps: 6 digits
+// changing every 30 seconds, computed using HMAC-SHA1
+const (
+	totpTimeStep = 30 * time.Second
+	totpDigits   = 6
+	// the size of the generated secrets, as recommended by RFC 4226
+	totpSecretSize = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random secret encoded in base32, as the authenticator apps expect it
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// ParseTOTPSecret decodes a base32 secret, ignoring its case, spaces and padding
+func ParseTOTPSecret(encoded string) ([]byte, error) {
+	encoded = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(strings.TrimSpace(encoded), " ", ""), "="))
+	secret, err := totpEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 TOTP secret: %w", err)
+	}
+	if len(secret) < 10 {
+		return nil, fmt.Errorf("the TOTP secret is shorter than 80 bits")
+	}
+	return secret, nil
+}
+
+// LoadTOTPSecret reads the base32 secret on the first line of the file, such as the
+// ~/.google_authenticator files, the other lines being ignored
+func LoadTOTPSecret(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	firstLine, _, _ := bytes.Cut(content, []byte("\n"))
+	return ParseTOTPSecret(string(firstLine))
+}
+
+// TOTPStep returns the time step of the one-time passwords at the given time
+func TOTPStep(now time.Time) int64 {
+	return now.Unix() / int64(totpTimeStep.Seconds())
+}
+
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(step)))
+	sum := mac.Sum(nil)
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// NewTOTPCode returns the one-time password of secret at the given time
+func NewTOTPCode(secret []byte, now time.Time) string {
+	return totpCode(secret, TOTPStep(now))
+}
+
+// VerifyTOTPCode returns the time step of the one-time password if it is the one of secret at
+// the given time, or at the previous or next time step to tolerate the clock skews. The servers
+// refuse the codes of the steps that were already used, so that they cannot be replayed.
+func VerifyTOTPCode(secret []byte, code string, now time.Time) (step int64, ok bool) {
+	code = strings.TrimSpace(code)
+	step = TOTPStep(now)
+	for delta := int64(-1); delta <= 1; delta++ {
+		if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(secret, step+delta))) == 1 {
+			return step + delta, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPKeyURI returns the otpauth:// URI of the secret, shown as a QR code to the authenticator apps
+func TOTPKeyURI(encodedSecret string, account string, issuer string) string {
+	query := url.Values{"secret": {encodedSecret}, "issuer": {issuer}}
+	return (&url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: query.Encode()}).String()
+}
+
+// SetKeyboardInteractiveResponse adds the answer of the user to the prompt of the server to the request
+func SetKeyboardInteractiveResponse(req *http.Request, response string) {
+	req.Header.Set(KeyboardInteractiveResponseHeader, response)
+}
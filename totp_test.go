@@ -0,0 +1,51 @@
+package ssh3_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Time-based one-time passwords", func() {
+	// the SHA1 secret of the test vectors of RFC 6238
+	secret := []byte("12345678901234567890")
+
+	It("Computes the codes of the RFC 6238 test vectors", func() {
+		Expect(ssh3.NewTOTPCode(secret, time.Unix(59, 0))).To(Equal("287082"))
+		Expect(ssh3.NewTOTPCode(secret, time.Unix(1111111109, 0))).To(Equal("081804"))
+		Expect(ssh3.NewTOTPCode(secret, time.Unix(1234567890, 0))).To(Equal("005924"))
+		Expect(ssh3.NewTOTPCode(secret, time.Unix(2000000000, 0))).To(Equal("279037"))
+	})
+
+	It("Accepts the codes of the surrounding time steps only", func() {
+		now := time.Unix(1700000000, 0)
+		code := ssh3.NewTOTPCode(secret, now)
+		step, ok := ssh3.VerifyTOTPCode(secret, code, now.Add(30*time.Second))
+		Expect(ok).To(BeTrue())
+		Expect(step).To(Equal(ssh3.TOTPStep(now)))
+		_, ok = ssh3.VerifyTOTPCode(secret, code+"\n", now.Add(-30*time.Second))
+		Expect(ok).To(BeTrue())
+		_, ok = ssh3.VerifyTOTPCode(secret, code, now.Add(2*time.Minute))
+		Expect(ok).To(BeFalse())
+		_, ok = ssh3.VerifyTOTPCode(secret, "", now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Loads the generated secrets and refuses the short ones", func() {
+		encoded, err := ssh3.GenerateTOTPSecret()
+		Expect(err).ToNot(HaveOccurred())
+		filename := filepath.Join(GinkgoT().TempDir(), "totp_secret")
+		Expect(os.WriteFile(filename, []byte(encoded+"\n\" RATE_LIMIT 3 30\n"), 0600)).To(Succeed())
+		loaded, err := ssh3.LoadTOTPSecret(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded).To(HaveLen(20))
+		_, err = ssh3.ParseTOTPSecret("MFRGG")
+		Expect(err).To(HaveOccurred())
+		Expect(ssh3.TOTPKeyURI(encoded, "alice", "ssh3")).To(HavePrefix("otpauth://totp/ssh3:alice?"))
+	})
+})
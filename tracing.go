@@ -0,0 +1,17 @@
+package ssh3
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var tracer = otel.Tracer("github.com/francoismichel/ssh3")
+
+// ChannelAttributes returns the tracing attributes identifying a channel
+func ChannelAttributes(channel Channel) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("ssh3.conversation_id", channel.ConversationID().String()),
+		attribute.Int64("ssh3.channel_id", int64(channel.ChannelID())),
+		attribute.String("ssh3.channel_type", channel.ChannelType()),
+	}
+}
@@ -0,0 +1,205 @@
+package ssh3
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TransportConfig tunes the QUIC connections, e.g. to fill high bandwidth-delay product paths
+// on which the default receive windows of quic-go (up to 6MB per channel and 15MB per
+// conversation) limit the throughput. Zero values keep the defaults of quic-go. The congestion
+// controller cannot be selected: quic-go only implements Cubic.
+type TransportConfig struct {
+	// the receive window of each channel at the start of the connection in bytes, quic-go then
+	// grows it up to MaxStreamReceiveWindow
+	InitialStreamReceiveWindow uint64 `json:"initial_stream_receive_window,omitempty"`
+	// the maximum receive window of each channel in bytes
+	MaxStreamReceiveWindow uint64 `json:"max_stream_receive_window,omitempty"`
+	// the receive window of all the channels of a conversation at the start of the connection
+	// in bytes
+	InitialConnectionReceiveWindow uint64 `json:"initial_connection_receive_window,omitempty"`
+	// the maximum receive window of all the channels of a conversation in bytes
+	MaxConnectionReceiveWindow uint64 `json:"max_connection_receive_window,omitempty"`
+	// the connection is closed after this many seconds without any packet received, 30 by
+	// default. The shortest of the timeouts of both peers applies.
+	MaxIdleTimeoutSeconds int `json:"max_idle_timeout_seconds,omitempty"`
+	// the maximum number of channels the peer can open concurrently
+	MaxIncomingStreams int64 `json:"max_incoming_streams,omitempty"`
+	// the size of the receive buffer of the UDP socket in bytes, quic-go raises it to 2MB by
+	// default. On Linux, it is capped by the net.core.rmem_max sysctl.
+	UDPReceiveBufferSize int `json:"udp_receive_buffer_size,omitempty"`
+	// the traffic class marking all the packets sent on the UDP socket (see ParseTrafficClass),
+	// e.g. "af21", unmarked if empty. The clients mark their conversations with IPQoS instead.
+	TrafficClass string `json:"traffic_class,omitempty"`
+}
+
+func (t TransportConfig) Validate() error {
+	if t.InitialStreamReceiveWindow != 0 && t.MaxStreamReceiveWindow != 0 && t.InitialStreamReceiveWindow > t.MaxStreamReceiveWindow {
+		return fmt.Errorf("the initial stream receive window (%d bytes) is larger than the maximum one (%d bytes)",
+			t.InitialStreamReceiveWindow, t.MaxStreamReceiveWindow)
+	}
+	if t.InitialConnectionReceiveWindow != 0 && t.MaxConnectionReceiveWindow != 0 && t.InitialConnectionReceiveWindow > t.MaxConnectionReceiveWindow {
+		return fmt.Errorf("the initial connection receive window (%d bytes) is larger than the maximum one (%d bytes)",
+			t.InitialConnectionReceiveWindow, t.MaxConnectionReceiveWindow)
+	}
+	if t.MaxConnectionReceiveWindow != 0 && t.MaxStreamReceiveWindow != 0 && t.MaxConnectionReceiveWindow < t.MaxStreamReceiveWindow {
+		return fmt.Errorf("the maximum connection receive window (%d bytes) is smaller than the maximum stream receive window (%d bytes)",
+			t.MaxConnectionReceiveWindow, t.MaxStreamReceiveWindow)
+	}
+	if t.MaxIdleTimeoutSeconds < 0 {
+		return fmt.Errorf("negative max idle timeout: %d seconds", t.MaxIdleTimeoutSeconds)
+	}
+	if t.MaxIncomingStreams < 0 {
+		return fmt.Errorf("negative max incoming streams: %d", t.MaxIncomingStreams)
+	}
+	if t.UDPReceiveBufferSize < 0 {
+		return fmt.Errorf("negative UDP receive buffer size: %d bytes", t.UDPReceiveBufferSize)
+	}
+	if t.TrafficClass != "" {
+		if _, err := ParseTrafficClass(t.TrafficClass); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetsReceiveWindows returns true if the config sets one of the receive windows
+func (t TransportConfig) SetsReceiveWindows() bool {
+	return t.InitialStreamReceiveWindow != 0 || t.MaxStreamReceiveWindow != 0 ||
+		t.InitialConnectionReceiveWindow != 0 || t.MaxConnectionReceiveWindow != 0
+}
+
+// CustomizesSocket returns true if the config sets an option of the UDP socket, that is only
+// applied to the sockets created by ListenUDP
+func (t TransportConfig) CustomizesSocket() bool {
+	return t.UDPReceiveBufferSize != 0 || t.TrafficClass != ""
+}
+
+// ApplyTo sets the transport parameters of the QUIC connections using quicConf. The UDP receive
+// buffer and the traffic class are set on the sockets created by ListenUDP.
+func (t TransportConfig) ApplyTo(quicConf *quic.Config) {
+	if t.InitialStreamReceiveWindow != 0 {
+		quicConf.InitialStreamReceiveWindow = t.InitialStreamReceiveWindow
+	}
+	if t.MaxStreamReceiveWindow != 0 {
+		quicConf.MaxStreamReceiveWindow = t.MaxStreamReceiveWindow
+	}
+	if t.InitialConnectionReceiveWindow != 0 {
+		quicConf.InitialConnectionReceiveWindow = t.InitialConnectionReceiveWindow
+	}
+	if t.MaxConnectionReceiveWindow != 0 {
+		quicConf.MaxConnectionReceiveWindow = t.MaxConnectionReceiveWindow
+	}
+	if t.MaxIdleTimeoutSeconds != 0 {
+		quicConf.MaxIdleTimeout = time.Duration(t.MaxIdleTimeoutSeconds) * time.Second
+	}
+	if t.MaxIncomingStreams != 0 {
+		quicConf.MaxIncomingStreams = t.MaxIncomingStreams
+	}
+}
+
+// ListenUDP returns a UDP socket bound to address (e.g. ":443", or ":0" for a client) with the
+// configured receive buffer size and traffic class. quic-go does not shrink the buffers larger
+// than its default.
+func (t TransportConfig) ListenUDP(address string) (*net.UDPConn, error) {
+	packetConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := packetConn.(*net.UDPConn)
+	if t.UDPReceiveBufferSize != 0 {
+		if err := conn.SetReadBuffer(t.UDPReceiveBufferSize); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not set the UDP receive buffer size to %d bytes: %w", t.UDPReceiveBufferSize, err)
+		}
+	}
+	if t.TrafficClass != "" {
+		// validated along with the config
+		class, err := ParseTrafficClass(t.TrafficClass)
+		if err == nil {
+			err = SetTrafficClass(conn, class)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier uint64
+}{{"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10}, {"gb", 1e9}, {"mb", 1e6}, {"kb", 1e3}, {"b", 1}}
+
+// ParseTransportConfig parses comma-separated transport parameters, e.g.
+// "max-stream-window=32MiB,max-connection-window=64MiB,max-idle-timeout=2m,udp-receive-buffer=8MiB".
+// The keys are initial-stream-window, max-stream-window, initial-connection-window,
+// max-connection-window, max-idle-timeout, max-incoming-streams and udp-receive-buffer.
+func ParseTransportConfig(s string) (TransportConfig, error) {
+	var config TransportConfig
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return TransportConfig{}, fmt.Errorf("invalid transport parameter %q: expected key=value", field)
+		}
+		var err error
+		switch key {
+		case "initial-stream-window":
+			config.InitialStreamReceiveWindow, err = parseByteSize(value)
+		case "max-stream-window":
+			config.MaxStreamReceiveWindow, err = parseByteSize(value)
+		case "initial-connection-window":
+			config.InitialConnectionReceiveWindow, err = parseByteSize(value)
+		case "max-connection-window":
+			config.MaxConnectionReceiveWindow, err = parseByteSize(value)
+		case "max-idle-timeout":
+			var timeout time.Duration
+			timeout, err = time.ParseDuration(value)
+			if err == nil && (timeout < time.Second || timeout%time.Second != 0) {
+				err = fmt.Errorf("the timeout must be a whole number of seconds")
+			}
+			config.MaxIdleTimeoutSeconds = int(timeout / time.Second)
+		case "max-incoming-streams":
+			config.MaxIncomingStreams, err = strconv.ParseInt(value, 10, 64)
+			if err == nil && config.MaxIncomingStreams <= 0 {
+				err = fmt.Errorf("the number of streams must be positive")
+			}
+		case "udp-receive-buffer":
+			var size uint64
+			size, err = parseByteSize(value)
+			if err == nil && size > 1<<30 {
+				err = fmt.Errorf("the buffer cannot exceed 1GiB")
+			}
+			config.UDPReceiveBufferSize = int(size)
+		default:
+			err = fmt.Errorf("unknown transport parameter")
+		}
+		if err != nil {
+			return TransportConfig{}, fmt.Errorf("invalid transport parameter %q: %w", field, err)
+		}
+	}
+	return config, config.Validate()
+}
+
+// parses a size such as "16MiB", "512kb" or "65536"
+func parseByteSize(value string) (uint64, error) {
+	lower := strings.ToLower(value)
+	multiplier := uint64(1)
+	for _, unit := range byteSizeUnits {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			lower, multiplier = number, unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseUint(lower, 10, 64)
+	if err != nil || size == 0 || size > (1<<62)/multiplier {
+		return 0, fmt.Errorf("invalid size %q: expected a positive number of bytes, optionally followed by a unit among GiB, MiB, KiB, GB, MB, KB and B", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,55 @@
+package ssh3_test
+
+import (
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/quic-go/quic-go"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport config", func() {
+	It("Parses all the parameters", func() {
+		config, err := ssh3.ParseTransportConfig("initial-stream-window=1MiB, max-stream-window=32MiB,initial-connection-window=2MB," +
+			"max-connection-window=64mib,max-idle-timeout=2m,max-incoming-streams=256,udp-receive-buffer=8388608")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config).To(Equal(ssh3.TransportConfig{
+			InitialStreamReceiveWindow:     1 << 20,
+			MaxStreamReceiveWindow:         32 << 20,
+			InitialConnectionReceiveWindow: 2e6,
+			MaxConnectionReceiveWindow:     64 << 20,
+			MaxIdleTimeoutSeconds:          120,
+			MaxIncomingStreams:             256,
+			UDPReceiveBufferSize:           8 << 20,
+		}))
+	})
+
+	It("Rejects the invalid parameters", func() {
+		for _, invalid := range []string{"", "max-stream-window", "max-stream-window=0", "max-stream-window=16MiBit", "max-stream-window=-1",
+			"max-idle-timeout=500ms", "max-idle-timeout=1.5s", "max-incoming-streams=0", "udp-receive-buffer=2GiB", "congestion=bbr",
+			"initial-stream-window=8MiB,max-stream-window=1MiB", "max-stream-window=16MiB,max-connection-window=8MiB"} {
+			_, err := ssh3.ParseTransportConfig(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("Only overrides the set parameters", func() {
+		quicConf := &quic.Config{MaxIncomingStreams: 10, KeepAlivePeriod: time.Second}
+		ssh3.TransportConfig{MaxStreamReceiveWindow: 32 << 20, MaxIdleTimeoutSeconds: 90}.ApplyTo(quicConf)
+		Expect(quicConf).To(Equal(&quic.Config{
+			MaxIncomingStreams:     10,
+			KeepAlivePeriod:        time.Second,
+			MaxStreamReceiveWindow: 32 << 20,
+			MaxIdleTimeout:         90 * time.Second,
+		}))
+	})
+
+	It("Sets the receive buffer of the UDP sockets", func() {
+		conn, err := ssh3.TransportConfig{UDPReceiveBufferSize: 64 << 10}.ListenUDP("127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.LocalAddr().String()).To(HavePrefix("127.0.0.1:"))
+	})
+})
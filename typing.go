@@ -0,0 +1,262 @@
+package ssh3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/rs/zerolog/log"
+)
+
+// FeatureDatagramTyping is the ExtInfo feature of the servers accepting the keystrokes of the
+// interactive sessions in datagrams, see TypingSender
+const FeatureDatagramTyping = "datagram-typing"
+
+// the types of the datagrams of the session channels
+const (
+	// the position of the keystrokes in the input of the session followed by the keystrokes
+	typingKeystrokesDatagram byte = 1
+	// the number of bytes of input written to the command
+	typingAckDatagram byte = 2
+)
+
+// the maximum number of keystrokes waiting for their acknowledgement, the larger inputs (e.g.
+// pastes) being sent on the stream of the channel. The datagrams fit in the smallest QUIC packets.
+const maxUnackedKeystrokes = 256
+
+// the keystrokes are sent again after this delay, doubled at each retransmission
+const (
+	typingRetransmitDelay    = 50 * time.Millisecond
+	maxTypingRetransmitDelay = time.Second
+)
+
+// TypingSender sends the keystrokes of an interactive session in QUIC datagrams, which, unlike
+// the data of the channel stream, are not delayed by the retransmission of a lost packet. The
+// keystrokes not acknowledged by the server are sent again in each datagram until they are. The
+// larger inputs, e.g. pastes, are sent on the stream once all the keystrokes are acknowledged,
+// so that the server writes the input of the command in order.
+type TypingSender struct {
+	ctx     context.Context
+	channel Channel
+
+	mutex sync.Mutex
+	// the position in the input of the first keystroke not acknowledged yet, counting the
+	// input sent on the stream
+	offset uint64
+	// the keystrokes sent in datagrams and not acknowledged yet
+	unacked []byte
+	// closed once the keystrokes are acknowledged, nil if there is no unacknowledged keystroke
+	acked chan struct{}
+	// notified of the new keystrokes, to restart the retransmission timer
+	typed chan struct{}
+}
+
+// NewTypingSender returns a TypingSender of the input of channel, Run must be called to receive
+// the acknowledgements of the server
+func NewTypingSender(ctx context.Context, channel Channel) *TypingSender {
+	return &TypingSender{ctx: ctx, channel: channel, typed: make(chan struct{}, 1)}
+}
+
+// Write sends the input in a datagram, or on the stream of the channel if it is too large
+func (s *TypingSender) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	if len(s.unacked)+len(p) <= maxUnackedKeystrokes {
+		s.unacked = append(s.unacked, p...)
+		if s.acked == nil {
+			s.acked = make(chan struct{})
+		}
+		datagram := s.keystrokesDatagram()
+		s.mutex.Unlock()
+		select {
+		case s.typed <- struct{}{}:
+		default:
+		}
+		if err := s.channel.SendDatagram(datagram); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	acked := s.acked
+	s.mutex.Unlock()
+	if acked != nil {
+		select {
+		case <-acked:
+		case <-s.ctx.Done():
+			return 0, context.Cause(s.ctx)
+		}
+	}
+	// Write is the only one adding keystrokes, so none is sent until the input is written
+	s.mutex.Lock()
+	s.offset += uint64(len(p))
+	s.mutex.Unlock()
+	return s.channel.WriteData(p, ssh3Messages.SSH_EXTENDED_DATA_NONE)
+}
+
+// must be called with the mutex held
+func (s *TypingSender) keystrokesDatagram() []byte {
+	datagram := util.AppendVarInt([]byte{typingKeystrokesDatagram}, s.offset)
+	return append(datagram, s.unacked...)
+}
+
+// Run receives the acknowledgements of the server and sends the unacknowledged keystrokes
+// again, until the context of the TypingSender is done or the channel cannot receive datagrams
+func (s *TypingSender) Run() error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			datagram, err := s.channel.ReceiveDatagram(s.ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := s.handleAck(datagram); err != nil {
+				log.Debug().Msgf("discarding datagram on typing channel %d: %s", s.channel.ChannelID(), err)
+			}
+		}
+	}()
+
+	delay := typingRetransmitDelay
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return context.Cause(s.ctx)
+		case err := <-errs:
+			return err
+		case <-s.typed:
+			delay = typingRetransmitDelay
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			s.mutex.Lock()
+			var datagram []byte
+			if len(s.unacked) > 0 {
+				datagram = s.keystrokesDatagram()
+			}
+			s.mutex.Unlock()
+			// the timer is restarted by the next keystrokes once all are acknowledged
+			if datagram != nil {
+				if err := s.channel.SendDatagram(datagram); err != nil {
+					return err
+				}
+				delay = min(2*delay, maxTypingRetransmitDelay)
+				timer.Reset(delay)
+			}
+		}
+	}
+}
+
+func (s *TypingSender) handleAck(datagram []byte) error {
+	if len(datagram) == 0 || datagram[0] != typingAckDatagram {
+		return fmt.Errorf("unexpected datagram type")
+	}
+	written, err := util.ReadVarInt(util.NewReader(bytes.NewReader(datagram[1:])))
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if written <= s.offset {
+		return nil
+	}
+	n := min(written-s.offset, uint64(len(s.unacked)))
+	s.offset += n
+	s.unacked = s.unacked[n:]
+	if len(s.unacked) == 0 && s.acked != nil {
+		close(s.acked)
+		s.acked = nil
+		s.unacked = nil
+	}
+	return nil
+}
+
+// TypingReceiver writes the input of an interactive session to the command in order, whether it
+// was received on the stream of the channel or in the datagrams of a TypingSender
+type TypingReceiver struct {
+	channel Channel
+
+	mutex sync.Mutex
+	input io.Writer
+	// the number of bytes of input written to the command
+	written uint64
+}
+
+func NewTypingReceiver(channel Channel, input io.Writer) *TypingReceiver {
+	return &TypingReceiver{channel: channel, input: input}
+}
+
+// Write writes the input received on the stream of the channel
+func (r *TypingReceiver) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n, err := r.input.Write(p)
+	r.written += uint64(n)
+	return n, err
+}
+
+// Run writes the keystrokes received in datagrams and acknowledges them, until ctx is done or
+// the input of the command cannot be written
+func (r *TypingReceiver) Run(ctx context.Context) error {
+	for {
+		datagram, err := r.channel.ReceiveDatagram(ctx)
+		if err != nil {
+			return err
+		}
+		written, err := r.handleKeystrokes(datagram)
+		if _, invalid := err.(invalidTypingDatagram); invalid {
+			log.Debug().Msgf("discarding datagram on typing channel %d: %s", r.channel.ChannelID(), err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		ack := util.AppendVarInt([]byte{typingAckDatagram}, written)
+		if err := r.channel.SendDatagram(ack); err != nil {
+			return err
+		}
+	}
+}
+
+type invalidTypingDatagram struct {
+	reason string
+}
+
+func (e invalidTypingDatagram) Error() string {
+	return fmt.Sprintf("invalid typing datagram: %s", e.reason)
+}
+
+// writes the keystrokes that were not written yet and returns the number of bytes of input
+// written. The keystrokes following input that was not received yet are discarded, the
+// TypingSender sends them again.
+func (r *TypingReceiver) handleKeystrokes(datagram []byte) (uint64, error) {
+	if len(datagram) == 0 || datagram[0] != typingKeystrokesDatagram {
+		return 0, invalidTypingDatagram{reason: "unexpected datagram type"}
+	}
+	reader := bytes.NewReader(datagram[1:])
+	offset, err := util.ReadVarInt(util.NewReader(reader))
+	if err != nil {
+		return 0, invalidTypingDatagram{reason: err.Error()}
+	}
+	keystrokes := datagram[len(datagram)-reader.Len():]
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if offset <= r.written && offset+uint64(len(keystrokes)) > r.written {
+		n, err := r.input.Write(keystrokes[r.written-offset:])
+		r.written += uint64(n)
+		if err != nil {
+			return r.written, err
+		}
+	}
+	return r.written, nil
+}
@@ -0,0 +1,113 @@
+package ssh3_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// one end of a session channel whose datagrams can be lost, the data being delivered to the
+// TypingReceiver of the peer right away
+type typingChannel struct {
+	ssh3.Channel
+	datagrams chan []byte
+	peer      *typingChannel
+	receiver  *ssh3.TypingReceiver
+	// returns true if the datagram sent must be dropped
+	drop func() bool
+}
+
+func (c *typingChannel) ChannelID() uint64 { return 0 }
+
+func (c *typingChannel) SendDatagram(datagram []byte) error {
+	if c.drop == nil || !c.drop() {
+		select {
+		case c.peer.datagrams <- datagram:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *typingChannel) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case datagram := <-c.datagrams:
+		return datagram, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *typingChannel) WriteData(data []byte, dataType ssh3Messages.SSHDataType) (int, error) {
+	return c.peer.receiver.Write(data)
+}
+
+// the input of the command
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+var _ = Describe("Datagram typing", func() {
+	var input *lockedBuffer
+	var sender *ssh3.TypingSender
+
+	// starts a typing session in which the datagrams of the client are dropped as specified
+	start := func(drop func() bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		client := &typingChannel{datagrams: make(chan []byte, 100), drop: drop}
+		server := &typingChannel{datagrams: make(chan []byte, 100), peer: client}
+		client.peer = server
+		input = &lockedBuffer{}
+		server.receiver = ssh3.NewTypingReceiver(server, input)
+		go server.receiver.Run(ctx)
+		sender = ssh3.NewTypingSender(ctx, client)
+		go sender.Run()
+	}
+
+	It("Writes the keystrokes and the pasted input in order", func() {
+		start(nil)
+		for _, keystroke := range []string{"e", "c", "h", "o", " "} {
+			Expect(sender.Write([]byte(keystroke))).To(Equal(1))
+		}
+		paste := strings.Repeat("pasted ", 100)
+		Expect(sender.Write([]byte(paste))).To(Equal(len(paste)))
+		Expect(sender.Write([]byte("\r"))).To(Equal(1))
+		Eventually(input.String).Should(Equal("echo " + paste + "\r"))
+	})
+
+	It("Sends the lost keystrokes again", func() {
+		var sent atomic.Int32
+		// drops two datagrams out of three
+		start(func() bool {
+			return sent.Add(1)%3 != 0
+		})
+		for _, keystroke := range []string{"l", "s", " ", "-", "l"} {
+			Expect(sender.Write([]byte(keystroke))).To(Equal(1))
+		}
+		Eventually(input.String, 5*time.Second).Should(Equal("ls -l"))
+		Consistently(input.String, 200*time.Millisecond).Should(Equal("ls -l"))
+	})
+})
@@ -0,0 +1,153 @@
+package unix_server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// patterns may contain the '*' and '?' wildcards, similarly to sshd_config
+type AccessControlConfig struct {
+	// if not empty, only the local usernames matching one of these patterns can start conversations
+	AllowUsers []string `json:"allow_users,omitempty"`
+	// the local usernames matching one of these patterns cannot start conversations, even if allowed
+	DenyUsers []string `json:"deny_users,omitempty"`
+	// if not empty, the host:port targets of forwarded connections, "any" or "none".
+	// The host can be an IP address, a host name or "*" and the port can be "*".
+	PermitOpen []string `json:"permit_open,omitempty"`
+	// if not empty, the directories in which the commands can be started on request of the
+	// client, along with their subdirectories, or "none". "~" stands for the home of the user.
+	PermitWorkingDirectories []string `json:"permit_working_directories,omitempty"`
+}
+
+type permitOpenTarget struct {
+	host string
+	port string
+}
+
+func parsePermitOpenTarget(target string) (permitOpenTarget, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return permitOpenTarget{}, err
+	}
+	if port != "*" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return permitOpenTarget{}, fmt.Errorf("invalid port in %q", target)
+		}
+	}
+	if host == "" {
+		return permitOpenTarget{}, fmt.Errorf("missing host in %q", target)
+	}
+	return permitOpenTarget{host: host, port: port}, nil
+}
+
+func (c AccessControlConfig) validate() error {
+	for _, pattern := range append(append([]string{}, c.AllowUsers...), c.DenyUsers...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+		}
+	}
+	for _, target := range c.PermitOpen {
+		if target == "any" || target == "none" {
+			if len(c.PermitOpen) > 1 {
+				return fmt.Errorf("permit_open cannot mix %q with other targets", target)
+			}
+			continue
+		}
+		if _, err := parsePermitOpenTarget(target); err != nil {
+			return fmt.Errorf("invalid permit_open target: %w", err)
+		}
+	}
+	for _, directory := range c.PermitWorkingDirectories {
+		if directory == "none" {
+			if len(c.PermitWorkingDirectories) > 1 {
+				return fmt.Errorf("permit_working_directories cannot mix %q with other directories", directory)
+			}
+			continue
+		}
+		if directory != "~" && !strings.HasPrefix(directory, "~/") && !filepath.IsAbs(directory) {
+			return fmt.Errorf("invalid permit_working_directories entry %q: must be absolute or start with ~", directory)
+		}
+	}
+	return nil
+}
+
+func matchesOneOf(patterns []string, username string) bool {
+	for _, pattern := range patterns {
+		// the patterns have been checked when loading the config
+		if matched, _ := path.Match(pattern, username); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsUser returns true if the local user can start new conversations
+func (c AccessControlConfig) AllowsUser(username string) bool {
+	if matchesOneOf(c.DenyUsers, username) {
+		return false
+	}
+	return len(c.AllowUsers) == 0 || matchesOneOf(c.AllowUsers, username)
+}
+
+// PermitsOpen returns true if connections can be forwarded to addr. The host names of
+// permit_open are resolved at every call as clients only send IP addresses.
+func (c AccessControlConfig) PermitsOpen(ctx context.Context, addr net.IP, port int) bool {
+	if len(c.PermitOpen) == 0 || c.PermitOpen[0] == "any" {
+		return true
+	}
+	for _, entry := range c.PermitOpen {
+		target, err := parsePermitOpenTarget(entry)
+		if err != nil {
+			// "none" or checked when loading the config
+			continue
+		}
+		if target.port != "*" && target.port != strconv.Itoa(port) {
+			continue
+		}
+		if target.host == "*" {
+			return true
+		}
+		if ip := net.ParseIP(target.host); ip != nil {
+			if ip.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, target.host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.IP.Equal(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PermitsWorkingDirectory returns true if the commands of the user can be started in dir, a
+// clean absolute path. The home of the user is always permitted as it is the default one.
+func (c AccessControlConfig) PermitsWorkingDirectory(dir string, home string) bool {
+	if dir == home || len(c.PermitWorkingDirectories) == 0 {
+		return true
+	}
+	for _, entry := range c.PermitWorkingDirectories {
+		if entry == "none" {
+			return false
+		}
+		if entry == "~" || strings.HasPrefix(entry, "~/") {
+			entry = filepath.Join(home, entry[1:])
+		}
+		entry = filepath.Clean(entry)
+		if dir == entry || strings.HasPrefix(dir, strings.TrimSuffix(entry, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,469 @@
+package unix_server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+)
+
+// the ACME challenges answered to prove the control of the domains
+const (
+	// a file served on port 80 of the domains by a companion HTTP listener
+	ACMEChallengeHTTP01 = "http-01"
+	// a TXT record created by a DNS provider, e.g. for the servers that cannot listen on port 80
+	ACMEChallengeDNS01 = "dns-01"
+)
+
+const (
+	DefaultACMEHTTPAddr        = ":80"
+	DefaultACMERenewBeforeDays = 30
+	// the delay before trying again to renew the certificate after a failure
+	acmeRetryDelay = time.Hour
+	// the name of the account key in the cache directory
+	acmeAccountKeyFile = "acme_account.key"
+)
+
+// The server obtains its certificate from an ACME certificate authority (Let's Encrypt by
+// default) instead of reading the -cert and -key files, and renews it before it expires. The
+// account key and the certificate are kept in the cache directory, so that a restart does not
+// issue a new certificate.
+type ACMEConfig struct {
+	// the names of the certificate, the first one naming the certificate in the cache
+	Domains []string `json:"domains"`
+	// the contact address of the account, optional
+	Email string `json:"email,omitempty"`
+	// must be set to accept the terms of service of the certificate authority
+	AcceptTOS bool `json:"accept_tos"`
+	// the directory URL of the certificate authority, Let's Encrypt by default
+	DirectoryURL string `json:"directory_url,omitempty"`
+	// the directory keeping the account key and the certificates, e.g. /var/lib/ssh3/acme
+	CacheDir string `json:"cache_dir"`
+	// ACMEChallengeHTTP01 (the default) or ACMEChallengeDNS01
+	Challenge string `json:"challenge,omitempty"`
+	// the address of the listener answering the HTTP-01 challenges, DefaultACMEHTTPAddr by default
+	HTTPAddr string `json:"http_addr,omitempty"`
+	// creates the TXT records of the DNS-01 challenges
+	DNSProvider *DNSProviderConfig `json:"dns_provider,omitempty"`
+	// the certificate is renewed this number of days before it expires, 30 by default
+	RenewBeforeDays int `json:"renew_before_days,omitempty"`
+}
+
+type DNSProviderConfig struct {
+	// the name of a provider registered using RegisterDNSProvider, e.g. "exec"
+	Name string `json:"name"`
+	// the options of the provider, e.g. "command" for the "exec" provider
+	Options map[string]string `json:"options,omitempty"`
+	// the time to wait for the TXT records to propagate before asking the certificate authority to
+	// check them, in seconds
+	PropagationSeconds int `json:"propagation_seconds,omitempty"`
+}
+
+func (c *ACMEConfig) validate() error {
+	if len(c.Domains) == 0 {
+		return fmt.Errorf("the ACME config does not list any domain")
+	}
+	for _, domain := range c.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/\\ ") {
+			return fmt.Errorf("invalid ACME domain %q", domain)
+		}
+	}
+	if !c.AcceptTOS {
+		return fmt.Errorf("the terms of service of the ACME certificate authority must be accepted using accept_tos")
+	}
+	if !filepath.IsAbs(c.CacheDir) {
+		return fmt.Errorf("the ACME cache directory must be an absolute path: %q", c.CacheDir)
+	}
+	if c.RenewBeforeDays < 0 {
+		return fmt.Errorf("negative ACME renewal delay: %d days", c.RenewBeforeDays)
+	}
+	switch c.challenge() {
+	case ACMEChallengeHTTP01:
+		if c.DNSProvider != nil {
+			return fmt.Errorf("a DNS provider is set but the ACME challenge is %s", ACMEChallengeHTTP01)
+		}
+	case ACMEChallengeDNS01:
+		if c.DNSProvider == nil {
+			return fmt.Errorf("the %s ACME challenge requires a DNS provider", ACMEChallengeDNS01)
+		}
+		if _, ok := dnsProviders[c.DNSProvider.Name]; !ok {
+			return fmt.Errorf("unknown DNS provider %q", c.DNSProvider.Name)
+		}
+		if c.DNSProvider.PropagationSeconds < 0 {
+			return fmt.Errorf("negative DNS propagation delay: %d seconds", c.DNSProvider.PropagationSeconds)
+		}
+	default:
+		return fmt.Errorf("unsupported ACME challenge %q, expected %s or %s", c.Challenge, ACMEChallengeHTTP01, ACMEChallengeDNS01)
+	}
+	return nil
+}
+
+func (c *ACMEConfig) challenge() string {
+	if c.Challenge == "" {
+		return ACMEChallengeHTTP01
+	}
+	return c.Challenge
+}
+
+func (c *ACMEConfig) RenewBefore() time.Duration {
+	if c.RenewBeforeDays == 0 {
+		return DefaultACMERenewBeforeDays * 24 * time.Hour
+	}
+	return time.Duration(c.RenewBeforeDays) * 24 * time.Hour
+}
+
+func (c *ACMEConfig) ChallengeHTTPAddr() string {
+	if c.HTTPAddr == "" {
+		return DefaultACMEHTTPAddr
+	}
+	return c.HTTPAddr
+}
+
+// DNSProvider creates and removes the TXT records answering the DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn (e.g. "_acme-challenge.example.com.") containing value
+	Present(ctx context.Context, fqdn string, value string) error
+	// CleanUp removes the record created by Present
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+// DNSProviderFactory returns the provider configured using the options of its DNSProviderConfig
+type DNSProviderFactory func(options map[string]string) (DNSProvider, error)
+
+var dnsProviders = map[string]DNSProviderFactory{
+	"exec": newExecDNSProvider,
+}
+
+// RegisterDNSProvider makes a DNS provider available to the ACME configs under name, e.g. one
+// using the API of a DNS hosting service. It must be called before the server config is parsed.
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProviders[name] = factory
+}
+
+// runs `<command> present|cleanup <fqdn> <value>`, as the exec provider of lego
+type execDNSProvider struct {
+	command string
+}
+
+func newExecDNSProvider(options map[string]string) (DNSProvider, error) {
+	command := options["command"]
+	if !filepath.IsAbs(command) {
+		return nil, fmt.Errorf("the command of the exec DNS provider must be an absolute path: %q", command)
+	}
+	return &execDNSProvider{command: command}, nil
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action string, fqdn string, value string) error {
+	output, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", p.command, action, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// ACMEManager obtains and renews the certificate of an ACMEConfig
+type ACMEManager struct {
+	config      *ACMEConfig
+	client      *acme.Client
+	dnsProvider DNSProvider
+	certificate atomic.Pointer[tls.Certificate]
+	// maps the tokens of the pending HTTP-01 challenges onto their responses
+	httpTokens sync.Map
+}
+
+// NewACMEManager loads or creates the account key in the cache directory. The requests to the
+// certificate authority are sent using httpClient, http.DefaultClient if nil.
+func NewACMEManager(config *ACMEConfig, httpClient *http.Client) (*ACMEManager, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	accountKey, err := loadOrCreateACMEKey(filepath.Join(config.CacheDir, acmeAccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not load the ACME account key: %w", err)
+	}
+	directoryURL := config.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = acme.LetsEncryptURL
+	}
+	manager := &ACMEManager{
+		config: config,
+		client: &acme.Client{Key: accountKey, DirectoryURL: directoryURL, HTTPClient: httpClient, UserAgent: "ssh3-server"},
+	}
+	if config.DNSProvider != nil {
+		manager.dnsProvider, err = dnsProviders[config.DNSProvider.Name](config.DNSProvider.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manager, nil
+}
+
+func loadOrCreateACMEKey(filename string) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM key in %s", filename)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, util.WriteFileAtomic(filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// the file keeping the key and the certificate chain
+func (m *ACMEManager) cacheFile() string {
+	return filepath.Join(m.config.CacheDir, m.config.Domains[0]+".pem")
+}
+
+// GetCertificate returns the current certificate, to be used as the GetCertificate of the TLS
+// config of the server
+func (m *ACMEManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate := m.certificate.Load()
+	if certificate == nil {
+		return nil, fmt.Errorf("no ACME certificate obtained yet")
+	}
+	return certificate, nil
+}
+
+// HTTPHandler answers the HTTP-01 challenges, to be served on the ChallengeHTTPAddr of the config
+func (m *ACMEManager) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		response, ok := m.httpTokens.Load(token)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(response.(string)))
+	})
+}
+
+// LoadOrObtain uses the cached certificate if it does not need to be renewed yet, and obtains
+// a new one otherwise
+func (m *ACMEManager) LoadOrObtain(ctx context.Context) error {
+	cached, err := os.ReadFile(m.cacheFile())
+	var certificate tls.Certificate
+	if err == nil {
+		certificate, err = parseACMECertificate(cached)
+	}
+	if err == nil && time.Until(certificate.Leaf.NotAfter) > m.config.RenewBefore() && m.coversDomains(certificate.Leaf) {
+		m.certificate.Store(&certificate)
+		log.Info().Msgf("using the ACME certificate cached in %s, valid until %s", m.cacheFile(), certificate.Leaf.NotAfter)
+		return nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("could not load the cached ACME certificate %s, obtaining a new one: %s", m.cacheFile(), err)
+	}
+	return m.obtain(ctx)
+}
+
+// parses the key and the certificate chain of the cache file
+func parseACMECertificate(cached []byte) (tls.Certificate, error) {
+	certificate, err := tls.X509KeyPair(cached, cached)
+	if err != nil {
+		return certificate, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	return certificate, err
+}
+
+func (m *ACMEManager) coversDomains(cert *x509.Certificate) bool {
+	for _, domain := range m.config.Domains {
+		if cert.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RenewPeriodically renews the certificate RenewBefore its expiry until ctx is done, the
+// certificate must have been obtained using LoadOrObtain
+func (m *ACMEManager) RenewPeriodically(ctx context.Context) {
+	for {
+		delay := time.Until(m.certificate.Load().Leaf.NotAfter) - m.config.RenewBefore()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		for {
+			err := m.obtain(ctx)
+			if err == nil {
+				break
+			}
+			log.Error().Msgf("could not renew the ACME certificate, trying again in %s: %s", acmeRetryDelay, err)
+			select {
+			case <-time.After(acmeRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (m *ACMEManager) register(ctx context.Context) error {
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	_, err := m.client.Register(ctx, account, acme.AcceptTOS)
+	if errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// obtains a new certificate and stores it in the cache
+func (m *ACMEManager) obtain(ctx context.Context) error {
+	if err := m.register(ctx); err != nil {
+		return fmt.Errorf("could not register the ACME account: %w", err)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return fmt.Errorf("could not create the ACME order: %w", err)
+	}
+	for _, authorizationURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, authorizationURL); err != nil {
+			return err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("the ACME order failed: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.config.Domains[0]},
+		DNSNames: m.config.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("could not finalize the ACME order: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	cached := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		cached = append(cached, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	certificate, err := parseACMECertificate(cached)
+	if err != nil {
+		return fmt.Errorf("invalid certificate issued by the ACME certificate authority: %w", err)
+	}
+	if err := util.WriteFileAtomic(m.cacheFile(), cached, 0600); err != nil {
+		return fmt.Errorf("could not cache the ACME certificate: %w", err)
+	}
+	m.certificate.Store(&certificate)
+	log.Info().Msgf("obtained an ACME certificate for %s, valid until %s", strings.Join(m.config.Domains, ", "), certificate.Leaf.NotAfter)
+	return nil
+}
+
+// answers the challenge of the config for an authorization of the order
+func (m *ACMEManager) authorize(ctx context.Context, authorizationURL string) error {
+	authorization, err := m.client.GetAuthorization(ctx, authorizationURL)
+	if err != nil {
+		return err
+	}
+	if authorization.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, offered := range authorization.Challenges {
+		if offered.Type == m.config.challenge() {
+			challenge = offered
+		}
+	}
+	domain := authorization.Identifier.Value
+	if challenge == nil {
+		return fmt.Errorf("the ACME certificate authority does not offer the %s challenge for %s", m.config.challenge(), domain)
+	}
+	switch challenge.Type {
+	case ACMEChallengeHTTP01:
+		response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		m.httpTokens.Store(challenge.Token, response)
+		defer m.httpTokens.Delete(challenge.Token)
+	case ACMEChallengeDNS01:
+		value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+		if err := m.dnsProvider.Present(ctx, fqdn, value); err != nil {
+			return fmt.Errorf("could not create the DNS record of the ACME challenge: %w", err)
+		}
+		defer func() {
+			if err := m.dnsProvider.CleanUp(context.WithoutCancel(ctx), fqdn, value); err != nil {
+				log.Warn().Msgf("could not remove the DNS record of the ACME challenge: %s", err)
+			}
+		}()
+		select {
+		case <-time.After(time.Duration(m.config.DNSProvider.PropagationSeconds) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("could not accept the ACME challenge for %s: %w", domain, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authorizationURL); err != nil {
+		return fmt.Errorf("the %s ACME challenge failed for %s: %w", challenge.Type, domain, err)
+	}
+	return nil
+}
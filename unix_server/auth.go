@@ -9,30 +9,59 @@ import (
 	"strings"
 
 	"github.com/francoismichel/ssh3"
-	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/francoismichel/ssh3/audit"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/util"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func HandleAuths(ctx context.Context, enablePasswordLogin bool, defaultMaxPacketSize uint64, handlerFunc ssh3.AuthenticatedHandlerFunc) (http.HandlerFunc, error) {
+var tracer = otel.Tracer("github.com/francoismichel/ssh3/unix_server")
+
+// canonicalizeUsername is applied on the requested usernames before authenticating them,
+// IdentityUsernameCanonicalizer is used if it is nil. The users are authenticated by
+// authenticator, LocalAuthenticator if it is nil, using the sequences of authenticationMethods.
+func HandleAuths(ctx context.Context, enablePasswordLogin bool, defaultMaxPacketSize uint64, canonicalizeUsername UsernameCanonicalizer, authenticator Authenticator,
+	authenticationMethods AuthenticationMethods, handlerFunc ssh3.AuthenticatedHandlerFunc) (http.HandlerFunc, error) {
 	if runtime.GOOS != "linux" && enablePasswordLogin {
 		return nil, fmt.Errorf("password login not supported on %s/%s systems", runtime.GOOS, runtime.GOARCH)
 	}
+	if canonicalizeUsername == nil {
+		canonicalizeUsername = IdentityUsernameCanonicalizer
+	}
+	if authenticator == nil {
+		authenticator = LocalAuthenticator{}
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer w.(http.Flusher).Flush()
-		w.Header().Set("Server", ssh3.GetCurrentVersion())
-		major, minor, patch, err := ssh3.ParseVersion(r.UserAgent())
-		log.Debug().Msgf("received request from User-Agent %s (major %d, minor %d, patch %d)", r.UserAgent(), major, minor, patch)
-		// currently apply strict version rules
-		if err != nil || major != ssh3.MAJOR || minor != ssh3.MINOR {
-			w.WriteHeader(http.StatusForbidden)
-			if err == nil {
-				w.Write([]byte(fmt.Sprintf("Unsupported version: %d.%d.%d not supported by server in version %s", major, minor, patch, ssh3.GetCurrentVersion())))
-			} else {
-				w.Write([]byte("Unsupported user-agent"))
+		// continue the trace started by the client, if any
+		remoteCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		_, span := tracer.Start(remoteCtx, "ssh3.authenticate", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("client.address", r.RemoteAddr), attribute.String("user_agent.original", r.UserAgent())))
+		defer span.End()
+		authenticated := false
+		defer func() {
+			if !authenticated {
+				span.SetStatus(codes.Error, "authentication failed")
 			}
+		}()
+		w.Header().Set("Server", ssh3.GetCurrentVersion())
+		version, err := ssh3.NegotiateProtocolVersion(r)
+		log.Debug().Msgf("received request from User-Agent %s (protocol versions %q, negotiated %d)", r.UserAgent(), r.Header.Get(ssh3.ProtocolVersionsHeader), version)
+		// the clients predating the negotiation must run the same major and minor version
+		if err != nil {
+			ssh3.WriteDisconnectResponse(w, http.StatusForbidden, ssh3.Disconnect{
+				ReasonCode:  ssh3Messages.SSH_DISCONNECT_PROTOCOL_VERSION_NOT_SUPPORTED,
+				Description: fmt.Sprintf("Unsupported version: %s, the server is in version %s", err, ssh3.GetCurrentVersion()),
+				LanguageTag: "en",
+			})
 			return
 		}
 		hijacker, ok := w.(http3.Hijacker)
@@ -51,38 +80,137 @@ func HandleAuths(ctx context.Context, enablePasswordLogin bool, defaultMaxPacket
 			return
 		}
 		str := r.Body.(http3.HTTPStreamer).HTTPStream()
-		conv, err := ssh3.NewServerConversation(ctx, str, qconn, qconn, defaultMaxPacketSize)
+		// the conversation spans will be children of the client's span
+		conv, err := ssh3.NewServerConversation(remoteCtx, str, qconn, qconn, defaultMaxPacketSize)
 		if err != nil {
 			log.Error().Msgf("could not create new server conversation")
+			util.SetSpanError(span, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		convID := conv.ConversationID()
 		base64ConvID := base64.StdEncoding.EncodeToString(convID[:])
+		keyExchange := ssh3.KeyExchangeName(qconn.ConnectionState().TLS)
+		span.SetAttributes(attribute.String("ssh3.conversation_id", base64ConvID), attribute.String("tls.key_exchange", keyExchange))
+		log.Debug().Msgf("conversation %s from %s negotiated the %s key exchange", base64ConvID, r.RemoteAddr, keyExchange)
+		authMethod, requestedUsername := "none", ""
+		auditAuthentication := func(username string, result string) {
+			audit.Log(audit.Event{
+				Type:           audit.EventAuthentication,
+				Username:       username,
+				ConversationID: base64ConvID,
+				RemoteAddr:     r.RemoteAddr,
+				Details: map[string]string{
+					"method":             authMethod,
+					"requested_username": requestedUsername,
+					"user_agent":         r.UserAgent(),
+					"result":             result,
+				},
+			})
+		}
+		defer func() {
+			if !authenticated {
+				auditAuthentication("", "failure")
+				if conversational, ok := authenticator.(ConversationAuthenticator); ok {
+					conversational.ConversationRefused(base64ConvID)
+				}
+			}
+		}()
+		tracedHandlerFunc := func(authenticatedUsername string, newConv *ssh3.Conversation, w http.ResponseWriter, r *http.Request) {
+			if identity, ok := VerifiedIdentity(r.Context()); ok && authMethod == "bearer" {
+				authMethod = identityAuthenticationMethod(identity)
+			}
+			allowed, secondFactor := authenticationMethods.Requirements(authMethod)
+			if !allowed {
+				log.Warn().Msgf("refusing the %s authentication of user %s, not allowed by the authentication methods", authMethod, authenticatedUsername)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if secondFactor {
+				if !handleSecondFactor(authenticator, authenticatedUsername, base64ConvID, w, r) {
+					return
+				}
+				authMethod += "," + AuthMethodKeyboardInteractive
+			}
+			authenticated = true
+			unmaskResponses(w)
+			span.SetAttributes(attribute.String("enduser.id", authenticatedUsername))
+			auditAuthentication(authenticatedUsername, "success")
+			handlerFunc(authenticatedUsername, newConv, w, r)
+		}
 		authorization := r.Header.Get("Authorization")
-		if enablePasswordLogin && strings.HasPrefix(authorization, "Basic ") {
-			HandleBasicAuth(handlerFunc, conv)(w, r)
+		if certificateAuthenticator, ok := authenticator.(CertificateAuthenticator); ok && authorization == "" && len(qconn.ConnectionState().TLS.VerifiedChains) > 0 {
+			username := r.URL.Query().Get("user")
+			authMethod, requestedUsername = AuthMethodClientCertificate, username
+			span.SetAttributes(attribute.String("ssh3.auth_method", authMethod))
+			localUsername, err := canonicalizeUsername(username)
+			if err != nil {
+				log.Warn().Msgf("refusing requested username: %s", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			ok, err := certificateAuthenticator.AuthenticateCertificate(localUsername, qconn.ConnectionState().TLS.VerifiedChains[0])
+			if err != nil || !ok {
+				if err != nil {
+					log.Error().Msgf("client certificate authentication failed: %s", err)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tracedHandlerFunc(localUsername, conv, w, r)
+		} else if enablePasswordLogin && strings.HasPrefix(authorization, "Basic ") {
+			authMethod = AuthMethodPassword
+			requestedUsername, _, _ = r.BasicAuth()
+			span.SetAttributes(attribute.String("ssh3.auth_method", authMethod))
+			HandleBasicAuth(canonicalizeUsername, authenticator, tracedHandlerFunc, conv)(w, r)
 		} else if strings.HasPrefix(authorization, "Bearer ") {
 			username := r.URL.User.Username()
 			if username == "" {
 				username = r.URL.Query().Get("user")
 			}
-			HandleBearerAuth(username, base64ConvID, HandleJWTAuth(username, conv, handlerFunc))(w, r)
+			authMethod, requestedUsername = "bearer", username
+			if bearer, _ := BearerAuth(r); IsBreakGlassToken(bearer) {
+				authMethod = AuthMethodBreakGlass
+			} else if strings.HasPrefix(bearer, ssh3.PreauthTokenPrefix) {
+				authMethod = AuthMethodPreauth
+			}
+			span.SetAttributes(attribute.String("ssh3.auth_method", authMethod))
+			localUsername, err := canonicalizeUsername(username)
+			if err != nil {
+				log.Warn().Msgf("refusing requested username: %s", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if localUsername != username {
+				log.Debug().Msgf("requested username %s canonicalized into %s", username, localUsername)
+			}
+			HandleBearerAuth(localUsername, base64ConvID, HandleJWTAuth(username, localUsername, authenticator, conv, tracedHandlerFunc))(w, r)
 		} else {
 			w.WriteHeader(http.StatusUnauthorized)
 		}
 	}, nil
 }
 
-func HandleBasicAuth(handlerFunc ssh3.AuthenticatedHandlerFunc, conv *ssh3.Conversation) http.HandlerFunc {
+func HandleBasicAuth(canonicalizeUsername UsernameCanonicalizer, authenticator Authenticator, handlerFunc ssh3.AuthenticatedHandlerFunc, conv *ssh3.Conversation) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
+		requestedUsername, password, ok := r.BasicAuth()
 		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		username, err := canonicalizeUsername(requestedUsername)
+		if err != nil {
+			log.Warn().Msgf("refusing requested username: %s", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-		ok, err := unix_util.UserPasswordAuthentication(username, password)
+		if conversational, isConversational := authenticator.(ConversationAuthenticator); isConversational {
+			convID := conv.ConversationID()
+			ok, err = conversational.AuthenticateConversationPassword(username, password, base64.StdEncoding.EncodeToString(convID[:]))
+		} else {
+			ok, err = authenticator.AuthenticatePassword(username, password)
+		}
 		if err != nil || !ok {
 			if err != nil {
 				log.Error().Msgf("user authentication failed: %s", err)
@@ -0,0 +1,185 @@
+package unix_server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the authentication methods, named as in the AuthenticationMethods directive of sshd when it has them
+const (
+	AuthMethodPublicKey         = "publickey"
+	AuthMethodPassword          = "password"
+	AuthMethodOpenIDConnect     = "oidc"
+	AuthMethodToken             = "token"
+	AuthMethodClientCertificate = "client-certificate"
+	AuthMethodPreauth           = "preauth"
+	AuthMethodBreakGlass        = "break-glass"
+	// the second factor, a one-time password prompted to the user
+	AuthMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+var firstFactorAuthMethods = map[string]bool{
+	AuthMethodPublicKey:         true,
+	AuthMethodPassword:          true,
+	AuthMethodOpenIDConnect:     true,
+	AuthMethodToken:             true,
+	AuthMethodClientCertificate: true,
+	AuthMethodPreauth:           true,
+}
+
+// the prompt of the second factor
+const keyboardInteractivePrompt = "Verification code: "
+
+// AuthenticationMethods lists the sequences of authentication methods that authenticate the
+// users, e.g. "publickey,keyboard-interactive" requires a public key followed by a one-time
+// password, as the AuthenticationMethods directive of sshd. Each sequence is a first factor,
+// optionally followed by keyboard-interactive. The break-glass tokens are always accepted, as
+// they are issued by root on the server. A nil AuthenticationMethods accepts any first factor.
+type AuthenticationMethods [][]string
+
+func ParseAuthenticationMethods(lists []string) (AuthenticationMethods, error) {
+	var methods AuthenticationMethods
+	for _, list := range lists {
+		sequence := strings.Split(list, ",")
+		if !firstFactorAuthMethods[sequence[0]] {
+			return nil, fmt.Errorf("invalid authentication method %q in %q", sequence[0], list)
+		}
+		if len(sequence) > 2 || (len(sequence) == 2 && sequence[1] != AuthMethodKeyboardInteractive) {
+			return nil, fmt.Errorf("invalid authentication methods %q, only %s can follow the first method", list, AuthMethodKeyboardInteractive)
+		}
+		methods = append(methods, sequence)
+	}
+	return methods, nil
+}
+
+// Requirements returns whether the users can authenticate using the method, and whether the
+// method must then be followed by the second factor
+func (m AuthenticationMethods) Requirements(method string) (allowed bool, secondFactor bool) {
+	if m == nil || method == AuthMethodBreakGlass {
+		return true, false
+	}
+	for _, sequence := range m {
+		if sequence[0] != method {
+			continue
+		} else if len(sequence) == 1 {
+			return true, false
+		}
+		allowed, secondFactor = true, true
+	}
+	return allowed, secondFactor
+}
+
+// returns the authentication method of the identities verified by a bearer token
+func identityAuthenticationMethod(identity Identity) string {
+	switch identity := identity.(type) {
+	case *PubKeyIdentity:
+		return AuthMethodPublicKey
+	case *OpenIDConnectIdentity:
+		return AuthMethodOpenIDConnect
+	case *TokenIdentity:
+		return AuthMethodToken
+	case interface{ AuthenticationMethod() string }:
+		// e.g. the identities verified in another process
+		return identity.AuthenticationMethod()
+	default:
+		return AuthMethodPublicKey
+	}
+}
+
+// BearerAuthenticationMethod returns the authentication method of the bearer token verifying
+// identity, e.g. for the tokens verified by another process
+func BearerAuthenticationMethod(bearer string, identity Identity) string {
+	if IsBreakGlassToken(bearer) {
+		return AuthMethodBreakGlass
+	} else if strings.HasPrefix(bearer, ssh3.PreauthTokenPrefix) {
+		return AuthMethodPreauth
+	}
+	return identityAuthenticationMethod(identity)
+}
+
+// IdentityAuthenticationMethod returns the authentication method of an identity, e.g. for the
+// identities verified by another process
+func IdentityAuthenticationMethod(identity Identity) string {
+	return identityAuthenticationMethod(identity)
+}
+
+// returns whether the request carries the valid second factor of the user, refusing it with the
+// prompt of the second factor otherwise
+func handleSecondFactor(authenticator Authenticator, username string, base64ConversationID string, w http.ResponseWriter, r *http.Request) bool {
+	response := r.Header.Get(ssh3.KeyboardInteractiveResponseHeader)
+	if response == "" {
+		w.Header().Set(ssh3.KeyboardInteractivePromptHeader, keyboardInteractivePrompt)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	var ok bool
+	var err error
+	if conversational, isConversational := authenticator.(ConversationAuthenticator); isConversational {
+		ok, err = conversational.AuthenticateConversationKeyboardInteractive(username, response, base64ConversationID)
+	} else {
+		ok, err = authenticator.AuthenticateKeyboardInteractive(username, response)
+	}
+	if err != nil || !ok {
+		if err != nil {
+			log.Error().Msgf("keyboard-interactive authentication of user %s failed: %s", username, err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// the TOTP secret of the users, encoded in base32 on the first line
+func DefaultTOTPSecretFileName(user *unix_util.User) string {
+	return path.Join(user.Dir, ".ssh3", "totp_secret")
+}
+
+// the last time steps of the one-time passwords accepted for each user, refused afterwards so that
+// an observed password cannot be used again
+var usedTOTPSteps = struct {
+	sync.Mutex
+	steps map[string]int64
+}{steps: make(map[string]int64)}
+
+// verifies the one-time password of the user using the TOTP secret of its home directory
+func authenticateTOTP(username string, code string) (bool, error) {
+	user, err := unix_util.GetUser(username)
+	if err != nil {
+		return false, err
+	}
+	filename := DefaultTOTPSecretFileName(user)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	// as sshd with its StrictModes, the secrets that others may have read are refused
+	if info.Mode().Perm()&0077 != 0 {
+		return false, fmt.Errorf("the TOTP secret %s is accessible by other users (mode %s)", filename, info.Mode().Perm())
+	}
+	secret, err := ssh3.LoadTOTPSecret(filename)
+	if err != nil {
+		return false, err
+	}
+	step, ok := ssh3.VerifyTOTPCode(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	usedTOTPSteps.Lock()
+	defer usedTOTPSteps.Unlock()
+	if lastStep, used := usedTOTPSteps.steps[username]; used && step <= lastStep {
+		log.Warn().Msgf("refusing a one-time password of user %s that was already used", username)
+		return false, nil
+	}
+	usedTOTPSteps.steps[username] = step
+	return true, nil
+}
@@ -0,0 +1,126 @@
+package unix_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/francoismichel/ssh3"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// verifies the one-time passwords of the conversations waiting for them
+type secondFactorAuthenticator struct {
+	LocalAuthenticator
+	// the conversations waiting for the second factor, by base64-encoded ID
+	pending map[string]string
+	code    string
+}
+
+func (a *secondFactorAuthenticator) AuthenticateConversationPassword(username string, password string, base64ConversationID string) (bool, error) {
+	return false, nil
+}
+
+func (a *secondFactorAuthenticator) AuthenticateConversationKeyboardInteractive(username string, response string, base64ConversationID string) (bool, error) {
+	if a.pending[base64ConversationID] != username || response != a.code {
+		return false, nil
+	}
+	delete(a.pending, base64ConversationID)
+	return true, nil
+}
+
+func (a *secondFactorAuthenticator) ConversationRefused(base64ConversationID string) {
+	delete(a.pending, base64ConversationID)
+}
+
+var _ = Describe("Authentication methods", func() {
+	It("Requires the second factor after the first ones only followed by keyboard-interactive", func() {
+		methods, err := ParseAuthenticationMethods([]string{"publickey,keyboard-interactive", "password,keyboard-interactive", "password", "oidc"})
+		Expect(err).ToNot(HaveOccurred())
+		for _, testCase := range []struct {
+			method       string
+			allowed      bool
+			secondFactor bool
+		}{
+			{AuthMethodPublicKey, true, true},
+			// one of the sequences accepts the first factor alone
+			{AuthMethodPassword, true, false},
+			{AuthMethodOpenIDConnect, true, false},
+			{AuthMethodToken, false, false},
+			{AuthMethodBreakGlass, true, false},
+		} {
+			allowed, secondFactor := methods.Requirements(testCase.method)
+			Expect(allowed).To(Equal(testCase.allowed), testCase.method)
+			Expect(secondFactor).To(Equal(testCase.secondFactor), testCase.method)
+		}
+
+		allowed, secondFactor := AuthenticationMethods(nil).Requirements(AuthMethodPassword)
+		Expect(allowed).To(BeTrue())
+		Expect(secondFactor).To(BeFalse())
+	})
+
+	It("Refuses the invalid sequences", func() {
+		for _, lists := range [][]string{
+			{"keyboard-interactive"},
+			{"publickey,password"},
+			{"publickey,keyboard-interactive,keyboard-interactive"},
+			{"break-glass"},
+		} {
+			_, err := ParseAuthenticationMethods(lists)
+			Expect(err).To(HaveOccurred(), "%q", lists)
+		}
+	})
+
+	It("Names the methods of the bearer tokens", func() {
+		Expect(BearerAuthenticationMethod(ssh3.PreauthTokenPrefix+"token", nil)).To(Equal(AuthMethodPreauth))
+		Expect(BearerAuthenticationMethod("token", &TokenIdentity{})).To(Equal(AuthMethodToken))
+	})
+
+	Context("Second factor", func() {
+		var authenticator *secondFactorAuthenticator
+
+		BeforeEach(func() {
+			authenticator = &secondFactorAuthenticator{pending: map[string]string{"conv-1": "alice"}, code: "123456"}
+		})
+
+		// returns whether the second factor of the request authenticates the conversation,
+		// and the response of the refusal
+		handle := func(username string, base64ConversationID string, response string) (bool, *httptest.ResponseRecorder) {
+			request := httptest.NewRequest(http.MethodGet, "https://localhost/ssh3", nil)
+			if response != "" {
+				request.Header.Set(ssh3.KeyboardInteractiveResponseHeader, response)
+			}
+			recorder := httptest.NewRecorder()
+			return handleSecondFactor(authenticator, username, base64ConversationID, recorder, request), recorder
+		}
+
+		It("Prompts the second factor", func() {
+			ok, recorder := handle("alice", "conv-1", "")
+			Expect(ok).To(BeFalse())
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(recorder.Header().Get(ssh3.KeyboardInteractivePromptHeader)).To(Equal(keyboardInteractivePrompt))
+		})
+
+		It("Authenticates the conversation that proved its first factor", func() {
+			ok, _ := handle("alice", "conv-1", "123456")
+			Expect(ok).To(BeTrue())
+			Expect(authenticator.pending).To(BeEmpty())
+		})
+
+		It("Refuses the wrong codes and the other conversations", func() {
+			for _, attempt := range []struct{ username, conversation, response string }{
+				{"alice", "conv-1", "654321"},
+				{"alice", "conv-2", "123456"},
+				{"bob", "conv-1", "123456"},
+			} {
+				ok, recorder := handle(attempt.username, attempt.conversation, attempt.response)
+				Expect(ok).To(BeFalse())
+				Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+				// the refusal does not prompt again
+				Expect(recorder.Header().Get(ssh3.KeyboardInteractivePromptHeader)).To(BeEmpty())
+			}
+			Expect(authenticator.pending).To(HaveKey("conv-1"))
+		})
+	})
+})
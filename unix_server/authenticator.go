@@ -0,0 +1,112 @@
+package unix_server
+
+import (
+	"crypto/x509"
+	"os"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Authenticator performs the steps of the authentication requiring the privileges of the
+// server, so that they can be delegated to another process
+type Authenticator interface {
+	// returns whether password is the password of the user
+	AuthenticatePassword(username string, password string) (bool, error)
+	// returns the authorized identity of the user verifying the bearer token, nil if none does.
+	// requestedUsername is the username the token was issued for.
+	AuthenticateBearer(requestedUsername string, user *unix_util.User, bearer string, base64ConversationID string) (Identity, error)
+	// returns whether response is the valid answer of the user to the prompt of the second factor,
+	// i.e. its current one-time password, see AuthenticationMethods
+	AuthenticateKeyboardInteractive(username string, response string) (bool, error)
+}
+
+// CertificateAuthenticator is implemented by the authenticators accepting the client
+// certificates presented during the TLS handshake, see ClientCertificatesConfig
+type CertificateAuthenticator interface {
+	// returns whether the certificate chain, already verified by the TLS stack, authenticates the
+	// user. The chain starts with the client certificate and ends with its certificate authority.
+	AuthenticateCertificate(username string, chain []*x509.Certificate) (bool, error)
+}
+
+// ConversationAuthenticator is implemented by the authenticators keeping track of the
+// conversations they authenticated, e.g. to restrict another process to the users of its
+// ongoing conversations
+type ConversationAuthenticator interface {
+	// returns whether password is the password of the user, authenticating the conversation.
+	// It is used instead of AuthenticatePassword.
+	AuthenticateConversationPassword(username string, password string, base64ConversationID string) (bool, error)
+	// returns whether response is the second factor of the user, completing the authentication
+	// of the conversation by its first factor. It is used instead of AuthenticateKeyboardInteractive.
+	AuthenticateConversationKeyboardInteractive(username string, response string, base64ConversationID string) (bool, error)
+	// called when the conversation is refused after being authenticated, e.g. for lack of
+	// a second factor
+	ConversationRefused(base64ConversationID string)
+}
+
+// LocalAuthenticator authenticates the users in the current process
+type LocalAuthenticator struct {
+	// the SSH public keys refused for every user, if set, see ServerConfig.RevokedKeys
+	RevokedKeysFile string
+}
+
+func (LocalAuthenticator) AuthenticatePassword(username string, password string) (bool, error) {
+	return unix_util.UserPasswordAuthentication(username, password)
+}
+
+func (LocalAuthenticator) AuthenticateKeyboardInteractive(username string, response string) (bool, error) {
+	return authenticateTOTP(username, response)
+}
+
+func (a LocalAuthenticator) AuthenticateBearer(requestedUsername string, user *unix_util.User, bearer string, base64ConversationID string) (Identity, error) {
+	var revokedKeys *ssh3.KeyRevocationList
+	if a.RevokedKeysFile != "" {
+		var err error
+		// refuse every key rather than accepting the revoked ones if the file cannot be read
+		if revokedKeys, err = ssh3.LoadKeyRevocationList(a.RevokedKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	var identities []Identity
+	for _, filename := range DefaultIdentitiesFileNames(user) {
+		identitiesFile, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		newIdentities, err := ParseAuthorizedIdentitiesFile(user, identitiesFile)
+		identitiesFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, newIdentities...)
+	}
+	if identitiesFile, err := os.Open(DefaultJWKIdentitiesFileName(user)); err == nil {
+		newIdentities, err := ParseAuthorizedJWKsFile(user, identitiesFile)
+		identitiesFile.Close()
+		if err != nil {
+			// as the invalid lines of the other files, the keys of authorized_keys remain usable
+			log.Error().Msgf("cannot parse the authorized identities of user %s: %s", user.Username, err)
+		}
+		identities = append(identities, newIdentities...)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, identity := range identities {
+		if pubkeyIdentity, ok := identity.(*PubKeyIdentity); ok && revokedKeys != nil && revokedKeys.IsRevoked(pubkeyIdentity.SSHPublicKey()) {
+			log.Warn().Msgf("ignoring the revoked %s key %s authorized for user %s", pubkeyIdentity.sshPubkey.Type(),
+				ssh.FingerprintSHA256(pubkeyIdentity.sshPubkey), user.Username)
+			continue
+		}
+		if identity.Verify(util.JWTTokenString{Token: bearer, RequestedUsername: requestedUsername}, base64ConversationID) {
+			return identity, nil
+		}
+	}
+	return nil, nil
+}
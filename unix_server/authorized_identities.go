@@ -9,15 +9,13 @@ import (
 	"path"
 	"strings"
 
-	"github.com/francoismichel/ssh3/auth"
+	"github.com/francoismichel/ssh3"
 	"github.com/francoismichel/ssh3/util"
 	"github.com/francoismichel/ssh3/util/unix_util"
 
 	"github.com/rs/zerolog/log"
 
 	"golang.org/x/crypto/ssh"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 /*
@@ -35,49 +33,35 @@ type Identity interface {
 type PubKeyIdentity struct {
 	username string
 	pubkey   crypto.PublicKey
+	// the key as parsed from the authorized identities, to look it up in the revoked keys
+	sshPubkey ssh.PublicKey
+	// set using the command="..." option of authorized keys
+	forcedCommand string
 }
 
 func DefaultIdentitiesFileNames(user *unix_util.User) []string {
 	return []string{path.Join(user.Dir, ".ssh3", "authorized_identities"), path.Join(user.Dir, ".ssh", "authorized_keys")}
 }
 
+func (i *PubKeyIdentity) SSHPublicKey() ssh.PublicKey {
+	return i.sshPubkey
+}
+
+func (i *PubKeyIdentity) ForcedCommand() string {
+	return i.forcedCommand
+}
+
 func (i *PubKeyIdentity) Verify(genericCandidate interface{}, base64ConversationID string) bool {
 	switch candidate := genericCandidate.(type) {
 	case util.JWTTokenString:
-		token, err := jwt.Parse(candidate.Token, func(unvalidatedToken *jwt.Token) (interface{}, error) {
-			switch unvalidatedToken.Method.Alg() {
-			case "RS256":
-				return i.pubkey, nil
-			case "EdDSA":
-				return i.pubkey, nil
-			}
-			return nil, fmt.Errorf("unsupported signature algorithm '%s' for %T", unvalidatedToken.Method.Alg(), i)
-		},
-			jwt.WithIssuer(i.username),
-			jwt.WithSubject("ssh3"),
-			jwt.WithIssuedAt(),
-			jwt.WithAudience("unused"),
-			jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
-		if err != nil || !token.Valid {
+		issuer := i.username
+		if candidate.RequestedUsername != "" {
+			issuer = candidate.RequestedUsername
+		}
+		if err := ssh3.VerifyJWTBearerToken(candidate.Token, i.pubkey, issuer, base64ConversationID); err != nil {
 			log.Error().Msgf("invalid private key token: %s", err)
 			return false
 		}
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if _, ok = claims["exp"]; !ok {
-				return false
-			}
-			if clientId, ok := claims["client_id"]; !ok || clientId != fmt.Sprintf("ssh3-%s", i.username) {
-				return false
-			}
-			if jti, ok := claims["jti"]; !ok || jti != base64ConversationID {
-				log.Error().Msgf("rsa verification failed: the jti claim does not contain the base64-encoded conversation ID")
-				return false
-			}
-			// jti not checked yet
-		} else {
-			fmt.Println(err)
-		}
-
 		return true
 	default:
 		return false
@@ -87,20 +71,29 @@ func (i *PubKeyIdentity) Verify(genericCandidate interface{}, base64Conversation
 type OpenIDConnectIdentity struct {
 	clientID  string
 	issuerURL string
-	email     string
+	// the verified email of the accepted tokens, empty if only the allow rules accept tokens
+	email string
+	// see claim_rules.go
+	rules claimRules
 }
 
 func (i *OpenIDConnectIdentity) Verify(genericCandidate interface{}, base64ConversationID string) bool {
-	// TODO: verify that the base64ConversationID is also present in the token
 	log.Debug().Msgf("verifying openid connect idenitity")
 	switch candidate := genericCandidate.(type) {
 	case util.JWTTokenString:
-		token, err := auth.VerifyRawToken(context.Background(), i.clientID, i.issuerURL, candidate.Token)
+		// the provider is cached along with the context fetching its keys, which must not be canceled
+		token, err := openIDConnectVerifier.Verify(openIDConnectContext(context.Background()), i.clientID, i.issuerURL, candidate.Token, "")
 		if err != nil {
 			log.Error().Msgf("cannot verify raw token: %s", err.Error())
 			return false
 		}
 
+		// the clients set the conversation ID as nonce, so that the token cannot be replayed in another conversation
+		if token.Nonce != base64ConversationID && (token.Nonce != "" || openIDConnectRequireNonce) {
+			log.Error().Msgf("cannot verify identity: the token nonce %q is not the conversation ID", token.Nonce)
+			return false
+		}
+
 		log.Debug().Msgf("token signature verification successful")
 
 		if token.Issuer != i.issuerURL {
@@ -108,19 +101,19 @@ func (i *OpenIDConnectIdentity) Verify(genericCandidate interface{}, base64Conve
 			return false
 		}
 
-		var claims struct {
-			Email         string `json:"email"`
-			EmailVerified bool   `json:"email_verified"`
-		}
+		var claims map[string]interface{}
 		if err := token.Claims(&claims); err != nil {
 			log.Error().Msgf("error verifying claims: %s", err)
 			return false
 		}
 
-		valid := token != nil && claims.EmailVerified && claims.Email == i.email
+		valid := i.authorizes(claims)
 
 		if !valid {
-			log.Error().Msgf("invalid token: email should be: %s received claims: %+v", i.email, claims)
+			log.Error().Msgf("invalid token: the claims are not authorized by the identity of %s: %+v", i.issuerURL, claims)
+		} else if token.Nonce == "" {
+			log.Warn().Msgf("accepted a token of %s without nonce, which could be replayed in another conversation: "+
+				"set require_nonce in the openid_connect section of the server config once the clients send it", i.issuerURL)
 		}
 
 		return valid
@@ -129,8 +122,25 @@ func (i *OpenIDConnectIdentity) Verify(genericCandidate interface{}, base64Conve
 	}
 }
 
+// returns whether the claims of a validated token are authorized by the rules of the identity
+func (i *OpenIDConnectIdentity) authorizes(claims map[string]interface{}) bool {
+	denied, allowed := i.rules.evaluate(claims)
+	if denied != nil {
+		log.Warn().Msgf("token of %s denied by the rule deny=%s", i.issuerURL, denied)
+		return false
+	} else if allowed {
+		return true
+	}
+	if i.email == "" {
+		return false
+	}
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	return verified && email == i.email
+}
+
 func ParseIdentity(user *unix_util.User, identityStr string) (Identity, error) {
-	out, _, _, _, err := ssh.ParseAuthorizedKey([]byte(identityStr))
+	out, _, options, _, err := ssh.ParseAuthorizedKey([]byte(identityStr))
 	if err == nil {
 		log.Debug().Msg("parsing ssh authorized key")
 		switch out.Type() {
@@ -139,31 +149,47 @@ func ParseIdentity(user *unix_util.User, identityStr string) (Identity, error) {
 		case "ssh-ed25519":
 			log.Debug().Msgf("parsing %s identity", out.Type())
 			cryptoPublicKey := out.(ssh.CryptoPublicKey)
-			return &PubKeyIdentity{username: user.Username, pubkey: cryptoPublicKey.CryptoPublicKey()}, nil
+			return &PubKeyIdentity{username: user.Username, pubkey: cryptoPublicKey.CryptoPublicKey(), sshPubkey: out, forcedCommand: parseCommandOption(options)}, nil
 		case "ecdsa-sha2-nistp256":
-			panic("not implemented")
+			return nil, fmt.Errorf("%s identities are not supported yet", out.Type())
 		}
 	}
 	// it is not an SSH key
 	if strings.HasPrefix(identityStr, "oidc") {
-		nExpectedTokens := 4
+		nMinTokens := 4
 		log.Debug().Msg("parsing oidc identity")
 		tokens := strings.Fields(identityStr)
-		if len(tokens) != nExpectedTokens {
-			return nil, fmt.Errorf("bad identity format for oidc identity, %d tokens instead of the %d expected tokens, identity: %s",
+		if len(tokens) < nMinTokens {
+			return nil, fmt.Errorf("bad identity format for oidc identity, %d tokens instead of at least %d expected tokens, identity: %s",
 				len(tokens),
-				nExpectedTokens,
+				nMinTokens,
 				identityStr)
 		}
-		clientID := tokens[1]
-		issuerURL := tokens[2]
-		email := tokens[3]
-		log.Debug().Msgf("oidc identity parsing success: client_id: %s, issuer_url: %s, email: %s", clientID, issuerURL, email)
-		return &OpenIDConnectIdentity{
-			clientID:  clientID,
-			issuerURL: issuerURL,
-			email:     email,
-		}, nil
+		identity := &OpenIDConnectIdentity{
+			clientID:  tokens[1],
+			issuerURL: tokens[2],
+		}
+		for _, token := range tokens[3:] {
+			if isRule, err := identity.rules.parse(token); err != nil {
+				return nil, err
+			} else if isRule {
+				continue
+			}
+			if identity.email != "" {
+				return nil, fmt.Errorf("bad identity format for oidc identity, unexpected token %q, identity: %s", token, identityStr)
+			}
+			identity.email = token
+		}
+		if identity.email == "" && len(identity.rules.allow) == 0 {
+			return nil, fmt.Errorf("bad identity format for oidc identity, either an email or an allow rule is expected, identity: %s", identityStr)
+		}
+		log.Debug().Msgf("oidc identity parsing success: client_id: %s, issuer_url: %s, email: %s, %d allow rules, %d deny rules",
+			identity.clientID, identity.issuerURL, identity.email, len(identity.rules.allow), len(identity.rules.deny))
+		return identity, nil
+	}
+	if strings.HasPrefix(identityStr, "token ") {
+		log.Debug().Msg("parsing token identity")
+		return parseTokenIdentity(identityStr)
 	}
 	// either error or identity not implemented
 	return nil, fmt.Errorf("unknown identity format")
@@ -0,0 +1,176 @@
+package unix_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util/unix_util"
+
+	"github.com/rs/zerolog/log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// the duration during which a fetched JWKS is used before being fetched again
+	jwksCacheDuration = 5 * time.Minute
+	// the maximum duration of the request fetching a JWKS
+	jwksFetchTimeout = 10 * time.Second
+	// the maximum size of a fetched JWKS
+	maxJWKSSize = 1 << 20
+)
+
+// The authorized identities can also be given as JSON Web Keys (RFC 7517), for the
+// organizations managing the keys of their users as JWKs. The JSON file is a JWKS, whose keys
+// are accepted as the public keys of authorized_keys, and may reference the URL of a JWKS
+// fetched by the server:
+//
+//	{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "..."}], "jwks_uri": "https://keys.example.org/alice.json"}
+type authorizedJWKs struct {
+	Keys    []json.RawMessage `json:"keys"`
+	JWKSURI string            `json:"jwks_uri,omitempty"`
+}
+
+func DefaultJWKIdentitiesFileName(user *unix_util.User) string {
+	return path.Join(user.Dir, ".ssh3", "authorized_identities.json")
+}
+
+// returns the identity of a JWK, whose public key verifies the tokens signed by the client
+// as the keys of authorized_keys
+func parseJWKIdentity(user *unix_util.User, data []byte) (Identity, error) {
+	jwk, err := ssh3.ParseJWK(data)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return nil, fmt.Errorf("the JWK %q is not a signature key (use %q)", jwk.Kid, jwk.Use)
+	}
+	if jwk.IsPrivate() {
+		return nil, fmt.Errorf("the JWK %q holds a private key", jwk.Kid)
+	}
+	pubkey, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	sshPubkey, err := ssh.NewPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	switch sshPubkey.Type() {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoED25519:
+	default:
+		return nil, fmt.Errorf("%s identities are not supported yet", sshPubkey.Type())
+	}
+	return &PubKeyIdentity{username: user.Username, pubkey: pubkey, sshPubkey: sshPubkey}, nil
+}
+
+// parses the keys of a JWKS, skipping the invalid ones
+func parseJWKIdentities(user *unix_util.User, source string, keys []json.RawMessage) []Identity {
+	var identities []Identity
+	for i, key := range keys {
+		identity, err := parseJWKIdentity(user, key)
+		if err != nil {
+			log.Error().Msgf("%s: cannot parse the JWK #%d: %s", source, i+1, err)
+			continue
+		}
+		identities = append(identities, identity)
+	}
+	return identities
+}
+
+func ParseAuthorizedJWKsFile(user *unix_util.User, file *os.File) (identities []Identity, err error) {
+	var authorized authorizedJWKs
+	if err := json.NewDecoder(file).Decode(&authorized); err != nil {
+		return nil, fmt.Errorf("%s: invalid JSON: %w", file.Name(), err)
+	}
+	identities = parseJWKIdentities(user, file.Name(), authorized.Keys)
+	if authorized.JWKSURI != "" {
+		keys, err := defaultJWKSCache.fetch(authorized.JWKSURI)
+		if err != nil {
+			// the inline keys remain usable
+			log.Error().Msgf("%s: cannot fetch the JWKS %s: %s", file.Name(), authorized.JWKSURI, err)
+		} else {
+			identities = append(identities, parseJWKIdentities(user, authorized.JWKSURI, keys)...)
+		}
+	}
+	return identities, nil
+}
+
+type cachedJWKS struct {
+	keys      []json.RawMessage
+	fetchedAt time.Time
+}
+
+// the JWKSs fetched from the URLs of the authorized identities
+type jwksCache struct {
+	mutex sync.Mutex
+	sets  map[string]*cachedJWKS
+}
+
+var defaultJWKSCache = &jwksCache{sets: make(map[string]*cachedJWKS)}
+
+// returns the keys of the JWKS at uri, fetching it if it is not cached. The last fetched JWKS is
+// used when it cannot be fetched again, e.g. when the server hosting it is briefly unreachable.
+func (c *jwksCache) fetch(uri string) ([]json.RawMessage, error) {
+	c.mutex.Lock()
+	cached, ok := c.sets[uri]
+	c.mutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < jwksCacheDuration {
+		return cached.keys, nil
+	}
+	keys, err := fetchJWKS(uri)
+	if err != nil {
+		if ok {
+			log.Warn().Msgf("cannot refresh the JWKS %s, using the one fetched at %s: %s", uri, cached.fetchedAt, err)
+			return cached.keys, nil
+		}
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.sets[uri] = &cachedJWKS{keys: keys, fetchedAt: time.Now()}
+	c.mutex.Unlock()
+	return keys, nil
+}
+
+func fetchJWKS(uri string) ([]json.RawMessage, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" {
+		return nil, fmt.Errorf("the JWKS must be fetched using https")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	client := http.DefaultClient
+	if openIDConnectHTTPClient != nil {
+		client = openIDConnectHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var jwks authorizedJWKs
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	return jwks.Keys, nil
+}
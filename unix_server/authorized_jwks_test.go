@@ -0,0 +1,143 @@
+package unix_server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/francoismichel/ssh3/util/unix_util"
+	"github.com/golang-jwt/jwt/v5"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorized JWKs", func() {
+	user := &unix_util.User{Username: "alice"}
+	var edKey, otherEdKey ed25519.PrivateKey
+	var rsaKey *rsa.PrivateKey
+
+	// returns the JSON of the public JWK of key, with its kid
+	publicJWK := func(key crypto.Signer, kid string) json.RawMessage {
+		jwk, err := ssh3.NewJWK(key.Public())
+		Expect(err).ToNot(HaveOccurred())
+		jwk.Kid = kid
+		data, err := json.Marshal(jwk)
+		Expect(err).ToNot(HaveOccurred())
+		return data
+	}
+
+	// returns a token signed by key as the client signs them for the conversation
+	clientToken := func(key crypto.Signer, username string, base64ConversationID string) util.JWTTokenString {
+		signingMethod, err := util.JWTSigningMethodFromCryptoPubkey(key.Public())
+		Expect(err).ToNot(HaveOccurred())
+		signed, err := jwt.NewWithClaims(signingMethod, jwt.MapClaims{
+			"iss":       username,
+			"iat":       jwt.NewNumericDate(time.Now()),
+			"exp":       jwt.NewNumericDate(time.Now().Add(10 * time.Second)),
+			"sub":       "ssh3",
+			"aud":       "unused",
+			"client_id": fmt.Sprintf("ssh3-%s", username),
+			"jti":       base64ConversationID,
+		}).SignedString(key)
+		Expect(err).ToNot(HaveOccurred())
+		return util.JWTTokenString{Token: signed}
+	}
+
+	// returns the identities of the JWKS file holding the keys
+	parseFile := func(keys ...json.RawMessage) []Identity {
+		filename := filepath.Join(GinkgoT().TempDir(), "authorized_identities.json")
+		data, err := json.Marshal(authorizedJWKs{Keys: keys})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.WriteFile(filename, data, 0600)).To(Succeed())
+		file, err := os.Open(filename)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		identities, err := ParseAuthorizedJWKsFile(user, file)
+		Expect(err).ToNot(HaveOccurred())
+		return identities
+	}
+
+	BeforeEach(func() {
+		var err error
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, otherEdKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Parses the signature keys of the JWKS, skipping the other ones", func() {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		privateJWK, err := ssh3.NewJWK(edKey)
+		Expect(err).ToNot(HaveOccurred())
+		privateData, err := json.Marshal(privateJWK)
+		Expect(err).ToNot(HaveOccurred())
+		encryptionJWK, err := ssh3.NewJWK(rsaKey.Public())
+		Expect(err).ToNot(HaveOccurred())
+		encryptionJWK.Use = "enc"
+		encryptionData, err := json.Marshal(encryptionJWK)
+		Expect(err).ToNot(HaveOccurred())
+
+		identities := parseFile(
+			publicJWK(edKey, "ed"),
+			publicJWK(rsaKey, "rsa"),
+			// ECDSA identities are not supported yet
+			publicJWK(ecKey, "ec"),
+			privateData,
+			encryptionData,
+			json.RawMessage(`{"kty": "OKP", "crv": "X25519", "x": "AAAA"}`),
+		)
+		Expect(identities).To(HaveLen(2))
+		Expect(identities[0].(*PubKeyIdentity).pubkey).To(Equal(edKey.Public()))
+		Expect(identities[1].(*PubKeyIdentity).pubkey).To(Equal(rsaKey.Public()))
+	})
+
+	It("Refuses the JWKs whose parameters do not match their key type", func() {
+		var jwk map[string]interface{}
+		Expect(json.Unmarshal(publicJWK(edKey, ""), &jwk)).To(Succeed())
+		for _, kty := range []string{"RSA", "EC"} {
+			jwk["kty"] = kty
+			data, err := json.Marshal(jwk)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = parseJWKIdentity(user, data)
+			Expect(err).To(HaveOccurred(), kty)
+		}
+	})
+
+	It("Verifies the tokens signed by the private key of the JWK", func() {
+		identities := parseFile(publicJWK(edKey, "ed"), publicJWK(rsaKey, "rsa"))
+		Expect(identities[0].Verify(clientToken(edKey, "alice", "conv-1"), "conv-1")).To(BeTrue())
+		Expect(identities[1].Verify(clientToken(rsaKey, "alice", "conv-1"), "conv-1")).To(BeTrue())
+	})
+
+	It("Refuses the tokens signed by a key of another type", func() {
+		identities := parseFile(publicJWK(edKey, "ed"), publicJWK(rsaKey, "rsa"))
+		Expect(identities[0].Verify(clientToken(rsaKey, "alice", "conv-1"), "conv-1")).To(BeFalse())
+		Expect(identities[1].Verify(clientToken(edKey, "alice", "conv-1"), "conv-1")).To(BeFalse())
+	})
+
+	It("Refuses the tokens signed by the key of another kid", func() {
+		identities := parseFile(publicJWK(edKey, "ed"), publicJWK(otherEdKey, "ed-2"))
+		Expect(identities[0].Verify(clientToken(otherEdKey, "alice", "conv-1"), "conv-1")).To(BeFalse())
+		Expect(identities[1].Verify(clientToken(edKey, "alice", "conv-1"), "conv-1")).To(BeFalse())
+	})
+
+	It("Refuses the tokens of another user or conversation", func() {
+		identities := parseFile(publicJWK(edKey, "ed"))
+		Expect(identities[0].Verify(clientToken(edKey, "bob", "conv-1"), "conv-1")).To(BeFalse())
+		Expect(identities[0].Verify(clientToken(edKey, "alice", "conv-2"), "conv-1")).To(BeFalse())
+	})
+})
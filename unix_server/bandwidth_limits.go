@@ -0,0 +1,59 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// limits the data of the channels of the users matching one of the patterns of Users, all the
+// conversations of a user sharing the limits, e.g. so that the backups do not saturate a link
+type BandwidthLimitConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	// the maximum rates in bytes per second of the data sent to the users and received from them,
+	// e.g. "10MiB", unlimited if empty
+	Download string `json:"download,omitempty"`
+	Upload   string `json:"upload,omitempty"`
+}
+
+// Rates returns the rates in bytes per second of the data sent to the users and received from
+// them, 0 if unlimited
+func (c *BandwidthLimitConfig) Rates() (download uint64, upload uint64, err error) {
+	if c.Download != "" {
+		if download, err = ssh3.ParseBandwidthRate(c.Download); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.Upload != "" {
+		if upload, err = ssh3.ParseBandwidthRate(c.Upload); err != nil {
+			return 0, 0, err
+		}
+	}
+	return download, upload, nil
+}
+
+func validateBandwidthLimits(bandwidthLimits []BandwidthLimitConfig) error {
+	for _, config := range bandwidthLimits {
+		for _, pattern := range config.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+			}
+		}
+		if _, _, err := config.Rates(); err != nil {
+			return fmt.Errorf("invalid bandwidth limits of users %v: %w", config.Users, err)
+		}
+	}
+	return nil
+}
+
+// BandwidthLimits returns the first bandwidth limits matching username, if any
+func BandwidthLimits(bandwidthLimits []BandwidthLimitConfig, username string) (BandwidthLimitConfig, bool) {
+	for _, config := range bandwidthLimits {
+		if matchesOneOf(config.Users, username) {
+			return config, true
+		}
+	}
+	return BandwidthLimitConfig{}, false
+}
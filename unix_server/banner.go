@@ -0,0 +1,57 @@
+package unix_server
+
+import (
+	"net/http"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// BannerHandler sends banner to the clients, in the body of the refusals of their authentication
+// and of the responses establishing their conversations, as sshd sends its Banner before the
+// authentication
+func BannerHandler(banner string, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	message := &ssh3Messages.BannerMessage{MessageUTF8: banner}
+	encoded := make([]byte, message.Length())
+	// the buffer has the length of the message
+	message.Write(encoded)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ssh3.KeyboardInteractiveResponseHeader) != "" {
+			// the banner was sent along with the prompt of the second factor
+			handlerFunc(w, r)
+			return
+		}
+		handlerFunc(&bannerResponseWriter{ResponseWriter: w, banner: encoded}, r)
+	}
+}
+
+type bannerResponseWriter struct {
+	http.ResponseWriter
+	banner []byte
+	sent   bool
+}
+
+func (w *bannerResponseWriter) WriteHeader(statusCode int) {
+	if w.sent || (statusCode != http.StatusOK && statusCode != http.StatusUnauthorized) {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.sent = true
+	w.Header().Set("Content-Type", ssh3.ConversationMessagesContentType)
+	w.ResponseWriter.WriteHeader(statusCode)
+	w.ResponseWriter.Write(w.banner)
+}
+
+func (w *bannerResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *bannerResponseWriter) StreamCreator() http3.StreamCreator {
+	return w.ResponseWriter.(http3.Hijacker).StreamCreator()
+}
+
+func (w *bannerResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,76 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BreakGlassTokenPrefix prefixes the one-time bearer tokens issued on the break-glass socket,
+// telling them apart from the JWTs verified using the authorized identities
+const BreakGlassTokenPrefix = "ssh3-break-glass-"
+
+const (
+	DefaultBreakGlassTokenLifetime    = 15 * time.Minute
+	DefaultBreakGlassMaxTokensPerHour = 3
+)
+
+// The break-glass socket lets root on the server host issue one-time tokens authenticating
+// a user without their authorized identities nor any OpenID Connect provider, e.g. when the
+// identity provider is down. The tokens are kept in the store of the server, so they only
+// survive a restart with a persistent store and can be redeemed on the servers sharing it.
+type BreakGlassConfig struct {
+	// the path of the UNIX socket, only accessible by root
+	Socket string `json:"socket"`
+	// username patterns that may contain the '*' and '?' wildcards, the tokens can only be
+	// issued for the matching users
+	Users []string `json:"users"`
+	// the lifetime of the tokens in minutes, 15 by default
+	TokenLifetimeMinutes int `json:"token_lifetime_minutes,omitempty"`
+	// the maximum number of tokens issued per hour, 3 by default
+	MaxTokensPerHour int `json:"max_tokens_per_hour,omitempty"`
+}
+
+func (c *BreakGlassConfig) validate() error {
+	if !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("the break-glass socket must be an absolute path: %q", c.Socket)
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("the break-glass config does not list any user")
+	}
+	for _, pattern := range c.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+		}
+	}
+	if c.TokenLifetimeMinutes < 0 || c.MaxTokensPerHour < 0 {
+		return fmt.Errorf("negative break-glass token lifetime or rate limit: %+v", *c)
+	}
+	return nil
+}
+
+// AllowsUser returns true if break-glass tokens can be issued for the local user
+func (c *BreakGlassConfig) AllowsUser(username string) bool {
+	return matchesOneOf(c.Users, username)
+}
+
+func (c *BreakGlassConfig) TokenLifetime() time.Duration {
+	if c.TokenLifetimeMinutes == 0 {
+		return DefaultBreakGlassTokenLifetime
+	}
+	return time.Duration(c.TokenLifetimeMinutes) * time.Minute
+}
+
+func (c *BreakGlassConfig) MaxTokens() int {
+	if c.MaxTokensPerHour == 0 {
+		return DefaultBreakGlassMaxTokensPerHour
+	}
+	return c.MaxTokensPerHour
+}
+
+// IsBreakGlassToken returns true if bearer has been issued on the break-glass socket
+func IsBreakGlassToken(bearer string) bool {
+	return strings.HasPrefix(bearer, BreakGlassTokenPrefix)
+}
@@ -0,0 +1,74 @@
+package unix_server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UsernameCanonicalizer maps the username requested by a client onto the name of
+// a local account before its identities are looked up. An error refuses the request.
+type UsernameCanonicalizer func(requestedUsername string) (string, error)
+
+type UsernameCanonicalizationConfig struct {
+	// lower-case the requested username
+	CaseFolding bool `json:"case_folding,omitempty"`
+	// strip these domains from usernames of the form user@domain (e.g. alice@CORP becomes alice),
+	// domains are compared case-insensitively
+	StripDomains []string `json:"strip_domains,omitempty"`
+	// maps aliases onto local account names, applied after case folding and domain stripping
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+type InvalidUsername struct {
+	Username string
+	Reason   string
+}
+
+func (e InvalidUsername) Error() string {
+	return fmt.Sprintf("invalid username %q: %s", e.Username, e.Reason)
+}
+
+// IdentityUsernameCanonicalizer leaves requested usernames untouched
+func IdentityUsernameCanonicalizer(requestedUsername string) (string, error) {
+	if requestedUsername == "" {
+		return "", InvalidUsername{Username: requestedUsername, Reason: "empty username"}
+	}
+	return requestedUsername, nil
+}
+
+func NewUsernameCanonicalizer(config UsernameCanonicalizationConfig) (UsernameCanonicalizer, error) {
+	aliases := make(map[string]string, len(config.Aliases))
+	for alias, username := range config.Aliases {
+		if alias == "" || username == "" {
+			return nil, fmt.Errorf("invalid username alias %q -> %q", alias, username)
+		}
+		if config.CaseFolding {
+			alias = strings.ToLower(alias)
+		}
+		aliases[alias] = username
+	}
+	stripDomains := make(map[string]bool, len(config.StripDomains))
+	for _, domain := range config.StripDomains {
+		if domain == "" {
+			return nil, fmt.Errorf("empty domain to strip from usernames")
+		}
+		stripDomains[strings.ToLower(domain)] = true
+	}
+
+	return func(requestedUsername string) (string, error) {
+		username := requestedUsername
+		if config.CaseFolding {
+			username = strings.ToLower(username)
+		}
+		if at := strings.LastIndex(username, "@"); at >= 0 && stripDomains[strings.ToLower(username[at+1:])] {
+			username = username[:at]
+		}
+		if alias, ok := aliases[username]; ok {
+			username = alias
+		}
+		if username == "" {
+			return "", InvalidUsername{Username: requestedUsername, Reason: "empty username after canonicalization"}
+		}
+		return username, nil
+	}, nil
+}
@@ -0,0 +1,54 @@
+package unix_server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/francoismichel/ssh3"
+
+	"github.com/rs/zerolog/log"
+)
+
+// serves the channels of extension types using the executables of Directory, each named after
+// the channel type it serves (e.g. tunnel@example.com). The executable runs as the user with
+// the data of the channel on its standard input and output, similarly to a subsystem.
+type ChannelPluginsConfig struct {
+	Directory string `json:"directory"`
+}
+
+func (c *ChannelPluginsConfig) validate() error {
+	if !filepath.IsAbs(c.Directory) {
+		return fmt.Errorf("the channel plugins directory must be an absolute path, got %q", c.Directory)
+	}
+	return nil
+}
+
+// LoadChannelPlugins registers the channel types of the executables of the plugins directory
+// and returns their paths by channel type. The other files, and the executables named after a
+// channel type that is already registered (e.g. session), are ignored.
+func LoadChannelPlugins(config *ChannelPluginsConfig) (map[string]string, error) {
+	entries, err := os.ReadDir(config.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the channel plugins directory: %w", err)
+	}
+	plugins := make(map[string]string)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		channelType := entry.Name()
+		if slices.Contains(ssh3.RegisteredChannelTypes(), channelType) {
+			log.Warn().Msgf("ignoring channel plugin %s: the %s channel type is already registered", filepath.Join(config.Directory, channelType), channelType)
+			continue
+		}
+		if err := ssh3.RegisterChannelType(channelType, nil); err != nil {
+			log.Warn().Msgf("ignoring channel plugin %s: %s", filepath.Join(config.Directory, channelType), err)
+			continue
+		}
+		plugins[channelType] = filepath.Join(config.Directory, channelType)
+	}
+	return plugins, nil
+}
@@ -0,0 +1,170 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The OpenID Connect and token identities authorize the tokens using rules on their claims rather
+// than pinning a single email, e.g. to let the members of the sre group log in as the deploy user:
+//
+//	oidc <client_id> https://sso.example.org allow=groups=sre deny=acr=basic
+//	token corp-sso allow=groups=sre,scope=ssh
+//
+// A rule is a comma-separated list of conditions that must all hold. A condition claim=pattern
+// holds if the claim, or one of its elements if it is an array, matches the pattern, using the
+// syntax of path.Match. Nested claims are named using dots, e.g. realm_access.roles=admin.
+// The email and email_domain conditions only hold for verified emails. The rules are evaluated
+// after the token is validated: the token is refused if a deny rule holds, then it is accepted
+// if an allow rule holds or if its verified email is the one pinned by the OpenID Connect
+// identity, if any.
+
+const (
+	claimAllowPrefix = "allow="
+	claimDenyPrefix  = "deny="
+)
+
+type claimCondition struct {
+	claim   string
+	pattern string
+}
+
+type claimRule []claimCondition
+
+// the allow and deny rules of an identity
+type claimRules struct {
+	allow []claimRule
+	deny  []claimRule
+}
+
+// parses the token of an identity line if it is a rule, returning whether it is one
+func (r *claimRules) parse(token string) (bool, error) {
+	var rules *[]claimRule
+	switch {
+	case strings.HasPrefix(token, claimAllowPrefix):
+		rules, token = &r.allow, strings.TrimPrefix(token, claimAllowPrefix)
+	case strings.HasPrefix(token, claimDenyPrefix):
+		rules, token = &r.deny, strings.TrimPrefix(token, claimDenyPrefix)
+	default:
+		return false, nil
+	}
+	rule, err := parseClaimRule(token)
+	if err != nil {
+		return true, err
+	}
+	*rules = append(*rules, rule)
+	return true, nil
+}
+
+// returns the deny rule holding for the claims, if any, and whether an allow rule holds
+func (r *claimRules) evaluate(claims map[string]interface{}) (denied claimRule, allowed bool) {
+	for _, rule := range r.deny {
+		if rule.holds(claims) {
+			return rule, false
+		}
+	}
+	for _, rule := range r.allow {
+		if rule.holds(claims) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func parseClaimRule(expression string) (claimRule, error) {
+	var rule claimRule
+	for _, condition := range strings.Split(expression, ",") {
+		claim, pattern, ok := strings.Cut(condition, "=")
+		if !ok || claim == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid claim condition %q, expected claim=pattern", condition)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid claim pattern %q: %w", pattern, err)
+		}
+		rule = append(rule, claimCondition{claim: claim, pattern: pattern})
+	}
+	return rule, nil
+}
+
+func (r claimRule) String() string {
+	conditions := make([]string, len(r))
+	for i, condition := range r {
+		conditions[i] = condition.claim + "=" + condition.pattern
+	}
+	return strings.Join(conditions, ",")
+}
+
+func (r claimRule) holds(claims map[string]interface{}) bool {
+	for _, condition := range r {
+		if !condition.holds(claims) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c claimCondition) holds(claims map[string]interface{}) bool {
+	var values []string
+	switch c.claim {
+	case "email", "email_domain":
+		email, _ := claims["email"].(string)
+		if verified, _ := claims["email_verified"].(bool); !verified || email == "" {
+			return false
+		}
+		if c.claim == "email_domain" {
+			at := strings.LastIndex(email, "@")
+			if at < 0 {
+				return false
+			}
+			email = email[at+1:]
+		}
+		values = []string{email}
+	default:
+		values = claimValues(lookupClaim(claims, c.claim))
+	}
+	for _, value := range values {
+		if matched, _ := path.Match(c.pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the claim named by the dot-separated path, nil if there is none
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var claim interface{} = claims
+	for _, component := range strings.Split(name, ".") {
+		object, ok := claim.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if claim, ok = object[component]; !ok {
+			return nil
+		}
+	}
+	return claim
+}
+
+// returns the scalar values of a claim as strings, the claims such as groups being arrays
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case bool:
+		return []string{strconv.FormatBool(value)}
+	case float64:
+		return []string{strconv.FormatFloat(value, 'f', -1, 64)}
+	case []interface{}:
+		var values []string
+		for _, element := range value {
+			if _, isArray := element.([]interface{}); !isArray {
+				values = append(values, claimValues(element)...)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package unix_server
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Claim rules", func() {
+	claims := map[string]interface{}{
+		"sub":            "alice",
+		"email":          "alice@example.org",
+		"email_verified": true,
+		"groups":         []interface{}{"sre", "dev", []interface{}{"nested"}},
+		"mfa":            true,
+		"level":          float64(3),
+		"realm_access":   map[string]interface{}{"roles": []interface{}{"admin"}},
+	}
+
+	// returns the rules of the tokens of an identity line
+	parse := func(tokens ...string) (claimRules, error) {
+		var rules claimRules
+		for _, token := range tokens {
+			isRule, err := rules.parse(token)
+			if err != nil {
+				return rules, err
+			}
+			Expect(isRule).To(BeTrue(), token)
+		}
+		return rules, nil
+	}
+
+	It("Only parses the allow and deny tokens", func() {
+		var rules claimRules
+		isRule, err := rules.parse("alice@example.org")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(isRule).To(BeFalse())
+	})
+
+	It("Refuses the malformed rules", func() {
+		for _, token := range []string{
+			"allow=",
+			"allow=groups",
+			"allow=groups=",
+			"deny==sre",
+			"allow=groups=sre,",
+			"allow=groups=[sre",
+		} {
+			_, err := parse(token)
+			Expect(err).To(HaveOccurred(), token)
+		}
+	})
+
+	It("Evaluates the rules", func() {
+		for _, testCase := range []struct {
+			description string
+			tokens      []string
+			denied      bool
+			allowed     bool
+		}{
+			{"string claim", []string{"allow=sub=alice"}, false, true},
+			{"pattern", []string{"allow=sub=al*"}, false, true},
+			{"one element of an array", []string{"allow=groups=dev"}, false, true},
+			{"no element of an array", []string{"allow=groups=ops"}, false, false},
+			{"nested arrays are not flattened", []string{"allow=groups=nested"}, false, false},
+			{"boolean claim", []string{"allow=mfa=true"}, false, true},
+			{"number claim", []string{"allow=level=3"}, false, true},
+			{"nested claim", []string{"allow=realm_access.roles=admin"}, false, true},
+			{"object claim", []string{"allow=realm_access=*"}, false, false},
+			{"missing claim", []string{"allow=acr=*"}, false, false},
+			{"missing nested claim", []string{"allow=sub.name=alice"}, false, false},
+			{"all the conditions hold", []string{"allow=groups=sre,mfa=true"}, false, true},
+			{"one of the conditions does not hold", []string{"allow=groups=sre,mfa=false"}, false, false},
+			{"one of the rules holds", []string{"allow=groups=ops", "allow=groups=sre"}, false, true},
+			{"verified email domain", []string{"allow=email_domain=example.org"}, false, true},
+			{"deny takes precedence over allow", []string{"allow=groups=sre", "deny=groups=dev"}, true, false},
+			{"deny listed first", []string{"deny=groups=dev", "allow=sub=alice"}, true, false},
+			{"deny not holding", []string{"allow=groups=sre", "deny=groups=contractors"}, false, true},
+			{"deny on a missing claim", []string{"allow=groups=sre", "deny=acr=*"}, false, true},
+			{"no allow rule", []string{"deny=groups=contractors"}, false, false},
+		} {
+			rules, err := parse(testCase.tokens...)
+			Expect(err).ToNot(HaveOccurred(), testCase.description)
+			denied, allowed := rules.evaluate(claims)
+			Expect(denied != nil).To(Equal(testCase.denied), testCase.description)
+			Expect(allowed).To(Equal(testCase.allowed), testCase.description)
+		}
+	})
+
+	It("Ignores the unverified emails", func() {
+		rules, err := parse("allow=email=alice@example.org", "allow=email_domain=example.org")
+		Expect(err).ToNot(HaveOccurred())
+		_, allowed := rules.evaluate(map[string]interface{}{"email": "alice@example.org", "email_verified": false})
+		Expect(allowed).To(BeFalse())
+		_, allowed = rules.evaluate(map[string]interface{}{"email": "alice@example.org"})
+		Expect(allowed).To(BeFalse())
+	})
+})
@@ -0,0 +1,178 @@
+package unix_server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// The clients presenting a certificate issued by one of the certificate authorities during the
+// TLS handshake are authenticated as the local users that the mapping file associates with the
+// certificate, without any Authorization header, e.g. for machine-to-machine use. The clients
+// without certificate still authenticate using the other methods.
+type ClientCertificatesConfig struct {
+	// the PEM file of the certificate authorities issuing the client certificates
+	CAFile string `json:"ca_file"`
+	// maps the subjects and SANs of the certificates onto the local users, see
+	// ParseCertificateMapping. It is read at each authentication, so that it can be edited without
+	// restarting the server.
+	MappingFile string `json:"mapping_file"`
+	// the CRLs of the certificate authorities, in PEM or DER, read at each authentication
+	CRLFiles []string `json:"crl_files,omitempty"`
+	// whether the OCSP responders of the certificates are queried and what to do when the
+	// revocation status of a certificate cannot be determined, "off" by default
+	RevocationCheck ssh3.RevocationPolicy `json:"revocation_check,omitempty"`
+}
+
+func (c *ClientCertificatesConfig) validate() error {
+	if !filepath.IsAbs(c.CAFile) {
+		return fmt.Errorf("the client certificate authorities file must be an absolute path: %q", c.CAFile)
+	}
+	if !filepath.IsAbs(c.MappingFile) {
+		return fmt.Errorf("the client certificate mapping file must be an absolute path: %q", c.MappingFile)
+	}
+	for _, crlFile := range c.CRLFiles {
+		if !filepath.IsAbs(crlFile) {
+			return fmt.Errorf("the client certificate CRL files must be absolute paths: %q", crlFile)
+		}
+	}
+	var err error
+	c.RevocationCheck, err = ssh3.ParseRevocationPolicy(string(c.RevocationCheck))
+	return err
+}
+
+// RevocationChecker loads the CRL files and returns the checker of the client certificates,
+// querying the OCSP responders using httpClient, or http.DefaultClient if nil
+func (c *ClientCertificatesConfig) RevocationChecker(httpClient *http.Client) (*ssh3.RevocationChecker, error) {
+	crls, err := ssh3.LoadCRLFiles(c.CRLFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh3.RevocationChecker{Policy: c.RevocationCheck, CRLs: crls, HTTPClient: httpClient}, nil
+}
+
+// ApplyTo makes tlsConf request a client certificate and verify it using the certificate
+// authorities, the clients may still connect without certificate
+func (c *ClientCertificatesConfig) ApplyTo(tlsConf *tls.Config) error {
+	caPEM, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificate found in %s", c.CAFile)
+	}
+	tlsConf.ClientCAs = pool
+	tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// the fields of the certificates matched by the mapping rules
+const (
+	certificateFieldSubject = "subject"
+	certificateFieldDNS     = "dns"
+	certificateFieldEmail   = "email"
+	certificateFieldURI     = "uri"
+	certificateFieldIP      = "ip"
+)
+
+type certificateMappingRule struct {
+	field string
+	value string
+	users []string
+}
+
+func (r certificateMappingRule) matches(cert *x509.Certificate) bool {
+	switch r.field {
+	case certificateFieldSubject:
+		return cert.Subject.String() == r.value
+	case certificateFieldDNS:
+		return slices.ContainsFunc(cert.DNSNames, func(name string) bool { return strings.EqualFold(name, r.value) })
+	case certificateFieldEmail:
+		return slices.ContainsFunc(cert.EmailAddresses, func(address string) bool { return strings.EqualFold(address, r.value) })
+	case certificateFieldURI:
+		return slices.ContainsFunc(cert.URIs, func(uri *url.URL) bool { return uri.String() == r.value })
+	case certificateFieldIP:
+		ip := net.ParseIP(r.value)
+		return slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+	}
+	return false
+}
+
+// CertificateMapping associates the client certificates with the local users
+type CertificateMapping struct {
+	rules []certificateMappingRule
+}
+
+// ParseCertificateMapping parses one rule per line, "<field>:<value> <user>[,<user>...]", the field
+// being the subject of the certificate in the RFC 2253 format (e.g. "subject:CN=backup,O=Example")
+// or one of its SANs ("dns:", "email:", "uri:" or "ip:"). The empty lines and the lines starting
+// with '#' are ignored.
+func ParseCertificateMapping(r io.Reader) (*CertificateMapping, error) {
+	mapping := &CertificateMapping{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the subjects may contain spaces, the users are the last field
+		separator := strings.LastIndexAny(line, " \t")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: expected <field>:<value> <users>", lineNumber)
+		}
+		field, value, ok := strings.Cut(strings.TrimSpace(line[:separator]), ":")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("line %d: expected <field>:<value> <users>", lineNumber)
+		}
+		rule := certificateMappingRule{field: field, value: value, users: strings.Split(line[separator+1:], ",")}
+		switch field {
+		case certificateFieldSubject, certificateFieldDNS, certificateFieldEmail, certificateFieldURI:
+		case certificateFieldIP:
+			if net.ParseIP(value) == nil {
+				return nil, fmt.Errorf("line %d: invalid IP address %q", lineNumber, value)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown certificate field %q", lineNumber, field)
+		}
+		if slices.Contains(rule.users, "") {
+			return nil, fmt.Errorf("line %d: empty username", lineNumber)
+		}
+		mapping.rules = append(mapping.rules, rule)
+	}
+	return mapping, scanner.Err()
+}
+
+func LoadCertificateMapping(filename string) (*CertificateMapping, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mapping, err := ParseCertificateMapping(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate mapping %s: %w", filename, err)
+	}
+	return mapping, nil
+}
+
+// Allows returns true if cert is mapped onto the local user
+func (m *CertificateMapping) Allows(cert *x509.Certificate, username string) bool {
+	for _, rule := range m.rules {
+		if rule.matches(cert) && slices.Contains(rule.users, username) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package unix_server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// limits the concurrent use of the server, so that a client cannot exhaust its resources. The
+// forwarded connections of each conversation are limited by ForwardingQuotasConfig. Zero values
+// disable the limits.
+type ConcurrencyLimitsConfig struct {
+	// the requests being authenticated at the same time, as the MaxStartups of sshd: either the
+	// maximum number, or "start:rate:full" to refuse rate percent of the requests once start
+	// requests are being authenticated, linearly more up to all of them at full
+	MaxStartups string `json:"max_startups,omitempty"`
+	// the maximum number of simultaneous conversations of each user
+	MaxConversationsPerUser int `json:"max_conversations_per_user,omitempty"`
+	// the maximum number of simultaneously open channels of each conversation, sessions and
+	// forwarded connections included
+	MaxChannelsPerConversation int `json:"max_channels_per_conversation,omitempty"`
+}
+
+func (c *ConcurrencyLimitsConfig) validate() error {
+	if c.MaxConversationsPerUser < 0 || c.MaxChannelsPerConversation < 0 {
+		return fmt.Errorf("negative concurrency limits: %+v", *c)
+	}
+	if c.MaxStartups != "" {
+		if _, err := ParseMaxStartups(c.MaxStartups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxStartups is the limit of the requests being authenticated at the same time, see
+// ConcurrencyLimitsConfig
+type MaxStartups struct {
+	Start int
+	// the percentage of the requests refused once Start requests are being authenticated
+	Rate int
+	Full int
+}
+
+// ParseMaxStartups parses either "full" or "start:rate:full"
+func ParseMaxStartups(value string) (MaxStartups, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 1 && len(fields) != 3 {
+		return MaxStartups{}, fmt.Errorf("invalid max startups %q, expected full or start:rate:full", value)
+	}
+	numbers := make([]int, len(fields))
+	for i, field := range fields {
+		number, err := strconv.Atoi(field)
+		if err != nil || number <= 0 {
+			return MaxStartups{}, fmt.Errorf("invalid max startups %q, expected positive numbers", value)
+		}
+		numbers[i] = number
+	}
+	if len(numbers) == 1 {
+		return MaxStartups{Start: numbers[0], Rate: 100, Full: numbers[0]}, nil
+	}
+	maxStartups := MaxStartups{Start: numbers[0], Rate: numbers[1], Full: numbers[2]}
+	if maxStartups.Start > maxStartups.Full || maxStartups.Rate > 100 {
+		return MaxStartups{}, fmt.Errorf("invalid max startups %q, expected start <= full and rate <= 100", value)
+	}
+	return maxStartups, nil
+}
+
+// refuses returns true if a new request must be refused while inProgress requests are being
+// authenticated, random being uniformly chosen in [0, 1)
+func (m MaxStartups) refuses(inProgress int, random float64) bool {
+	if inProgress >= m.Full {
+		return true
+	}
+	if inProgress < m.Start {
+		return false
+	}
+	rate := float64(m.Rate) + float64(100-m.Rate)*float64(inProgress-m.Start)/float64(m.Full-m.Start)
+	return random*100 < rate
+}
+
+// StartupLimiter refuses the requests arriving while too many others are being authenticated,
+// see ConcurrencyLimitsConfig
+type StartupLimiter struct {
+	maxStartups MaxStartups
+	inProgress  int
+	lock        sync.Mutex
+}
+
+func NewStartupLimiter(maxStartups MaxStartups) *StartupLimiter {
+	return &StartupLimiter{maxStartups: maxStartups}
+}
+
+func (l *StartupLimiter) admit() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxStartups.refuses(l.inProgress, rand.Float64()) {
+		return false
+	}
+	l.inProgress += 1
+	return true
+}
+
+func (l *StartupLimiter) done() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inProgress -= 1
+}
+
+// Handler refuses the requests exceeding the limit with 503 Service Unavailable. The
+// authenticated conversations outlive handlerFunc, which returns once they are established.
+func (l *StartupLimiter) Handler(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.admit() {
+			log.Warn().Msgf("refusing the request from %s: too many requests being authenticated", r.RemoteAddr)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("The server is handling too many connections, please try again later."))
+			return
+		}
+		defer l.done()
+		handlerFunc(w, r)
+	}
+}
@@ -0,0 +1,410 @@
+package unix_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/audit"
+)
+
+// ServerConfig is the content of the JSON configuration file of the server
+// (e.g. /etc/ssh3/server_config.json, passed using the -config arg)
+type ServerConfig struct {
+	UsernameCanonicalization UsernameCanonicalizationConfig `json:"username_canonicalization"`
+	Maintenance              MaintenanceConfig              `json:"maintenance"`
+	AccessControl            AccessControlConfig            `json:"access_control"`
+	// maps subsystem names onto the command lines run in the user's shell (e.g. "sftp": "/usr/lib/openssh/sftp-server")
+	Subsystems       map[string]string      `json:"subsystems,omitempty"`
+	SessionRecording SessionRecordingConfig `json:"session_recording"`
+	// the first entry matching the username applies
+	ForceCommands    []ForceCommandConfig   `json:"force_commands,omitempty"`
+	ForwardingQuotas ForwardingQuotasConfig `json:"forwarding_quotas"`
+	// the limits of the concurrent authentications, conversations and channels
+	ConcurrencyLimits ConcurrencyLimitsConfig `json:"concurrency_limits"`
+	// the first entry matching the username applies
+	Confinements []ConfinementConfig `json:"confinements,omitempty"`
+	// the first entry matching the username applies
+	ResourceLimits []ResourceLimitsConfig `json:"resource_limits,omitempty"`
+	// the first entry matching the username applies
+	BandwidthLimits []BandwidthLimitConfig `json:"bandwidth_limits,omitempty"`
+	// the cgroup v2 directory under which the cgroups of the users limiting their CPU, memory and
+	// processes are created, /sys/fs/cgroup/ssh3 by default
+	CgroupDirectory string `json:"cgroup_directory,omitempty"`
+	// if set, enables the built-in "rpc" subsystem
+	RPCSubsystem *RPCSubsystemConfig `json:"rpc_subsystem,omitempty"`
+	// if set, serves the channels of extension types using executables
+	ChannelPlugins *ChannelPluginsConfig `json:"channel_plugins,omitempty"`
+	SessionTmpDir  SessionTmpDirConfig   `json:"session_tmpdir"`
+	// if set, serves the break-glass socket issuing emergency tokens
+	BreakGlass *BreakGlassConfig `json:"break_glass,omitempty"`
+	// if set, accepts the pre-authorization tokens signed using the verification keys
+	Preauth *PreauthConfig `json:"preauth,omitempty"`
+	// if set, the live output of the sessions of the matching users can be tailed
+	LiveTail *LiveTailConfig `json:"live_tail,omitempty"`
+	// if set, the pty sessions of the matching users are detached instead of ended when their conversation drops
+	SessionPersistence *SessionPersistenceConfig `json:"session_persistence,omitempty"`
+	// if set, the admin API is also served over HTTPS to the orchestration tools
+	ManagementAPI *ManagementAPIConfig `json:"management_api,omitempty"`
+	// the receive windows of the channels and conversations
+	FlowControl ssh3.FlowControl `json:"flow_control"`
+	// the parameters of the QUIC connections, e.g. larger receive windows for high-latency paths
+	Transport ssh3.TransportConfig `json:"transport"`
+	// the compression of the data sent to the clients supporting it, disabled if not set
+	Compression ssh3.CompressionConfig `json:"compression"`
+	// if set, samples and redacts the events before they are recorded in the audit log
+	AuditPolicy *audit.Policy `json:"audit_policy,omitempty"`
+	// if set, the forwarded TCP connections and the requests to the OpenID Connect providers go through this proxy
+	EgressProxy *EgressProxyConfig `json:"egress_proxy,omitempty"`
+	// how the tokens of the OpenID Connect identities are verified
+	OpenIDConnect *OpenIDConnectConfig `json:"openid_connect,omitempty"`
+	// the validators of the bearer tokens of the token identities, e.g. OAuth2 access tokens or SAML assertions
+	TokenValidators []TokenValidatorConfig `json:"token_validators,omitempty"`
+	// where the state shared by the servers is kept, in memory if not set
+	Store *StoreConfig `json:"store,omitempty"`
+	// if set, the clients can authenticate using a certificate presented during the TLS handshake
+	ClientCertificates *ClientCertificatesConfig `json:"client_certificates,omitempty"`
+	// if set, the certificate of the server is obtained and renewed using ACME instead of the -cert and -key files
+	ACME *ACMEConfig `json:"acme,omitempty"`
+	// whether the TLS handshakes use the hybrid post-quantum key exchanges: "off" (the default), "prefer" or "require"
+	PostQuantumKeyExchange ssh3.PostQuantumKeyExchange `json:"post_quantum_key_exchange,omitempty"`
+	// if set, the OCSP responses about the certificate of the server are fetched from its issuer and stapled
+	OCSPStapling bool `json:"ocsp_stapling,omitempty"`
+	// the SSH public keys refused for every user, either a KRL generated by ssh-keygen -k or one public key per
+	// line, read at each authentication, see ssh3.ParseKeyRevocationList
+	RevokedKeys string `json:"revoked_keys,omitempty"`
+	// if set, the server answers 404 to the requests not reaching the SSH3 endpoint, so that it cannot be found by scanners
+	Stealth *StealthConfig `json:"stealth,omitempty"`
+	// if set, the sequences of authentication methods authenticating the users, e.g. "publickey,keyboard-interactive"
+	// to require a one-time password after the public key, see AuthenticationMethods
+	AuthenticationMethods []string `json:"authentication_methods,omitempty"`
+	// if set, limits the failed authentications of each address and username
+	AuthRateLimit *AuthRateLimitConfig `json:"auth_rate_limit,omitempty"`
+	// the logical SSH3 endpoints hosted along with the default one, e.g. for several tenants
+	VirtualHosts []VirtualHostConfig `json:"virtual_hosts,omitempty"`
+	// if set, the server runs behind the configured load balancers and proxies
+	ReverseProxy *ReverseProxyConfig `json:"reverse_proxy,omitempty"`
+	// if set, the server also accepts the QUIC connections tunneled over HTTP/2 by the clients
+	// whose network blocks UDP
+	TCPFallback *TCPFallbackConfig `json:"tcp_fallback,omitempty"`
+	// if set, the content of this file (e.g. /etc/issue.net) is sent to the clients before they authenticate
+	BannerFile string `json:"banner_file,omitempty"`
+	// whether /etc/motd is printed at the beginning of the interactive login sessions
+	PrintMotd bool `json:"print_motd,omitempty"`
+	// whether the date and origin of the previous login of the user are printed at the beginning of the
+	// interactive login sessions
+	PrintLastLog bool `json:"print_last_log,omitempty"`
+	// on Windows, the shell of all the users: "cmd" (the default), "powershell" or the path of an executable
+	WindowsShell string `json:"windows_shell,omitempty"`
+}
+
+// limits the forwarded TCP and UDP connections of each conversation, so that a compromised
+// client cannot turn the server into a scanning proxy. Zero values disable the limits.
+type ForwardingQuotasConfig struct {
+	// the maximum number of simultaneously forwarded connections
+	MaxConnections int `json:"max_connections,omitempty"`
+	// the maximum number of connections being established at the same time
+	MaxPendingDials int `json:"max_pending_dials,omitempty"`
+	// the maximum number of connections established per minute
+	MaxDialsPerMinute int `json:"max_dials_per_minute,omitempty"`
+}
+
+// Sessions are recorded in the asciicast v2 format in <directory>/<username>/<hex conversation ID>_<channel ID>.cast.
+// Only the output of the sessions is recorded, not what the users type.
+type SessionRecordingConfig struct {
+	// if set, record the sessions in this directory
+	Directory string `json:"directory,omitempty"`
+	// also record the sessions running commands without a pty (e.g. ssh3 host ls)
+	RecordExec bool `json:"record_exec,omitempty"`
+	// if positive, remove the recordings older than this number of days
+	RetentionDays int `json:"retention_days,omitempty"`
+}
+
+// The root user can attach read-only to the live output of the sessions of the matching users
+// using the /sessions/tail endpoint of the admin socket, e.g. to follow a flagged session.
+type LiveTailConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	// if set, written on the terminal of the session when an auditor attaches to it
+	Notice string `json:"notice,omitempty"`
+}
+
+func (c *LiveTailConfig) validate() error {
+	for _, pattern := range c.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid live tail username pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// AllowsUser returns true if the sessions of the local user can be tailed
+func (c *LiveTailConfig) AllowsUser(username string) bool {
+	return matchesOneOf(c.Users, username)
+}
+
+// The pty sessions of the matching users survive the end of their conversation, e.g. a network
+// change, their command running detached until the user reattaches to them using ssh3 -reattach.
+type SessionPersistenceConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	// the last kilobytes of the output of a session replayed when reattaching to it, 64 by default
+	ScrollbackKB int `json:"scrollback_kb,omitempty"`
+	// if positive, the sessions detached for this number of minutes are hung up
+	DetachedTimeoutMinutes int `json:"detached_timeout_minutes,omitempty"`
+}
+
+func (c *SessionPersistenceConfig) validate() error {
+	for _, pattern := range c.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid session persistence username pattern %q: %w", pattern, err)
+		}
+	}
+	if c.ScrollbackKB < 0 || c.DetachedTimeoutMinutes < 0 {
+		return fmt.Errorf("negative session persistence scrollback or timeout: %+v", *c)
+	}
+	return nil
+}
+
+// AllowsUser returns true if the pty sessions of the local user are kept once detached
+func (c *SessionPersistenceConfig) AllowsUser(username string) bool {
+	return matchesOneOf(c.Users, username)
+}
+
+// The management API serves the endpoints of the admin socket over HTTPS on a TCP address, e.g. on
+// a management network, so that orchestration tools can manage a fleet of servers. The requests
+// are authenticated using the bearer tokens of the tokens file.
+type ManagementAPIConfig struct {
+	// the address and port to listen on, e.g. "10.0.0.1:4444"
+	Listen string `json:"listen"`
+	// the file listing the accepted bearer tokens, one per line, read at each request so that
+	// the tokens can be rotated without restarting the server
+	TokensFile string `json:"tokens_file"`
+}
+
+func (c *ManagementAPIConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid management API listen address %q: %w", c.Listen, err)
+	}
+	if !filepath.IsAbs(c.TokensFile) {
+		return fmt.Errorf("the management API tokens file must be an absolute path: %q", c.TokensFile)
+	}
+	return nil
+}
+
+// If enabled, each session gets a private temporary directory owned by the user with mode 0700,
+// exported as TMPDIR and XDG_RUNTIME_DIR and removed along with its content once the command of
+// the session exited. The chrooted users do not get one, as it would be outside of their chroot.
+type SessionTmpDirConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// the directory in which the session directories are created, the temporary directory of the
+	// system (e.g. /tmp) by default
+	Directory string `json:"directory,omitempty"`
+}
+
+// In maintenance mode, only the allowed users can start new conversations.
+// The mode can then be toggled using the admin API.
+type MaintenanceConfig struct {
+	// start the server in maintenance mode
+	Enabled bool `json:"enabled,omitempty"`
+	// the local usernames allowed to connect in maintenance mode
+	AllowedUsers []string `json:"allowed_users,omitempty"`
+	// the message displayed to the refused users
+	Banner string `json:"banner,omitempty"`
+}
+
+type InvalidServerConfig struct {
+	Filename string
+	Reason   error
+}
+
+func (e InvalidServerConfig) Error() string {
+	return fmt.Sprintf("invalid server config %s: %s", e.Filename, e.Reason)
+}
+
+func (e InvalidServerConfig) Unwrap() error {
+	return e.Reason
+}
+
+// ParseServerConfig parses a JSON server config. Unknown fields are refused
+// so that typos do not silently disable a setting.
+func ParseServerConfig(r io.Reader) (*ServerConfig, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	config := &ServerConfig{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	if err := config.AccessControl.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateForceCommands(config.ForceCommands); err != nil {
+		return nil, err
+	}
+	if err := validateConfinements(config.Confinements); err != nil {
+		return nil, err
+	}
+	if err := validateResourceLimits(config.ResourceLimits); err != nil {
+		return nil, err
+	}
+	if err := validateBandwidthLimits(config.BandwidthLimits); err != nil {
+		return nil, err
+	}
+	if config.RPCSubsystem != nil {
+		if err := config.RPCSubsystem.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ChannelPlugins != nil {
+		if err := config.ChannelPlugins.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.BreakGlass != nil {
+		if err := config.BreakGlass.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Preauth != nil {
+		if err := config.Preauth.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.LiveTail != nil {
+		if err := config.LiveTail.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.SessionPersistence != nil {
+		if err := config.SessionPersistence.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ManagementAPI != nil {
+		if err := config.ManagementAPI.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.EgressProxy != nil {
+		if err := config.EgressProxy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.OpenIDConnect != nil {
+		if err := config.OpenIDConnect.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := ParseAuthenticationMethods(config.AuthenticationMethods); err != nil {
+		return nil, err
+	}
+	if err := validateTokenValidators(config.TokenValidators); err != nil {
+		return nil, err
+	}
+	if config.Store != nil {
+		if err := config.Store.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ClientCertificates != nil {
+		if err := config.ClientCertificates.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ACME != nil {
+		if err := config.ACME.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Stealth != nil {
+		if err := config.Stealth.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.AuthRateLimit != nil {
+		if err := config.AuthRateLimit.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateVirtualHosts(config.VirtualHosts); err != nil {
+		return nil, err
+	}
+	if config.ReverseProxy != nil {
+		if err := config.ReverseProxy.validate(); err != nil {
+			return nil, err
+		}
+		if config.ReverseProxy.HealthCheckPath != "" && config.Stealth != nil {
+			return nil, fmt.Errorf("the health-check endpoint would reveal the hidden server, it cannot be used along with stealth")
+		}
+	}
+	if config.TCPFallback != nil {
+		if err := config.TCPFallback.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.PostQuantumKeyExchange.Validate(); err != nil {
+		return nil, err
+	}
+	if config.RevokedKeys != "" && !filepath.IsAbs(config.RevokedKeys) {
+		return nil, fmt.Errorf("the revoked keys file must be an absolute path: %q", config.RevokedKeys)
+	}
+	if config.AuditPolicy != nil {
+		if err := config.AuditPolicy.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.FlowControl.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Transport.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Compression.Validate(); err != nil {
+		return nil, err
+	}
+	if config.FlowControl != (ssh3.FlowControl{}) && config.Transport.SetsReceiveWindows() {
+		return nil, fmt.Errorf("the receive windows are set in both flow_control and transport")
+	}
+	if quotas := config.ForwardingQuotas; quotas.MaxConnections < 0 || quotas.MaxPendingDials < 0 || quotas.MaxDialsPerMinute < 0 {
+		return nil, fmt.Errorf("negative forwarding quotas: %+v", quotas)
+	}
+	if config.CgroupDirectory != "" && !filepath.IsAbs(config.CgroupDirectory) {
+		return nil, fmt.Errorf("the cgroup directory must be an absolute path: %q", config.CgroupDirectory)
+	}
+	if config.BannerFile != "" && !filepath.IsAbs(config.BannerFile) {
+		return nil, fmt.Errorf("the banner file must be an absolute path: %q", config.BannerFile)
+	}
+	if err := config.ConcurrencyLimits.validate(); err != nil {
+		return nil, err
+	}
+	if config.SessionTmpDir.Directory != "" && !filepath.IsAbs(config.SessionTmpDir.Directory) {
+		return nil, fmt.Errorf("the session tmpdir directory must be an absolute path: %q", config.SessionTmpDir.Directory)
+	}
+	if config.SessionRecording.RetentionDays < 0 {
+		return nil, fmt.Errorf("negative session recording retention: %d days", config.SessionRecording.RetentionDays)
+	}
+	for name, command := range config.Subsystems {
+		if name == "" || command == "" {
+			return nil, fmt.Errorf("invalid subsystem %q -> %q", name, command)
+		}
+	}
+	return config, nil
+}
+
+func LoadServerConfig(filename string) (*ServerConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config, err := ParseServerConfig(file)
+	if err != nil {
+		return nil, InvalidServerConfig{Filename: filename, Reason: err}
+	}
+	return config, nil
+}
@@ -0,0 +1,80 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// confines the shells, commands and subsystems of the users matching one of the patterns of Users,
+// e.g. to jail SFTP-only users in their home directory
+type ConfinementConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	// if set, chroot(2) the sessions in this directory once authenticated, similarly to the
+	// ChrootDirectory directive of sshd. %h is replaced by the home directory of the user
+	// and %u by the username. The directory and all its components must be owned by root
+	// and not writable by other users.
+	ChrootDirectory string `json:"chroot_directory,omitempty"`
+	// if set, also run the sessions in new namespaces with a seccomp filter (Linux only)
+	Sandbox *SandboxConfig `json:"sandbox,omitempty"`
+}
+
+type SandboxConfig struct {
+	// keep the network namespace of the server instead of an empty one
+	AllowNetwork bool `json:"allow_network,omitempty"`
+}
+
+func validateConfinements(confinements []ConfinementConfig) error {
+	for _, confinement := range confinements {
+		for _, pattern := range confinement.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+			}
+		}
+		if confinement.ChrootDirectory == "" && confinement.Sandbox == nil {
+			return fmt.Errorf("confinement of users %v sets neither a chroot directory nor a sandbox", confinement.Users)
+		}
+		if confinement.ChrootDirectory != "" && !filepath.IsAbs(confinement.ChrootDirectory) && !strings.HasPrefix(confinement.ChrootDirectory, "%h") {
+			return fmt.Errorf("the chroot directory must be an absolute path: %q", confinement.ChrootDirectory)
+		}
+	}
+	return nil
+}
+
+// Confinement returns the first confinement matching username, if any
+func Confinement(confinements []ConfinementConfig, username string) (ConfinementConfig, bool) {
+	for _, confinement := range confinements {
+		if matchesOneOf(confinement.Users, username) {
+			return confinement, true
+		}
+	}
+	return ConfinementConfig{}, false
+}
+
+// ExpandChrootDirectory replaces the %h, %u and %% tokens of the chroot directory
+func ExpandChrootDirectory(chrootDirectory string, username string, homeDir string) (string, error) {
+	var expanded strings.Builder
+	for i := 0; i < len(chrootDirectory); i++ {
+		if chrootDirectory[i] != '%' {
+			expanded.WriteByte(chrootDirectory[i])
+			continue
+		}
+		if i+1 == len(chrootDirectory) {
+			return "", fmt.Errorf("trailing %% in chroot directory %q", chrootDirectory)
+		}
+		i += 1
+		switch chrootDirectory[i] {
+		case 'h':
+			expanded.WriteString(homeDir)
+		case 'u':
+			expanded.WriteString(username)
+		case '%':
+			expanded.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown token %%%c in chroot directory %q", chrootDirectory[i], chrootDirectory)
+		}
+	}
+	return filepath.Clean(expanded.String()), nil
+}
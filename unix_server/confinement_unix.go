@@ -0,0 +1,33 @@
+//go:build unix
+
+package unix_server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CheckChrootDirectory verifies that the directory and all its components are owned by root and
+// not writable by other users, as otherwise the users could escape the chroot (e.g. by
+// hard-linking a setuid binary in it). These are the same requirements as sshd.
+func CheckChrootDirectory(chrootDirectory string) error {
+	if !filepath.IsAbs(chrootDirectory) {
+		return fmt.Errorf("the chroot directory must be an absolute path: %q", chrootDirectory)
+	}
+	component := "/"
+	for _, element := range strings.Split(chrootDirectory, "/") {
+		component = filepath.Join(component, element)
+		info, err := os.Stat(component)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.IsDir() || !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+			return fmt.Errorf("bad ownership or modes for chroot directory component %q", component)
+		}
+	}
+	return nil
+}
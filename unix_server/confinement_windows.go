@@ -0,0 +1,9 @@
+//go:build windows
+
+package unix_server
+
+import "fmt"
+
+func CheckChrootDirectory(chrootDirectory string) error {
+	return fmt.Errorf("chroot is not available on Windows")
+}
@@ -0,0 +1,216 @@
+package unix_server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/net/proxy"
+)
+
+// The egress proxy carries all the connections the server establishes on behalf of the
+// clients (forwarded TCP connections) and for itself (e.g. fetching the keys of the OpenID
+// Connect providers), for hosts without direct access to the network. The UDP forwarding
+// channels are refused as neither HTTP nor SOCKS5 proxies relay UDP here.
+type EgressProxyConfig struct {
+	// socks5://host:port, socks5h://host:port (the proxy resolves the host names) or http://host:port
+	URL string `json:"url"`
+	// if set, authenticate on the proxy using SOCKS5 username/password or HTTP basic authentication
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (c *EgressProxyConfig) validate() error {
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid egress proxy URL %q: %w", c.URL, err)
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return fmt.Errorf("unsupported egress proxy scheme %q, expected socks5, socks5h or http", proxyURL.Scheme)
+	}
+	if proxyURL.Port() == "" {
+		return fmt.Errorf("the egress proxy URL must contain a port: %q", c.URL)
+	}
+	if proxyURL.User != nil {
+		return fmt.Errorf("the egress proxy credentials must be set using the username and password fields")
+	}
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("egress proxy password set without username")
+	}
+	return nil
+}
+
+// EgressDialer establishes the outbound TCP connections of the server through the egress proxy
+type EgressDialer struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func NewEgressDialer(config *EgressProxyConfig) (*EgressDialer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	proxyURL, _ := url.Parse(config.URL)
+	if proxyURL.Scheme == "http" {
+		dialer := &httpConnectDialer{proxyAddress: proxyURL.Host}
+		if config.Username != "" {
+			dialer.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password))
+		}
+		return &EgressDialer{dial: dialer.DialContext}, nil
+	}
+	var auth *proxy.Auth
+	if config.Username != "" {
+		auth = &proxy.Auth{User: config.Username, Password: config.Password}
+	}
+	socksDialer := &socksDialer{proxyAddress: proxyURL.Host, auth: auth, resolveLocally: proxyURL.Scheme == "socks5"}
+	return &EgressDialer{dial: socksDialer.DialContext}, nil
+}
+
+// DialContext connects to the address through the proxy, only TCP is supported
+func (d *EgressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("cannot dial %s %s through the egress proxy", network, address)
+	}
+	return d.dial(ctx, network, address)
+}
+
+// HTTPClient returns a client sending its requests through the proxy
+func (d *EgressDialer) HTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+}
+
+// the client fetching the metadata and keys of the OpenID Connect providers, if not the default one
+var openIDConnectHTTPClient *http.Client
+
+// UseEgressDialer sends the requests of the server to the OpenID Connect providers through the egress proxy
+func UseEgressDialer(dialer *EgressDialer) {
+	openIDConnectHTTPClient = dialer.HTTPClient()
+}
+
+func openIDConnectContext(ctx context.Context) context.Context {
+	if openIDConnectHTTPClient == nil {
+		return ctx
+	}
+	return oidc.ClientContext(ctx, openIDConnectHTTPClient)
+}
+
+// tunnels the connections using the CONNECT method of HTTP/1.1
+type httpConnectDialer struct {
+	proxyAddress string
+	// the value of the Proxy-Authorization header, if any
+	authorization string
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	// unblocks the CONNECT exchange if the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.authorization != "" {
+		request.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("the egress proxy refused to connect to %s: %s", address, response.Status)
+	}
+	if reader.Buffered() > 0 {
+		// the target spoke first and its bytes are already buffered
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// tunnels the connections using the CONNECT command of SOCKS5
+type socksDialer struct {
+	proxyAddress string
+	auth         *proxy.Auth
+	// with socks5 (unlike socks5h), the host names are resolved by the server
+	resolveLocally bool
+}
+
+func (d *socksDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.resolveLocally {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(ips[0].String(), port)
+	}
+	forward := &recordingDialer{}
+	dialer, err := proxy.SOCKS5("tcp", d.proxyAddress, d.auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, address); err != nil {
+		return nil, err
+	}
+	// once the CONNECT command succeeded, the proxy relays the bytes as they are: return the
+	// TCP connection itself so that it can be half-closed
+	return forward.conn, nil
+}
+
+// keeps the connection established with the SOCKS5 proxy
+type recordingDialer struct {
+	conn net.Conn
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	d.conn = conn
+	return conn, err
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	return c.Conn.(*net.TCPConn).CloseRead()
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
@@ -0,0 +1,82 @@
+package unix_server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// forces the users matching one of the patterns of Users to run Command instead of the
+// requested shell, command or subsystem, similarly to the ForceCommand directive of sshd.
+// The command is run in the user's shell, the requested command being available in the
+// SSH3_ORIGINAL_COMMAND environment variable.
+type ForceCommandConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users   []string `json:"users"`
+	Command string   `json:"command"`
+}
+
+func validateForceCommands(forceCommands []ForceCommandConfig) error {
+	for _, forceCommand := range forceCommands {
+		if forceCommand.Command == "" {
+			return fmt.Errorf("empty forced command for users %v", forceCommand.Users)
+		}
+		for _, pattern := range forceCommand.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CommandRestrictedIdentity is implemented by identities only allowed to run a specific
+// command, such as authorized keys with a command="..." option
+type CommandRestrictedIdentity interface {
+	Identity
+	// returns the empty string if the identity can run any command
+	ForcedCommand() string
+}
+
+// parses the value of the command="..." option of an authorized key, if any
+func parseCommandOption(options []string) string {
+	for _, option := range options {
+		if len(option) < len("command=") || !strings.EqualFold(option[:len("command=")], "command=") {
+			continue
+		}
+		value := option[len("command="):]
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+		}
+		return value
+	}
+	return ""
+}
+
+type verifiedIdentityKey struct{}
+
+func withVerifiedIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, verifiedIdentityKey{}, identity)
+}
+
+// VerifiedIdentity returns the identity that authenticated the request passed to the
+// authenticated handlers, if the authentication method relies on identities
+func VerifiedIdentity(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(verifiedIdentityKey{}).(Identity)
+	return identity, ok
+}
+
+// ForcedCommand returns the command the user must run when authenticated by identity,
+// which may be nil. The server config prevails over the options of the identity, as in sshd.
+func ForcedCommand(forceCommands []ForceCommandConfig, username string, identity Identity) (string, bool) {
+	for _, forceCommand := range forceCommands {
+		if matchesOneOf(forceCommand.Users, username) {
+			return forceCommand.Command, true
+		}
+	}
+	if restricted, ok := identity.(CommandRestrictedIdentity); ok && restricted.ForcedCommand() != "" {
+		return restricted.ForcedCommand(), true
+	}
+	return "", false
+}
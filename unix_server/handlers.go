@@ -2,7 +2,6 @@ package unix_server
 
 import (
 	"net/http"
-	"os"
 
 	"github.com/francoismichel/ssh3"
 	"github.com/francoismichel/ssh3/util"
@@ -46,7 +45,9 @@ func HandleBearerAuth(username string, base64ConversationID string, handlerFunc
 }
 
 // currently only supports RS256 and EdDSA signing algorithms
-func HandleJWTAuth(username string, newConv *ssh3.Conversation, handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.UnauthenticatedBearerFunc {
+// requestedUsername is the username the token was issued for, username is the local account
+// it was canonicalized into
+func HandleJWTAuth(requestedUsername string, username string, authenticator Authenticator, newConv *ssh3.Conversation, handlerFunc ssh3.AuthenticatedHandlerFunc) ssh3.UnauthenticatedBearerFunc {
 	return func(unauthenticatedBearerString string, base64ConversationID string, w http.ResponseWriter, r *http.Request) {
 		user, err := unix_util.GetUser(username)
 		if err != nil {
@@ -54,33 +55,16 @@ func HandleJWTAuth(username string, newConv *ssh3.Conversation, handlerFunc ssh3
 			return
 		}
 
-		filenames := DefaultIdentitiesFileNames(user)
-		var identities []Identity
-		for _, filename := range filenames {
-			identitiesFile, err := os.Open(filename)
-			if err == nil {
-				newIdentities, err := ParseAuthorizedIdentitiesFile(user, identitiesFile)
-				if err != nil {
-					// TODO: logging
-					log.Error().Msgf("error when parsing authorized identities: %s", err)
-					w.WriteHeader(http.StatusUnauthorized)
-					return
-				}
-				identities = append(identities, newIdentities...)
-			} else if !os.IsNotExist(err) {
-				log.Error().Msgf("error could not open %s: %s", filename, err)
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
+		identity, err := authenticator.AuthenticateBearer(requestedUsername, user, unauthenticatedBearerString, base64ConversationID)
+		if err != nil {
+			log.Error().Msgf("error when reading the authorized identities of %s: %s", username, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
-
-		for _, identity := range identities {
-			verified := identity.Verify(util.JWTTokenString{Token: unauthenticatedBearerString}, base64ConversationID)
-			if verified {
-				// authentication successful
-				handlerFunc(username, newConv, w, r)
-				return
-			}
+		if identity != nil {
+			// authentication successful
+			handlerFunc(username, newConv, w, r.WithContext(withVerifiedIdentity(r.Context(), identity)))
+			return
 		}
 
 		// TODO: logging
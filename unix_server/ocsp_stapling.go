@@ -0,0 +1,134 @@
+package unix_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// the maximum duration of the queries to the OCSP responders
+const ocspStaplingTimeout = 30 * time.Second
+
+// the delay before querying the OCSP responder again after a failure
+const ocspStaplingRetryDelay = 5 * time.Minute
+
+type ocspStaple struct {
+	der        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+	// whether a query to the OCSP responder is in progress
+	refreshing bool
+	// the responder is not queried again before, after a failure
+	retryAfter time.Time
+}
+
+// the staple is refreshed once half of its validity has elapsed, or after an hour if the
+// responder does not tell when the next update is
+func (s *ocspStaple) refreshAt() time.Time {
+	if s.der == nil {
+		return time.Time{}
+	}
+	if s.nextUpdate.IsZero() {
+		return s.thisUpdate.Add(time.Hour)
+	}
+	return s.thisUpdate.Add(s.nextUpdate.Sub(s.thisUpdate) / 2)
+}
+
+func (s *ocspStaple) valid(now time.Time) bool {
+	return s.der != nil && (s.nextUpdate.IsZero() || now.Before(s.nextUpdate))
+}
+
+// OCSPStapler staples the OCSP responses about the certificates of the server, queried in the
+// background from the responders of their issuers. The certificates must be followed by their
+// issuer, as in the chains issued by ACME, to be stapled.
+type OCSPStapler struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	httpClient     *http.Client
+	mutex          sync.Mutex
+	// indexed by the DER of the certificates
+	staples map[string]*ocspStaple
+}
+
+// NewOCSPStapler staples the certificates returned by getCertificate, the OCSP responders being
+// queried using httpClient, or http.DefaultClient if nil
+func NewOCSPStapler(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), httpClient *http.Client) *OCSPStapler {
+	return &OCSPStapler{getCertificate: getCertificate, httpClient: httpClient, staples: make(map[string]*ocspStaple)}
+}
+
+// GetCertificate returns the certificate along with its valid staple, if any. The staple is
+// refreshed in the background, so the first handshakes are answered without staple.
+func (s *OCSPStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.getCertificate(hello)
+	if err != nil || cert == nil || len(cert.Certificate) < 2 {
+		return cert, err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	staple, ok := s.staples[string(cert.Certificate[0])]
+	if !ok {
+		staple = &ocspStaple{}
+		s.staples[string(cert.Certificate[0])] = staple
+	}
+	if !staple.refreshing && now.After(staple.refreshAt()) && now.After(staple.retryAfter) {
+		staple.refreshing = true
+		go s.refresh(cert, staple)
+	}
+	var der []byte
+	if staple.valid(now) {
+		der = staple.der
+	}
+	s.mutex.Unlock()
+	if der == nil {
+		return cert, nil
+	}
+	stapled := *cert
+	stapled.OCSPStaple = der
+	return &stapled, nil
+}
+
+func (s *OCSPStapler) refresh(cert *tls.Certificate, staple *ocspStaple) {
+	var response *ocsp.Response
+	var der []byte
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err == nil && len(leaf.OCSPServer) == 0 {
+		log.Warn().Msgf("the certificate of the server has no OCSP responder, it is not stapled")
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		staple.refreshing, staple.retryAfter = false, leaf.NotAfter
+		return
+	}
+	if err == nil {
+		var issuer *x509.Certificate
+		if issuer, err = x509.ParseCertificate(cert.Certificate[1]); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), ocspStaplingTimeout)
+			response, der, err = ssh3.FetchOCSPResponse(ctx, s.httpClient, leaf, issuer)
+			cancel()
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	staple.refreshing = false
+	if err != nil {
+		log.Warn().Msgf("could not refresh the OCSP staple of the server certificate: %s", err)
+		staple.retryAfter = time.Now().Add(ocspStaplingRetryDelay)
+		return
+	}
+	if response.Status == ocsp.Revoked {
+		log.Error().Msgf("the certificate of the server has been revoked on %s", response.RevokedAt)
+	}
+	staple.der, staple.thisUpdate, staple.nextUpdate = der, response.ThisUpdate, response.NextUpdate
+	// forget the staples of the replaced certificates, e.g. once renewed using ACME
+	for key, other := range s.staples {
+		if other != staple && !other.refreshing && !other.valid(time.Now()) {
+			delete(s.staples, key)
+		}
+	}
+}
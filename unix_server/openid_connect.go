@@ -0,0 +1,111 @@
+package unix_server
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/auth"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the verification of the ID tokens of the OpenID Connect identities of the users
+type OpenIDConnectConfig struct {
+	// the number of seconds during which the discovery document and the keys of an issuer are used
+	// before being fetched again, 3600 by default
+	CacheDurationSeconds int `json:"cache_duration_seconds,omitempty"`
+	// refuse the tokens that do not carry the conversation ID as nonce, i.e. those issued for the
+	// clients predating the nonce, as they could be replayed in another conversation
+	RequireNonce bool `json:"require_nonce,omitempty"`
+	// the issuers whose keys are provisioned on the server, e.g. when it cannot reach them
+	OfflineIssuers []OfflineIssuerConfig `json:"offline_issuers,omitempty"`
+}
+
+// The tokens of an offline issuer are verified using the keys of a JWKS file rather than the
+// keys published by the issuer, which is never contacted.
+type OfflineIssuerConfig struct {
+	IssuerURL string `json:"issuer_url"`
+	// the absolute path of the JWKS file, e.g. a copy of the file published at the jwks_uri of the issuer
+	JWKSFile string `json:"jwks_file"`
+}
+
+func (c *OpenIDConnectConfig) validate() error {
+	if c.CacheDurationSeconds < 0 {
+		return fmt.Errorf("negative OpenID Connect cache duration: %d seconds", c.CacheDurationSeconds)
+	}
+	issuers := make(map[string]bool, len(c.OfflineIssuers))
+	for _, issuer := range c.OfflineIssuers {
+		if issuer.IssuerURL == "" {
+			return fmt.Errorf("empty offline OpenID Connect issuer URL")
+		}
+		if issuers[issuer.IssuerURL] {
+			return fmt.Errorf("duplicate offline OpenID Connect issuer %s", issuer.IssuerURL)
+		}
+		issuers[issuer.IssuerURL] = true
+		if !filepath.IsAbs(issuer.JWKSFile) {
+			return fmt.Errorf("the JWKS file of the OpenID Connect issuer %s must be an absolute path: %q", issuer.IssuerURL, issuer.JWKSFile)
+		}
+	}
+	return nil
+}
+
+// verifies the tokens of the OpenID Connect identities
+var openIDConnectVerifier = auth.NewTokenVerifier(0)
+
+// whether the tokens of the OpenID Connect identities must carry the conversation ID as nonce,
+// the tokens accepted without it being logged as warnings
+var openIDConnectRequireNonce = false
+
+// ConfigureOpenIDConnect sets how the tokens of the OpenID Connect identities are verified,
+// loading the keys of the offline issuers
+func ConfigureOpenIDConnect(config *OpenIDConnectConfig) error {
+	verifier := auth.NewTokenVerifier(time.Duration(config.CacheDurationSeconds) * time.Second)
+	for _, issuer := range config.OfflineIssuers {
+		keys, err := loadJWKSFile(issuer.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("cannot load the keys of the OpenID Connect issuer %s: %w", issuer.IssuerURL, err)
+		}
+		verifier.SetStaticKeys(issuer.IssuerURL, keys)
+	}
+	openIDConnectVerifier = verifier
+	openIDConnectRequireNonce = config.RequireNonce
+	return nil
+}
+
+// returns the public signature keys of a JWKS file
+func loadJWKSFile(filename string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var jwks authorizedJWKs
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("%s: invalid JWKS: %w", filename, err)
+	}
+	var keys []crypto.PublicKey
+	for i, data := range jwks.Keys {
+		// the issuers may publish keys of types that are not supported
+		jwk, err := ssh3.ParseJWK(data)
+		if err != nil {
+			log.Warn().Msgf("%s: skipping the JWK #%d: %s", filename, i+1, err)
+			continue
+		}
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signature key", filename)
+	}
+	return keys, nil
+}
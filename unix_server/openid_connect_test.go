@@ -0,0 +1,106 @@
+package unix_server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/util"
+	"github.com/golang-jwt/jwt/v5"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenID Connect identities", func() {
+	const issuerURL = "https://sso.example.org"
+	const clientID = "ssh3"
+	var key *rsa.PrivateKey
+	var identity Identity
+
+	// configures the verification of the tokens of the offline issuers, signed by key
+	configure := func(requireNonce bool, issuers ...string) {
+		jwk, err := ssh3.NewJWK(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+		jwks, err := json.Marshal(map[string]interface{}{"keys": []interface{}{jwk}})
+		Expect(err).ToNot(HaveOccurred())
+		jwksFile := filepath.Join(GinkgoT().TempDir(), "jwks.json")
+		Expect(os.WriteFile(jwksFile, jwks, 0600)).To(Succeed())
+		config := &OpenIDConnectConfig{RequireNonce: requireNonce}
+		for _, issuer := range issuers {
+			config.OfflineIssuers = append(config.OfflineIssuers, OfflineIssuerConfig{IssuerURL: issuer, JWKSFile: jwksFile})
+		}
+		Expect(config.validate()).To(Succeed())
+		Expect(ConfigureOpenIDConnect(config)).To(Succeed())
+	}
+
+	// returns a token of the issuer for alice, carrying the nonce if not empty
+	token := func(issuer string, nonce string) util.JWTTokenString {
+		claims := jwt.MapClaims{
+			"iss":            issuer,
+			"aud":            clientID,
+			"sub":            "alice",
+			"email":          "alice@example.org",
+			"email_verified": true,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		Expect(err).ToNot(HaveOccurred())
+		return util.JWTTokenString{Token: signed}
+	}
+
+	BeforeEach(func() {
+		previousVerifier, previousRequireNonce := openIDConnectVerifier, openIDConnectRequireNonce
+		DeferCleanup(func() {
+			openIDConnectVerifier, openIDConnectRequireNonce = previousVerifier, previousRequireNonce
+		})
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		identity, err = ParseIdentity(nil, "oidc "+clientID+" "+issuerURL+" alice@example.org")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Accepts the tokens carrying the conversation ID as nonce", func() {
+		configure(true, issuerURL)
+		Expect(identity.Verify(token(issuerURL, "conv-1"), "conv-1")).To(BeTrue())
+	})
+
+	It("Refuses the tokens issued for another conversation", func() {
+		configure(false, issuerURL)
+		Expect(identity.Verify(token(issuerURL, "conv-2"), "conv-1")).To(BeFalse())
+	})
+
+	It("Only accepts the tokens without nonce unless they are required", func() {
+		configure(false, issuerURL)
+		Expect(identity.Verify(token(issuerURL, ""), "conv-1")).To(BeTrue())
+		configure(true, issuerURL)
+		Expect(identity.Verify(token(issuerURL, ""), "conv-1")).To(BeFalse())
+	})
+
+	It("Refuses the tokens of another issuer signed by a trusted key", func() {
+		configure(true, issuerURL, "https://other.example.org")
+		Expect(identity.Verify(token("https://other.example.org", "conv-1"), "conv-1")).To(BeFalse())
+	})
+
+	It("Refuses the tokens signed by another key", func() {
+		configure(true, issuerURL)
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(identity.Verify(token(issuerURL, "conv-1"), "conv-1")).To(BeFalse())
+	})
+
+	It("Refuses the offline issuers without absolute JWKS file", func() {
+		config := &OpenIDConnectConfig{OfflineIssuers: []OfflineIssuerConfig{{IssuerURL: issuerURL, JWKSFile: "jwks.json"}}}
+		Expect(config.validate()).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,89 @@
+package unix_server
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const DefaultPreauthMaxLifetime = 24 * time.Hour
+
+// The pre-authorization tokens let clients on network segments without access to the identity
+// providers authenticate. They are signed in advance on a connected machine (ssh3 preauth)
+// using a key whose public part is trusted by the server, and can be used until they expire.
+type PreauthConfig struct {
+	// the public keys trusted to sign the tokens, in the authorized_keys format
+	VerificationKeys string `json:"verification_keys"`
+	// the name of this server in the tokens (ssh3 preauth -host), the tokens issued for other
+	// hosts are refused
+	Host string `json:"host"`
+	// username patterns that may contain the '*' and '?' wildcards, the tokens are only
+	// accepted for the matching users
+	Users []string `json:"users"`
+	// the maximum lifetime of the tokens in minutes, 24 hours by default
+	MaxLifetimeMinutes int `json:"max_lifetime_minutes,omitempty"`
+}
+
+func (c *PreauthConfig) validate() error {
+	if !filepath.IsAbs(c.VerificationKeys) {
+		return fmt.Errorf("the pre-authorization verification keys must be an absolute path: %q", c.VerificationKeys)
+	}
+	if c.Host == "" {
+		return fmt.Errorf("the pre-authorization config does not set the host name of the server")
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("the pre-authorization config does not list any user")
+	}
+	for _, pattern := range c.Users {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+		}
+	}
+	if c.MaxLifetimeMinutes < 0 {
+		return fmt.Errorf("negative pre-authorization token lifetime: %d", c.MaxLifetimeMinutes)
+	}
+	return nil
+}
+
+// AllowsUser returns true if the local user can authenticate using a pre-authorization token
+func (c *PreauthConfig) AllowsUser(username string) bool {
+	return matchesOneOf(c.Users, username)
+}
+
+func (c *PreauthConfig) MaxLifetime() time.Duration {
+	if c.MaxLifetimeMinutes == 0 {
+		return DefaultPreauthMaxLifetime
+	}
+	return time.Duration(c.MaxLifetimeMinutes) * time.Minute
+}
+
+// LoadVerificationKeys returns the public keys trusted to sign the tokens
+func (c *PreauthConfig) LoadVerificationKeys() ([]crypto.PublicKey, error) {
+	content, err := os.ReadFile(c.VerificationKeys)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for len(content) > 0 {
+		pubkey, _, _, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			// no more keys in the remaining lines
+			break
+		}
+		cryptoPubkey, ok := pubkey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported verification key type %s", pubkey.Type())
+		}
+		keys = append(keys, cryptoPubkey.CryptoPublicKey())
+		content = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no verification key in %s", c.VerificationKeys)
+	}
+	return keys, nil
+}
@@ -0,0 +1,343 @@
+package unix_server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+	"github.com/francoismichel/ssh3/store"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultMaxAuthFailuresPerAddress = 10
+	DefaultMaxAuthFailuresPerUser    = 30
+	DefaultAuthFailureWindow         = 10 * time.Minute
+	DefaultAuthBanDuration           = 15 * time.Minute
+	DefaultMaxAuthBanDuration        = 24 * time.Hour
+	DefaultAuthBackoff               = 500 * time.Millisecond
+	DefaultMaxAuthBackoff            = 30 * time.Second
+)
+
+const (
+	authFailuresKeyPrefix = "auth_failures/"
+	authBackoffKeyPrefix  = "auth_backoff/"
+	authBanKeyPrefix      = "auth_ban/"
+	authBansKeyPrefix     = "auth_bans/"
+)
+
+// limits the failed authentications of each source address and of each requested username. After
+// a failure, the next attempts of the address or username are refused until a backoff doubling at
+// each failure has elapsed, and the addresses exceeding their maximum number of failures are
+// banned, for twice as long at each new ban. The usernames are only banned for the addresses
+// exceeding their maximum number of failures, so that an attacker cannot lock their owners out.
+// The counters are kept in the store of the server, so that they are shared by the servers of a
+// cluster. Zero values use the defaults.
+type AuthRateLimitConfig struct {
+	// the failures of an address within the failure window before it is banned, 10 by default,
+	// negative to disable the bans of the addresses
+	MaxFailuresPerAddress int `json:"max_failures_per_address,omitempty"`
+	// the failures for a username from an address within the failure window before the username
+	// is banned for that address, 30 by default, negative to disable these bans
+	MaxFailuresPerUser int `json:"max_failures_per_user,omitempty"`
+	// the failures are forgotten after this delay, 10 minutes by default
+	FailureWindowSeconds int `json:"failure_window_seconds,omitempty"`
+	// the duration of the first ban, 15 minutes by default
+	BanSeconds int `json:"ban_seconds,omitempty"`
+	// the maximum duration of the bans, also the delay after which the previous bans are
+	// forgotten, 24 hours by default
+	MaxBanSeconds int `json:"max_ban_seconds,omitempty"`
+	// the backoff after the first failure, 500 milliseconds by default, negative to disable it
+	BackoffMilliseconds int `json:"backoff_milliseconds,omitempty"`
+	// the maximum backoff, 30 seconds by default
+	MaxBackoffSeconds int `json:"max_backoff_seconds,omitempty"`
+	// the addresses or CIDR prefixes never limited, e.g. the ones of the monitoring probes
+	ExemptAddresses []string `json:"exempt_addresses,omitempty"`
+	// refuse the attempts when the limits cannot be read from the store, instead of not
+	// limiting them
+	FailClosed bool `json:"fail_closed,omitempty"`
+}
+
+func (c *AuthRateLimitConfig) validate() error {
+	if c.FailureWindowSeconds < 0 || c.BanSeconds < 0 || c.MaxBanSeconds < 0 || c.MaxBackoffSeconds < 0 {
+		return fmt.Errorf("negative durations in the authentication rate limits: %+v", *c)
+	}
+	if c.BanDuration() > c.MaxBanDuration() {
+		return fmt.Errorf("the ban duration exceeds the maximum ban duration")
+	}
+	if _, err := c.exemptPrefixes(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func defaultInt(value int, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func defaultDuration(value int, unit time.Duration, defaultValue time.Duration) time.Duration {
+	if value == 0 {
+		return defaultValue
+	}
+	return time.Duration(value) * unit
+}
+
+// MaxFailures returns the failures of a subject of the kind before it is banned, zero or
+// negative if it is never banned
+func (c *AuthRateLimitConfig) MaxFailures(kind string) int {
+	switch kind {
+	case authSubjectUser:
+		return 0
+	case authSubjectUserAddress:
+		return defaultInt(c.MaxFailuresPerUser, DefaultMaxAuthFailuresPerUser)
+	}
+	return defaultInt(c.MaxFailuresPerAddress, DefaultMaxAuthFailuresPerAddress)
+}
+
+func (c *AuthRateLimitConfig) FailureWindow() time.Duration {
+	return defaultDuration(c.FailureWindowSeconds, time.Second, DefaultAuthFailureWindow)
+}
+
+func (c *AuthRateLimitConfig) BanDuration() time.Duration {
+	return defaultDuration(c.BanSeconds, time.Second, DefaultAuthBanDuration)
+}
+
+func (c *AuthRateLimitConfig) MaxBanDuration() time.Duration {
+	return defaultDuration(c.MaxBanSeconds, time.Second, DefaultMaxAuthBanDuration)
+}
+
+func (c *AuthRateLimitConfig) Backoff() time.Duration {
+	return defaultDuration(c.BackoffMilliseconds, time.Millisecond, DefaultAuthBackoff)
+}
+
+func (c *AuthRateLimitConfig) MaxBackoff() time.Duration {
+	return defaultDuration(c.MaxBackoffSeconds, time.Second, DefaultMaxAuthBackoff)
+}
+
+func (c *AuthRateLimitConfig) exemptPrefixes() ([]netip.Prefix, error) {
+	proxies := ReverseProxyConfig{TrustedProxies: c.ExemptAddresses}
+	prefixes, err := proxies.TrustedPrefixes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid exempt address: %w", err)
+	}
+	return prefixes, nil
+}
+
+// the kinds of subjects whose failures are counted: the addresses back off and are banned, the
+// usernames only back off, and they are banned per address, the address backoff applying
+const (
+	authSubjectAddress     = "address"
+	authSubjectUser        = "user"
+	authSubjectUserAddress = "user_address"
+)
+
+// AuthRateLimiter refuses the authentication attempts of the banned or backing off addresses and
+// usernames, see AuthRateLimitConfig
+type AuthRateLimiter struct {
+	config *AuthRateLimitConfig
+	exempt []netip.Prefix
+	store  store.Store
+}
+
+func NewAuthRateLimiter(config *AuthRateLimitConfig, store store.Store) (*AuthRateLimiter, error) {
+	exempt, err := config.exemptPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthRateLimiter{config: config, exempt: exempt, store: store}, nil
+}
+
+// the subjects are escaped, so that a username cannot extend the key of another one
+func authSubjectKey(kind string, subject string) string {
+	return kind + "/" + url.PathEscape(subject) + "/"
+}
+
+// returns how long the subject must wait before its next attempt, and why
+func (l *AuthRateLimiter) retryAfter(ctx context.Context, kind string, subject string, now time.Time) (time.Duration, string, error) {
+	for _, limit := range []struct{ keyPrefix, reason string }{{authBanKeyPrefix, "banned"}, {authBackoffKeyPrefix, "backing off"}} {
+		until, err := l.store.Get(ctx, limit.keyPrefix+authSubjectKey(kind, subject))
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return 0, "", err
+		}
+		untilTime, err := time.Parse(time.RFC3339Nano, string(until))
+		if err != nil {
+			return 0, "", err
+		}
+		if wait := untilTime.Sub(now); wait > 0 {
+			return wait, limit.reason, nil
+		}
+	}
+	return 0, "", nil
+}
+
+func newRandomKey() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// counts a failure of the subject, then bans it if it exceeded its maximum number of failures, or
+// makes it back off otherwise
+func (l *AuthRateLimiter) recordFailure(ctx context.Context, kind string, subject string, now time.Time) error {
+	subjectKey := authSubjectKey(kind, subject)
+	failureID, err := newRandomKey()
+	if err != nil {
+		return err
+	}
+	if err := l.store.Put(ctx, authFailuresKeyPrefix+subjectKey+failureID, nil, l.config.FailureWindow()); err != nil {
+		return err
+	}
+	failures, err := l.store.Count(ctx, authFailuresKeyPrefix+subjectKey)
+	if err != nil {
+		return err
+	}
+	if maxFailures := l.config.MaxFailures(kind); maxFailures > 0 && failures >= maxFailures {
+		previousBans, err := l.store.Count(ctx, authBansKeyPrefix+subjectKey)
+		if err != nil {
+			return err
+		}
+		banDuration := l.config.BanDuration()
+		for i := 0; i < previousBans && banDuration < l.config.MaxBanDuration(); i++ {
+			banDuration *= 2
+		}
+		banDuration = min(banDuration, l.config.MaxBanDuration())
+		until := now.Add(banDuration)
+		log.Warn().Msgf("banned %s %s for %s after %d authentication failures", kind, subject, banDuration, failures)
+		if err := l.store.Put(ctx, authBanKeyPrefix+subjectKey, []byte(until.Format(time.RFC3339Nano)), banDuration); err != nil {
+			return err
+		}
+		return l.store.Put(ctx, authBansKeyPrefix+subjectKey+failureID, nil, l.config.MaxBanDuration())
+	}
+	backoff := l.config.Backoff()
+	if backoff <= 0 || kind == authSubjectUserAddress {
+		return nil
+	}
+	for i := 1; i < failures && backoff < l.config.MaxBackoff(); i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, l.config.MaxBackoff())
+	return l.store.Put(ctx, authBackoffKeyPrefix+subjectKey, []byte(now.Add(backoff).Format(time.RFC3339Nano)), backoff)
+}
+
+// returns the username requested by the client, whatever the authentication method
+func requestedUsername(r *http.Request) string {
+	if username := r.URL.User.Username(); username != "" {
+		return username
+	}
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	return r.URL.Query().Get("user")
+}
+
+// Handler refuses the attempts of the banned or backing off clients with 429 Too Many Requests,
+// and counts the ones that handlerFunc refuses with 401 Unauthorized
+func (l *AuthRateLimiter) Handler(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || ssh3.ContainsAddr(l.exempt, remoteAddr.Addr()) {
+			handlerFunc(w, r)
+			return
+		}
+		address := remoteAddr.Addr().Unmap().String()
+		// the case of the usernames is ignored so that it cannot be varied to evade the limits
+		username := strings.ToLower(requestedUsername(r))
+		subjects := []struct{ kind, subject string }{{authSubjectAddress, address}}
+		if username != "" {
+			// the addresses cannot contain @, the username is the part before the last one
+			subjects = append(subjects, struct{ kind, subject string }{authSubjectUser, username},
+				struct{ kind, subject string }{authSubjectUserAddress, username + "@" + address})
+		}
+		now := time.Now()
+		for _, subject := range subjects {
+			wait, reason, err := l.retryAfter(r.Context(), subject.kind, subject.subject, now)
+			if err != nil && l.config.FailClosed {
+				log.Error().Msgf("refused the authentication attempt for user %q from %s: could not check the authentication rate limits of %s %s: %s", username, address, subject.kind, subject.subject, err)
+				ssh3.WriteDisconnectResponse(w, http.StatusServiceUnavailable, ssh3.Disconnect{
+					ReasonCode:  ssh3Messages.SSH_DISCONNECT_SERVICE_NOT_AVAILABLE,
+					Description: "the authentication rate limits are unavailable, retry later",
+					LanguageTag: "en",
+				})
+				return
+			} else if err != nil {
+				// the attempts are not limited rather than refused when the store is down, unless
+				// the config fails closed
+				log.Error().Msgf("could not check the authentication rate limits of %s %s, not limiting the attempt: %s", subject.kind, subject.subject, err)
+				continue
+			}
+			if wait > 0 {
+				log.Warn().Msgf("refused the authentication attempt for user %q from %s: %s %s for %s", username, address, subject.kind, reason, wait.Round(time.Second))
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())+1))
+				ssh3.WriteDisconnectResponse(w, http.StatusTooManyRequests, ssh3.Disconnect{
+					ReasonCode:  ssh3Messages.SSH_DISCONNECT_NO_MORE_AUTH_METHODS_AVAILABLE,
+					Description: fmt.Sprintf("too many authentication failures, retry in %s", wait.Round(time.Second)),
+					LanguageTag: "en",
+				})
+				return
+			}
+		}
+		recorder := &authStatusRecorder{ResponseWriter: w}
+		handlerFunc(recorder, r)
+		if recorder.status != http.StatusUnauthorized {
+			return
+		}
+		if r.Header.Get("Authorization") == "" && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			// the client did not try to authenticate, e.g. to get the banner of the server first
+			return
+		}
+		if recorder.Header().Get(ssh3.KeyboardInteractivePromptHeader) != "" {
+			// the first factor was accepted, the second one is still to be sent
+			return
+		}
+		log.Warn().Msgf("authentication failure for user %q from %s", username, address)
+		for _, subject := range subjects {
+			if err := l.recordFailure(context.Background(), subject.kind, subject.subject, now); err != nil {
+				log.Error().Msgf("could not count the authentication failure of %s %s: %s", subject.kind, subject.subject, err)
+			}
+		}
+	}
+}
+
+// records the status of the response to tell the failed authentications apart
+type authStatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *authStatusRecorder) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *authStatusRecorder) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *authStatusRecorder) StreamCreator() http3.StreamCreator {
+	return w.ResponseWriter.(http3.Hijacker).StreamCreator()
+}
+
+func (w *authStatusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,160 @@
+package unix_server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+	"github.com/francoismichel/ssh3/store"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// a store that cannot be read, as a Redis server that is down
+type unavailableStore struct {
+	store.Store
+}
+
+func (s unavailableStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+var _ = Describe("Authentication rate limits", func() {
+	var limitStore *store.Memory
+	var calls int
+
+	BeforeEach(func() {
+		limitStore = store.NewMemory()
+		calls = 0
+	})
+
+	newLimiter := func(config *AuthRateLimitConfig) *AuthRateLimiter {
+		limiter, err := NewAuthRateLimiter(config, limitStore)
+		Expect(err).ToNot(HaveOccurred())
+		return limiter
+	}
+
+	// an authentication handler refusing the users, prompting for a second factor if prompt is set
+	refusingHandler := func(prompt bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			calls += 1
+			if prompt {
+				w.Header().Set(ssh3.KeyboardInteractivePromptHeader, keyboardInteractivePrompt)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+
+	// returns the response to an authentication attempt of username from remoteAddr
+	attempt := func(handler http.HandlerFunc, username string, remoteAddr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "https://localhost/ssh3?user="+username, nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer token")
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder
+	}
+
+	It("Backs off the subjects twice as long at each failure", func() {
+		limiter := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: -1, BackoffMilliseconds: 500, MaxBackoffSeconds: 3})
+		now := time.Now()
+		for _, backoff := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+			Expect(limiter.recordFailure(context.Background(), authSubjectAddress, "192.0.2.1", now)).To(Succeed())
+			wait, reason, err := limiter.retryAfter(context.Background(), authSubjectAddress, "192.0.2.1", now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(Equal("backing off"))
+			Expect(wait).To(Equal(backoff))
+		}
+	})
+
+	It("Bans the addresses exceeding their failures, twice as long at each new ban", func() {
+		limiter := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: 2, BanSeconds: 60, MaxBanSeconds: 150})
+		now := time.Now()
+		Expect(limiter.recordFailure(context.Background(), authSubjectAddress, "192.0.2.1", now)).To(Succeed())
+		_, reason, err := limiter.retryAfter(context.Background(), authSubjectAddress, "192.0.2.1", now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reason).To(Equal("backing off"))
+		for _, ban := range []time.Duration{time.Minute, 2 * time.Minute, 150 * time.Second} {
+			Expect(limiter.recordFailure(context.Background(), authSubjectAddress, "192.0.2.1", now)).To(Succeed())
+			wait, reason, err := limiter.retryAfter(context.Background(), authSubjectAddress, "192.0.2.1", now)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reason).To(Equal("banned"))
+			Expect(wait).To(Equal(ban))
+		}
+	})
+
+	It("Never bans the usernames alone", func() {
+		limiter := newLimiter(&AuthRateLimitConfig{MaxFailuresPerUser: 1, BackoffMilliseconds: 500})
+		now := time.Now()
+		Expect(limiter.recordFailure(context.Background(), authSubjectUser, "alice", now)).To(Succeed())
+		Expect(limiter.recordFailure(context.Background(), authSubjectUser, "alice", now)).To(Succeed())
+		_, reason, err := limiter.retryAfter(context.Background(), authSubjectUser, "alice", now)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reason).To(Equal("backing off"))
+	})
+
+	It("Refuses the attempts of the backing off clients without authenticating them", func() {
+		handler := newLimiter(&AuthRateLimitConfig{BackoffMilliseconds: 5000}).Handler(refusingHandler(false))
+		Expect(attempt(handler, "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		recorder := attempt(handler, "alice", "192.0.2.1:4433")
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal("6"))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("Bans the usernames only for the addresses of their failures", func() {
+		handler := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: -1, MaxFailuresPerUser: 2, BackoffMilliseconds: -1}).Handler(refusingHandler(false))
+		Expect(attempt(handler, "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		Expect(attempt(handler, "Alice", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		Expect(attempt(handler, "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusTooManyRequests))
+
+		// the owner of the username can still authenticate from elsewhere
+		Expect(attempt(handler, "alice", "198.51.100.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		Expect(attempt(handler, "bob", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Never limits the exempt addresses", func() {
+		handler := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: 1, ExemptAddresses: []string{"192.0.2.0/24"}}).Handler(refusingHandler(false))
+		for i := 0; i < 3; i++ {
+			Expect(attempt(handler, "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		}
+		Expect(limitStore.Count(context.Background(), authFailuresKeyPrefix)).To(BeZero())
+
+		Expect(attempt(handler, "alice", "[::ffff:198.51.100.1]:4433").Code).To(Equal(http.StatusUnauthorized))
+		Expect(attempt(handler, "alice", "198.51.100.1:4433").Code).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("Does not count the first factors waiting for the second one", func() {
+		handler := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: 1}).Handler(refusingHandler(true))
+		for i := 0; i < 3; i++ {
+			Expect(attempt(handler, "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusUnauthorized))
+		}
+		Expect(limitStore.Count(context.Background(), authFailuresKeyPrefix)).To(BeZero())
+	})
+
+	It("Does not count the attempts without credentials", func() {
+		handler := newLimiter(&AuthRateLimitConfig{MaxFailuresPerAddress: 1}).Handler(refusingHandler(false))
+		request := httptest.NewRequest(http.MethodGet, "https://localhost/ssh3?user=alice", nil)
+		handler(httptest.NewRecorder(), request)
+		Expect(limitStore.Count(context.Background(), authFailuresKeyPrefix)).To(BeZero())
+	})
+
+	It("Only refuses the attempts when the store is down if configured to fail closed", func() {
+		config := &AuthRateLimitConfig{}
+		limiter, err := NewAuthRateLimiter(config, unavailableStore{})
+		Expect(err).ToNot(HaveOccurred())
+		accepting := func(w http.ResponseWriter, r *http.Request) {
+			calls += 1
+		}
+		Expect(attempt(limiter.Handler(accepting), "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusOK))
+		Expect(calls).To(Equal(1))
+
+		config.FailClosed = true
+		Expect(attempt(limiter.Handler(accepting), "alice", "192.0.2.1:4433").Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(calls).To(Equal(1))
+	})
+})
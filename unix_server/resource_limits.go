@@ -0,0 +1,106 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/francoismichel/ssh3/limits"
+)
+
+// applies resource limits, a scheduling priority and a umask to the sessions of the users
+// matching one of the patterns of Users, similarly to pam_limits. The unset fields keep the
+// values of the server.
+type ResourceLimitsConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	// the maximum number of open files of each process (RLIMIT_NOFILE)
+	MaxOpenFiles *uint64 `json:"max_open_files,omitempty"`
+	// the maximum number of processes of the user (RLIMIT_NPROC), including the ones outside
+	// of the session
+	MaxProcesses *uint64 `json:"max_processes,omitempty"`
+	// the maximum size of the core dumps in bytes (RLIMIT_CORE), 0 disables them
+	MaxCoreSize *uint64 `json:"max_core_size,omitempty"`
+	// the niceness of the sessions, from -20 (highest priority) to 19 (lowest priority)
+	Nice *int `json:"nice,omitempty"`
+	// the I/O scheduling class of the sessions (Linux only): "realtime", "best-effort" or "idle"
+	IOClass string `json:"io_class,omitempty"`
+	// the priority within the I/O scheduling class, from 0 (highest) to 7 (lowest)
+	IOPriority int `json:"io_priority,omitempty"`
+	// the umask of the sessions in octal, e.g. "027"
+	Umask string `json:"umask,omitempty"`
+	// the CPU time in CPUs, the memory in bytes and the processes and threads of all the sessions
+	// of the user together, enforced using a cgroup per user (Linux only, cgroup v2)
+	CPUs      *float64 `json:"cpus,omitempty"`
+	MaxMemory *uint64  `json:"max_memory,omitempty"`
+	MaxPids   *uint64  `json:"max_pids,omitempty"`
+}
+
+// the directory under which the cgroups of the users are created by default
+const DefaultCgroupDirectory = "/sys/fs/cgroup/ssh3"
+
+// UserCgroup returns the cgroup of the sessions of the local user, directory being the one of the
+// server config if set
+func UserCgroup(directory string, username string) (string, error) {
+	if directory == "" {
+		directory = DefaultCgroupDirectory
+	}
+	if username == "" || username == "." || username == ".." || strings.Contains(username, "/") {
+		return "", fmt.Errorf("cannot create the cgroup of user %q", username)
+	}
+	return filepath.Join(directory, username), nil
+}
+
+// Limits returns the limits applied to the sessions
+func (c *ResourceLimitsConfig) Limits() (limits.Config, error) {
+	config := limits.Config{
+		MaxOpenFiles: c.MaxOpenFiles,
+		MaxProcesses: c.MaxProcesses,
+		MaxCoreSize:  c.MaxCoreSize,
+		Nice:         c.Nice,
+		IOPriority:   c.IOPriority,
+		CPUs:         c.CPUs,
+		MaxMemory:    c.MaxMemory,
+		MaxPids:      c.MaxPids,
+	}
+	if c.IOClass != "" {
+		class, err := limits.ParseIOClass(c.IOClass)
+		if err != nil {
+			return limits.Config{}, err
+		}
+		config.IOClass = class
+	}
+	if c.Umask != "" {
+		umask, err := limits.ParseUmask(c.Umask)
+		if err != nil {
+			return limits.Config{}, err
+		}
+		config.Umask = &umask
+	}
+	return config, config.Validate()
+}
+
+func validateResourceLimits(resourceLimits []ResourceLimitsConfig) error {
+	for _, config := range resourceLimits {
+		for _, pattern := range config.Users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid username pattern %q: %w", pattern, err)
+			}
+		}
+		if _, err := config.Limits(); err != nil {
+			return fmt.Errorf("invalid resource limits of users %v: %w", config.Users, err)
+		}
+	}
+	return nil
+}
+
+// ResourceLimits returns the first resource limits matching username, if any
+func ResourceLimits(resourceLimits []ResourceLimitsConfig, username string) (ResourceLimitsConfig, bool) {
+	for _, config := range resourceLimits {
+		if matchesOneOf(config.Users, username) {
+			return config, true
+		}
+	}
+	return ResourceLimitsConfig{}, false
+}
@@ -0,0 +1,131 @@
+package unix_server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/francoismichel/ssh3"
+)
+
+// ReverseProxyConfig lets the server run behind load balancers and proxies while attributing
+// the requests to the actual clients
+type ReverseProxyConfig struct {
+	// the addresses or CIDR prefixes of the proxies whose PROXY protocol headers and Forwarded
+	// and X-Forwarded-For headers are trusted, e.g. "10.0.0.0/8"
+	TrustedProxies []string `json:"trusted_proxies"`
+	// if set, the datagrams relayed by the trusted proxies may start with a PROXY protocol v2
+	// header carrying the address of the client, e.g. for UDP load balancers
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+	// prefixes the URL path of the server and the health-check path, e.g. "/ssh3" when the
+	// proxy routes the requests under /ssh3/ to the server
+	BasePath string `json:"base_path,omitempty"`
+	// if set, the GET requests on this path are answered 200, or 503 during a maintenance
+	// window, so that the load balancers stop routing new conversations to the server
+	HealthCheckPath string `json:"health_check_path,omitempty"`
+}
+
+func (c *ReverseProxyConfig) validate() error {
+	if _, err := c.TrustedPrefixes(); err != nil {
+		return err
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.HasSuffix(c.BasePath, "/")) {
+		return fmt.Errorf("the base path must start with a / and not end with one: %q", c.BasePath)
+	}
+	if c.HealthCheckPath != "" && !strings.HasPrefix(c.HealthCheckPath, "/") {
+		return fmt.Errorf("the health-check path must start with a /: %q", c.HealthCheckPath)
+	}
+	return nil
+}
+
+// TrustedPrefixes parses the trusted proxies, the single addresses becoming full-length prefixes
+func (c *ReverseProxyConfig) TrustedPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Path returns the path under the base path
+func (c *ReverseProxyConfig) Path(path string) string {
+	return c.BasePath + path
+}
+
+// parses a node of the Forwarded or X-Forwarded-For headers, e.g. 192.0.2.1, "[2001:db8::1]:4711"
+// or an obfuscated identifier, which is not valid
+func parseForwardedNode(node string) netip.AddrPort {
+	node = strings.Trim(strings.TrimSpace(node), "\"")
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")); err == nil {
+		return netip.AddrPortFrom(addr, 0)
+	}
+	return netip.AddrPort{}
+}
+
+// returns the nodes of the Forwarded (RFC 7239) header, or of the X-Forwarded-For one if absent,
+// from the farthest to the closest
+func forwardedNodes(header http.Header) []string {
+	var nodes []string
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if key, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(key, "for") {
+					nodes = append(nodes, value)
+				}
+			}
+		}
+		return nodes
+	}
+	for _, forwardedFor := range header.Values("X-Forwarded-For") {
+		nodes = append(nodes, strings.Split(forwardedFor, ",")...)
+	}
+	return nodes
+}
+
+// ClientAddressHandler replaces the RemoteAddr of the requests relayed by the trusted proxies with
+// the address of the client, taken from the PROXY protocol header of its datagrams if proxyConn is
+// not nil, then from the Forwarded headers, the closest untrusted node being the client
+func (c *ReverseProxyConfig) ClientAddressHandler(proxyConn *ssh3.ProxyProtocolConn, handlerFunc http.HandlerFunc) (http.HandlerFunc, error) {
+	trustedProxies, err := c.TrustedPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !ssh3.ContainsAddr(trustedProxies, remoteAddr.Addr()) {
+			handlerFunc(w, r)
+			return
+		}
+		if proxyConn != nil {
+			if clientAddr, ok := proxyConn.ClientAddr(r.RemoteAddr); ok {
+				remoteAddr = clientAddr
+			}
+		}
+		nodes := forwardedNodes(r.Header)
+		for i := len(nodes) - 1; i >= 0 && ssh3.ContainsAddr(trustedProxies, remoteAddr.Addr()); i-- {
+			node := parseForwardedNode(nodes[i])
+			if !node.IsValid() {
+				break
+			}
+			remoteAddr = node
+		}
+		r.RemoteAddr = remoteAddr.String()
+		handlerFunc(w, r)
+	}, nil
+}
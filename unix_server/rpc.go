@@ -0,0 +1,54 @@
+package unix_server
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/francoismichel/ssh3/rpc"
+)
+
+// the built-in rpc subsystem is only available if configured, each method being
+// only allowed to the users matching one of its patterns
+type RPCSubsystemConfig struct {
+	Methods map[string]RPCMethodConfig `json:"methods"`
+}
+
+type RPCMethodConfig struct {
+	// username patterns that may contain the '*' and '?' wildcards
+	Users []string `json:"users"`
+	rpc.MethodPolicy
+}
+
+func isRPCMethod(method string) bool {
+	for _, knownMethod := range rpc.Methods {
+		if method == knownMethod {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RPCSubsystemConfig) validate() error {
+	for method, methodConfig := range c.Methods {
+		if !isRPCMethod(method) {
+			return fmt.Errorf("unknown rpc method %q", method)
+		}
+		for _, pattern := range append(append(append([]string{}, methodConfig.Users...), methodConfig.Paths...), methodConfig.Commands...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q for rpc method %s: %w", pattern, method, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Policy returns the policy of the methods allowed to username
+func (c *RPCSubsystemConfig) Policy(username string) rpc.Policy {
+	policy := make(rpc.Policy)
+	for method, methodConfig := range c.Methods {
+		if matchesOneOf(methodConfig.Users, username) {
+			policy[method] = methodConfig.MethodPolicy
+		}
+	}
+	return policy
+}
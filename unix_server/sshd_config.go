@@ -0,0 +1,348 @@
+package unix_server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// status of an sshd_config directive once imported
+const (
+	// translated into the SSH3 server config
+	SSHDDirectiveTranslated = "translated"
+	// must be set using the args or the environment of ssh3-server
+	SSHDDirectiveFlag = "flag"
+	// already the behaviour of ssh3-server, nothing to translate
+	SSHDDirectiveEquivalent = "equivalent"
+	// overridden by a previous occurrence of the same directive, as in sshd
+	SSHDDirectiveIgnored     = "ignored"
+	SSHDDirectiveUnsupported = "unsupported"
+)
+
+type SSHDDirectiveReport struct {
+	Line    int
+	Keyword string
+	Status  string
+	Message string
+}
+
+type InvalidSSHDConfig struct {
+	Line   int
+	Reason string
+}
+
+func (e InvalidSSHDConfig) Error() string {
+	return fmt.Sprintf("invalid sshd_config at line %d: %s", e.Line, e.Reason)
+}
+
+// splits a line into its keyword and arguments, the keyword being optionally followed by '='
+func splitSSHDConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	keywordEnd := strings.IndexAny(line, " \t=")
+	if keywordEnd < 0 {
+		return line, nil, nil
+	}
+	keyword := line[:keywordEnd]
+	rest := strings.TrimLeft(line[keywordEnd:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var current strings.Builder
+	inArg, inQuotes := false, false
+	for _, c := range rest {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return "", nil, fmt.Errorf("unterminated quoted argument")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return keyword, args, nil
+}
+
+// the directives that can appear several times, the others only take their first value into account
+var sshdMultipleDirectives = map[string]bool{
+	"allowusers":      true,
+	"denyusers":       true,
+	"subsystem":       true,
+	"port":            true,
+	"listenaddress":   true,
+	"hostkey":         true,
+	"hostcertificate": true,
+	"include":         true,
+	"match":           true,
+}
+
+// the features that ssh3-server does not support, so that disabling them is equivalent
+var sshdUnsupportedFeatureDirectives = map[string]bool{
+	"kbdinteractiveauthentication":    true,
+	"challengeresponseauthentication": true,
+	"gssapiauthentication":            true,
+	"hostbasedauthentication":         true,
+	"permitemptypasswords":            true,
+	"x11forwarding":                   true,
+}
+
+// ImportSSHDConfig translates the directives of an sshd_config file into an SSH3 server config.
+// It returns a report for every directive telling whether and how it was translated.
+func ImportSSHDConfig(r io.Reader) (*ServerConfig, []SSHDDirectiveReport, error) {
+	config := &ServerConfig{}
+	var reports []SSHDDirectiveReport
+	seen := make(map[string]bool)
+	inMatchBlock := false
+	tcpForwardingDisabled := false
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, args, err := splitSSHDConfigLine(line)
+		if err != nil {
+			return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: err.Error()}
+		}
+		report := func(status string, format string, a ...interface{}) {
+			reports = append(reports, SSHDDirectiveReport{Line: lineNumber, Keyword: keyword, Status: status, Message: fmt.Sprintf(format, a...)})
+		}
+		lowerKeyword := strings.ToLower(keyword)
+		if lowerKeyword == "match" {
+			inMatchBlock = len(args) != 1 || strings.ToLower(args[0]) != "all"
+			if inMatchBlock {
+				report(SSHDDirectiveUnsupported, "conditional blocks are not supported, the directives of this block are not imported")
+			}
+			continue
+		}
+		if inMatchBlock {
+			report(SSHDDirectiveUnsupported, "not imported as it is part of a Match block")
+			continue
+		}
+		if len(args) == 0 {
+			return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("missing argument for %s", keyword)}
+		}
+		if !sshdMultipleDirectives[lowerKeyword] {
+			if seen[lowerKeyword] {
+				report(SSHDDirectiveIgnored, "only the first occurrence of this directive is taken into account")
+				continue
+			}
+			seen[lowerKeyword] = true
+		}
+		value := strings.ToLower(args[0])
+
+		switch lowerKeyword {
+		case "allowusers", "denyusers":
+			var patterns []string
+			for _, pattern := range args {
+				if strings.Contains(pattern, "@") {
+					report(SSHDDirectiveUnsupported, "host restrictions are not supported, %q is not imported", pattern)
+					continue
+				}
+				patterns = append(patterns, pattern)
+			}
+			if len(patterns) == 0 {
+				continue
+			}
+			if lowerKeyword == "allowusers" {
+				config.AccessControl.AllowUsers = append(config.AccessControl.AllowUsers, patterns...)
+				report(SSHDDirectiveTranslated, "access_control.allow_users")
+			} else {
+				config.AccessControl.DenyUsers = append(config.AccessControl.DenyUsers, patterns...)
+				report(SSHDDirectiveTranslated, "access_control.deny_users")
+			}
+		case "permitopen":
+			if value == "any" {
+				report(SSHDDirectiveEquivalent, "forwarded connections are permitted to any target by default")
+				continue
+			}
+			if value != "none" {
+				for _, target := range args {
+					if _, err := parsePermitOpenTarget(target); err != nil {
+						return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: err.Error()}
+					}
+				}
+			}
+			config.AccessControl.PermitOpen = args
+			report(SSHDDirectiveTranslated, "access_control.permit_open")
+		case "allowtcpforwarding":
+			switch value {
+			case "yes", "all", "local":
+				report(SSHDDirectiveEquivalent, "ssh3-server permits the forwarding of connections initiated by clients")
+			case "no", "remote":
+				tcpForwardingDisabled = true
+				report(SSHDDirectiveTranslated, "access_control.permit_open set to \"none\"")
+			default:
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("invalid value %q for %s", args[0], keyword)}
+			}
+		case "subsystem":
+			if len(args) < 2 {
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("missing command for subsystem %s", args[0])}
+			}
+			if _, ok := config.Subsystems[args[0]]; ok {
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("subsystem %s defined twice", args[0])}
+			}
+			if args[1] == "internal-sftp" {
+				report(SSHDDirectiveUnsupported, "internal-sftp is not supported, use the command of an sftp server instead (e.g. /usr/lib/openssh/sftp-server)")
+				continue
+			}
+			if config.Subsystems == nil {
+				config.Subsystems = make(map[string]string)
+			}
+			config.Subsystems[args[0]] = strings.Join(args[1:], " ")
+			report(SSHDDirectiveTranslated, "subsystems.%s", args[0])
+		case "forcecommand":
+			if value == "none" {
+				report(SSHDDirectiveEquivalent, "no command is forced by default")
+				continue
+			}
+			config.ForceCommands = append(config.ForceCommands, ForceCommandConfig{Users: []string{"*"}, Command: strings.Join(args, " ")})
+			report(SSHDDirectiveTranslated, "force_commands")
+		case "chrootdirectory":
+			if value == "none" {
+				report(SSHDDirectiveEquivalent, "sessions are not chrooted by default")
+				continue
+			}
+			config.Confinements = append(config.Confinements, ConfinementConfig{Users: []string{"*"}, ChrootDirectory: args[0]})
+			report(SSHDDirectiveTranslated, "confinements")
+		case "banner":
+			if value == "none" {
+				report(SSHDDirectiveEquivalent, "ssh3-server displays no banner by default")
+				continue
+			}
+			if !filepath.IsAbs(args[0]) {
+				report(SSHDDirectiveUnsupported, "the banner file must be an absolute path")
+				continue
+			}
+			config.BannerFile = args[0]
+			report(SSHDDirectiveTranslated, "banner_file")
+		case "printmotd", "printlastlog":
+			switch value {
+			case "yes":
+				if lowerKeyword == "printmotd" {
+					config.PrintMotd = true
+					report(SSHDDirectiveTranslated, "print_motd")
+				} else {
+					config.PrintLastLog = true
+					report(SSHDDirectiveTranslated, "print_last_log")
+				}
+			case "no":
+				report(SSHDDirectiveEquivalent, "disabled by default")
+			default:
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("invalid value %q for %s", args[0], keyword)}
+			}
+		case "port", "listenaddress":
+			report(SSHDDirectiveFlag, "use the -bind arg, SSH3 listens on a UDP port (e.g. -bind [::]:443)")
+		case "hostkey", "hostcertificate":
+			report(SSHDDirectiveFlag, "use the -cert and -key args, SSH3 servers authenticate using X.509 certificates")
+		case "loglevel":
+			report(SSHDDirectiveFlag, "use the SSH3_LOG_LEVEL environment variable")
+		case "passwordauthentication":
+			if value == "yes" {
+				report(SSHDDirectiveFlag, "use the -enable-password-login arg")
+			} else {
+				report(SSHDDirectiveEquivalent, "password authentication is disabled by default")
+			}
+		case "pubkeyauthentication":
+			if value == "yes" {
+				report(SSHDDirectiveEquivalent, "public key authentication is always enabled")
+			} else {
+				report(SSHDDirectiveUnsupported, "public key authentication cannot be disabled")
+			}
+		case "authenticationmethods":
+			if value == "any" {
+				report(SSHDDirectiveEquivalent, "any authentication method is accepted by default")
+				continue
+			}
+			var lists []string
+			for _, list := range args {
+				if _, err := ParseAuthenticationMethods([]string{list}); err != nil {
+					report(SSHDDirectiveUnsupported, "%s, %q is not imported", err, list)
+					continue
+				}
+				lists = append(lists, list)
+			}
+			if len(lists) == 0 {
+				continue
+			}
+			config.AuthenticationMethods = lists
+			report(SSHDDirectiveTranslated, "authentication_methods, the keyboard-interactive second factor being a one-time password (see ssh3-keygen totp)")
+		case "authorizedkeysfile":
+			isDefault := true
+			for _, file := range args {
+				if file != ".ssh/authorized_keys" && file != ".ssh/authorized_keys2" && file != "%h/.ssh/authorized_keys" {
+					isDefault = false
+				}
+			}
+			if isDefault {
+				report(SSHDDirectiveEquivalent, "ssh3-server reads ~/.ssh/authorized_keys and ~/.ssh3/authorized_identities")
+			} else {
+				report(SSHDDirectiveUnsupported, "ssh3-server only reads ~/.ssh/authorized_keys and ~/.ssh3/authorized_identities")
+			}
+		case "maxstartups":
+			if _, err := ParseMaxStartups(args[0]); err != nil {
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: err.Error()}
+			}
+			config.ConcurrencyLimits.MaxStartups = args[0]
+			report(SSHDDirectiveTranslated, "concurrency_limits.max_startups")
+		case "maxsessions":
+			maxSessions, err := strconv.Atoi(args[0])
+			if err != nil || maxSessions < 0 {
+				return nil, nil, InvalidSSHDConfig{Line: lineNumber, Reason: fmt.Sprintf("invalid value %q for %s", args[0], keyword)}
+			}
+			if maxSessions == 0 {
+				report(SSHDDirectiveUnsupported, "the sessions cannot be disabled")
+				continue
+			}
+			config.ConcurrencyLimits.MaxChannelsPerConversation = maxSessions
+			report(SSHDDirectiveTranslated, "concurrency_limits.max_channels_per_conversation, which also counts the forwarded connections")
+		case "revokedkeys":
+			if value == "none" {
+				report(SSHDDirectiveEquivalent, "no key is revoked by default")
+				continue
+			}
+			if !filepath.IsAbs(args[0]) {
+				report(SSHDDirectiveUnsupported, "the revoked keys file must be an absolute path")
+				continue
+			}
+			config.RevokedKeys = args[0]
+			report(SSHDDirectiveTranslated, "revoked_keys")
+		default:
+			if sshdUnsupportedFeatureDirectives[lowerKeyword] && value == "no" {
+				report(SSHDDirectiveEquivalent, "not supported by ssh3-server")
+			} else {
+				report(SSHDDirectiveUnsupported, "no SSH3 equivalent")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if tcpForwardingDisabled {
+		config.AccessControl.PermitOpen = []string{"none"}
+	}
+	if err := config.AccessControl.validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := validateConfinements(config.Confinements); err != nil {
+		return nil, nil, err
+	}
+	return config, reports, nil
+}
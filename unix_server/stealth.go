@@ -0,0 +1,177 @@
+package unix_server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRefusalDelayMilliseconds is the delay of the refusals of the hidden endpoints, above
+// the usual duration of the authentications, e.g. hashing a password
+const DefaultRefusalDelayMilliseconds = 1000
+
+// StealthConfig hides the SSH3 endpoint from the scanners: the requests on other paths than the
+// secret URL path, the unauthenticated requests and the requests of other clients than SSH3 all
+// get the same 404 response, sent after the same delay
+type StealthConfig struct {
+	// the refusals are answered this long after the request was received, so that the
+	// authentication failures cannot be told apart from the unknown paths by their timing,
+	// DefaultRefusalDelayMilliseconds by default. The refusals of the authentications lasting
+	// longer are answered after the next multiple of this delay.
+	RefusalDelayMilliseconds int `json:"refusal_delay_milliseconds,omitempty"`
+	// if set, the requests not carrying a knock token derived from this secret in the
+	// ssh3.KnockHeader are refused before being processed, see ssh3.LoadKnockSecret. The
+	// clients proving that they know the secret get the actual refusals, e.g. 401.
+	KnockSecretFile string `json:"knock_secret_file,omitempty"`
+}
+
+func (c *StealthConfig) validate() error {
+	if c.RefusalDelayMilliseconds < 0 {
+		return fmt.Errorf("the refusal delay must be positive: %d", c.RefusalDelayMilliseconds)
+	}
+	if c.KnockSecretFile != "" && !filepath.IsAbs(c.KnockSecretFile) {
+		return fmt.Errorf("the knock secret file must be an absolute path: %q", c.KnockSecretFile)
+	}
+	return nil
+}
+
+func (c *StealthConfig) RefusalDelay() time.Duration {
+	if c.RefusalDelayMilliseconds == 0 {
+		return DefaultRefusalDelayMilliseconds * time.Millisecond
+	}
+	return time.Duration(c.RefusalDelayMilliseconds) * time.Millisecond
+}
+
+type stealthRoute struct {
+	urlPathHash [sha256.Size]byte
+	handlerFunc http.HandlerFunc
+}
+
+type stealthHandler struct {
+	routes       []stealthRoute
+	refusalDelay time.Duration
+	knockSecret  []byte
+}
+
+// NewStealthHandler serves the handlers on their secret URL paths, and answers 404 to the other
+// requests as configured. The paths are compared in constant time.
+func NewStealthHandler(config *StealthConfig, handlers map[string]http.HandlerFunc) (http.Handler, error) {
+	handler := &stealthHandler{refusalDelay: config.RefusalDelay()}
+	for urlPath, handlerFunc := range handlers {
+		handler.routes = append(handler.routes, stealthRoute{urlPathHash: sha256.Sum256([]byte(urlPath)), handlerFunc: handlerFunc})
+	}
+	if config.KnockSecretFile != "" {
+		var err error
+		if handler.knockSecret, err = ssh3.LoadKnockSecret(config.KnockSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	return handler, nil
+}
+
+func (h *stealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	// the hashes have the same length whatever the path, so the comparisons do not tell how
+	// much of the path matched, and all the routes are compared
+	pathHash := sha256.Sum256([]byte(r.URL.Path))
+	var handlerFunc http.HandlerFunc
+	for _, route := range h.routes {
+		if subtle.ConstantTimeCompare(pathHash[:], route.urlPathHash[:]) == 1 {
+			handlerFunc = route.handlerFunc
+		}
+	}
+	knocked := h.knockSecret != nil && ssh3.VerifyKnockToken(h.knockSecret, r.Header.Get(ssh3.KnockHeader), received)
+	if handlerFunc == nil || (h.knockSecret != nil && !knocked) {
+		h.refuse(w, r, received)
+		return
+	}
+	if knocked {
+		handlerFunc(w, r)
+		return
+	}
+	masked := &stealthResponseWriter{ResponseWriter: w, masked: true}
+	handlerFunc(masked, r)
+	if masked.refused {
+		h.refuse(w, r, received)
+	}
+}
+
+// returns when the refusal of the request received at received is answered: once the refusal
+// delay elapsed, or on its next multiple if the request took longer to process, so that a slow
+// authentication only tells how many delays it lasted
+func (h *stealthHandler) refusalDeadline(received time.Time) time.Time {
+	delays := time.Since(received)/h.refusalDelay + 1
+	return received.Add(delays * h.refusalDelay)
+}
+
+// answers 404 as for an unknown path at the refusal deadline
+func (h *stealthHandler) refuse(w http.ResponseWriter, r *http.Request, received time.Time) {
+	log.Debug().Msgf("answering 404 to the %s request on a hidden endpoint from %s", r.Method, r.RemoteAddr)
+	time.Sleep(time.Until(h.refusalDeadline(received)))
+	header := w.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	http.NotFound(w, r)
+	// the server does not flush the response once the handler took over the request stream
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// drops the refusals until the user is authenticated, the stealth handler then answering 404
+type stealthResponseWriter struct {
+	http.ResponseWriter
+	masked  bool
+	refused bool
+}
+
+func (w *stealthResponseWriter) WriteHeader(statusCode int) {
+	if w.masked && statusCode >= http.StatusMultipleChoices {
+		w.refused = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *stealthResponseWriter) Write(p []byte) (int, error) {
+	if w.refused {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *stealthResponseWriter) Flush() {
+	if !w.refused {
+		w.ResponseWriter.(http.Flusher).Flush()
+	}
+}
+
+func (w *stealthResponseWriter) StreamCreator() http3.StreamCreator {
+	return w.ResponseWriter.(http3.Hijacker).StreamCreator()
+}
+
+// the responses to the authenticated users are not masked, e.g. to tell them why their
+// conversation is refused
+func unmaskResponses(w http.ResponseWriter) {
+	for {
+		if stealthWriter, ok := w.(*stealthResponseWriter); ok {
+			stealthWriter.masked = false
+			return
+		}
+		// the stealth writer may be wrapped by the other handlers, e.g. to record the status
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
+}
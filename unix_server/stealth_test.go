@@ -0,0 +1,51 @@
+package unix_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stealth handler", func() {
+	const refusalDelay = 300 * time.Millisecond
+
+	// returns the status of the response to a request on urlPath and how long it took
+	serve := func(handler http.Handler, urlPath string) (int, time.Duration) {
+		recorder := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "https://localhost"+urlPath, nil))
+		return recorder.Code, time.Since(start)
+	}
+
+	// an authenticator taking authenticationTime to refuse the users
+	slowAuthenticator := func(authenticationTime time.Duration) http.Handler {
+		handler, err := NewStealthHandler(&StealthConfig{RefusalDelayMilliseconds: int(refusalDelay / time.Millisecond)}, map[string]http.HandlerFunc{
+			"/ssh3": func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(authenticationTime)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return handler
+	}
+
+	It("Refuses a slow authentication as late as an unknown path", func() {
+		handler := slowAuthenticator(200 * time.Millisecond)
+		status, wrongPathTime := serve(handler, "/wrong")
+		Expect(status).To(Equal(http.StatusNotFound))
+		status, refusalTime := serve(handler, "/ssh3")
+		Expect(status).To(Equal(http.StatusNotFound))
+
+		Expect(wrongPathTime).To(BeNumerically(">=", refusalDelay))
+		Expect(refusalTime).To(BeNumerically("~", wrongPathTime, 50*time.Millisecond))
+	})
+
+	It("Refuses the authentications outlasting the delay on its next multiple", func() {
+		_, refusalTime := serve(slowAuthenticator(400*time.Millisecond), "/ssh3")
+		Expect(refusalTime).To(BeNumerically(">=", 2*refusalDelay))
+		Expect(refusalTime).To(BeNumerically("<", 2*refusalDelay+50*time.Millisecond))
+	})
+})
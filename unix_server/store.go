@@ -0,0 +1,83 @@
+package unix_server
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/francoismichel/ssh3/store"
+)
+
+// The store keeps the state shared by the servers and outliving the conversations, such as the
+// break-glass tokens. By default, it is kept in memory and lost on restart.
+type StoreConfig struct {
+	// "memory" (the default), "file", "sqlite" or "redis"
+	Type string `json:"type"`
+	// the JSON file of the file store, or the data source name of the SQLite database
+	Path string `json:"path,omitempty"`
+	// the database/sql driver of the SQLite store, which must be linked in the server binary,
+	// "sqlite" by default
+	SQLDriver string `json:"sql_driver,omitempty"`
+	// the host:port of the Redis server
+	Address  string `json:"address,omitempty"`
+	Password string `json:"password,omitempty"`
+	Database int    `json:"database,omitempty"`
+	// prefixes the Redis keys, "ssh3:" by default
+	KeyPrefix string `json:"key_prefix,omitempty"`
+}
+
+func (c *StoreConfig) validate() error {
+	switch c.Type {
+	case "", "memory":
+	case "file":
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("the path of the file store must be absolute: %q", c.Path)
+		}
+	case "sqlite":
+		if c.Path == "" {
+			return fmt.Errorf("the SQLite store requires a path")
+		}
+	case "redis":
+		if c.Address == "" {
+			return fmt.Errorf("the Redis store requires an address")
+		}
+		if c.Database < 0 {
+			return fmt.Errorf("negative Redis database: %d", c.Database)
+		}
+	default:
+		return fmt.Errorf("unsupported store type %q, expected memory, file, sqlite or redis", c.Type)
+	}
+	return nil
+}
+
+// OpenStore opens the store configured by config, a memory store if config is nil
+func OpenStore(ctx context.Context, config *StoreConfig) (store.Store, error) {
+	if config == nil {
+		return store.NewMemory(), nil
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	switch config.Type {
+	case "file":
+		return store.OpenFile(config.Path)
+	case "sqlite":
+		driver := config.SQLDriver
+		if driver == "" {
+			driver = "sqlite"
+		}
+		return store.OpenSQL(driver, config.Path)
+	case "redis":
+		keyPrefix := config.KeyPrefix
+		if keyPrefix == "" {
+			keyPrefix = "ssh3:"
+		}
+		return store.DialRedis(ctx, store.RedisConfig{
+			Address:   config.Address,
+			Password:  config.Password,
+			Database:  config.Database,
+			KeyPrefix: keyPrefix,
+		})
+	}
+	return store.NewMemory(), nil
+}
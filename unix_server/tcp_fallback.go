@@ -0,0 +1,32 @@
+package unix_server
+
+import (
+	"fmt"
+	"net"
+)
+
+// TCPFallbackConfig lets the clients whose network blocks UDP reach the server over TCP, their
+// QUIC packets being tunneled in HTTP/2 requests to the URL paths of the server, see
+// ssh3.HTTP2TunnelServer
+type TCPFallbackConfig struct {
+	// the TCP address of the HTTP/2 server, the address of the SSH3 server by default so that
+	// the clients find it on the same port, e.g. 443
+	Bind string `json:"bind,omitempty"`
+}
+
+func (c *TCPFallbackConfig) validate() error {
+	if c.Bind != "" {
+		if _, _, err := net.SplitHostPort(c.Bind); err != nil {
+			return fmt.Errorf("invalid TCP fallback bind address %q: %w", c.Bind, err)
+		}
+	}
+	return nil
+}
+
+// BindAddr returns the TCP address of the HTTP/2 server given the address of the SSH3 server
+func (c *TCPFallbackConfig) BindAddr(ssh3BindAddr string) string {
+	if c.Bind != "" {
+		return c.Bind
+	}
+	return ssh3BindAddr
+}
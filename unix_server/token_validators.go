@@ -0,0 +1,287 @@
+package unix_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// the maximum duration of the validation of a token
+	tokenValidationTimeout = 10 * time.Second
+	// the maximum size of the claims returned by a validator
+	maxTokenClaimsSize = 1 << 20
+	// the maximum size of the errors printed by a validation command
+	maxTokenValidationErrorSize = 4096
+)
+
+// TokenValidator validates the bearer tokens issued by an identity provider that are not OpenID
+// Connect ID tokens, e.g. the opaque OAuth2 access tokens or the SAML assertions, and returns
+// their claims, which are authorized by the rules of the token identities of the users:
+//
+//	token <validator name> allow=username=alice,scope=ssh
+type TokenValidator interface {
+	// returns the claims of the token, or an error if it is not valid
+	ValidateToken(ctx context.Context, token string) (map[string]interface{}, error)
+}
+
+var (
+	tokenValidatorsMutex sync.Mutex
+	tokenValidators      = make(map[string]TokenValidator)
+)
+
+// RegisterTokenValidator makes the validator available to the token identities under name,
+// replacing any validator registered under the same name
+func RegisterTokenValidator(name string, validator TokenValidator) {
+	tokenValidatorsMutex.Lock()
+	defer tokenValidatorsMutex.Unlock()
+	tokenValidators[name] = validator
+}
+
+func getTokenValidator(name string) (TokenValidator, bool) {
+	tokenValidatorsMutex.Lock()
+	defer tokenValidatorsMutex.Unlock()
+	validator, ok := tokenValidators[name]
+	return validator, ok
+}
+
+// the built-in validators, exactly one of Introspection and Command is set
+type TokenValidatorConfig struct {
+	// the name referenced by the token identities
+	Name string `json:"name"`
+	// validates the OAuth2 tokens using the introspection endpoint of the authorization server
+	Introspection *IntrospectionConfig `json:"introspection,omitempty"`
+	// validates the tokens, e.g. SAML assertions, using an executable run as the server
+	Command *TokenValidationCommandConfig `json:"command,omitempty"`
+}
+
+// The OAuth2 tokens are validated by the introspection endpoint of the authorization server
+// (RFC 7662), and the claims of its response are those of the token. The scope claim is split
+// into the scopes it lists.
+type IntrospectionConfig struct {
+	Endpoint string `json:"endpoint"`
+	// the credentials of the server on the introspection endpoint, sent using basic authentication
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// if set, the tokens must have been issued for this audience, e.g. the URL of the server
+	Audience string `json:"audience,omitempty"`
+}
+
+// The token is written on the standard input of the executable, which exits with status 0 and
+// writes the claims of the token as a JSON object on its standard output if the token is valid.
+type TokenValidationCommandConfig struct {
+	Path string   `json:"path"`
+	Args []string `json:"args,omitempty"`
+}
+
+func validateTokenValidators(configs []TokenValidatorConfig) error {
+	names := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		if config.Name == "" || strings.ContainsAny(config.Name, " \t") {
+			return fmt.Errorf("invalid token validator name %q", config.Name)
+		}
+		if names[config.Name] {
+			return fmt.Errorf("duplicate token validator %s", config.Name)
+		}
+		names[config.Name] = true
+		if (config.Introspection == nil) == (config.Command == nil) {
+			return fmt.Errorf("the token validator %s must set exactly one of introspection and command", config.Name)
+		}
+		if introspection := config.Introspection; introspection != nil {
+			endpoint, err := url.Parse(introspection.Endpoint)
+			if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+				return fmt.Errorf("the introspection endpoint of the token validator %s must be an https URL: %q", config.Name, introspection.Endpoint)
+			}
+			if introspection.ClientID == "" {
+				return fmt.Errorf("the token validator %s has no client_id", config.Name)
+			}
+		}
+		if config.Command != nil && !filepath.IsAbs(config.Command.Path) {
+			return fmt.Errorf("the command of the token validator %s must be an absolute path: %q", config.Name, config.Command.Path)
+		}
+	}
+	return nil
+}
+
+// RegisterTokenValidators registers the built-in validators of the server config
+func RegisterTokenValidators(configs []TokenValidatorConfig) {
+	for _, config := range configs {
+		if config.Introspection != nil {
+			RegisterTokenValidator(config.Name, &introspectionValidator{config: *config.Introspection})
+		} else {
+			RegisterTokenValidator(config.Name, &commandValidator{config: *config.Command})
+		}
+	}
+}
+
+type introspectionValidator struct {
+	config IntrospectionConfig
+}
+
+func (v *introspectionValidator) ValidateToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, tokenValidationTimeout)
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(v.config.ClientID), url.QueryEscape(v.config.ClientSecret))
+	client := http.DefaultClient
+	if openIDConnectHTTPClient != nil {
+		client = openIDConnectHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected introspection status %s", resp.Status)
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenClaimsSize)).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, fmt.Errorf("inactive token")
+	}
+	// the authorization servers should not return expired tokens as active, but some cache their answers
+	if exp, ok := claims["exp"].(float64); ok && time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("expired token")
+	}
+	if v.config.Audience != "" && !slices.Contains(claimValues(claims["aud"]), v.config.Audience) {
+		return nil, fmt.Errorf("the token was not issued for the audience %s", v.config.Audience)
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		var scopes []interface{}
+		for _, s := range strings.Fields(scope) {
+			scopes = append(scopes, s)
+		}
+		claims["scope"] = scopes
+	}
+	return claims, nil
+}
+
+// keeps the first limit bytes written to it and discards the rest, so that a command cannot
+// exhaust the memory of the server
+type limitedBuffer struct {
+	// not embedded, so that io.Copy does not bypass the limit using its ReadFrom
+	buffer   bytes.Buffer
+	limit    int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	kept := p
+	if remaining := b.limit - b.buffer.Len(); len(p) > remaining {
+		kept, b.exceeded = p[:remaining], true
+	}
+	b.buffer.Write(kept)
+	// the command is not interrupted by a short write, it is refused once it exits
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buffer.Bytes()
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buffer.String()
+}
+
+type commandValidator struct {
+	config TokenValidationCommandConfig
+}
+
+func (v *commandValidator) ValidateToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, tokenValidationTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, v.config.Path, v.config.Args...)
+	cmd.Stdin = strings.NewReader(token)
+	stdout := &limitedBuffer{limit: maxTokenClaimsSize}
+	stderr := &limitedBuffer{limit: maxTokenValidationErrorSize}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", v.config.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.exceeded {
+		return nil, fmt.Errorf("%s: the claims exceed %d bytes", v.config.Path, maxTokenClaimsSize)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &claims); err != nil {
+		return nil, fmt.Errorf("%s: invalid claims: %w", v.config.Path, err)
+	}
+	return claims, nil
+}
+
+// TokenIdentity accepts the tokens validated by a TokenValidator whose claims are authorized by
+// its rules. As they are not bound to the conversation, the tokens should be issued for the
+// audience of the server only.
+type TokenIdentity struct {
+	validatorName string
+	rules         claimRules
+}
+
+func parseTokenIdentity(identityStr string) (*TokenIdentity, error) {
+	tokens := strings.Fields(identityStr)
+	if len(tokens) < 3 {
+		return nil, fmt.Errorf("bad identity format for token identity, expected a validator name and allow rules, identity: %s", identityStr)
+	}
+	identity := &TokenIdentity{validatorName: tokens[1]}
+	for _, token := range tokens[2:] {
+		if isRule, err := identity.rules.parse(token); err != nil {
+			return nil, err
+		} else if !isRule {
+			return nil, fmt.Errorf("bad identity format for token identity, unexpected token %q, identity: %s", token, identityStr)
+		}
+	}
+	if len(identity.rules.allow) == 0 {
+		return nil, fmt.Errorf("bad identity format for token identity, an allow rule is expected, identity: %s", identityStr)
+	}
+	return identity, nil
+}
+
+func (i *TokenIdentity) Verify(genericCandidate interface{}, base64ConversationID string) bool {
+	candidate, ok := genericCandidate.(util.JWTTokenString)
+	if !ok {
+		return false
+	}
+	validator, ok := getTokenValidator(i.validatorName)
+	if !ok {
+		log.Error().Msgf("unknown token validator %s", i.validatorName)
+		return false
+	}
+	claims, err := validator.ValidateToken(context.Background(), candidate.Token)
+	if err != nil {
+		log.Debug().Msgf("token not validated by %s: %s", i.validatorName, err)
+		return false
+	}
+	denied, allowed := i.rules.evaluate(claims)
+	if denied != nil {
+		log.Warn().Msgf("token validated by %s denied by the rule deny=%s", i.validatorName, denied)
+		return false
+	}
+	if !allowed {
+		// the other identities of the user may authorize the token
+		log.Debug().Msgf("the token of subject %v validated by %s is not authorized by the identity", claims["sub"], i.validatorName)
+	}
+	return allowed
+}
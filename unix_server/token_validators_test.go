@@ -0,0 +1,178 @@
+package unix_server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/francoismichel/ssh3/util"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// a validator returning fixed claims
+type stubTokenValidator map[string]interface{}
+
+func (v stubTokenValidator) ValidateToken(ctx context.Context, token string) (map[string]interface{}, error) {
+	if token != "valid" {
+		return nil, errors.New("invalid token")
+	}
+	return v, nil
+}
+
+var _ = Describe("Token validators", func() {
+	Context("Introspection", func() {
+		var claims map[string]interface{}
+		var validator *introspectionValidator
+
+		BeforeEach(func() {
+			claims = map[string]interface{}{"active": true, "sub": "alice", "aud": "https://ssh3.example.org", "scope": "openid ssh"}
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				clientID, clientSecret, _ := r.BasicAuth()
+				if clientID != "ssh3" || clientSecret != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				Expect(r.ParseForm()).To(Succeed())
+				if r.PostForm.Get("token") != "valid" {
+					json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+					return
+				}
+				json.NewEncoder(w).Encode(claims)
+			}))
+			DeferCleanup(server.Close)
+			previousClient := openIDConnectHTTPClient
+			openIDConnectHTTPClient = server.Client()
+			DeferCleanup(func() { openIDConnectHTTPClient = previousClient })
+			validator = &introspectionValidator{config: IntrospectionConfig{
+				Endpoint:     server.URL,
+				ClientID:     "ssh3",
+				ClientSecret: "secret",
+				Audience:     "https://ssh3.example.org",
+			}}
+		})
+
+		It("Returns the claims of the active tokens, their scope split", func() {
+			validated, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validated).To(HaveKeyWithValue("sub", "alice"))
+			Expect(validated).To(HaveKeyWithValue("scope", []interface{}{"openid", "ssh"}))
+		})
+
+		It("Refuses the inactive tokens", func() {
+			_, err := validator.ValidateToken(context.Background(), "revoked")
+			Expect(err).To(MatchError("inactive token"))
+		})
+
+		It("Refuses the expired tokens still reported as active", func() {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).To(MatchError("expired token"))
+		})
+
+		It("Refuses the tokens issued for another audience", func() {
+			claims["aud"] = []string{"https://other.example.org"}
+			_, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Fails if the server is refused by the endpoint", func() {
+			validator.config.ClientSecret = "wrong"
+			_, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).To(MatchError(ContainSubstring("unexpected introspection status")))
+		})
+	})
+
+	Context("Command", func() {
+		// returns a validator running the shell script
+		command := func(script string) *commandValidator {
+			path := filepath.Join(GinkgoT().TempDir(), "validate")
+			Expect(os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700)).To(Succeed())
+			return &commandValidator{config: TokenValidationCommandConfig{Path: path}}
+		}
+
+		It("Returns the claims printed by the command for the token of its input", func() {
+			validator := command(`test "$(cat)" = valid || exit 1; echo '{"sub": "alice", "groups": ["sre"]}'`)
+			claims, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(Equal(map[string]interface{}{"sub": "alice", "groups": []interface{}{"sre"}}))
+		})
+
+		It("Refuses the tokens when the command fails, with its errors", func() {
+			validator := command(`echo "signature mismatch" >&2; exit 1`)
+			_, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).To(MatchError(ContainSubstring("signature mismatch")))
+		})
+
+		It("Refuses the invalid claims", func() {
+			_, err := command(`echo '["sub"]'`).ValidateToken(context.Background(), "valid")
+			Expect(err).To(MatchError(ContainSubstring("invalid claims")))
+		})
+
+		It("Does not keep the claims exceeding the maximum size", func() {
+			validator := command(fmt.Sprintf(`head -c %d /dev/zero`, 4*maxTokenClaimsSize))
+			_, err := validator.ValidateToken(context.Background(), "valid")
+			Expect(err).To(MatchError(ContainSubstring("the claims exceed")))
+		})
+	})
+
+	Context("Identities", func() {
+		BeforeEach(func() {
+			RegisterTokenValidator("stub", stubTokenValidator{"sub": "alice", "groups": []interface{}{"sre", "dev"}, "scope": []interface{}{"ssh"}})
+		})
+
+		It("Parses the token identities", func() {
+			identity, err := ParseIdentity(nil, "token stub allow=groups=sre,scope=ssh deny=groups=contractors")
+			Expect(err).ToNot(HaveOccurred())
+			tokenIdentity, ok := identity.(*TokenIdentity)
+			Expect(ok).To(BeTrue())
+			Expect(tokenIdentity.validatorName).To(Equal("stub"))
+			Expect(tokenIdentity.rules.allow).To(HaveLen(1))
+			Expect(tokenIdentity.rules.deny).To(HaveLen(1))
+		})
+
+		It("Refuses the malformed token identities", func() {
+			for _, identityStr := range []string{
+				"token stub",
+				"token stub alice@example.org",
+				"token stub deny=groups=contractors",
+				"token stub allow=groups",
+				"token stub allow=groups=[",
+			} {
+				_, err := ParseIdentity(nil, identityStr)
+				Expect(err).To(HaveOccurred(), identityStr)
+			}
+		})
+
+		It("Verifies the tokens validated by the validator and authorized by the rules", func() {
+			for _, testCase := range []struct {
+				identity string
+				token    string
+				verified bool
+			}{
+				{"token stub allow=groups=sre", "valid", true},
+				{"token stub allow=groups=sre", "forged", false},
+				{"token stub allow=groups=ops", "valid", false},
+				{"token stub allow=groups=sre deny=groups=dev", "valid", false},
+				{"token unknown allow=groups=sre", "valid", false},
+			} {
+				identity, err := ParseIdentity(nil, testCase.identity)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(identity.Verify(util.JWTTokenString{Token: testCase.token}, "")).To(Equal(testCase.verified), "%s with token %s", testCase.identity, testCase.token)
+			}
+		})
+
+		It("Only verifies the bearer tokens", func() {
+			identity, err := ParseIdentity(nil, "token stub allow=groups=sre")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(identity.Verify("valid", "")).To(BeFalse())
+		})
+	})
+})
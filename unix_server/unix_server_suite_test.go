@@ -0,0 +1,13 @@
+package unix_server
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestUnixServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Unix Server Suite")
+}
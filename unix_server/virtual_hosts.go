@@ -0,0 +1,253 @@
+package unix_server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// VirtualHostConfig is a logical SSH3 endpoint hosted by the server, e.g. for a tenant of a hosting
+// provider, reached using one of its TLS server names (SNI) or its URL path
+type VirtualHostConfig struct {
+	// identifies the virtual host in the logs
+	Name string `json:"name"`
+	// the server names requested by the clients of the virtual host, "*.example.org" matching the
+	// names of a single label under example.org. Any name matches if empty.
+	ServerNames []string `json:"server_names,omitempty"`
+	// the URL path of the virtual host, the one of the server (-url-path) if not set
+	URLPath string `json:"url_path,omitempty"`
+	// the PEM files of the certificate presented to the clients requesting one of the server names
+	// and of its private key, the certificate of the server being presented if not set
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// if set, the users of the virtual host are the local accounts whose name starts with this
+	// prefix: user alice of the virtual host logs in as the local user <prefix>alice, and cannot
+	// log in as the other local users
+	UserPrefix string `json:"user_prefix,omitempty"`
+	// whether the users can log in using their password, as on the rest of the server if not set
+	PasswordLogin *bool `json:"password_login,omitempty"`
+	// if set, the pre-authorization tokens of the virtual host, accepted instead of the ones of the
+	// server. The usernames of the config are the local ones, including the prefix.
+	Preauth *PreauthConfig `json:"preauth,omitempty"`
+	// the first entry matching the username (without the prefix) applies, before the resource
+	// limits of the server. Only allowed along with a user prefix.
+	ResourceLimits []ResourceLimitsConfig `json:"resource_limits,omitempty"`
+}
+
+func (c *VirtualHostConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("a virtual host has no name")
+	}
+	for _, serverName := range c.ServerNames {
+		if serverName == "" || strings.Contains(strings.TrimPrefix(serverName, "*."), "*") {
+			return fmt.Errorf("invalid server name %q of virtual host %s", serverName, c.Name)
+		}
+	}
+	if c.URLPath != "" && !strings.HasPrefix(c.URLPath, "/") {
+		return fmt.Errorf("the URL path of virtual host %s must start with a /: %q", c.Name, c.URLPath)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("virtual host %s must set both its certificate and its private key", c.Name)
+	}
+	if c.CertFile != "" {
+		if len(c.ServerNames) == 0 {
+			return fmt.Errorf("virtual host %s has a certificate but no server name to present it to", c.Name)
+		}
+		if !filepath.IsAbs(c.CertFile) || !filepath.IsAbs(c.KeyFile) {
+			return fmt.Errorf("the certificate and private key of virtual host %s must be absolute paths", c.Name)
+		}
+	}
+	if c.Preauth != nil {
+		if err := c.Preauth.validate(); err != nil {
+			return fmt.Errorf("virtual host %s: %w", c.Name, err)
+		}
+	}
+	if len(c.ResourceLimits) > 0 && c.UserPrefix == "" {
+		return fmt.Errorf("the resource limits of virtual host %s need a user prefix to tell its users apart", c.Name)
+	}
+	if err := validateResourceLimits(c.ResourceLimits); err != nil {
+		return fmt.Errorf("virtual host %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+func validateVirtualHosts(hosts []VirtualHostConfig) error {
+	names := make(map[string]bool, len(hosts))
+	for i := range hosts {
+		if err := hosts[i].validate(); err != nil {
+			return err
+		}
+		if names[hosts[i].Name] {
+			return fmt.Errorf("duplicate virtual host %s", hosts[i].Name)
+		}
+		names[hosts[i].Name] = true
+	}
+	return nil
+}
+
+// MatchesServerName returns true if the clients requesting serverName reach the virtual host
+func (c *VirtualHostConfig) MatchesServerName(serverName string) bool {
+	if len(c.ServerNames) == 0 {
+		return true
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for _, pattern := range c.ServerNames {
+		pattern = strings.ToLower(pattern)
+		if domain, isWildcard := strings.CutPrefix(pattern, "*."); isWildcard {
+			if label, ok := strings.CutSuffix(serverName, "."+domain); ok && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		} else if serverName == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the URL path of the virtual host, defaultPath being the one of the server
+func (c *VirtualHostConfig) Path(defaultPath string) string {
+	if c.URLPath == "" {
+		return defaultPath
+	}
+	return c.URLPath
+}
+
+func (c *VirtualHostConfig) PasswordLoginEnabled(serverPasswordLogin bool) bool {
+	if c.PasswordLogin == nil {
+		return serverPasswordLogin
+	}
+	return *c.PasswordLogin
+}
+
+// UsernameCanonicalizer maps the usernames of the virtual host onto the local accounts, after
+// canonicalizing them as on the rest of the server
+func (c *VirtualHostConfig) UsernameCanonicalizer(canonicalize UsernameCanonicalizer) UsernameCanonicalizer {
+	if c.UserPrefix == "" {
+		return canonicalize
+	}
+	return func(requestedUsername string) (string, error) {
+		username, err := canonicalize(requestedUsername)
+		if err != nil {
+			return "", err
+		}
+		return c.UserPrefix + username, nil
+	}
+}
+
+// HasUser returns true if the local user belongs to the virtual host
+func (c *VirtualHostConfig) HasUser(localUsername string) bool {
+	return strings.HasPrefix(localUsername, c.UserPrefix)
+}
+
+// VirtualHostResourceLimits returns the first resource limits of the virtual host of the local
+// user matching its name without the prefix, if any
+func VirtualHostResourceLimits(hosts []VirtualHostConfig, localUsername string) (ResourceLimitsConfig, bool) {
+	for i := range hosts {
+		if hosts[i].UserPrefix == "" || !hosts[i].HasUser(localUsername) {
+			continue
+		}
+		if config, ok := ResourceLimits(hosts[i].ResourceLimits, strings.TrimPrefix(localUsername, hosts[i].UserPrefix)); ok {
+			return config, true
+		}
+	}
+	return ResourceLimitsConfig{}, false
+}
+
+// LoadVirtualHostCertificates loads the certificates of the virtual hosts setting one, indexed by
+// the name of the virtual host
+func LoadVirtualHostCertificates(hosts []VirtualHostConfig) (map[string]tls.Certificate, error) {
+	certificates := make(map[string]tls.Certificate)
+	for _, host := range hosts {
+		if host.CertFile == "" {
+			continue
+		}
+		certificate, err := tls.LoadX509KeyPair(host.CertFile, host.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the certificate of virtual host %s: %w", host.Name, err)
+		}
+		certificates[host.Name] = certificate
+	}
+	return certificates, nil
+}
+
+// ApplyVirtualHostCertificates makes tlsConf present the certificates of the virtual hosts to the
+// clients requesting their server names, the other clients getting the certificate of tlsConf
+func ApplyVirtualHostCertificates(tlsConf *tls.Config, hosts []VirtualHostConfig, certificates map[string]tls.Certificate) {
+	if len(certificates) == 0 {
+		return
+	}
+	getCertificate := tlsConf.GetCertificate
+	if getCertificate == nil {
+		certificate := tlsConf.Certificates[0]
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &certificate, nil
+		}
+	}
+	tlsConf.Certificates = nil
+	tlsConf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for i := range hosts {
+			if certificate, ok := certificates[hosts[i].Name]; ok && hosts[i].MatchesServerName(hello.ServerName) {
+				return &certificate, nil
+			}
+		}
+		return getCertificate(hello)
+	}
+}
+
+type virtualHostRoute struct {
+	// nil for the default host
+	host    *VirtualHostConfig
+	path    string
+	handler http.HandlerFunc
+}
+
+// VirtualHostRouter dispatches the requests to the first virtual host matching their path and the
+// server name requested during the TLS handshake, then to the default host
+type VirtualHostRouter struct {
+	routes []virtualHostRoute
+}
+
+// Handle routes the requests for host on path to handler, host being nil for the default host,
+// which must be added last
+func (r *VirtualHostRouter) Handle(host *VirtualHostConfig, path string, handler http.HandlerFunc) {
+	r.routes = append(r.routes, virtualHostRoute{host: host, path: path, handler: handler})
+}
+
+// Paths returns the paths of the routes, without duplicates
+func (r *VirtualHostRouter) Paths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, route := range r.routes {
+		if !seen[route.path] {
+			seen[route.path] = true
+			paths = append(paths, route.path)
+		}
+	}
+	return paths
+}
+
+func (r *VirtualHostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serverName := ""
+	if req.TLS != nil {
+		serverName = req.TLS.ServerName
+	}
+	for _, route := range r.routes {
+		if route.path != req.URL.Path {
+			continue
+		}
+		if route.host == nil {
+			route.handler(w, req)
+			return
+		}
+		if route.host.MatchesServerName(serverName) {
+			log.Debug().Msgf("routing the request for %s%s from %s to virtual host %s", serverName, req.URL.Path, req.RemoteAddr, route.host.Name)
+			route.handler(w, req)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
@@ -0,0 +1,105 @@
+package ssh3
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+)
+
+// the features of the built-in channel types, as named in the feature reports
+var channelTypeFeatures = map[string]string{
+	"direct-udp":       "udp_forwarding",
+	"direct-tcp":       "tcp_forwarding",
+	"agent-connection": "agent_forwarding",
+}
+
+var featureDescriptions = map[string]string{
+	"udp_forwarding":           "UDP forwarding",
+	"tcp_forwarding":           "TCP forwarding",
+	"agent_forwarding":         "agent forwarding",
+	"remote_working_directory": "remote working directory",
+	"break":                    "break",
+	"x11_forwarding":           "X11 forwarding",
+	"datagram_typing":          "datagram typing",
+	"compression":              "compression",
+	"channel_eof":              "channel EOF",
+	"session_persistence":      "session persistence",
+	"multiple_sessions":        "multiple sessions",
+	"request_replies":          "request replies",
+}
+
+// UnsupportedFeature refuses a channel using a feature that the peer does not implement or that
+// its configuration disables. It is sent as a channel open failure with the
+// SSH3_OPEN_UNSUPPORTED_FEATURE reason code, so that the peer can tell the user what is missing.
+type UnsupportedFeature struct {
+	// the name of the feature in the feature reports, e.g. "udp_forwarding"
+	Feature string
+	// the first version implementing the feature, empty if the peer implements it but does not
+	// enable it
+	MinVersion string
+}
+
+func (e UnsupportedFeature) Error() string {
+	description, ok := featureDescriptions[e.Feature]
+	if !ok {
+		description = e.Feature
+	}
+	if e.MinVersion != "" {
+		return fmt.Sprintf("%s is not supported, it requires version %s or later", description, e.MinVersion)
+	}
+	return fmt.Sprintf("%s is not supported", description)
+}
+
+// ChannelOpenFailure returns the failure refusing a channel because of the missing feature
+func (e UnsupportedFeature) ChannelOpenFailure() *ChannelOpenFailure {
+	errorMessage := "unsupported feature: " + e.Feature
+	if e.MinVersion != "" {
+		errorMessage += "; min version: " + e.MinVersion
+	}
+	return &ChannelOpenFailure{ReasonCode: ssh3Messages.SSH3_OPEN_UNSUPPORTED_FEATURE, ErrorMsg: errorMessage}
+}
+
+var unsupportedFeatureRegexp = regexp.MustCompile(`^unsupported feature: ([^;]+)(?:; min version: (.+))?$`)
+
+// AsUnsupportedFeature returns the feature missing on the peer if err is a ChannelOpenFailure
+// built by UnsupportedFeature.ChannelOpenFailure or an UnsupportedFeature
+func AsUnsupportedFeature(err error) (UnsupportedFeature, bool) {
+	var unsupported UnsupportedFeature
+	if errors.As(err, &unsupported) {
+		return unsupported, true
+	}
+	var failure ChannelOpenFailure
+	if !errors.As(err, &failure) || failure.ReasonCode != ssh3Messages.SSH3_OPEN_UNSUPPORTED_FEATURE {
+		return UnsupportedFeature{}, false
+	}
+	match := unsupportedFeatureRegexp.FindStringSubmatch(failure.ErrorMsg)
+	if match == nil {
+		return UnsupportedFeature{Feature: failure.ErrorMsg}, true
+	}
+	return UnsupportedFeature{Feature: match[1], MinVersion: match[2]}, true
+}
+
+// UnsupportedChannelType returns the failure refusing a channel of a type that the peer does not
+// accept: an UnsupportedFeature for the built-in types and an unknown channel type otherwise
+func UnsupportedChannelType(channelType string) *ChannelOpenFailure {
+	if feature, ok := channelTypeFeatures[channelType]; ok {
+		return UnsupportedFeature{Feature: feature}.ChannelOpenFailure()
+	}
+	return &ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_UNKNOWN_CHANNEL_TYPE,
+		ErrorMsg: fmt.Sprintf("unsupported channel type %s", channelType)}
+}
+
+// CheckPeerChannelType returns an UnsupportedFeature, or an error for the extension types, if
+// the peer advertised the channel types it accepts without channelType. It returns nil if the
+// peer did not advertise them, the channel then being refused when opened if unsupported.
+func (c *Conversation) CheckPeerChannelType(channelType string) error {
+	return c.peerExtInfo.CheckChannelType(channelType)
+}
+
+// CheckPeerRequestType returns an UnsupportedFeature if the peer advertised the request types it
+// parses without requestType
+func (c *Conversation) CheckPeerRequestType(requestType string) error {
+	return c.peerExtInfo.CheckRequestType(requestType)
+}
@@ -0,0 +1,43 @@
+package ssh3_test
+
+import (
+	"fmt"
+
+	"github.com/francoismichel/ssh3"
+	ssh3Messages "github.com/francoismichel/ssh3/message"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unsupported features", func() {
+	It("Are carried by the channel open failures", func() {
+		failure := ssh3.UnsupportedFeature{Feature: "udp_forwarding", MinVersion: "0.2.0"}.ChannelOpenFailure()
+		Expect(failure.ReasonCode).To(BeEquivalentTo(ssh3Messages.SSH3_OPEN_UNSUPPORTED_FEATURE))
+		// as returned by NextMessage
+		var err error = fmt.Errorf("could not forward: %w", *failure)
+		unsupported, ok := ssh3.AsUnsupportedFeature(err)
+		Expect(ok).To(BeTrue())
+		Expect(unsupported).To(Equal(ssh3.UnsupportedFeature{Feature: "udp_forwarding", MinVersion: "0.2.0"}))
+		Expect(unsupported.Error()).To(Equal("UDP forwarding is not supported, it requires version 0.2.0 or later"))
+
+		unsupported, ok = ssh3.AsUnsupportedFeature(*ssh3.UnsupportedFeature{Feature: "tcp_forwarding"}.ChannelOpenFailure())
+		Expect(ok).To(BeTrue())
+		Expect(unsupported).To(Equal(ssh3.UnsupportedFeature{Feature: "tcp_forwarding"}))
+		Expect(unsupported.Error()).To(Equal("TCP forwarding is not supported"))
+	})
+
+	It("Are not mistaken for other failures", func() {
+		_, ok := ssh3.AsUnsupportedFeature(ssh3.ChannelOpenFailure{ReasonCode: ssh3Messages.SSH_OPEN_CONNECT_FAILED, ErrorMsg: "unsupported feature: x"})
+		Expect(ok).To(BeFalse())
+		_, ok = ssh3.AsUnsupportedFeature(fmt.Errorf("unsupported feature: x"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Refuse the built-in channel types", func() {
+		unsupported, ok := ssh3.AsUnsupportedFeature(*ssh3.UnsupportedChannelType("direct-udp"))
+		Expect(ok).To(BeTrue())
+		Expect(unsupported.Feature).To(Equal("udp_forwarding"))
+		Expect(ssh3.UnsupportedChannelType("tunnel@example.com").ReasonCode).To(BeEquivalentTo(ssh3Messages.SSH_OPEN_UNKNOWN_CHANNEL_TYPE))
+	})
+})
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// the suffix of the copies of the previous content of the files replaced by UpdateFile and
+// ReplaceFiles, so that an unwanted edit of an access-control file can be reverted by hand
+const BackupSuffix = ".bak"
+
+// the suffix of the files locked by LockFile. They are never removed: another process may be
+// waiting for the lock of the removed file while a third one creates and locks a new one.
+const lockSuffix = ".lock"
+
+// replaced by the tests to make the writes fail
+var rename = os.Rename
+
+// LockFile takes an exclusive lock on filename, waiting for the other processes editing it to
+// release theirs. The lock is advisory: it only excludes the writers taking it as well.
+func LockFile(filename string) (unlock func(), err error) {
+	lockFile, err := os.OpenFile(filename+lockSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockExclusive(lockFile); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("could not lock %s: %w", filename, err)
+	}
+	// closing the file releases the lock
+	return func() { lockFile.Close() }, nil
+}
+
+// WriteFileAtomic replaces the content of filename by data. The data is written in a temporary
+// file renamed over filename, so that the readers and a crash see either the previous or the new
+// content, never a truncated file.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// UpdateFile locks filename and replaces its content by the one returned by update, which gets
+// the current content (nil if the file does not exist yet). The current content is kept in a
+// copy with the BackupSuffix. If update returns an error, the file is left untouched.
+func UpdateFile(filename string, perm os.FileMode, update func(content []byte) ([]byte, error)) error {
+	unlock, err := LockFile(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	content, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	updated, err := update(content)
+	if err != nil {
+		return err
+	}
+	if content != nil {
+		if err := WriteFileAtomic(filename+BackupSuffix, content, perm); err != nil {
+			return fmt.Errorf("could not back up %s: %w", filename, err)
+		}
+	}
+	return WriteFileAtomic(filename, updated, perm)
+}
+
+// A FileReplacement is the new content of a file replaced by ReplaceFiles
+type FileReplacement struct {
+	Path string
+	Data []byte
+	Perm os.FileMode
+}
+
+// ReplaceFiles replaces several files that must stay consistent with each other, e.g. a
+// certificate and its private key. The files are locked and backed up as with UpdateFile and
+// replaced one by one: if a file cannot be replaced, the files already replaced are rolled back
+// to their previous content.
+func ReplaceFiles(replacements ...FileReplacement) (err error) {
+	// locking in a consistent order, so that two concurrent replacements cannot deadlock
+	sorted := append([]FileReplacement(nil), replacements...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	for _, replacement := range sorted {
+		unlock, err := LockFile(replacement.Path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	previous := make([][]byte, len(replacements))
+	for i, replacement := range replacements {
+		previous[i], err = os.ReadFile(replacement.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if previous[i] != nil {
+			if err := WriteFileAtomic(replacement.Path+BackupSuffix, previous[i], replacement.Perm); err != nil {
+				return fmt.Errorf("could not back up %s: %w", replacement.Path, err)
+			}
+		}
+	}
+	for i, replacement := range replacements {
+		if err := WriteFileAtomic(replacement.Path, replacement.Data, replacement.Perm); err != nil {
+			return errors.Join(err, rollBack(replacements[:i], previous[:i]))
+		}
+	}
+	return nil
+}
+
+// restores the previous content of the replaced files, removing the ones that did not exist
+func rollBack(replaced []FileReplacement, previous [][]byte) error {
+	var errs []error
+	for i, replacement := range replaced {
+		var err error
+		if previous[i] == nil {
+			err = os.Remove(replacement.Path)
+		} else {
+			err = WriteFileAtomic(replacement.Path, previous[i], replacement.Perm)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not roll back %s: %w", replacement.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Atomic file writes", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("Replaces the file with the requested permissions and leaves no temporary file", func() {
+		filename := filepath.Join(dir, "authorized_identities")
+		Expect(os.WriteFile(filename, []byte("previous\n"), 0644)).To(Succeed())
+		Expect(WriteFileAtomic(filename, []byte("new\n"), 0600)).To(Succeed())
+		Expect(os.ReadFile(filename)).To(Equal([]byte("new\n")))
+		info, err := os.Stat(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("Backs up the previous content and leaves the file untouched on error", func() {
+		filename := filepath.Join(dir, "known_hosts")
+		Expect(UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+			Expect(content).To(BeNil())
+			return []byte("first\n"), nil
+		})).To(Succeed())
+		Expect(filename + BackupSuffix).ToNot(BeAnExistingFile())
+
+		Expect(UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+			return append(content, "second\n"...), nil
+		})).To(Succeed())
+		Expect(os.ReadFile(filename)).To(Equal([]byte("first\nsecond\n")))
+		Expect(os.ReadFile(filename + BackupSuffix)).To(Equal([]byte("first\n")))
+
+		updateErr := errors.New("invalid edit")
+		Expect(UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+			return nil, updateErr
+		})).To(MatchError(updateErr))
+		Expect(os.ReadFile(filename)).To(Equal([]byte("first\nsecond\n")))
+	})
+
+	It("Serializes the concurrent updates", func() {
+		filename := filepath.Join(dir, "known_hosts")
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				Expect(UpdateFile(filename, 0600, func(content []byte) ([]byte, error) {
+					return append(content, fmt.Sprintf("host%d\n", i)...), nil
+				})).To(Succeed())
+			}(i)
+		}
+		wg.Wait()
+		content, err := os.ReadFile(filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Split(strings.TrimSpace(string(content)), "\n")).To(HaveLen(20))
+	})
+
+	It("Rolls back the replaced files if one of them cannot be written", func() {
+		certPath := filepath.Join(dir, "cert.pem")
+		keyPath := filepath.Join(dir, "priv.key")
+		Expect(os.WriteFile(certPath, []byte("previous cert"), 0644)).To(Succeed())
+		Expect(os.WriteFile(keyPath, []byte("previous key"), 0600)).To(Succeed())
+		chainPath := filepath.Join(dir, "chain.pem")
+		renameErr := errors.New("disk full")
+		rename = func(oldpath string, newpath string) error {
+			if newpath == chainPath {
+				return renameErr
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		DeferCleanup(func() { rename = os.Rename })
+		Expect(ReplaceFiles(
+			FileReplacement{Path: certPath, Data: []byte("new cert"), Perm: 0644},
+			FileReplacement{Path: keyPath, Data: []byte("new key"), Perm: 0600},
+			FileReplacement{Path: chainPath, Data: []byte("new chain"), Perm: 0644},
+		)).To(MatchError(renameErr))
+		Expect(os.ReadFile(certPath)).To(Equal([]byte("previous cert")))
+		Expect(os.ReadFile(keyPath)).To(Equal([]byte("previous key")))
+		Expect(chainPath).ToNot(BeAnExistingFile())
+
+		Expect(ReplaceFiles(
+			FileReplacement{Path: certPath, Data: []byte("new cert"), Perm: 0644},
+			FileReplacement{Path: keyPath, Data: []byte("new key"), Perm: 0600},
+		)).To(Succeed())
+		Expect(os.ReadFile(certPath)).To(Equal([]byte("new cert")))
+		Expect(os.ReadFile(keyPath)).To(Equal([]byte("new key")))
+	})
+})
@@ -0,0 +1,28 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lockExclusive(file *os.File) error {
+	for {
+		err := unix.Flock(int(file.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// makes the renaming of a file in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,16 @@
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockExclusive(file *os.File) error {
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+// the directories cannot be opened, hence synced, on Windows
+func syncDir(dir string) error {
+	return nil
+}
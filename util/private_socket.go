@@ -0,0 +1,10 @@
+package util
+
+import "net"
+
+// ListenPrivateSocket listens on a UNIX socket only accessible by the user running the process.
+// The socket is created with these permissions rather than restricted once listening, so that
+// no other user can connect to it in between.
+func ListenPrivateSocket(socketPath string) (net.Listener, error) {
+	return listenPrivateSocket(socketPath)
+}
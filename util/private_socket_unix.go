@@ -0,0 +1,22 @@
+//go:build unix
+
+package util
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// the umask is shared by the whole process: the files created by the other goroutines while a
+// socket is created are only more restricted than requested
+var umaskLock sync.Mutex
+
+func listenPrivateSocket(socketPath string) (net.Listener, error) {
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	previous := unix.Umask(0077)
+	defer unix.Umask(previous)
+	return net.Listen("unix", socketPath)
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Private sockets", func() {
+	It("Creates the socket only accessible by the user whatever the umask", func() {
+		previous := unix.Umask(0)
+		defer unix.Umask(previous)
+		socketPath := filepath.Join(GinkgoT().TempDir(), "admin.sock")
+		listener, err := ListenPrivateSocket(socketPath)
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		info, err := os.Stat(socketPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Type()).To(Equal(os.ModeSocket))
+		Expect(info.Mode().Perm() & 0077).To(BeZero())
+		// the umask of the process is restored
+		Expect(unix.Umask(0)).To(Equal(0))
+	})
+})
@@ -0,0 +1,8 @@
+package util
+
+import "net"
+
+// the sockets get the permissions inherited from their directory on Windows
+func listenPrivateSocket(socketPath string) (net.Listener, error) {
+	return net.Listen("unix", socketPath)
+}
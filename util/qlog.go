@@ -0,0 +1,56 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/rs/zerolog/log"
+)
+
+type bufferedWriteCloser struct {
+	*bufio.Writer
+	io.Closer
+}
+
+// NewBufferedWriteCloser buffers the writes to w, flushing them before closing it
+func NewBufferedWriteCloser(w io.WriteCloser) io.WriteCloser {
+	return &bufferedWriteCloser{Writer: bufio.NewWriter(w), Closer: w}
+}
+
+func (w *bufferedWriteCloser) Close() error {
+	if err := w.Writer.Flush(); err != nil {
+		w.Closer.Close()
+		return err
+	}
+	return w.Closer.Close()
+}
+
+func PerspectiveString(p logging.Perspective) string {
+	if p == logging.PerspectiveClient {
+		return "client"
+	}
+	return "server"
+}
+
+// QlogTracer returns a quic.Config Tracer writing the qlog trace of every QUIC connection
+// in qlogDir, in a file named after the original destination connection ID and the perspective.
+// The traces can be analyzed using qvis (https://qvis.quictools.info).
+func QlogTracer(qlogDir string) func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+	return func(ctx context.Context, p logging.Perspective, odcid quic.ConnectionID) logging.ConnectionTracer {
+		filename := filepath.Join(qlogDir, fmt.Sprintf("%s_%s.qlog", odcid, PerspectiveString(p)))
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Error().Msgf("could not create qlog file %s: %s", filename, err)
+			return nil
+		}
+		log.Debug().Msgf("writing qlog of connection %s in %s", odcid, filename)
+		return qlog.NewConnectionTracer(NewBufferedWriteCloser(file), p, odcid)
+	}
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConfigureTracing sets up the global OpenTelemetry tracer provider.
+// Traces are exported using OTLP over HTTP if OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set (the exporter is then configured through the
+// standard OTEL_* environment variables), or written as JSON in tracesFile if not empty.
+// Otherwise, tracing stays disabled.
+// The returned function flushes the pending spans and must be called before exiting.
+func ConfigureTracing(ctx context.Context, serviceName string, tracesFile string) (shutdown func(context.Context) error, err error) {
+	// propagate the trace context even if we do not export our own spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		exporter, err = otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else if tracesFile != "" {
+		file, err := os.OpenFile(tracesFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// TraceContextEnv returns the trace context of ctx as environment variables
+// (TRACEPARENT, TRACESTATE) so that it can be propagated to child processes
+func TraceContextEnv(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	var env []string
+	if traceparent := carrier.Get("traceparent"); traceparent != "" {
+		env = append(env, "TRACEPARENT="+traceparent)
+	}
+	if tracestate := carrier.Get("tracestate"); tracestate != "" {
+		env = append(env, "TRACESTATE="+tracestate)
+	}
+	return env
+}
+
+// SetSpanError records err in span and marks the span as failed, if err is not nil
+func SetSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -3,11 +3,15 @@ package util
 import (
 	"bytes"
 	"fmt"
+	"time"
 )
 
 // a JWT bearer token, encoded following the JWT specification
 type JWTTokenString struct {
 	Token string
+	// the username requested by the client, if it differs from the local username
+	// the token must have been issued for it
+	RequestedUsername string
 }
 
 type SSHForwardingProtocol = uint64
@@ -49,12 +53,74 @@ func (e InvalidSSHString) Error() string {
 	return fmt.Sprintf("Invalid SSH string: %s", e.Reason)
 }
 
+func (e InvalidSSHString) Unwrap() error {
+	return e.Reason
+}
+
+// SSHStringTooLong is returned when the length announced by an SSH string exceeds the maximum
+// length of the field, before reading its content
+type SSHStringTooLong struct {
+	Length    uint64
+	MaxLength uint64
+}
+
+func (e SSHStringTooLong) Error() string {
+	return fmt.Sprintf("SSH string of %d bytes exceeds the maximum length of %d bytes", e.Length, e.MaxLength)
+}
+
 type Unauthorized struct{}
 
 func (e Unauthorized) Error() string {
 	return "Unauthorized"
 }
 
+// returned when the server accepted the first authentication factor and requires the user to
+// answer the prompt, e.g. with a one-time password
+type KeyboardInteractiveRequired struct {
+	Prompt string
+}
+
+func (e KeyboardInteractiveRequired) Error() string {
+	return fmt.Sprintf("Keyboard-interactive authentication required: %s", e.Prompt)
+}
+
+// returned when the user authenticated but is not allowed to start conversations
+type Forbidden struct{}
+
+func (e Forbidden) Error() string {
+	return "Forbidden"
+}
+
+// returned when the URL path is not the one of the server, or when a hidden server refuses the
+// request without telling why
+type NotFound struct{}
+
+func (e NotFound) Error() string {
+	return "Not found"
+}
+
+// returned when the server refuses new conversations, e.g. during a maintenance window
+type ServiceUnavailable struct {
+	Message string
+}
+
+func (e ServiceUnavailable) Error() string {
+	return fmt.Sprintf("Service unavailable: %s", e.Message)
+}
+
+// returned when the server refuses the attempts of the client after too many authentication
+// failures, RetryAfter being zero if the server did not tell when to try again
+type TooManyRequests struct {
+	RetryAfter time.Duration
+}
+
+func (e TooManyRequests) Error() string {
+	if e.RetryAfter == 0 {
+		return "Too many requests"
+	}
+	return fmt.Sprintf("Too many requests, retry after %s", e.RetryAfter)
+}
+
 type BytesReadCloser struct {
 	*bytes.Reader
 }
@@ -3,13 +3,19 @@ package unix_util
 import (
 	"fmt"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
 )
 
 func NewUnixSocketPath() (string, error) {
-	dir, err := os.MkdirTemp("/tmp/", "")
+	tempDir := "/tmp/"
+	if runtime.GOOS == "windows" {
+		// UNIX sockets are supported since Windows 10
+		tempDir = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(tempDir, "")
 	if err != nil {
 		return "", err
 	}
-	return path.Join(dir, fmt.Sprintf("agent.%d", os.Getpid())), nil
+	return filepath.Join(dir, fmt.Sprintf("agent.%d", os.Getpid())), nil
 }
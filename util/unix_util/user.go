@@ -1,11 +1,10 @@
 package unix_util
 
 import (
-	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
-	"syscall"
 )
 
 type User struct {
@@ -14,27 +13,28 @@ type User struct {
 	Gid      uint64
 	Dir      string
 	Shell    string
+	// the security identifier of the user on Windows, where Uid and Gid are not set
+	Sid string
 }
 
+// Windows accounts have no login shell, so every user runs the same shell: either "cmd" (the
+// default), "powershell" or the path of an executable. Set by the server from its config.
+var WindowsShell = "cmd"
+
 func GetUser(username string) (*User, error) {
 	return getUser(username)
 }
 
-func (u *User) CreateCommand(addEnv string, stdout, stderr io.Writer, stdin io.Reader, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
-	cmd := exec.Command(command, args...)
-	cmd.Env = append(cmd.Env, addEnv)
-	cmd.Dir = u.Dir
-
-	if loginShell {
-		// from man bash: A  login shell is one whose first character of argument zero is a -, or
-		// 				  one started with the --login option.
-		// We chose to start it with a preprended "-"
-		cmd.Args[0] = fmt.Sprintf("-%s", filepath.Base(cmd.Args[0]))
+// ChrootWorkingDir returns the working directory of the user once chrooted in chrootDirectory
+func (u *User) ChrootWorkingDir(chrootDirectory string) string {
+	if info, err := os.Stat(filepath.Join(chrootDirectory, u.Dir)); err == nil && info.IsDir() {
+		return u.Dir
 	}
+	return "/"
+}
 
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.Uid), Gid: uint32(u.Gid)}
-
+// sets the standard streams of cmd, returning pipes for the ones that are nil
+func attachCommandIO(cmd *exec.Cmd, stdout, stderr io.Writer, stdin io.Reader) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
 	var err error
 	var stdoutR, stderrR io.Reader
 	var stdinW io.Writer
@@ -67,18 +67,6 @@ func (u *User) CreateCommand(addEnv string, stdout, stderr io.Writer, stdin io.R
 	return cmd, stdoutR, stderrR, stdinW, err
 }
 
-func (u *User) CreateCommandPipeOutput(addEnv string, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
-	cmd := exec.Command(command, args...)
-
-	cmd.Env = append(cmd.Env, addEnv)
-	cmd.Dir = u.Dir
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.Uid), Gid: uint32(u.Gid)}
-
-	return u.CreateCommand(addEnv, nil, nil, nil, loginShell, command, args...)
-}
-
 /*
  *  Returns a boolean stating whether the user is correctly authenticated on this
  *  server. May return a UserNotFound error when the user does not exist.
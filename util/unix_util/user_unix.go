@@ -0,0 +1,57 @@
+//go:build unix
+
+package unix_util
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+func (u *User) CreateCommand(addEnv string, stdout, stderr io.Writer, stdin io.Reader, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(cmd.Env, addEnv)
+	cmd.Dir = u.Dir
+
+	if loginShell {
+		// from man bash: A  login shell is one whose first character of argument zero is a -, or
+		// 				  one started with the --login option.
+		// We chose to start it with a preprended "-"
+		cmd.Args[0] = fmt.Sprintf("-%s", filepath.Base(cmd.Args[0]))
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.Uid), Gid: uint32(u.Gid)}
+
+	return attachCommandIO(cmd, stdout, stderr, stdin)
+}
+
+func (u *User) CreateCommandPipeOutput(addEnv string, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
+	cmd := exec.Command(command, args...)
+
+	cmd.Env = append(cmd.Env, addEnv)
+	cmd.Dir = u.Dir
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.Uid), Gid: uint32(u.Gid)}
+
+	return u.CreateCommand(addEnv, nil, nil, nil, loginShell, command, args...)
+}
+
+// ShellCommandArgs returns the arguments making the shell of the user run command
+func (u *User) ShellCommandArgs(command string) []string {
+	return []string{"-c", command}
+}
+
+// Chroot makes cmd chroot(2) in chrootDirectory before dropping its privileges. The command
+// then starts in the home directory of the user if it exists in the chroot, or in its root otherwise.
+func (u *User) Chroot(cmd *exec.Cmd, chrootDirectory string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = chrootDirectory
+	cmd.Dir = u.ChrootWorkingDir(chrootDirectory)
+	return nil
+}
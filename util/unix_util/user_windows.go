@@ -0,0 +1,184 @@
+//go:build windows
+
+package unix_util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/francoismichel/ssh3/util"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	advapi32       = windows.NewLazySystemDLL("advapi32.dll")
+	procLogonUserW = advapi32.NewProc("LogonUserW")
+)
+
+// see the LogonUserW documentation
+const (
+	logon32LogonNetwork    = 3
+	logon32ProviderDefault = 0
+)
+
+func windowsShellPath() (string, error) {
+	systemDirectory, err := windows.GetSystemDirectory()
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(WindowsShell) {
+	case "cmd":
+		if comspec := os.Getenv("ComSpec"); comspec != "" {
+			return comspec, nil
+		}
+		return filepath.Join(systemDirectory, "cmd.exe"), nil
+	case "powershell":
+		return filepath.Join(systemDirectory, "WindowsPowerShell", "v1.0", "powershell.exe"), nil
+	default:
+		return WindowsShell, nil
+	}
+}
+
+// resolves the account through the security accounts manager (or the domain controller for a
+// DOMAIN\user username) and its profile directory
+func getUser(username string) (*User, error) {
+	sid, _, accountType, err := windows.LookupSID("", username)
+	if errors.Is(err, windows.ERROR_NONE_MAPPED) || (err == nil && accountType != windows.SidTypeUser) {
+		return nil, util.UserNotFound{Username: username}
+	} else if err != nil {
+		return nil, err
+	}
+	account, err := osuser.LookupId(sid.String())
+	if err != nil {
+		return nil, err
+	}
+	shell, err := windowsShellPath()
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		Username: username,
+		Dir:      account.HomeDir,
+		Shell:    shell,
+		Sid:      sid.String(),
+	}, nil
+}
+
+// the server cannot create a logon session for the user without their password, so commands
+// can only be run as the account running the server
+func (u *User) checkRunningAccount() error {
+	token, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return err
+	}
+	defer token.Close()
+	tokenUser, err := token.GetTokenUser()
+	if err != nil {
+		return err
+	}
+	if tokenUser.User.Sid.String() != u.Sid {
+		return fmt.Errorf("cannot run commands as %s: the server runs as another account and cannot impersonate users on Windows", u.Username)
+	}
+	return nil
+}
+
+// Environ returns the environment of the user, as created for a new logon session
+func (u *User) Environ() ([]string, error) {
+	token, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return nil, err
+	}
+	defer token.Close()
+	return token.Environ(false)
+}
+
+func isCmdShell(command string) bool {
+	return strings.EqualFold(filepath.Base(command), "cmd.exe") || strings.EqualFold(filepath.Base(command), "cmd")
+}
+
+func (u *User) CreateCommand(addEnv string, stdout, stderr io.Writer, stdin io.Reader, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
+	if err := u.checkRunningAccount(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(cmd.Env, addEnv)
+	cmd.Dir = u.Dir
+
+	if isCmdShell(command) && len(args) > 0 {
+		// cmd.exe does not follow the quoting rules of the other programs, so its arguments are
+		// passed as is
+		cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: syscall.EscapeArg(command) + " " + strings.Join(args, " ")}
+	}
+
+	return attachCommandIO(cmd, stdout, stderr, stdin)
+}
+
+func (u *User) CreateCommandPipeOutput(addEnv string, loginShell bool, command string, args ...string) (*exec.Cmd, io.Reader, io.Reader, io.Writer, error) {
+	return u.CreateCommand(addEnv, nil, nil, nil, loginShell, command, args...)
+}
+
+// ShellCommandArgs returns the arguments making the shell of the user run command
+func (u *User) ShellCommandArgs(command string) []string {
+	switch strings.ToLower(strings.TrimSuffix(filepath.Base(u.Shell), filepath.Ext(u.Shell))) {
+	case "powershell", "pwsh":
+		return []string{"-NoLogo", "-Command", command}
+	case "cmd":
+		return []string{"/c", command}
+	default:
+		return []string{"-c", command}
+	}
+}
+
+func (u *User) Chroot(cmd *exec.Cmd, chrootDirectory string) error {
+	return fmt.Errorf("chroot is not available on Windows")
+}
+
+/*
+ *  Returns a boolean stating whether the user is correctly authenticated on this
+ *  server. May return a UserNotFound error when the user does not exist.
+ */
+func userPasswordAuthentication(username, password string) (bool, error) {
+	if _, err := getUser(username); err != nil {
+		return false, err
+	}
+	// local accounts are in the "." domain
+	domain := "."
+	if before, after, found := strings.Cut(username, `\`); found {
+		domain, username = before, after
+	}
+	usernamePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return false, err
+	}
+	domainPtr, err := windows.UTF16PtrFromString(domain)
+	if err != nil {
+		return false, err
+	}
+	passwordPtr, err := windows.UTF16PtrFromString(password)
+	if err != nil {
+		return false, err
+	}
+	var token windows.Token
+	ret, _, err := procLogonUserW.Call(uintptr(unsafe.Pointer(usernamePtr)), uintptr(unsafe.Pointer(domainPtr)), uintptr(unsafe.Pointer(passwordPtr)),
+		logon32LogonNetwork, logon32ProviderDefault, uintptr(unsafe.Pointer(&token)))
+	if ret == 0 {
+		if errors.Is(err, windows.ERROR_LOGON_FAILURE) {
+			return false, nil
+		}
+		return false, err
+	}
+	token.Close()
+	return true, nil
+}
+
+func passwordAuthAvailable() bool {
+	return true
+}
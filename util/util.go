@@ -15,7 +15,6 @@ import (
 	"fmt"
 	"math/big"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -279,35 +278,29 @@ func GenerateCert(priv crypto.PrivateKey) (*x509.Certificate, error) {
 	return &cert, nil
 }
 
-func DumpCertAndKeyToFiles(cert *x509.Certificate, pubkey crypto.PublicKey, privkey crypto.PrivateKey, certPath, keyPath string) error {
+// EncodeCertAndKey returns the PEM encodings of the self-signed cert and of privkey
+func EncodeCertAndKey(cert *x509.Certificate, pubkey crypto.PublicKey, privkey crypto.PrivateKey) (certPEM []byte, keyPEM []byte, err error) {
 	certBytes, err := x509.CreateCertificate(rand.Reader, cert, cert, pubkey, privkey)
 	if err != nil {
-		return err
-	}
-	certFile, err := os.Create(certPath)
-	if err != nil {
-		return err
-	}
-	defer certFile.Close()
-	err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer keyFile.Close()
-
 	keyBytes, err := x509.MarshalPKCS8PrivateKey(privkey)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	err = pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// DumpCertAndKeyToFiles writes the self-signed cert and its private key, replacing both files or
+// none of them
+func DumpCertAndKeyToFiles(cert *x509.Certificate, pubkey crypto.PublicKey, privkey crypto.PrivateKey, certPath, keyPath string) error {
+	certPEM, keyPEM, err := EncodeCertAndKey(cert, pubkey, privkey)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return ReplaceFiles(
+		FileReplacement{Path: certPath, Data: certPEM, Perm: 0644},
+		FileReplacement{Path: keyPath, Data: keyPEM, Perm: 0600},
+	)
 }
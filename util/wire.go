@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"unsafe"
 )
 
 // taken from the QUIC draft
@@ -201,20 +202,46 @@ func VarIntLen(i uint64) uint64 {
 	}{"value doesn't fit into 62 bits: ", i})
 }
 
+// the strings up to this length are read in a buffer allocated up front, the longer ones are
+// only allocated as they are received
+const maxPreallocatedStringLength = 64 << 10
+
 func ParseSSHString(buf Reader) (string, error) {
+	return ParseSSHStringMaxLength(buf, Max)
+}
+
+// ParseSSHStringMaxLength parses an SSH string of at most maxLength bytes, it fails with
+// SSHStringTooLong without reading the content of longer strings
+func ParseSSHStringMaxLength(buf Reader, maxLength uint64) (string, error) {
 	length, err := ReadVarInt(buf)
 	if err != nil {
 		return "", InvalidSSHString{err}
 	}
-	out := make([]byte, length)
-	n, err := io.ReadFull(buf, out)
-	if n != int(length) {
-		return "", InvalidSSHString{fmt.Errorf("expected length %d, read length %d", length, n)}
-	}
+	if length > maxLength {
+		return "", SSHStringTooLong{Length: length, MaxLength: maxLength}
+	}
+	if length <= maxPreallocatedStringLength {
+		out := make([]byte, length)
+		n, err := io.ReadFull(buf, out)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", InvalidSSHString{fmt.Errorf("expected length %d, read length %d", length, n)}
+		} else if err != nil {
+			return "", err
+		}
+		// out is never modified, so the string can share its bytes instead of copying them
+		return unsafe.String(unsafe.SliceData(out), len(out)), nil
+	}
+	// the length is chosen by the peer, so only allocate the bytes that were actually received
+	var out bytes.Buffer
+	out.Grow(maxPreallocatedStringLength)
+	n, err := io.CopyN(&out, buf, int64(length))
 	if err != nil && err != io.EOF {
 		return "", err
 	}
-	return string(out[:n]), err
+	if n != int64(length) {
+		return "", InvalidSSHString{fmt.Errorf("expected length %d, read length %d", length, n)}
+	}
+	return out.String(), err
 }
 
 func WriteSSHString(out []byte, s string) (int, error) {